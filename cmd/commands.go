@@ -0,0 +1,1476 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/node"
+	"p2p-storage/internal/protocol"
+	"p2p-storage/internal/storage"
+)
+
+var (
+	// errQuit is returned by the quit command to end the session
+	errQuit = errors.New("quit")
+	// errUsage makes runCommand print the command's usage line
+	errUsage = errors.New("usage")
+)
+
+// command is a single interactive command shared by the REPL and the TUI
+type command struct {
+	name  string
+	usage string
+	help  string
+	run   func(n *node.Node, args []string, out io.Writer) error
+}
+
+// commands returns the interactive commands in the order they are listed
+func commands() []command {
+	return []command{
+		{"store", "store [--ns <namespace>] <file>", "Store a file (store migrate --to <dir> [--layout d/w] moves the store)", cmdStore},
+		{"import", "import [--ns <namespace>] <dir>", "Store every file under a directory, keeping relative paths", cmdImport},
+		{"get", "get [--restore-tree] <hash|name> [dest]", "Get a file by hash or name, or restore a file or directory manifest under dest", cmdGet},
+		{"list", "list", "List stored files", cmdList},
+		{"delete", "delete <hash>", "Delete a stored object, and on peers that honor this node's deletions", cmdDelete},
+		{"info", "info <hash>", "Show what is known about an object, including its popularity", cmdInfo},
+		{"stat", "stat <peer> <hash>", "Show what a peer knows of an object without downloading it", cmdStat},
+		{"search", "search [--depth n] <words...>", "Find objects by name on this node and on peers up to n hops away", cmdSearch},
+		{"pieces", "pieces <hash>", "Show which chunks of an object each peer can serve", cmdPieces},
+		{"swarm", "swarm <hash>", "Fetch an object's chunks from every peer holding them at once", cmdSwarm},
+		{"replicas", "replicas [--under] [hash]", "Show live replica counts against the replication target", cmdReplicas},
+		{"receipts", "receipts [hash]", "Show signed storage receipts returned by peers holding replicas", cmdReceipts},
+		{"audit", "audit [hash]", "Challenge replica holders to prove they still store objects", cmdAudit},
+		{"repair", "repair [--all | --hash <hash>]", "Copy under-replicated objects to more peers until they reach the target", cmdRepair},
+		{"decommission", "decommission", "Hand off this node's data to peers and exit once it can safely leave", cmdDecommission},
+		{"publish", "publish <label> <hash>", "Point a name under this node's identity at a stored hash", cmdPublish},
+		{"resolve", "resolve <name>", "Show the hash a name currently points at", cmdResolve},
+		{"names", "names", "List known name records", cmdNames},
+		{"feed", "feed [add <hash> | <fingerprint>]", "Append a stored hash to this node's feed, or list the entries of a feed", cmdFeed},
+		{"topic", "topic [sub <topic> | unsub <topic> | pub <topic> <text...>]", "Subscribe to, leave or publish to an application topic, or list those subscribed to", cmdTopic},
+		{"follow", "follow <fingerprint>", "Subscribe to a node's feed and fetch everything published to it", cmdFollow},
+		{"unfollow", "unfollow <fingerprint>", "Stop fetching new entries of a feed", cmdUnfollow},
+		{"feeds", "feeds", "List known feeds and the ones followed", cmdFeeds},
+		{"namespace", "namespace <name> [network|file|none]", "Show or set how a namespace's objects are encrypted", cmdNamespace},
+		{"namespaces", "namespaces", "List namespaces and their encryption modes", cmdNamespaces},
+		{"peers", "peers", "List peers with their software versions and protocol features", cmdPeers},
+		{"overlay", "overlay", "List peers known to the overlay and the neighbours chosen among them", cmdOverlay},
+		{"connect", "connect <addr|peer>", "Connect to a peer by address, or again to a known peer by node ID", cmdConnect},
+		{"relisten", "relisten", "Reopen the listeners, such as after one stopped accepting connections", cmdRelisten},
+		{"ping", "ping <peer>", "Measure the round trip to a connected peer", cmdPing},
+		{"punch", "punch <peer>", "Connect directly to a peer behind NAT, through a peer both are connected to", cmdPunch},
+		{"rtc", "rtc <peer>", "Connect to a peer over a WebRTC data channel, signaled through a peer both are connected to", cmdRTC},
+		{"ban", "ban <peer|addr> [dur] [reason]", "Block a peer by node ID, address or CIDR block, optionally for a duration", cmdBan},
+		{"unban", "unban <peer|addr>", "Lift a ban", cmdUnban},
+		{"bans", "bans", "List banned peers and addresses", cmdBans},
+		{"invite", "invite [uses] [ttl]", "Create an invite token admitting new nodes to this invite-only node (default 1 use, 24h)", cmdInvite},
+		{"invites", "invites", "List open invites", cmdInvites},
+		{"uninvite", "uninvite <id>", "Revoke an open invite", cmdUninvite},
+		{"traffic", "traffic", "Show bytes, messages, round trips and errors of each peer connection, busiest first", cmdTraffic},
+		{"tap", "tap on|off", "Log every message sent and received with its type, size, peer and trace ID", cmdTap},
+		{"ledger", "ledger", "Show bytes exchanged with each peer and their exchange ratios", cmdLedger},
+		{"scores", "scores", "Show peer scores and the misbehaviour behind them", cmdScores},
+		{"status", "status", "Show node status and transfer throughput", cmdStatus},
+		{"downloads", "downloads", "Show active transfers with progress and ETA", cmdDownloads},
+		{"stats", "stats [--json]", "Show store, network and transfer statistics", cmdStats},
+		{"scrub", "scrub [fraction]", "Verify stored files against their hashes", cmdScrub},
+		{"bench", "bench [--size 1M] [--count n] [--concurrency n] [--peer <id>] [--json]", "Measure encryption, store and transfer performance", cmdBench},
+		{"help", "help", "Show available commands", cmdHelp},
+		{"quit", "quit", "Exit the program", func(*node.Node, []string, io.Writer) error { return errQuit }},
+	}
+}
+
+// runCommand parses and executes a command line, writing its output to out.
+// It returns errQuit when the session should end.
+func runCommand(n *node.Node, line string, out io.Writer) error {
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return nil
+	}
+
+	for _, c := range commands() {
+		if c.name != parts[0] {
+			continue
+		}
+		err := c.run(n, parts[1:], out)
+		if errors.Is(err, errUsage) {
+			fmt.Fprintf(out, "Usage: %s\n", c.usage)
+			return nil
+		}
+		return err
+	}
+
+	fmt.Fprintln(out, "Unknown command")
+	return nil
+}
+
+func printHelp(out io.Writer) {
+	width := 0
+	for _, c := range commands() {
+		if len(c.usage) > width {
+			width = len(c.usage)
+		}
+	}
+	fmt.Fprintln(out, "Available commands:")
+	for _, c := range commands() {
+		fmt.Fprintf(out, "  %-*s - %s\n", width, c.usage, c.help)
+	}
+}
+
+func cmdHelp(_ *node.Node, _ []string, out io.Writer) error {
+	printHelp(out)
+	return nil
+}
+
+func cmdStore(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	if args[0] == "migrate" && len(args) > 1 {
+		return cmdStoreMigrate(n, args[1:], out)
+	}
+	namespace, args := namespaceArg(args)
+	if len(args) < 1 {
+		return errUsage
+	}
+	hash, err := n.StoreFileIn(namespace, args[0])
+	if err != nil {
+		fmt.Fprintf(out, "Failed to store file: %v\n", err)
+	} else {
+		fmt.Fprintf(out, "File stored with hash: %s\n", hash)
+	}
+	return nil
+}
+
+func cmdStoreMigrate(n *node.Node, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("store migrate", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	to := flags.String("to", "", "destination store directory")
+	layout := flags.String("layout", "", "path layout of the destination as depth/width")
+	if err := flags.Parse(args); err != nil || *to == "" {
+		fmt.Fprintln(out, "Usage: store migrate --to <dir> [--layout depth/width]")
+		return nil
+	}
+	target := *to
+
+	var opts []storage.Option
+	if *layout != "" {
+		l, err := storage.ParseLayout(*layout)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to migrate store: %v\n", err)
+			return nil
+		}
+		opts = append(opts, storage.WithLayout(l))
+	}
+
+	result, err := n.MigrateStore(target, func(done, total int) {
+		if done%100 == 0 || done == total {
+			fmt.Fprintf(out, "  %d/%d objects\n", done, total)
+		}
+	}, opts...)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to migrate store: %v\n", err)
+		return nil
+	}
+
+	fmt.Fprintf(out, "Migrated %d objects (%s), %d already done, %d failed\n",
+		result.Copied, formatBytes(result.Bytes), result.Resumed, result.Failed)
+	for _, e := range result.Errors {
+		fmt.Fprintf(out, "  error: %s\n", e)
+	}
+	if result.Complete {
+		dir, _ := storage.ParseBackend(target)
+		fmt.Fprintf(out, "Migration complete; restart with -store-dir %s to use the new store\n", dir)
+	} else {
+		fmt.Fprintln(out, "Migration incomplete; run the same command again to retry")
+	}
+	return nil
+}
+
+// namespaceArg strips a leading --ns <namespace> from args
+func namespaceArg(args []string) (string, []string) {
+	if len(args) >= 2 && (args[0] == "--ns" || args[0] == "-ns") {
+		return args[1], args[2:]
+	}
+	return "", args
+}
+
+func cmdImport(n *node.Node, args []string, out io.Writer) error {
+	namespace, args := namespaceArg(args)
+	if len(args) < 1 {
+		return errUsage
+	}
+	result, err := n.ImportIn(namespace, args[0])
+	if err != nil {
+		fmt.Fprintf(out, "Failed to import directory: %v\n", err)
+		if result == nil {
+			return nil
+		}
+	}
+	fmt.Fprintf(out, "Imported %d files (%s), %d unchanged, %d ignored, %d failed\n",
+		result.Imported, formatBytes(result.Bytes), result.Skipped, result.Ignored, result.Failed)
+	for _, e := range result.Errors {
+		fmt.Fprintf(out, "  error: %s\n", e)
+	}
+	if result.Base != "" {
+		if result.Manifest == result.Base {
+			fmt.Fprintln(out, "No changes since the previous import")
+		} else {
+			fmt.Fprintf(out, "Since the previous import: %d added, %d changed, %d removed\n",
+				result.Added, result.Changed, result.Removed)
+		}
+	}
+	if result.Manifest != "" {
+		fmt.Fprintf(out, "Manifest: %s\n", result.Manifest)
+	}
+	return nil
+}
+
+func cmdGet(n *node.Node, args []string, out io.Writer) error {
+	if len(args) > 0 && (args[0] == "--restore-tree" || args[0] == "-restore-tree") {
+		return cmdRestoreTree(n, args[1:], out)
+	}
+	if len(args) < 1 {
+		return errUsage
+	}
+	hash := resolveTarget(n, args[0])
+	reader, key, err := n.GetFile(hash)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to get file: %v\n", err)
+		return nil
+	}
+	defer reader.Close()
+
+	// Create downloads directory
+	os.MkdirAll(n.DownloadDir(), 0755)
+	outPath := filepath.Join(n.DownloadDir(), hash)
+
+	// Create temporary file for decrypted content
+	tempFile, err := os.CreateTemp(n.DownloadDir(), "decrypted-*")
+	if err != nil {
+		fmt.Fprintf(out, "Failed to create temporary file: %v\n", err)
+		return nil
+	}
+	tempPath := tempFile.Name()
+	defer tempFile.Close()
+
+	// Decrypt using the appropriate key; plaintext objects have none
+	if key == nil {
+		_, err = io.Copy(tempFile, reader)
+	} else {
+		err = crypto.DecryptStream(key, reader, tempFile)
+	}
+	if err != nil {
+		fmt.Fprintf(out, "Failed to decrypt file: %v\n", err)
+		os.Remove(tempPath)
+		return nil
+	}
+
+	// Close temp file before renaming
+	tempFile.Close()
+
+	// Move the decrypted file to final location
+	if err := os.Rename(tempPath, outPath); err != nil {
+		fmt.Fprintf(out, "Failed to move decrypted file: %v\n", err)
+		os.Remove(tempPath)
+		return nil
+	}
+
+	fmt.Fprintf(out, "File decrypted and saved to: %s\n", outPath)
+	return nil
+}
+
+func cmdRestoreTree(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	hash, dest := resolveTarget(n, args[0]), args[1]
+	result, err := n.Restore(hash, dest)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to restore: %v\n", err)
+		return nil
+	}
+	if result.Incremental {
+		fmt.Fprintf(out, "Synced %d changed files (%s) and removed %d in %s", result.Files, formatBytes(result.Bytes), result.Removed, dest)
+	} else {
+		fmt.Fprintf(out, "Restored %d files (%s) to %s", result.Files, formatBytes(result.Bytes), dest)
+	}
+	if result.Skipped > 0 {
+		fmt.Fprintf(out, ", %d changed locally left alone", result.Skipped)
+	}
+	if result.Failed > 0 {
+		fmt.Fprintf(out, ", %d failed", result.Failed)
+	}
+	fmt.Fprintln(out)
+	for _, e := range result.Errors {
+		fmt.Fprintf(out, "  error: %s\n", e)
+	}
+	return nil
+}
+
+// resolveTarget turns a known name into the hash it points at; anything
+// else is taken to be a hash
+func resolveTarget(n *node.Node, arg string) string {
+	if record, err := n.Resolve(arg); err == nil {
+		return record.Hash
+	}
+	return arg
+}
+
+func cmdDelete(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	tombstone, err := n.Delete(args[0])
+	if err != nil {
+		fmt.Fprintf(out, "Failed to delete: %v\n", err)
+		return nil
+	}
+	fmt.Fprintf(out, "Deleted %s; peers honoring deletions by %s will delete it too\n", tombstone.Hash, tombstone.Signer())
+	return nil
+}
+
+func cmdPublish(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	record, err := n.Publish(args[0], args[1])
+	if err != nil {
+		fmt.Fprintf(out, "Failed to publish: %v\n", err)
+		return nil
+	}
+	fmt.Fprintf(out, "Published %s -> %s (version %d)\n", record.Name(), record.Hash, record.Sequence)
+	return nil
+}
+
+func cmdResolve(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	record, err := n.Resolve(args[0])
+	if err != nil {
+		fmt.Fprintf(out, "Failed to resolve: %v\n", err)
+		return nil
+	}
+	printNameRecord(out, record)
+	return nil
+}
+
+func cmdNames(n *node.Node, _ []string, out io.Writer) error {
+	records := n.Names()
+	if len(records) == 0 {
+		fmt.Fprintln(out, "No names")
+		return nil
+	}
+	for _, record := range records {
+		printNameRecord(out, record)
+	}
+	return nil
+}
+
+func printNameRecord(out io.Writer, record node.NameRecord) {
+	fmt.Fprintf(out, "  %s -> %s  version %d  published %s\n",
+		record.Name(), record.Hash, record.Sequence, record.Published.Format(time.RFC3339))
+}
+
+func cmdFeed(n *node.Node, args []string, out io.Writer) error {
+	if len(args) > 0 && args[0] == "add" {
+		if len(args) < 2 {
+			return errUsage
+		}
+		entry, err := n.PublishToFeed(args[1])
+		if err != nil {
+			fmt.Fprintf(out, "Failed to publish: %v\n", err)
+			return nil
+		}
+		fmt.Fprintf(out, "Published %s as entry %d of feed %s\n", entry.Hash, entry.Sequence, entry.Feed())
+		return nil
+	}
+
+	feed := ""
+	if len(args) > 0 {
+		feed = args[0]
+	}
+	entries := n.Feed(feed)
+	if len(entries) == 0 {
+		fmt.Fprintln(out, "No entries")
+		return nil
+	}
+	for _, e := range entries {
+		fmt.Fprintf(out, "  %4d  %s  published %s\n", e.Sequence, e.Hash, e.Published.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// topicSubscriptions holds the cancel functions of the topics subscribed
+// to with the topic command
+var topicSubscriptions = struct {
+	sync.Mutex
+	cancel map[string]func()
+}{cancel: make(map[string]func())}
+
+func cmdTopic(n *node.Node, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		topics := n.Topics()
+		if len(topics) == 0 {
+			fmt.Fprintln(out, "No topics subscribed to")
+			return nil
+		}
+		for _, topic := range topics {
+			fmt.Fprintf(out, "  %s\n", topic)
+		}
+		return nil
+	}
+	if len(args) < 2 {
+		return errUsage
+	}
+	topic := args[1]
+
+	topicSubscriptions.Lock()
+	defer topicSubscriptions.Unlock()
+	switch args[0] {
+	case "sub":
+		if topicSubscriptions.cancel[topic] != nil {
+			fmt.Fprintf(out, "Already subscribed to %s\n", topic)
+			return nil
+		}
+		messages, cancel, err := n.SubscribeTopic(topic)
+		if err != nil {
+			fmt.Fprintf(out, "Failed to subscribe: %v\n", err)
+			return nil
+		}
+		topicSubscriptions.cancel[topic] = cancel
+		go func() {
+			for m := range messages {
+				fmt.Fprintf(out, "[%s] %s: %s\n", m.Topic, m.Origin, m.Data)
+			}
+		}()
+		fmt.Fprintf(out, "Subscribed to %s\n", topic)
+	case "unsub":
+		cancel := topicSubscriptions.cancel[topic]
+		if cancel == nil {
+			fmt.Fprintf(out, "Not subscribed to %s\n", topic)
+			return nil
+		}
+		cancel()
+		delete(topicSubscriptions.cancel, topic)
+		fmt.Fprintf(out, "Unsubscribed from %s\n", topic)
+	case "pub":
+		if len(args) < 3 {
+			return errUsage
+		}
+		if err := n.PublishTopic(topic, []byte(strings.Join(args[2:], " "))); err != nil {
+			fmt.Fprintf(out, "Failed to publish: %v\n", err)
+		}
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func cmdFollow(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	if err := n.Follow(args[0]); err != nil {
+		fmt.Fprintf(out, "Failed to follow: %v\n", err)
+		return nil
+	}
+	fmt.Fprintf(out, "Following %s\n", args[0])
+	return nil
+}
+
+func cmdUnfollow(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	if err := n.Unfollow(args[0]); err != nil {
+		fmt.Fprintf(out, "Failed to unfollow: %v\n", err)
+		return nil
+	}
+	fmt.Fprintf(out, "No longer following %s\n", args[0])
+	return nil
+}
+
+func cmdFeeds(n *node.Node, _ []string, out io.Writer) error {
+	feeds := n.Feeds()
+	if len(feeds) == 0 {
+		fmt.Fprintln(out, "No feeds")
+		return nil
+	}
+	for _, f := range feeds {
+		following := ""
+		if f.Following {
+			following = "  following"
+		}
+		if f.Entries == 0 {
+			fmt.Fprintf(out, "  %s  no entries yet%s\n", f.Feed, following)
+			continue
+		}
+		fmt.Fprintf(out, "  %s  %d entries, latest %s%s\n", f.Feed, f.Entries, f.Latest.Published.Format(time.RFC3339), following)
+	}
+	return nil
+}
+
+func cmdList(n *node.Node, _ []string, out io.Writer) error {
+	files, err := n.List()
+	if err != nil {
+		fmt.Fprintf(out, "Failed to list files: %v\n", err)
+		return nil
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(out, "No files stored")
+		return nil
+	}
+	fmt.Fprintln(out, "Stored files:")
+	for _, hash := range files {
+		fmt.Fprintf(out, "  %s\n", hash)
+	}
+	return nil
+}
+
+func cmdInfo(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	info := n.Info(args[0])
+
+	fmt.Fprintf(out, "Hash:       %s\n", info.Hash)
+	if info.Stored {
+		fmt.Fprintf(out, "Stored:     yes (%s)\n", formatBytes(info.StoredSize))
+	} else {
+		fmt.Fprintln(out, "Stored:     no")
+	}
+	if meta := info.Meta; meta != nil {
+		name := meta.Name
+		if meta.Path != "" {
+			name = meta.Path
+		}
+		fmt.Fprintf(out, "Name:       %s\n", name)
+		fmt.Fprintf(out, "Size:       %s\n", formatBytes(meta.Size))
+		if meta.Manifest {
+			fmt.Fprintln(out, "Kind:       directory manifest")
+		}
+		if meta.Link != "" {
+			fmt.Fprintf(out, "Link:       %s\n", meta.Link)
+		}
+	}
+	p := info.Popularity
+	fmt.Fprintf(out, "Accesses:   %d local, %d remote (score %.2f)\n", p.LocalReads, p.RemoteRequests, p.Score)
+	if !p.LastAccess.IsZero() {
+		fmt.Fprintf(out, "Last used:  %s\n", p.LastAccess.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func cmdStat(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), node.DefaultFetchTimeout)
+	defer cancel()
+	stat, err := n.Stat(ctx, args[0], args[1])
+	if err != nil {
+		fmt.Fprintf(out, "Failed to stat: %v\n", err)
+		return nil
+	}
+
+	fmt.Fprintf(out, "Hash:       %s\n", stat.Hash)
+	if stat.Stored {
+		fmt.Fprintf(out, "Stored:     yes (%s)\n", formatBytes(stat.StoredSize))
+	} else {
+		fmt.Fprintln(out, "Stored:     no")
+	}
+	if stat.Encryption != "" {
+		name := stat.Name
+		if stat.Path != "" {
+			name = stat.Path
+		}
+		fmt.Fprintf(out, "Name:       %s\n", name)
+		fmt.Fprintf(out, "Size:       %s\n", formatBytes(stat.Size))
+		fmt.Fprintf(out, "Encryption: %s\n", stat.Encryption)
+		if stat.Manifest {
+			fmt.Fprintln(out, "Kind:       directory manifest")
+		}
+	}
+	fmt.Fprintf(out, "Replicas:   %d\n", stat.Replicas)
+	return nil
+}
+
+func cmdSearch(n *node.Node, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	depth := flags.Int("depth", node.DefaultSearchDepth, "hops the search reaches")
+	if err := flags.Parse(args); err != nil || flags.NArg() == 0 {
+		return errUsage
+	}
+
+	hits, err := n.Search(context.Background(), strings.Join(flags.Args(), " "), *depth)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to search: %v\n", err)
+		return nil
+	}
+	if len(hits) == 0 {
+		fmt.Fprintln(out, "No matches")
+		return nil
+	}
+	for _, hit := range hits {
+		name := hit.Name
+		if hit.Path != "" {
+			name = hit.Path
+		}
+		fmt.Fprintf(out, "%s  %s  %s\n", hit.Hash, formatBytes(hit.Size), name)
+		fmt.Fprintf(out, "  held by %s\n", strings.Join(hit.Holders, ", "))
+	}
+	return nil
+}
+
+func cmdPieces(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), node.DefaultFetchTimeout)
+	defer cancel()
+	pieces := n.Pieces(ctx, args[0])
+	if len(pieces) == 0 {
+		fmt.Fprintln(out, "No peer holds chunks of it")
+		return nil
+	}
+	for _, p := range pieces {
+		fmt.Fprintf(out, "  %-20s %d/%d chunks of %s\n", p.PeerID, p.Held, p.Chunks, formatBytes(p.Size))
+	}
+	return nil
+}
+
+func cmdSwarm(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	if err := n.FetchSwarm(context.Background(), args[0]); err != nil {
+		fmt.Fprintf(out, "Failed to fetch: %v\n", err)
+		return nil
+	}
+	fmt.Fprintf(out, "Stored %s\n", args[0])
+	return nil
+}
+
+func cmdReplicas(n *node.Node, args []string, out io.Writer) error {
+	underOnly := len(args) > 0 && args[0] == "--under"
+	if underOnly {
+		args = args[1:]
+	}
+
+	if len(args) > 0 {
+		printReplicaStatus(out, n.Replicas(args[0]))
+		return nil
+	}
+
+	report, err := n.ReplicationReport()
+	if err != nil {
+		fmt.Fprintf(out, "Failed to collect replica counts: %v\n", err)
+		return nil
+	}
+	shown := 0
+	for _, status := range report {
+		if underOnly && !status.UnderReplicated() {
+			continue
+		}
+		printReplicaStatus(out, status)
+		shown++
+	}
+	if shown == 0 {
+		fmt.Fprintln(out, "No objects to report")
+	}
+	return nil
+}
+
+func printReplicaStatus(out io.Writer, status node.ReplicaStatus) {
+	note := ""
+	if status.UnderReplicated() {
+		note = "  under-replicated"
+	}
+	local := "remote"
+	if status.Local {
+		local = "local"
+	}
+	fmt.Fprintf(out, "  %s  %d/%d  %-6s%s\n", status.Hash, status.Replicas, status.Target, local, note)
+	if len(status.Holders) > 0 {
+		fmt.Fprintf(out, "      held by %s\n", strings.Join(status.Holders, ", "))
+	}
+}
+
+func cmdReceipts(n *node.Node, args []string, out io.Writer) error {
+	hash := ""
+	if len(args) > 0 {
+		hash = args[0]
+	}
+	receipts := n.Receipts(hash)
+	if len(receipts) == 0 {
+		fmt.Fprintln(out, "No receipts")
+		return nil
+	}
+	for _, r := range receipts {
+		note := ""
+		if !r.Verify() {
+			note = "  INVALID SIGNATURE"
+		}
+		fmt.Fprintf(out, "  %s  %-12s %s  %d bytes  stored %s%s\n", r.Hash, r.NodeID, r.Fingerprint(), r.Size, r.Stored.Format(time.RFC3339), note)
+	}
+	return nil
+}
+
+func cmdAudit(n *node.Node, args []string, out io.Writer) error {
+	hash := ""
+	if len(args) > 0 {
+		hash = args[0]
+	}
+	results, err := n.Audit(hash)
+	if err != nil {
+		fmt.Fprintf(out, "Audit failed: %v\n", err)
+		return nil
+	}
+	if len(results) == 0 {
+		fmt.Fprintln(out, "No connected holders to audit")
+		return nil
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Passed {
+			fmt.Fprintf(out, "  %s  %-12s passed\n", r.Hash, r.PeerID)
+			continue
+		}
+		failed++
+		fmt.Fprintf(out, "  %s  %-12s FAILED: %s\n", r.Hash, r.PeerID, r.Error)
+	}
+	fmt.Fprintf(out, "Audited %d holders, %d failed\n", len(results), failed)
+	return nil
+}
+
+func cmdRepair(n *node.Node, args []string, out io.Writer) error {
+	var hashes []string
+	switch {
+	case len(args) == 0 || len(args) == 1 && args[0] == "--all":
+	case len(args) == 2 && args[0] == "--hash":
+		hashes = args[1:]
+	default:
+		return errUsage
+	}
+
+	result, err := n.Repair(hashes, func(status node.ReplicaStatus) {
+		printReplicaStatus(out, status)
+	})
+	if err != nil {
+		fmt.Fprintf(out, "Repair failed: %v\n", err)
+		return nil
+	}
+	if result.Checked == 0 {
+		fmt.Fprintln(out, "Nothing to repair")
+		return nil
+	}
+	fmt.Fprintf(out, "Repaired %d of %d objects, %d new replicas, %d failed, %d not held locally\n",
+		result.Repaired, result.Checked, result.Copies, result.Failed, result.Skipped)
+	for _, e := range result.Errors {
+		fmt.Fprintf(out, "  %s\n", e)
+	}
+	return nil
+}
+
+func cmdDecommission(n *node.Node, _ []string, out io.Writer) error {
+	fmt.Fprintln(out, "Draining: no new content will be accepted")
+	result, err := n.Decommission(func(status node.ReplicaStatus) {
+		printReplicaStatus(out, status)
+	})
+	if err != nil {
+		fmt.Fprintf(out, "Decommission failed: %v\n", err)
+		return nil
+	}
+
+	fmt.Fprintf(out, "%d objects, %d new replicas created on peers\n", result.Objects, result.Copies)
+	for _, e := range result.Errors {
+		fmt.Fprintf(out, "  %s\n", e)
+	}
+	if len(result.UnderTarget) > 0 {
+		fmt.Fprintf(out, "Warning: %d objects will be below the replication target after leaving\n", len(result.UnderTarget))
+	}
+	if !result.Safe {
+		fmt.Fprintf(out, "Not safe to leave: %d objects exist only on this node\n", len(result.SoleCopies))
+		for _, hash := range result.SoleCopies {
+			fmt.Fprintf(out, "  %s\n", hash)
+		}
+		fmt.Fprintln(out, "Connect more peers and run decommission again")
+		return nil
+	}
+	fmt.Fprintln(out, "Departure announced; the node can be removed")
+	return errQuit
+}
+
+func cmdNamespace(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	if len(args) == 1 {
+		fmt.Fprintf(out, "%s: %s\n", args[0], n.NamespaceMode(args[0]))
+		return nil
+	}
+	mode, err := node.ParseEncryptionMode(args[1])
+	if err != nil {
+		fmt.Fprintf(out, "Failed to set namespace mode: %v\n", err)
+		return nil
+	}
+	if err := n.SetNamespaceMode(args[0], mode); err != nil {
+		fmt.Fprintf(out, "Failed to set namespace mode: %v\n", err)
+		return nil
+	}
+	fmt.Fprintf(out, "Namespace %s now uses encryption mode %s\n", args[0], mode)
+	return nil
+}
+
+func cmdNamespaces(n *node.Node, _ []string, out io.Writer) error {
+	list := n.Namespaces()
+	if len(list) == 0 {
+		fmt.Fprintln(out, "No namespace policies; everything uses the network key")
+		return nil
+	}
+	for _, ns := range list {
+		fmt.Fprintf(out, "  %-20s %s\n", ns.Name, ns.Mode)
+	}
+	return nil
+}
+
+// capabilityList describes a peer's capabilities, leaving out the chunk
+// size when it is the default
+func capabilityList(caps protocol.Capabilities) []string {
+	var list []string
+	if caps.StorageOnly {
+		list = append(list, "storage-only")
+	}
+	if caps.Relay {
+		list = append(list, "relay")
+	}
+	list = append(list, caps.Compression...)
+	if caps.MaxChunkSize != protocol.DefaultChunkSize {
+		list = append(list, fmt.Sprintf("%d-byte chunks", caps.MaxChunkSize))
+	}
+	return list
+}
+
+func cmdPeers(n *node.Node, _ []string, out io.Writer) error {
+	peers := n.Peers()
+	if len(peers) == 0 {
+		fmt.Fprintln(out, "No peers")
+		return nil
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	for _, p := range peers {
+		agent := p.UserAgent
+		if agent == "" {
+			agent = "unknown (predates version reporting)"
+		}
+		fmt.Fprintf(out, "  %-16s %-22s %s", p.ID, p.Address, agent)
+		if p.RTT > 0 {
+			fmt.Fprintf(out, "  rtt %v (average %v)", p.RTT.Round(time.Microsecond), p.SmoothedRTT.Round(time.Microsecond))
+		}
+		if p.Keyless {
+			fmt.Fprint(out, "  public mirror")
+		}
+		fmt.Fprintln(out)
+		if len(p.Addresses) > 1 {
+			fmt.Fprintf(out, "  %-16s addresses: %s\n", "", strings.Join(p.Addresses, ", "))
+		}
+		if len(p.Features) > 0 {
+			fmt.Fprintf(out, "  %-16s features: %s\n", "", strings.Join(p.Features, ", "))
+		}
+		if caps := capabilityList(p.Capabilities); len(caps) > 0 {
+			fmt.Fprintf(out, "  %-16s capabilities: %s\n", "", strings.Join(caps, ", "))
+		}
+	}
+	return nil
+}
+
+func cmdOverlay(n *node.Node, _ []string, out io.Writer) error {
+	peers := n.Overlay()
+	if len(peers) == 0 {
+		fmt.Fprintln(out, "No peers known to the overlay")
+		return nil
+	}
+	for _, p := range peers {
+		kind := p.Kind
+		if kind == "" {
+			kind = "-"
+		}
+		identity := p.Identity
+		if identity == "" {
+			identity = "unconfirmed"
+		}
+		state := "not connected"
+		if p.Connected {
+			state = "connected"
+		}
+		fmt.Fprintf(out, "  %-16s %-16s %-8s %-14s %s\n", p.ID, identity, kind, state, strings.Join(p.Addresses, ", "))
+	}
+	return nil
+}
+
+func cmdConnect(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	addr := args[0]
+	connect := n.Connect
+	for _, p := range n.Peers() {
+		if p.ID == addr {
+			connect = n.ConnectKnown
+		}
+	}
+	if err := connect(context.Background(), addr); err != nil {
+		fmt.Fprintf(out, "Failed to connect: %v\n", err)
+	} else {
+		fmt.Fprintf(out, "Connected to %s\n", addr)
+	}
+	return nil
+}
+
+func cmdPing(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	rtt, err := n.Ping(ctx, args[0])
+	if err != nil {
+		fmt.Fprintf(out, "Failed to ping %s: %v\n", args[0], err)
+		return nil
+	}
+	fmt.Fprintf(out, "Reply from %s: rtt %v, average %v\n", args[0], rtt.Round(time.Microsecond), n.RTT(args[0]).Round(time.Microsecond))
+	return nil
+}
+
+func cmdPunch(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	if err := n.Punch(args[0]); err != nil {
+		fmt.Fprintf(out, "Failed to punch: %v\n", err)
+	} else {
+		fmt.Fprintf(out, "Punching through to %s from %s\n", args[0], n.ExternalAddress())
+	}
+	return nil
+}
+
+func cmdRTC(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	if err := n.ConnectWebRTC(context.Background(), args[0]); err != nil {
+		fmt.Fprintf(out, "Failed to connect over WebRTC: %v\n", err)
+	} else {
+		fmt.Fprintf(out, "Connected to %s over WebRTC\n", args[0])
+	}
+	return nil
+}
+
+func cmdBan(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	target, rest := args[0], args[1:]
+
+	var duration time.Duration
+	if len(rest) > 0 {
+		if d, err := time.ParseDuration(rest[0]); err == nil {
+			duration = d
+			rest = rest[1:]
+		}
+	}
+
+	entry, err := n.Ban(target, strings.Join(rest, " "), duration)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to ban: %v\n", err)
+		return nil
+	}
+	fmt.Fprintf(out, "Banned %s %s", entry.Kind, entry.Target)
+	if !entry.Permanent() {
+		fmt.Fprintf(out, " until %s", entry.Expires.Format(time.RFC3339))
+	}
+	fmt.Fprintln(out)
+	return nil
+}
+
+func cmdUnban(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	found, err := n.Unban(args[0])
+	switch {
+	case err != nil:
+		fmt.Fprintf(out, "Failed to unban: %v\n", err)
+	case !found:
+		fmt.Fprintf(out, "%s is not banned\n", args[0])
+	default:
+		fmt.Fprintf(out, "Unbanned %s\n", args[0])
+	}
+	return nil
+}
+
+func cmdBans(n *node.Node, _ []string, out io.Writer) error {
+	bans := n.Bans()
+	if len(bans) == 0 {
+		fmt.Fprintln(out, "No bans")
+		return nil
+	}
+	for _, b := range bans {
+		expires := "never"
+		if !b.Permanent() {
+			expires = b.Expires.Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "  %-7s %-24s expires %s", b.Kind, b.Target, expires)
+		if b.Reason != "" {
+			fmt.Fprintf(out, "  (%s)", b.Reason)
+		}
+		fmt.Fprintln(out)
+	}
+	return nil
+}
+
+func cmdInvite(n *node.Node, args []string, out io.Writer) error {
+	uses, ttl := 1, 24*time.Hour
+	for _, arg := range args {
+		if d, err := time.ParseDuration(arg); err == nil {
+			ttl = d
+		} else if u, err := strconv.Atoi(arg); err == nil {
+			uses = u
+		} else {
+			return errUsage
+		}
+	}
+
+	token, invite, err := n.CreateInvite(uses, ttl)
+	if err != nil {
+		fmt.Fprintf(out, "Failed to create invite: %v\n", err)
+		return nil
+	}
+	fmt.Fprintf(out, "Invite %s: %s\n", invite.ID, token)
+	fmt.Fprintf(out, "Join with -invite %s; the token is not shown again\n", token)
+	if !n.InviteOnly() {
+		fmt.Fprintln(out, "This node admits any peer; start it with -invite-only to require invites")
+	}
+	return nil
+}
+
+func cmdInvites(n *node.Node, _ []string, out io.Writer) error {
+	invites := n.Invites()
+	if len(invites) == 0 {
+		fmt.Fprintln(out, "No open invites")
+		return nil
+	}
+	for _, i := range invites {
+		uses := "unlimited uses"
+		if i.Uses > 0 {
+			uses = fmt.Sprintf("%d uses left", i.Uses)
+		}
+		expires := "never"
+		if !i.Expires.IsZero() {
+			expires = i.Expires.Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "  %s  %-16s expires %s\n", i.ID, uses, expires)
+	}
+	return nil
+}
+
+func cmdUninvite(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	found, err := n.RevokeInvite(args[0])
+	switch {
+	case err != nil:
+		fmt.Fprintf(out, "Failed to revoke invite: %v\n", err)
+	case !found:
+		fmt.Fprintf(out, "No open invite %s\n", args[0])
+	default:
+		fmt.Fprintf(out, "Revoked invite %s\n", args[0])
+	}
+	return nil
+}
+
+func cmdRelisten(n *node.Node, _ []string, out io.Writer) error {
+	if err := n.RestartListeners(); err != nil {
+		fmt.Fprintf(out, "Failed to reopen listeners: %v\n", err)
+	} else {
+		fmt.Fprintln(out, "Listeners reopened")
+	}
+	return nil
+}
+
+func cmdTap(n *node.Node, args []string, out io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	switch args[0] {
+	case "on":
+		// Logged with the node's other output rather than to this session
+		n.SetTap(network.LogTap(os.Stdout))
+		fmt.Fprintln(out, "Logging every message")
+	case "off":
+		n.SetTap(nil)
+		fmt.Fprintln(out, "Stopped logging messages")
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func cmdTraffic(n *node.Node, _ []string, out io.Writer) error {
+	stats := n.NetworkStats()
+	if len(stats) == 0 {
+		fmt.Fprintln(out, "No peers")
+		return nil
+	}
+	for _, s := range stats {
+		fmt.Fprintf(out, "  %-24s sent %10s  received %10s  messages %6d/%-6d errors %d/%d",
+			s.ID, formatBytes(s.BytesSent), formatBytes(s.BytesReceived),
+			countTotal(s.MessagesSent), countTotal(s.MessagesReceived), s.SendErrors, s.HandleErrors)
+		if s.RTT > 0 {
+			fmt.Fprintf(out, "  rtt %v", s.RTT.Round(time.Microsecond))
+		}
+		fmt.Fprintln(out)
+		if busiest := busiestTypes(s.MessagesSent, s.MessagesReceived, 3); len(busiest) > 0 {
+			fmt.Fprintf(out, "  %-24s most messages: %s\n", "", strings.Join(busiest, ", "))
+		}
+	}
+	return nil
+}
+
+func countTotal(counts map[protocol.MessageType]int64) int64 {
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+	return total
+}
+
+// busiestTypes lists the limit message types exchanged most, both ways
+func busiestTypes(sent, received map[protocol.MessageType]int64, limit int) []string {
+	totals := make(map[protocol.MessageType]int64, len(sent))
+	for msgType, count := range sent {
+		totals[msgType] += count
+	}
+	for msgType, count := range received {
+		totals[msgType] += count
+	}
+	types := make([]protocol.MessageType, 0, len(totals))
+	for msgType := range totals {
+		types = append(types, msgType)
+	}
+	sort.Slice(types, func(i, j int) bool {
+		if totals[types[i]] != totals[types[j]] {
+			return totals[types[i]] > totals[types[j]]
+		}
+		return types[i] < types[j]
+	})
+	list := make([]string, 0, limit)
+	for _, msgType := range types[:min(limit, len(types))] {
+		list = append(list, fmt.Sprintf("%s %d", msgType, totals[msgType]))
+	}
+	return list
+}
+
+func cmdLedger(n *node.Node, _ []string, out io.Writer) error {
+	entries := n.Ledger()
+	if len(entries) == 0 {
+		fmt.Fprintln(out, "No traffic recorded")
+		return nil
+	}
+	for _, e := range entries {
+		ratio := "-"
+		if e.Sent > 0 {
+			ratio = fmt.Sprintf("%.2f", e.Ratio())
+		}
+		fmt.Fprintf(out, "  %-24s sent %10s  received %10s  ratio %6s  last seen %s\n",
+			e.PeerID, formatBytes(e.Sent), formatBytes(e.Received), ratio, e.LastSeen.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func cmdScores(n *node.Node, _ []string, out io.Writer) error {
+	scores := n.PeerScores()
+	if len(scores) == 0 {
+		fmt.Fprintln(out, "No peers scored")
+		return nil
+	}
+	for _, s := range scores {
+		fmt.Fprintf(out, "  %-24s score %7.1f  invalid %4d  failed %4d  mismatched %4d  completed %6d",
+			s.PeerID, s.Score, s.InvalidMessages, s.FailedTransfers, s.HashMismatches, s.CompletedTransfers)
+		if s.Derated {
+			fmt.Fprint(out, "  (derated)")
+		}
+		fmt.Fprintln(out)
+	}
+	return nil
+}
+
+func cmdStatus(n *node.Node, _ []string, out io.Writer) error {
+	files, err := n.List()
+	if err != nil {
+		fmt.Fprintf(out, "Failed to list files: %v\n", err)
+	}
+
+	fmt.Fprintf(out, "Node:      %s\n", n.ID)
+	fmt.Fprintf(out, "Address:   %s\n", strings.Join(n.Addresses(), ", "))
+	if advertised := n.AdvertisedAddress(); advertised != n.Address() {
+		fmt.Fprintf(out, "External:  %s\n", advertised)
+	}
+	fmt.Fprintf(out, "Identity:  %s\n", n.Identity())
+	if id := n.NetworkID(); id != "" {
+		fmt.Fprintf(out, "Network:   %s\n", id)
+	}
+	fmt.Fprintf(out, "Version:   %s\n", protocol.UserAgent())
+	if n.PublicMirror() {
+		fmt.Fprintln(out, "Mode:      public mirror (no network key)")
+	}
+	fmt.Fprintf(out, "Peers:     %d\n", len(n.Peers()))
+	fmt.Fprintf(out, "Bootstrap: %s\n", formatBootstrap(n.BootstrapStatus()))
+	fmt.Fprintf(out, "Stored:    %d files\n", len(files))
+	fmt.Fprintf(out, "Transfers: %d active\n", len(n.Transfers()))
+
+	printPeerThroughput(out, n.PeerThroughput())
+	return nil
+}
+
+// formatBootstrap describes how joining the network is going
+func formatBootstrap(status node.BootstrapStatus) string {
+	switch {
+	case status.Complete && status.Peer == "":
+		return "complete"
+	case status.Complete:
+		return "complete through " + status.Peer
+	case status.GaveUp:
+		return fmt.Sprintf("gave up after %d attempts: %s", status.Attempts, status.LastError)
+	case status.Attempts == 0:
+		return "pending"
+	default:
+		return fmt.Sprintf("retrying after %d attempts: %s", status.Attempts, status.LastError)
+	}
+}
+
+func cmdDownloads(n *node.Node, _ []string, out io.Writer) error {
+	transfers := n.Transfers()
+	if len(transfers) == 0 {
+		fmt.Fprintln(out, "No active transfers")
+		return nil
+	}
+
+	for _, t := range transfers {
+		eta := "unknown"
+		if t.ETA > 0 {
+			eta = t.ETA.Round(time.Second).String()
+		}
+		fmt.Fprintf(out, "  %-8s %s  peer %s\n", t.Direction, t.ContentHash, t.PeerID)
+		fmt.Fprintf(out, "           %s at %s/s, ETA %s\n", formatProgress(t), formatBytes(int64(t.Rate)), eta)
+	}
+	return nil
+}
+
+func cmdStats(n *node.Node, args []string, out io.Writer) error {
+	stats, err := n.Stats()
+	if err != nil {
+		fmt.Fprintf(out, "Failed to collect stats: %v\n", err)
+		return nil
+	}
+
+	if len(args) > 0 && (args[0] == "--json" || args[0] == "-json") {
+		encoded, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			fmt.Fprintf(out, "Failed to encode stats: %v\n", err)
+			return nil
+		}
+		fmt.Fprintln(out, string(encoded))
+		return nil
+	}
+
+	fmt.Fprintln(out, "Store:")
+	fmt.Fprintf(out, "  files:    %d\n", stats.Store.Files)
+	fmt.Fprintf(out, "  size:     %s\n", formatBytes(stats.Store.Bytes))
+	if stats.Cache.Capacity > 0 {
+		fmt.Fprintf(out, "  cache:    %s / %s, %d hits, %d misses\n",
+			formatBytes(stats.Cache.Size), formatBytes(stats.Cache.Capacity), stats.Cache.Hits, stats.Cache.Misses)
+	}
+	if stats.Relay.Budget > 0 {
+		fmt.Fprintf(out, "  relay:    %s / %s, %d objects, %d hits, %d evictions\n",
+			formatBytes(stats.Relay.Used), formatBytes(stats.Relay.Budget), stats.Relay.Objects, stats.Relay.Hits, stats.Relay.Evictions)
+	}
+	fmt.Fprintln(out, "Network:")
+	fmt.Fprintf(out, "  peers:    %d\n", stats.Network.Peers)
+	fmt.Fprintf(out, "  sent:     %s\n", formatBytes(stats.Network.BytesSent))
+	fmt.Fprintf(out, "  received: %s\n", formatBytes(stats.Network.BytesReceived))
+	fmt.Fprintln(out, "Transfers:")
+	fmt.Fprintf(out, "  active:   %d\n", stats.Transfers.Active)
+	fmt.Fprintf(out, "  completed: %d, failed: %d (%.1f%% success)\n",
+		stats.Transfers.Completed, stats.Transfers.Failed, stats.Transfers.SuccessRate*100)
+	printPeerThroughput(out, stats.Peers)
+	fmt.Fprintf(out, "Replication:\n  under-replicated: %d\n", stats.UnderReplicated)
+	if len(stats.Popular) > 0 {
+		fmt.Fprintln(out, "Popular objects:")
+		for _, p := range stats.Popular {
+			fmt.Fprintf(out, "  %s  score %6.2f  %d local, %d remote\n", p.Hash, p.Score, p.LocalReads, p.RemoteRequests)
+		}
+	}
+	return nil
+}
+
+func cmdScrub(n *node.Node, args []string, out io.Writer) error {
+	fraction := 1.0
+	if len(args) > 0 {
+		if _, err := fmt.Sscanf(args[0], "%g", &fraction); err != nil {
+			return errUsage
+		}
+	}
+	result, err := n.Scrub(fraction)
+	if err != nil {
+		fmt.Fprintf(out, "Scrub failed: %v\n", err)
+		return nil
+	}
+	fmt.Fprintf(out, "Checked %d files (%s) in %v\n", result.Checked, formatBytes(result.Bytes), result.Duration.Round(time.Millisecond))
+	for _, hash := range result.Corrupt {
+		fmt.Fprintf(out, "  corrupt: %s\n", hash)
+	}
+	return nil
+}
+
+func cmdBench(n *node.Node, args []string, out io.Writer) error {
+	cfg := node.DefaultBenchConfig()
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	size := flags.String("size", formatSize(cfg.Size), "bytes per object, with an optional K, M or G suffix")
+	flags.IntVar(&cfg.Count, "count", cfg.Count, "objects per phase")
+	flags.IntVar(&cfg.Concurrency, "concurrency", cfg.Concurrency, "operations in flight at once")
+	flags.StringVar(&cfg.Peer, "peer", "", "node ID of the peer to measure transfers against")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return errUsage
+	}
+	var err error
+	if cfg.Size, err = parseSize(*size); err != nil {
+		fmt.Fprintf(out, "Benchmark failed: %v\n", err)
+		return nil
+	}
+
+	report, err := n.Benchmark(cfg)
+	if err != nil {
+		fmt.Fprintf(out, "Benchmark failed: %v\n", err)
+		return nil
+	}
+	if *asJSON {
+		encoded, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Fprintf(out, "Failed to encode report: %v\n", err)
+			return nil
+		}
+		fmt.Fprintln(out, string(encoded))
+		return nil
+	}
+
+	fmt.Fprintf(out, "%d objects of %s, %d at a time\n", cfg.Count, formatBytes(cfg.Size), cfg.Concurrency)
+	fmt.Fprintf(out, "  %-12s %12s %10s %10s %10s %10s\n", "phase", "throughput", "min", "p50", "p99", "max")
+	for _, r := range report.Results {
+		throughput := "-"
+		if r.Bytes > 0 {
+			throughput = formatBytes(int64(r.Throughput)) + "/s"
+		}
+		fmt.Fprintf(out, "  %-12s %12s %10s %10s %10s %10s\n", r.Name, throughput,
+			formatLatency(r.Latency.Min), formatLatency(r.Latency.P50), formatLatency(r.Latency.P99), formatLatency(r.Latency.Max))
+	}
+	if cfg.Peer == "" {
+		fmt.Fprintln(out, "Pass --peer <id> to also measure transfers")
+	}
+	return nil
+}
+
+func printPeerThroughput(out io.Writer, throughput []node.PeerThroughput) {
+	if len(throughput) == 0 {
+		return
+	}
+	fmt.Fprintln(out, "Peer throughput:")
+	for _, p := range throughput {
+		fmt.Fprintf(out, "  %-24s up %10s/s (%s)  down %10s/s (%s)\n",
+			p.PeerID,
+			formatBytes(int64(p.UploadRate)), formatBytes(p.BytesSent),
+			formatBytes(int64(p.DownloadRate)), formatBytes(p.BytesReceived))
+	}
+}
+
+// formatProgress renders bytes done, and the percentage when the total is known
+func formatProgress(t node.TransferStats) string {
+	if t.TotalBytes <= 0 {
+		return formatBytes(t.BytesDone)
+	}
+	return fmt.Sprintf("%s / %s (%.1f%%)", formatBytes(t.BytesDone), formatBytes(t.TotalBytes),
+		float64(t.BytesDone)*100/float64(t.TotalBytes))
+}
+
+// formatLatency rounds a duration for display in a table
+func formatLatency(d time.Duration) string {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond).String()
+	}
+	return d.Round(10 * time.Microsecond).String()
+}
+
+// formatSize renders a byte count in the form parseSize accepts
+func formatSize(n int64) string {
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}} {
+		if n >= unit.size && n%unit.size == 0 {
+			return fmt.Sprintf("%d%s", n/unit.size, unit.suffix)
+		}
+	}
+	return fmt.Sprint(n)
+}
+
+// parseSize parses a byte count with an optional K, M or G suffix (binary
+// units)
+func parseSize(s string) (int64, error) {
+	digits, multiplier := strings.ToUpper(s), int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}} {
+		if trimmed, ok := strings.CutSuffix(digits, unit.suffix); ok {
+			digits, multiplier = trimmed, unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// formatBytes renders a byte count using binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -1,26 +1,233 @@
 package main
 
 import (
-	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
 
-	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/api"
+	"p2p-storage/internal/network"
 	"p2p-storage/internal/node"
+	"p2p-storage/internal/protocol"
+	"p2p-storage/internal/storage"
 )
 
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: demo <node-id> <port> [peer-address]")
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		os.Exit(runSimulate(os.Args[2:]))
+	}
+	socketOpts := network.DefaultSocketOptions()
+	flag.DurationVar(&socketOpts.KeepAlive, "keepalive", socketOpts.KeepAlive, "TCP keepalive interval (0 = OS default, negative disables)")
+	flag.BoolVar(&socketOpts.NoDelay, "nodelay", socketOpts.NoDelay, "disable Nagle's algorithm on peer connections")
+	flag.IntVar(&socketOpts.ReadBuffer, "rcvbuf", socketOpts.ReadBuffer, "socket receive buffer size in bytes (0 = OS default)")
+	flag.IntVar(&socketOpts.WriteBuffer, "sndbuf", socketOpts.WriteBuffer, "socket send buffer size in bytes (0 = OS default)")
+	plaintext := flag.Bool("plaintext", false, "use plaintext TCP instead of TLS for peer connections (for local testing only)")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate presented to peers (default a self-signed certificate for the identity key)")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	sessionEncryption := flag.Bool("session-encryption", false, "encrypt peer connections with keys agreed anew for each one, so a leaked identity key can't decrypt past traffic; every node must enable it")
+	tlsCA := flag.String("tls-ca", "", "PEM CA certificates that peer certificates must chain to (default any certificate matching the peer's identity key)")
+	networkID := flag.String("network-id", "", "network this node belongs to; peers of other networks are refused (default the default network)")
+	networkSecret := flag.String("network-secret", "", "secret shared by the network's nodes, from which the network ID is derived (instead of -network-id)")
+	inviteOnly := flag.Bool("invite-only", false, "admit only peers presenting an invite created with the invite command, or admitted with one before")
+	invite := flag.String("invite", "", "invite token presented to the peer address to join it, if it is invite-only")
+	allow := flag.String("allow", "", "comma-separated identity key fingerprints, node IDs of peers without keys, addresses and CIDR blocks; only matching peers are admitted (default all)")
+	deny := flag.String("deny", "", "comma-separated identity key fingerprints, node IDs, addresses and CIDR blocks whose peers are refused")
+	writeTimeout := flag.Duration("write-timeout", network.DefaultWriteTimeout, "evict peers whose writes stay blocked longer than this (0 disables)")
+	dialTimeout := flag.Duration("dial-timeout", network.DefaultDialTimeout, "give up connecting to a peer that doesn't accept within this (0 = no limit)")
+	handshakeTimeout := flag.Duration("handshake-timeout", network.DefaultHandshakeTimeout, "give up on a new connection whose TLS handshake and node handshake take longer than this (0 = no limit)")
+	replay := node.DefaultReplayConfig()
+	flag.DurationVar(&replay.MaxSkew, "max-clock-skew", replay.MaxSkew, "refuse messages whose timestamp is further than this from the local clock, and those whose nonce was already seen (0 disables replay checks)")
+	handshakeWindow := flag.Duration("handshake-window", network.DefaultHandshakeWindow, "close peer connections that haven't completed the handshake within this long (0 = never)")
+	heartbeat := network.DefaultHeartbeatConfig()
+	flag.DurationVar(&heartbeat.Interval, "heartbeat-interval", heartbeat.Interval, "interval between pings that detect dead peers (0 disables)")
+	flag.IntVar(&heartbeat.MaxMissed, "heartbeat-misses", heartbeat.MaxMissed, "unanswered pings after which a peer is evicted")
+	framing := flag.Bool("framing", true, "send messages to dialed peers as length-prefixed frames (disable to reach nodes that predate framing)")
+	maxFrameSize := flag.Int("max-frame-size", network.DefaultMaxFrameSize, "largest message in bytes sent or accepted on a framed connection")
+	readTimeout := flag.Duration("read-timeout", network.DefaultReadTimeout, "disconnect peers whose messages take longer than this to arrive once started (0 disables)")
+	maxInflight := flag.Int64("max-inflight", network.DefaultMaxInflight, "disconnect peers whose messages being handled at once exceed this many bytes (0 = no limit)")
+	peerLimits := network.DefaultPeerLimits()
+	flag.IntVar(&peerLimits.MaxInbound, "max-inbound", peerLimits.MaxInbound, "most connections accepted from peers at once (0 = no limit)")
+	flag.IntVar(&peerLimits.MaxOutbound, "max-outbound", peerLimits.MaxOutbound, "most connections dialed to peers at once (0 = no limit)")
+	flag.DurationVar(&peerLimits.EvictIdle, "evict-idle", peerLimits.EvictIdle, "how long a peer must have sent nothing useful before it is evicted to make room at a connection limit (0 never evicts)")
+	codecs := flag.String("codecs", strings.Join(protocol.Codecs, ","), "codecs accepted on framed connections, in order of preference (binary, json)")
+	frameCompression := flag.String("frame-compression", strings.Join(protocol.FrameCompressions, ","), "schemes frames on framed connections may be compressed with, in order of preference (gzip; empty disables)")
+	compressMin := flag.Int("compress-min", network.DefaultCompressThreshold, "frames smaller than this many bytes are sent uncompressed")
+	listen := flag.String("listen", "", "comma-separated addresses to listen on besides the port, such as [::]:3000 for IPv6 or another interface's address")
+	wsListen := flag.String("ws-listen", "", "also accept peers over WebSocket on this address, at "+network.WebSocketPath+" (empty disables)")
+	advertise := flag.String("advertise", "", "address peers are told to dial instead of the bind address, such as the host's public address:port for a node in a container")
+	portMap := flag.Bool("portmap", false, "forward the listen port on the router with NAT-PMP or UPnP and advertise its external address")
+	webRTC := flag.Bool("webrtc", false, "accept peers, such as browsers, over WebRTC data channels, with offers answered at "+network.WebRTCSignalPath+" on the -ws-listen address and relayed by peers")
+	iceServers := flag.String("ice-servers", "", "comma-separated STUN or TURN URLs for WebRTC connections, such as stun:stun.l.google.com:19302")
+	stunServer := flag.String("stun", "", "STUN server (host:port), reached over TCP, to learn the external address from, enabling hole punching with the punch command")
+	lanBeacon := flag.Bool("lan-beacon", false, "broadcast a UDP beacon on the LAN and dial the nodes of this network whose beacons are heard, for discovery where multicast is blocked")
+	beacon := node.DefaultBeaconConfig()
+	flag.IntVar(&beacon.Port, "beacon-port", beacon.Port, "UDP port LAN beacons are broadcast to and listened for on")
+	flag.DurationVar(&beacon.Interval, "beacon-interval", beacon.Interval, "interval between LAN beacons")
+	var rateLimits network.RateLimits
+	flag.Int64Var(&rateLimits.Upload, "upload-rate", 0, "upload rate limit across all peers in bytes/s (0 = no limit)")
+	flag.Int64Var(&rateLimits.Download, "download-rate", 0, "download rate limit across all peers in bytes/s (0 = no limit)")
+	flag.Int64Var(&rateLimits.PeerUpload, "peer-upload-rate", 0, "upload rate limit for each peer in bytes/s (0 = no limit)")
+	flag.Int64Var(&rateLimits.PeerDownload, "peer-download-rate", 0, "download rate limit for each peer in bytes/s (0 = no limit)")
+	bulkChannel := flag.Bool("bulk-channel", true, "send chunk data over a second connection per peer so transfers don't delay control messages")
+	mux := flag.Bool("mux", true, "send large messages to peers in fragments, interleaved with other messages on the connection")
+	deltaTransfers := flag.Bool("delta-transfer", true, "fetch new versions of files as deltas against the previous version when it is held")
+	publicMirror := flag.Bool("public-mirror", false, "run as a public mirror: hold no network key and store only unencrypted content")
+	cacheSize := flag.Int64("cache-size", 64<<20, "bytes of RAM used to cache hot objects (0 disables)")
+	maxObjectSize := flag.Int64("max-object-size", 0, "largest file in bytes accepted from peers; larger announcements and transfers are refused (0 = no limit)")
+	relayCache := flag.Int64("relay-cache", 0, "bytes of disk for caching content fetched on behalf of other peers (0 disables)")
+	relay := flag.Bool("relay", true, "fetch content this node lacks from a peer holding it when another peer asks for it")
+	storageOnly := flag.Bool("storage-only", false, "hold replicas for peers without watching the watch directory; peers prefer such nodes for replicas")
+	maxChunkSize := flag.Int("max-chunk-size", protocol.DefaultChunkSize, "largest transfer chunk in bytes accepted from peers, rounded down to a power of two (at least 16384)")
+	transferWindow := flag.Int("transfer-window", node.DefaultTransferWindow, "chunks of a transfer a peer may send ahead of those written here (0 = as fast as it reads)")
+	uploadSlots := flag.Int("upload-slots", node.DefaultUploadSlots, "chunks sent to peers at once; further chunks wait, interactive transfers ahead of bulk ones (0 = no limit)")
+	storeDirFlag := flag.String("store-dir", "", "directory holding stored objects (default data/<node-id>/store)")
+	scratchDir := flag.String("scratch-dir", "", "directory for temporary files of transfers and ingests (default the store's temp directory)")
+	downloadDir := flag.String("download-dir", "downloads", "directory files fetched with get are decrypted to")
+	storeLayout := flag.String("store-layout", "", "object path fan-out as depth/width for a new store, e.g. 2/2 (existing stores keep their recorded layout)")
+	scrubConfig := node.DefaultScrubConfig()
+	flag.DurationVar(&scrubConfig.Interval, "scrub-interval", scrubConfig.Interval, "interval between background integrity checks (0 disables)")
+	flag.Float64Var(&scrubConfig.Fraction, "scrub-fraction", scrubConfig.Fraction, "fraction of the store verified per integrity check run")
+	flag.Int64Var(&scrubConfig.BytesPerSecond, "scrub-rate", scrubConfig.BytesPerSecond, "disk read rate limit for integrity checks in bytes/s (0 = unpaced)")
+	replication := node.DefaultReplicationConfig()
+	flag.IntVar(&replication.Target, "replication-target", replication.Target, "number of live replicas each object should have, including the local copy")
+	flag.DurationVar(&replication.Interval, "inventory-interval", replication.Interval, "interval between inventory exchanges used to count replicas (0 disables)")
+	discovery := node.DefaultDiscoveryConfig()
+	flag.DurationVar(&discovery.DialInterval, "discovery-interval", discovery.DialInterval, "minimum time between dials to peers learned through discovery")
+	flag.IntVar(&discovery.MaxPeers, "max-peers", discovery.MaxPeers, "stop dialing discovered peers once this many are connected (0 = no cap)")
+	seeds := node.DefaultSeedConfig()
+	seedList := flag.String("seeds", "", "comma-separated bootstrap peers as host:port DNS names, each of whose addresses is dialed, or txt:<name> for a TXT record listing them")
+	flag.DurationVar(&seeds.Interval, "seed-interval", seeds.Interval, "interval between resolving seeds again and dialing those not connected (0 = only at start)")
+	bootstrap := node.DefaultBootstrapConfig()
+	flag.IntVar(&bootstrap.MaxAttempts, "bootstrap-attempts", bootstrap.MaxAttempts, "attempts at joining through the peer address before giving up (0 = keep trying)")
+	flag.DurationVar(&bootstrap.MinBackoff, "bootstrap-backoff", bootstrap.MinBackoff, "wait after the first failed attempt at joining through the peer address, doubled after each further failure")
+	flag.DurationVar(&bootstrap.MaxBackoff, "bootstrap-max-backoff", bootstrap.MaxBackoff, "longest wait between attempts at joining through the peer address")
+	idle := node.DefaultIdleConfig()
+	flag.DurationVar(&idle.Timeout, "idle-timeout", idle.Timeout, "close connections that carried nothing but heartbeats for this long (0 = never)")
+	flag.IntVar(&idle.MinPeers, "idle-min-peers", idle.MinPeers, "connections kept open however idle they are")
+	peerDB := node.DefaultPeerDBConfig()
+	flag.IntVar(&peerDB.Reconnect, "reconnect", peerDB.Reconnect, "number of the most recently seen known peers dialed again at start (0 = none)")
+	flag.DurationVar(&peerDB.MaxAge, "peer-max-age", peerDB.MaxAge, "forget known peers not seen for this long and don't dial them at start (0 = keep forever)")
+	overlay := node.DefaultOverlayConfig()
+	flag.IntVar(&overlay.Nearest, "overlay-nearest", overlay.Nearest, "number of peers nearest by node ID to keep connected to")
+	flag.IntVar(&overlay.Random, "overlay-random", overlay.Random, "number of random peers to keep connected to (0 for both turns the overlay off and every discovered peer is dialed)")
+	flag.DurationVar(&overlay.Interval, "overlay-interval", overlay.Interval, "interval between overlay maintenance and peer exchange rounds")
+	gossip := node.DefaultGossipConfig()
+	flag.IntVar(&gossip.TTL, "gossip-ttl", gossip.TTL, "hops announcements of new files travel through the overlay (1 = neighbours only)")
+	batching := node.DefaultBatchConfig()
+	flag.DurationVar(&batching.Window, "announce-window", batching.Window, "how long an announcement of a new file waits for others to be sent with it (0 = announce each at once)")
+	flag.IntVar(&batching.MaxSize, "announce-batch", batching.MaxSize, "most announcements sent together")
+	antiEntropy := node.DefaultAntiEntropyConfig()
+	flag.DurationVar(&antiEntropy.Interval, "anti-entropy-interval", antiEntropy.Interval, "interval between summaries of stored objects sent to peers, which pull those they missed (0 disables)")
+	flag.IntVar(&antiEntropy.MaxPulls, "anti-entropy-pulls", antiEntropy.MaxPulls, "objects pulled from a peer for each summary it sends")
+	honorDeletes := flag.Bool("honor-deletes", false, "delete objects when other nodes delete them and propagate a signed tombstone")
+	deleteSigners := flag.String("delete-signers", "", "comma-separated identity key fingerprints of the nodes whose deletions -honor-deletes honors (required with -honor-deletes)")
+	requests := node.DefaultRequestConfig()
+	flag.DurationVar(&requests.Timeout, "request-timeout", requests.Timeout, "how long a peer asked for a file has to start sending it before the next peer is asked")
+	flag.IntVar(&requests.Attempts, "request-attempts", requests.Attempts, "number of peers asked in turn for a file before giving up")
+	audits := node.DefaultAuditConfig()
+	flag.DurationVar(&audits.Interval, "audit-interval", audits.Interval, "interval between storage audits of replica holders (0 disables)")
+	flag.IntVar(&audits.Sample, "audit-sample", audits.Sample, "number of holders challenged per storage audit")
+	ledgerPolicy := node.DefaultLedgerPolicy()
+	flag.Float64Var(&ledgerPolicy.MinRatio, "min-ratio", ledgerPolicy.MinRatio, "minimum ratio of bytes received from a peer to bytes served to it (0 disables)")
+	flag.Int64Var(&ledgerPolicy.Grace, "ratio-grace", ledgerPolicy.Grace, "bytes served to a peer before -min-ratio is enforced")
+	flag.Int64Var(&ledgerPolicy.ThrottleRate, "throttle-rate", ledgerPolicy.ThrottleRate, "upload rate in bytes/s for peers below -min-ratio (0 refuses them)")
+	scoring := node.DefaultScoreConfig()
+	flag.Float64Var(&scoring.DerateThreshold, "derate-score", scoring.DerateThreshold, "peer score below which a peer's offers are ignored and it is tried last for repairs (0 disables)")
+	flag.Float64Var(&scoring.DisconnectThreshold, "disconnect-score", scoring.DisconnectThreshold, "peer score below which a peer is disconnected (0 disables)")
+	flag.DurationVar(&scoring.BanDuration, "score-ban", scoring.BanDuration, "how long peers disconnected for their score are banned (0 = no ban)")
+	watchDebounce := flag.Duration("watch-debounce", node.DefaultWatchDebounce, "how long a file in the watch directory must go without changes before it is stored")
+	ingest := node.DefaultIngestConfig()
+	flag.Int64Var(&ingest.MaxFileSize, "max-file-size", ingest.MaxFileSize, "largest file in bytes stored from the watch directory, store or import (0 = no limit)")
+	flag.IntVar(&ingest.Workers, "ingest-workers", ingest.Workers, "files encrypted and hashed at once")
+	flag.IntVar(&ingest.QueueSize, "ingest-queue", ingest.QueueSize, "files waiting for an ingest worker before -ingest-overflow applies")
+	ingestOverflow := flag.String("ingest-overflow", string(ingest.Overflow), "when the ingest queue is full: block waits for room, drop refuses the file")
+	symlinks := flag.String("symlinks", string(node.SymlinkFollow), "symlink handling in the watch directory and imports: follow, preserve or ignore")
+	httpAddr := flag.String("http", "", "address for the HTTP API serving /metrics, /events and /admin/ (disabled if empty)")
+	httpOrigins := flag.String("http-origins", "", "comma-separated browser origins, besides the API's own, allowed to open /events, such as https://dashboard.example.com")
+	logLevel := flag.String("log-level", "info", "log verbosity: info or debug (can be changed at runtime through /admin/log-level)")
+	tracing := flag.Bool("trace", false, "give announcements and requests this node starts a trace ID, carried by the messages and chunks sent because of them")
+	tap := flag.Bool("tap", false, "log every message sent and received with its type, size, peer and trace ID (can be toggled with the tap command)")
+	tuiMode := flag.Bool("tui", false, "run the full-screen terminal UI instead of the line-based REPL")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: demo [flags] <node-id> <port> [peer-address]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       demo simulate [flags]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	symlinkPolicy, err := node.ParseSymlinkPolicy(*symlinks)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if ingest.Overflow, err = node.ParseIngestOverflow(*ingestOverflow); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	codecList := strings.Split(*codecs, ",")
+	for _, name := range codecList {
+		if _, err := protocol.CodecByName(name); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	var compressionList []string
+	if *frameCompression != "" {
+		compressionList = strings.Split(*frameCompression, ",")
+	}
+	for _, scheme := range compressionList {
+		if !protocol.HasFeature(protocol.FrameCompressions, scheme) {
+			fmt.Printf("unknown frame compression %q (want %s)\n", scheme, strings.Join(protocol.FrameCompressions, ", "))
+			os.Exit(1)
+		}
+	}
+	if *networkSecret != "" {
+		if *networkID != "" {
+			fmt.Println("-network-id and -network-secret are mutually exclusive")
+			os.Exit(1)
+		}
+		*networkID = protocol.NetworkIDFromSecret(*networkSecret)
+	}
+	if *honorDeletes && strings.TrimSpace(strings.ReplaceAll(*deleteSigners, ",", "")) == "" {
+		fmt.Println("-honor-deletes needs -delete-signers to list the nodes whose deletions are honored")
+		os.Exit(1)
+	}
+	level, err := node.ParseLogLevel(*logLevel)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	nodeID := os.Args[1]
-	port := os.Args[2]
+	storeOpts := []storage.Option{storage.WithCacheSize(*cacheSize)}
+	if *storeLayout != "" {
+		layout, err := storage.ParseLayout(*storeLayout)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		storeOpts = append(storeOpts, storage.WithLayout(layout))
+	}
+
+	nodeID := args[0]
+	port := args[1]
 	baseDir := filepath.Join("data", nodeID)
 	storeDir := filepath.Join(baseDir, "store")
+	if *storeDirFlag != "" {
+		storeDir = *storeDirFlag
+	}
 	watchDir := filepath.Join(baseDir, "watch")
 
 	// Create directories
@@ -28,12 +235,105 @@ func main() {
 	os.MkdirAll(watchDir, 0755)
 
 	// Create node
-	n, err := node.NewNode(
-		nodeID,
-		fmt.Sprintf(":%s", port),
-		storeDir,
-		watchDir,
-	)
+	nodeOpts := []node.Option{
+		node.WithFirstNode(len(args) < 3 && *seedList == "" && !node.HasKnownPeers(baseDir)),
+		node.WithDataDir(baseDir),
+		node.WithCodecs(codecList),
+		node.WithFrameCompression(compressionList, *compressMin),
+		node.WithTransportOptions(
+			network.WithSocketOptions(socketOpts),
+			network.WithWriteTimeout(*writeTimeout),
+			network.WithDialTimeout(*dialTimeout),
+			network.WithHandshakeTimeout(*handshakeTimeout),
+			network.WithHandshakeWindow(*handshakeWindow),
+			network.WithHeartbeat(heartbeat),
+			network.WithBulkChannel(*bulkChannel),
+			network.WithMultiplexing(*mux),
+			network.WithFraming(*framing),
+			network.WithMaxFrameSize(*maxFrameSize),
+			network.WithReadTimeout(*readTimeout),
+			network.WithMaxInflight(*maxInflight),
+			network.WithPeerLimits(peerLimits),
+		),
+		node.WithStoreOptions(storeOpts...),
+		node.WithScrubSchedule(scrubConfig),
+		node.WithSymlinkPolicy(symlinkPolicy),
+		node.WithRelayCache(*relayCache),
+		node.WithRelay(*relay),
+		node.WithStorageOnly(*storageOnly),
+		node.WithMaxChunkSize(*maxChunkSize),
+		node.WithTransferWindow(*transferWindow),
+		node.WithUploadSlots(*uploadSlots),
+		node.WithReplication(replication),
+		node.WithDiscovery(discovery),
+		node.WithOverlay(overlay),
+		node.WithAntiEntropy(antiEntropy),
+		node.WithDeletePolicy(node.DeletePolicy{Honor: *honorDeletes, Trusted: strings.Split(*deleteSigners, ",")}),
+		node.WithIdleConfig(idle),
+		node.WithPeerDB(peerDB),
+		node.WithGossip(gossip),
+		node.WithBatching(batching),
+		node.WithRequests(requests),
+		node.WithAudits(audits),
+		node.WithLedgerPolicy(ledgerPolicy),
+		node.WithScoring(scoring),
+		node.WithDeltaTransfers(*deltaTransfers),
+		node.WithPublicMirror(*publicMirror),
+		node.WithMaxObjectSize(*maxObjectSize),
+		node.WithRateLimits(rateLimits),
+		node.WithWatchDebounce(*watchDebounce),
+		node.WithIngestLimits(ingest),
+		node.WithTLS(node.TLSConfig{Enabled: !*plaintext, CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA}),
+		node.WithSessionEncryption(*sessionEncryption),
+		node.WithDownloadDir(*downloadDir),
+		node.WithNetworkID(*networkID),
+		node.WithInviteOnly(*inviteOnly),
+		node.WithAllowlist(strings.Split(*allow, ",")...),
+		node.WithDenylist(strings.Split(*deny, ",")...),
+		node.WithLogLevel(level),
+		node.WithTracing(*tracing),
+		node.WithReplayProtection(replay),
+	}
+	if *tap {
+		nodeOpts = append(nodeOpts, node.WithTransportOptions(network.WithTap(network.LogTap(os.Stdout))))
+	}
+	if *scratchDir != "" {
+		nodeOpts = append(nodeOpts, node.WithScratchDir(*scratchDir))
+	}
+	if len(args) > 2 {
+		bootstrap.Peers = []string{args[2]}
+		nodeOpts = append(nodeOpts, node.WithBootstrap(bootstrap), node.WithInvite(*invite, args[2]))
+	}
+	if *seedList != "" {
+		seeds.Seeds = strings.Split(*seedList, ",")
+		nodeOpts = append(nodeOpts, node.WithSeeds(seeds))
+	}
+	if *listen != "" {
+		nodeOpts = append(nodeOpts, node.WithTransportOptions(network.WithListenAddresses(strings.Split(*listen, ",")...)))
+	}
+	if *wsListen != "" {
+		nodeOpts = append(nodeOpts, node.WithTransportOptions(network.WithWebSocket(*wsListen)))
+	}
+	if *webRTC {
+		var rtc network.WebRTCConfig
+		if *iceServers != "" {
+			rtc.ICEServers = strings.Split(*iceServers, ",")
+		}
+		nodeOpts = append(nodeOpts, node.WithWebRTC(rtc))
+	}
+	if *stunServer != "" {
+		nodeOpts = append(nodeOpts, node.WithHolePunching(*stunServer))
+	}
+	if *lanBeacon {
+		nodeOpts = append(nodeOpts, node.WithLANBeacon(beacon))
+	}
+	if *advertise != "" {
+		nodeOpts = append(nodeOpts, node.WithAdvertisedAddress(*advertise))
+	}
+	if *portMap {
+		nodeOpts = append(nodeOpts, node.WithPortMapping(nil))
+	}
+	n, err := node.NewNode(nodeID, fmt.Sprintf(":%s", port), storeDir, watchDir, nodeOpts...)
 	if err != nil {
 		fmt.Printf("Failed to create node: %v\n", err)
 		os.Exit(1)
@@ -46,127 +346,71 @@ func main() {
 	}
 	defer n.Stop()
 
-	// Connect to peer if provided
-	if len(os.Args) > 3 {
-		peerAddr := os.Args[3]
-		fmt.Printf("Connecting to peer at %s...\n", peerAddr)
-		if err := n.Connect(peerAddr); err != nil {
-			fmt.Printf("Failed to connect to peer: %v\n", err)
-		}
-	}
-
-	fmt.Printf("Node %s started. Watch directory: %s\n", nodeID, watchDir)
-	fmt.Println("Available commands:")
-	fmt.Println("  store <file>  - Store a file")
-	fmt.Println("  get <hash>    - Get a file by hash")
-	fmt.Println("  list          - List stored files")
-	fmt.Println("  connect <addr> - Connect to a peer")
-	fmt.Println("  quit          - Exit the program")
-
-	scanner := bufio.NewScanner(os.Stdin)
-	for {
-		fmt.Print("> ")
-		if !scanner.Scan() {
-			break
-		}
-
-		cmd := scanner.Text()
-		parts := strings.Fields(cmd)
-		if len(parts) == 0 {
-			continue
+	if *httpAddr != "" {
+		tokenPath := filepath.Join(baseDir, "admin.token")
+		token, err := loadAdminToken(tokenPath)
+		if err != nil {
+			fmt.Printf("Failed to load admin token: %v\n", err)
+			os.Exit(1)
 		}
-
-		switch parts[0] {
-		case "store":
-			if len(parts) < 2 {
-				fmt.Println("Usage: store <file>")
-				continue
-			}
-			filePath := parts[1]
-			hash, err := n.StoreFile(filePath)
-			if err != nil {
-				fmt.Printf("Failed to store file: %v\n", err)
-			} else {
-				fmt.Printf("File stored with hash: %s\n", hash)
-			}
-
-		case "get":
-			if len(parts) < 2 {
-				fmt.Println("Usage: get <hash>")
-				continue
-			}
-			hash := parts[1]
-			reader, key, err := n.GetFile(hash)
-			if err != nil {
-				fmt.Printf("Failed to get file: %v\n", err)
-				continue
-			}
-			defer reader.Close()
-
-			// Create downloads directory
-			os.MkdirAll("downloads", 0755)
-			outPath := filepath.Join("downloads", hash)
-
-			// Create temporary file for decrypted content
-			tempFile, err := os.CreateTemp("downloads", "decrypted-*")
-			if err != nil {
-				fmt.Printf("Failed to create temporary file: %v\n", err)
-				continue
-			}
-			tempPath := tempFile.Name()
-			defer tempFile.Close()
-
-			// Decrypt using the appropriate key
-			if err := crypto.DecryptStream(key, reader, tempFile); err != nil {
-				fmt.Printf("Failed to decrypt file: %v\n", err)
-				os.Remove(tempPath)
-				continue
-			}
-
-			// Close temp file before renaming
-			tempFile.Close()
-
-			// Move the decrypted file to final location
-			if err := os.Rename(tempPath, outPath); err != nil {
-				fmt.Printf("Failed to move decrypted file: %v\n", err)
-				os.Remove(tempPath)
-				continue
+		go func() {
+			if err := http.ListenAndServe(*httpAddr, api.NewServer(n, api.WithAdminToken(token), api.WithAllowedOrigins(strings.Split(*httpOrigins, ",")...))); err != nil {
+				fmt.Printf("HTTP API stopped: %v\n", err)
 			}
+		}()
+		fmt.Printf("HTTP API listening on %s (admin token in %s)\n", *httpAddr, tokenPath)
+	}
 
-			fmt.Printf("File decrypted and saved to: %s\n", outPath)
-
-		case "list":
-			files, err := n.List()
+	// SIGHUP reloads the blocklist and namespace policies
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			result, err := n.Reload()
 			if err != nil {
-				fmt.Printf("Failed to list files: %v\n", err)
+				fmt.Printf("Failed to reload configuration: %v\n", err)
 				continue
 			}
-			if len(files) == 0 {
-				fmt.Println("No files stored")
-				continue
-			}
-			fmt.Println("Stored files:")
-			for _, hash := range files {
-				fmt.Printf("  %s\n", hash)
-			}
+			fmt.Printf("Reloaded configuration: %d bans, %d namespace policies\n", result.Bans, result.Namespaces)
+		}
+	}()
 
-		case "connect":
-			if len(parts) < 2 {
-				fmt.Println("Usage: connect <address>")
-				continue
-			}
-			addr := parts[1]
-			if err := n.Connect(addr); err != nil {
-				fmt.Printf("Failed to connect: %v\n", err)
-			} else {
-				fmt.Printf("Connected to %s\n", addr)
-			}
+	if *tuiMode {
+		if err := runTUI(n); err != nil {
+			fmt.Printf("Failed to start TUI: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-		case "quit":
-			return
+	fmt.Printf("Node %s started. Watch directory: %s\n", nodeID, watchDir)
+	if err := runREPL(n); err != nil {
+		fmt.Printf("REPL error: %v\n", err)
+	}
+}
 
-		default:
-			fmt.Println("Unknown command")
+// loadAdminToken reads the token guarding the /admin/ endpoints, creating a
+// random one readable only by the owner on first use
+func loadAdminToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("%s is empty", path)
 		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", err
 	}
+	return token, nil
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"p2p-storage/internal/node"
+
+	"golang.org/x/term"
+)
+
+// hashArgCommands complete their argument from the node's stored hashes;
+// every other command completes filesystem paths
+var hashArgCommands = map[string]bool{
+	"get": true,
+}
+
+// runREPL runs the interactive prompt. On a terminal it provides line
+// editing, history (Up/Down) and Tab completion; piped input falls back to
+// a plain line reader so the REPL stays scriptable.
+func runREPL(n *node.Node) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return runPlainREPL(n)
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to enter raw mode: %w", err)
+	}
+	defer term.Restore(fd, state)
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "> ")
+	if width, height, err := term.GetSize(fd); err == nil {
+		terminal.SetSize(width, height)
+	}
+	terminal.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return complete(n, terminal, line, pos)
+	}
+
+	// Route node output through the terminal so it doesn't garble the prompt
+	realStdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to capture output: %w", err)
+	}
+	os.Stdout = w
+	defer func() {
+		os.Stdout = realStdout
+		w.Close()
+	}()
+	go io.Copy(terminal, r)
+
+	printHelp(terminal)
+
+	for {
+		line, err := terminal.ReadLine()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if err := runCommand(n, line, terminal); errors.Is(err, errQuit) {
+			return nil
+		}
+	}
+}
+
+func runPlainREPL(n *node.Node) error {
+	printHelp(os.Stdout)
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+
+		if err := runCommand(n, scanner.Text(), os.Stdout); errors.Is(err, errQuit) {
+			return nil
+		}
+	}
+}
+
+// complete expands the word under the cursor: command names for the first
+// word, stored hashes for hash arguments and filesystem paths otherwise.
+// Ambiguous completions extend to the longest common prefix and list the
+// candidates.
+func complete(n *node.Node, out io.Writer, line string, pos int) (string, int, bool) {
+	prefix := line[:pos]
+	start := strings.LastIndex(prefix, " ") + 1
+	word := prefix[start:]
+
+	var candidates []string
+	if start == 0 {
+		for _, c := range commands() {
+			candidates = append(candidates, c.name)
+		}
+	} else if fields := strings.Fields(prefix); len(fields) > 0 && hashArgCommands[fields[0]] {
+		hashes, err := n.Hashes()
+		if err == nil {
+			candidates = hashes
+		}
+	} else {
+		candidates = completePath(word)
+	}
+
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(matches)
+
+	replacement := commonPrefix(matches)
+	if len(matches) == 1 && !strings.HasSuffix(replacement, string(filepath.Separator)) {
+		replacement += " "
+	}
+	if len(matches) > 1 && replacement == word {
+		// Nothing to extend; show the options. The terminal is locked while
+		// this callback runs, so print once it has been released.
+		list := strings.Join(matches, "  ")
+		go fmt.Fprintln(out, list)
+		return "", 0, false
+	}
+
+	newLine := prefix[:start] + replacement + line[pos:]
+	return newLine, start + len(replacement), true
+}
+
+// completePath lists filesystem entries matching a partially typed path
+func completePath(word string) []string {
+	dir, base := filepath.Split(word)
+	listDir := dir
+	if listDir == "" {
+		listDir = "."
+	}
+
+	entries, err := os.ReadDir(listDir)
+	if err != nil {
+		return nil
+	}
+
+	var paths []string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), base) {
+			continue
+		}
+		p := dir + e.Name()
+		if e.IsDir() {
+			p += string(filepath.Separator)
+		}
+		paths = append(paths, p)
+	}
+	return paths
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"p2p-storage/internal/node"
+)
+
+// runSimulate runs a simulated cluster in this process and prints its
+// report, returning the exit code
+func runSimulate(args []string) int {
+	cfg := node.DefaultSimConfig()
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.IntVar(&cfg.Nodes, "nodes", cfg.Nodes, "number of nodes")
+	topology := flags.String("topology", string(cfg.Topology), "initial connections: full, star, ring, line or random")
+	flags.IntVar(&cfg.Degree, "degree", cfg.Degree, "connections each node opens in a random topology")
+	flags.IntVar(&cfg.Files, "files", cfg.Files, "files dropped into the watch directories, one node after another")
+	size := flags.String("size", formatSize(cfg.FileSize), "bytes per file, with an optional K, M or G suffix")
+	flags.DurationVar(&cfg.Timeout, "timeout", cfg.Timeout, "how long to wait for the network key and for files to reach every node")
+	keep := flags.Bool("keep", false, "keep the nodes' data directories instead of removing them")
+	verbose := flags.Bool("verbose", false, "show the nodes' log output")
+	asJSON := flags.Bool("json", false, "print the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: demo simulate [flags]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	var err error
+	if cfg.Topology, err = node.ParseSimTopology(*topology); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	if cfg.FileSize, err = parseSize(*size); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	dir, err := os.MkdirTemp("", "p2p-simulate-*")
+	if err != nil {
+		fmt.Printf("Failed to create simulation directory: %v\n", err)
+		return 1
+	}
+	if *keep {
+		fmt.Printf("Node data in %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+
+	fmt.Printf("Simulating %d nodes (%s topology) with %d files of %s...\n", cfg.Nodes, cfg.Topology, cfg.Files, formatBytes(cfg.FileSize))
+	stdout := os.Stdout
+	if !*verbose {
+		// The nodes log with fmt.Printf; silence them while they run
+		if null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			os.Stdout = null
+			defer null.Close()
+		}
+	}
+	report, err := node.Simulate(dir, cfg)
+	os.Stdout = stdout
+	if err != nil {
+		fmt.Printf("Simulation failed: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		encoded, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			fmt.Printf("Failed to encode report: %v\n", err)
+			return 1
+		}
+		fmt.Println(string(encoded))
+		return 0
+	}
+
+	fmt.Printf("Links: %d opened, %d connections at the end\n", report.Links, report.Connections)
+	fmt.Printf("Key distribution: %v\n", report.Setup.Round(time.Millisecond))
+	for _, f := range report.Files {
+		if f.Converged {
+			fmt.Printf("  %s from %s: on all nodes after %v\n", f.Name, f.Origin, f.Time.Round(time.Millisecond))
+		} else {
+			fmt.Printf("  %s from %s: on %d of %d nodes\n", f.Name, f.Origin, f.Replicas, cfg.Nodes)
+		}
+	}
+	if report.Converged == len(report.Files) {
+		fmt.Printf("Converged: all %d files in %v\n", report.Converged, report.Convergence.Round(time.Millisecond))
+	} else {
+		fmt.Printf("Converged: %d of %d files within %v\n", report.Converged, len(report.Files), cfg.Timeout)
+	}
+
+	types := make([]string, 0, len(report.Messages))
+	var total int64
+	for msgType, count := range report.Messages {
+		types = append(types, msgType)
+		total += count
+	}
+	sort.Strings(types)
+	fmt.Printf("Messages: %d (%s sent)\n", total, formatBytes(report.Bytes))
+	for _, msgType := range types {
+		fmt.Printf("  %-16s %d\n", msgType, report.Messages[msgType])
+	}
+	return 0
+}
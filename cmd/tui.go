@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"p2p-storage/internal/node"
+
+	"golang.org/x/term"
+)
+
+const (
+	tuiRefreshInterval = 500 * time.Millisecond
+	tuiLogLimit        = 500
+)
+
+// tui is a full-screen terminal dashboard showing peers, transfers and the
+// file index, with a command palette that runs the same commands as the REPL
+type tui struct {
+	node   *node.Node
+	screen io.Writer
+
+	mu    sync.Mutex
+	log   []string
+	files []string
+	input []rune
+	quit  chan struct{}
+	once  sync.Once
+}
+
+// runTUI takes over the terminal until the user quits
+func runTUI(n *node.Node) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("TUI mode requires an interactive terminal")
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to enter raw mode: %w", err)
+	}
+	defer term.Restore(fd, state)
+
+	t := &tui{
+		node:   n,
+		screen: os.Stdout,
+		quit:   make(chan struct{}),
+	}
+
+	// Node components log with fmt.Printf; route that into the log pane
+	// instead of letting it scribble over the dashboard
+	realStdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to capture output: %w", err)
+	}
+	os.Stdout = w
+	defer func() {
+		os.Stdout = realStdout
+		w.Close()
+	}()
+	go t.capture(r)
+
+	events, cancel := n.Subscribe()
+	defer cancel()
+
+	keys := make(chan []byte)
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			nr, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(keys)
+				return
+			}
+			chunk := make([]byte, nr)
+			copy(chunk, buf[:nr])
+			keys <- chunk
+		}
+	}()
+
+	fmt.Fprint(t.screen, "\x1b[?1049h\x1b[?25l") // alternate screen, hide cursor
+	defer fmt.Fprint(t.screen, "\x1b[?25h\x1b[?1049l")
+
+	t.appendLog("Type a command and press Enter. Tab completes, Esc clears, Ctrl-C quits.")
+	t.refreshFiles()
+	t.render()
+
+	ticker := time.NewTicker(tuiRefreshInterval)
+	defer ticker.Stop()
+	ticks := 0
+
+	for {
+		select {
+		case <-t.quit:
+			return nil
+		case chunk, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			t.handleKeys(chunk)
+			t.render()
+		case event := <-events:
+			t.appendLog(formatEvent(event))
+			if event.Type == node.EventFileStored {
+				t.refreshFiles()
+			}
+		case <-ticker.C:
+			ticks++
+			if ticks%10 == 0 {
+				t.refreshFiles()
+			}
+			t.render()
+		}
+	}
+}
+
+// capture copies captured process output into the log pane line by line
+func (t *tui) capture(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			t.appendLog(line)
+		}
+	}
+}
+
+func (t *tui) appendLog(line string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.log = append(t.log, line)
+	if len(t.log) > tuiLogLimit {
+		t.log = t.log[len(t.log)-tuiLogLimit:]
+	}
+}
+
+func (t *tui) refreshFiles() {
+	files, err := t.node.List()
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	t.files = files
+	t.mu.Unlock()
+}
+
+// Write lets command output flow into the log pane
+func (t *tui) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		t.appendLog(line)
+	}
+	return len(p), nil
+}
+
+func (t *tui) handleKeys(chunk []byte) {
+	// Escape sequences (arrow keys etc.) are ignored; a lone Esc clears input
+	if chunk[0] == 0x1b {
+		if len(chunk) == 1 {
+			t.mu.Lock()
+			t.input = t.input[:0]
+			t.mu.Unlock()
+		}
+		return
+	}
+
+	for len(chunk) > 0 {
+		r, size := utf8.DecodeRune(chunk)
+		chunk = chunk[size:]
+
+		switch r {
+		case 3: // Ctrl-C
+			t.stop()
+			return
+		case '\r', '\n':
+			t.mu.Lock()
+			line := strings.TrimSpace(string(t.input))
+			t.input = t.input[:0]
+			t.mu.Unlock()
+			if line != "" {
+				t.execute(line)
+			}
+		case 127, 8: // Backspace
+			t.mu.Lock()
+			if len(t.input) > 0 {
+				t.input = t.input[:len(t.input)-1]
+			}
+			t.mu.Unlock()
+		case '\t':
+			t.complete()
+		default:
+			if r >= 32 {
+				t.mu.Lock()
+				t.input = append(t.input, r)
+				t.mu.Unlock()
+			}
+		}
+	}
+}
+
+// complete expands the word at the end of the input, sharing the REPL's
+// completion of command names, hashes and paths
+func (t *tui) complete() {
+	t.mu.Lock()
+	line := string(t.input)
+	t.mu.Unlock()
+
+	if newLine, _, ok := complete(t.node, t, line, len(line)); ok {
+		t.mu.Lock()
+		t.input = []rune(newLine)
+		t.mu.Unlock()
+	}
+}
+
+// execute runs a command in the background so slow commands don't freeze the UI
+func (t *tui) execute(line string) {
+	t.appendLog("> " + line)
+	go func() {
+		if err := runCommand(t.node, line, t); errors.Is(err, errQuit) {
+			t.stop()
+		}
+	}()
+}
+
+func (t *tui) stop() {
+	t.once.Do(func() { close(t.quit) })
+}
+
+func (t *tui) render() {
+	width, height, err := term.GetSize(int(os.Stdin.Fd()))
+	if err != nil || width < 40 || height < 16 {
+		width, height = 80, 24
+	}
+
+	t.mu.Lock()
+	logLines := append([]string(nil), t.log...)
+	files := append([]string(nil), t.files...)
+	input := string(t.input)
+	t.mu.Unlock()
+
+	peers := t.node.Peers()
+	transfers := t.node.Transfers()
+
+	var up, down float64
+	for _, p := range t.node.PeerThroughput() {
+		up += p.UploadRate
+		down += p.DownloadRate
+	}
+
+	var lines []string
+	header := fmt.Sprintf(" p2p-storage  %s  %s   peers %d   files %d   up %s/s  down %s/s",
+		t.node.ID, t.node.Address(), len(peers), len(files), formatBytes(int64(up)), formatBytes(int64(down)))
+	lines = append(lines, "\x1b[7m"+fit(header, width)+"\x1b[0m")
+
+	// Peers and transfers side by side
+	paneHeight := (height - 8) / 3
+	leftWidth := width / 3
+	rightWidth := width - leftWidth - 1
+	left := []string{fmt.Sprintf(" PEERS (%d)", len(peers))}
+	for _, p := range peers {
+		left = append(left, fmt.Sprintf(" %s  %s  %s", p.ID, p.Address, p.UserAgent))
+	}
+	right := []string{fmt.Sprintf(" TRANSFERS (%d)", len(transfers))}
+	for _, tr := range transfers {
+		frac := 0.0
+		if tr.TotalBytes > 0 {
+			frac = float64(tr.BytesDone) / float64(tr.TotalBytes)
+		}
+		eta := "?"
+		if tr.ETA > 0 {
+			eta = tr.ETA.Round(time.Second).String()
+		}
+		right = append(right, fmt.Sprintf(" %-8s %s %s %3.0f%% %s/s ETA %s",
+			tr.Direction, shorten(tr.ContentHash, 12), bar(frac, 16), frac*100, formatBytes(int64(tr.Rate)), eta))
+	}
+	lines = append(lines, strings.Repeat("─", width))
+	for i := 0; i < paneHeight; i++ {
+		lines = append(lines, fit(at(left, i), leftWidth)+"│"+fit(at(right, i), rightWidth))
+	}
+
+	lines = append(lines, strings.Repeat("─", width))
+	lines = append(lines, fit(fmt.Sprintf(" FILES (%d)", len(files)), width))
+	for i := 0; i < paneHeight-1; i++ {
+		lines = append(lines, fit(" "+at(files, i), width))
+	}
+
+	lines = append(lines, strings.Repeat("─", width))
+	logHeight := height - len(lines) - 3
+	start := len(logLines) - logHeight
+	if start < 0 {
+		start = 0
+	}
+	for i := 0; i < logHeight; i++ {
+		lines = append(lines, fit(" "+at(logLines[start:], i), width))
+	}
+
+	lines = append(lines, strings.Repeat("─", width))
+	lines = append(lines, fit(" > "+input+"█", width))
+	lines = append(lines, "\x1b[2m"+fit(" Tab complete · Enter run · Esc clear · Ctrl-C quit", width)+"\x1b[0m")
+
+	fmt.Fprint(t.screen, "\x1b[H"+strings.Join(lines, "\r\n"))
+}
+
+func formatEvent(e node.Event) string {
+	parts := []string{e.Time.Format("15:04:05"), string(e.Type)}
+	if e.PeerID != "" {
+		parts = append(parts, "peer="+e.PeerID)
+	}
+	if e.ContentHash != "" {
+		parts = append(parts, "hash="+shorten(e.ContentHash, 12))
+	}
+	if e.Error != "" {
+		parts = append(parts, "error="+e.Error)
+	}
+	return strings.Join(parts, " ")
+}
+
+// fit truncates or pads s to exactly width runes
+func fit(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return s + strings.Repeat(" ", width-len(runes))
+}
+
+func at(lines []string, i int) string {
+	if i < len(lines) {
+		return lines[i]
+	}
+	return ""
+}
+
+func shorten(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
+
+func bar(frac float64, width int) string {
+	if frac < 0 {
+		frac = 0
+	}
+	if frac > 1 {
+		frac = 1
+	}
+	filled := int(frac * float64(width))
+	return "[" + strings.Repeat("#", filled) + strings.Repeat(".", width-filled) + "]"
+}
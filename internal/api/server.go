@@ -0,0 +1,351 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/node"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// eventWriteTimeout bounds how long a single event write may block
+	eventWriteTimeout = 10 * time.Second
+	// eventPingInterval keeps idle event streams alive through proxies
+	eventPingInterval = 30 * time.Second
+)
+
+// Server exposes the node's HTTP API: Prometheus metrics, a live event
+// stream and administration endpoints
+type Server struct {
+	node       *node.Node
+	mux        *http.ServeMux
+	upgrader   websocket.Upgrader
+	adminToken string
+	// origins are the browser origins, besides the API's own, allowed to
+	// open the event stream
+	origins map[string]bool
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithAdminToken requires requests to /admin/ endpoints to carry the token
+// as "Authorization: Bearer <token>"
+func WithAdminToken(token string) Option {
+	return func(s *Server) {
+		s.adminToken = token
+	}
+}
+
+// WithAllowedOrigins lets pages served from origins, such as
+// "https://dashboard.example.com", open the event stream. Pages from the
+// API's own host may always open it.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(s *Server) {
+		for _, origin := range origins {
+			if origin != "" {
+				s.origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+			}
+		}
+	}
+}
+
+// NewServer creates an HTTP API server for the given node
+func NewServer(n *node.Node, opts ...Option) *Server {
+	s := &Server{
+		node:    n,
+		mux:     http.NewServeMux(),
+		origins: make(map[string]bool),
+	}
+	s.upgrader.CheckOrigin = s.checkOrigin
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.mux.Handle("/metrics", n.Metrics())
+	s.mux.HandleFunc("/events", s.admin(s.handleEvents))
+	s.mux.HandleFunc("/admin/bans", s.admin(s.handleBans))
+	s.mux.HandleFunc("/admin/reload", s.admin(post(s.handleReload)))
+	s.mux.HandleFunc("/admin/gc", s.admin(post(s.handleGC)))
+	s.mux.HandleFunc("/admin/scrub", s.admin(post(s.handleScrub)))
+	s.mux.HandleFunc("/admin/log-level", s.admin(s.handleLogLevel))
+	s.mux.HandleFunc("/admin/rate-limits", s.admin(s.handleRateLimits))
+	s.mux.HandleFunc("/admin/state", s.admin(s.handleState))
+
+	return s
+}
+
+// admin rejects requests without the admin token, if one is set
+func (s *Server) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// checkOrigin admits event stream requests from programs, which send no
+// Origin, and from pages served by the API's own host or an allowed origin,
+// so that no other site a browser visits can read the node's events
+func (s *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if s.origins[strings.ToLower(origin)] {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// post rejects requests other than POST
+func post(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleEvents upgrades the request to a WebSocket and streams node events as JSON
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written an HTTP error response
+		return
+	}
+	defer conn.Close()
+
+	events, cancel := s.node.Subscribe()
+	defer cancel()
+
+	// Drain incoming frames so close and pong control messages are processed
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(eventPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			conn.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+			if err := conn.WriteJSON(event); err != nil {
+				fmt.Printf("Event stream to %s closed: %v\n", r.RemoteAddr, err)
+				return
+			}
+		case <-ticker.C:
+			deadline := time.Now().Add(eventWriteTimeout)
+			if err := conn.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// banRequest is the body of POST /admin/bans
+type banRequest struct {
+	Target   string `json:"target"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"` // Go duration such as "24h"; empty for a permanent ban
+}
+
+// handleBans lists bans (GET), adds one (POST) or lifts one (DELETE ?target=)
+func (s *Server) handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.node.Bans())
+
+	case http.MethodPost:
+		var req banRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		var duration time.Duration
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid duration: %v", err), http.StatusBadRequest)
+				return
+			}
+			duration = d
+		}
+		entry, err := s.node.Ban(req.Target, req.Reason, duration)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, entry)
+
+	case http.MethodDelete:
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "missing target", http.StatusBadRequest)
+			return
+		}
+		found, err := s.node.Unban(target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("%s is not banned", target), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleReload re-reads the node's configuration files
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	result, err := s.node.Reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleGC removes stale temporary files and frees unused memory
+func (s *Server) handleGC(w http.ResponseWriter, r *http.Request) {
+	result, err := s.node.GC()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleScrub verifies a fraction of the store (?fraction=, default all)
+// and returns the result once done
+func (s *Server) handleScrub(w http.ResponseWriter, r *http.Request) {
+	fraction := 1.0
+	if v := r.URL.Query().Get("fraction"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid fraction: %v", err), http.StatusBadRequest)
+			return
+		}
+		fraction = f
+	}
+	result, err := s.node.Scrub(fraction)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// logLevelRequest is the body of PUT /admin/log-level
+type logLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// handleLogLevel shows (GET) or changes (PUT) the log verbosity
+func (s *Server) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, logLevelRequest{Level: s.node.LogLevel().String()})
+
+	case http.MethodPut:
+		var req logLevelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		level, err := node.ParseLogLevel(req.Level)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.node.SetLogLevel(level)
+		writeJSON(w, http.StatusOK, logLevelRequest{Level: level.String()})
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRateLimits shows (GET) or changes (PUT) the bandwidth caps
+func (s *Server) handleRateLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.node.RateLimits())
+
+	case http.MethodPut:
+		var limits network.RateLimits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := s.node.SetRateLimits(limits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.node.RateLimits())
+
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleState dumps the node's internal state
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.node.State())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Printf("Failed to write response: %v\n", err)
+	}
+}
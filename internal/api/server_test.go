@@ -0,0 +1,324 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/node"
+
+	"github.com/gorilla/websocket"
+)
+
+func setupTestNode(t *testing.T) (*node.Node, func()) {
+	tmpDir, err := os.MkdirTemp("", "api-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+
+	n, err := node.NewNode("test-node", ":0",
+		filepath.Join(tmpDir, "store"),
+		filepath.Join(tmpDir, "watch"),
+		node.WithFirstNode(true),
+	)
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		t.Fatalf("Failed to create node: %v", err)
+	}
+
+	cleanup := func() {
+		n.Stop()
+		os.RemoveAll(tmpDir)
+	}
+	return n, cleanup
+}
+
+func TestServer_Metrics(t *testing.T) {
+	n, cleanup := setupTestNode(t)
+	defer cleanup()
+
+	server := httptest.NewServer(NewServer(n))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to get metrics: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Status = %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+}
+
+func TestServer_Events(t *testing.T) {
+	n, cleanup := setupTestNode(t)
+	defer cleanup()
+
+	server := httptest.NewServer(NewServer(n))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/events"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial event stream: %v", err)
+	}
+	defer conn.Close()
+
+	// Give the handler a moment to subscribe before triggering an event
+	time.Sleep(50 * time.Millisecond)
+
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(path, []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	hash, err := n.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event node.Event
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("Failed to read event: %v", err)
+	}
+
+	if event.Type != node.EventFileStored {
+		t.Errorf("Event type = %v, want %v", event.Type, node.EventFileStored)
+	}
+	if event.ContentHash != hash {
+		t.Errorf("Event hash = %v, want %v", event.ContentHash, hash)
+	}
+}
+
+func TestServer_EventsOrigin(t *testing.T) {
+	n, cleanup := setupTestNode(t)
+	defer cleanup()
+
+	server := httptest.NewServer(NewServer(n, WithAllowedOrigins("https://dashboard.example.com")))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/events"
+	tests := []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{server.URL, true},
+		{"https://dashboard.example.com", true},
+		{"https://evil.example.com", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("Origin %q: error = %v, want ok %v", tt.origin, err, tt.ok)
+		}
+		if !tt.ok && resp != nil && resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Origin %q: status = %v, want %v", tt.origin, resp.StatusCode, http.StatusForbidden)
+		}
+	}
+}
+
+func TestServer_Bans(t *testing.T) {
+	n, cleanup := setupTestNode(t)
+	defer cleanup()
+
+	server := httptest.NewServer(NewServer(n))
+	defer server.Close()
+	url := server.URL + "/admin/bans"
+
+	body := strings.NewReader(`{"target": "bad-node", "reason": "spam", "duration": "1h"}`)
+	resp, err := http.Post(url, "application/json", body)
+	if err != nil {
+		t.Fatalf("Failed to add ban: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("POST status = %v, want %v", resp.StatusCode, http.StatusCreated)
+	}
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to list bans: %v", err)
+	}
+	var bans []node.BanEntry
+	err = json.NewDecoder(resp.Body).Decode(&bans)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to decode bans: %v", err)
+	}
+	if len(bans) != 1 || bans[0].Target != "bad-node" || bans[0].Reason != "spam" || bans[0].Permanent() {
+		t.Errorf("bans = %+v, want one expiring ban of bad-node", bans)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, url+"?target=bad-node", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to lift ban: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE status = %v, want %v", resp.StatusCode, http.StatusNoContent)
+	}
+	if len(n.Bans()) != 0 {
+		t.Errorf("Bans() = %v after DELETE, want none", n.Bans())
+	}
+
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to lift ban: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Second DELETE status = %v, want %v", resp.StatusCode, http.StatusNotFound)
+	}
+}
+
+func TestServer_AdminToken(t *testing.T) {
+	n, cleanup := setupTestNode(t)
+	defer cleanup()
+
+	server := httptest.NewServer(NewServer(n, WithAdminToken("secret")))
+	defer server.Close()
+
+	do := func(method, path, token, body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to request %s: %v", path, err)
+		}
+		return resp
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		resp := do(http.MethodGet, "/admin/state", token, "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Status with token %q = %v, want %v", token, resp.StatusCode, http.StatusUnauthorized)
+		}
+	}
+
+	// Metrics stay open
+	resp := do(http.MethodGet, "/metrics", "", "")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/metrics status = %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+
+	// The event stream needs the token
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/events"
+	if conn, resp, err := websocket.DefaultDialer.Dial(wsURL, nil); err == nil {
+		conn.Close()
+		t.Error("Event stream opened without the token")
+	} else if resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Event stream without token: error = %v, want %v", err, http.StatusUnauthorized)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Authorization": {"Bearer secret"}})
+	if err != nil {
+		t.Fatalf("Failed to dial event stream with the token: %v", err)
+	}
+	conn.Close()
+
+	resp = do(http.MethodGet, "/admin/state", "secret", "")
+	var state node.StateDump
+	err = json.NewDecoder(resp.Body).Decode(&state)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to decode state: %v", err)
+	}
+	if state.ID != "test-node" || !state.FirstNode {
+		t.Errorf("state = %+v, want test-node as first node", state)
+	}
+
+	resp = do(http.MethodPut, "/admin/log-level", "secret", `{"level": "debug"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || n.LogLevel() != node.LogDebug {
+		t.Errorf("PUT log-level = %v, level %v, want %v, debug", resp.StatusCode, n.LogLevel(), http.StatusOK)
+	}
+	resp = do(http.MethodPut, "/admin/log-level", "secret", `{"level": "loud"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PUT invalid log-level status = %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	for _, path := range []string{"/admin/reload", "/admin/gc", "/admin/scrub?fraction=0.5"} {
+		resp = do(http.MethodGet, path, "secret", "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Errorf("GET %s status = %v, want %v", path, resp.StatusCode, http.StatusMethodNotAllowed)
+		}
+		resp = do(http.MethodPost, path, "secret", "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("POST %s status = %v, want %v", path, resp.StatusCode, http.StatusOK)
+		}
+	}
+}
+
+func TestServer_RateLimits(t *testing.T) {
+	n, cleanup := setupTestNode(t)
+	defer cleanup()
+
+	server := httptest.NewServer(NewServer(n))
+	defer server.Close()
+	url := server.URL + "/admin/rate-limits"
+
+	put := func(body string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to set rate limits: %v", err)
+		}
+		return resp
+	}
+
+	resp := put(`{"upload": 1048576, "peer_download": 65536}`)
+	var limits network.RateLimits
+	err := json.NewDecoder(resp.Body).Decode(&limits)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to decode rate limits: %v", err)
+	}
+	want := network.RateLimits{Upload: 1 << 20, PeerDownload: 64 << 10}
+	if limits != want || n.RateLimits() != want {
+		t.Errorf("rate limits = %+v, node has %+v, want %+v", limits, n.RateLimits(), want)
+	}
+
+	resp = put(`{"upload": -1}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("PUT of a negative rate status = %v, want %v", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	resp, err = http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to get rate limits: %v", err)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&limits)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Failed to decode rate limits: %v", err)
+	}
+	if limits != want {
+		t.Errorf("GET rate limits = %+v, want %+v", limits, want)
+	}
+}
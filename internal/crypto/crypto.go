@@ -48,20 +48,29 @@ func ContentHash(r io.Reader) (string, error) {
 
 // EncryptStream encrypts data from reader and writes to writer using AES-CTR
 func EncryptStream(key Key, r io.Reader, w io.Writer) error {
+	iv, err := GenerateIV()
+	if err != nil {
+		return err
+	}
+	return EncryptStreamWithIV(key, iv, r, w)
+}
+
+// EncryptStreamWithIV encrypts like EncryptStream with a given IV. Encrypting
+// the same plaintext with the same key and IV reproduces the same ciphertext.
+func EncryptStreamWithIV(key Key, iv []byte, r io.Reader, w io.Writer) error {
 	if len(key) != KeySize {
 		return fmt.Errorf("invalid key size: expected %d, got %d", KeySize, len(key))
 	}
+	if len(iv) != IVSize {
+		return fmt.Errorf("invalid IV size: expected %d, got %d", IVSize, len(iv))
+	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return fmt.Errorf("failed to create cipher: %w", err)
 	}
 
-	// Generate and write IV
-	iv, err := GenerateIV()
-	if err != nil {
-		return err
-	}
+	// Write IV
 	if _, err := w.Write(iv); err != nil {
 		return fmt.Errorf("failed to write IV: %w", err)
 	}
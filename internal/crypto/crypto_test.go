@@ -161,6 +161,35 @@ func TestEncryptStreamInvalidKey(t *testing.T) {
 	}
 }
 
+func TestEncryptStreamWithIV(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	iv, err := GenerateIV()
+	if err != nil {
+		t.Fatalf("Failed to generate IV: %v", err)
+	}
+
+	var first, second bytes.Buffer
+	if err := EncryptStreamWithIV(key, iv, strings.NewReader("same plaintext"), &first); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	if err := EncryptStreamWithIV(key, iv, strings.NewReader("same plaintext"), &second); err != nil {
+		t.Fatalf("Failed to encrypt: %v", err)
+	}
+	if !bytes.Equal(first.Bytes(), second.Bytes()) {
+		t.Error("Encrypting with the same IV produced different ciphertexts")
+	}
+	if !bytes.HasPrefix(first.Bytes(), iv) {
+		t.Error("Ciphertext does not start with the IV")
+	}
+
+	if err := EncryptStreamWithIV(key, iv[:IVSize-1], strings.NewReader("test"), &first); err == nil {
+		t.Error("Expected error for invalid IV size, got nil")
+	}
+}
+
 func TestDecryptStreamInvalidKey(t *testing.T) {
 	invalidKey := make([]byte, KeySize-1) // Invalid key size
 	reader := strings.NewReader("test")
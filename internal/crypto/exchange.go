@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// exchangeContext prefixes signed exchange keys so a signature made for a
+// key exchange can't be passed off as any other signature
+const exchangeContext = "p2p-storage key exchange\x00"
+
+// ErrUnwrapKey is returned when a wrapped key can't be opened, because it
+// was wrapped for another key pair, with another context or was altered
+var ErrUnwrapKey = errors.New("failed to unwrap key")
+
+// ExchangeKey is an X25519 key pair for agreeing on a key with a peer. It is
+// not stored; a node generates a new one each time it starts.
+type ExchangeKey struct {
+	private *ecdh.PrivateKey
+}
+
+// GenerateExchangeKey generates a new X25519 key pair
+func GenerateExchangeKey() (*ExchangeKey, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate exchange key: %w", err)
+	}
+	return &ExchangeKey{private: private}, nil
+}
+
+// Public returns the public half of the key pair
+func (k *ExchangeKey) Public() []byte {
+	return k.private.PublicKey().Bytes()
+}
+
+// WrapKey encrypts key so that only the holder of the private half of
+// peerPublic can read it. context binds the result to its use, such as the
+// sender and recipient; UnwrapKey must be given the same context.
+func (k *ExchangeKey) WrapKey(key Key, peerPublic, context []byte) ([]byte, error) {
+	aead, err := k.keyWrapCipher(peerPublic, context)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, key, context), nil
+}
+
+// UnwrapKey decrypts a key wrapped by the holder of peerPublic with WrapKey
+func (k *ExchangeKey) UnwrapKey(wrapped, peerPublic, context []byte) (Key, error) {
+	aead, err := k.keyWrapCipher(peerPublic, context)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrUnwrapKey
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	key, err := aead.Open(nil, nonce, sealed, context)
+	if err != nil || len(key) != KeySize {
+		return nil, ErrUnwrapKey
+	}
+	return key, nil
+}
+
+// SharedKey derives a 32-byte key shared with the holder of peerPublic for
+// context; both sides arrive at the same key given the same context
+func (k *ExchangeKey) SharedKey(peerPublic, context []byte) ([]byte, error) {
+	public, err := ecdh.X25519().NewPublicKey(peerPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exchange key: %w", err)
+	}
+	shared, err := k.private.ECDH(public)
+	if err != nil {
+		return nil, fmt.Errorf("key agreement failed: %w", err)
+	}
+
+	h := sha256.New()
+	h.Write([]byte(exchangeContext))
+	h.Write(shared)
+	h.Write(context)
+	return h.Sum(nil), nil
+}
+
+// keyWrapCipher derives the AES-256-GCM cipher shared with the holder of
+// peerPublic for context
+func (k *ExchangeKey) keyWrapCipher(peerPublic, context []byte) (cipher.AEAD, error) {
+	key, err := k.SharedKey(peerPublic, context)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// SignExchangeKey signs an exchange public key with the identity key, so
+// peers know the exchange key belongs to this identity
+func (i *Identity) SignExchangeKey(public []byte) []byte {
+	return i.Sign(append([]byte(exchangeContext), public...))
+}
+
+// VerifyExchangeKey reports whether sig is a signature of the exchange key
+// public by the identity key identity
+func VerifyExchangeKey(identity, public, sig []byte) bool {
+	return Verify(identity, append([]byte(exchangeContext), public...), sig)
+}
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestExchangeKeyWrapUnwrap(t *testing.T) {
+	sender, err := GenerateExchangeKey()
+	if err != nil {
+		t.Fatalf("Failed to generate exchange key: %v", err)
+	}
+	recipient, err := GenerateExchangeKey()
+	if err != nil {
+		t.Fatalf("Failed to generate exchange key: %v", err)
+	}
+	eavesdropper, err := GenerateExchangeKey()
+	if err != nil {
+		t.Fatalf("Failed to generate exchange key: %v", err)
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	context := []byte("a to b")
+
+	wrapped, err := sender.WrapKey(key, recipient.Public(), context)
+	if err != nil {
+		t.Fatalf("Failed to wrap key: %v", err)
+	}
+	if bytes.Contains(wrapped, key) {
+		t.Error("Wrapped key contains the key in the clear")
+	}
+
+	got, err := recipient.UnwrapKey(wrapped, sender.Public(), context)
+	if err != nil {
+		t.Fatalf("Failed to unwrap key: %v", err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Error("Unwrapped key differs from the original")
+	}
+
+	tampered := append([]byte(nil), wrapped...)
+	tampered[len(tampered)-1] ^= 1
+	for _, tc := range []struct {
+		name    string
+		by      *ExchangeKey
+		wrapped []byte
+		from    []byte
+		context []byte
+	}{
+		{"another key pair", eavesdropper, wrapped, sender.Public(), context},
+		{"another context", recipient, wrapped, sender.Public(), []byte("c to b")},
+		{"another sender", recipient, wrapped, eavesdropper.Public(), context},
+		{"altered", recipient, tampered, sender.Public(), context},
+		{"truncated", recipient, wrapped[:4], sender.Public(), context},
+	} {
+		if _, err := tc.by.UnwrapKey(tc.wrapped, tc.from, tc.context); !errors.Is(err, ErrUnwrapKey) {
+			t.Errorf("%s: UnwrapKey error = %v, want %v", tc.name, err, ErrUnwrapKey)
+		}
+	}
+
+	if _, err := sender.WrapKey(key, []byte("short"), context); err == nil {
+		t.Error("Expected error for a malformed exchange key")
+	}
+}
+
+func TestSignExchangeKey(t *testing.T) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	exchange, err := GenerateExchangeKey()
+	if err != nil {
+		t.Fatalf("Failed to generate exchange key: %v", err)
+	}
+	other, err := GenerateExchangeKey()
+	if err != nil {
+		t.Fatalf("Failed to generate exchange key: %v", err)
+	}
+
+	sig := id.SignExchangeKey(exchange.Public())
+	if !VerifyExchangeKey(id.Public, exchange.Public(), sig) {
+		t.Error("Valid exchange key signature rejected")
+	}
+	if VerifyExchangeKey(id.Public, other.Public(), sig) {
+		t.Error("Signature accepted for another exchange key")
+	}
+	// A plain signature of the key is not an exchange key signature
+	if VerifyExchangeKey(id.Public, exchange.Public(), id.Sign(exchange.Public())) {
+		t.Error("Signature made outside the key exchange accepted")
+	}
+}
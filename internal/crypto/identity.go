@@ -0,0 +1,115 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Identity is a node's long-term Ed25519 signing key pair. Unlike the
+// network encryption key it is unique to each node and survives restarts.
+type Identity struct {
+	Public  ed25519.PublicKey
+	private ed25519.PrivateKey
+}
+
+// GenerateIdentity creates a new random identity
+func GenerateIdentity() (*Identity, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate identity: %w", err)
+	}
+	return &Identity{Public: public, private: private}, nil
+}
+
+// LoadOrCreateIdentity reads the identity stored at path, generating and
+// saving a new one if the file does not exist. The file holds the hex
+// encoded private key seed and is readable only by its owner.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid identity key in %s", path)
+		}
+		private := ed25519.NewKeyFromSeed(seed)
+		return &Identity{Public: private.Public().(ed25519.PublicKey), private: private}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read identity: %w", err)
+	}
+
+	id, err := GenerateIdentity()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to save identity: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(id.private.Seed())+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save identity: %w", err)
+	}
+	return id, nil
+}
+
+// Sign signs data with the identity's private key
+func (i *Identity) Sign(data []byte) []byte {
+	return ed25519.Sign(i.private, data)
+}
+
+// Fingerprint returns a short, printable digest of the public key
+func (i *Identity) Fingerprint() string {
+	return Fingerprint(i.Public)
+}
+
+// Fingerprint returns a short, printable digest of a public key
+func Fingerprint(public []byte) string {
+	sum := sha256.Sum256(public)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Verify reports whether sig is a valid signature of data by public
+func Verify(public, data, sig []byte) bool {
+	if len(public) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(public, data, sig)
+}
+
+// Certificate returns a self-signed TLS certificate for the identity key,
+// so peers can bind a TLS connection to the identity in its handshake. The
+// certificate is generated anew each time; only its key is long-lived.
+func (i *Identity) Certificate() (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: i.Fingerprint()},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, i.Public, i.private)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: i.private, Leaf: leaf}, nil
+}
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+
+	id, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Identity was not saved: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Identity file mode = %v, want 0600", perm)
+	}
+
+	reloaded, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatalf("Failed to reload identity: %v", err)
+	}
+	if !bytes.Equal(id.Public, reloaded.Public) {
+		t.Error("Reloaded identity has a different public key")
+	}
+	if id.Fingerprint() != reloaded.Fingerprint() || len(id.Fingerprint()) != 16 {
+		t.Errorf("Fingerprint = %q, want a stable 16 character digest", id.Fingerprint())
+	}
+}
+
+func TestLoadOrCreateIdentityInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "identity.key")
+	if err := os.WriteFile(path, []byte("not a key"), 0600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := LoadOrCreateIdentity(path); err == nil {
+		t.Error("Expected error for an invalid identity file")
+	}
+}
+
+func TestIdentitySignVerify(t *testing.T) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	other, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	data := []byte("receipt")
+	sig := id.Sign(data)
+	if !Verify(id.Public, data, sig) {
+		t.Error("Valid signature rejected")
+	}
+	if Verify(other.Public, data, sig) {
+		t.Error("Signature accepted for the wrong key")
+	}
+	if Verify(id.Public, []byte("tampered"), sig) {
+		t.Error("Signature accepted for different data")
+	}
+	if Verify([]byte("short"), data, sig) {
+		t.Error("Signature accepted for a malformed key")
+	}
+}
+
+func TestIdentityCertificate(t *testing.T) {
+	id, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	cert, err := id.Certificate()
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	leaf := cert.Leaf
+	if key, ok := leaf.PublicKey.(ed25519.PublicKey); !ok || !bytes.Equal(key, id.Public) {
+		t.Error("Certificate is not for the identity key")
+	}
+	if leaf.Subject.CommonName != id.Fingerprint() {
+		t.Errorf("CommonName = %q, want %q", leaf.Subject.CommonName, id.Fingerprint())
+	}
+	if err := leaf.CheckSignature(leaf.SignatureAlgorithm, leaf.RawTBSCertificate, leaf.Signature); err != nil {
+		t.Errorf("Certificate is not self-signed: %v", err)
+	}
+}
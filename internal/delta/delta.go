@@ -0,0 +1,310 @@
+// Package delta computes and applies rsync-style binary deltas. The holder
+// of an old version of a file describes its blocks with a Signature; the
+// holder of the new version expresses it as copies of those blocks plus
+// literal data, so only the changed parts have to be sent.
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// MinBlockSize and MaxBlockSize bound the block size picked by BlockSize
+	MinBlockSize = 1 << 10
+	MaxBlockSize = 64 << 10
+
+	strongSize = 16
+	blockBytes = 4 + strongSize // encoded size of one block signature
+
+	opCopy    byte = 'C'
+	opLiteral byte = 'L'
+)
+
+// ErrCorrupt is returned when decoding malformed signatures or deltas
+var ErrCorrupt = errors.New("corrupt delta encoding")
+
+// BlockSize picks a block size for a file of the given size: about its
+// square root, as rsync does, rounded to whole KiB
+func BlockSize(size int64) int {
+	bs := int(math.Sqrt(float64(size))) &^ (MinBlockSize - 1)
+	if bs < MinBlockSize {
+		return MinBlockSize
+	}
+	if bs > MaxBlockSize {
+		return MaxBlockSize
+	}
+	return bs
+}
+
+// Block is the signature of one block of the old version
+type Block struct {
+	Weak   uint32
+	Strong [strongSize]byte
+}
+
+// Signature describes the blocks of the old version of a file
+type Signature struct {
+	BlockSize int
+	Size      int64 // size of the old version
+	Blocks    []Block
+}
+
+// Sign reads the old version of a file and computes its signature
+func Sign(r io.Reader, blockSize int) (*Signature, error) {
+	if blockSize <= 0 {
+		return nil, fmt.Errorf("invalid block size %d", blockSize)
+	}
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, Block{Weak: weakSum(buf[:n]), Strong: strongSum(buf[:n])})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+	}
+}
+
+// MarshalBinary encodes the signature
+func (s *Signature) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 16, 16+len(s.Blocks)*blockBytes)
+	binary.BigEndian.PutUint32(buf[0:], uint32(s.BlockSize))
+	binary.BigEndian.PutUint64(buf[4:], uint64(s.Size))
+	binary.BigEndian.PutUint32(buf[12:], uint32(len(s.Blocks)))
+	for _, b := range s.Blocks {
+		buf = binary.BigEndian.AppendUint32(buf, b.Weak)
+		buf = append(buf, b.Strong[:]...)
+	}
+	return buf, nil
+}
+
+// ParseSignature decodes a signature encoded with MarshalBinary
+func ParseSignature(data []byte) (*Signature, error) {
+	if len(data) < 16 {
+		return nil, ErrCorrupt
+	}
+	sig := &Signature{
+		BlockSize: int(binary.BigEndian.Uint32(data[0:])),
+		Size:      int64(binary.BigEndian.Uint64(data[4:])),
+	}
+	count := int(binary.BigEndian.Uint32(data[12:]))
+	data = data[16:]
+	if sig.BlockSize < 1 || sig.BlockSize > MaxBlockSize || sig.Size < 0 || len(data) != count*blockBytes {
+		return nil, ErrCorrupt
+	}
+	if blocks := (sig.Size + int64(sig.BlockSize) - 1) / int64(sig.BlockSize); blocks != int64(count) {
+		return nil, ErrCorrupt
+	}
+	sig.Blocks = make([]Block, count)
+	for i := range sig.Blocks {
+		sig.Blocks[i].Weak = binary.BigEndian.Uint32(data)
+		copy(sig.Blocks[i].Strong[:], data[4:blockBytes])
+		data = data[blockBytes:]
+	}
+	return sig, nil
+}
+
+// Op is one instruction for rebuilding the new version: either a run of
+// Count blocks of the old version starting at block Start, or literal Data
+type Op struct {
+	Start int
+	Count int
+	Data  []byte
+}
+
+// Compute expresses target as blocks of the old version described by sig
+// and literal data. Only full-size blocks are matched.
+func Compute(sig *Signature, target []byte) []Op {
+	bs := sig.BlockSize
+	full := len(sig.Blocks)
+	if sig.Size%int64(bs) != 0 {
+		full-- // the last block is short
+	}
+	index := make(map[uint32][]int, full)
+	for i := 0; i < full; i++ {
+		index[sig.Blocks[i].Weak] = append(index[sig.Blocks[i].Weak], i)
+	}
+
+	var ops []Op
+	literal := 0 // start of pending literal data
+	emitCopy := func(block int) {
+		if last := len(ops) - 1; last >= 0 && ops[last].Data == nil && ops[last].Start+ops[last].Count == block {
+			ops[last].Count++
+			return
+		}
+		ops = append(ops, Op{Start: block, Count: 1})
+	}
+	flush := func(end int) {
+		if end > literal {
+			ops = append(ops, Op{Data: target[literal:end]})
+		}
+	}
+
+	if len(index) > 0 && len(target) >= bs {
+		var r rolling
+		r.init(target[:bs])
+		for i := 0; i+bs <= len(target); {
+			if block, ok := match(index, sig.Blocks, r.sum(), target[i:i+bs]); ok {
+				flush(i)
+				emitCopy(block)
+				i += bs
+				literal = i
+				if i+bs <= len(target) {
+					r.init(target[i : i+bs])
+				}
+				continue
+			}
+			if i+bs < len(target) {
+				r.roll(target[i], target[i+bs])
+			}
+			i++
+		}
+	}
+	flush(len(target))
+	return ops
+}
+
+func match(index map[uint32][]int, blocks []Block, weak uint32, data []byte) (int, bool) {
+	candidates, ok := index[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := strongSum(data)
+	for _, i := range candidates {
+		if blocks[i].Strong == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// LiteralBytes returns how many bytes of ops are sent as literal data
+func LiteralBytes(ops []Op) int64 {
+	var total int64
+	for _, op := range ops {
+		total += int64(len(op.Data))
+	}
+	return total
+}
+
+// EncodeOps serializes a delta
+func EncodeOps(ops []Op) []byte {
+	var buf []byte
+	for _, op := range ops {
+		if op.Data != nil {
+			buf = append(buf, opLiteral)
+			buf = binary.AppendUvarint(buf, uint64(len(op.Data)))
+			buf = append(buf, op.Data...)
+			continue
+		}
+		buf = append(buf, opCopy)
+		buf = binary.AppendUvarint(buf, uint64(op.Start))
+		buf = binary.AppendUvarint(buf, uint64(op.Count))
+	}
+	return buf
+}
+
+// DecodeOps parses a delta serialized with EncodeOps
+func DecodeOps(data []byte) ([]Op, error) {
+	var ops []Op
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		kind, _ := r.ReadByte()
+		switch kind {
+		case opLiteral:
+			n, err := binary.ReadUvarint(r)
+			if err != nil || n > uint64(r.Len()) {
+				return nil, ErrCorrupt
+			}
+			lit := make([]byte, n)
+			if _, err := io.ReadFull(r, lit); err != nil {
+				return nil, ErrCorrupt
+			}
+			ops = append(ops, Op{Data: lit})
+		case opCopy:
+			start, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, ErrCorrupt
+			}
+			count, err := binary.ReadUvarint(r)
+			if err != nil || count == 0 || start > math.MaxInt32 || count > math.MaxInt32 {
+				return nil, ErrCorrupt
+			}
+			ops = append(ops, Op{Start: int(start), Count: int(count)})
+		default:
+			return nil, ErrCorrupt
+		}
+	}
+	return ops, nil
+}
+
+// Apply rebuilds the new version from the old one and writes it to w
+func Apply(old io.ReaderAt, sig *Signature, ops []Op, w io.Writer) error {
+	bs := int64(sig.BlockSize)
+	for _, op := range ops {
+		if op.Data != nil {
+			if _, err := w.Write(op.Data); err != nil {
+				return err
+			}
+			continue
+		}
+		offset, length := int64(op.Start)*bs, int64(op.Count)*bs
+		if offset+length > sig.Size {
+			return fmt.Errorf("copy of blocks %d-%d is past the end of the old version", op.Start, op.Start+op.Count)
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(old, offset, length)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// weakSum is the rsync rolling checksum of a block
+func weakSum(data []byte) uint32 {
+	var r rolling
+	r.init(data)
+	return r.sum()
+}
+
+func strongSum(data []byte) [strongSize]byte {
+	sum := sha256.Sum256(data)
+	var strong [strongSize]byte
+	copy(strong[:], sum[:])
+	return strong
+}
+
+// rolling is a checksum over a window that can be moved one byte at a time
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func (r *rolling) init(data []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(data))
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += uint32(len(data)-i) * uint32(c)
+	}
+}
+
+// roll moves the window one byte forward, dropping out and adding in
+func (r *rolling) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r *rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
@@ -0,0 +1,105 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func roundTrip(t *testing.T, old, target []byte, blockSize int) []Op {
+	t.Helper()
+	sig, err := Sign(bytes.NewReader(old), blockSize)
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	encoded, err := sig.MarshalBinary()
+	if err != nil {
+		t.Fatalf("Failed to encode signature: %v", err)
+	}
+	if sig, err = ParseSignature(encoded); err != nil {
+		t.Fatalf("Failed to parse signature: %v", err)
+	}
+
+	ops, err := DecodeOps(EncodeOps(Compute(sig, target)))
+	if err != nil {
+		t.Fatalf("Failed to decode delta: %v", err)
+	}
+	var out bytes.Buffer
+	if err := Apply(bytes.NewReader(old), sig, ops, &out); err != nil {
+		t.Fatalf("Failed to apply delta: %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), target) {
+		t.Fatalf("Applied delta does not reproduce the target (%d bytes, want %d)", out.Len(), len(target))
+	}
+	return ops
+}
+
+func TestDelta_RoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	old := make([]byte, 64<<10)
+	rng.Read(old)
+	const bs = 1024
+
+	// Appended data is sent literally; everything before it is copied
+	appended := append(append([]byte(nil), old...), []byte("new log lines")...)
+	ops := roundTrip(t, old, appended, bs)
+	if got := LiteralBytes(ops); got != 13 {
+		t.Errorf("Append: LiteralBytes = %d, want 13", got)
+	}
+	if len(ops) != 2 {
+		t.Errorf("Append: %d ops, want one copy and one literal", len(ops))
+	}
+
+	// An insertion shifts everything after it; the rolling checksum realigns
+	edited := append(append(append([]byte(nil), old[:10000]...), []byte("inserted")...), old[10000:]...)
+	if got := LiteralBytes(roundTrip(t, old, edited, bs)); got > 2*bs {
+		t.Errorf("Insert: LiteralBytes = %d, want at most %d", got, 2*bs)
+	}
+
+	// Unrelated content and empty files still round-trip
+	other := make([]byte, 5000)
+	rng.Read(other)
+	if got := LiteralBytes(roundTrip(t, old, other, bs)); got != int64(len(other)) {
+		t.Errorf("Unrelated: LiteralBytes = %d, want %d", got, len(other))
+	}
+	roundTrip(t, nil, other, bs)
+	roundTrip(t, old, nil, bs)
+}
+
+func TestDelta_Corrupt(t *testing.T) {
+	if _, err := ParseSignature([]byte{1, 2, 3}); err != ErrCorrupt {
+		t.Errorf("ParseSignature(short) error = %v, want %v", err, ErrCorrupt)
+	}
+	if _, err := DecodeOps([]byte{opLiteral, 10, 'x'}); err != ErrCorrupt {
+		t.Errorf("DecodeOps(truncated literal) error = %v, want %v", err, ErrCorrupt)
+	}
+	if _, err := DecodeOps([]byte{'?'}); err != ErrCorrupt {
+		t.Errorf("DecodeOps(unknown op) error = %v, want %v", err, ErrCorrupt)
+	}
+
+	sig, err := Sign(bytes.NewReader(make([]byte, 2048)), 1024)
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	var out bytes.Buffer
+	if err := Apply(bytes.NewReader(make([]byte, 2048)), sig, []Op{{Start: 1, Count: 2}}, &out); err == nil {
+		t.Error("Expected error copying past the end of the old version")
+	}
+}
+
+func TestBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, MinBlockSize},
+		{100 << 10, MinBlockSize},
+		{16 << 20, 4096},
+		{64 << 30, MaxBlockSize},
+	}
+	for _, tt := range tests {
+		if got := BlockSize(tt.size); got != tt.want {
+			t.Errorf("BlockSize(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
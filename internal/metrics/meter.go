@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultMeterWindow is the span over which meters average their rate
+const DefaultMeterWindow = 10 * time.Second
+
+type meterSample struct {
+	at time.Time
+	n  int64
+}
+
+// Meter tracks a rolling per-second rate (e.g. bytes/s) over a time window
+type Meter struct {
+	mu      sync.Mutex
+	window  time.Duration
+	start   time.Time
+	samples []meterSample
+	total   int64
+	now     func() time.Time
+}
+
+// NewMeter creates a meter averaging over the given window
+func NewMeter(window time.Duration) *Meter {
+	if window <= 0 {
+		window = DefaultMeterWindow
+	}
+	return &Meter{
+		window: window,
+		start:  time.Now(),
+		now:    time.Now,
+	}
+}
+
+// Mark records n units at the current time
+func (m *Meter) Mark(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.total += n
+	m.samples = append(m.samples, meterSample{at: now, n: n})
+	m.prune(now)
+}
+
+// Total returns the number of units recorded since the meter was created
+func (m *Meter) Total() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+// Rate returns the average units per second over the meter's window
+func (m *Meter) Rate() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	m.prune(now)
+
+	// Young meters average over their lifetime instead of the full window
+	span := now.Sub(m.start)
+	if span > m.window {
+		span = m.window
+	}
+	if span < time.Second {
+		span = time.Second
+	}
+
+	var sum int64
+	for _, s := range m.samples {
+		sum += s.n
+	}
+	return float64(sum) / span.Seconds()
+}
+
+// prune drops samples that have fallen out of the window
+func (m *Meter) prune(now time.Time) {
+	cutoff := now.Add(-m.window)
+	i := 0
+	for i < len(m.samples) && m.samples[i].at.Before(cutoff) {
+		i++
+	}
+	m.samples = m.samples[i:]
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeter_Rate(t *testing.T) {
+	now := time.Now()
+	meter := NewMeter(10 * time.Second)
+	meter.start = now
+	meter.now = func() time.Time { return now }
+
+	// 4000 bytes over the first 4 seconds
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		meter.Mark(1000)
+	}
+
+	if rate := meter.Rate(); rate != 1000 {
+		t.Errorf("Rate() = %v, want %v", rate, 1000)
+	}
+	if total := meter.Total(); total != 4000 {
+		t.Errorf("Total() = %v, want %v", total, 4000)
+	}
+
+	// Once samples fall out of the window the rate drops to zero
+	now = now.Add(30 * time.Second)
+	if rate := meter.Rate(); rate != 0 {
+		t.Errorf("Rate() after window = %v, want %v", rate, 0)
+	}
+	if total := meter.Total(); total != 4000 {
+		t.Errorf("Total() after window = %v, want %v", total, 4000)
+	}
+}
@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Kind is the Prometheus metric type
+type Kind string
+
+const (
+	KindCounter Kind = "counter"
+	KindGauge   Kind = "gauge"
+)
+
+// Sample is a single metric value with optional labels
+type Sample struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v atomic.Int64
+}
+
+// Add increases the counter by delta
+func (c *Counter) Add(delta int64) {
+	c.v.Add(delta)
+}
+
+// Inc increases the counter by one
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Value returns the current counter value
+func (c *Counter) Value() int64 {
+	return c.v.Load()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	v atomic.Int64
+}
+
+// Set sets the gauge value
+func (g *Gauge) Set(v int64) {
+	g.v.Store(v)
+}
+
+// Add adjusts the gauge by delta
+func (g *Gauge) Add(delta int64) {
+	g.v.Add(delta)
+}
+
+// Value returns the current gauge value
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+type metric struct {
+	name    string
+	help    string
+	kind    Kind
+	collect func() []Sample
+}
+
+// Registry holds a set of named metrics and renders them in the
+// Prometheus text exposition format
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]*metric
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		metrics: make(map[string]*metric),
+	}
+}
+
+// Counter registers and returns a new counter
+func (r *Registry) Counter(name, help string) *Counter {
+	c := &Counter{}
+	r.Register(name, help, KindCounter, func() []Sample {
+		return []Sample{{Value: float64(c.Value())}}
+	})
+	return c
+}
+
+// Gauge registers and returns a new gauge
+func (r *Registry) Gauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.Register(name, help, KindGauge, func() []Sample {
+		return []Sample{{Value: float64(g.Value())}}
+	})
+	return g
+}
+
+// Register adds a metric whose samples are computed on demand by collect.
+// Registering the same name twice replaces the earlier metric.
+func (r *Registry) Register(name, help string, kind Kind, collect func() []Sample) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics[name] = &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		collect: collect,
+	}
+}
+
+// Snapshot returns the current value of every sample keyed by its
+// rendered name (including labels)
+func (r *Registry) Snapshot() map[string]float64 {
+	snapshot := make(map[string]float64)
+	for _, m := range r.sorted() {
+		for _, s := range m.collect() {
+			snapshot[m.name+formatLabels(s.Labels)] = s.Value
+		}
+	}
+	return snapshot
+}
+
+// WriteText writes all metrics in the Prometheus text format
+func (r *Registry) WriteText(w io.Writer) error {
+	for _, m := range r.sorted() {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind); err != nil {
+			return err
+		}
+		for _, s := range m.collect() {
+			if _, err := fmt.Fprintf(w, "%s%s %g\n", m.name, formatLabels(s.Labels), s.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ServeHTTP implements http.Handler so the registry can be mounted at /metrics
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := r.WriteText(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (r *Registry) sorted() []*metric {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	metrics := make([]*metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		metrics = append(metrics, m)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name < metrics[j].name
+	})
+	return metrics
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[k])
+		parts = append(parts, fmt.Sprintf("%s=%q", k, v))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
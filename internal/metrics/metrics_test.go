@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteText(t *testing.T) {
+	registry := NewRegistry()
+
+	counter := registry.Counter("test_requests_total", "Total requests")
+	counter.Add(3)
+	gauge := registry.Gauge("test_active", "Active things")
+	gauge.Set(7)
+	registry.Register("test_labeled", "Labeled values", KindGauge, func() []Sample {
+		return []Sample{{Labels: map[string]string{"peer": "a"}, Value: 1.5}}
+	})
+
+	var buf bytes.Buffer
+	if err := registry.WriteText(&buf); err != nil {
+		t.Fatalf("Failed to write metrics: %v", err)
+	}
+
+	output := buf.String()
+	for _, want := range []string{
+		"# TYPE test_requests_total counter",
+		"test_requests_total 3",
+		"# TYPE test_active gauge",
+		"test_active 7",
+		`test_labeled{peer="a"} 1.5`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Output missing %q:\n%s", want, output)
+		}
+	}
+}
+
+func TestRegistry_Snapshot(t *testing.T) {
+	registry := NewRegistry()
+	registry.Counter("test_total", "Total").Inc()
+
+	snapshot := registry.Snapshot()
+	if snapshot["test_total"] != 1 {
+		t.Errorf("Snapshot test_total = %v, want %v", snapshot["test_total"], 1)
+	}
+}
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	registry := NewRegistry()
+	registry.Gauge("test_gauge", "A gauge").Set(2)
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if recorder.Code != 200 {
+		t.Errorf("Status = %v, want %v", recorder.Code, 200)
+	}
+	if !strings.Contains(recorder.Body.String(), "test_gauge 2") {
+		t.Errorf("Body missing gauge value:\n%s", recorder.Body.String())
+	}
+}
@@ -0,0 +1,174 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ErrTransportStopped is returned for listener restarts after Stop
+var ErrTransportStopped = errors.New("transport stopped")
+
+// Bounds of the pause before retrying Accept after a temporary error, such
+// as an aborted connection or running out of file descriptors
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// WithListenerErrorHandler sets a function called when a listener fails
+// for good and its address stops accepting connections, with the address
+// and the error. Without one the error is logged. See RestartListeners.
+func WithListenerErrorHandler(fn func(address string, err error)) Option {
+	return func(t *Transport) {
+		t.onListenerError = fn
+	}
+}
+
+// startAccepting runs an accept loop for each listener until Stop or the
+// next restart
+func (t *Transport) startAccepting() {
+	t.acceptMu.Lock()
+	defer t.acceptMu.Unlock()
+	t.accepting = true
+	t.startAcceptingLocked()
+}
+
+func (t *Transport) startAcceptingLocked() {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.stopAccepting = cancel
+	for _, listener := range t.listeners() {
+		go t.acceptLoop(ctx, listener)
+	}
+}
+
+// closeListeners stops the accept loops and closes every listener
+func (t *Transport) closeListeners() {
+	t.acceptMu.Lock()
+	defer t.acceptMu.Unlock()
+	t.closeListenersLocked()
+}
+
+func (t *Transport) closeListenersLocked() {
+	if t.stopAccepting != nil {
+		t.stopAccepting()
+		t.stopAccepting = nil
+	}
+	for _, listener := range t.listeners() {
+		listener.Close()
+	}
+}
+
+// acceptLoop serves the connections accepted by listener until ctx is
+// cancelled, which closes the listener to interrupt a pending Accept.
+// Temporary errors are retried with a growing pause; any other error ends
+// the loop and is reported.
+func (t *Transport) acceptLoop(ctx context.Context, listener net.Listener) {
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if !temporaryAcceptError(err) {
+				t.listenerFailed(listener, err)
+				return
+			}
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+
+		if t.filter != nil {
+			if err := t.filter(conn.RemoteAddr().String()); err != nil {
+				fmt.Printf("Refusing connection from %s: %v\n", conn.RemoteAddr(), err)
+				conn.Close()
+				continue
+			}
+		}
+		if err := t.applySocketOptions(conn); err != nil {
+			fmt.Printf("Failed to apply socket options to %s: %v\n", conn.RemoteAddr(), err)
+		}
+		go t.serveConn(t.countConn(conn))
+	}
+}
+
+// temporaryAcceptError reports whether Accept may succeed if retried
+func temporaryAcceptError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Transport) listenerFailed(listener net.Listener, err error) {
+	address := listener.Addr().String()
+	if t.onListenerError != nil {
+		t.onListenerError(address, err)
+		return
+	}
+	fmt.Printf("Stopped accepting connections on %s: %v\n", address, err)
+}
+
+// RestartListeners closes the transport's listeners and opens them again
+// at the same addresses, for when one has failed or the interface it was
+// bound to has come back. Open connections are kept. A listener bound to
+// port 0 reopens on the port it was given, if it is still free.
+func (t *Transport) RestartListeners() error {
+	t.acceptMu.Lock()
+	defer t.acceptMu.Unlock()
+	select {
+	case <-t.done:
+		return ErrTransportStopped
+	default:
+	}
+
+	old := t.listeners()
+	t.closeListenersLocked()
+
+	listener, err := t.network.Listen(reopenAddress(t.address, old[0]))
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", t.address, err)
+	}
+	t.listener = listener
+	t.extraListeners = nil
+	err = t.listenExtra()
+	if t.accepting {
+		t.startAcceptingLocked()
+	}
+	return err
+}
+
+// reopenAddress returns the address to listen on again in place of
+// listener, which was opened at address
+func reopenAddress(address string, listener net.Listener) string {
+	if _, port, err := net.SplitHostPort(address); err == nil && port == "0" {
+		return listener.Addr().String()
+	}
+	return address
+}
+
+// listenAddr returns the address of the main listener
+func (t *Transport) listenAddr() net.Addr {
+	t.acceptMu.Lock()
+	defer t.acceptMu.Unlock()
+	return t.listener.Addr()
+}
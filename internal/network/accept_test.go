@@ -0,0 +1,119 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// faultyNetwork is a simulated network whose listeners fail Accept with the
+// errors queued in errs before accepting again
+type faultyNetwork struct {
+	*SimNetwork
+	errs chan error
+}
+
+func (f *faultyNetwork) Listen(address string) (net.Listener, error) {
+	listener, err := f.SimNetwork.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyListener{Listener: listener, errs: f.errs}, nil
+}
+
+type faultyListener struct {
+	net.Listener
+	errs chan error
+}
+
+func (l *faultyListener) Accept() (net.Conn, error) {
+	select {
+	case err := <-l.errs:
+		return nil, err
+	default:
+	}
+	return l.Listener.Accept()
+}
+
+func TestTransport_AcceptRetriesTemporaryErrors(t *testing.T) {
+	network := &faultyNetwork{SimNetwork: NewSimNetwork(), errs: make(chan error, 3)}
+	for i := 0; i < 3; i++ {
+		network.errs <- &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	failed := make(chan error, 1)
+	server, err := NewTransport("server", "server:1", &mockHandler{}, WithNetwork(network), WithListenerErrorHandler(func(_ string, err error) {
+		failed <- err
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "client:1", &mockHandler{}, WithNetwork(network.SimNetwork))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+	if err := client.Connect(context.Background(), "server:1"); err != nil {
+		t.Fatalf("Failed to connect after temporary accept errors: %v", err)
+	}
+	select {
+	case err := <-failed:
+		t.Errorf("Temporary error reported as a listener failure: %v", err)
+	default:
+	}
+}
+
+func TestTransport_RestartListeners(t *testing.T) {
+	network := &faultyNetwork{SimNetwork: NewSimNetwork(), errs: make(chan error, 1)}
+	broken := errors.New("listener broken")
+	network.errs <- broken
+	type failure struct {
+		address string
+		err     error
+	}
+	failed := make(chan failure, 1)
+	server, err := NewTransport("server", "server:1", &mockHandler{}, WithNetwork(network), WithListenerErrorHandler(func(address string, err error) {
+		failed <- failure{address, err}
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	server.Start()
+
+	select {
+	case f := <-failed:
+		if f.address != "server:1" || !errors.Is(f.err, broken) {
+			t.Errorf("Listener failure = %s: %v, want server:1: %v", f.address, f.err, broken)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the listener failure")
+	}
+
+	if err := server.RestartListeners(); err != nil {
+		t.Fatalf("Failed to restart listeners: %v", err)
+	}
+	client, err := NewTransport("client", "client:1", &mockHandler{}, WithNetwork(network.SimNetwork))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+	if err := client.Connect(context.Background(), "server:1"); err != nil {
+		t.Fatalf("Failed to connect after restarting listeners: %v", err)
+	}
+
+	server.Stop()
+	if err := server.RestartListeners(); !errors.Is(err, ErrTransportStopped) {
+		t.Errorf("RestartListeners() after Stop = %v, want %v", err, ErrTransportStopped)
+	}
+	select {
+	case f := <-failed:
+		t.Errorf("Stop reported as a listener failure: %s: %v", f.address, f.err)
+	default:
+	}
+}
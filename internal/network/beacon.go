@@ -0,0 +1,71 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// beaconMagic starts every beacon, so other datagrams sent to the beacon
+// port are ignored
+const beaconMagic = "p2p-storage beacon\n"
+
+// DefaultBeaconPort is the UDP port nodes broadcast and listen for beacons on
+const DefaultBeaconPort = 3999
+
+// ErrNotBeacon is returned for datagrams that aren't beacons
+var ErrNotBeacon = errors.New("not a beacon")
+
+// Beacon announces a node to the others on its LAN, for discovery where
+// multicast is blocked. Peers dial the port at the address the beacon came
+// from.
+type Beacon struct {
+	NodeID    string `json:"node_id"`
+	NetworkID string `json:"network_id,omitempty"`
+	Port      int    `json:"port"`
+}
+
+// EncodeBeacon returns the datagram announcing b
+func EncodeBeacon(b Beacon) ([]byte, error) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(beaconMagic), data...), nil
+}
+
+// DecodeBeacon parses a datagram received on the beacon port
+func DecodeBeacon(data []byte) (Beacon, error) {
+	var b Beacon
+	rest, ok := bytes.CutPrefix(data, []byte(beaconMagic))
+	if !ok {
+		return b, ErrNotBeacon
+	}
+	if err := json.Unmarshal(rest, &b); err != nil {
+		return b, fmt.Errorf("%w: %v", ErrNotBeacon, err)
+	}
+	if b.NodeID == "" || b.Port <= 0 || b.Port > 65535 {
+		return b, fmt.Errorf("%w: missing node ID or port", ErrNotBeacon)
+	}
+	return b, nil
+}
+
+// ListenBeacons opens the UDP socket beacons are received on and sent from.
+// Where the platform allows, the port is shared, so several nodes on one
+// host all hear the beacons broadcast to it.
+func ListenBeacons(port int) (net.PacketConn, error) {
+	address := fmt.Sprintf(":%d", port)
+	lc := net.ListenConfig{Control: reusePortControl}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", address)
+	if err != nil {
+		// Without port sharing, one node per host listens
+		conn, err = net.ListenPacket("udp4", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for beacons: %w", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,32 @@
+package network
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBeacon_RoundTrip(t *testing.T) {
+	data, err := EncodeBeacon(Beacon{NodeID: "node-a", NetworkID: "lab", Port: 3000})
+	if err != nil {
+		t.Fatalf("EncodeBeacon() error = %v", err)
+	}
+	beacon, err := DecodeBeacon(data)
+	if err != nil {
+		t.Fatalf("DecodeBeacon() error = %v", err)
+	}
+	if beacon != (Beacon{NodeID: "node-a", NetworkID: "lab", Port: 3000}) {
+		t.Errorf("DecodeBeacon() = %+v", beacon)
+	}
+
+	for _, data := range []string{
+		`{"node_id":"node-a","port":3000}`,
+		beaconMagic + `{"node_id":"node-a"}`,
+		beaconMagic + `{"port":3000}`,
+		beaconMagic + `{"node_id":"node-a","port":70000}`,
+		beaconMagic + `not json`,
+	} {
+		if _, err := DecodeBeacon([]byte(data)); !errors.Is(err, ErrNotBeacon) {
+			t.Errorf("DecodeBeacon(%q) error = %v, want ErrNotBeacon", data, err)
+		}
+	}
+}
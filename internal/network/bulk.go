@@ -0,0 +1,336 @@
+package network
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// bulkTimeout bounds how long a new connection may take to identify itself,
+// and how long a bulk connection waits to be paired with its control connection
+const bulkTimeout = 10 * time.Second
+
+// TransferHandler is implemented by handlers that accept chunk transfers
+// directly, without wrapping them in a Message. Transfers that arrive over a
+// bulk channel are delivered this way when available.
+type TransferHandler interface {
+	HandleTransfer(peer *Peer, transfer *protocol.DataTransfer) error
+}
+
+// bulkChannel is a dedicated connection for chunk data belonging to a
+// control connection. Chunks are written as raw frames, so large transfers
+// neither pay for JSON encoding nor hold up control messages.
+type bulkChannel struct {
+	conn         net.Conn
+	r            io.Reader
+	mu           sync.Mutex // serializes frame writes
+	writeTimeout time.Duration
+	// counted is conn before TLS, where its traffic is throttled
+	counted net.Conn
+}
+
+func (b *bulkChannel) send(transfer *protocol.DataTransfer) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.writeTimeout > 0 {
+		if err := b.conn.SetWriteDeadline(time.Now().Add(b.writeTimeout)); err != nil {
+			return err
+		}
+	}
+	return protocol.WriteTransferFrame(b.conn, transfer)
+}
+
+// readLoop delivers incoming frames to the peer until the channel fails.
+// Frames are held to the peer's read timeout, maximum frame size and
+// in-flight limit like messages on the control connection.
+func (b *bulkChannel) readLoop(peer *Peer) {
+	br := bufio.NewReader(b.r)
+	limit := &messageLimit{r: br, max: peer.maxFrame}
+	for {
+		if _, err := br.Peek(1); err != nil {
+			peer.detachBulk(b)
+			return
+		}
+		if peer.readTimeout > 0 {
+			b.conn.SetReadDeadline(time.Now().Add(peer.readTimeout))
+		}
+		limit.start = limit.pulled
+		// Each part of the frame is reserved before it is read
+		var size int64
+		transfer, err := protocol.ReadTransferFrameWith(limit, func(part int) error {
+			if err := peer.acquire(int64(part)); err != nil {
+				return err
+			}
+			size += int64(part)
+			return nil
+		})
+		b.conn.SetReadDeadline(time.Time{})
+		if errors.Is(err, ErrInflightLimit) {
+			peer.release(size)
+			fmt.Printf("Disconnecting peer %s: %v\n", peer.ID(), err)
+			peer.Close()
+			return
+		}
+		if err != nil {
+			peer.release(size)
+			fmt.Printf("Closing bulk channel of peer %s: %v\n", peer.ID(), peer.messageRead(err))
+			peer.detachBulk(b)
+			return
+		}
+		peer.countReceived(protocol.MessageTypeDataTransfer)
+		if err := protocol.ValidateTransfer(transfer); err != nil {
+			peer.release(size)
+			peer.refuseMalformed(err)
+			return
+		}
+		peer.tapTransfer(false, transfer)
+		if err := peer.deliverTransfer(transfer); err != nil {
+			peer.counts.handleErrors.Add(1)
+			fmt.Printf("Error handling transfer from peer %s: %v\n", peer.ID(), err)
+		}
+		peer.release(size)
+	}
+}
+
+// bufferedConn is a connection whose first bytes were already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// SendTransfer sends a chunk over the peer's bulk channel, or as a regular
+// message on the control connection when there is none
+func (p *Peer) SendTransfer(senderID string, transfer *protocol.DataTransfer) error {
+	if b := p.bulkChannel(); b != nil {
+		err := b.send(transfer)
+		if err == nil {
+			p.tapTransfer(true, transfer)
+			return p.countSent(protocol.MessageTypeDataTransfer, nil)
+		}
+		// A partial frame leaves the channel unusable; fall back to control
+		fmt.Printf("Bulk channel to %s failed, using control connection: %v\n", p.ID(), err)
+		p.detachBulk(b)
+	}
+
+	if p.framed {
+		err := p.sendFrame(string(protocol.MessageTypeDataTransfer), func(codec protocol.Codec) ([]byte, error) {
+			return codec.EncodeTransfer(senderID, transfer)
+		})
+		if err == nil {
+			p.tapTransfer(true, transfer)
+		}
+		return p.countSent(protocol.MessageTypeDataTransfer, err)
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeDataTransfer, senderID, transfer)
+	if err != nil {
+		return fmt.Errorf("failed to create transfer message: %w", err)
+	}
+	msg.TraceID = transfer.TraceID
+	return p.Send(msg)
+}
+
+// HasBulkChannel reports whether chunk data to this peer uses a bulk channel
+func (p *Peer) HasBulkChannel() bool {
+	return p.bulkChannel() != nil
+}
+
+func (p *Peer) bulkChannel() *bulkChannel {
+	p.bulkMu.Lock()
+	defer p.bulkMu.Unlock()
+	return p.bulk
+}
+
+// attachBulk pairs a bulk channel with the peer and starts reading from it
+func (p *Peer) attachBulk(b *bulkChannel) {
+	p.bulkMu.Lock()
+	if p.Closed() {
+		p.bulkMu.Unlock()
+		b.conn.Close()
+		return
+	}
+	old := p.bulk
+	p.bulk = b
+	p.bulkMu.Unlock()
+	shareBuckets(b.counted, p.counted)
+
+	if old != nil {
+		old.conn.Close()
+	}
+	go b.readLoop(p)
+}
+
+// detachBulk closes a failed bulk channel, leaving the peer on its control connection
+func (p *Peer) detachBulk(b *bulkChannel) {
+	p.bulkMu.Lock()
+	if p.bulk == b {
+		p.bulk = nil
+	}
+	p.bulkMu.Unlock()
+	b.conn.Close()
+}
+
+// deliverTransfer hands a chunk received over the bulk channel or as a
+// binary frame to the handler
+func (p *Peer) deliverTransfer(transfer *protocol.DataTransfer) error {
+	if h, ok := p.handler.(TransferHandler); ok {
+		return h.HandleTransfer(p, transfer)
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeDataTransfer, "", transfer)
+	if err != nil {
+		return err
+	}
+	return p.handler.HandleMessage(p, msg)
+}
+
+// serveConn identifies a newly accepted connection and starts serving it as
+// either a control connection or a bulk channel
+func (t *Transport) serveConn(conn net.Conn) {
+	counted := conn
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	conn, err := t.secure(ctx, conn, false)
+	cancel()
+	if err != nil {
+		fmt.Printf("Refusing connection: %v\n", err)
+		return
+	}
+
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(bulkTimeout))
+	first, err := br.Peek(len(protocol.BulkMagic))
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	if string(first) != string(protocol.BulkMagic) {
+		conn.SetReadDeadline(time.Time{})
+		if err := t.makeRoom(false); err != nil {
+			fmt.Printf("Refusing connection from %s: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		// Framed connections announce themselves; others carry a JSON stream
+		framed := string(first) == string(frameMagic)
+		if framed {
+			br.Discard(len(frameMagic))
+		}
+		peer := NewPeer(&bufferedConn{Conn: conn, r: br}, t.handler)
+		peer.certificate = peerCertificate(conn)
+		peer.sessionKey = sessionIdentity(conn)
+		peer.framed = framed
+		peer.counted = counted
+		t.addPeer(peer)
+		peer.Start()
+		return
+	}
+
+	token, err := protocol.ReadBulkHello(br)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		fmt.Printf("Invalid bulk connection from %s: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	t.pairBulk(token, nil, &bulkChannel{conn: conn, r: br, writeTimeout: t.writeTimeout, counted: counted})
+}
+
+// pairBulk matches a bulk channel with the control connection that announced
+// its token. Whichever side arrives first waits for the other; a channel
+// that is never claimed is closed after bulkTimeout.
+func (t *Transport) pairBulk(token string, peer *Peer, b *bulkChannel) {
+	t.mu.Lock()
+	if peer == nil {
+		if waiting, ok := t.bulkPeers[token]; ok {
+			delete(t.bulkPeers, token)
+			peer = waiting
+		} else {
+			t.bulkConns[token] = b
+			t.mu.Unlock()
+			time.AfterFunc(bulkTimeout, func() {
+				t.mu.Lock()
+				unclaimed := t.bulkConns[token] == b
+				if unclaimed {
+					delete(t.bulkConns, token)
+				}
+				t.mu.Unlock()
+				if unclaimed {
+					b.conn.Close()
+				}
+			})
+			return
+		}
+	} else {
+		if waiting, ok := t.bulkConns[token]; ok {
+			delete(t.bulkConns, token)
+			b = waiting
+		} else {
+			t.bulkPeers[token] = peer
+			t.mu.Unlock()
+			time.AfterFunc(bulkTimeout, func() {
+				t.mu.Lock()
+				if t.bulkPeers[token] == peer {
+					delete(t.bulkPeers, token)
+				}
+				t.mu.Unlock()
+			})
+			return
+		}
+	}
+	t.mu.Unlock()
+
+	peer.attachBulk(b)
+}
+
+// openBulk dials a bulk channel for a control connection the transport opened
+func (t *Transport) openBulk(address string, peer *Peer) error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	hexToken := hex.EncodeToString(token)
+
+	// Announce the token first so the acceptor can pair the connection
+	msg, err := protocol.NewMessage(protocol.MessageTypeBulkChannel, t.nodeID, protocol.BulkChannelPayload{Token: hexToken})
+	if err != nil {
+		return err
+	}
+	if err := peer.Send(msg); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bulkTimeout)
+	defer cancel()
+	conn, err := t.dial(ctx, address)
+	if err != nil {
+		return err
+	}
+	if err := t.applySocketOptions(conn); err != nil {
+		fmt.Printf("Failed to apply socket options to %s: %v\n", address, err)
+	}
+	conn = t.countConn(conn)
+	counted := conn
+	if conn, err = t.secure(ctx, conn, true); err != nil {
+		return err
+	}
+	if err := protocol.WriteBulkHello(conn, hexToken); err != nil {
+		conn.Close()
+		return err
+	}
+
+	peer.attachBulk(&bulkChannel{conn: conn, r: conn, writeTimeout: t.writeTimeout, counted: counted})
+	return nil
+}
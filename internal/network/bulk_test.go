@@ -0,0 +1,171 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// transferRecorder collects transfers and messages delivered to a handler
+type transferRecorder struct {
+	transfers chan *protocol.DataTransfer
+	messages  chan *protocol.Message
+}
+
+func newTransferRecorder() *transferRecorder {
+	return &transferRecorder{
+		transfers: make(chan *protocol.DataTransfer, 8),
+		messages:  make(chan *protocol.Message, 8),
+	}
+}
+
+func (h *transferRecorder) HandleMessage(peer *Peer, msg *protocol.Message) error {
+	h.messages <- msg
+	return nil
+}
+
+func (h *transferRecorder) HandleTransfer(peer *Peer, transfer *protocol.DataTransfer) error {
+	h.transfers <- transfer
+	return nil
+}
+
+// onlyPeer waits for the transport to have exactly one peer and returns it
+func onlyPeer(t *testing.T, transport *Transport) *Peer {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		transport.mu.RLock()
+		for _, peer := range transport.peers {
+			transport.mu.RUnlock()
+			return peer
+		}
+		transport.mu.RUnlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for a peer")
+	return nil
+}
+
+func waitForBulk(t *testing.T, peer *Peer) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !peer.HasBulkChannel() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for bulk channel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransport_BulkChannel(t *testing.T) {
+	serverHandler := newTransferRecorder()
+	server, err := NewTransport("server", "127.0.0.1:0", serverHandler)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	clientHandler := newTransferRecorder()
+	client, err := NewTransport("client", "127.0.0.1:0", clientHandler)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	clientPeer := onlyPeer(t, client)
+	serverPeer := onlyPeer(t, server)
+	waitForBulk(t, clientPeer)
+	waitForBulk(t, serverPeer)
+
+	transfer := &protocol.DataTransfer{ContentHash: "abc123", Data: []byte("chunk"), FinalChunk: true}
+	for _, tc := range []struct {
+		name     string
+		from     *Peer
+		receiver *transferRecorder
+	}{
+		{"client to server", clientPeer, serverHandler},
+		{"server to client", serverPeer, clientHandler},
+	} {
+		if err := tc.from.SendTransfer("sender", transfer); err != nil {
+			t.Fatalf("%s: Failed to send transfer: %v", tc.name, err)
+		}
+		select {
+		case got := <-tc.receiver.transfers:
+			if got.ContentHash != transfer.ContentHash || !bytes.Equal(got.Data, transfer.Data) || !got.FinalChunk {
+				t.Errorf("%s: transfer = %+v, want %+v", tc.name, got, transfer)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: Timed out waiting for transfer", tc.name)
+		}
+	}
+
+	// Closing the peer also closes its bulk channel
+	clientPeer.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for serverPeer.HasBulkChannel() || !serverPeer.Closed() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Server peer still connected after client closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransport_BulkChannelDisabled(t *testing.T) {
+	serverHandler := newTransferRecorder()
+	server, err := NewTransport("server", "127.0.0.1:0", serverHandler)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	peer := onlyPeer(t, client)
+	if peer.HasBulkChannel() {
+		t.Error("HasBulkChannel() = true with bulk channels disabled")
+	}
+
+	transfer := &protocol.DataTransfer{ContentHash: "abc123", Data: []byte("chunk")}
+	if err := peer.SendTransfer("client", transfer); err != nil {
+		t.Fatalf("Failed to send transfer: %v", err)
+	}
+
+	// Without a bulk channel the chunk arrives as a regular message
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-serverHandler.messages:
+			if msg.Type != protocol.MessageTypeDataTransfer {
+				continue
+			}
+			var got protocol.DataTransfer
+			if err := msg.ParsePayload(&got); err != nil {
+				t.Fatalf("Failed to parse transfer: %v", err)
+			}
+			if !bytes.Equal(got.Data, transfer.Data) {
+				t.Errorf("Data = %q, want %q", got.Data, transfer.Data)
+			}
+			return
+		case <-serverHandler.transfers:
+			t.Fatal("Transfer delivered over a bulk channel")
+		case <-deadline:
+			t.Fatal("Timed out waiting for transfer message")
+		}
+	}
+}
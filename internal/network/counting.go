@@ -0,0 +1,145 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// countingConn wraps a connection and adds every byte read or written to
+// the transport-wide counters and those of its peer. It is also where
+// traffic is throttled to the transport's rate limits.
+type countingConn struct {
+	net.Conn
+	sent     *atomic.Int64
+	received *atomic.Int64
+	// traffic counts the bytes of the peer the connection belongs to; a
+	// bulk channel takes over that of its control connection once paired
+	traffic atomic.Pointer[peerTraffic]
+
+	limiter *rateLimiter
+	// buckets pace the peer the connection belongs to; a bulk channel
+	// takes over those of its control connection once paired
+	buckets atomic.Pointer[rateBuckets]
+	// writeDeadline is the last deadline set, which is pushed back by the
+	// time a write waits on the rate limits
+	deadlineMu    sync.Mutex
+	writeDeadline time.Time
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received.Add(int64(n))
+	c.traffic.Load().received.Add(int64(n))
+	if n > 0 {
+		if delay := c.limiter.downloadDelay(c.buckets.Load(), n); delay > 0 {
+			time.Sleep(delay)
+		}
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	if delay := c.limiter.uploadDelay(c.buckets.Load(), len(b)); delay > 0 {
+		time.Sleep(delay)
+		// Waiting on the limit doesn't count against the write timeout
+		c.deadlineMu.Lock()
+		if !c.writeDeadline.IsZero() {
+			c.Conn.SetWriteDeadline(c.writeDeadline.Add(delay))
+		}
+		c.deadlineMu.Unlock()
+	}
+	n, err := c.Conn.Write(b)
+	c.sent.Add(int64(n))
+	c.traffic.Load().sent.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *countingConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	c.writeDeadline = t
+	c.deadlineMu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// countConn wraps conn so its traffic is reflected in BytesSent/BytesReceived
+// and paced by the rate limits
+func (t *Transport) countConn(conn net.Conn) net.Conn {
+	c := &countingConn{
+		Conn:     conn,
+		sent:     &t.bytesSent,
+		received: &t.bytesReceived,
+		limiter:  &t.limiter,
+	}
+	c.buckets.Store(&rateBuckets{})
+	c.traffic.Store(&peerTraffic{})
+	return c
+}
+
+// shareBuckets has a bulk channel's traffic count against the per-peer
+// limits and byte counts of its control connection
+func shareBuckets(bulk, control net.Conn) {
+	b, ok := bulk.(*countingConn)
+	if !ok {
+		return
+	}
+	if c, ok := control.(*countingConn); ok {
+		b.buckets.Store(c.buckets.Load())
+		b.traffic.Store(c.traffic.Load())
+	}
+}
+
+// BytesSent returns the total number of bytes written to all peers
+func (t *Transport) BytesSent() int64 {
+	return t.bytesSent.Load()
+}
+
+// BytesReceived returns the total number of bytes read from all peers
+func (t *Transport) BytesReceived() int64 {
+	return t.bytesReceived.Load()
+}
+
+// PeerCount returns the number of currently connected peers
+func (t *Transport) PeerCount() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.peers)
+}
+
+// messageCounts counts messages received by type
+type messageCounts struct {
+	mu     sync.Mutex
+	counts map[protocol.MessageType]int64
+}
+
+func (c *messageCounts) add(msgType protocol.MessageType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[protocol.MessageType]int64)
+	}
+	c.counts[msgType]++
+}
+
+// MessagesReceived returns the number of messages received from all peers
+// by type. Chunks that arrive over bulk channels count as data transfers.
+func (t *Transport) MessagesReceived() map[protocol.MessageType]int64 {
+	t.messages.mu.Lock()
+	defer t.messages.mu.Unlock()
+
+	counts := make(map[protocol.MessageType]int64, len(t.messages.counts))
+	for msgType, count := range t.messages.counts {
+		counts[msgType] = count
+	}
+	return counts
+}
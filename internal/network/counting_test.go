@@ -0,0 +1,39 @@
+package network
+
+import (
+	"testing"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestTransport_ByteCounters(t *testing.T) {
+	transport := &Transport{peers: make(map[string]*Peer)}
+
+	conn := newMockConn()
+	conn.readData = []byte("incoming")
+	counted := transport.countConn(conn)
+
+	buf := make([]byte, 16)
+	if _, err := counted.Read(buf); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	peer := NewPeer(counted, &mockHandler{})
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, "test", nil)
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := peer.Send(msg); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	if got := transport.BytesReceived(); got != int64(len("incoming")) {
+		t.Errorf("BytesReceived() = %v, want %v", got, len("incoming"))
+	}
+	conn.mu.Lock()
+	written := int64(len(conn.writeData))
+	conn.mu.Unlock()
+	if got := transport.BytesSent(); got != written {
+		t.Errorf("BytesSent() = %v, want %v", got, written)
+	}
+}
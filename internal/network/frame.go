@@ -0,0 +1,86 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"p2p-storage/internal/protocol"
+)
+
+// frameMagic opens a control connection whose messages are sent as
+// length-prefixed frames. Connections without it carry a plain JSON stream,
+// as sent by nodes that predate framing. Frames are encoded with the codec
+// negotiated in the handshake, JSON until then.
+var frameMagic = []byte("P2PF")
+
+// frameHeaderSize is the size of the big-endian length before each frame
+const frameHeaderSize = 4
+
+// DefaultMaxFrameSize bounds a single message, enough for a 1 MiB chunk
+// with room to spare for the JSON around it
+const DefaultMaxFrameSize = 16 << 20
+
+// ErrFrameTooLarge is returned for messages over the maximum frame size,
+// whether sent or received
+var ErrFrameTooLarge = errors.New("frame exceeds the maximum frame size")
+
+// DefaultCompressThreshold is the size below which frames are sent
+// uncompressed to peers that negotiated compression
+const DefaultCompressThreshold = 1 << 10
+
+// writeFrame writes an encoded message as a single frame in one write, so
+// a frame is never interleaved with another
+func writeFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+// readFrame reads, decompresses and decodes the next frame. Frames over
+// maxSize are refused before their body is read, and compressed frames that
+// expand past it as they are decompressed. Chunks sent by the binary codec
+// come back as a transfer; see protocol.DecodeFrame.
+func readFrame(r io.Reader, maxSize int) (*protocol.Message, *protocol.DataTransfer, error) {
+	data, err := readFrameData(r, maxSize, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return decodeFrame(data, maxSize)
+}
+
+// readFrameData reads the next frame without decoding it, refusing frames
+// over maxSize before their body is read. If reserve is set, it is passed
+// the size of the whole frame, header included, before the body is read,
+// and an error from it stops the read.
+func readFrameData(r io.Reader, maxSize int, reserve func(size int64) error) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > uint32(maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes announced", ErrFrameTooLarge, size)
+	}
+	if reserve != nil {
+		if err := reserve(frameHeaderSize + int64(size)); err != nil {
+			return nil, err
+		}
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// decodeFrame decompresses and decodes a frame
+func decodeFrame(data []byte, maxSize int) (*protocol.Message, *protocol.DataTransfer, error) {
+	data, err := protocol.DecompressFrame(data, maxSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	return protocol.DecodeFrame(data)
+}
@@ -0,0 +1,218 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	for i, name := range []string{"a.txt", "b.txt"} {
+		msg, err := protocol.NewMessage(protocol.MessageTypeData, "node1", protocol.DataPayload{ContentHash: "abc", FileName: name, Size: int64(i)})
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		data, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("Failed to encode message: %v", err)
+		}
+		if err := writeFrame(&buf, data); err != nil {
+			t.Fatalf("Failed to write frame: %v", err)
+		}
+	}
+
+	// Frames keep their boundaries back to back
+	for _, want := range []string{"a.txt", "b.txt"} {
+		msg, _, err := readFrame(&buf, DefaultMaxFrameSize)
+		if err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		var payload protocol.DataPayload
+		if err := msg.ParsePayload(&payload); err != nil {
+			t.Fatalf("Failed to parse payload: %v", err)
+		}
+		if msg.Type != protocol.MessageTypeData || payload.FileName != want {
+			t.Errorf("Frame = %s %q, want %s %q", msg.Type, payload.FileName, protocol.MessageTypeData, want)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left after reading all frames", buf.Len())
+	}
+}
+
+func TestFrameSizeLimit(t *testing.T) {
+	// An oversized announcement is refused before its body is read
+	header := binary.BigEndian.AppendUint32(nil, 1<<30)
+	if _, _, err := readFrame(bytes.NewReader(header), DefaultMaxFrameSize); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("readFrame() error = %v, want %v", err, ErrFrameTooLarge)
+	}
+
+	// Oversized messages are refused without touching the connection
+	conn := newMockConn()
+	peer := NewPeer(conn, &mockHandler{})
+	peer.framed, peer.maxFrame = true, 256
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, "node1", protocol.DataPayload{FileName: string(make([]byte, 512))})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := peer.Send(msg); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Send() error = %v, want %v", err, ErrFrameTooLarge)
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.writeData) != 0 {
+		t.Error("Oversized frame was written")
+	}
+}
+
+func TestTransport_FramedAndLegacyPeers(t *testing.T) {
+	serverHandler := newTransferRecorder()
+	server, err := NewTransport("server", "127.0.0.1:0", serverHandler)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	for _, framing := range []bool{true, false} {
+		client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithFraming(framing), WithBulkChannel(false))
+		if err != nil {
+			t.Fatalf("Failed to create transport: %v", err)
+		}
+		defer client.Stop()
+
+		if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+			t.Fatalf("framing %v: Failed to connect: %v", framing, err)
+		}
+		select {
+		case msg := <-serverHandler.messages:
+			if msg.Type != protocol.MessageTypeHandshake {
+				t.Errorf("framing %v: message type = %s, want %s", framing, msg.Type, protocol.MessageTypeHandshake)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("framing %v: Timed out waiting for the handshake", framing)
+		}
+	}
+}
+
+func TestTransport_BinaryCodec(t *testing.T) {
+	serverHandler := newTransferRecorder()
+	server, err := NewTransport("server", "127.0.0.1:0", serverHandler)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	<-serverHandler.messages // handshake
+	peer := onlyPeer(t, client)
+	binaryCodec, err := protocol.CodecByName(protocol.CodecBinary)
+	if err != nil {
+		t.Fatalf("Failed to get codec: %v", err)
+	}
+	peer.UseCodec(binaryCodec)
+
+	// Chunks on the control connection reach the handler as transfers
+	transfer := &protocol.DataTransfer{ContentHash: "abc123", Data: []byte{0, 1, 2, 0xff}, ChunkIndex: 2, FinalChunk: true}
+	if err := peer.SendTransfer("client", transfer); err != nil {
+		t.Fatalf("Failed to send transfer: %v", err)
+	}
+	select {
+	case got := <-serverHandler.transfers:
+		if got.ContentHash != transfer.ContentHash || !bytes.Equal(got.Data, transfer.Data) || got.ChunkIndex != 2 || !got.FinalChunk {
+			t.Errorf("transfer = %+v, want %+v", got, transfer)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for transfer")
+	}
+
+	// Other messages still arrive as messages
+	msg, err := protocol.NewMessage(protocol.MessageTypeLeave, "client", protocol.LeavePayload{NodeID: "client"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := peer.Send(msg); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	select {
+	case got := <-serverHandler.messages:
+		if got.Type != protocol.MessageTypeLeave || got.SenderID != "client" {
+			t.Errorf("message = %s from %q, want %s from %q", got.Type, got.SenderID, protocol.MessageTypeLeave, "client")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for message")
+	}
+}
+
+func TestTransport_FrameCompression(t *testing.T) {
+	serverHandler := newTransferRecorder()
+	server, err := NewTransport("server", "127.0.0.1:0", serverHandler)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	<-serverHandler.messages // handshake
+	peer := onlyPeer(t, client)
+	peer.UseCompression(protocol.CompressionGzip)
+
+	send := func(payload protocol.DataPayload) int64 {
+		t.Helper()
+		msg, err := protocol.NewMessage(protocol.MessageTypeData, "client", payload)
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		before := client.BytesSent()
+		if err := peer.Send(msg); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+		select {
+		case got := <-serverHandler.messages:
+			var received protocol.DataPayload
+			if err := got.ParsePayload(&received); err != nil || received.FileName != payload.FileName {
+				t.Errorf("Received %q, %v; want %q", received.FileName, err, payload.FileName)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for message")
+		}
+		return client.BytesSent() - before
+	}
+
+	// Large messages shrink on the wire
+	large := strings.Repeat("compressible ", 300)
+	if sent := send(protocol.DataPayload{ContentHash: "abc", FileName: large}); sent >= int64(len(large)) {
+		t.Errorf("Sent %d bytes for a %d-byte payload, want it compressed", sent, len(large))
+	}
+	// Small ones go as they are
+	small := "small.txt"
+	if sent := send(protocol.DataPayload{ContentHash: "abc", FileName: small}); sent >= DefaultCompressThreshold {
+		t.Errorf("Sent %d bytes for a small message", sent)
+	}
+}
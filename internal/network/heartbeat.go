@@ -0,0 +1,217 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// HeartbeatConfig controls the pings that detect peers that went away
+// without closing their connection
+type HeartbeatConfig struct {
+	Interval  time.Duration // between pings; 0 disables heartbeats
+	MaxMissed int           // unanswered pings after which a peer is evicted
+}
+
+// DefaultHeartbeatConfig pings every 15 seconds and evicts a peer after 3
+// unanswered pings
+func DefaultHeartbeatConfig() HeartbeatConfig {
+	return HeartbeatConfig{
+		Interval:  15 * time.Second,
+		MaxMissed: 3,
+	}
+}
+
+// explicitPing marks the sequence numbers of explicit pings, which count
+// apart from heartbeats so neither kind moves the other's sequence. Pongs
+// echo the ping's payload, so peers need not know the difference.
+const explicitPing = 1 << 63
+
+// heartbeat tracks the pings sent to one peer
+type heartbeat struct {
+	mu      sync.Mutex
+	enabled bool
+	seq     uint64        // of the last heartbeat
+	pingSeq uint64        // of the last explicit ping, without explicitPing
+	missed  int           // pings sent since the last pong
+	rtt     time.Duration // round trip of the last answered ping
+	srtt    time.Duration // smoothed round trip; see SmoothedRTT
+	// waiters are the explicit pings waiting for their pong, by sequence
+	// number; see Ping
+	waiters map[uint64]chan time.Duration
+}
+
+// record takes the round trip of an answered ping into account
+func (h *heartbeat) record(rtt time.Duration) {
+	h.rtt = rtt
+	if h.srtt == 0 {
+		h.srtt = rtt
+	} else {
+		h.srtt += (rtt - h.srtt) / 8
+	}
+}
+
+// EnableHeartbeats starts pinging the peer. Only peers that announced they
+// answer pings are pinged, so older peers are not evicted for ignoring them.
+func (p *Peer) EnableHeartbeats() {
+	p.heartbeat.mu.Lock()
+	p.heartbeat.enabled = true
+	p.heartbeat.mu.Unlock()
+}
+
+// RTT returns the round-trip time of the last answered ping, or 0 if none
+// was answered yet
+func (p *Peer) RTT() time.Duration {
+	p.heartbeat.mu.Lock()
+	defer p.heartbeat.mu.Unlock()
+	return p.heartbeat.rtt
+}
+
+// SmoothedRTT returns the round-trip time averaged over the answered pings,
+// each weighing an eighth against those before it as in TCP's estimate, or 0
+// if none was answered yet. It moves less with a single slow pong than RTT,
+// so it suits ranking peers by latency.
+func (p *Peer) SmoothedRTT() time.Duration {
+	p.heartbeat.mu.Lock()
+	defer p.heartbeat.mu.Unlock()
+	return p.heartbeat.srtt
+}
+
+// Ping sends a ping outside the heartbeat schedule and returns the round
+// trip once its pong arrives. The peer must answer pings; those that
+// predate heartbeats never do, and Ping waits for ctx.
+func (p *Peer) Ping(ctx context.Context) (time.Duration, error) {
+	answer := make(chan time.Duration, 1)
+	p.heartbeat.mu.Lock()
+	p.heartbeat.pingSeq++
+	seq := explicitPing | p.heartbeat.pingSeq
+	if p.heartbeat.waiters == nil {
+		p.heartbeat.waiters = make(map[uint64]chan time.Duration)
+	}
+	p.heartbeat.waiters[seq] = answer
+	p.heartbeat.mu.Unlock()
+	defer func() {
+		p.heartbeat.mu.Lock()
+		delete(p.heartbeat.waiters, seq)
+		p.heartbeat.mu.Unlock()
+	}()
+
+	msg, err := protocol.NewMessage(protocol.MessageTypePing, p.localID, protocol.PingPayload{Seq: seq, Sent: time.Now().UnixNano()})
+	if err != nil {
+		return 0, err
+	}
+	if err := p.Send(msg); err != nil {
+		return 0, err
+	}
+	select {
+	case rtt := <-answer:
+		return rtt, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-p.done:
+		return 0, errors.New("connection closed")
+	}
+}
+
+// ping sends the next heartbeat and counts it as missed until its pong
+// arrives. It reports false, without sending, once the peer missed
+// maxMissed pings in a row, and for peers without heartbeats.
+func (p *Peer) ping(nodeID string, maxMissed int) bool {
+	p.heartbeat.mu.Lock()
+	if !p.heartbeat.enabled {
+		p.heartbeat.mu.Unlock()
+		return true
+	}
+	if p.heartbeat.missed >= maxMissed {
+		p.heartbeat.mu.Unlock()
+		return false
+	}
+	p.heartbeat.missed++
+	p.heartbeat.seq++
+	payload := protocol.PingPayload{Seq: p.heartbeat.seq, Sent: time.Now().UnixNano()}
+	p.heartbeat.mu.Unlock()
+
+	msg, err := protocol.NewMessage(protocol.MessageTypePing, nodeID, payload)
+	if err == nil {
+		go p.Send(msg)
+	}
+	return true
+}
+
+// handlePing answers a heartbeat by echoing its payload
+func (p *Peer) handlePing(msg *protocol.Message) {
+	pong := &protocol.Message{Type: protocol.MessageTypePong, SenderID: p.localID, Payload: msg.Payload}
+	if err := p.Send(pong); err != nil {
+		fmt.Printf("Failed to answer ping from peer %s: %v\n", p.ID(), err)
+	}
+}
+
+// handlePong records the answer to a heartbeat or an explicit ping. A late
+// pong for an earlier heartbeat still shows the peer is alive but says
+// nothing about the round trip.
+func (p *Peer) handlePong(msg *protocol.Message) {
+	var payload protocol.PingPayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		fmt.Printf("Invalid pong from peer %s\n", p.ID())
+		return
+	}
+
+	p.heartbeat.mu.Lock()
+	defer p.heartbeat.mu.Unlock()
+	rtt := time.Since(time.Unix(0, payload.Sent))
+	if payload.Seq&explicitPing != 0 {
+		answer, ok := p.heartbeat.waiters[payload.Seq]
+		if !ok {
+			return
+		}
+		p.heartbeat.missed = 0
+		p.heartbeat.record(rtt)
+		answer <- rtt
+		delete(p.heartbeat.waiters, payload.Seq)
+		return
+	}
+	if payload.Seq == 0 || payload.Seq > p.heartbeat.seq {
+		return
+	}
+	p.heartbeat.missed = 0
+	if payload.Seq == p.heartbeat.seq {
+		p.heartbeat.record(rtt)
+	}
+}
+
+// heartbeatLoop pings every peer each interval and evicts those that
+// missed too many pings in a row
+func (t *Transport) heartbeatLoop() {
+	ticker := time.NewTicker(t.heartbeat.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+
+		t.mu.RLock()
+		peers := make([]*Peer, 0, len(t.peers))
+		for _, peer := range t.peers {
+			peers = append(peers, peer)
+		}
+		t.mu.RUnlock()
+
+		for _, peer := range peers {
+			if peer.ping(t.nodeID, t.heartbeat.MaxMissed) {
+				continue
+			}
+			fmt.Printf("Evicting peer %s: no answer to %d heartbeats\n", peer.ID(), t.heartbeat.MaxMissed)
+			peer.Close()
+			if t.onEvict != nil {
+				t.onEvict(peer)
+			}
+		}
+	}
+}
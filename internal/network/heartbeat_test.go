@@ -0,0 +1,194 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestTransport_HeartbeatRTT(t *testing.T) {
+	cfg := HeartbeatConfig{Interval: 20 * time.Millisecond, MaxMissed: 3}
+	server, err := NewTransport("server", "127.0.0.1:0", &mockHandler{}, WithHeartbeat(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithHeartbeat(cfg), WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+	client.Start()
+
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	clientPeer, serverPeer := onlyPeer(t, client), onlyPeer(t, server)
+	clientPeer.EnableHeartbeats()
+	serverPeer.EnableHeartbeats()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for clientPeer.RTT() == 0 || serverPeer.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for heartbeat round trips")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Peers that answer stay connected however many pings were sent
+	time.Sleep(10 * cfg.Interval)
+	if clientPeer.Closed() || serverPeer.Closed() {
+		t.Error("Responsive peer was evicted")
+	}
+}
+
+func TestTransport_HeartbeatEvictsSilentPeer(t *testing.T) {
+	evicted := make(chan *Peer, 1)
+	cfg := HeartbeatConfig{Interval: 20 * time.Millisecond, MaxMissed: 2}
+	server, err := NewTransport("server", "127.0.0.1:0", &mockHandler{}, WithHeartbeat(cfg), WithEvictHandler(func(p *Peer) {
+		evicted <- p
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	// A peer that keeps its connection open but never answers
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	// The server waits for the first bytes to tell control from bulk
+	// connections; whitespace is skipped by the message decoder
+	if _, err := conn.Write([]byte("                \n")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	silent := onlyPeer(t, server)
+
+	// Peers that never announced heartbeats are left alone
+	time.Sleep(5 * cfg.Interval)
+	if silent.Closed() {
+		t.Fatalf("Peer without heartbeats was evicted")
+	}
+
+	silent.EnableHeartbeats()
+	select {
+	case p := <-evicted:
+		if p != silent {
+			t.Errorf("Evicted peer %s, want %s", p.ID(), silent.ID())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for the silent peer to be evicted")
+	}
+	if !silent.Closed() {
+		t.Error("Evicted peer is still open")
+	}
+	if count := server.PeerCount(); count != 0 {
+		t.Errorf("PeerCount() = %d, want 0", count)
+	}
+}
+
+func TestPeer_Ping(t *testing.T) {
+	// No heartbeats, so only the explicit pings are answered
+	cfg := HeartbeatConfig{}
+	server, err := NewTransport("server", "127.0.0.1:0", &mockHandler{}, WithHeartbeat(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithHeartbeat(cfg), WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+	client.Start()
+
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	peer := onlyPeer(t, client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		rtt, err := peer.Ping(ctx)
+		if err != nil {
+			t.Fatalf("Ping() error = %v", err)
+		}
+		if rtt <= 0 || peer.RTT() != rtt {
+			t.Errorf("Ping() = %v, RTT() = %v; want the same positive round trip", rtt, peer.RTT())
+		}
+	}
+	if peer.SmoothedRTT() <= 0 {
+		t.Errorf("SmoothedRTT() = %v after answered pings", peer.SmoothedRTT())
+	}
+	if stats := peer.Stats(); stats.SmoothedRTT != peer.SmoothedRTT() {
+		t.Errorf("Stats().SmoothedRTT = %v, want %v", stats.SmoothedRTT, peer.SmoothedRTT())
+	}
+
+	peer.Close()
+	if _, err := peer.Ping(ctx); err == nil {
+		t.Error("Ping() over a closed connection succeeded")
+	}
+}
+
+func TestHeartbeat_SmoothedRTT(t *testing.T) {
+	var h heartbeat
+	h.record(80 * time.Millisecond)
+	if h.srtt != 80*time.Millisecond {
+		t.Fatalf("srtt after the first sample = %v, want it", h.srtt)
+	}
+	// A single slow round trip moves the average an eighth of the way
+	h.record(160 * time.Millisecond)
+	if h.srtt != 90*time.Millisecond || h.rtt != 160*time.Millisecond {
+		t.Errorf("srtt, rtt = %v, %v; want 90ms, 160ms", h.srtt, h.rtt)
+	}
+}
+
+func TestPeer_PingKeepsHeartbeatSequence(t *testing.T) {
+	pong := func(seq uint64) *protocol.Message {
+		t.Helper()
+		msg, err := protocol.NewMessage(protocol.MessageTypePong, "peer", protocol.PingPayload{Seq: seq, Sent: time.Now().Add(-time.Millisecond).UnixNano()})
+		if err != nil {
+			t.Fatalf("Failed to create pong: %v", err)
+		}
+		return msg
+	}
+
+	// A heartbeat is in flight when an explicit ping goes out
+	p := &Peer{}
+	p.heartbeat.seq, p.heartbeat.missed = 1, 1
+	answer := make(chan time.Duration, 1)
+	p.heartbeat.pingSeq = 1
+	p.heartbeat.waiters = map[uint64]chan time.Duration{explicitPing | 1: answer}
+
+	p.handlePong(pong(1))
+	if p.heartbeat.missed != 0 || p.RTT() <= 0 {
+		t.Errorf("missed, RTT = %d, %v after the heartbeat's pong; want 0 and a round trip", p.heartbeat.missed, p.RTT())
+	}
+	p.handlePong(pong(explicitPing | 1))
+	select {
+	case rtt := <-answer:
+		if rtt <= 0 {
+			t.Errorf("Ping answered with round trip %v", rtt)
+		}
+	default:
+		t.Error("Explicit ping not answered")
+	}
+
+	// Pongs for explicit pings no one waits for are ignored
+	p.heartbeat.missed = 1
+	p.handlePong(pong(explicitPing | 7))
+	if p.heartbeat.missed != 1 {
+		t.Error("Unexpected explicit pong counted as a heartbeat answer")
+	}
+}
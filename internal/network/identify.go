@@ -0,0 +1,97 @@
+package network
+
+import (
+	"fmt"
+
+	"p2p-storage/internal/crypto"
+)
+
+// Identify keys a peer by the fingerprint of the identity key it presented
+// in the handshake instead of its remote address, so a node keeps the same
+// ID across reconnects and is connected at most once. If it is connected
+// already, one connection is closed: a reconnect replaces the older one,
+// and of two connections opened by dialing each other at once, both sides
+// keep the one dialed by the node with the lower fingerprint. Identify
+// reports whether peer was kept; if not, it has been closed.
+func (t *Transport) Identify(peer *Peer, publicKey []byte) bool {
+	return t.identify(peer, crypto.Fingerprint(publicKey), crypto.Fingerprint(t.identityKey))
+}
+
+// keylessPrefix sets the IDs of peers without identity keys apart from
+// fingerprints, so a node ID chosen to equal some node's fingerprint cannot
+// take the place of that node's connection
+const keylessPrefix = "node:"
+
+// IdentityOf returns the ID a peer with publicKey and nodeID is known by
+// once identified: the fingerprint of its key, or for a peer without one
+// its node ID prefixed with "node:"
+func IdentityOf(publicKey []byte, nodeID string) string {
+	if len(publicKey) == 0 {
+		return keylessPrefix + nodeID
+	}
+	return crypto.Fingerprint(publicKey)
+}
+
+// IdentifyNode is Identify for peers that presented no identity key, such
+// as nodes that predate identities. They are keyed by the node ID from the
+// handshake, prefixed with "node:", and the node with the lower ID keeps
+// the connection it dialed.
+func (t *Transport) IdentifyNode(peer *Peer, nodeID string) bool {
+	return t.identify(peer, keylessPrefix+nodeID, keylessPrefix+t.nodeID)
+}
+
+// identify keys peer by id, where localID is this node's counterpart used
+// to break ties between connections dialed at once
+func (t *Transport) identify(peer *Peer, id, localID string) bool {
+	t.mu.Lock()
+	if peer.identified() == id {
+		t.mu.Unlock()
+		return true
+	}
+	existing := t.peers[id]
+	if existing != nil && (existing == peer || existing.Closed()) {
+		existing = nil
+	}
+	if existing != nil && existing.outbound != peer.outbound {
+		lowerDials := localID < id
+		if existing.outbound == lowerDials {
+			t.mu.Unlock()
+			peer.Close()
+			return false
+		}
+	}
+
+	if current, exists := t.peers[peer.ID()]; exists && current == peer {
+		delete(t.peers, peer.ID())
+	}
+	peer.idMu.Lock()
+	peer.identity = id
+	peer.idMu.Unlock()
+	t.peers[id] = peer
+	if peer.handshakeTimer != nil {
+		peer.handshakeTimer.Stop()
+	}
+	t.mu.Unlock()
+
+	if existing != nil {
+		fmt.Printf("Peer %s connected again from %s, closing its connection from %s\n", id, peer.Address(), existing.Address())
+		existing.Close()
+	}
+	return true
+}
+
+// Identified reports whether the handshake has identified the peer, which
+// until then only receives messages sent to it directly
+func (p *Peer) Identified() bool {
+	return p.identified() != ""
+}
+
+// expireUnidentified closes a peer that is still unidentified once the
+// handshake window has passed
+func (t *Transport) expireUnidentified(peer *Peer) {
+	if peer.Identified() || peer.Closed() {
+		return
+	}
+	fmt.Printf("Dropping peer %s: no handshake within %v\n", peer.ID(), t.handshakeWindow)
+	peer.Close()
+}
@@ -0,0 +1,208 @@
+package network
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+// peerList returns the transport's peers in no particular order
+func peerList(transport *Transport) []*Peer {
+	transport.mu.RLock()
+	defer transport.mu.RUnlock()
+
+	peers := make([]*Peer, 0, len(transport.peers))
+	for _, peer := range transport.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+func TestTransport_IdentifyReplacesReconnect(t *testing.T) {
+	server, err := NewTransport("server", "127.0.0.1:0", &mockHandler{})
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	// The same node connects twice, from two addresses
+	for i := 0; i < 2; i++ {
+		if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	var conns []*Peer
+	for len(conns) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for both connections")
+		}
+		time.Sleep(10 * time.Millisecond)
+		conns = peerList(server)
+	}
+
+	key := []byte("client identity key")
+	fingerprint := crypto.Fingerprint(key)
+	for _, peer := range conns {
+		if !server.Identify(peer, key) {
+			t.Fatalf("Identify() dropped a reconnect")
+		}
+	}
+
+	// The connection identified last is the one kept
+	peers := peerList(server)
+	if len(peers) != 1 || peers[0] != conns[1] {
+		t.Fatalf("peers = %v, want only the newer connection", peers)
+	}
+	if peers[0].ID() != fingerprint {
+		t.Errorf("ID() = %q, want fingerprint %q", peers[0].ID(), fingerprint)
+	}
+	if !conns[0].Closed() {
+		t.Error("Older connection was left open")
+	}
+	// Identifying again, as for a handshake reply, is a no-op
+	if !server.Identify(conns[1], key) || conns[1].Closed() {
+		t.Error("Identify() of an identified peer dropped it")
+	}
+}
+
+func TestTransport_IdentifyNodeKeepsKeyedPeer(t *testing.T) {
+	server, err := NewTransport("server", "127.0.0.1:0", &mockHandler{})
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+
+	key := []byte("victim identity key")
+	victim := NewPeer(newMockConn(), &mockHandler{})
+	server.addPeer(victim)
+	server.Identify(victim, key)
+
+	// A keyless peer naming itself after the victim's fingerprint
+	impostor := NewPeer(newMockConn(), &mockHandler{})
+	server.addPeer(impostor)
+	if !server.IdentifyNode(impostor, crypto.Fingerprint(key)) {
+		t.Fatal("IdentifyNode() dropped the keyless peer")
+	}
+
+	if victim.Closed() {
+		t.Error("Keyless peer replaced the key-identified one")
+	}
+	if len(peerList(server)) != 2 {
+		t.Errorf("peers = %v, want both", peerList(server))
+	}
+	if impostor.ID() == victim.ID() {
+		t.Errorf("ID() = %q for both peers", victim.ID())
+	}
+}
+
+func TestTransport_IdentifySimultaneousDial(t *testing.T) {
+	localKey := []byte("local identity key")
+	type identifyCase struct {
+		name     string
+		remoteID string // what the remote is keyed by
+		lower    bool   // whether this node's ID is the lower one
+		identify func(*Transport, *Peer) bool
+	}
+	var tests []identifyCase
+	for _, remoteKey := range []string{"remote key a", "remote key b", "remote key c"} {
+		remoteKey := []byte(remoteKey)
+		tests = append(tests, identifyCase{string(remoteKey), crypto.Fingerprint(remoteKey), crypto.Fingerprint(localKey) < crypto.Fingerprint(remoteKey), func(tr *Transport, p *Peer) bool {
+			return tr.Identify(p, remoteKey)
+		}})
+	}
+	// Peers without identity keys are keyed by node ID
+	for _, nodeID := range []string{"alpha", "omega"} {
+		nodeID := nodeID
+		tests = append(tests, identifyCase{"node " + nodeID, "node:" + nodeID, "local" < nodeID, func(tr *Transport, p *Peer) bool {
+			return tr.IdentifyNode(p, nodeID)
+		}})
+	}
+
+	for _, tt := range tests {
+		transport, err := NewTransport("local", "127.0.0.1:0", &mockHandler{}, WithIdentityKey(localKey))
+		if err != nil {
+			t.Fatalf("Failed to create transport: %v", err)
+		}
+
+		inbound := NewPeer(newMockConn(), &mockHandler{})
+		outbound := NewPeer(newMockConn(), &mockHandler{})
+		outbound.outbound = true
+		transport.addPeer(inbound)
+		transport.addPeer(outbound)
+
+		// Both sides keep the connection dialed by the lower ID
+		want := inbound
+		if tt.lower {
+			want = outbound
+		}
+		tt.identify(transport, inbound)
+		tt.identify(transport, outbound)
+
+		transport.mu.RLock()
+		got := transport.peers[tt.remoteID]
+		transport.mu.RUnlock()
+		if got != want {
+			t.Errorf("%s: kept outbound = %v, want outbound = %v", tt.name, got != nil && got.outbound, want.outbound)
+		}
+		if inbound.Closed() == outbound.Closed() {
+			t.Errorf("%s: closed inbound %v, outbound %v, want exactly one closed", tt.name, inbound.Closed(), outbound.Closed())
+		}
+		transport.Stop()
+	}
+}
+
+func TestTransport_DropsPeersWithoutHandshake(t *testing.T) {
+	server, err := NewTransport("server", "127.0.0.1:0", &mockHandler{}, WithHandshakeWindow(200*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithBulkChannel(false), WithHandshakeWindow(0))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	// Nobody identifies the other, as a node would after the handshake
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	unidentified := onlyPeer(t, server)
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, "server", nil)
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := server.Broadcast(msg); err != nil {
+		t.Fatalf("Broadcast() error = %v", err)
+	}
+	if sent := unidentified.Stats().MessagesSent; sent[protocol.MessageTypeData] != 0 {
+		t.Error("Unidentified peer was sent a broadcast")
+	}
+
+	waitClosed(t, unidentified, 5*time.Second)
+	if n := server.PeerCount(); n != 0 {
+		t.Errorf("PeerCount() = %d after the handshake window, want 0", n)
+	}
+
+	// Identified peers are kept
+	identified := NewPeer(newMockConn(), &mockHandler{})
+	server.addPeer(identified)
+	server.IdentifyNode(identified, "node")
+	time.Sleep(400 * time.Millisecond)
+	if identified.Closed() {
+		t.Error("Identified peer was dropped")
+	}
+}
@@ -0,0 +1,132 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// WithListenAddresses makes the transport listen on addresses besides its
+// main one, such as an IPv6 address or the address of another interface.
+// All of them are advertised in handshakes, after the main address.
+func WithListenAddresses(addresses ...string) Option {
+	return func(t *Transport) {
+		t.extraAddrs = append(t.extraAddrs, addresses...)
+	}
+}
+
+// WithAdvertisedAddress sets the address sent in handshakes, for nodes
+// whose bind address is useless to peers, such as ":9000" or an address
+// inside a container. See SetAdvertisedAddress.
+func WithAdvertisedAddress(address string) Option {
+	return func(t *Transport) {
+		t.advertised = address
+	}
+}
+
+// listenExtra opens the listeners for the extra addresses, closing any
+// already open if one fails
+func (t *Transport) listenExtra() error {
+	for _, address := range t.extraAddrs {
+		listener, err := t.network.Listen(address)
+		if err != nil {
+			for _, l := range t.extraListeners {
+				l.Close()
+			}
+			t.extraListeners = nil
+			return fmt.Errorf("failed to listen on %s: %w", address, err)
+		}
+		t.extraListeners = append(t.extraListeners, listener)
+	}
+	return nil
+}
+
+// listeners returns the main listener followed by the extra ones
+func (t *Transport) listeners() []net.Listener {
+	return append([]net.Listener{t.listener}, t.extraListeners...)
+}
+
+// Addresses returns every address the transport listens on, starting with
+// the main one
+func (t *Transport) Addresses() []string {
+	return append([]string{t.address}, t.extraAddrs...)
+}
+
+// AdvertisedAddresses returns the addresses sent in handshakes: the
+// advertised address followed by the other listen addresses
+func (t *Transport) AdvertisedAddresses() []string {
+	addresses := []string{t.AdvertisedAddress()}
+	for _, address := range t.Addresses() {
+		if address != addresses[0] {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// ConnectAny connects to a peer that can be reached at any of addresses,
+// trying them in order until one succeeds. Each attempt has its own dial
+// and handshake timeouts; ctx bounds them all.
+func (t *Transport) ConnectAny(ctx context.Context, addresses []string) error {
+	if len(addresses) == 0 {
+		return fmt.Errorf("no address to connect to")
+	}
+	var errs []error
+	for _, address := range addresses {
+		err := t.Connect(ctx, address)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", address, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DialableAddress returns the address to dial a peer at, given the address
+// it advertised and the one its connection came from. An advertised host
+// that can't be reached from here, such as an unspecified, loopback or
+// private address, is replaced by the observed one, keeping the advertised
+// port. Advertised addresses that are not host:port pairs, such as
+// WebSocket URLs, are returned unchanged.
+func DialableAddress(advertised, observed string) string {
+	if strings.Contains(advertised, "://") {
+		return advertised
+	}
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return advertised
+	}
+	observedHost, _, err := net.SplitHostPort(observed)
+	if err != nil || reachableFrom(host, observedHost) {
+		return advertised
+	}
+	return net.JoinHostPort(observedHost, port)
+}
+
+// reachableFrom reports whether a host advertised by a peer that connected
+// from observed can be dialed. Host names are taken at their word.
+func reachableFrom(host, observed string) bool {
+	if host == "" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	remote := net.ParseIP(observed)
+	if ip == nil || remote == nil {
+		return true
+	}
+	switch {
+	case ip.IsUnspecified():
+		return false
+	case ip.IsLoopback():
+		return remote.IsLoopback()
+	case ip.IsPrivate(), ip.IsLinkLocalUnicast():
+		// Only peers on the same kind of network can route to it
+		return remote.IsPrivate() || remote.IsLinkLocalUnicast() || remote.IsLoopback()
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package network
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTransport_ListensOnExtraAddresses(t *testing.T) {
+	accepted := make(chan *Peer, 2)
+	server, err := NewTransport("server", "127.0.0.1:0", &mockHandler{},
+		WithListenAddresses("127.0.0.1:0"),
+		WithConnectHandler(func(p *Peer) { accepted <- p }),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	server.Start()
+	defer server.Stop()
+
+	if got := len(server.Addresses()); got != 2 {
+		t.Errorf("Addresses() has %d entries, want 2", got)
+	}
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	client.Start()
+	defer client.Stop()
+
+	// Nothing listens on the first address, so the second is dialed
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	unreachable := closed.Addr().String()
+	closed.Close()
+
+	extra := server.extraListeners[0].Addr().String()
+	if err := client.ConnectAny(context.Background(), []string{unreachable, extra}); err != nil {
+		t.Fatalf("ConnectAny() error = %v", err)
+	}
+	select {
+	case <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection on the extra address was not accepted")
+	}
+
+	if err := client.ConnectAny(context.Background(), []string{unreachable}); err == nil {
+		t.Error("ConnectAny() to an unreachable address succeeded")
+	}
+}
+
+func TestTransport_AdvertisedAddresses(t *testing.T) {
+	transport, err := NewTransport("node", "127.0.0.1:0", &mockHandler{}, WithListenAddresses("127.0.0.2:0"))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer transport.Stop()
+
+	want := []string{"127.0.0.1:0", "127.0.0.2:0"}
+	if got := transport.AdvertisedAddresses(); !reflect.DeepEqual(got, want) {
+		t.Errorf("AdvertisedAddresses() = %v, want %v", got, want)
+	}
+
+	transport.SetAdvertisedAddress("203.0.113.1:3000")
+	want = []string{"203.0.113.1:3000", "127.0.0.1:0", "127.0.0.2:0"}
+	if got := transport.AdvertisedAddresses(); !reflect.DeepEqual(got, want) {
+		t.Errorf("AdvertisedAddresses() = %v, want %v", got, want)
+	}
+}
+
+func TestDialableAddress(t *testing.T) {
+	tests := []struct {
+		name       string
+		advertised string
+		observed   string
+		want       string
+	}{
+		{"public address", "203.0.113.1:3000", "198.51.100.7:51234", "203.0.113.1:3000"},
+		{"bind address", ":3000", "198.51.100.7:51234", "198.51.100.7:3000"},
+		{"unspecified IPv6", "[::]:3000", "[2001:db8::7]:51234", "[2001:db8::7]:3000"},
+		{"loopback from afar", "127.0.0.1:3000", "198.51.100.7:51234", "198.51.100.7:3000"},
+		{"loopback locally", "127.0.0.1:3000", "127.0.0.1:51234", "127.0.0.1:3000"},
+		{"container address", "172.17.0.2:3000", "198.51.100.7:51234", "198.51.100.7:3000"},
+		{"private network", "192.168.1.10:3000", "192.168.1.10:51234", "192.168.1.10:3000"},
+		{"host name", "node1.example.com:3000", "198.51.100.7:51234", "node1.example.com:3000"},
+		{"WebSocket URL", "ws://node1.example.com/p2p", "198.51.100.7:51234", "ws://node1.example.com/p2p"},
+	}
+
+	for _, tt := range tests {
+		if got := DialableAddress(tt.advertised, tt.observed); got != tt.want {
+			t.Errorf("%s: DialableAddress(%q, %q) = %q, want %q", tt.name, tt.advertised, tt.observed, got, tt.want)
+		}
+	}
+}
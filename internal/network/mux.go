@@ -0,0 +1,114 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"sync/atomic"
+
+	"p2p-storage/internal/protocol"
+)
+
+// muxFragmentSize is the largest piece of a frame written at once to a
+// multiplexed peer. Larger frames are split so that other messages, and
+// the pieces of other frames, can be written between their pieces.
+const muxFragmentSize = 16 << 10
+
+// muxState tracks the frames sent to a peer in fragments
+type muxState struct {
+	// allowed is set by the transport and enabled once the peer announced
+	// that it reassembles fragments
+	allowed bool
+	enabled atomic.Bool
+	// nextStream numbers the frames sent in fragments, and slots holds one
+	// token for each of them under way, up to protocol.MaxStreams
+	nextStream atomic.Uint64
+	slots      chan struct{}
+}
+
+// muxPartial is a frame of which only some fragments have arrived
+type muxPartial struct {
+	data []byte
+	size int64 // bytes read off the wire, held against the in-flight limit
+}
+
+// EnableMux sends frames larger than a fragment to the peer in fragments,
+// so a large transfer doesn't hold up the messages sent after it. Only
+// peers that announced they reassemble fragments are sent them, and peers
+// on a plain JSON stream never are.
+func (p *Peer) EnableMux() {
+	if p.mux.allowed && p.framed {
+		p.mux.enabled.Store(true)
+	}
+}
+
+// Muxed reports whether large frames are sent to the peer in fragments
+func (p *Peer) Muxed() bool {
+	return p.mux.enabled.Load()
+}
+
+// writeFrameData writes an encoded frame, in fragments if it is large and
+// the peer is multiplexed
+func (p *Peer) writeFrameData(data []byte) error {
+	if !p.Muxed() || len(data) <= muxFragmentSize {
+		return p.write(func(w io.Writer) error {
+			return writeFrame(w, data)
+		})
+	}
+
+	select {
+	case p.mux.slots <- struct{}{}:
+	case <-p.done:
+		return net.ErrClosed
+	}
+	defer func() { <-p.mux.slots }()
+
+	stream := p.mux.nextStream.Add(1)
+	for start := 0; start < len(data); start += muxFragmentSize {
+		end := min(start+muxFragmentSize, len(data))
+		fragment := protocol.AppendFragment(nil, stream, end == len(data), data[start:end])
+		if err := p.write(func(w io.Writer) error {
+			return writeFrame(w, fragment)
+		}); err != nil {
+			return err
+		}
+		// Let messages waiting for the connection go before the next piece
+		runtime.Gosched()
+	}
+	return nil
+}
+
+// reassemble collects fragments until the frame they belong to is
+// complete. It returns the frame and its size on the wire once its last
+// fragment arrives, and a nil frame until then. Frames that aren't
+// fragments are complete as they are. The fragments of frames still
+// arriving count against the in-flight limit.
+func (p *Peer) reassemble(partials map[uint64]*muxPartial, data []byte, size int64) ([]byte, int64, error) {
+	stream, final, piece, ok, err := protocol.ParseFragment(data)
+	if err != nil || !ok {
+		return data, size, err
+	}
+
+	partial := partials[stream]
+	if partial == nil {
+		if len(partials) >= protocol.MaxStreams {
+			return nil, 0, fmt.Errorf("more than %d fragmented frames at once", protocol.MaxStreams)
+		}
+		partial = &muxPartial{}
+		partials[stream] = partial
+	}
+	if len(partial.data)+len(piece) > p.maxFrame {
+		return nil, 0, fmt.Errorf("%w: fragments of more than %d bytes", ErrFrameTooLarge, p.maxFrame)
+	}
+	// Each fragment was reserved as it was read, and stays reserved until
+	// the whole frame has been handled
+	partial.data = append(partial.data, piece...)
+	partial.size += size
+	if !final {
+		return nil, 0, nil
+	}
+
+	delete(partials, stream)
+	return partial.data, partial.size, nil
+}
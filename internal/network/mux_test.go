@@ -0,0 +1,134 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestTransport_MuxInterleavesLargeFrames(t *testing.T) {
+	serverHandler := newTransferRecorder()
+	server, err := NewTransport("server", "127.0.0.1:0", serverHandler)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	// Slow enough that the chunk takes about a second to send
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithBulkChannel(false),
+		WithRateLimits(RateLimits{Upload: 512 << 10}))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	<-serverHandler.messages // handshake
+	peer := onlyPeer(t, client)
+	binaryCodec, err := protocol.CodecByName(protocol.CodecBinary)
+	if err != nil {
+		t.Fatalf("Failed to get codec: %v", err)
+	}
+	peer.UseCodec(binaryCodec)
+	peer.EnableMux()
+	if !peer.Muxed() {
+		t.Fatal("Muxed() = false after EnableMux")
+	}
+
+	data := bytes.Repeat([]byte{0xab}, 1<<20)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- peer.SendTransfer("client", &protocol.DataTransfer{ContentHash: "big", Data: data, FinalChunk: true})
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeLeave, "client", protocol.LeavePayload{NodeID: "client"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := peer.Send(msg); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	select {
+	case got := <-serverHandler.messages:
+		if got.Type != protocol.MessageTypeLeave {
+			t.Errorf("message = %s, want %s", got.Type, protocol.MessageTypeLeave)
+		}
+		if len(serverHandler.transfers) > 0 {
+			t.Error("Message arrived after the chunk sent before it, want it to overtake")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+
+	select {
+	case got := <-serverHandler.transfers:
+		if got.ContentHash != "big" || !bytes.Equal(got.Data, data) {
+			t.Errorf("transfer %s of %d bytes, want big of %d", got.ContentHash, len(got.Data), len(data))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for transfer")
+	}
+	if err := <-sent; err != nil {
+		t.Errorf("SendTransfer() error = %v", err)
+	}
+}
+
+func TestPeer_Reassemble(t *testing.T) {
+	peer := NewPeer(newMockConn(), &mockHandler{})
+	peer.maxFrame = 10
+	partials := make(map[uint64]*muxPartial)
+
+	// Whole frames pass through
+	if frame, _, err := peer.reassemble(partials, []byte("{}"), 2); err != nil || string(frame) != "{}" {
+		t.Errorf("reassemble() of a whole frame = %q, %v", frame, err)
+	}
+
+	// Interleaved streams
+	pieces := []struct {
+		stream uint64
+		final  bool
+		piece  string
+	}{{1, false, "ab"}, {2, false, "xy"}, {1, true, "cd"}, {2, true, "z"}}
+	var got []string
+	for _, p := range pieces {
+		frame, _, err := peer.reassemble(partials, protocol.AppendFragment(nil, p.stream, p.final, []byte(p.piece)), 10)
+		if err != nil {
+			t.Fatalf("reassemble() error = %v", err)
+		}
+		if frame != nil {
+			got = append(got, string(frame))
+		}
+	}
+	if len(got) != 2 || got[0] != "abcd" || got[1] != "xyz" {
+		t.Errorf("Reassembled %q, want [abcd xyz]", got)
+	}
+	if len(partials) != 0 || peer.inflight.Load() != 0 {
+		t.Errorf("%d streams and %d bytes left over", len(partials), peer.inflight.Load())
+	}
+
+	// Frames may not grow past the maximum frame size
+	peer.reassemble(partials, protocol.AppendFragment(nil, 3, false, []byte("0123456789")), 10)
+	if _, _, err := peer.reassemble(partials, protocol.AppendFragment(nil, 3, true, []byte("!")), 10); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("reassemble() past the maximum = %v, want %v", err, ErrFrameTooLarge)
+	}
+
+	// Nor may too many be under way at once
+	partials = make(map[uint64]*muxPartial)
+	for i := 0; i < protocol.MaxStreams; i++ {
+		if _, _, err := peer.reassemble(partials, protocol.AppendFragment(nil, uint64(i), false, nil), 1); err != nil {
+			t.Fatalf("reassemble() error = %v", err)
+		}
+	}
+	if _, _, err := peer.reassemble(partials, protocol.AppendFragment(nil, 99, false, nil), 1); err == nil {
+		t.Error("reassemble() of one stream too many succeeded, want an error")
+	}
+}
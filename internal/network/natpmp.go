@@ -0,0 +1,108 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// natPMPPort is where routers listen for NAT-PMP requests (RFC 6886)
+	natPMPPort = 5351
+
+	natPMPOpExternalAddress = 0
+	natPMPOpMapTCP          = 2
+	// natPMPReply is added to the opcode of a request in its response
+	natPMPReply = 128
+)
+
+// NATPMP maps ports with NAT-PMP, as spoken by many home routers
+type NATPMP struct {
+	gateway string // host:port of the router
+	timeout time.Duration
+}
+
+// NewNATPMP creates a NAT-PMP client for the router at gateway (host:port)
+func NewNATPMP(gateway string, timeout time.Duration) *NATPMP {
+	return &NATPMP{gateway: gateway, timeout: timeout}
+}
+
+// Name implements PortMapper
+func (p *NATPMP) Name() string {
+	return "NAT-PMP"
+}
+
+// ExternalIP implements PortMapper
+func (p *NATPMP) ExternalIP() (net.IP, error) {
+	resp, err := p.call([]byte{0, natPMPOpExternalAddress}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(resp[8:12]), nil
+}
+
+// AddMapping implements PortMapper
+func (p *NATPMP) AddMapping(internalPort, externalPort int, lifetime time.Duration) (int, error) {
+	request := make([]byte, 12)
+	request[1] = natPMPOpMapTCP
+	binary.BigEndian.PutUint16(request[4:], uint16(internalPort))
+	binary.BigEndian.PutUint16(request[6:], uint16(externalPort))
+	binary.BigEndian.PutUint32(request[8:], uint32(lifetime/time.Second))
+
+	resp, err := p.call(request, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(resp[10:])), nil
+}
+
+// DeleteMapping implements PortMapper. A mapping is deleted by asking for it
+// again with no lifetime.
+func (p *NATPMP) DeleteMapping(internalPort, externalPort int) error {
+	_, err := p.AddMapping(internalPort, 0, 0)
+	return err
+}
+
+// call sends a request and returns the response, which must be at least
+// size bytes. Requests are resent with doubling waits until the timeout, as
+// NAT-PMP runs over UDP.
+func (p *NATPMP) call(request []byte, size int) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", p.gateway, p.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach gateway %s: %w", p.gateway, err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(p.timeout)
+	buf := make([]byte, 16)
+	for wait := 250 * time.Millisecond; time.Now().Before(deadline); wait *= 2 {
+		if _, err := conn.Write(request); err != nil {
+			return nil, fmt.Errorf("failed to send NAT-PMP request: %w", err)
+		}
+		if next := time.Now().Add(wait); next.Before(deadline) {
+			conn.SetReadDeadline(next)
+		} else {
+			conn.SetReadDeadline(deadline)
+		}
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read NAT-PMP response: %w", err)
+		}
+		resp := buf[:n]
+		if n < size || resp[1] != request[1]+natPMPReply {
+			return nil, fmt.Errorf("invalid NAT-PMP response of %d bytes", n)
+		}
+		if code := binary.BigEndian.Uint16(resp[2:]); code != 0 {
+			return nil, fmt.Errorf("NAT-PMP request refused with result code %d", code)
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("gateway %s did not answer NAT-PMP within %s", p.gateway, p.timeout)
+}
@@ -0,0 +1,95 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeNATPMP answers NAT-PMP requests like a router with address
+// 203.0.113.9 that maps every port to one above the port asked for
+func fakeNATPMP(t *testing.T, result uint16) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < 2 {
+				continue
+			}
+			resp := []byte{0, buf[1] + natPMPReply, 0, 0, 0, 0, 0, 1}
+			binary.BigEndian.PutUint16(resp[2:], result)
+			switch buf[1] {
+			case natPMPOpExternalAddress:
+				resp = append(resp, 203, 0, 113, 9)
+			case natPMPOpMapTCP:
+				external := binary.BigEndian.Uint16(buf[6:])
+				if external != 0 {
+					external++
+				}
+				resp = append(resp, buf[4:6]...)
+				resp = binary.BigEndian.AppendUint16(resp, external)
+				resp = append(resp, buf[8:12]...)
+			}
+			conn.WriteTo(resp, from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestNATPMP(t *testing.T) {
+	pmp := NewNATPMP(fakeNATPMP(t, 0), time.Second)
+	if pmp.Name() != "NAT-PMP" {
+		t.Errorf("Name() = %q, want NAT-PMP", pmp.Name())
+	}
+
+	ip, err := pmp.ExternalIP()
+	if err != nil {
+		t.Fatalf("ExternalIP() error = %v", err)
+	}
+	if !ip.Equal(net.ParseIP("203.0.113.9")) {
+		t.Errorf("ExternalIP() = %v, want 203.0.113.9", ip)
+	}
+
+	port, err := pmp.AddMapping(3000, 3000, time.Hour)
+	if err != nil {
+		t.Fatalf("AddMapping() error = %v", err)
+	}
+	if port != 3001 {
+		t.Errorf("AddMapping() = %d, want the granted port 3001", port)
+	}
+	if err := pmp.DeleteMapping(3000, port); err != nil {
+		t.Errorf("DeleteMapping() error = %v", err)
+	}
+}
+
+func TestNATPMP_Refused(t *testing.T) {
+	// Result code 2: not authorized
+	pmp := NewNATPMP(fakeNATPMP(t, 2), time.Second)
+	if _, err := pmp.AddMapping(3000, 3000, time.Hour); err == nil {
+		t.Error("AddMapping() on a refusing router succeeded, want error")
+	}
+}
+
+func TestNATPMP_NoAnswer(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	pmp := NewNATPMP(conn.LocalAddr().String(), 300*time.Millisecond)
+	if _, err := pmp.ExternalIP(); err == nil {
+		t.Error("ExternalIP() from a silent gateway succeeded, want error")
+	}
+}
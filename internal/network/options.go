@@ -0,0 +1,332 @@
+package network
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// SocketOptions holds the TCP tuning knobs applied to every peer connection
+type SocketOptions struct {
+	// KeepAlive is the TCP keepalive probe interval. Zero uses the OS
+	// default, a negative value disables keepalives.
+	KeepAlive time.Duration
+	// NoDelay disables Nagle's algorithm when true
+	NoDelay bool
+	// ReadBuffer is the socket receive buffer size in bytes (0 = OS default)
+	ReadBuffer int
+	// WriteBuffer is the socket send buffer size in bytes (0 = OS default)
+	WriteBuffer int
+}
+
+// DefaultSocketOptions returns the socket options used when none are configured
+func DefaultSocketOptions() SocketOptions {
+	return SocketOptions{
+		KeepAlive: 15 * time.Second,
+		NoDelay:   true,
+	}
+}
+
+// DefaultWriteTimeout is how long a single message write may block before
+// the receiving peer is considered wedged and evicted
+const DefaultWriteTimeout = 30 * time.Second
+
+// DefaultDialTimeout and DefaultHandshakeTimeout bound the two stages of
+// Connect: opening the connection, then securing it and sending the
+// handshake
+const (
+	DefaultDialTimeout      = 10 * time.Second
+	DefaultHandshakeTimeout = 10 * time.Second
+)
+
+// DefaultHandshakeWindow is how long a connection may stay open without
+// completing the handshake, in either direction
+const DefaultHandshakeWindow = 30 * time.Second
+
+// Option configures a Transport
+type Option func(*Transport)
+
+// WithSocketOptions sets the TCP socket options for accepted and dialed connections
+func WithSocketOptions(opts SocketOptions) Option {
+	return func(t *Transport) {
+		t.socketOpts = opts
+	}
+}
+
+// WithWriteTimeout sets the per-message write deadline. Peers whose sockets
+// stay blocked longer than this are disconnected. Zero disables the deadline.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(t *Transport) {
+		t.writeTimeout = d
+	}
+}
+
+// WithDialTimeout bounds how long Connect waits for a connection to open.
+// Zero leaves it to the context passed to Connect.
+func WithDialTimeout(d time.Duration) Option {
+	return func(t *Transport) {
+		t.dialTimeout = d
+	}
+}
+
+// WithHandshakeTimeout bounds how long Connect may take, once connected, to
+// complete the TLS handshake and send the node's handshake. Zero leaves it
+// to the context passed to Connect.
+func WithHandshakeTimeout(d time.Duration) Option {
+	return func(t *Transport) {
+		t.handshakeTimeout = d
+	}
+}
+
+// WithHandshakeWindow sets how long a peer connection may stay open before
+// the handshake identifies the peer; see Transport.Identify. Connections
+// that don't complete it in time are closed. Zero keeps them open.
+func WithHandshakeWindow(d time.Duration) Option {
+	return func(t *Transport) {
+		t.handshakeWindow = d
+	}
+}
+
+// WithNetwork replaces TCP with another network, such as a SimNetwork that
+// connects transports within one process
+func WithNetwork(network Network) Option {
+	return func(t *Transport) {
+		t.network = network
+	}
+}
+
+// WithFraming controls whether dialed connections send messages as
+// length-prefixed frames (the default). Nodes that predate framing only
+// accept a JSON stream; accepted connections work either way.
+func WithFraming(enabled bool) Option {
+	return func(t *Transport) {
+		t.framing = enabled
+	}
+}
+
+// WithMaxFrameSize bounds the size of a single framed message. Larger
+// incoming frames close the connection, and larger outgoing messages are
+// refused with ErrFrameTooLarge.
+func WithMaxFrameSize(size int) Option {
+	return func(t *Transport) {
+		t.maxFrame = size
+	}
+}
+
+// WithCodecs sets the codecs announced in the handshake of outgoing
+// connections, in order of preference (default protocol.Codecs)
+func WithCodecs(codecs []string) Option {
+	return func(t *Transport) {
+		t.codecs = codecs
+	}
+}
+
+// WithMultiplexing controls whether frames larger than a fragment are sent
+// in fragments, interleaved with other messages, to peers that announce
+// protocol.FeatureMux once Peer.EnableMux is called (the default). Without
+// it a large frame holds up every message sent after it.
+func WithMultiplexing(enabled bool) Option {
+	return func(t *Transport) {
+		t.muxing = enabled
+	}
+}
+
+// WithFrameCompression sets the schemes announced in the handshake of
+// outgoing connections for compressing frames, in order of preference
+// (default protocol.FrameCompressions). An empty list asks peers to send
+// frames uncompressed.
+func WithFrameCompression(schemes []string) Option {
+	return func(t *Transport) {
+		t.compressions = schemes
+	}
+}
+
+// WithCompressThreshold sets the size below which frames are sent
+// uncompressed, since compressing small messages saves little
+func WithCompressThreshold(size int) Option {
+	return func(t *Transport) {
+		t.compressMin = size
+	}
+}
+
+// WithWebSocket also accepts peer connections as WebSockets on address, at
+// WebSocketPath, for peers that can only reach this node over HTTP. The
+// listener speaks plain HTTP; put a TLS-terminating proxy in front of it to
+// offer wss:// URLs.
+func WithWebSocket(address string) Option {
+	return func(t *Transport) {
+		t.wsAddress = address
+	}
+}
+
+// WithHeartbeat sets how often peers are pinged and how many pings they may
+// leave unanswered before they are evicted
+func WithHeartbeat(cfg HeartbeatConfig) Option {
+	return func(t *Transport) {
+		t.heartbeat = cfg
+	}
+}
+
+// WithEvictHandler sets a function called for each peer evicted for not
+// answering heartbeats, after its connection is closed
+func WithEvictHandler(fn func(*Peer)) Option {
+	return func(t *Transport) {
+		t.onEvict = fn
+	}
+}
+
+// WithMalformedHandler sets a function called for each peer that sent a
+// message or chunk refused by protocol.Validate, before its connection is
+// closed
+func WithMalformedHandler(fn func(*Peer, error)) Option {
+	return func(t *Transport) {
+		t.onMalformed = fn
+	}
+}
+
+// WithBroadcastFailureHandler sets a function called for each broadcast
+// that could not be written to a peer after it was queued. It runs on the
+// goroutine writing the peer's queue and must not block.
+func WithBroadcastFailureHandler(fn func(*Peer, *protocol.Message, error)) Option {
+	return func(t *Transport) {
+		t.onBroadcastFailure = fn
+	}
+}
+
+// WithConnectHandler adds a function called for each peer connection once
+// it is registered, before its handshake, so the peer's ID is still its
+// remote address. Handlers run in the order they were added, on the
+// goroutine that set up the connection, and must not block.
+func WithConnectHandler(fn func(*Peer)) Option {
+	return func(t *Transport) {
+		t.onConnect = append(t.onConnect, fn)
+	}
+}
+
+// WithDisconnectHandler adds a function called for each peer connection
+// after it is closed, whatever the reason, including connections closed as
+// duplicates of another to the same peer. Handlers must not block.
+func WithDisconnectHandler(fn func(*Peer)) Option {
+	return func(t *Transport) {
+		t.onDisconnect = append(t.onDisconnect, fn)
+	}
+}
+
+// WithConnFilter rejects connections for which filter returns an error. The
+// filter is given the address before dialing and the remote address of
+// accepted connections.
+func WithConnFilter(filter func(address string) error) Option {
+	return func(t *Transport) {
+		t.filter = filter
+	}
+}
+
+// WithIdentityKey sets the public identity key sent in the handshake of
+// outgoing connections
+func WithIdentityKey(key []byte) Option {
+	return func(t *Transport) {
+		t.identityKey = key
+	}
+}
+
+// WithExchangeKey sets the X25519 public key and its identity signature
+// sent in the handshake of outgoing connections
+func WithExchangeKey(public, signature []byte) Option {
+	return func(t *Transport) {
+		t.exchangeKey = public
+		t.exchangeSignature = signature
+	}
+}
+
+// WithKeyless marks outgoing handshakes as coming from a node that holds
+// only public content, so the first node does not send it the network key
+func WithKeyless(keyless bool) Option {
+	return func(t *Transport) {
+		t.keyless = keyless
+	}
+}
+
+// WithCapabilities sets the capabilities announced in outgoing handshakes
+func WithCapabilities(caps protocol.Capabilities) Option {
+	return func(t *Transport) {
+		t.capabilities = &caps
+	}
+}
+
+// WithNetworkID sets the network ID announced in outgoing handshakes
+func WithNetworkID(id string) Option {
+	return func(t *Transport) {
+		t.networkID = id
+	}
+}
+
+// WithInvite sets the invite token presented in handshakes dialed to
+// address, the invite-only node it joins; other peers never see it
+func WithInvite(token, address string) Option {
+	return func(t *Transport) {
+		t.invite = token
+		t.inviteAddress = address
+	}
+}
+
+// WithBulkChannel controls whether dialed connections open a separate bulk
+// connection for chunk data (the default). Without one, chunks are sent as
+// JSON messages on the control connection.
+func WithBulkChannel(enabled bool) Option {
+	return func(t *Transport) {
+		t.bulkEnabled = enabled
+	}
+}
+
+// WithTLS secures every peer connection, control and bulk, with config,
+// typically from NewTLSConfig. Both sides must use TLS; peers without it
+// fail the TLS handshake.
+func WithTLS(config *tls.Config) Option {
+	return func(t *Transport) {
+		t.tlsConfig = config
+	}
+}
+
+// applySocketOptions tunes a connection according to the transport's socket options.
+// Connections that are not TCP (e.g. in tests) are left untouched.
+func (t *Transport) applySocketOptions(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	opts := t.socketOpts
+	if opts.KeepAlive >= 0 {
+		if err := tcpConn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if opts.KeepAlive > 0 {
+			if err := tcpConn.SetKeepAlivePeriod(opts.KeepAlive); err != nil {
+				return err
+			}
+		}
+	} else {
+		if err := tcpConn.SetKeepAlive(false); err != nil {
+			return err
+		}
+	}
+
+	if err := tcpConn.SetNoDelay(opts.NoDelay); err != nil {
+		return err
+	}
+
+	if opts.ReadBuffer > 0 {
+		if err := tcpConn.SetReadBuffer(opts.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.WriteBuffer > 0 {
+		if err := tcpConn.SetWriteBuffer(opts.WriteBuffer); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
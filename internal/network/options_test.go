@@ -0,0 +1,112 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithSocketOptions(t *testing.T) {
+	opts := SocketOptions{
+		KeepAlive:   30 * time.Second,
+		NoDelay:     false,
+		ReadBuffer:  64 * 1024,
+		WriteBuffer: 64 * 1024,
+	}
+
+	transport, err := NewTransport("test-node", ":0", &mockHandler{}, WithSocketOptions(opts))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer transport.Stop()
+
+	if transport.socketOpts != opts {
+		t.Errorf("Transport socketOpts = %+v, want %+v", transport.socketOpts, opts)
+	}
+}
+
+func TestTransport_ApplySocketOptions(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name string
+		opts SocketOptions
+	}{
+		{name: "defaults", opts: DefaultSocketOptions()},
+		{name: "keepalive disabled", opts: SocketOptions{KeepAlive: -1}},
+		{name: "buffers", opts: SocketOptions{NoDelay: true, ReadBuffer: 128 * 1024, WriteBuffer: 128 * 1024}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &Transport{socketOpts: tt.opts}
+			if err := transport.applySocketOptions(conn); err != nil {
+				t.Errorf("applySocketOptions() error = %v", err)
+			}
+		})
+	}
+
+	// Non-TCP connections are ignored
+	transport := &Transport{socketOpts: DefaultSocketOptions()}
+	if err := transport.applySocketOptions(newMockConn()); err != nil {
+		t.Errorf("applySocketOptions() on mock conn error = %v", err)
+	}
+}
+
+func TestTransport_ConnFilter(t *testing.T) {
+	errBlocked := errors.New("blocked")
+	filter := func(address string) error {
+		if strings.HasPrefix(address, "127.0.0.1:") {
+			return errBlocked
+		}
+		return nil
+	}
+
+	server, err := NewTransport("server", "127.0.0.1:0", &mockHandler{}, WithConnFilter(filter))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	// Dialing a filtered address fails before any connection is made
+	if err := server.Connect(context.Background(), "127.0.0.1:1"); !errors.Is(err, errBlocked) {
+		t.Errorf("Connect() error = %v, want %v", err, errBlocked)
+	}
+
+	// Accepted connections from filtered addresses are closed
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, want the connection closed", err)
+	}
+	if count := server.PeerCount(); count != 0 {
+		t.Errorf("PeerCount() = %d, want 0", count)
+	}
+}
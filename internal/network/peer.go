@@ -1,78 +1,579 @@
 package network
 
 import (
+	"bufio"
+	"crypto/rand"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"p2p-storage/internal/protocol"
 )
 
+// ErrSlowPeer is returned when a write to a peer stays blocked past the write timeout
+var ErrSlowPeer = errors.New("peer write timed out")
+
+// ErrQueueFull is returned when a peer has fallen broadcastQueueSize
+// broadcasts behind
+var ErrQueueFull = errors.New("peer broadcast queue full")
+
+// broadcastQueueSize bounds the broadcasts waiting to be written to a peer
+const broadcastQueueSize = 256
+
 // Peer represents a connected peer
 type Peer struct {
-	conn    net.Conn
-	handler MessageHandler
-	done    chan struct{}
-	mu      sync.Mutex
+	conn         net.Conn
+	handler      MessageHandler
+	done         chan struct{}
+	mu           sync.Mutex
+	closeOnce    sync.Once
+	writeTimeout time.Duration
+	onClose      func(*Peer)
+	// onBulkToken pairs the bulk channel announced by the remote side
+	onBulkToken func(*Peer, string)
+	// onMalformed is told of messages refused by protocol.Validate
+	onMalformed func(*Peer, error)
+	bulkMu      sync.Mutex
+	bulk        *bulkChannel
+
+	// countMessage, if set, is called with the type of each message received
+	countMessage func(protocol.MessageType)
+	// counts are the connection's messages and errors; see Stats
+	counts peerCounts
+	// tap, if set, holds the transport's debug tap; see Transport.SetTap
+	tap *atomic.Pointer[Tap]
+
+	// certificate is the one presented over TLS, nil for plaintext
+	certificate *x509.Certificate
+	// sessionKey is the identity key proven in the session handshake, nil
+	// without session encryption
+	sessionKey []byte
+
+	// localID is this node's ID, sent in pongs
+	localID   string
+	heartbeat heartbeat
+
+	// framed peers exchange length-prefixed frames of at most maxFrame
+	// bytes instead of a JSON stream
+	framed   bool
+	maxFrame int
+	// codec encodes frames sent to the peer; nil means JSON
+	codecMu sync.Mutex
+	codec   protocol.Codec
+	// compression, if set, compresses frames sent to the peer of at least
+	// compressMin bytes
+	compression string
+	compressMin int
+	// mux sends large frames in fragments once enabled; see EnableMux
+	mux muxState
+	// stamping stamps each message sent to the peer; see EnableStamps
+	stamping atomic.Bool
+	// seal holds the keys stamps are sealed with either way; see SealStamps
+	seal atomic.Pointer[sealKeys]
+
+	// identity is the peer's identity key fingerprint, or its node ID if
+	// it has no key, once the handshake has named it; see Transport.Identify
+	idMu     sync.RWMutex
+	identity string
+	// outbound is set for connections this side dialed
+	outbound bool
+	// handshakeTimer closes the connection unless the handshake identifies
+	// the peer in time; guarded by the transport's mu
+	handshakeTimer *time.Timer
+	// challenge is what the peer signs to prove its identity key; see
+	// Challenge. hello is the payload of the handshake this side sent, if
+	// it dialed.
+	challengeOnce sync.Once
+	challenge     []byte
+	hello         []byte
+	// counted is conn before TLS, where its traffic is throttled; nil for
+	// peers not set up by a transport
+	counted net.Conn
+
+	// readTimeout bounds how long a started message may take to arrive;
+	// inflight counts the bytes of messages being handled, up to maxInflight
+	readTimeout time.Duration
+	maxInflight int64
+	inflight    atomic.Int64
+	// handling holds the reservations of messages being handled, for Hold
+	handlingMu sync.Mutex
+	handling   map[*protocol.Message]*reservation
+
+	// queue holds broadcasts waiting to be written; see enqueue
+	queueOnce sync.Once
+	queue     chan queuedMessage
+
+	// lastUseful is when the peer last sent something other than a
+	// heartbeat, in Unix nanoseconds; see Transport.makeRoom
+	lastUseful atomic.Int64
+	// lastSent is when something other than a heartbeat was last sent to
+	// the peer, likewise; see LastUsed
+	lastSent atomic.Int64
 }
 
 // NewPeer creates a new peer
 func NewPeer(conn net.Conn, handler MessageHandler) *Peer {
-	return &Peer{
+	p := &Peer{
 		conn:    conn,
 		handler: handler,
 		done:    make(chan struct{}),
 	}
+	p.mux.slots = make(chan struct{}, protocol.MaxStreams)
+	p.counts.since = time.Now()
+	p.markUseful()
+	return p
 }
 
-// ID returns the peer's ID (using remote address for now)
+// ID returns the fingerprint of the peer's identity key, which stays the
+// same across reconnects, or its node ID if it presented no key. Until the
+// handshake has identified the peer, it is its remote address.
 func (p *Peer) ID() string {
+	if identity := p.identified(); identity != "" {
+		return identity
+	}
 	return p.conn.RemoteAddr().String()
 }
 
+// identified returns the ID set by the handshake, or ""
+func (p *Peer) identified() string {
+	p.idMu.RLock()
+	defer p.idMu.RUnlock()
+	return p.identity
+}
+
+// Challenge returns the random value this side sent, or sends, in its
+// handshake on the connection for the peer to sign; see protocol.ProofData
+func (p *Peer) Challenge() []byte {
+	p.challengeOnce.Do(func() {
+		p.challenge = make([]byte, protocol.ChallengeSize)
+		rand.Read(p.challenge)
+	})
+	return p.challenge
+}
+
+// Hello returns the payload of the handshake this side sent on a
+// connection it dialed, which the peer's reply proves its key with
+func (p *Peer) Hello() []byte {
+	p.idMu.RLock()
+	defer p.idMu.RUnlock()
+	return p.hello
+}
+
+// Certificate returns the certificate the peer presented over TLS, or nil
+// if the connection is plaintext
+func (p *Peer) Certificate() *x509.Certificate {
+	return p.certificate
+}
+
+// SessionKey returns the identity key the peer proved it holds in the
+// session handshake, or nil if the connection has no session
+func (p *Peer) SessionKey() []byte {
+	return p.sessionKey
+}
+
 // Start starts handling peer communication
 func (p *Peer) Start() {
 	go p.readLoop()
 }
 
-// Close closes the peer connection
+// Close closes the peer connection. It is safe to call more than once.
 func (p *Peer) Close() error {
-	close(p.done)
-	return p.conn.Close()
+	var err error
+	p.closeOnce.Do(func() {
+		p.bulkMu.Lock()
+		close(p.done)
+		if p.bulk != nil {
+			p.bulk.conn.Close()
+			p.bulk = nil
+		}
+		p.bulkMu.Unlock()
+		err = p.conn.Close()
+		if p.onClose != nil {
+			p.onClose(p)
+		}
+	})
+	return err
 }
 
-// Send sends a message to the peer
+// Closed reports whether the peer connection has been closed
+func (p *Peer) Closed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Send sends a message to the peer. If the write stays blocked longer than
+// the peer's write timeout the peer is considered wedged and is evicted.
 func (p *Peer) Send(msg *protocol.Message) error {
+	var err error
+	if p.stamping.Load() {
+		// A copy, since the same message may go to several peers
+		stamped, err := msg.Stamp()
+		if err != nil {
+			return p.countSent(msg.Type, err)
+		}
+		if keys := p.seal.Load(); keys != nil {
+			stamped.Seal(keys.send)
+		}
+		msg = stamped
+	}
+	if !p.framed {
+		err = p.write(func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(msg)
+		})
+	} else {
+		err = p.sendFrame(string(msg.Type), func(codec protocol.Codec) ([]byte, error) {
+			return codec.EncodeMessage(msg)
+		})
+	}
+	if err == nil {
+		p.tapMessage(true, msg)
+	}
+	return p.countSent(msg.Type, err)
+}
+
+// sendFrame encodes a message with the peer's codec and sends it as a frame
+func (p *Peer) sendFrame(kind string, encode func(protocol.Codec) ([]byte, error)) error {
+	data, err := encode(p.Codec())
+	if err != nil {
+		return err
+	}
+	if len(data) > p.maxFrame {
+		return fmt.Errorf("%w: %d bytes of %s", ErrFrameTooLarge, len(data), kind)
+	}
+	if scheme := p.Compression(); scheme != "" && len(data) >= p.compressMin {
+		// Kept as is where compression doesn't make it smaller, such as
+		// encrypted chunk data
+		if packed, err := protocol.CompressFrame(scheme, data); err == nil && len(packed) < len(data) {
+			data = packed
+		}
+	}
+	return p.writeFrameData(data)
+}
+
+// write runs fn with exclusive use of the connection under the write timeout
+func (p *Peer) write(fn func(io.Writer) error) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	return json.NewEncoder(p.conn).Encode(msg)
+	if p.writeTimeout > 0 {
+		if err := p.conn.SetWriteDeadline(time.Now().Add(p.writeTimeout)); err != nil {
+			return err
+		}
+	}
+
+	if err := fn(p.conn); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// A partial write leaves the stream unusable, so drop the peer
+			fmt.Printf("Evicting slow peer %s: write blocked for more than %v\n", p.ID(), p.writeTimeout)
+			p.Close()
+			return fmt.Errorf("%w: %v", ErrSlowPeer, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// queuedMessage is a broadcast waiting to be written to a peer, and what to
+// tell if writing it fails
+type queuedMessage struct {
+	msg    *protocol.Message
+	failed func(*Peer, *protocol.Message, error)
+}
+
+// enqueue queues msg to be sent to the peer in the background, in the order
+// queued, calling failed, if set, if the write fails. A peer whose queue is full is
+// closed, since it can't keep up, and ErrQueueFull is returned.
+func (p *Peer) enqueue(msg *protocol.Message, failed func(*Peer, *protocol.Message, error)) error {
+	p.queueOnce.Do(func() {
+		p.queue = make(chan queuedMessage, broadcastQueueSize)
+		go p.drainQueue()
+	})
+	select {
+	case p.queue <- queuedMessage{msg: msg, failed: failed}:
+		return nil
+	default:
+		fmt.Printf("Evicting slow peer %s: %d broadcasts waiting\n", p.ID(), broadcastQueueSize)
+		p.Close()
+		return ErrQueueFull
+	}
+}
+
+// drainQueue writes queued broadcasts until the peer is closed
+func (p *Peer) drainQueue() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case q := <-p.queue:
+			if err := p.Send(q.msg); err != nil && q.failed != nil {
+				q.failed(p, q.msg, err)
+			}
+		}
+	}
+}
+
+// EnableStamps stamps every message sent to the peer with the time and a
+// nonce from now on, as the handshake asks of peers announcing
+// protocol.FeatureReplay
+func (p *Peer) EnableStamps() {
+	p.stamping.Store(true)
+}
+
+// sealKeys are the keys of the MACs of messages sent to and received from
+// a peer
+type sealKeys struct {
+	send, receive []byte
+}
+
+// SealStamps seals the stamp of every message sent to the peer with send
+// from now on, and makes Sealed report that its messages must be sealed
+// with receive, as the handshake asks of peers announcing
+// protocol.FeatureSealed
+func (p *Peer) SealStamps(send, receive []byte) {
+	p.seal.Store(&sealKeys{send: send, receive: receive})
+}
+
+// Sealed reports whether messages from the peer must be sealed, and if so
+// whether msg is, with the key set by SealStamps
+func (p *Peer) Sealed(msg *protocol.Message) (required, ok bool) {
+	keys := p.seal.Load()
+	if keys == nil {
+		return false, false
+	}
+	return true, msg.VerifySeal(keys.receive)
+}
+
+// UseCodec sets the codec of messages sent to the peer, as negotiated in
+// the handshake. Peers on a plain JSON stream keep using it.
+func (p *Peer) UseCodec(codec protocol.Codec) {
+	p.codecMu.Lock()
+	defer p.codecMu.Unlock()
+	if p.framed {
+		p.codec = codec
+	}
+}
+
+// UseCompression sets the scheme frames sent to the peer are compressed
+// with, as negotiated in the handshake; "" sends them uncompressed. Peers on
+// a plain JSON stream are never sent compressed messages.
+func (p *Peer) UseCompression(scheme string) {
+	p.codecMu.Lock()
+	defer p.codecMu.Unlock()
+	if p.framed {
+		p.compression = scheme
+	}
+}
+
+// Compression returns the scheme frames sent to the peer are compressed
+// with, or ""
+func (p *Peer) Compression() string {
+	p.codecMu.Lock()
+	defer p.codecMu.Unlock()
+	return p.compression
+}
+
+// Codec returns the codec of messages sent to the peer
+func (p *Peer) Codec() protocol.Codec {
+	p.codecMu.Lock()
+	defer p.codecMu.Unlock()
+	if p.codec == nil {
+		codec, _ := protocol.CodecByName(protocol.CodecJSON)
+		return codec
+	}
+	return p.codec
 }
 
 func (p *Peer) readLoop() {
-	decoder := json.NewDecoder(p.conn)
+	read := p.messageReader()
 
 	for {
 		select {
 		case <-p.done:
 			return
 		default:
-			var msg protocol.Message
-			if err := decoder.Decode(&msg); err != nil {
+			msg, transfer, size, err := read()
+			if errors.Is(err, ErrInflightLimit) {
+				fmt.Printf("Disconnecting peer %s: %v\n", p.ID(), err)
+				p.Close()
+				return
+			}
+			if err != nil {
 				fmt.Printf("Error reading message from peer %s: %v\n", p.ID(), err)
 				p.Close()
 				return
 			}
+			// Held until the handler is done with the message; see Hold
+			p.track(msg, size)
+			p.dispatch(msg, transfer)
+			p.untrack(msg, size)
+		}
+	}
+}
 
-			if err := p.handler.HandleMessage(p, &msg); err != nil {
-				fmt.Printf("Error handling message from peer %s: %v\n", p.ID(), err)
+// dispatch handles a message read from the control connection
+func (p *Peer) dispatch(msg *protocol.Message, transfer *protocol.DataTransfer) {
+	p.countReceived(msg.Type)
+
+	err := protocol.Validate(msg)
+	if transfer != nil {
+		err = protocol.ValidateTransfer(transfer)
+	}
+	if err != nil {
+		p.refuseMalformed(err)
+		return
+	}
+
+	if transfer != nil {
+		p.tapTransfer(false, transfer)
+		p.markUseful()
+		if err := p.deliverTransfer(transfer); err != nil {
+			p.counts.handleErrors.Add(1)
+			fmt.Printf("Error handling transfer from peer %s: %v\n", p.ID(), err)
+		}
+		return
+	}
+
+	p.tapMessage(false, msg)
+	switch msg.Type {
+	case protocol.MessageTypeBulkChannel:
+		p.handleBulkChannel(msg)
+		return
+	case protocol.MessageTypePing:
+		p.handlePing(msg)
+		return
+	case protocol.MessageTypePong:
+		p.handlePong(msg)
+		return
+	}
+
+	p.markUseful()
+	if err := p.handler.HandleMessage(p, msg); err != nil {
+		p.counts.handleErrors.Add(1)
+		fmt.Printf("Error handling message from peer %s: %v\n", p.ID(), err)
+	}
+}
+
+// refuseMalformed disconnects a peer that sent a message or chunk out of
+// bounds; see protocol.Validate
+func (p *Peer) refuseMalformed(err error) {
+	p.counts.handleErrors.Add(1)
+	fmt.Printf("Disconnecting peer %s: %v\n", p.ID(), err)
+	if p.onMalformed != nil {
+		p.onMalformed(p, err)
+	}
+	p.Close()
+}
+
+// messageReader returns the function that reads the next message from the
+// connection, as frames or as a JSON stream, along with its size. The size
+// is reserved against the in-flight limit before the message is read, from
+// a frame's header or as the maximum frame size for JSON, and stays
+// reserved once the message is returned; the caller releases it. Frames
+// sent in fragments are returned once their last fragment arrives. Messages
+// over the maximum frame size are refused either way.
+func (p *Peer) messageReader() func() (*protocol.Message, *protocol.DataTransfer, int64, error) {
+	br := bufio.NewReader(p.conn)
+	limit := &messageLimit{r: br, max: p.maxFrame}
+	if p.framed {
+		// readFrameData refuses oversized frames from their header
+		limit.max += frameHeaderSize
+		partials := make(map[uint64]*muxPartial)
+		var reserved int64
+		reserve := func(size int64) error {
+			if err := p.acquire(size); err != nil {
+				return err
+			}
+			reserved = size
+			return nil
+		}
+		return func() (*protocol.Message, *protocol.DataTransfer, int64, error) {
+			for {
+				if err := p.awaitMessage(br, false); err != nil {
+					return nil, nil, 0, err
+				}
+				limit.start = limit.pulled
+				reserved = 0
+				data, err := readFrameData(limit, p.maxFrame, reserve)
+				p.conn.SetReadDeadline(time.Time{})
+				if err != nil {
+					p.release(reserved)
+					return nil, nil, 0, p.messageRead(err)
+				}
+				frame, size, err := p.reassemble(partials, data, reserved)
+				if err != nil {
+					p.release(reserved)
+					return nil, nil, 0, err
+				}
+				if frame == nil {
+					// More fragments to come
+					continue
+				}
+				msg, transfer, err := decodeFrame(frame, p.maxFrame)
+				return msg, transfer, size, err
 			}
 		}
 	}
+	decoder := json.NewDecoder(limit)
+	return func() (*protocol.Message, *protocol.DataTransfer, int64, error) {
+		if err := p.awaitMessage(br, pendingJSON(decoder)); err != nil {
+			return nil, nil, 0, err
+		}
+		// A JSON message has no length up front, so the most it may take
+		// is reserved and the rest given back once it is read
+		reserved := int64(p.maxFrame)
+		if err := p.acquire(reserved); err != nil {
+			return nil, nil, 0, err
+		}
+		limit.start = decoder.InputOffset()
+		var msg protocol.Message
+		err := decoder.Decode(&msg)
+		p.conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			p.release(reserved)
+			return nil, nil, 0, p.messageRead(err)
+		}
+		size := decoder.InputOffset() - limit.start
+		if size <= reserved {
+			p.release(reserved - size)
+		} else if err := p.acquire(size - reserved); err != nil {
+			// Only without a maximum frame size
+			p.release(reserved)
+			return nil, nil, 0, err
+		}
+		return &msg, nil, size, nil
+	}
 }
 
 // Address returns the peer's address
 func (p *Peer) Address() string {
 	return p.conn.RemoteAddr().String()
 }
+
+// Outbound reports whether this side dialed the connection
+func (p *Peer) Outbound() bool {
+	return p.outbound
+}
+
+// handleBulkChannel passes the token of an announced bulk channel to the transport
+func (p *Peer) handleBulkChannel(msg *protocol.Message) {
+	var payload protocol.BulkChannelPayload
+	if err := msg.ParsePayload(&payload); err != nil || payload.Token == "" {
+		fmt.Printf("Invalid bulk channel announcement from peer %s\n", p.ID())
+		return
+	}
+	if p.onBulkToken != nil {
+		p.onBulkToken(p, payload.Token)
+	}
+}
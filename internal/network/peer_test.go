@@ -1,6 +1,7 @@
 package network
 
 import (
+	"errors"
 	"net"
 	"sync"
 	"testing"
@@ -125,4 +126,43 @@ func TestPeer_Close(t *testing.T) {
 	if !closed {
 		t.Error("Connection not marked as closed")
 	}
+	if !peer.Closed() {
+		t.Error("Closed() = false after Close")
+	}
+}
+
+func TestPeer_SendSlowPeer(t *testing.T) {
+	// net.Pipe is unbuffered, so writes block until the other side reads
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	peer := NewPeer(local, &mockHandler{})
+	peer.writeTimeout = 50 * time.Millisecond
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, "test", nil)
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+
+	err = peer.Send(msg)
+	if !errors.Is(err, ErrSlowPeer) {
+		t.Fatalf("Send() error = %v, want %v", err, ErrSlowPeer)
+	}
+
+	select {
+	case <-peer.done:
+	default:
+		t.Error("Slow peer was not closed")
+	}
+}
+
+func TestPeer_CloseTwice(t *testing.T) {
+	peer := NewPeer(newMockConn(), &mockHandler{})
+
+	if err := peer.Close(); err != nil {
+		t.Errorf("Failed to close peer: %v", err)
+	}
+	if err := peer.Close(); err != nil {
+		t.Errorf("Second close returned error: %v", err)
+	}
 }
@@ -0,0 +1,100 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrPeerLimit is returned when a connection would go over the peer limits
+// and no peer can be evicted to make room for it
+var ErrPeerLimit = errors.New("peer limit reached")
+
+// PeerLimits caps the peer connections a transport keeps open, so large
+// swarms can't exhaust its file descriptors. Zero means no limit.
+type PeerLimits struct {
+	// MaxInbound and MaxOutbound cap accepted and dialed connections
+	// separately, so peers dialing in can't crowd out the ones this node
+	// chose to dial
+	MaxInbound  int
+	MaxOutbound int
+	// EvictIdle is how long a peer must have sent nothing useful before it
+	// may be evicted to make room for a new connection. Zero never evicts;
+	// new connections are refused while a limit is reached.
+	EvictIdle time.Duration
+}
+
+// DefaultPeerLimits returns limits of 128 inbound and 32 outbound
+// connections, evicting the least recently useful peer once it has been of
+// no use for a minute
+func DefaultPeerLimits() PeerLimits {
+	return PeerLimits{
+		MaxInbound:  128,
+		MaxOutbound: 32,
+		EvictIdle:   time.Minute,
+	}
+}
+
+// WithPeerLimits caps the number of inbound and outbound connections
+func WithPeerLimits(limits PeerLimits) Option {
+	return func(t *Transport) {
+		t.peerLimits = limits
+	}
+}
+
+// LastUseful returns when the peer last sent a message or chunk other than
+// a heartbeat, or when it connected if it hasn't yet
+func (p *Peer) LastUseful() time.Time {
+	return time.Unix(0, p.lastUseful.Load())
+}
+
+// LastUsed returns when anything other than a heartbeat was last sent to
+// or received from the peer, or when it connected if nothing was yet
+func (p *Peer) LastUsed() time.Time {
+	return time.Unix(0, max(p.lastUseful.Load(), p.lastSent.Load()))
+}
+
+func (p *Peer) markUseful() {
+	p.lastUseful.Store(time.Now().UnixNano())
+}
+
+// makeRoom checks that there is room for one more connection in a
+// direction, evicting the least recently useful peer in that direction if
+// the limit is reached and it has been idle long enough
+func (t *Transport) makeRoom(outbound bool) error {
+	limit, direction := t.peerLimits.MaxInbound, "inbound"
+	if outbound {
+		limit, direction = t.peerLimits.MaxOutbound, "outbound"
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	t.mu.RLock()
+	count := 0
+	var victim *Peer
+	for _, peer := range t.peers {
+		if peer.outbound != outbound || peer.Closed() {
+			continue
+		}
+		count++
+		if victim == nil || peer.LastUseful().Before(victim.LastUseful()) {
+			victim = peer
+		}
+	}
+	t.mu.RUnlock()
+	if count < limit {
+		return nil
+	}
+
+	idle := time.Since(victim.LastUseful())
+	if t.peerLimits.EvictIdle <= 0 || idle < t.peerLimits.EvictIdle {
+		return fmt.Errorf("%w: %d %s connections", ErrPeerLimit, count, direction)
+	}
+	fmt.Printf("Evicting peer %s to make room: nothing useful for %v\n", victim.ID(), idle.Round(time.Second))
+	victim.Close()
+	if t.onEvict != nil {
+		t.onEvict(victim)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// limitedServer starts a transport with limits that reports each peer it
+// accepts
+func limitedServer(t *testing.T, limits PeerLimits) (*Transport, chan *Peer) {
+	t.Helper()
+	accepted := make(chan *Peer, 4)
+	server, err := NewTransport("server", "127.0.0.1:0", &mockHandler{},
+		WithPeerLimits(limits),
+		WithConnectHandler(func(p *Peer) { accepted <- p }),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	server.Start()
+	return server, accepted
+}
+
+// connectClient connects a new transport to server and returns the
+// server's side of the connection
+func connectClient(t *testing.T, server *Transport, accepted chan *Peer) *Peer {
+	t.Helper()
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	client.Start()
+	t.Cleanup(client.Stop)
+
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	select {
+	case peer := <-accepted:
+		return peer
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connection was not accepted")
+		return nil
+	}
+}
+
+func TestTransport_RefusesInboundOverLimit(t *testing.T) {
+	server, accepted := limitedServer(t, PeerLimits{MaxInbound: 1})
+	defer server.Stop()
+
+	first := connectClient(t, server, accepted)
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+	client.Connect(context.Background(), server.listener.Addr().String())
+
+	select {
+	case <-accepted:
+		t.Fatal("Connection over the limit was accepted")
+	case <-time.After(300 * time.Millisecond):
+	}
+	if first.Closed() {
+		t.Error("Peer without an idle limit was evicted")
+	}
+	if got := server.PeerCount(); got != 1 {
+		t.Errorf("PeerCount() = %d, want 1", got)
+	}
+}
+
+func TestTransport_EvictsLeastRecentlyUseful(t *testing.T) {
+	server, accepted := limitedServer(t, PeerLimits{MaxInbound: 2, EvictIdle: time.Nanosecond})
+	defer server.Stop()
+
+	first := connectClient(t, server, accepted)
+	second := connectClient(t, server, accepted)
+	// The first peer has been useful since the second connected
+	first.markUseful()
+
+	third := connectClient(t, server, accepted)
+	waitClosed(t, second, 2*time.Second)
+	if first.Closed() || third.Closed() {
+		t.Error("A more recently useful peer was evicted")
+	}
+}
+
+func TestTransport_RefusesOutboundOverLimit(t *testing.T) {
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithBulkChannel(false), WithPeerLimits(PeerLimits{MaxOutbound: 1}))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	client.Start()
+	defer client.Stop()
+
+	for i, want := range []error{nil, ErrPeerLimit} {
+		server, _ := limitedServer(t, PeerLimits{})
+		defer server.Stop()
+		if err := client.Connect(context.Background(), server.listener.Addr().String()); !errors.Is(err, want) {
+			t.Errorf("Connect() #%d error = %v, want %v", i+1, err, want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultPortMapTimeout bounds each request to the router, discovery
+// included
+const DefaultPortMapTimeout = 3 * time.Second
+
+// ErrNoPortMapper is returned when no router answers NAT-PMP or UPnP
+var ErrNoPortMapper = errors.New("no NAT-PMP or UPnP router found")
+
+// PortMapper forwards a TCP port on the router in front of this host, so
+// peers outside can dial in
+type PortMapper interface {
+	// Name identifies the protocol spoken to the router
+	Name() string
+	// ExternalIP returns the router's public address
+	ExternalIP() (net.IP, error)
+	// AddMapping forwards externalPort on the router to internalPort on
+	// this host for lifetime, and returns the external port the router
+	// granted, which may differ from the one asked for
+	AddMapping(internalPort, externalPort int, lifetime time.Duration) (int, error)
+	// DeleteMapping removes a mapping made by AddMapping
+	DeleteMapping(internalPort, externalPort int) error
+}
+
+// DiscoverPortMapper finds the router in front of this host, trying NAT-PMP
+// at the default gateway first and then UPnP
+func DiscoverPortMapper(timeout time.Duration) (PortMapper, error) {
+	var errs []error
+	if gateway, err := defaultGateway(); err != nil {
+		errs = append(errs, err)
+	} else {
+		pmp := NewNATPMP(net.JoinHostPort(gateway.String(), fmt.Sprint(natPMPPort)), timeout)
+		if _, err := pmp.ExternalIP(); err != nil {
+			errs = append(errs, fmt.Errorf("NAT-PMP: %w", err))
+		} else {
+			return pmp, nil
+		}
+	}
+
+	igd, err := DiscoverUPnP(timeout)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("UPnP: %w", err))
+		return nil, fmt.Errorf("%w: %v", ErrNoPortMapper, errors.Join(errs...))
+	}
+	return igd, nil
+}
+
+// defaultGateway returns the IPv4 default route's gateway. It is read from
+// /proc/net/route, so it is only found on Linux; elsewhere discovery falls
+// back to UPnP.
+func defaultGateway() (net.IP, error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes: %w", err)
+	}
+	defer f.Close()
+	return parseDefaultGateway(f)
+}
+
+// parseDefaultGateway finds the default route in a /proc/net/route table,
+// whose addresses are little-endian hex
+func parseDefaultGateway(r io.Reader) (net.IP, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != net.IPv4len {
+			continue
+		}
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, binary.LittleEndian.Uint32(raw))
+		if !ip.IsUnspecified() {
+			return ip, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no default gateway")
+}
@@ -0,0 +1,26 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseDefaultGateway(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	0000A8C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+eth0	00000000	0101A8C0	0003	0	0	0	00000000	0	0	0
+`
+	ip, err := parseDefaultGateway(strings.NewReader(routes))
+	if err != nil {
+		t.Fatalf("parseDefaultGateway() error = %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.168.1.1")) {
+		t.Errorf("parseDefaultGateway() = %v, want 192.168.1.1", ip)
+	}
+
+	noDefault := strings.SplitAfterN(routes, "\n", 3)
+	if _, err := parseDefaultGateway(strings.NewReader(noDefault[0] + noDefault[1])); err == nil {
+		t.Error("Expected error for a table without a default route")
+	}
+}
@@ -0,0 +1,127 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	// DefaultPunchTimeout is how long Punch keeps dialing before giving up
+	DefaultPunchTimeout = 10 * time.Second
+	// punchAttemptTimeout bounds a single dial; behind NAT, most attempts
+	// fail until the other side's dials have opened its router
+	punchAttemptTimeout = time.Second
+	// punchRetryInterval paces the dials of a punch
+	punchRetryInterval = 250 * time.Millisecond
+)
+
+// ErrPunchingDisabled is returned by Punch on transports created without
+// WithHolePunching
+var ErrPunchingDisabled = errors.New("hole punching is not enabled")
+
+// WithHolePunching lets peers behind NAT connect directly by dialing each
+// other at the same time, see Punch. The TCP listener then shares its port
+// with these dials.
+func WithHolePunching(enabled bool) Option {
+	return func(t *Transport) {
+		t.punching = enabled
+	}
+}
+
+// Punch opens a direct connection to a peer behind NAT that is dialing this
+// transport at the same time, coordinated through another peer. Dials leave
+// from the listen port, which the peer was told, so each side's outgoing
+// SYNs open its router to the other's, until a connection opens either
+// through a TCP simultaneous open or a normal accept. The initiator sets up
+// the connection as dialed and sends the handshake; the other side serves it
+// like an accepted one, so the two agree on which end runs the TLS client.
+func (t *Transport) Punch(address string, initiator bool, timeout time.Duration) error {
+	if !t.punching {
+		return ErrPunchingDisabled
+	}
+	local, ok := t.listenAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("hole punching needs a TCP listener, have %s", t.listenAddr().Network())
+	}
+	if t.filter != nil {
+		if err := t.filter(address); err != nil {
+			return err
+		}
+	}
+
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: local.IP, Port: local.Port},
+		Control:   reusePortControl,
+		Timeout:   punchAttemptTimeout,
+	}
+	if !initiator {
+		// Let the initiator's first dial win where nothing is in the way,
+		// rather than racing it to two half-open connections
+		time.Sleep(punchRetryInterval)
+	}
+
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		select {
+		case <-t.done:
+			return errors.New("transport stopped")
+		default:
+		}
+		// The other side's dial may have been accepted already
+		if t.hasPeer(address) {
+			return nil
+		}
+
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			lastErr = err
+			time.Sleep(punchRetryInterval)
+			continue
+		}
+		if initiator {
+			// The hole is only open between the two listen ports, so chunks
+			// share the control connection
+			ctx, cancel := withTimeout(context.Background(), t.handshakeTimeout)
+			defer cancel()
+			return t.connectConn(ctx, address, conn, false)
+		}
+		if err := t.applySocketOptions(conn); err != nil {
+			fmt.Printf("Failed to apply socket options to %s: %v\n", address, err)
+		}
+		go t.serveConn(t.countConn(conn))
+		return nil
+	}
+	return fmt.Errorf("failed to punch through to %s: %w", address, lastErr)
+}
+
+// DiscoverExternalAddress asks a STUN server for the address the router
+// maps the listen port to. Punches leave from that port, so this is the
+// address peers punching through to the transport should dial.
+func (t *Transport) DiscoverExternalAddress(server string, timeout time.Duration) (*net.TCPAddr, error) {
+	if !t.punching {
+		return nil, ErrPunchingDisabled
+	}
+	local, ok := t.listenAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, fmt.Errorf("hole punching needs a TCP listener, have %s", t.listenAddr().Network())
+	}
+	return DiscoverExternalAddress(server, &net.TCPAddr{IP: local.IP, Port: local.Port}, timeout)
+}
+
+// hasPeer reports whether a peer is connected from address. Peers are keyed
+// by identity, so this looks at where their connections come from.
+func (t *Transport) hasPeer(address string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, peer := range t.peers {
+		if peer.Address() == address {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package network
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestTransport_Punch(t *testing.T) {
+	initiator, err := NewTransport("initiator", "127.0.0.1:0", &mockHandler{}, WithHolePunching(true))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer initiator.Stop()
+	initiator.Start()
+
+	responderHandler := newTransferRecorder()
+	responder, err := NewTransport("responder", "127.0.0.1:0", responderHandler, WithHolePunching(true))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer responder.Stop()
+	responder.Start()
+
+	// Both sides dial each other from their listen ports at the same time
+	errs := make(chan error, 1)
+	go func() {
+		errs <- responder.Punch(initiator.listener.Addr().String(), false, DefaultPunchTimeout)
+	}()
+	if err := initiator.Punch(responder.listener.Addr().String(), true, DefaultPunchTimeout); err != nil {
+		t.Fatalf("Initiator Punch() error = %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Responder Punch() error = %v", err)
+	}
+
+	select {
+	case msg := <-responderHandler.messages:
+		if msg.Type != protocol.MessageTypeHandshake || msg.SenderID != "initiator" {
+			t.Errorf("message = %s from %q, want %s from initiator", msg.Type, msg.SenderID, protocol.MessageTypeHandshake)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the handshake")
+	}
+
+	// The connection leaves from the initiator's listen port
+	peer := onlyPeer(t, initiator)
+	if got, want := peer.conn.LocalAddr().String(), initiator.listener.Addr().String(); got != want {
+		t.Errorf("local address = %s, want %s", got, want)
+	}
+	// Further punches see the peer by the address it is connected from
+	if !initiator.hasPeer(responder.listener.Addr().String()) {
+		t.Error("hasPeer() = false for the punched peer's address")
+	}
+}
+
+func TestTransport_DiscoverExternalAddress(t *testing.T) {
+	server := serveSTUN(t, false)
+	defer server.Close()
+
+	transport, err := NewTransport("node", "127.0.0.1:0", &mockHandler{}, WithHolePunching(true))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer transport.Stop()
+	transport.Start()
+
+	// The request leaves from the listen port, so the mapping is the one
+	// punches get
+	addr, err := transport.DiscoverExternalAddress(server.Addr().String(), DefaultSTUNTimeout)
+	if err != nil {
+		t.Fatalf("DiscoverExternalAddress() error = %v", err)
+	}
+	if got, want := addr.String(), transport.listener.Addr().String(); got != want {
+		t.Errorf("DiscoverExternalAddress() = %s, want %s", got, want)
+	}
+}
+
+func TestTransport_PunchDisabled(t *testing.T) {
+	transport, err := NewTransport("node", "127.0.0.1:0", &mockHandler{})
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer transport.Stop()
+
+	if err := transport.Punch("127.0.0.1:1", true, time.Second); !errors.Is(err, ErrPunchingDisabled) {
+		t.Errorf("Punch() error = %v, want %v", err, ErrPunchingDisabled)
+	}
+}
@@ -0,0 +1,111 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimits caps transfer rates in bytes per second. Zero means no limit.
+type RateLimits struct {
+	// Upload and Download cap the traffic of all peers together
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	// PeerUpload and PeerDownload cap the traffic of each peer, its control
+	// connection and bulk channel together
+	PeerUpload   int64 `json:"peer_upload"`
+	PeerDownload int64 `json:"peer_download"`
+}
+
+// WithRateLimits caps the transport's upload and download rates, see
+// SetRateLimits
+func WithRateLimits(limits RateLimits) Option {
+	return func(t *Transport) {
+		t.limiter.set(limits)
+	}
+}
+
+// SetRateLimits changes the rate caps. Connections already open follow the
+// new caps from their next read or write.
+func (t *Transport) SetRateLimits(limits RateLimits) {
+	t.limiter.set(limits)
+}
+
+// RateLimits returns the current rate caps
+func (t *Transport) RateLimits() RateLimits {
+	return t.limiter.get()
+}
+
+// tokenBucket paces bytes to a rate with a burst of one second's worth.
+// Takers may overdraw it and then wait until the debt is paid off, so large
+// writes pass whole, at the average rate.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// take charges n bytes at rate bytes per second and returns how long the
+// caller must wait before they may pass
+func (b *tokenBucket) take(n int, rate int64) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+		if b.tokens > float64(rate) {
+			b.tokens = float64(rate)
+		}
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(rate) * float64(time.Second))
+}
+
+// rateBuckets pace one direction each
+type rateBuckets struct {
+	upload   tokenBucket
+	download tokenBucket
+}
+
+// rateLimiter holds the transport's caps and the buckets of all peers
+// together. Each peer has its own rateBuckets, shared by its connections.
+type rateLimiter struct {
+	mu     sync.RWMutex
+	limits RateLimits
+	total  rateBuckets
+}
+
+func (l *rateLimiter) set(limits RateLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+func (l *rateLimiter) get() RateLimits {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.limits
+}
+
+// uploadDelay charges n bytes sent to a peer and returns how long to wait
+// before sending them
+func (l *rateLimiter) uploadDelay(peer *rateBuckets, n int) time.Duration {
+	limits := l.get()
+	return max(l.total.upload.take(n, limits.Upload), peer.upload.take(n, limits.PeerUpload))
+}
+
+// downloadDelay charges n bytes received from a peer and returns how long
+// to wait before reading more
+func (l *rateLimiter) downloadDelay(peer *rateBuckets, n int) time.Duration {
+	limits := l.get()
+	return max(l.total.download.take(n, limits.Download), peer.download.take(n, limits.PeerDownload))
+}
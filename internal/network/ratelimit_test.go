@@ -0,0 +1,98 @@
+package network
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	var b tokenBucket
+	if wait := b.take(1000, 0); wait != 0 {
+		t.Errorf("take() without a limit waits %v, want 0", wait)
+	}
+
+	// A second's worth passes at once, then the debt is paid off at the rate
+	if wait := b.take(1000, 1000); wait != 0 {
+		t.Errorf("take() within the burst waits %v, want 0", wait)
+	}
+	wait := b.take(500, 1000)
+	if wait < 450*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("take() over the burst waits %v, want about 500ms", wait)
+	}
+}
+
+// throttledPipe returns a counted connection of transport whose other end
+// is drained
+func throttledPipe(t *testing.T, transport *Transport) *countingConn {
+	t.Helper()
+	local, remote := net.Pipe()
+	go io.Copy(io.Discard, remote)
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return transport.countConn(local).(*countingConn)
+}
+
+func TestCountingConn_RateLimits(t *testing.T) {
+	transport, err := NewTransport("node", "127.0.0.1:0", &mockHandler{}, WithRateLimits(RateLimits{PeerUpload: 64 << 10}))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer transport.Stop()
+
+	conn := throttledPipe(t, transport)
+	// The write waits past its deadline, which is pushed back by the wait
+	conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	if _, err := conn.Write(make([]byte, 64<<10+16<<10)); err != nil {
+		t.Fatalf("Throttled write failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Write over the per-peer limit took %v, want at least 200ms", elapsed)
+	}
+
+	// A bulk channel shares the per-peer budget of its control connection
+	bulk := throttledPipe(t, transport)
+	shareBuckets(bulk, conn)
+	if bulk.buckets.Load() != conn.buckets.Load() {
+		t.Error("Bulk channel does not share the control connection's buckets")
+	}
+
+	// Lifting the limit applies to open connections
+	transport.SetRateLimits(RateLimits{})
+	if got := transport.RateLimits(); got != (RateLimits{}) {
+		t.Errorf("RateLimits() = %+v, want none", got)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	start = time.Now()
+	if _, err := conn.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Unthrottled write took %v", elapsed)
+	}
+}
+
+func TestCountingConn_TotalLimitAcrossPeers(t *testing.T) {
+	transport, err := NewTransport("node", "127.0.0.1:0", &mockHandler{}, WithRateLimits(RateLimits{Upload: 64 << 10}))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer transport.Stop()
+
+	// Two peers each within a burst still share the transport-wide budget
+	first, second := throttledPipe(t, transport), throttledPipe(t, transport)
+	start := time.Now()
+	if _, err := first.Write(make([]byte, 48<<10)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if _, err := second.Write(make([]byte, 32<<10)); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("Writes over the total limit took %v, want at least 200ms", elapsed)
+	}
+}
@@ -0,0 +1,161 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// DefaultReadTimeout is how long the rest of a message may take to arrive
+// once its first byte has. Idle peers are left alone; heartbeats find dead
+// ones.
+const DefaultReadTimeout = 60 * time.Second
+
+// DefaultMaxInflight bounds the bytes of a peer's messages being handled at
+// once, across its control connection and bulk channel. It leaves room for
+// a message of the default maximum size on each.
+const DefaultMaxInflight = 64 << 20
+
+// ErrInflightLimit is returned when a peer's messages being handled at once
+// would exceed the in-flight limit
+var ErrInflightLimit = errors.New("peer exceeded the in-flight byte limit")
+
+// WithReadTimeout sets how long a message may take to arrive once it has
+// started. Peers that trickle a message slower than this are disconnected.
+// Zero disables the deadline.
+func WithReadTimeout(d time.Duration) Option {
+	return func(t *Transport) {
+		t.readTimeout = d
+	}
+}
+
+// WithMaxInflight bounds the bytes of a peer's messages that may be read
+// but not yet handled. Peers that exceed it are disconnected. Zero disables
+// the limit.
+func WithMaxInflight(bytes int64) Option {
+	return func(t *Transport) {
+		t.maxInflight = bytes
+	}
+}
+
+// awaitMessage waits, without a deadline, for the first byte of the next
+// message unless part of it is already buffered, then gives the rest of the
+// message the read timeout to arrive
+func (p *Peer) awaitMessage(r *bufio.Reader, buffered bool) error {
+	if !buffered {
+		if _, err := r.Peek(1); err != nil {
+			return err
+		}
+	}
+	if p.readTimeout > 0 {
+		return p.conn.SetReadDeadline(time.Now().Add(p.readTimeout))
+	}
+	return nil
+}
+
+// messageRead wraps the error of a message read, naming a read timeout
+func (p *Peer) messageRead(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("message not received within %v: %w", p.readTimeout, err)
+	}
+	return err
+}
+
+// acquire reserves size bytes of the peer's in-flight limit for a message
+// being handled
+func (p *Peer) acquire(size int64) error {
+	if total := p.inflight.Add(size); p.maxInflight > 0 && total > p.maxInflight {
+		p.inflight.Add(-size)
+		return fmt.Errorf("%w: %d bytes with %d already in flight", ErrInflightLimit, size, total-size)
+	}
+	return nil
+}
+
+// release returns a handled message's bytes to the in-flight limit
+func (p *Peer) release(size int64) {
+	p.inflight.Add(-size)
+}
+
+// reservation is the in-flight bytes of a message being handled
+type reservation struct {
+	size int64
+	held bool // by a handler that goes on in the background; see Hold
+}
+
+// track notes the bytes reserved for a message about to be handled
+func (p *Peer) track(msg *protocol.Message, size int64) {
+	p.handlingMu.Lock()
+	defer p.handlingMu.Unlock()
+	if p.handling == nil {
+		p.handling = make(map[*protocol.Message]*reservation)
+	}
+	p.handling[msg] = &reservation{size: size}
+}
+
+// untrack releases the bytes of a handled message, unless its handler
+// holds them
+func (p *Peer) untrack(msg *protocol.Message, size int64) {
+	p.handlingMu.Lock()
+	r := p.handling[msg]
+	delete(p.handling, msg)
+	p.handlingMu.Unlock()
+	if r == nil || !r.held {
+		p.release(size)
+	}
+}
+
+// Hold keeps a message's bytes reserved against the peer's in-flight limit
+// after its handler returns, for handlers that go on with it in the
+// background. The returned function releases them and must be called once
+// the handler is done. Holding a message that isn't being handled does
+// nothing.
+func (p *Peer) Hold(msg *protocol.Message) func() {
+	p.handlingMu.Lock()
+	r := p.handling[msg]
+	if r != nil {
+		r.held = true
+	}
+	p.handlingMu.Unlock()
+	if r == nil {
+		return func() {}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { p.release(r.size) })
+	}
+}
+
+// messageLimit counts the bytes read through it and refuses to read past
+// max bytes of the current message, which starts at start
+type messageLimit struct {
+	r      io.Reader
+	max    int
+	start  int64
+	pulled int64
+}
+
+func (l *messageLimit) Read(b []byte) (int, error) {
+	// The message is still incomplete after max bytes
+	if l.max > 0 && l.pulled-l.start >= int64(l.max) {
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrFrameTooLarge, l.max)
+	}
+	n, err := l.r.Read(b)
+	l.pulled += int64(n)
+	return n, err
+}
+
+// pendingJSON reports whether a decoder holds part of the next message,
+// rather than nothing or the whitespace after the last one
+func pendingJSON(decoder *json.Decoder) bool {
+	data, _ := io.ReadAll(decoder.Buffered())
+	return len(bytes.TrimSpace(data)) > 0
+}
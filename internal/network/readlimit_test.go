@@ -0,0 +1,168 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// waitClosed fails the test unless peer is closed within timeout
+func waitClosed(t *testing.T, peer *Peer, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !peer.Closed() {
+		if time.Now().After(deadline) {
+			t.Fatal("Peer was not disconnected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPeer_OversizedJSONMessage(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	peer := NewPeer(local, &mockHandler{})
+	peer.maxFrame = 1024
+	peer.Start()
+	defer peer.Close()
+
+	// A plain JSON stream has no length to check up front
+	go remote.Write([]byte(`{"type":"data","payload":"` + strings.Repeat("a", 4096) + `"}`))
+	waitClosed(t, peer, 2*time.Second)
+}
+
+func TestPeer_SlowMessage(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	peer := NewPeer(local, &mockHandler{})
+	peer.framed = true
+	peer.maxFrame = DefaultMaxFrameSize
+	peer.readTimeout = 100 * time.Millisecond
+	peer.Start()
+	defer peer.Close()
+
+	// An idle peer is left alone
+	time.Sleep(300 * time.Millisecond)
+	if peer.Closed() {
+		t.Fatal("Idle peer was disconnected")
+	}
+
+	// A frame that never finishes arriving is not
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], 100)
+	if _, err := remote.Write(append(header[:], "partial"...)); err != nil {
+		t.Fatalf("Failed to write frame: %v", err)
+	}
+	waitClosed(t, peer, 2*time.Second)
+}
+
+func TestPeer_InflightLimit(t *testing.T) {
+	peer := NewPeer(newMockConn(), &mockHandler{})
+	peer.maxInflight = 100
+
+	if err := peer.acquire(60); err != nil {
+		t.Fatalf("acquire(60) error = %v", err)
+	}
+	if err := peer.acquire(60); !errors.Is(err, ErrInflightLimit) {
+		t.Errorf("acquire(60) error = %v, want %v", err, ErrInflightLimit)
+	}
+	peer.release(60)
+	if err := peer.acquire(60); err != nil {
+		t.Errorf("acquire(60) after release error = %v", err)
+	}
+}
+
+func TestMessageLimit(t *testing.T) {
+	limit := &messageLimit{r: strings.NewReader(strings.Repeat("a", 100)), max: 10}
+	buf := make([]byte, 8)
+
+	// Reads stop once max bytes of the message were read without ending it
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		_, err = limit.Read(buf)
+	}
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Read() error = %v, want %v", err, ErrFrameTooLarge)
+	}
+
+	limit.start = limit.pulled
+	if _, err := limit.Read(buf); err != nil {
+		t.Errorf("Read() of the next message error = %v", err)
+	}
+}
+
+func TestPeer_ReservesFrameBeforeBody(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	peer := NewPeer(local, &mockHandler{})
+	peer.framed = true
+	peer.maxFrame = DefaultMaxFrameSize
+	peer.maxInflight = 1024
+	peer.Start()
+	defer peer.Close()
+
+	// The header alone is enough to refuse a frame over the limit
+	var header [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(header[:], 4096)
+	if _, err := remote.Write(header[:]); err != nil {
+		t.Fatalf("Failed to write frame header: %v", err)
+	}
+	waitClosed(t, peer, 2*time.Second)
+}
+
+// holdingHandler holds each message it handles, passing on the release
+type holdingHandler chan func()
+
+func (h holdingHandler) HandleMessage(peer *Peer, msg *protocol.Message) error {
+	h <- peer.Hold(msg)
+	return nil
+}
+
+func TestPeer_HoldKeepsReservation(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	handler := make(holdingHandler, 1)
+	peer := NewPeer(local, handler)
+	peer.framed = true
+	peer.maxFrame = DefaultMaxFrameSize
+	peer.maxInflight = 1 << 20
+	peer.Start()
+	defer peer.Close()
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, "remote", protocol.DataPayload{ContentHash: strings.Repeat("a", 40)})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode message: %v", err)
+	}
+	go writeFrame(remote, data)
+
+	var release func()
+	select {
+	case release = <-handler:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Message was not handled")
+	}
+	// Still reserved once the handler has returned
+	time.Sleep(50 * time.Millisecond)
+	if got, want := peer.inflight.Load(), int64(frameHeaderSize+len(data)); got != want {
+		t.Errorf("In flight = %d bytes while held, want %d", got, want)
+	}
+	release()
+	release()
+	if got := peer.inflight.Load(); got != 0 {
+		t.Errorf("In flight = %d bytes after release, want 0", got)
+	}
+}
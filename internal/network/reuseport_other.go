@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package network
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortControl fails where sockets can't share a port, which rules out
+// hole punching
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errors.New("hole punching is not supported on this platform")
+}
@@ -0,0 +1,289 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/crypto"
+)
+
+// sessionMagic starts each side's hello in a session handshake, so a peer
+// without session encryption is refused rather than misread
+const sessionMagic = "p2p-storage session 1\n"
+
+// sessionContext prefixes what session keys and proofs are derived from,
+// so they can't be confused with any other use of the same keys
+const sessionContext = "p2p-storage session\x00"
+
+// maxSessionRecord is the most plaintext sealed into one record
+const maxSessionRecord = 16 * 1024
+
+// ErrSessionHandshake is returned when a peer doesn't complete a session
+// handshake or can't prove the identity key it presented
+var ErrSessionHandshake = errors.New("session handshake failed")
+
+// WithSessionEncryption encrypts every connection, control and bulk, with
+// keys agreed for that connection alone from ephemeral X25519 keys, which
+// are thrown away once it is set up. Traffic recorded today stays sealed
+// even if a node's identity key leaks later. Each side signs the handshake
+// with sign, its identity key's signing function, and the identity key set
+// by WithIdentityKey is sent to be checked against it; see
+// Peer.SessionKey. Sessions run inside TLS if both are enabled, and peers
+// must agree on using them.
+func WithSessionEncryption(sign func(data []byte) []byte) Option {
+	return func(t *Transport) {
+		t.sessionSign = sign
+	}
+}
+
+// startSession runs the session handshake over conn, giving up when ctx is
+// done. The side that dialed speaks first.
+func (t *Transport) startSession(ctx context.Context, conn net.Conn, client bool) (*sessionConn, error) {
+	if len(t.identityKey) != ed25519.PublicKeySize {
+		return nil, errors.New("session encryption needs an identity key")
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate session key: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	local := append(append([]byte(sessionMagic), ephemeral.PublicKey().Bytes()...), t.identityKey...)
+	remote := make([]byte, len(local))
+	if client {
+		if _, err := conn.Write(local); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSessionHandshake, err)
+	}
+	if !client {
+		if _, err := conn.Write(local); err != nil {
+			return nil, err
+		}
+	}
+
+	rest, ok := bytes.CutPrefix(remote, []byte(sessionMagic))
+	if !ok {
+		return nil, fmt.Errorf("%w: peer doesn't use session encryption", ErrSessionHandshake)
+	}
+	remoteEphemeral, err := ecdh.X25519().NewPublicKey(rest[:32])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSessionHandshake, err)
+	}
+	remoteIdentity := bytes.Clone(rest[32:])
+	shared, err := ephemeral.ECDH(remoteEphemeral)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSessionHandshake, err)
+	}
+
+	clientHello, serverHello := local, remote
+	if !client {
+		clientHello, serverHello = remote, local
+	}
+	h := sha256.New()
+	h.Write([]byte(sessionContext))
+	h.Write(clientHello)
+	h.Write(serverHello)
+	transcript := h.Sum(nil)
+
+	clientKey, serverKey := deriveSessionKeys(shared, transcript)
+	sendKey, recvKey := clientKey, serverKey
+	if !client {
+		sendKey, recvKey = serverKey, clientKey
+	}
+	sc, err := newSessionConn(conn, sendKey, recvKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each side proves it holds the identity key it sent by signing the
+	// transcript, sealed under the new keys
+	proof := t.sessionSign(sessionProof(transcript, client))
+	remoteProof := make([]byte, ed25519.SignatureSize)
+	if client {
+		if _, err := sc.Write(proof); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.ReadFull(sc, remoteProof); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSessionHandshake, err)
+	}
+	if !client {
+		if _, err := sc.Write(proof); err != nil {
+			return nil, err
+		}
+	}
+	if !crypto.Verify(remoteIdentity, sessionProof(transcript, !client), remoteProof) {
+		return nil, fmt.Errorf("%w: invalid identity proof", ErrSessionHandshake)
+	}
+	sc.identity = remoteIdentity
+	return sc, nil
+}
+
+// sessionProof is what each side of a session signs: the transcript and
+// its role, so one side's proof can't be reflected back as the other's
+func sessionProof(transcript []byte, client bool) []byte {
+	role := "server"
+	if client {
+		role = "client"
+	}
+	return append(append([]byte(sessionContext+role), 0), transcript...)
+}
+
+// deriveSessionKeys derives a key for each direction from the shared
+// secret, bound to the transcript of the handshake
+func deriveSessionKeys(shared, transcript []byte) (clientKey, serverKey []byte) {
+	prk := hmacSHA256(transcript, shared)
+	return hmacSHA256(prk, []byte("client\x01")), hmacSHA256(prk, []byte("server\x01"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// sessionIdentity returns the identity key a peer proved in the session
+// handshake of conn, or nil if conn has no session
+func sessionIdentity(conn net.Conn) []byte {
+	sc, ok := conn.(*sessionConn)
+	if !ok {
+		return nil
+	}
+	return sc.identity
+}
+
+// sessionConn seals everything written to it into AES-256-GCM records of at
+// most maxSessionRecord bytes, each prefixed with its length, and opens the
+// records it reads. Nonces count records in each direction, so records
+// can't be dropped, reordered or replayed without failing to open.
+type sessionConn struct {
+	net.Conn
+	identity []byte // the peer's identity key, as proven in the handshake
+
+	writeMu sync.Mutex
+	send    cipher.AEAD
+	sendSeq uint64
+	record  []byte
+
+	readMu  sync.Mutex
+	recv    cipher.AEAD
+	recvSeq uint64
+	raw     []byte // records read but not yet opened
+	rawLen  int
+	plain   []byte // the opened record being read
+	opened  []byte
+}
+
+func newSessionConn(conn net.Conn, sendKey, recvKey []byte) (*sessionConn, error) {
+	send, err := newSessionCipher(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newSessionCipher(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	size := 2 + maxSessionRecord + send.Overhead()
+	return &sessionConn{
+		Conn:   conn,
+		send:   send,
+		recv:   recv,
+		record: make([]byte, size),
+		raw:    make([]byte, size),
+		opened: make([]byte, maxSessionRecord),
+	}, nil
+}
+
+func newSessionCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func sessionNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		end := min(written+maxSessionRecord, len(b))
+		sealed := c.send.Seal(c.record[2:2], sessionNonce(c.send, c.sendSeq), b[written:end], nil)
+		c.sendSeq++
+		binary.BigEndian.PutUint16(c.record[:2], uint16(len(sealed)))
+		if _, err := c.Conn.Write(c.record[:2+len(sealed)]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (c *sessionConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.plain) == 0 {
+		if err := c.readRecord(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+// readRecord opens the next record into plain. Partly read records are
+// kept, so a read deadline passing mid-record loses nothing.
+func (c *sessionConn) readRecord() error {
+	for {
+		if c.rawLen >= 2 {
+			size := 2 + int(binary.BigEndian.Uint16(c.raw[:2]))
+			if size > len(c.raw) {
+				return fmt.Errorf("session record of %d bytes exceeds the limit", size)
+			}
+			if c.rawLen >= size {
+				plain, err := c.recv.Open(c.opened[:0], sessionNonce(c.recv, c.recvSeq), c.raw[2:size], nil)
+				if err != nil {
+					return errors.New("session record failed to open")
+				}
+				c.recvSeq++
+				c.plain = plain
+				c.rawLen = copy(c.raw, c.raw[size:c.rawLen])
+				return nil
+			}
+		}
+		n, err := c.Conn.Read(c.raw[c.rawLen:])
+		c.rawLen += n
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+// recordingConn keeps a copy of everything written to the connection
+type recordingConn struct {
+	net.Conn
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.written.Write(b)
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) Written() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Clone(c.written.Bytes())
+}
+
+// sessionTransport returns a transport that doesn't listen for anything
+// but runs session handshakes with a fresh identity
+func sessionTransport(t *testing.T) (*Transport, *crypto.Identity) {
+	t.Helper()
+	id, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	return &Transport{identityKey: id.Public, sessionSign: id.Sign}, id
+}
+
+func TestSession_Handshake(t *testing.T) {
+	client, clientID := sessionTransport(t)
+	server, serverID := sessionTransport(t)
+	clientRaw, serverRaw := net.Pipe()
+	recorded := &recordingConn{Conn: clientRaw}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	type result struct {
+		conn *sessionConn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := server.startSession(ctx, serverRaw, false)
+		accepted <- result{conn, err}
+	}()
+	clientConn, err := client.startSession(ctx, recorded, true)
+	if err != nil {
+		t.Fatalf("Client session failed: %v", err)
+	}
+	res := <-accepted
+	if res.err != nil {
+		t.Fatalf("Server session failed: %v", res.err)
+	}
+	serverConn := res.conn
+
+	if !bytes.Equal(clientConn.identity, serverID.Public) || !bytes.Equal(serverConn.identity, clientID.Public) {
+		t.Error("Session identities don't match the peers' identity keys")
+	}
+
+	secret := bytes.Repeat([]byte("secret message "), 2000)
+	go clientConn.Write(secret)
+	got := make([]byte, len(secret))
+	if _, err := io.ReadFull(serverConn, got); err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+	if !bytes.Equal(got, secret) {
+		t.Error("Server read different data than the client wrote")
+	}
+	if bytes.Contains(recorded.Written(), []byte("secret message")) {
+		t.Error("Plaintext visible on the wire")
+	}
+}
+
+func TestSession_RefusesPlainPeer(t *testing.T) {
+	server, _ := sessionTransport(t)
+	clientRaw, serverRaw := net.Pipe()
+	defer clientRaw.Close()
+
+	// A peer without sessions opens with its frame magic instead of a hello
+	go func() {
+		clientRaw.Write(append(bytes.Clone(frameMagic), make([]byte, len(sessionMagic)+64-len(frameMagic))...))
+		io.Copy(io.Discard, clientRaw)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := server.startSession(ctx, serverRaw, false); err == nil {
+		t.Error("Session with a peer not using sessions succeeded")
+	}
+}
+
+func TestSessionConn_RefusesTamperedRecords(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	writerRaw, readerRaw := net.Pipe()
+	writer, err := newSessionConn(writerRaw, key, key)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+	reader, err := newSessionConn(&flippingConn{Conn: readerRaw}, key, key)
+	if err != nil {
+		t.Fatalf("Failed to create session: %v", err)
+	}
+
+	go writer.Write([]byte("chunk of data"))
+	if _, err := reader.Read(make([]byte, 64)); err == nil {
+		t.Error("Read of a tampered record succeeded")
+	}
+}
+
+// flippingConn flips a bit in the last byte of every read
+type flippingConn struct {
+	net.Conn
+}
+
+func (c *flippingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		b[n-1] ^= 1
+	}
+	return n, err
+}
+
+func TestTransport_SessionEncryption(t *testing.T) {
+	serverID, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	clientID, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+
+	serverHandler := newTransferRecorder()
+	server, err := NewTransport("server", "127.0.0.1:0", serverHandler, WithIdentityKey(serverID.Public), WithSessionEncryption(serverID.Sign))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithIdentityKey(clientID.Public), WithSessionEncryption(clientID.Sign))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	<-serverHandler.messages // handshake
+	if key := onlyPeer(t, server).SessionKey(); !bytes.Equal(key, clientID.Public) {
+		t.Errorf("SessionKey() = %x, want the client's identity key", key)
+	}
+
+	// Chunks on the bulk channel run through a session of their own
+	clientPeer := onlyPeer(t, client)
+	waitForBulk(t, clientPeer)
+	data := bytes.Repeat([]byte{7}, 3*maxSessionRecord)
+	if err := clientPeer.SendTransfer("client", &protocol.DataTransfer{ContentHash: "abc", Data: data, FinalChunk: true}); err != nil {
+		t.Fatalf("Failed to send transfer: %v", err)
+	}
+	select {
+	case transfer := <-serverHandler.transfers:
+		if !bytes.Equal(transfer.Data, data) {
+			t.Errorf("Transfer data = %d bytes, want %d", len(transfer.Data), len(data))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for transfer")
+	}
+}
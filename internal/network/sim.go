@@ -0,0 +1,256 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Network opens the listener and connections of a Transport. TCP is used
+// unless WithNetwork selects another, such as a SimNetwork.
+type Network interface {
+	Listen(address string) (net.Listener, error)
+	// DialContext connects to address, giving up when ctx is done
+	DialContext(ctx context.Context, address string) (net.Conn, error)
+}
+
+// tcpNetwork is the default Network. With reusePort set, the listening
+// socket shares its port with the dials of hole punching.
+type tcpNetwork struct {
+	reusePort bool
+}
+
+func (n tcpNetwork) Listen(address string) (net.Listener, error) {
+	if n.reusePort {
+		lc := net.ListenConfig{Control: reusePortControl}
+		return lc.Listen(context.Background(), "tcp", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+func (tcpNetwork) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// SimNetwork connects transports in the same process through in-memory
+// connections, so a whole cluster can run without sockets. Addresses are
+// arbitrary host:port strings. Connections buffer without limit, like
+// generous socket buffers, so peers that write to each other from their
+// read loops can't deadlock.
+type SimNetwork struct {
+	mu        sync.Mutex
+	listeners map[string]*simListener
+	nextPort  int
+}
+
+// NewSimNetwork creates an empty simulated network
+func NewSimNetwork() *SimNetwork {
+	return &SimNetwork{listeners: make(map[string]*simListener)}
+}
+
+// Listen registers a listener at address
+func (s *SimNetwork) Listen(address string) (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.listeners[address]; exists {
+		return nil, fmt.Errorf("listen %s: address already in use", address)
+	}
+	l := &simListener{
+		network: s,
+		addr:    simAddr(address),
+		conns:   make(chan net.Conn),
+		done:    make(chan struct{}),
+	}
+	s.listeners[address] = l
+	return l, nil
+}
+
+// DialContext connects to the listener at address. Each connection gets a
+// unique local address, as an ephemeral port would.
+func (s *SimNetwork) DialContext(ctx context.Context, address string) (net.Conn, error) {
+	s.mu.Lock()
+	l, ok := s.listeners[address]
+	s.nextPort++
+	local := simAddr(fmt.Sprintf("sim:%d", s.nextPort))
+	s.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	}
+
+	client, server := newSimConnPair(local, l.addr)
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("dial %s: connection refused", address)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("dial %s: %w", address, ctx.Err())
+	}
+}
+
+// simAddr is an address on a SimNetwork
+type simAddr string
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return string(a) }
+
+type simListener struct {
+	network   *SimNetwork
+	addr      simAddr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *simListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+		l.network.mu.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *simListener) Addr() net.Addr {
+	return l.addr
+}
+
+// simPipe is one direction of a simulated connection
+type simPipe struct {
+	mu     sync.Mutex
+	buf    bytes.Buffer
+	closed bool
+	// notify wakes a blocked reader after a write, a close or a new deadline
+	notify chan struct{}
+}
+
+func newSimPipe() *simPipe {
+	return &simPipe{notify: make(chan struct{}, 1)}
+}
+
+func (p *simPipe) wake() {
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (p *simPipe) close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	p.wake()
+}
+
+// simConn is one end of a simulated connection
+type simConn struct {
+	local, remote simAddr
+	in, out       *simPipe
+	mu            sync.Mutex
+	readDeadline  time.Time
+	closed        bool
+}
+
+func newSimConnPair(client, server simAddr) (*simConn, *simConn) {
+	up, down := newSimPipe(), newSimPipe()
+	return &simConn{local: client, remote: server, in: down, out: up},
+		&simConn{local: server, remote: client, in: up, out: down}
+}
+
+func (c *simConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		closed, deadline := c.closed, c.readDeadline
+		c.mu.Unlock()
+		if closed {
+			return 0, net.ErrClosed
+		}
+
+		c.in.mu.Lock()
+		if c.in.buf.Len() > 0 {
+			n, _ := c.in.buf.Read(b)
+			c.in.mu.Unlock()
+			return n, nil
+		}
+		eof := c.in.closed
+		c.in.mu.Unlock()
+		if eof {
+			return 0, io.EOF
+		}
+
+		if deadline.IsZero() {
+			<-c.in.notify
+			continue
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.in.notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	c.out.mu.Lock()
+	if c.out.closed {
+		c.out.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	c.out.buf.Write(b)
+	c.out.mu.Unlock()
+	c.out.wake()
+	return len(b), nil
+}
+
+// Close shuts both directions; the remote end reads what was already
+// written and then EOF
+func (c *simConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr  { return c.local }
+func (c *simConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *simConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *simConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.in.wake()
+	return nil
+}
+
+// SetWriteDeadline is a no-op since writes never block
+func (c *simConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,90 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestSimNetwork_Transports(t *testing.T) {
+	sim := NewSimNetwork()
+
+	serverHandler := newTransferRecorder()
+	server, err := NewTransport("server", "server:1", serverHandler, WithNetwork(sim))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	if _, err := NewTransport("other", "server:1", &mockHandler{}, WithNetwork(sim)); err == nil {
+		t.Error("Expected error for an address in use")
+	}
+
+	clientHandler := newTransferRecorder()
+	client, err := NewTransport("client", "client:1", clientHandler, WithNetwork(sim))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	if err := client.Connect(context.Background(), "nowhere:1"); err == nil {
+		t.Error("Expected error dialing an unknown address")
+	}
+	if err := client.Connect(context.Background(), "server:1"); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	select {
+	case msg := <-serverHandler.messages:
+		if msg.Type != protocol.MessageTypeHandshake {
+			t.Errorf("First message = %s, want handshake", msg.Type)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for handshake")
+	}
+
+	clientPeer := onlyPeer(t, client)
+	waitForBulk(t, clientPeer)
+	waitForBulk(t, onlyPeer(t, server))
+	if err := clientPeer.SendTransfer("client", &protocol.DataTransfer{ContentHash: "abc", Data: []byte("chunk"), FinalChunk: true}); err != nil {
+		t.Fatalf("Failed to send transfer: %v", err)
+	}
+	select {
+	case <-serverHandler.transfers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for transfer")
+	}
+
+	counts := server.MessagesReceived()
+	if counts[protocol.MessageTypeHandshake] != 1 || counts[protocol.MessageTypeBulkChannel] != 1 || counts[protocol.MessageTypeDataTransfer] != 1 {
+		t.Errorf("MessagesReceived() = %v, want one handshake, bulk channel and data transfer", counts)
+	}
+}
+
+func TestSimConn_Deadline(t *testing.T) {
+	client, server := newSimConnPair("client:1", "server:1")
+
+	server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	buf := make([]byte, 4)
+	if _, err := server.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error = %v, want deadline exceeded", err)
+	}
+
+	server.SetReadDeadline(time.Time{})
+	client.Write([]byte("data"))
+	client.Close()
+	if n, err := server.Read(buf); err != nil || string(buf[:n]) != "data" {
+		t.Errorf("Read() = %q, %v, want data written before close", buf[:n], err)
+	}
+	if _, err := server.Read(buf); err == nil {
+		t.Error("Expected EOF after the remote end closed")
+	}
+	if _, err := server.Write(buf); err == nil {
+		t.Error("Expected error writing to a closed connection")
+	}
+}
@@ -0,0 +1,140 @@
+package network
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// PeerStats is the traffic of one peer connection since it was opened
+type PeerStats struct {
+	ID       string    `json:"id"`
+	Address  string    `json:"address"`
+	Outbound bool      `json:"outbound"`
+	Since    time.Time `json:"since"`
+	// BytesSent and BytesReceived count the connection's traffic, bulk
+	// channel included, as it goes over the wire
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+	// MessagesSent and MessagesReceived count messages by type; chunks
+	// count as data transfers whichever way they travel
+	MessagesSent     map[protocol.MessageType]int64 `json:"messages_sent"`
+	MessagesReceived map[protocol.MessageType]int64 `json:"messages_received"`
+	// RTT is the round trip of the last answered heartbeat, 0 if unknown,
+	// and SmoothedRTT the average of those answered; see Peer.SmoothedRTT
+	RTT         time.Duration `json:"rtt"`
+	SmoothedRTT time.Duration `json:"smoothed_rtt"`
+	// SendErrors counts messages that failed to be sent, and HandleErrors
+	// those received that the handler failed to handle
+	SendErrors   int64 `json:"send_errors"`
+	HandleErrors int64 `json:"handle_errors"`
+}
+
+// peerTraffic counts the bytes of one peer, shared by its connections
+type peerTraffic struct {
+	sent     atomic.Int64
+	received atomic.Int64
+}
+
+// peerCounts counts the messages and errors of one peer connection
+type peerCounts struct {
+	since        time.Time
+	mu           sync.Mutex
+	sent         map[protocol.MessageType]int64
+	received     map[protocol.MessageType]int64
+	sendErrors   atomic.Int64
+	handleErrors atomic.Int64
+}
+
+func (c *peerCounts) add(counts *map[protocol.MessageType]int64, msgType protocol.MessageType) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if *counts == nil {
+		*counts = make(map[protocol.MessageType]int64)
+	}
+	(*counts)[msgType]++
+}
+
+// countSent records a message sent to the peer, or the failure to send it,
+// and returns err
+func (p *Peer) countSent(msgType protocol.MessageType, err error) error {
+	if err != nil {
+		p.counts.sendErrors.Add(1)
+		return err
+	}
+	p.counts.add(&p.counts.sent, msgType)
+	if msgType != protocol.MessageTypePing && msgType != protocol.MessageTypePong {
+		p.lastSent.Store(time.Now().UnixNano())
+	}
+	return nil
+}
+
+// countReceived records a message received from the peer
+func (p *Peer) countReceived(msgType protocol.MessageType) {
+	p.counts.add(&p.counts.received, msgType)
+	if p.countMessage != nil {
+		p.countMessage(msgType)
+	}
+}
+
+// Stats returns the traffic of the peer connection. Bytes are only counted
+// for peers set up by a transport.
+func (p *Peer) Stats() PeerStats {
+	stats := PeerStats{
+		ID:           p.ID(),
+		Address:      p.Address(),
+		Outbound:     p.outbound,
+		Since:        p.counts.since,
+		RTT:          p.RTT(),
+		SmoothedRTT:  p.SmoothedRTT(),
+		SendErrors:   p.counts.sendErrors.Load(),
+		HandleErrors: p.counts.handleErrors.Load(),
+	}
+	if c, ok := p.counted.(*countingConn); ok {
+		traffic := c.traffic.Load()
+		stats.BytesSent = traffic.sent.Load()
+		stats.BytesReceived = traffic.received.Load()
+	}
+
+	p.counts.mu.Lock()
+	defer p.counts.mu.Unlock()
+	stats.MessagesSent = copyCounts(p.counts.sent)
+	stats.MessagesReceived = copyCounts(p.counts.received)
+	return stats
+}
+
+func copyCounts(counts map[protocol.MessageType]int64) map[protocol.MessageType]int64 {
+	copied := make(map[protocol.MessageType]int64, len(counts))
+	for msgType, count := range counts {
+		copied[msgType] = count
+	}
+	return copied
+}
+
+// Stats returns the traffic of every connected peer, those that exchanged
+// the most bytes first
+func (t *Transport) Stats() []PeerStats {
+	t.mu.RLock()
+	peers := make([]*Peer, 0, len(t.peers))
+	for _, peer := range t.peers {
+		peers = append(peers, peer)
+	}
+	t.mu.RUnlock()
+
+	stats := make([]PeerStats, len(peers))
+	for i, peer := range peers {
+		stats[i] = peer.Stats()
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		ti := stats[i].BytesSent + stats[i].BytesReceived
+		tj := stats[j].BytesSent + stats[j].BytesReceived
+		if ti != tj {
+			return ti > tj
+		}
+		return stats[i].ID < stats[j].ID
+	})
+	return stats
+}
@@ -0,0 +1,96 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// failingHandler records messages like transferRecorder but fails to
+// handle plain data messages
+type failingHandler struct {
+	*transferRecorder
+}
+
+func (h failingHandler) HandleMessage(peer *Peer, msg *protocol.Message) error {
+	h.transferRecorder.HandleMessage(peer, msg)
+	if msg.Type == protocol.MessageTypeData {
+		return errors.New("refused")
+	}
+	return nil
+}
+
+func TestTransport_Stats(t *testing.T) {
+	serverHandler := failingHandler{newTransferRecorder()}
+	server, err := NewTransport("server", "127.0.0.1:0", serverHandler)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", newTransferRecorder())
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	clientPeer := onlyPeer(t, client)
+	serverPeer := onlyPeer(t, server)
+	waitForBulk(t, clientPeer)
+	waitForBulk(t, serverPeer)
+
+	// A chunk over the bulk channel and a message the server fails to handle
+	data := bytes.Repeat([]byte{1}, 64<<10)
+	if err := clientPeer.SendTransfer("client", &protocol.DataTransfer{ContentHash: "abc", Data: data, FinalChunk: true}); err != nil {
+		t.Fatalf("Failed to send transfer: %v", err)
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, "client", protocol.DataPayload{ContentHash: "abc"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := clientPeer.Send(msg); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	select {
+	case <-serverHandler.transfers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for transfer")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for server.Stats()[0].HandleErrors == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the failed message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sent := client.Stats()
+	if len(sent) != 1 {
+		t.Fatalf("Client Stats() = %d peers, want 1", len(sent))
+	}
+	if got := sent[0].MessagesSent; got[protocol.MessageTypeHandshake] != 1 || got[protocol.MessageTypeDataTransfer] != 1 || got[protocol.MessageTypeData] != 1 {
+		t.Errorf("Client MessagesSent = %v", got)
+	}
+	if sent[0].BytesSent < int64(len(data)) || !sent[0].Outbound {
+		t.Errorf("Client stats = %+v, want outbound with at least %d bytes sent", sent[0], len(data))
+	}
+
+	received := server.Stats()[0]
+	if got := received.MessagesReceived; got[protocol.MessageTypeDataTransfer] != 1 || got[protocol.MessageTypeData] != 1 {
+		t.Errorf("Server MessagesReceived = %v", got)
+	}
+	if received.BytesReceived < int64(len(data)) || received.BytesReceived > server.BytesReceived() {
+		t.Errorf("Server BytesReceived = %d, want between %d and the transport's %d", received.BytesReceived, len(data), server.BytesReceived())
+	}
+	if received.HandleErrors != 1 || received.SendErrors != 0 {
+		t.Errorf("Server errors = %d handling, %d sending; want 1 and 0", received.HandleErrors, received.SendErrors)
+	}
+}
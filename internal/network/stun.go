@@ -0,0 +1,166 @@
+package network
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// STUN message types and attributes used for a binding request (RFC 5389)
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112a442
+	stunHeaderSize      = 20
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXORMappedAddress = 0x0020
+)
+
+// DefaultSTUNTimeout bounds a STUN binding request
+const DefaultSTUNTimeout = 5 * time.Second
+
+// ErrNoMappedAddress is returned when a STUN response carries no address
+var ErrNoMappedAddress = errors.New("STUN response has no mapped address")
+
+// DiscoverExternalAddress asks a STUN server which address it sees this host
+// connecting from, so a node behind NAT can learn its public address. The
+// request goes over TCP from local, sharing the port with the socket
+// already bound to it, so the answer is the mapping the router gives every
+// connection from that port, such as hole punches from the listen port.
+func DiscoverExternalAddress(server string, local *net.TCPAddr, timeout time.Duration) (*net.TCPAddr, error) {
+	dialer := net.Dialer{LocalAddr: local, Control: reusePortControl, Timeout: timeout}
+	conn, err := dialer.Dial("tcp", server)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach STUN server %s: %w", server, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	request, txID, err := newSTUNRequest()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, fmt.Errorf("failed to send STUN request: %w", err)
+	}
+
+	// Over TCP, messages are framed by the length in their header
+	response := make([]byte, stunHeaderSize)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, stunReadError(server, timeout, err)
+	}
+	response = append(response, make([]byte, binary.BigEndian.Uint16(response[2:]))...)
+	if _, err := io.ReadFull(conn, response[stunHeaderSize:]); err != nil {
+		return nil, stunReadError(server, timeout, err)
+	}
+	addr, err := parseSTUNResponse(response, txID)
+	if err != nil {
+		return nil, err
+	}
+	return &net.TCPAddr{IP: addr.IP, Port: addr.Port}, nil
+}
+
+func stunReadError(server string, timeout time.Duration, err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("STUN server %s did not answer within %s", server, timeout)
+	}
+	return fmt.Errorf("failed to read STUN response: %w", err)
+}
+
+// newSTUNRequest builds a binding request with a random transaction ID
+func newSTUNRequest() ([]byte, []byte, error) {
+	request := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint16(request[2:], 0)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	if _, err := rand.Read(request[8:]); err != nil {
+		return nil, nil, fmt.Errorf("failed to generate STUN transaction ID: %w", err)
+	}
+	return request, request[8:stunHeaderSize], nil
+}
+
+// parseSTUNResponse returns the mapped address from a binding response to
+// the request with transaction ID txID, preferring XOR-MAPPED-ADDRESS
+func parseSTUNResponse(data, txID []byte) (*net.UDPAddr, error) {
+	if len(data) < stunHeaderSize {
+		return nil, errors.New("STUN response too short")
+	}
+	if binary.BigEndian.Uint16(data[0:]) != stunBindingResponse {
+		return nil, fmt.Errorf("unexpected STUN message type %#04x", binary.BigEndian.Uint16(data[0:]))
+	}
+	if binary.BigEndian.Uint32(data[4:]) != stunMagicCookie || !bytes.Equal(data[8:stunHeaderSize], txID) {
+		return nil, errors.New("STUN response does not match the request")
+	}
+	length := int(binary.BigEndian.Uint16(data[2:]))
+	if stunHeaderSize+length > len(data) {
+		return nil, errors.New("STUN response truncated")
+	}
+
+	var mapped *net.UDPAddr
+	attrs := data[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+attrLen > len(attrs) {
+			return nil, errors.New("STUN attribute truncated")
+		}
+		value := attrs[4 : 4+attrLen]
+		switch attrType {
+		case stunAttrXORMappedAddress:
+			return decodeSTUNAddress(value, data[4:stunHeaderSize])
+		case stunAttrMappedAddress:
+			if addr, err := decodeSTUNAddress(value, nil); err == nil {
+				mapped = addr
+			}
+		}
+		// Attributes are padded to a multiple of four bytes
+		next := 4 + (attrLen+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mapped == nil {
+		return nil, ErrNoMappedAddress
+	}
+	return mapped, nil
+}
+
+// decodeSTUNAddress decodes a (XOR-)MAPPED-ADDRESS value. xorKey is the
+// magic cookie followed by the transaction ID for XOR-MAPPED-ADDRESS, nil
+// for the plain form.
+func decodeSTUNAddress(value, xorKey []byte) (*net.UDPAddr, error) {
+	if len(value) < 4 {
+		return nil, errors.New("STUN address too short")
+	}
+	var size int
+	switch value[1] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x02:
+		size = net.IPv6len
+	default:
+		return nil, fmt.Errorf("unknown STUN address family %#02x", value[1])
+	}
+	if len(value) < 4+size {
+		return nil, errors.New("STUN address truncated")
+	}
+
+	port := binary.BigEndian.Uint16(value[2:])
+	ip := make(net.IP, size)
+	copy(ip, value[4:4+size])
+	if xorKey != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xorKey[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
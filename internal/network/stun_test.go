@@ -0,0 +1,118 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// stunResponse encodes a binding response for txID carrying addr as an
+// XOR-MAPPED-ADDRESS, or a plain MAPPED-ADDRESS if xor is false
+func stunResponse(txID []byte, addr *net.UDPAddr, xor bool) []byte {
+	ip := addr.IP.To4()
+	value := []byte{0, 0x01, 0, 0}
+	port := uint16(addr.Port)
+	attr := uint16(stunAttrMappedAddress)
+	if xor {
+		port ^= uint16(stunMagicCookie >> 16)
+		attr = stunAttrXORMappedAddress
+	}
+	binary.BigEndian.PutUint16(value[2:], port)
+	for i := range ip {
+		b := ip[i]
+		if xor {
+			b ^= byte(uint32(stunMagicCookie) >> (24 - 8*i))
+		}
+		value = append(value, b)
+	}
+
+	msg := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(msg[0:], stunBindingResponse)
+	binary.BigEndian.PutUint16(msg[2:], uint16(4+len(value)))
+	binary.BigEndian.PutUint32(msg[4:], stunMagicCookie)
+	copy(msg[8:], txID)
+	msg = binary.BigEndian.AppendUint16(msg, attr)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(value)))
+	return append(msg, value...)
+}
+
+// serveSTUN answers binding requests over TCP with the address each
+// connection comes from, unless silent is set
+func serveSTUN(t *testing.T, silent bool) net.Listener {
+	t.Helper()
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request := make([]byte, stunHeaderSize)
+				if _, err := io.ReadFull(conn, request); err != nil || silent {
+					io.Copy(io.Discard, conn)
+					return
+				}
+				from := conn.RemoteAddr().(*net.TCPAddr)
+				conn.Write(stunResponse(request[8:stunHeaderSize], &net.UDPAddr{IP: from.IP, Port: from.Port}, true))
+			}()
+		}
+	}()
+	return server
+}
+
+func TestDiscoverExternalAddress(t *testing.T) {
+	server := serveSTUN(t, false)
+	defer server.Close()
+
+	addr, err := DiscoverExternalAddress(server.Addr().String(), nil, DefaultSTUNTimeout)
+	if err != nil {
+		t.Fatalf("DiscoverExternalAddress() error = %v", err)
+	}
+	if !addr.IP.Equal(net.ParseIP("127.0.0.1")) || addr.Port == 0 {
+		t.Errorf("DiscoverExternalAddress() = %v, want 127.0.0.1 with a port", addr)
+	}
+}
+
+func TestDiscoverExternalAddress_NoAnswer(t *testing.T) {
+	server := serveSTUN(t, true)
+	defer server.Close()
+
+	if _, err := DiscoverExternalAddress(server.Addr().String(), nil, 300*time.Millisecond); err == nil {
+		t.Error("DiscoverExternalAddress() from a silent server succeeded, want error")
+	}
+}
+
+func TestParseSTUNResponse(t *testing.T) {
+	txID := []byte("0123456789ab")
+	want := &net.UDPAddr{IP: net.ParseIP("203.0.113.7").To4(), Port: 40000}
+
+	for _, xor := range []bool{true, false} {
+		got, err := parseSTUNResponse(stunResponse(txID, want, xor), txID)
+		if err != nil {
+			t.Fatalf("xor %v: parseSTUNResponse() error = %v", xor, err)
+		}
+		if !got.IP.Equal(want.IP) || got.Port != want.Port {
+			t.Errorf("xor %v: parseSTUNResponse() = %v, want %v", xor, got, want)
+		}
+	}
+
+	if _, err := parseSTUNResponse(stunResponse(txID, want, true), []byte("another txid")); err == nil {
+		t.Error("Expected error for a mismatched transaction ID")
+	}
+	if _, err := parseSTUNResponse(stunResponse(txID, want, true)[:stunHeaderSize+2], txID); err == nil {
+		t.Error("Expected error for a truncated response")
+	}
+	empty := stunResponse(txID, want, true)[:stunHeaderSize]
+	binary.BigEndian.PutUint16(empty[2:], 0)
+	if _, err := parseSTUNResponse(empty, txID); !errors.Is(err, ErrNoMappedAddress) {
+		t.Errorf("parseSTUNResponse() error = %v, want %v", err, ErrNoMappedAddress)
+	}
+}
@@ -0,0 +1,98 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// TapEvent is a message sent to or received from a peer, as shown to a tap
+type TapEvent struct {
+	Time time.Time            `json:"time"`
+	Peer string               `json:"peer"`
+	Sent bool                 `json:"sent"`
+	Type protocol.MessageType `json:"type"`
+	// Size is that of the message's payload, or of a chunk's data
+	Size    int    `json:"size"`
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// String formats the event as a log line
+func (e TapEvent) String() string {
+	direction := "<-"
+	if e.Sent {
+		direction = "->"
+	}
+	line := fmt.Sprintf("%s %s %s %s %dB", e.Time.Format("15:04:05.000"), direction, e.Peer, e.Type, e.Size)
+	if e.TraceID != "" {
+		line += " trace=" + e.TraceID
+	}
+	return line
+}
+
+// Tap is shown every message a transport sends or receives, heartbeats and
+// chunks included. It is called from the connections' goroutines, so it
+// must be quick and safe for concurrent use.
+type Tap func(TapEvent)
+
+// ChannelTap returns a tap that sends events to ch, dropping those ch has
+// no room for rather than holding up the connection
+func ChannelTap(ch chan<- TapEvent) Tap {
+	return func(e TapEvent) {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// LogTap returns a tap that writes a line per event to w
+func LogTap(w io.Writer) Tap {
+	var mu sync.Mutex
+	return func(e TapEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		fmt.Fprintln(w, e)
+	}
+}
+
+// WithTap sets the tap shown every message from the start; see SetTap
+func WithTap(tap Tap) Option {
+	return func(t *Transport) {
+		t.SetTap(tap)
+	}
+}
+
+// SetTap sets the tap shown every message sent and received from now on,
+// or removes it if tap is nil
+func (t *Transport) SetTap(tap Tap) {
+	if tap == nil {
+		t.tap.Store(nil)
+		return
+	}
+	t.tap.Store(&tap)
+}
+
+// tapMessage shows a message to the transport's tap, if there is one
+func (p *Peer) tapMessage(sent bool, msg *protocol.Message) {
+	p.tapEvent(sent, msg.Type, len(msg.Payload), msg.TraceID)
+}
+
+// tapTransfer shows a chunk to the transport's tap, if there is one
+func (p *Peer) tapTransfer(sent bool, transfer *protocol.DataTransfer) {
+	p.tapEvent(sent, protocol.MessageTypeDataTransfer, len(transfer.Data), transfer.TraceID)
+}
+
+func (p *Peer) tapEvent(sent bool, msgType protocol.MessageType, size int, traceID string) {
+	if p.tap == nil {
+		return
+	}
+	tap := p.tap.Load()
+	if tap == nil {
+		return
+	}
+	(*tap)(TapEvent{Time: time.Now(), Peer: p.ID(), Sent: sent, Type: msgType, Size: size, TraceID: traceID})
+}
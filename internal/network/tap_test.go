@@ -0,0 +1,92 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// waitForTap returns the next event of msgType shown to a channel tap
+func waitForTap(t *testing.T, events <-chan TapEvent, msgType protocol.MessageType) TapEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type == msgType {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for a %s event", msgType)
+		}
+	}
+}
+
+func TestTransport_Tap(t *testing.T) {
+	events := make(chan TapEvent, 64)
+	serverHandler := newTransferRecorder()
+	server, err := NewTransport("server", "127.0.0.1:0", serverHandler, WithTap(ChannelTap(events)))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", newTransferRecorder(), WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	clientPeer := onlyPeer(t, client)
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeDataRequest, "client", protocol.DataRequest{ContentHash: "abc"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	msg.TraceID = "trace-1"
+	if err := clientPeer.Send(msg); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	e := waitForTap(t, events, protocol.MessageTypeDataRequest)
+	if e.Sent || e.TraceID != "trace-1" || e.Size != len(msg.Payload) {
+		t.Errorf("Request event = %+v, want received with trace-1 and %d bytes", e, len(msg.Payload))
+	}
+
+	// Answered over the same connection, carrying the request's trace
+	serverPeer := onlyPeer(t, server)
+	data := bytes.Repeat([]byte{1}, 1000)
+	if err := serverPeer.SendTransfer("server", &protocol.DataTransfer{ContentHash: "abc", Data: data, FinalChunk: true, TraceID: "trace-1"}); err != nil {
+		t.Fatalf("Failed to send transfer: %v", err)
+	}
+	e = waitForTap(t, events, protocol.MessageTypeDataTransfer)
+	if !e.Sent || e.TraceID != "trace-1" || e.Size != len(data) || e.Peer != serverPeer.ID() {
+		t.Errorf("Transfer event = %+v, want sent to %s with trace-1 and %d bytes", e, serverPeer.ID(), len(data))
+	}
+	if !strings.Contains(e.String(), "trace=trace-1") {
+		t.Errorf("String() = %q, want the trace ID", e.String())
+	}
+
+	server.SetTap(nil)
+	if err := clientPeer.Send(msg); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-serverHandler.messages:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for requests")
+		}
+	}
+	for len(events) > 0 {
+		if e := <-events; e.Type == protocol.MessageTypeDataRequest {
+			t.Errorf("Event %+v shown after the tap was removed", e)
+		}
+	}
+}
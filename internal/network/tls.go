@@ -0,0 +1,109 @@
+package network
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the TLS handshake of a new connection
+const tlsHandshakeTimeout = 10 * time.Second
+
+// NewTLSConfig returns a TLS 1.3 configuration for peer connections that
+// presents cert and requires a certificate from the other side, whichever
+// side dialed. Peer addresses are not checked against certificate names.
+// With roots, peer certificates must chain to one of them. Without, any
+// certificate is accepted, and it is up to the handler to bind it to the
+// peer's identity through Peer.Certificate.
+func NewTLSConfig(cert tls.Certificate, roots *x509.CertPool) *tls.Config {
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		// Verification happens in VerifyPeerCertificate, without host names
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeerChain(roots),
+	}
+}
+
+// verifyPeerChain checks the certificates a peer presented against roots,
+// or only that there is one when roots is nil
+func verifyPeerChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("peer presented no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("invalid peer certificate: %w", err)
+			}
+			certs[i] = cert
+		}
+		if roots == nil {
+			return nil
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		return err
+	}
+}
+
+// secure wraps conn in TLS when the transport has a TLS configuration, and
+// in a session when it has session encryption, completing the handshakes
+// and giving up when ctx is done. client is set for connections this side
+// dialed.
+func (t *Transport) secure(ctx context.Context, conn net.Conn, client bool) (net.Conn, error) {
+	if t.tlsConfig != nil {
+		var tlsConn *tls.Conn
+		if client {
+			tlsConn = tls.Client(conn, t.tlsConfig)
+		} else {
+			tlsConn = tls.Server(conn, t.tlsConfig)
+		}
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %s failed: %w", conn.RemoteAddr(), err)
+		}
+		conn = tlsConn
+	}
+	if t.sessionSign != nil {
+		session, err := t.startSession(ctx, conn, client)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("session handshake with %s failed: %w", conn.RemoteAddr(), err)
+		}
+		conn = session
+	}
+	return conn, nil
+}
+
+// peerCertificate returns the leaf certificate presented over a TLS
+// connection, or nil for plaintext connections
+func peerCertificate(conn net.Conn) *x509.Certificate {
+	if session, ok := conn.(*sessionConn); ok {
+		conn = session.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certs[0]
+}
@@ -1,22 +1,132 @@
 package network
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/webrtc/v4"
 
 	"p2p-storage/internal/protocol"
 )
 
 // Transport handles the network communication
 type Transport struct {
-	listener net.Listener
-	nodeID   string
-	address  string
-	peers    map[string]*Peer
-	handler  MessageHandler
-	mu       sync.RWMutex
-	done     chan struct{}
+	listener   net.Listener
+	network    Network
+	nodeID     string
+	address    string
+	peers      map[string]*Peer
+	handler    MessageHandler
+	socketOpts SocketOptions
+	// writeTimeout bounds how long a single message write may block
+	writeTimeout time.Duration
+	// dialTimeout and handshakeTimeout bound the stages of Connect
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+	// handshakeWindow bounds how long peers may stay unidentified
+	handshakeWindow time.Duration
+	// readTimeout bounds how long a started message may take to arrive, and
+	// maxInflight the bytes of a peer's messages being handled at once
+	readTimeout time.Duration
+	maxInflight int64
+	// peerLimits caps inbound and outbound connections
+	peerLimits PeerLimits
+	// filter, if set, refuses dialing or accepting certain addresses
+	filter func(address string) error
+	// identityKey is the node's public identity key, sent in handshakes
+	identityKey []byte
+	// exchangeKey and exchangeSignature are the node's signed X25519 key,
+	// sent in handshakes so the first node can wrap the network key for it
+	exchangeKey       []byte
+	exchangeSignature []byte
+	// keyless is sent in handshakes by nodes that want no network key
+	keyless bool
+	// capabilities are sent in handshakes, if set
+	capabilities *protocol.Capabilities
+	// networkID is sent in handshakes; empty for the default network
+	networkID string
+	// invite is sent in handshakes dialed to inviteAddress, the invite-only
+	// node it joins, and to no other peer
+	invite        string
+	inviteAddress string
+	// bulkEnabled opens a bulk channel alongside each dialed connection
+	bulkEnabled bool
+	// framing sends length-prefixed frames on dialed connections; frames
+	// over maxFrame bytes are refused in either direction
+	framing  bool
+	maxFrame int
+	// codecs are announced in handshakes, in order of preference
+	codecs []string
+	// compressions are announced in handshakes, in order of preference;
+	// frames smaller than compressMin bytes are sent uncompressed
+	compressions []string
+	compressMin  int
+	// muxing sends large frames in fragments to peers that reassemble them
+	muxing bool
+	// extraAddrs are listened on besides address, by extraListeners
+	extraAddrs     []string
+	extraListeners []net.Listener
+	// wsAddress, if set, is where peers may also connect over WebSocket
+	wsAddress  string
+	wsListener net.Listener
+	wsServer   *http.Server
+	// rtcAPI, if set, accepts and dials connections over WebRTC data
+	// channels; see WithWebRTC
+	rtcAPI    *webrtc.API
+	rtcConfig webrtc.Configuration
+	// rtcPending holds a slot for every answered offer whose data channel
+	// hasn't opened yet
+	rtcPending chan struct{}
+	// punching dials from the listen port to reach peers behind NAT
+	punching bool
+	// advertised, if set, is sent in handshakes instead of address
+	advertised string
+	// tlsConfig, if set, secures every connection, control and bulk
+	tlsConfig *tls.Config
+	// sessionSign, if set, signs session handshakes, which encrypt every
+	// connection with keys of its own; see WithSessionEncryption
+	sessionSign func(data []byte) []byte
+	// heartbeat paces pings to peers; onEvict, if set, is called for peers
+	// evicted for not answering them
+	heartbeat HeartbeatConfig
+	onEvict   func(*Peer)
+	// onMalformed, if set, is called for peers that sent a message out of
+	// bounds, before they are disconnected
+	onMalformed func(*Peer, error)
+	// onBroadcastFailure, if set, is told of each broadcast a peer's queue
+	// failed to write; see Broadcast
+	onBroadcastFailure func(*Peer, *protocol.Message, error)
+	// onConnect and onDisconnect are called, in order, as each peer
+	// connection is opened and closed
+	onConnect    []func(*Peer)
+	onDisconnect []func(*Peer)
+	// bulkPeers and bulkConns hold the half of a bulk pairing that arrived
+	// first, keyed by token
+	bulkPeers map[string]*Peer
+	bulkConns map[string]*bulkChannel
+	// tap, if set, is shown every message sent and received
+	tap atomic.Pointer[Tap]
+	// onListenerError, if set, is told of listeners that failed for good;
+	// stopAccepting ends the running accept loops, once accepting is set by
+	// Start. acceptMu guards them and the listeners across restarts.
+	onListenerError func(address string, err error)
+	accepting       bool
+	stopAccepting   context.CancelFunc
+	acceptMu        sync.Mutex
+	// bytesSent and bytesReceived count traffic across all peers
+	bytesSent     atomic.Int64
+	bytesReceived atomic.Int64
+	limiter       rateLimiter
+	messages      messageCounts
+	mu            sync.RWMutex
+	done          chan struct{}
 }
 
 // MessageHandler handles incoming messages
@@ -25,116 +135,342 @@ type MessageHandler interface {
 }
 
 // NewTransport creates a new transport
-func NewTransport(nodeID, address string, handler MessageHandler) (*Transport, error) {
-	listener, err := net.Listen("tcp", address)
+func NewTransport(nodeID, address string, handler MessageHandler, opts ...Option) (*Transport, error) {
+	t := &Transport{
+		nodeID:       nodeID,
+		address:      address,
+		peers:        make(map[string]*Peer),
+		handler:      handler,
+		network:      tcpNetwork{},
+		socketOpts:   DefaultSocketOptions(),
+		writeTimeout: DefaultWriteTimeout,
+		heartbeat:    DefaultHeartbeatConfig(),
+		bulkEnabled:  true,
+		framing:      true,
+		muxing:       true,
+		maxFrame:     DefaultMaxFrameSize,
+		codecs:       protocol.Codecs,
+		compressions: protocol.FrameCompressions,
+		compressMin:  DefaultCompressThreshold,
+		bulkPeers:    make(map[string]*Peer),
+		bulkConns:    make(map[string]*bulkChannel),
+		done:         make(chan struct{}),
+
+		dialTimeout:      DefaultDialTimeout,
+		handshakeTimeout: DefaultHandshakeTimeout,
+		handshakeWindow:  DefaultHandshakeWindow,
+		readTimeout:      DefaultReadTimeout,
+		maxInflight:      DefaultMaxInflight,
+		peerLimits:       DefaultPeerLimits(),
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if _, ok := t.network.(tcpNetwork); ok && t.punching {
+		t.network = tcpNetwork{reusePort: true}
+	}
+
+	listener, err := t.network.Listen(address)
 	if err != nil {
 		return nil, err
 	}
+	t.listener = listener
+	if err := t.listenExtra(); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if t.wsAddress != "" {
+		if err := t.listenWebSocket(t.wsAddress); err != nil {
+			for _, l := range t.listeners() {
+				l.Close()
+			}
+			return nil, err
+		}
+	}
 
-	return &Transport{
-		listener: listener,
-		nodeID:   nodeID,
-		address:  address,
-		peers:    make(map[string]*Peer),
-		handler:  handler,
-		done:     make(chan struct{}),
-	}, nil
+	return t, nil
 }
 
 // Start starts the transport
 func (t *Transport) Start() {
-	go t.acceptLoop()
+	t.startAccepting()
+	if t.wsServer != nil {
+		go t.wsServer.Serve(t.wsListener)
+	}
+	if t.heartbeat.Interval > 0 {
+		go t.heartbeatLoop()
+	}
 }
 
 // Stop stops the transport
 func (t *Transport) Stop() {
 	close(t.done)
-	t.listener.Close()
+	t.closeListeners()
+	if t.wsServer != nil {
+		t.wsServer.Close()
+	}
 
 	t.mu.Lock()
-	defer t.mu.Unlock()
-
+	peers := make([]*Peer, 0, len(t.peers))
 	for _, peer := range t.peers {
+		peers = append(peers, peer)
+	}
+	unclaimed := make([]*bulkChannel, 0, len(t.bulkConns))
+	for _, b := range t.bulkConns {
+		unclaimed = append(unclaimed, b)
+	}
+	t.mu.Unlock()
+
+	for _, peer := range peers {
 		peer.Close()
 	}
+	for _, b := range unclaimed {
+		b.conn.Close()
+	}
 }
 
-// In transport.go, modify Connect:
-func (t *Transport) Connect(address string) error {
-	conn, err := net.Dial("tcp", address)
+// addPeer registers a peer with the transport and arranges for it to be
+// removed again once its connection is closed
+func (t *Transport) addPeer(peer *Peer) {
+	peer.writeTimeout = t.writeTimeout
+	peer.localID = t.nodeID
+	peer.maxFrame = t.maxFrame
+	peer.compressMin = t.compressMin
+	peer.mux.allowed = t.muxing
+	peer.readTimeout = t.readTimeout
+	peer.maxInflight = t.maxInflight
+	peer.countMessage = t.messages.add
+	peer.tap = &t.tap
+	peer.onClose = t.forgetPeer
+	peer.onBulkToken = func(p *Peer, token string) {
+		t.pairBulk(token, p, nil)
+	}
+	peer.onMalformed = t.onMalformed
+
+	t.mu.Lock()
+	t.peers[peer.ID()] = peer
+	if t.handshakeWindow > 0 {
+		peer.handshakeTimer = time.AfterFunc(t.handshakeWindow, func() {
+			t.expireUnidentified(peer)
+		})
+	}
+	t.mu.Unlock()
+
+	for _, fn := range t.onConnect {
+		fn(peer)
+	}
+}
+
+// forgetPeer drops a closed peer from the peer map
+func (t *Transport) forgetPeer(peer *Peer) {
+	t.mu.Lock()
+	if current, exists := t.peers[peer.ID()]; exists && current == peer {
+		delete(t.peers, peer.ID())
+	}
+	t.mu.Unlock()
+
+	for _, fn := range t.onDisconnect {
+		fn(peer)
+	}
+}
+
+// Connect dials address and sends the handshake. It gives up once ctx is
+// done, or when the dial or handshake timeout runs out.
+func (t *Transport) Connect(ctx context.Context, address string) error {
+	if t.filter != nil {
+		if err := t.filter(dialHost(address)); err != nil {
+			return err
+		}
+	}
+
+	dialCtx, cancel := withTimeout(ctx, t.dialTimeout)
+	conn, err := t.dial(dialCtx, address)
+	cancel()
 	if err != nil {
 		fmt.Printf("Connection error: %v\n", err)
 		return err
 	}
 
-	peer := NewPeer(conn, t.handler)
+	handshakeCtx, cancel := withTimeout(ctx, t.handshakeTimeout)
+	defer cancel()
+	return t.connectConn(handshakeCtx, address, conn, t.bulkEnabled)
+}
 
-	t.mu.Lock()
-	t.peers[peer.ID()] = peer
-	t.mu.Unlock()
+// withTimeout returns ctx bounded by timeout, or just cancellable if timeout
+// is zero
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// connectConn sets up a dialed connection as an outgoing peer and sends the
+// handshake, giving up if ctx is done first. A bulk channel is dialed
+// alongside it if bulk is set.
+func (t *Transport) connectConn(ctx context.Context, address string, conn net.Conn, bulk bool) error {
+	if err := t.makeRoom(true); err != nil {
+		conn.Close()
+		fmt.Printf("Not connecting to %s: %v\n", address, err)
+		return err
+	}
+	if err := t.applySocketOptions(conn); err != nil {
+		fmt.Printf("Failed to apply socket options to %s: %v\n", address, err)
+	}
+	conn = t.countConn(conn)
+	counted := conn
+	conn, err := t.secure(ctx, conn, true)
+	if err != nil {
+		fmt.Printf("Connection error: %v\n", err)
+		return err
+	}
+	if t.framing {
+		if deadline, ok := ctx.Deadline(); ok {
+			conn.SetWriteDeadline(deadline)
+		}
+		_, err := conn.Write(frameMagic)
+		conn.SetWriteDeadline(time.Time{})
+		if err != nil {
+			conn.Close()
+			fmt.Printf("Connection error: %v\n", err)
+			return err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	peer := NewPeer(conn, t.handler)
+	peer.certificate = peerCertificate(conn)
+	peer.sessionKey = sessionIdentity(conn)
+	peer.framed = t.framing
+	peer.outbound = true
+	peer.counted = counted
+	t.addPeer(peer)
 
 	// Start peer handling
 	peer.Start()
 
 	// Create and send handshake immediately
-	handshaker := protocol.NewHandshaker(t.nodeID, t.address, []string{})
+	handshaker := protocol.NewHandshaker(t.nodeID, t.AdvertisedAddress(), []string{})
+	handshaker.PublicKey = t.identityKey
+	handshaker.Keyless = t.keyless
+	handshaker.Capabilities = t.capabilities
+	handshaker.NetworkID = t.networkID
+	if address == t.inviteAddress {
+		handshaker.Invite = t.invite
+	}
+	handshaker.Codecs = t.codecs
+	handshaker.FrameCompression = t.compressions
+	handshaker.ExchangeKey = t.exchangeKey
+	handshaker.ExchangeSignature = t.exchangeSignature
+	handshaker.Addresses = t.AdvertisedAddresses()
+	handshaker.Challenge = peer.Challenge()
 	msg, err := handshaker.CreateHandshake()
 	if err != nil {
 		fmt.Printf("Handshake creation error: %v\n", err)
 		return err
 	}
+	peer.idMu.Lock()
+	peer.hello = msg.Payload
+	peer.idMu.Unlock()
 
 	if err := peer.Send(msg); err != nil {
 		fmt.Printf("Handshake send error: %v\n", err)
 		return err
 	}
 
+	if bulk {
+		if err := t.openBulk(address, peer); err != nil {
+			// Chunks travel over the control connection instead
+			fmt.Printf("Failed to open bulk channel to %s: %v\n", address, err)
+		}
+	}
+
 	return nil
 }
 
-// Broadcast sends a message to all connected peers
-func (t *Transport) Broadcast(msg *protocol.Message) error {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+// PeerError is a failed send to one peer
+type PeerError struct {
+	Peer *Peer
+	Err  error
+}
 
-	for _, peer := range t.peers {
-		if err := peer.Send(msg); err != nil {
-			fmt.Printf("Failed to send message to peer %s: %v\n", peer.ID(), err)
-		}
-	}
-	return nil
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer %s: %v", e.Peer.ID(), e.Err)
 }
 
-func (t *Transport) acceptLoop() {
-	for {
-		select {
-		case <-t.done:
-			return
-		default:
-			conn, err := t.listener.Accept()
-			if err != nil {
-				continue
-			}
+func (e *PeerError) Unwrap() error {
+	return e.Err
+}
+
+// BroadcastError lists the peers a broadcast did not reach
+type BroadcastError struct {
+	Failed []*PeerError
+	// Delivered is how many peers the message did reach
+	Delivered int
+}
+
+func (e *BroadcastError) Error() string {
+	reasons := make([]string, len(e.Failed))
+	for i, f := range e.Failed {
+		reasons[i] = f.Error()
+	}
+	return fmt.Sprintf("failed to send to %d of %d peers: %s", len(e.Failed), len(e.Failed)+e.Delivered, strings.Join(reasons, "; "))
+}
 
-			peer := NewPeer(conn, t.handler)
+// Unwrap lets errors.Is and errors.As see each peer's error
+func (e *BroadcastError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, f := range e.Failed {
+		errs[i] = f
+	}
+	return errs
+}
 
-			t.mu.Lock()
-			t.peers[peer.ID()] = peer
-			t.mu.Unlock()
+// Broadcast queues a message for all connected peers that completed the
+// handshake; see Identify. Each peer's queue is written in the background,
+// so a slow receiver holds up neither the caller nor the others. A peer
+// whose queue is full is evicted, and the error is then a *BroadcastError
+// naming the peers that missed the message, with Delivered counting those
+// it was queued for. Writes that fail later go to the handler set with
+// WithBroadcastFailureHandler.
+func (t *Transport) Broadcast(msg *protocol.Message) error {
+	t.mu.RLock()
+	peers := make([]*Peer, 0, len(t.peers))
+	for _, peer := range t.peers {
+		if peer.Identified() {
+			peers = append(peers, peer)
+		}
+	}
+	t.mu.RUnlock()
 
-			go peer.Start()
+	result := &BroadcastError{}
+	for _, peer := range peers {
+		if err := peer.enqueue(msg, t.onBroadcastFailure); err != nil {
+			result.Failed = append(result.Failed, &PeerError{Peer: peer, Err: err})
+		} else {
+			result.Delivered++
 		}
 	}
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
 }
 
 // RemovePeer removes a peer from the transport
 func (t *Transport) RemovePeer(peerID string) {
 	t.mu.Lock()
-	defer t.mu.Unlock()
+	peer, exists := t.peers[peerID]
+	if exists {
+		delete(t.peers, peerID)
+	}
+	t.mu.Unlock()
 
-	if peer, exists := t.peers[peerID]; exists {
+	if exists {
 		peer.Close()
-		delete(t.peers, peerID)
 	}
 }
 
@@ -155,3 +491,23 @@ func (t *Transport) Send(peerID string, msg *protocol.Message) error {
 func (t *Transport) Address() string {
 	return t.address
 }
+
+// SetAdvertisedAddress sets the address sent in handshakes, for peers that
+// must dial something other than the listen address, such as a port mapped
+// on the router. An empty address restores the listen address.
+func (t *Transport) SetAdvertisedAddress(address string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.advertised = address
+}
+
+// AdvertisedAddress returns the address sent in handshakes
+func (t *Transport) AdvertisedAddress() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.advertised != "" {
+		return t.advertised
+	}
+	return t.address
+}
@@ -1,7 +1,11 @@
 package network
 
 import (
+	"context"
+	"errors"
+	"net"
 	"testing"
+	"time"
 
 	"p2p-storage/internal/protocol"
 )
@@ -34,10 +38,9 @@ func TestTransport_Broadcast(t *testing.T) {
 	conn := newMockConn()
 	peer := NewPeer(conn, handler)
 
-	// Add peer to transport
-	transport.mu.Lock()
-	transport.peers[peer.ID()] = peer
-	transport.mu.Unlock()
+	// Add peer to transport, as after its handshake
+	transport.addPeer(peer)
+	transport.IdentifyNode(peer, "peer")
 
 	// Create test message
 	msg, err := protocol.NewMessage(protocol.MessageTypeData, "test-node", protocol.DataPayload{
@@ -53,11 +56,332 @@ func TestTransport_Broadcast(t *testing.T) {
 		t.Fatalf("Failed to broadcast message: %v", err)
 	}
 
-	// Check if message was written
-	conn.mu.Lock()
-	defer conn.mu.Unlock()
+	// The peer's queue is written in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn.mu.Lock()
+		written := len(conn.writeData)
+		conn.mu.Unlock()
+		if written > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Peer did not receive the message")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransport_BroadcastReportsFailures(t *testing.T) {
+	handler := &mockHandler{}
+	failures := make(chan *PeerError, 4)
+	transport, err := NewTransport("test-node", ":0", handler, WithBroadcastFailureHandler(func(p *Peer, msg *protocol.Message, err error) {
+		failures <- &PeerError{Peer: p, Err: err}
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer transport.Stop()
+
+	healthy := NewPeer(newMockConn(), handler)
+	brokenConn := newMockConn()
+	brokenConn.Close()
+	broken := NewPeer(brokenConn, handler)
+
+	// Mock connections share an address, so key them apart
+	healthy.identity = "healthy"
+	broken.identity = "broken"
+	transport.mu.Lock()
+	transport.peers["healthy"] = healthy
+	transport.peers["broken"] = broken
+	transport.mu.Unlock()
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, "test-node", protocol.DataPayload{
+		ContentHash: "test123",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+
+	// Queued for both; the broken peer's write fails afterwards
+	if err := transport.Broadcast(msg); err != nil {
+		t.Fatalf("Broadcast() error = %v", err)
+	}
+	select {
+	case failed := <-failures:
+		if failed.Peer != broken || !errors.Is(failed, net.ErrClosed) {
+			t.Errorf("Failure = %v, want the broken peer's %v", failed, net.ErrClosed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Failed write to the broken peer was not reported")
+	}
+	select {
+	case failed := <-failures:
+		t.Errorf("Unexpected failure %v", failed)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
 
-	if len(conn.writeData) == 0 {
-		t.Error("Peer did not receive the message")
+func TestTransport_EvictsPeerWithFullQueue(t *testing.T) {
+	handler := &mockHandler{}
+	transport, err := NewTransport("test-node", ":0", handler)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer transport.Stop()
+
+	// A wedged receiver without a write timeout: the first write never
+	// finishes, and the broadcasts after it pile up
+	local, remote := net.Pipe()
+	defer remote.Close()
+	slow := NewPeer(local, handler)
+	transport.addPeer(slow)
+	transport.IdentifyNode(slow, "slow")
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, "test-node", protocol.DataPayload{
+		ContentHash: "test123",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < broadcastQueueSize+2; i++ {
+			if err := transport.Broadcast(msg); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		var result *BroadcastError
+		if !errors.As(err, &result) || !errors.Is(err, ErrQueueFull) {
+			t.Fatalf("Broadcast() error = %v, want a *BroadcastError wrapping %v", err, ErrQueueFull)
+		}
+		if len(result.Failed) != 1 || result.Failed[0].Peer != slow || result.Delivered != 0 {
+			t.Errorf("Broadcast() failed %v and delivered %d, want only the slow peer failed", result.Failed, result.Delivered)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Broadcast blocked on slow peer")
+	}
+	if !slow.Closed() {
+		t.Error("Slow peer was not closed")
+	}
+}
+
+func TestTransport_EvictsSlowPeer(t *testing.T) {
+	handler := &mockHandler{}
+	transport, err := NewTransport("test-node", ":0", handler, WithWriteTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer transport.Stop()
+
+	// A wedged receiver: nothing ever reads from the remote end of the pipe
+	local, remote := net.Pipe()
+	defer remote.Close()
+	slow := NewPeer(local, handler)
+	transport.addPeer(slow)
+	transport.IdentifyNode(slow, "slow")
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, "test-node", protocol.DataPayload{
+		ContentHash: "test123",
+	})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		transport.Broadcast(msg)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Broadcast blocked on slow peer")
+	}
+
+	// Evicted once the queued write times out
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		transport.mu.RLock()
+		_, exists := transport.peers[slow.ID()]
+		transport.mu.RUnlock()
+		if !exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Slow peer was not evicted from transport")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransport_PeerHandlers(t *testing.T) {
+	connected := make(chan *Peer, 4)
+	disconnected := make(chan *Peer, 4)
+	handler := &mockHandler{}
+	server, err := NewTransport("server", "127.0.0.1:0", handler,
+		WithConnectHandler(func(p *Peer) { connected <- p }),
+		WithDisconnectHandler(func(p *Peer) { disconnected <- p }),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	server.Start()
+	defer server.Stop()
+
+	client, err := NewTransport("client", "127.0.0.1:0", handler, WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	client.Start()
+	defer client.Stop()
+
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	var peer *Peer
+	select {
+	case peer = <-connected:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connect handler was not called")
+	}
+	if peer.Outbound() {
+		t.Error("Accepted peer reported as outbound")
+	}
+
+	peer.Close()
+	select {
+	case closed := <-disconnected:
+		if closed != peer {
+			t.Error("Disconnect handler was called with another peer")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Disconnect handler was not called")
+	}
+}
+
+func TestTransport_ConnectTimeouts(t *testing.T) {
+	sim := NewSimNetwork()
+	// Never started, so its listener accepts nothing and dials hang
+	server, err := NewTransport("server", "server:1", &mockHandler{}, WithNetwork(sim))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+
+	client, err := NewTransport("client", "client:1", &mockHandler{}, WithNetwork(sim), WithDialTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	if err := client.Connect(context.Background(), "server:1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Connect() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.Connect(ctx, "server:1"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Connect() with cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestTransport_HandshakeTimeout(t *testing.T) {
+	// Accepts connections but never answers the TLS handshake
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{},
+		WithTLS(NewTLSConfig(testCertificate(t), nil)),
+		WithHandshakeTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	start := time.Now()
+	if err := client.Connect(context.Background(), listener.Addr().String()); err == nil {
+		t.Fatal("Connect() to a silent listener succeeded, want error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Connect() took %v, want about 100ms", elapsed)
+	}
+	if client.PeerCount() != 0 {
+		t.Errorf("PeerCount() = %d, want 0", client.PeerCount())
+	}
+}
+
+func TestTransport_DisconnectsMalformedPeer(t *testing.T) {
+	malformed := make(chan error, 1)
+	serverHandler := newTransferRecorder()
+	server, err := NewTransport("server", "127.0.0.1:0", serverHandler, WithMalformedHandler(func(_ *Peer, err error) {
+		malformed <- err
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{}, WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+	if err := client.Connect(context.Background(), server.listener.Addr().String()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	<-serverHandler.messages // handshake
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeDataRequest, "client", protocol.DataRequest{ContentHash: "../escape"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	peer := onlyPeer(t, client)
+	if err := peer.Send(msg); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+
+	select {
+	case err := <-malformed:
+		if !errors.Is(err, protocol.ErrInvalidPayload) {
+			t.Errorf("Malformed handler got %v, want %v", err, protocol.ErrInvalidPayload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the malformed message")
+	}
+	select {
+	case <-serverHandler.messages:
+		t.Error("Malformed message reached the handler")
+	default:
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !peer.Closed() {
+		if time.Now().After(deadline) {
+			t.Fatal("Peer still connected after a malformed message")
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
@@ -0,0 +1,303 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ssdpAddress = "239.255.255.250:1900"
+	// upnpGatewayType is searched for over SSDP
+	upnpGatewayType = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	// upnpOnlyPermanentLeases is the error of routers that refuse a lease
+	// duration, so the mapping is retried without one
+	upnpOnlyPermanentLeases = 725
+	// upnpMappingDescription names mappings in the router's admin page
+	upnpMappingDescription = "p2p-storage"
+)
+
+// UPnP maps ports through a UPnP Internet Gateway Device
+type UPnP struct {
+	controlURL  string // where SOAP actions are posted
+	serviceType string // WANIPConnection or WANPPPConnection
+	localIP     string // this host's address on the router's network
+	client      *http.Client
+}
+
+// upnpDevice is a device in a UPnP description, with its embedded devices
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// findService returns the first WAN connection service of the device tree
+func (d upnpDevice) findService() (upnpService, bool) {
+	for _, s := range d.Services {
+		if strings.Contains(s.ServiceType, ":WANIPConnection:") || strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+			return s, true
+		}
+	}
+	for _, child := range d.Devices {
+		if s, ok := child.findService(); ok {
+			return s, true
+		}
+	}
+	return upnpService{}, false
+}
+
+// DiscoverUPnP searches the local network for an Internet Gateway Device
+// over SSDP and returns the first one offering a WAN connection service
+func DiscoverUPnP(timeout time.Duration) (*UPnP, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open SSDP socket: %w", err)
+	}
+	defer conn.Close()
+
+	dst, err := net.ResolveUDPAddr("udp4", ssdpAddress)
+	if err != nil {
+		return nil, err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddress + "\r\n" +
+		"ST: " + upnpGatewayType + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), dst); err != nil {
+		return nil, fmt.Errorf("failed to send SSDP search: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 2048)
+	var lastErr error = errors.New("no gateway answered the SSDP search")
+	for time.Now().Before(deadline) {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		location, err := ssdpLocation(buf[:n])
+		if err != nil {
+			continue
+		}
+		igd, err := NewUPnP(location, time.Until(deadline))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return igd, nil
+	}
+	return nil, lastErr
+}
+
+// ssdpLocation returns the description URL from an SSDP search response
+func ssdpLocation(data []byte) (string, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid SSDP response: %w", err)
+	}
+	resp.Body.Close()
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", errors.New("SSDP response has no location")
+	}
+	return location, nil
+}
+
+// NewUPnP reads the device description at location and sets up a client
+// for its WAN connection service
+func NewUPnP(location string, timeout time.Duration) (*UPnP, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch UPnP description: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch UPnP description: %s", resp.Status)
+	}
+
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return nil, fmt.Errorf("invalid UPnP description: %w", err)
+	}
+	service, ok := desc.Device.findService()
+	if !ok {
+		return nil, errors.New("UPnP device offers no WAN connection service")
+	}
+
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	if desc.URLBase != "" {
+		if base, err = url.Parse(desc.URLBase); err != nil {
+			return nil, fmt.Errorf("invalid UPnP URL base: %w", err)
+		}
+	}
+	control, err := base.Parse(service.ControlURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UPnP control URL: %w", err)
+	}
+
+	// The mapping points at whichever local address routes to the router
+	probe, err := net.Dial("udp", base.Host)
+	if err != nil {
+		if probe, err = net.Dial("udp", net.JoinHostPort(base.Hostname(), "80")); err != nil {
+			return nil, fmt.Errorf("failed to find local address: %w", err)
+		}
+	}
+	localIP := probe.LocalAddr().(*net.UDPAddr).IP.String()
+	probe.Close()
+
+	return &UPnP{
+		controlURL:  control.String(),
+		serviceType: service.ServiceType,
+		localIP:     localIP,
+		client:      client,
+	}, nil
+}
+
+// Name implements PortMapper
+func (u *UPnP) Name() string {
+	return "UPnP"
+}
+
+// ExternalIP implements PortMapper
+func (u *UPnP) ExternalIP() (net.IP, error) {
+	body, err := u.call("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(soapValue(body, "NewExternalIPAddress"))
+	if ip == nil {
+		return nil, errors.New("UPnP router reported no external address")
+	}
+	return ip, nil
+}
+
+// AddMapping implements PortMapper. UPnP routers map the port asked for or
+// fail, so the granted port is always externalPort.
+func (u *UPnP) AddMapping(internalPort, externalPort int, lifetime time.Duration) (int, error) {
+	add := func(lease time.Duration) error {
+		_, err := u.call("AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(externalPort)},
+			{"NewProtocol", "TCP"},
+			{"NewInternalPort", strconv.Itoa(internalPort)},
+			{"NewInternalClient", u.localIP},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", upnpMappingDescription},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		})
+		return err
+	}
+
+	err := add(lifetime)
+	var upnpErr *upnpError
+	if errors.As(err, &upnpErr) && upnpErr.code == upnpOnlyPermanentLeases {
+		err = add(0)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return externalPort, nil
+}
+
+// DeleteMapping implements PortMapper
+func (u *UPnP) DeleteMapping(internalPort, externalPort int) error {
+	_, err := u.call("DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(externalPort)},
+		{"NewProtocol", "TCP"},
+	})
+	return err
+}
+
+// upnpError is a fault returned by a UPnP action
+type upnpError struct {
+	action      string
+	code        int
+	description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP %s failed: %d %s", e.action, e.code, e.description)
+}
+
+// call posts a SOAP action with its arguments, in order, and returns the
+// response body
+func (u *UPnP) call(action string, args [][2]string) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, u.serviceType)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, "</u:%s></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequest(http.MethodPost, u.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.serviceType, action))
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("UPnP %s failed: %w", action, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, fmt.Errorf("UPnP %s failed: %w", action, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		code, _ := strconv.Atoi(soapValue(data, "errorCode"))
+		description := soapValue(data, "errorDescription")
+		if description == "" {
+			description = resp.Status
+		}
+		return nil, &upnpError{action: action, code: code, description: description}
+	}
+	return data, nil
+}
+
+// soapValue returns the text of the first element called name in a SOAP
+// body, whatever its namespace
+func soapValue(body []byte, name string) string {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := token.(xml.StartElement); ok && start.Name.Local == name {
+			var value string
+			if err := decoder.DecodeElement(&value, &start); err != nil {
+				return ""
+			}
+			return strings.TrimSpace(value)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testServiceType = "urn:schemas-upnp-org:service:WANIPConnection:1"
+
+// fakeIGD serves a gateway description with the WAN service nested in
+// embedded devices, as real routers do, and records the SOAP actions posted
+type fakeIGD struct {
+	mu      sync.Mutex
+	actions []string
+	bodies  []string
+	// permanentOnly refuses mappings with a lease duration
+	permanentOnly bool
+}
+
+func (f *fakeIGD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/desc.xml":
+		fmt.Fprintf(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0"><device>
+<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+<deviceList><device><deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+<serviceList><service><serviceType>%s</serviceType><controlURL>/ctl/IPConn</controlURL></service></serviceList>
+</device></deviceList></device></deviceList></device></root>`, testServiceType)
+	case "/ctl/IPConn":
+		body, _ := io.ReadAll(r.Body)
+		action := strings.TrimSuffix(strings.SplitN(r.Header.Get("SOAPAction"), "#", 2)[1], `"`)
+		f.mu.Lock()
+		f.actions = append(f.actions, action)
+		f.bodies = append(f.bodies, string(body))
+		f.mu.Unlock()
+
+		if action == "AddPortMapping" && f.permanentOnly && !strings.Contains(string(body), "<NewLeaseDuration>0<") {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode><errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+		fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse xmlns:u="%s">`, action, testServiceType)
+		if action == "GetExternalIPAddress" {
+			fmt.Fprint(w, "<NewExternalIPAddress>198.51.100.4</NewExternalIPAddress>")
+		}
+		fmt.Fprintf(w, "</u:%sResponse></s:Body></s:Envelope>", action)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestUPnP(t *testing.T) {
+	igd := &fakeIGD{permanentOnly: true}
+	server := httptest.NewServer(igd)
+	defer server.Close()
+
+	u, err := NewUPnP(server.URL+"/desc.xml", time.Second)
+	if err != nil {
+		t.Fatalf("NewUPnP() error = %v", err)
+	}
+
+	ip, err := u.ExternalIP()
+	if err != nil {
+		t.Fatalf("ExternalIP() error = %v", err)
+	}
+	if !ip.Equal(net.ParseIP("198.51.100.4")) {
+		t.Errorf("ExternalIP() = %v, want 198.51.100.4", ip)
+	}
+
+	// A router that only takes permanent leases gets the mapping again
+	// without one
+	port, err := u.AddMapping(3000, 3000, time.Hour)
+	if err != nil {
+		t.Fatalf("AddMapping() error = %v", err)
+	}
+	if port != 3000 {
+		t.Errorf("AddMapping() = %d, want 3000", port)
+	}
+	if err := u.DeleteMapping(3000, port); err != nil {
+		t.Errorf("DeleteMapping() error = %v", err)
+	}
+
+	igd.mu.Lock()
+	defer igd.mu.Unlock()
+	want := []string{"GetExternalIPAddress", "AddPortMapping", "AddPortMapping", "DeletePortMapping"}
+	if strings.Join(igd.actions, ",") != strings.Join(want, ",") {
+		t.Errorf("actions = %v, want %v", igd.actions, want)
+	}
+	if !strings.Contains(igd.bodies[1], "<NewInternalClient>127.0.0.1</NewInternalClient>") {
+		t.Errorf("AddPortMapping body does not map to the local address: %s", igd.bodies[1])
+	}
+}
+
+func TestUPnP_NoWANService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<root><device><serviceList><service><serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType></service></serviceList></device></root>`)
+	}))
+	defer server.Close()
+
+	if _, err := NewUPnP(server.URL, time.Second); err == nil {
+		t.Error("NewUPnP() for a device without a WAN service succeeded, want error")
+	}
+}
+
+func TestSSDPLocation(t *testing.T) {
+	resp := "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=120\r\nLOCATION: http://192.168.1.1:5000/desc.xml\r\nST: " + upnpGatewayType + "\r\n\r\n"
+	location, err := ssdpLocation([]byte(resp))
+	if err != nil {
+		t.Fatalf("ssdpLocation() error = %v", err)
+	}
+	if location != "http://192.168.1.1:5000/desc.xml" {
+		t.Errorf("ssdpLocation() = %q, want http://192.168.1.1:5000/desc.xml", location)
+	}
+
+	if _, err := ssdpLocation([]byte("HTTP/1.1 200 OK\r\n\r\n")); err == nil {
+		t.Error("Expected error for a response without a location")
+	}
+}
@@ -0,0 +1,381 @@
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/webrtc/v4"
+)
+
+// WebRTCSignalPath is where the WebSocket listener answers WebRTC offers
+// posted by browsers, when WebRTC is enabled
+const WebRTCSignalPath = "/p2p/webrtc"
+
+// ErrWebRTCDisabled is returned for WebRTC offers and dials on a transport
+// without WithWebRTC
+var ErrWebRTCDisabled = errors.New("WebRTC is not enabled")
+
+// ErrTooManyWebRTCOffers is returned by AnswerWebRTC while maxPendingWebRTC
+// answered offers are still waiting for their data channel
+var ErrTooManyWebRTCOffers = errors.New("too many WebRTC offers pending")
+
+const (
+	// webrtcLabel names the data channel peer connections are served over
+	webrtcLabel = "p2p"
+	// webrtcChunkSize bounds the messages written to a data channel, the
+	// largest size every browser accepts
+	webrtcChunkSize = 16 * 1024
+	// webrtcMaxMessage is the largest message a data channel receives, as
+	// announced in the session description
+	webrtcMaxMessage = 64 * 1024
+	// maxSignalSize bounds an offer posted to WebRTCSignalPath
+	maxSignalSize = 64 * 1024
+	// maxPendingWebRTC bounds the answered offers whose data channel hasn't
+	// opened yet, each holding a peer connection with its ICE agent
+	maxPendingWebRTC = 32
+)
+
+// WebRTCConfig lets peers, browsers in particular, connect over WebRTC data
+// channels. Offers are answered at WebRTCSignalPath on the WebSocket
+// listener, or through the offers relayed between peers; see AnswerWebRTC.
+type WebRTCConfig struct {
+	// ICEServers are the STUN and TURN URLs used to gather candidates,
+	// such as "stun:stun.l.google.com:19302"; without any only the
+	// host's own addresses are offered
+	ICEServers []string
+}
+
+// WithWebRTC accepts peer connections over WebRTC data channels, and lets
+// DialWebRTC open them. The protocol runs over the data channel as over any
+// other connection, TLS included.
+func WithWebRTC(cfg WebRTCConfig) Option {
+	return func(t *Transport) {
+		var settings webrtc.SettingEngine
+		settings.DetachDataChannels()
+		settings.SetIncludeLoopbackCandidate(true)
+		settings.SetSCTPMaxMessageSize(webrtcMaxMessage)
+		t.rtcAPI = webrtc.NewAPI(webrtc.WithSettingEngine(settings))
+		t.rtcPending = make(chan struct{}, maxPendingWebRTC)
+		t.rtcConfig = webrtc.Configuration{}
+		if len(cfg.ICEServers) > 0 {
+			t.rtcConfig.ICEServers = []webrtc.ICEServer{{URLs: cfg.ICEServers}}
+		}
+	}
+}
+
+// WebRTCEnabled reports whether the transport accepts WebRTC connections
+func (t *Transport) WebRTCEnabled() bool {
+	return t.rtcAPI != nil
+}
+
+// AnswerWebRTC answers a WebRTC offer, given as SDP, and serves the data
+// channel the offering peer opens like an accepted connection. ICE
+// candidates are gathered before the answer is returned, so no trickling
+// is needed on either side. The peer connection is closed if the data
+// channel doesn't open within the handshake timeout, and at most
+// maxPendingWebRTC answers wait for theirs at once.
+func (t *Transport) AnswerWebRTC(ctx context.Context, offer string) (string, error) {
+	if t.rtcAPI == nil {
+		return "", ErrWebRTCDisabled
+	}
+	select {
+	case t.rtcPending <- struct{}{}:
+	default:
+		return "", ErrTooManyWebRTCOffers
+	}
+	var settle sync.Once
+	release := func() { settle.Do(func() { <-t.rtcPending }) }
+
+	pc, err := t.newPeerConnection()
+	if err != nil {
+		release()
+		return "", err
+	}
+	// Without a handshake timeout, pending answers still need a bound
+	timeout := t.handshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	opened := make(chan struct{})
+	expiry := time.AfterFunc(timeout, func() {
+		select {
+		case <-opened:
+		default:
+			pc.Close()
+		}
+		release()
+	})
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() != webrtcLabel {
+			dc.Close()
+			return
+		}
+		dc.OnOpen(func() {
+			select {
+			case <-opened:
+				return
+			default:
+			}
+			close(opened)
+			if expiry.Stop() {
+				release()
+			}
+			conn, err := newRTCConn(pc, dc)
+			if err != nil {
+				fmt.Printf("Refusing WebRTC connection: %v\n", err)
+				pc.Close()
+				return
+			}
+			if t.filter != nil {
+				if err := t.filter(conn.RemoteAddr().String()); err != nil {
+					fmt.Printf("Refusing WebRTC connection from %s: %v\n", conn.RemoteAddr(), err)
+					conn.Close()
+					return
+				}
+			}
+			go t.serveConn(t.countConn(conn))
+		})
+	})
+
+	fail := func(err error) (string, error) {
+		expiry.Stop()
+		pc.Close()
+		release()
+		return "", err
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return fail(fmt.Errorf("invalid WebRTC offer: %w", err))
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return fail(fmt.Errorf("failed to answer WebRTC offer: %w", err))
+	}
+	if err := t.setLocalDescription(ctx, pc, answer); err != nil {
+		return fail(err)
+	}
+	return pc.LocalDescription().SDP, nil
+}
+
+// DialWebRTC opens a data channel to a peer and sets it up as an outgoing
+// connection. The offer is passed to signal, which returns the peer's
+// answer, such as by relaying both through a peer both nodes are connected
+// to. The dial and handshake timeouts apply as in Connect.
+func (t *Transport) DialWebRTC(ctx context.Context, signal func(ctx context.Context, offer string) (string, error)) error {
+	if t.rtcAPI == nil {
+		return ErrWebRTCDisabled
+	}
+	dialCtx, cancel := withTimeout(ctx, t.dialTimeout)
+	defer cancel()
+
+	pc, err := t.newPeerConnection()
+	if err != nil {
+		return err
+	}
+	dc, err := pc.CreateDataChannel(webrtcLabel, nil)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("failed to open data channel: %w", err)
+	}
+	opened := make(chan struct{})
+	dc.OnOpen(func() { close(opened) })
+
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("failed to create WebRTC offer: %w", err)
+	}
+	if err := t.setLocalDescription(dialCtx, pc, offer); err != nil {
+		pc.Close()
+		return err
+	}
+	answer, err := signal(dialCtx, pc.LocalDescription().SDP)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("WebRTC signaling failed: %w", err)
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		pc.Close()
+		return fmt.Errorf("invalid WebRTC answer: %w", err)
+	}
+	select {
+	case <-opened:
+	case <-dialCtx.Done():
+		pc.Close()
+		return fmt.Errorf("WebRTC data channel did not open: %w", dialCtx.Err())
+	}
+
+	conn, err := newRTCConn(pc, dc)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	address := conn.RemoteAddr().String()
+	if t.filter != nil {
+		if err := t.filter(address); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	handshakeCtx, cancel := withTimeout(ctx, t.handshakeTimeout)
+	defer cancel()
+	// Chunks share the data channel; a bulk channel would need another
+	// round of signaling
+	return t.connectConn(handshakeCtx, address, conn, false)
+}
+
+// newPeerConnection creates a peer connection that closes itself once ICE
+// fails or the remote side goes away
+func (t *Transport) newPeerConnection() (*webrtc.PeerConnection, error) {
+	pc, err := t.rtcAPI.NewPeerConnection(t.rtcConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WebRTC peer connection: %w", err)
+	}
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateDisconnected {
+			pc.Close()
+		}
+	})
+	return pc, nil
+}
+
+// setLocalDescription sets desc and waits until every ICE candidate is
+// gathered into it
+func (t *Transport) setLocalDescription(ctx context.Context, pc *webrtc.PeerConnection, desc webrtc.SessionDescription) error {
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(desc); err != nil {
+		return fmt.Errorf("failed to set WebRTC description: %w", err)
+	}
+	select {
+	case <-gathered:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("gathering ICE candidates: %w", ctx.Err())
+	}
+}
+
+// serveWebRTCSignal answers an offer posted as a JSON session description,
+// {"type": "offer", "sdp": "..."}, with the answer in the same form, as
+// browsers produce and take them
+func (t *Transport) serveWebRTCSignal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if t.filter != nil {
+		if err := t.filter(r.RemoteAddr); err != nil {
+			fmt.Printf("Refusing WebRTC offer from %s: %v\n", r.RemoteAddr, err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	var offer webrtc.SessionDescription
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSignalSize)).Decode(&offer); err != nil || offer.Type != webrtc.SDPTypeOffer {
+		http.Error(w, "expected an offer", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := withTimeout(r.Context(), t.dialTimeout)
+	defer cancel()
+	answer, err := t.AnswerWebRTC(ctx, offer.SDP)
+	if errors.Is(err, ErrTooManyWebRTCOffers) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer})
+}
+
+// rtcConn adapts a data channel to net.Conn. Writes are split into
+// messages of at most webrtcChunkSize bytes, and reads run on across
+// message boundaries, so the stream looks the same as a TCP connection to
+// everything above it. Closing it closes the whole peer connection.
+type rtcConn struct {
+	pc      *webrtc.PeerConnection
+	dc      datachannel.ReadWriteCloserDeadliner
+	buf     []byte // the rest of the message being read
+	msg     []byte
+	local   net.Addr
+	remote  net.Addr
+	writeMu sync.Mutex
+}
+
+func newRTCConn(pc *webrtc.PeerConnection, dc *webrtc.DataChannel) (*rtcConn, error) {
+	raw, err := dc.DetachWithDeadline()
+	if err != nil {
+		return nil, fmt.Errorf("failed to detach data channel: %w", err)
+	}
+	c := &rtcConn{pc: pc, dc: raw, msg: make([]byte, webrtcMaxMessage), local: rtcAddr(""), remote: rtcAddr("")}
+	if sctp := pc.SCTP(); sctp != nil {
+		if pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+			c.local = rtcAddr(net.JoinHostPort(pair.Local.Address, strconv.Itoa(int(pair.Local.Port))))
+			c.remote = rtcAddr(net.JoinHostPort(pair.Remote.Address, strconv.Itoa(int(pair.Remote.Port))))
+		}
+	}
+	return c, nil
+}
+
+func (c *rtcConn) Read(b []byte) (int, error) {
+	for len(c.buf) == 0 {
+		n, err := c.dc.Read(c.msg)
+		if err != nil {
+			return 0, err
+		}
+		c.buf = c.msg[:n]
+	}
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *rtcConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		end := min(written+webrtcChunkSize, len(b))
+		if _, err := c.dc.Write(b[written:end]); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+func (c *rtcConn) Close() error {
+	err := c.dc.Close()
+	c.pc.Close()
+	return err
+}
+
+func (c *rtcConn) LocalAddr() net.Addr  { return c.local }
+func (c *rtcConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *rtcConn) SetDeadline(t time.Time) error {
+	if err := c.dc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.dc.SetWriteDeadline(t)
+}
+
+func (c *rtcConn) SetReadDeadline(t time.Time) error  { return c.dc.SetReadDeadline(t) }
+func (c *rtcConn) SetWriteDeadline(t time.Time) error { return c.dc.SetWriteDeadline(t) }
+
+// rtcAddr is the address of the selected ICE candidate at one end of a
+// WebRTC connection
+type rtcAddr string
+
+func (a rtcAddr) Network() string { return "webrtc" }
+func (a rtcAddr) String() string  { return string(a) }
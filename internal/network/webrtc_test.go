@@ -0,0 +1,155 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestTransport_WebRTC(t *testing.T) {
+	serverHandler := newTransferRecorder()
+	server, err := NewTransport("server", "127.0.0.1:0", serverHandler, WithWebRTC(WebRTCConfig{}), WithWebSocket("127.0.0.1:0"))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	clientHandler := newTransferRecorder()
+	client, err := NewTransport("client", "127.0.0.1:0", clientHandler, WithWebRTC(WebRTCConfig{}))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	// Signal through the endpoint a browser would post its offer to
+	signal := func(ctx context.Context, offer string) (string, error) {
+		body, err := json.Marshal(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+		if err != nil {
+			return "", err
+		}
+		url := fmt.Sprintf("http://%s%s", server.WebSocketAddress(), WebRTCSignalPath)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("signaling endpoint returned %s", resp.Status)
+		}
+		var answer webrtc.SessionDescription
+		if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+			return "", err
+		}
+		return answer.SDP, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := client.DialWebRTC(ctx, signal); err != nil {
+		t.Fatalf("Failed to dial over WebRTC: %v", err)
+	}
+
+	select {
+	case msg := <-serverHandler.messages:
+		if msg.Type != protocol.MessageTypeHandshake {
+			t.Errorf("First message = %s, want handshake", msg.Type)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for handshake")
+	}
+
+	// A chunk larger than a data channel message arrives whole; without a
+	// codec agreed it travels as a JSON message
+	data := bytes.Repeat([]byte("x"), 3*webrtcChunkSize)
+	if err := onlyPeer(t, client).SendTransfer("client", &protocol.DataTransfer{ContentHash: "abc", Data: data, FinalChunk: true}); err != nil {
+		t.Fatalf("Failed to send transfer: %v", err)
+	}
+	select {
+	case msg := <-serverHandler.messages:
+		var transfer protocol.DataTransfer
+		if err := msg.ParsePayload(&transfer); err != nil {
+			t.Fatalf("Failed to parse transfer: %v", err)
+		}
+		if !bytes.Equal(transfer.Data, data) {
+			t.Errorf("Transfer data = %d bytes, want %d", len(transfer.Data), len(data))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for transfer")
+	}
+}
+
+func TestTransport_WebRTCDisabled(t *testing.T) {
+	transport, err := NewTransport("node", "127.0.0.1:0", &mockHandler{})
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer transport.Stop()
+
+	if _, err := transport.AnswerWebRTC(context.Background(), "v=0"); !errors.Is(err, ErrWebRTCDisabled) {
+		t.Errorf("AnswerWebRTC() = %v, want %v", err, ErrWebRTCDisabled)
+	}
+}
+
+func TestTransport_WebRTCPendingOffers(t *testing.T) {
+	transport, err := NewTransport("node", "127.0.0.1:0", &mockHandler{}, WithWebRTC(WebRTCConfig{}), WithHandshakeTimeout(500*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer transport.Stop()
+	transport.rtcPending = make(chan struct{}, 2)
+
+	// Offers from peers that never take the answer, so no data channel opens
+	offer := func() string {
+		t.Helper()
+		pc, err := transport.newPeerConnection()
+		if err != nil {
+			t.Fatalf("Failed to create peer connection: %v", err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		if _, err := pc.CreateDataChannel(webrtcLabel, nil); err != nil {
+			t.Fatalf("Failed to open data channel: %v", err)
+		}
+		desc, err := pc.CreateOffer(nil)
+		if err != nil {
+			t.Fatalf("Failed to create offer: %v", err)
+		}
+		if err := transport.setLocalDescription(context.Background(), pc, desc); err != nil {
+			t.Fatalf("Failed to set offer: %v", err)
+		}
+		return pc.LocalDescription().SDP
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := transport.AnswerWebRTC(context.Background(), offer()); err != nil {
+			t.Fatalf("AnswerWebRTC() error = %v", err)
+		}
+	}
+	if _, err := transport.AnswerWebRTC(context.Background(), offer()); !errors.Is(err, ErrTooManyWebRTCOffers) {
+		t.Fatalf("AnswerWebRTC() over the cap = %v, want %v", err, ErrTooManyWebRTCOffers)
+	}
+
+	// Answers whose data channel never opened are given up on
+	deadline := time.Now().Add(5 * time.Second)
+	for len(transport.rtcPending) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d answers still pending after the handshake timeout", len(transport.rtcPending))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if _, err := transport.AnswerWebRTC(context.Background(), offer()); err != nil {
+		t.Errorf("AnswerWebRTC() after the pending answers expired = %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketPath is where the WebSocket listener accepts peer connections,
+// and the path dialed for ws:// and wss:// addresses without one
+const WebSocketPath = "/p2p"
+
+// isWebSocketURL reports whether address is a ws:// or wss:// URL rather
+// than a host:port
+func isWebSocketURL(address string) bool {
+	return strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://")
+}
+
+// dialHost returns the host:port an address connects to, for filtering
+func dialHost(address string) string {
+	if !isWebSocketURL(address) {
+		return address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return address
+	}
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		return net.JoinHostPort(u.Hostname(), port)
+	}
+	return u.Host
+}
+
+// dial connects to a host:port over the transport's network, or to a ws://
+// or wss:// URL over WebSocket. WebSocket dials honour the HTTP(S)_PROXY
+// environment variables.
+func (t *Transport) dial(ctx context.Context, address string) (net.Conn, error) {
+	if !isWebSocketURL(address) {
+		return t.network.DialContext(ctx, address)
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebSocket address %q: %w", address, err)
+	}
+	if u.Path == "" {
+		u.Path = WebSocketPath
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.HandshakeTimeout = 0
+	ws, _, err := dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("WebSocket dial to %s failed: %w", address, err)
+	}
+	return newWSConn(ws), nil
+}
+
+// listenWebSocket starts accepting peer connections over WebSocket on
+// address. Accepted connections are served like TCP ones, TLS included.
+func (t *Transport) listenWebSocket(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen for WebSocket peers: %w", err)
+	}
+
+	upgrader := websocket.Upgrader{
+		// Peers authenticate through the handshake, not the page they
+		// were loaded from
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(WebSocketPath, func(w http.ResponseWriter, r *http.Request) {
+		if t.filter != nil {
+			if err := t.filter(r.RemoteAddr); err != nil {
+				fmt.Printf("Refusing WebSocket connection from %s: %v\n", r.RemoteAddr, err)
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		go t.serveConn(t.countConn(newWSConn(ws)))
+	})
+	if t.rtcAPI != nil {
+		mux.HandleFunc(WebRTCSignalPath, t.serveWebRTCSignal)
+	}
+
+	t.wsListener = listener
+	t.wsServer = &http.Server{Handler: mux, ReadHeaderTimeout: bulkTimeout}
+	return nil
+}
+
+// WebSocketAddress returns the address of the WebSocket listener, or "" if
+// there is none
+func (t *Transport) WebSocketAddress() string {
+	if t.wsListener == nil {
+		return ""
+	}
+	return t.wsListener.Addr().String()
+}
+
+// wsConn adapts a WebSocket to net.Conn. Each Write is sent as one binary
+// message, and reads run on across message boundaries, so the stream looks
+// the same as a TCP connection to everything above it.
+type wsConn struct {
+	ws      *websocket.Conn
+	r       io.Reader // the message being read, if any
+	writeMu sync.Mutex
+}
+
+func newWSConn(ws *websocket.Conn) *wsConn {
+	return &wsConn{ws: ws}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		if c.r == nil {
+			kind, r, err := c.ws.NextReader()
+			if err != nil {
+				var closeErr *websocket.CloseError
+				if errors.As(err, &closeErr) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if kind != websocket.BinaryMessage {
+				continue
+			}
+			c.r = r
+		}
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			c.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) Close() error {
+	return c.ws.Close()
+}
+
+func (c *wsConn) LocalAddr() net.Addr  { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr { return c.ws.RemoteAddr() }
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.ws.SetWriteDeadline(t)
+}
+
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
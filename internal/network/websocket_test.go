@@ -0,0 +1,102 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestDialHost(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"127.0.0.1:3000", "127.0.0.1:3000"},
+		{"ws://example.com:8080/p2p", "example.com:8080"},
+		{"ws://example.com", "example.com:80"},
+		{"wss://example.com/p2p", "example.com:443"},
+	}
+	for _, tt := range tests {
+		if got := dialHost(tt.address); got != tt.want {
+			t.Errorf("dialHost(%q) = %q, want %q", tt.address, got, tt.want)
+		}
+	}
+}
+
+func TestTransport_WebSocket(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		var serverOpts, clientOpts []Option
+		if secure {
+			serverOpts = append(serverOpts, WithTLS(NewTLSConfig(testCertificate(t), nil)))
+			clientOpts = append(clientOpts, WithTLS(NewTLSConfig(testCertificate(t), nil)))
+		}
+
+		serverHandler := newTransferRecorder()
+		server, err := NewTransport("server", "127.0.0.1:0", serverHandler, append(serverOpts, WithWebSocket("127.0.0.1:0"))...)
+		if err != nil {
+			t.Fatalf("Failed to create transport: %v", err)
+		}
+		defer server.Stop()
+		server.Start()
+
+		client, err := NewTransport("client", "127.0.0.1:0", newTransferRecorder(), clientOpts...)
+		if err != nil {
+			t.Fatalf("Failed to create transport: %v", err)
+		}
+		defer client.Stop()
+
+		// The path defaults to WebSocketPath
+		if err := client.Connect(context.Background(), "ws://"+server.WebSocketAddress()); err != nil {
+			t.Fatalf("tls %v: Failed to connect: %v", secure, err)
+		}
+		select {
+		case msg := <-serverHandler.messages:
+			if msg.Type != protocol.MessageTypeHandshake {
+				t.Errorf("tls %v: message type = %s, want %s", secure, msg.Type, protocol.MessageTypeHandshake)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("tls %v: Timed out waiting for the handshake", secure)
+		}
+
+		// The bulk channel is opened over WebSocket as well
+		clientPeer := onlyPeer(t, client)
+		waitForBulk(t, clientPeer)
+		transfer := &protocol.DataTransfer{ContentHash: "abc123", Data: bytes.Repeat([]byte("chunk"), 1000), FinalChunk: true}
+		if err := clientPeer.SendTransfer("client", transfer); err != nil {
+			t.Fatalf("tls %v: Failed to send transfer: %v", secure, err)
+		}
+		select {
+		case got := <-serverHandler.transfers:
+			if !bytes.Equal(got.Data, transfer.Data) {
+				t.Errorf("tls %v: transfer data differs", secure)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("tls %v: Timed out waiting for transfer", secure)
+		}
+	}
+}
+
+func TestTransport_WebSocketFilter(t *testing.T) {
+	server, err := NewTransport("server", "127.0.0.1:0", &mockHandler{}, WithWebSocket("127.0.0.1:0"), WithConnFilter(func(address string) error {
+		return errors.New("banned")
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer server.Stop()
+	server.Start()
+
+	client, err := NewTransport("client", "127.0.0.1:0", &mockHandler{})
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer client.Stop()
+
+	if err := client.Connect(context.Background(), "ws://"+server.WebSocketAddress()+WebSocketPath); err == nil {
+		t.Error("Connect() to a filtering listener succeeded, want error")
+	}
+}
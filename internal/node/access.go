@@ -0,0 +1,145 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"p2p-storage/internal/crypto"
+)
+
+// ErrNotAllowed is returned for peers that are not on the allowlist
+var ErrNotAllowed = errors.New("peer is not on the allowlist")
+
+// accessList matches peers by identity key fingerprint, node ID, or by
+// address or CIDR block as bans do (see addressMatches). It is fixed when
+// the node starts, unlike the blocklist.
+type accessList struct {
+	keys  map[string]bool
+	ids   map[string]bool
+	addrs []string
+}
+
+// newAccessList sorts entries into fingerprints, node IDs and addresses,
+// see ParseBanTarget. Blank entries are skipped.
+func newAccessList(entries []string) *accessList {
+	l := &accessList{keys: make(map[string]bool), ids: make(map[string]bool)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		switch ParseBanTarget(entry) {
+		case BanAddress:
+			l.addrs = append(l.addrs, entry)
+		case BanIdentity:
+			l.keys[entry] = true
+		default:
+			l.ids[entry] = true
+		}
+	}
+	return l
+}
+
+func (l *accessList) empty() bool {
+	return l == nil || (len(l.keys) == 0 && len(l.ids) == 0 && len(l.addrs) == 0)
+}
+
+// namesPeers reports whether the list names peers by key or node ID, which
+// are only known from the handshake
+func (l *accessList) namesPeers() bool {
+	return l != nil && (len(l.keys) > 0 || len(l.ids) > 0)
+}
+
+// matchesKey reports whether the list names the fingerprint of key
+func (l *accessList) matchesKey(key []byte) bool {
+	return l != nil && key != nil && l.keys[crypto.Fingerprint(key)]
+}
+
+func (l *accessList) matchesID(id string) bool {
+	return l != nil && l.ids[id]
+}
+
+func (l *accessList) matchesAddress(addr string) bool {
+	if l == nil {
+		return false
+	}
+	for _, entry := range l.addrs {
+		if addressMatches(entry, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithAllowlist admits only peers whose identity key, node ID or address
+// matches one of entries. Entries are identity key fingerprints, node IDs,
+// IP addresses, host:port pairs or CIDR blocks. Peers choose their node
+// IDs, so a node ID admits only a peer without an identity key, and none
+// at all once the list names keys. Connections from addresses that match
+// no entry are refused before their handshake, unless the list names keys
+// or node IDs, which are only known from it.
+func WithAllowlist(entries ...string) Option {
+	return func(n *Node) {
+		n.allowlist = newAccessList(entries)
+	}
+}
+
+// WithDenylist refuses peers whose identity key, node ID or address matches
+// one of entries, like permanent bans that are not stored in the blocklist
+func WithDenylist(entries ...string) Option {
+	return func(n *Node) {
+		n.denylist = newAccessList(entries)
+	}
+}
+
+// filterConn is the transport's connection filter, for dialed and accepted
+// addresses
+func (n *Node) filterConn(addr string) error {
+	if err := n.checkAddress(addr); err != nil {
+		return err
+	}
+	return n.checkAccess(addr)
+}
+
+// checkAccess applies the allowlist and denylist to an address, before the
+// peer's node ID is known
+func (n *Node) checkAccess(addr string) error {
+	if n.denylist.matchesAddress(addr) {
+		return fmt.Errorf("%w: address %s is on the denylist", ErrBanned, addr)
+	}
+	if !n.allowlist.empty() && !n.allowlist.namesPeers() && !n.allowlist.matchesAddress(addr) {
+		return fmt.Errorf("%w: address %s", ErrNotAllowed, addr)
+	}
+	return nil
+}
+
+// checkAccessPeer applies the allowlist and denylist to a peer by the key
+// it presents in its handshake, which is nil for peers without one, and
+// which it must go on to prove. addr is
+// the address it connected from, not the one it advertises, which it could
+// make up.
+func (n *Node) checkAccessPeer(id string, key []byte, addr string) error {
+	if n.denylist.matchesKey(key) || n.denylist.matchesID(id) {
+		return fmt.Errorf("%w: %s is on the denylist", ErrBanned, id)
+	}
+	if err := n.checkAccess(addr); err != nil {
+		return err
+	}
+	if n.allowlist.empty() || n.allowlist.matchesAddress(addr) {
+		return nil
+	}
+	if key != nil {
+		if !n.allowlist.matchesKey(key) {
+			return fmt.Errorf("%w: %s (%s)", ErrNotAllowed, id, crypto.Fingerprint(key))
+		}
+		return nil
+	}
+	if len(n.allowlist.keys) > 0 {
+		return fmt.Errorf("%w: %s has no identity key", ErrNotAllowed, id)
+	}
+	if !n.allowlist.matchesID(id) {
+		return fmt.Errorf("%w: %s", ErrNotAllowed, id)
+	}
+	return nil
+}
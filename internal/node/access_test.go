@@ -0,0 +1,116 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+)
+
+func TestNode_CheckAccessPeer(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	other := bytes.Repeat([]byte{2}, 32)
+	fingerprint := crypto.Fingerprint(key)
+
+	tests := []struct {
+		name        string
+		allow, deny []string
+		id          string
+		key         []byte
+		addr        string
+		want        error
+	}{
+		{"no lists", nil, nil, "node1", nil, "10.0.0.1:5000", nil},
+		{"allowed by ID", []string{"node1"}, nil, "node1", nil, "10.0.0.1:5000", nil},
+		{"allowed by CIDR", []string{"10.0.0.0/8"}, nil, "node2", key, "10.0.0.1:5000", nil},
+		{"not allowed", []string{"node1", "192.168.0.0/16"}, nil, "node2", nil, "10.0.0.1:5000", ErrNotAllowed},
+		{"denied by ID", nil, []string{"node1"}, "node1", nil, "10.0.0.1:5000", ErrBanned},
+		{"denied by CIDR", []string{"node1"}, []string{"10.0.0.0/8"}, "node1", nil, "10.0.0.1:5000", ErrBanned},
+		{"allowed by key", []string{fingerprint}, nil, "node1", key, "10.0.0.1:5000", nil},
+		{"allowed key under any ID", []string{fingerprint}, nil, "renamed", key, "10.0.0.1:5000", nil},
+		{"other key", []string{fingerprint}, nil, "node1", other, "10.0.0.1:5000", ErrNotAllowed},
+		{"claimed ID with a key", []string{"node1"}, nil, "node1", other, "10.0.0.1:5000", ErrNotAllowed},
+		{"no key with keys listed", []string{fingerprint, "node1"}, nil, "node1", nil, "10.0.0.1:5000", ErrNotAllowed},
+		{"denied by key", nil, []string{fingerprint}, "renamed", key, "10.0.0.1:5000", ErrBanned},
+	}
+
+	for _, tt := range tests {
+		n := &Node{allowlist: newAccessList(tt.allow), denylist: newAccessList(tt.deny)}
+		if err := n.checkAccessPeer(tt.id, tt.key, tt.addr); !errors.Is(err, tt.want) {
+			t.Errorf("%s: checkAccessPeer() error = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+
+	// Without node IDs to go by, addresses are refused before the handshake
+	n := &Node{allowlist: newAccessList([]string{"192.168.0.0/16"})}
+	if err := n.checkAccess("10.0.0.1:5000"); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("checkAccess() error = %v, want %v", err, ErrNotAllowed)
+	}
+	n = &Node{allowlist: newAccessList([]string{"node1"})}
+	if err := n.checkAccess("10.0.0.1:5000"); err != nil {
+		t.Errorf("checkAccess() with an ID allowlist error = %v, want nil", err)
+	}
+}
+
+func TestNode_AllowlistRefusesHandshake(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true), WithAllowlist("third"))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+	events, cancel := second.Subscribe()
+	defer cancel()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	event := waitForEvent(t, events, EventPeerRejected, 5*time.Second)
+	if event.Error != "not_allowed" {
+		t.Errorf("Rejection code = %q, want %q", event.Error, "not_allowed")
+	}
+	if peers := first.Peers(); len(peers) != 0 {
+		t.Errorf("Peers() = %v, want none", peers)
+	}
+}
+
+func TestNode_AllowlistAdmitsProvenKey(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+	events, cancel := second.Subscribe()
+	defer cancel()
+
+	// The key admits the node whatever node ID it goes by
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true), WithAllowlist(second.Identity()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	waitForEvent(t, events, EventPeerConnected, 5*time.Second)
+}
@@ -0,0 +1,194 @@
+package node
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/storage"
+)
+
+// LogLevel controls how verbose the node's output is
+type LogLevel int32
+
+const (
+	// LogInfo prints progress and errors (the default)
+	LogInfo LogLevel = iota
+	// LogDebug also prints step-by-step detail of file handling
+	LogDebug
+)
+
+// staleTempAge is how long a temporary file must go unmodified before GC
+// treats it as left over from an interrupted operation
+const staleTempAge = time.Hour
+
+// ParseLogLevel validates a log level name
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch s {
+	case "info":
+		return LogInfo, nil
+	case "debug":
+		return LogDebug, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q (want info or debug)", s)
+}
+
+// String returns the name of the level
+func (l LogLevel) String() string {
+	if l == LogDebug {
+		return "debug"
+	}
+	return "info"
+}
+
+// MarshalText encodes the level by name
+func (l LogLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+// UnmarshalText decodes a level name
+func (l *LogLevel) UnmarshalText(text []byte) error {
+	level, err := ParseLogLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// SetLogLevel changes the log verbosity at runtime
+func (n *Node) SetLogLevel(level LogLevel) {
+	n.logLevel.Store(int32(level))
+}
+
+// LogLevel returns the current log verbosity
+func (n *Node) LogLevel() LogLevel {
+	return LogLevel(n.logLevel.Load())
+}
+
+// SetRateLimits changes the upload and download caps at runtime. Negative
+// rates are refused.
+func (n *Node) SetRateLimits(limits network.RateLimits) error {
+	if limits.Upload < 0 || limits.Download < 0 || limits.PeerUpload < 0 || limits.PeerDownload < 0 {
+		return fmt.Errorf("invalid rate limits %+v: rates can't be negative", limits)
+	}
+	n.transport.SetRateLimits(limits)
+	return nil
+}
+
+// RateLimits returns the current upload and download caps
+func (n *Node) RateLimits() network.RateLimits {
+	return n.transport.RateLimits()
+}
+
+// debugf prints only at LogDebug
+func (n *Node) debugf(format string, args ...interface{}) {
+	if n.LogLevel() >= LogDebug {
+		fmt.Printf("DEBUG: "+format, args...)
+	}
+}
+
+// ReloadResult reports what Reload read back from disk
+type ReloadResult struct {
+	Bans       int `json:"bans"`
+	Namespaces int `json:"namespaces"`
+}
+
+// Reload re-reads the blocklist and namespace policies from the data
+// directory, picking up edits made while the node runs. Peers banned by the
+// reloaded list are disconnected.
+func (n *Node) Reload() (ReloadResult, error) {
+	bans, err := n.blocklist.reload()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	namespaces, err := n.namespaces.reload()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	n.disconnectBanned()
+	return ReloadResult{Bans: bans, Namespaces: namespaces}, nil
+}
+
+// GCResult summarizes a GC run
+type GCResult struct {
+	TempFiles  int    `json:"temp_files"`
+	TempBytes  int64  `json:"temp_bytes"`
+	HeapBefore uint64 `json:"heap_before"`
+	HeapAfter  uint64 `json:"heap_after"`
+}
+
+// GC removes temporary files left in the store by interrupted transfers
+// and ingests, then runs the Go garbage collector and returns freed memory
+// to the operating system
+func (n *Node) GC() (GCResult, error) {
+	var result GCResult
+	files, size, err := n.store.CleanStaleTemp(staleTempAge)
+	if err != nil {
+		return result, fmt.Errorf("failed to clean temporary files: %w", err)
+	}
+	result.TempFiles, result.TempBytes = files, size
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	result.HeapBefore = mem.HeapAlloc
+	debug.FreeOSMemory()
+	runtime.ReadMemStats(&mem)
+	result.HeapAfter = mem.HeapAlloc
+	return result, nil
+}
+
+// StateDump is a snapshot of the node's internal state for debugging
+type StateDump struct {
+	ID           string             `json:"id"`
+	Address      string             `json:"address"`
+	Identity     string             `json:"identity"`
+	FirstNode    bool               `json:"first_node"`
+	PublicMirror bool               `json:"public_mirror"`
+	HasKey       bool               `json:"has_key"`
+	Draining     bool               `json:"draining"`
+	LogLevel     LogLevel           `json:"log_level"`
+	Peers        []PeerInfo         `json:"peers"`
+	Transfers    []TransferStats    `json:"transfers"`
+	Store        storage.Stats      `json:"store"`
+	Cache        storage.CacheStats `json:"cache"`
+	RelayCache   RelayCacheStats    `json:"relay_cache"`
+	Catalog      int                `json:"catalog_entries"`
+	Namespaces   []NamespaceInfo    `json:"namespaces"`
+	Bans         int                `json:"bans"`
+	Goroutines   int                `json:"goroutines"`
+	HeapAlloc    uint64             `json:"heap_alloc"`
+}
+
+// State collects a snapshot of the node's internal state
+func (n *Node) State() StateDump {
+	n.mu.RLock()
+	hasKey := n.networkKey != nil
+	n.mu.RUnlock()
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats, _ := n.store.Stats()
+	return StateDump{
+		ID:           n.ID,
+		Address:      n.Address(),
+		Identity:     n.Identity(),
+		FirstNode:    n.isFirstNode,
+		PublicMirror: n.publicMirror,
+		HasKey:       hasKey,
+		Draining:     n.Draining(),
+		LogLevel:     n.LogLevel(),
+		Peers:        n.Peers(),
+		Transfers:    n.Transfers(),
+		Store:        stats,
+		Cache:        n.store.CacheStats(),
+		RelayCache:   n.RelayCacheStats(),
+		Catalog:      len(n.catalog.all()),
+		Namespaces:   n.Namespaces(),
+		Bans:         len(n.Bans()),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+	}
+}
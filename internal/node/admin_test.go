@@ -0,0 +1,130 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+func TestNode_Reload(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	if _, err := node.Ban("old-peer", "", 0); err != nil {
+		t.Fatalf("Failed to ban: %v", err)
+	}
+
+	// Edit the files behind the node's back
+	writeTestFile(t, filepath.Join(node.dataDir, "blocklist.json"),
+		`[{"target": "bad-peer", "kind": "peer", "created": "2024-01-01T00:00:00Z"}, {"target": "10.0.0.1", "kind": "address", "created": "2024-01-01T00:00:00Z"}]`)
+	writeTestFile(t, filepath.Join(node.dataDir, "namespaces.json"), `[{"name": "public", "mode": "none"}]`)
+
+	result, err := node.Reload()
+	if err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if result.Bans != 2 || result.Namespaces != 1 {
+		t.Errorf("Reload() = %+v, want 2 bans and 1 namespace", result)
+	}
+	if _, banned := node.blocklist.peer(BanPeer, "bad-peer"); !banned {
+		t.Error("Reloaded ban not in force")
+	}
+	if _, banned := node.blocklist.peer(BanPeer, "old-peer"); banned {
+		t.Error("Ban removed from the file still in force")
+	}
+	if got := node.NamespaceMode("public"); got != EncryptNone {
+		t.Errorf("NamespaceMode(public) = %s, want %s", got, EncryptNone)
+	}
+
+	// A broken file leaves the current configuration in place
+	writeTestFile(t, filepath.Join(node.dataDir, "namespaces.json"), `{not json`)
+	if _, err := node.Reload(); err == nil {
+		t.Error("Expected error for an invalid file")
+	}
+	if got := node.NamespaceMode("public"); got != EncryptNone {
+		t.Errorf("NamespaceMode(public) after failed reload = %s, want %s", got, EncryptNone)
+	}
+}
+
+func TestNode_GCAndLogLevel(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true), WithLogLevel(LogDebug))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	if node.LogLevel() != LogDebug {
+		t.Errorf("LogLevel() = %v, want debug", node.LogLevel())
+	}
+	node.SetLogLevel(LogInfo)
+	if node.LogLevel() != LogInfo {
+		t.Errorf("LogLevel() after SetLogLevel = %v, want info", node.LogLevel())
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("Expected error for an unknown log level")
+	}
+
+	temp, err := node.store.CreateTemp()
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	temp.WriteString("left over")
+	temp.Close()
+	old := time.Now().Add(-2 * staleTempAge)
+	if err := os.Chtimes(temp.Name(), old, old); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+
+	result, err := node.GC()
+	if err != nil {
+		t.Fatalf("Failed to run GC: %v", err)
+	}
+	if result.TempFiles != 1 || result.TempBytes != int64(len("left over")) {
+		t.Errorf("GC() = %+v, want 1 temp file of %d bytes", result, len("left over"))
+	}
+
+	state := node.State()
+	if state.ID != "test-node" || !state.HasKey || state.LogLevel != LogInfo || state.Goroutines == 0 {
+		t.Errorf("State() = %+v, want test-node with a key at info level", state)
+	}
+}
+
+func TestNode_RateLimits(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	limits := network.RateLimits{Upload: 1 << 20, PeerDownload: 256 << 10}
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true), WithRateLimits(limits))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	if got := node.RateLimits(); got != limits {
+		t.Errorf("RateLimits() = %+v, want %+v", got, limits)
+	}
+	if err := node.SetRateLimits(network.RateLimits{Download: -1}); err == nil {
+		t.Error("Expected error for a negative rate")
+	}
+	if got := node.RateLimits(); got != limits {
+		t.Errorf("RateLimits() after a refused change = %+v, want %+v", got, limits)
+	}
+	if err := node.SetRateLimits(network.RateLimits{}); err != nil {
+		t.Fatalf("SetRateLimits() error = %v", err)
+	}
+	if got := node.RateLimits(); got != (network.RateLimits{}) {
+		t.Errorf("RateLimits() = %+v, want none", got)
+	}
+}
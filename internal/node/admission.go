@@ -0,0 +1,123 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// IngestOverflow decides what happens to a file offered for ingestion
+// while the queue is full
+type IngestOverflow string
+
+const (
+	// IngestBlock makes the caller wait until there is room (the default)
+	IngestBlock IngestOverflow = "block"
+	// IngestDrop refuses the file with ErrIngestQueueFull
+	IngestDrop IngestOverflow = "drop"
+)
+
+var (
+	// ErrFileTooLarge is returned for files over IngestConfig.MaxFileSize
+	ErrFileTooLarge = errors.New("file exceeds the maximum ingest size")
+	// ErrIngestQueueFull is returned under IngestDrop when the queue is full
+	ErrIngestQueueFull = errors.New("ingest queue is full")
+)
+
+// ParseIngestOverflow validates an overflow policy name
+func ParseIngestOverflow(s string) (IngestOverflow, error) {
+	switch p := IngestOverflow(s); p {
+	case IngestBlock, IngestDrop:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown ingest overflow policy %q (want block or drop)", s)
+}
+
+// IngestConfig limits how files from the watch directory, store and import
+// are encrypted, hashed and stored, so a huge file or directory can't
+// exhaust memory, descriptors or disk in one go
+type IngestConfig struct {
+	MaxFileSize int64          // larger files are refused; 0 means no limit
+	Workers     int            // files encrypted and hashed at once
+	QueueSize   int            // files waiting for a worker before Overflow applies
+	Overflow    IngestOverflow // what happens to files beyond the queue
+}
+
+// DefaultIngestConfig returns 4 workers with up to 256 files waiting, no
+// size limit, and callers blocked while the queue is full
+func DefaultIngestConfig() IngestConfig {
+	return IngestConfig{
+		Workers:   4,
+		QueueSize: 256,
+		Overflow:  IngestBlock,
+	}
+}
+
+// ingestQueue admits files for ingestion. Every admitted file holds a
+// token in admitted, whether running or waiting, and running ones also
+// hold one in running.
+type ingestQueue struct {
+	admitted chan struct{}
+	running  chan struct{}
+	overflow IngestOverflow
+	refused  atomic.Int64
+}
+
+func newIngestQueue(cfg IngestConfig) *ingestQueue {
+	workers, queue := max(cfg.Workers, 1), max(cfg.QueueSize, 0)
+	return &ingestQueue{
+		admitted: make(chan struct{}, workers+queue),
+		running:  make(chan struct{}, workers),
+		overflow: cfg.Overflow,
+	}
+}
+
+// acquire waits for a worker and returns the function that frees it
+func (q *ingestQueue) acquire(done <-chan struct{}) (func(), error) {
+	select {
+	case q.admitted <- struct{}{}:
+	default:
+		if q.overflow == IngestDrop {
+			q.refused.Add(1)
+			return nil, ErrIngestQueueFull
+		}
+		select {
+		case q.admitted <- struct{}{}:
+		case <-done:
+			return nil, fmt.Errorf("node stopped")
+		}
+	}
+
+	select {
+	case q.running <- struct{}{}:
+	case <-done:
+		<-q.admitted
+		return nil, fmt.Errorf("node stopped")
+	}
+	return func() {
+		<-q.running
+		<-q.admitted
+	}, nil
+}
+
+// counts returns the files being ingested and the files waiting
+func (q *ingestQueue) counts() (running, waiting int) {
+	running = len(q.running)
+	return running, max(len(q.admitted)-running, 0)
+}
+
+// admitIngest checks the file at path against the ingest limits and waits
+// for a worker. The returned function must be called once the file is
+// stored.
+func (n *Node) admitIngest(path string) (func(), error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if limit := n.ingestConfig.MaxFileSize; limit > 0 && info.Size() > limit {
+		n.ingests.refused.Add(1)
+		return nil, fmt.Errorf("%w of %d bytes (%d bytes)", ErrFileTooLarge, limit, info.Size())
+	}
+	return n.ingests.acquire(n.done)
+}
@@ -0,0 +1,92 @@
+package node
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIngestQueue(t *testing.T) {
+	done := make(chan struct{})
+	q := newIngestQueue(IngestConfig{Workers: 1, QueueSize: 1, Overflow: IngestDrop})
+
+	release, err := q.acquire(done)
+	if err != nil {
+		t.Fatalf("Failed to acquire worker: %v", err)
+	}
+
+	// The second file waits for the worker, the third finds the queue full
+	acquired := make(chan func())
+	go func() {
+		next, err := q.acquire(done)
+		if err != nil {
+			t.Errorf("Failed to acquire worker: %v", err)
+		}
+		acquired <- next
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if running, waiting := q.counts(); running == 1 && waiting == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Second file never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := q.acquire(done); !errors.Is(err, ErrIngestQueueFull) {
+		t.Errorf("acquire() on a full queue = %v, want %v", err, ErrIngestQueueFull)
+	}
+	if q.refused.Load() != 1 {
+		t.Errorf("Refused = %d, want 1", q.refused.Load())
+	}
+
+	release()
+	select {
+	case next := <-acquired:
+		next()
+	case <-time.After(time.Second):
+		t.Fatalf("Waiting file never got the worker")
+	}
+	if running, waiting := q.counts(); running != 0 || waiting != 0 {
+		t.Errorf("counts() = %d, %d, want 0, 0", running, waiting)
+	}
+
+	// Blocking callers give up when the node stops
+	blocking := newIngestQueue(IngestConfig{Workers: 1, Overflow: IngestBlock})
+	if _, err := blocking.acquire(done); err != nil {
+		t.Fatalf("Failed to acquire worker: %v", err)
+	}
+	close(done)
+	if _, err := blocking.acquire(done); err == nil {
+		t.Error("acquire() after stop = nil, want error")
+	}
+}
+
+func TestNode_IngestMaxFileSize(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	n, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+		WithFirstNode(true), WithIngestLimits(IngestConfig{MaxFileSize: 10, Workers: 1}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer n.Stop()
+
+	small := filepath.Join(baseDir, "small.txt")
+	writeTestFile(t, small, "fits")
+	if _, err := n.StoreFile(small); err != nil {
+		t.Errorf("StoreFile() of a small file = %v, want nil", err)
+	}
+
+	large := filepath.Join(baseDir, "large.txt")
+	writeTestFile(t, large, "well over ten bytes")
+	if _, err := n.StoreFile(large); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("StoreFile() of a large file = %v, want %v", err, ErrFileTooLarge)
+	}
+	if running, waiting := n.ingests.counts(); running != 0 || waiting != 0 {
+		t.Errorf("counts() = %d, %d, want 0, 0", running, waiting)
+	}
+}
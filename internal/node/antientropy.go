@@ -0,0 +1,266 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// AntiEntropyConfig schedules anti-entropy. Announcements of files added
+// while a peer was offline never reach it, so every interval the node sends
+// its peers a summary of the objects it stores; a peer whose own summary
+// differs lists the objects from the node and pulls those it lacks.
+type AntiEntropyConfig struct {
+	// Interval between summaries sent to peers; zero disables anti-entropy
+	Interval time.Duration
+	// MaxPulls is how many missing objects are pulled from a peer for each
+	// summary it sends; the rest follow with later ones
+	MaxPulls int
+}
+
+// DefaultAntiEntropyConfig returns summaries every 5 minutes, pulling at
+// most 100 objects each
+func DefaultAntiEntropyConfig() AntiEntropyConfig {
+	return AntiEntropyConfig{
+		Interval: 5 * time.Minute,
+		MaxPulls: 100,
+	}
+}
+
+func (c AntiEntropyConfig) enabled() bool {
+	return c.Interval > 0
+}
+
+// WithAntiEntropy sets how often the node sends peers summaries of what it
+// stores, so they pull objects whose announcements they missed
+func WithAntiEntropy(cfg AntiEntropyConfig) Option {
+	return func(n *Node) {
+		n.antiEntropyConfig = cfg
+	}
+}
+
+// antiEntropy keeps a peer's summaries from being acted on while an earlier
+// one still is
+type antiEntropy struct {
+	mu      sync.Mutex
+	syncing map[string]bool // by node ID
+}
+
+func newAntiEntropy() *antiEntropy {
+	return &antiEntropy{syncing: make(map[string]bool)}
+}
+
+func (a *antiEntropy) begin(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.syncing[id] {
+		return false
+	}
+	a.syncing[id] = true
+	return true
+}
+
+func (a *antiEntropy) end(id string) {
+	a.mu.Lock()
+	delete(a.syncing, id)
+	a.mu.Unlock()
+}
+
+// syncBuckets groups hashes by first character and sums up each group, in
+// order of prefix
+func syncBuckets(hashes []string) []protocol.SyncBucket {
+	sorted := append([]string(nil), hashes...)
+	sort.Strings(sorted)
+
+	var buckets []protocol.SyncBucket
+	digest := sha256.New()
+	count := 0
+	for i, hash := range sorted {
+		digest.Write([]byte(hash + "\n"))
+		count++
+		if i+1 < len(sorted) && sorted[i+1][:1] == hash[:1] {
+			continue
+		}
+		buckets = append(buckets, protocol.SyncBucket{Prefix: hash[:1], Count: count, Digest: digest.Sum(nil)})
+		digest.Reset()
+		count = 0
+	}
+	return buckets
+}
+
+func (n *Node) antiEntropyLoop() {
+	ticker := time.NewTicker(n.antiEntropyConfig.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			if err := n.sendSyncSummary(); err != nil {
+				fmt.Printf("Failed to send sync summary: %v\n", err)
+			}
+		}
+	}
+}
+
+// sendSyncSummary sends a summary of the local store to every connected
+// peer that takes part in anti-entropy
+func (n *Node) sendSyncSummary() error {
+	hashes, err := n.store.Hashes()
+	if err != nil {
+		return fmt.Errorf("failed to list store: %w", err)
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeSyncSummary, n.ID, protocol.SyncSummary{Buckets: syncBuckets(hashes)})
+	if err != nil {
+		return err
+	}
+	for _, id := range n.connectedPeers() {
+		peer, ok := n.peerConn(id)
+		if !ok || !n.peerSupports(id, protocol.FeatureSync) {
+			continue
+		}
+		if err := peer.Send(msg); err != nil {
+			n.debugf("Failed to send sync summary to %s: %v\n", id, err)
+		}
+	}
+	return nil
+}
+
+// handleSyncSummary pulls the objects a peer's summary shows it holds and
+// this node lacks. The listing needed to find them is answered on the
+// connection the summary came in on, so it is fetched in the background.
+func (n *Node) handleSyncSummary(peer *network.Peer, msg *protocol.Message) error {
+	var summary protocol.SyncSummary
+	if err := msg.ParsePayload(&summary); err != nil {
+		return fmt.Errorf("failed to parse sync summary: %w", err)
+	}
+	id := n.nodeID(peer)
+	if !n.antiEntropyConfig.enabled() || id == "" || n.Draining() || n.scores.derated(peer.ID()) {
+		return nil
+	}
+	if !n.antiEntropy.begin(id) {
+		return nil
+	}
+	go func() {
+		defer n.antiEntropy.end(id)
+		if err := n.syncWith(id, summary); err != nil {
+			fmt.Printf("Failed to sync with %s: %v\n", id, err)
+		}
+	}()
+	return nil
+}
+
+// syncWith lists the groups of a peer's summary that differ from the local
+// store and asks the peer for the objects missing here, at most MaxPulls
+// of them
+func (n *Node) syncWith(id string, summary protocol.SyncSummary) error {
+	hashes, err := n.store.Hashes()
+	if err != nil {
+		return fmt.Errorf("failed to list store: %w", err)
+	}
+	local := make(map[string][]byte)
+	for _, b := range syncBuckets(hashes) {
+		local[b.Prefix] = b.Digest
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultFetchTimeout)
+	defer cancel()
+	var missing []string
+	for _, b := range summary.Buckets {
+		if len(missing) >= n.antiEntropyConfig.MaxPulls {
+			break
+		}
+		if bytes.Equal(local[b.Prefix], b.Digest) {
+			continue
+		}
+		listed, err := n.listBucket(ctx, id, b.Prefix)
+		if err != nil {
+			return err
+		}
+		for _, hash := range listed {
+			if len(missing) < n.antiEntropyConfig.MaxPulls && n.syncWanted(hash) {
+				missing = append(missing, hash)
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	peer, ok := n.peerConn(id)
+	if !ok {
+		return fmt.Errorf("peer %s is not connected", id)
+	}
+	fmt.Printf("Pulling %d objects missing here from %s\n", len(missing), id)
+	for _, hash := range missing {
+		if err := n.requestObject(peer, hash, true, n.traceID(nil)); err != nil {
+			return fmt.Errorf("failed to request %s: %w", hash, err)
+		}
+	}
+	return nil
+}
+
+// listBucket returns the hashes a peer stores that start with prefix
+func (n *Node) listBucket(ctx context.Context, id, prefix string) ([]string, error) {
+	var hashes []string
+	// Every hash in the group sorts after the prefix itself
+	after := prefix
+	for {
+		page, next, err := n.ListPeer(ctx, id, after, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range page {
+			if !strings.HasPrefix(hash, prefix) {
+				return hashes, nil
+			}
+			hashes = append(hashes, hash)
+		}
+		if next == "" {
+			return hashes, nil
+		}
+		if next <= after {
+			return nil, fmt.Errorf("peer %s listed page after %q out of order", id, after)
+		}
+		after = next
+	}
+}
+
+// syncWanted reports whether an object a peer holds should be pulled: it is
+// neither stored, on its way nor deleted, and the local policy takes what
+// is known of it. A public mirror only pulls objects known to be plaintext.
+func (n *Node) syncWanted(hash string) bool {
+	if n.store.Exists(hash) || n.downloading(hash) || n.deleted(hash) {
+		return false
+	}
+	meta, known := n.catalog.get(hash)
+	if known && n.checkObjectSize(meta.Size) != nil {
+		return false
+	}
+	if n.publicMirror && (!known || meta.Encryption != EncryptNone) {
+		return false
+	}
+	return true
+}
+
+// downloading reports whether an object is being received from any peer
+func (n *Node) downloading(hash string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	for _, state := range n.transfers {
+		if state.hash == hash {
+			return true
+		}
+	}
+	return false
+}
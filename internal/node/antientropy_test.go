@@ -0,0 +1,72 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+)
+
+func TestSyncBuckets(t *testing.T) {
+	buckets := syncBuckets([]string{"c3", "ab", "a1"})
+	if len(buckets) != 2 || buckets[0].Prefix != "a" || buckets[0].Count != 2 || buckets[1].Prefix != "c" || buckets[1].Count != 1 {
+		t.Fatalf("syncBuckets() = %+v, want a with 2 hashes and c with 1", buckets)
+	}
+	if same := syncBuckets([]string{"a1", "ab", "c3"}); !bytes.Equal(same[0].Digest, buckets[0].Digest) {
+		t.Error("Digest depends on the order hashes are listed in")
+	}
+	if other := syncBuckets([]string{"a1", "a2", "c3"}); bytes.Equal(other[0].Digest, buckets[0].Digest) {
+		t.Error("Digest unchanged for other hashes")
+	}
+	if !bytes.Equal(syncBuckets([]string{"a1", "a2", "c4"})[0].Digest, syncBuckets([]string{"a1", "a2"})[0].Digest) {
+		t.Error("Digest of a group depends on other groups")
+	}
+}
+
+func TestNode_AntiEntropyPullsMissedObjects(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	antiEntropy := WithAntiEntropy(AntiEntropyConfig{Interval: 100 * time.Millisecond, MaxPulls: 10})
+	holder, err := NewNode("holder", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true), antiEntropy)
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer holder.Stop()
+	if err := holder.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+
+	// Stored without an announcement, as if the peer had been offline
+	data := []byte(strings.Repeat("missed while offline ", 100))
+	hash, err := crypto.ContentHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to hash object: %v", err)
+	}
+	if err := holder.store.Store(hash, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to store object: %v", err)
+	}
+
+	lagger, err := NewNode("lagger", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false), antiEntropy)
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer lagger.Stop()
+	events, unsubscribe := lagger.Subscribe()
+	defer unsubscribe()
+	if err := lagger.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	if err := lagger.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	waitForEvent(t, events, EventFileStored, 5*time.Second)
+	if !lagger.store.Exists(hash) {
+		t.Fatal("Object missed while offline not pulled")
+	}
+}
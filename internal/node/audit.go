@@ -0,0 +1,322 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	mathrand "math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"p2p-storage/internal/metrics"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// auditTimeout is how long a holder has to answer an audit challenge
+const auditTimeout = 10 * time.Second
+
+// AuditConfig schedules storage audits, in which holders of replicas prove
+// they still have the data by hashing a random byte range of it
+type AuditConfig struct {
+	// Interval between audit runs; zero disables scheduled audits
+	Interval time.Duration
+	// Sample is the number of holder and object pairs challenged per run
+	Sample int
+	// RangeSize is the number of bytes a holder hashes per challenge
+	RangeSize int64
+}
+
+// DefaultAuditConfig returns a disabled schedule that, once given an
+// interval, challenges 8 holders per run over 64 KiB ranges
+func DefaultAuditConfig() AuditConfig {
+	return AuditConfig{
+		Interval:  0,
+		Sample:    8,
+		RangeSize: 64 << 10,
+	}
+}
+
+// AuditResult is the outcome of challenging one holder for one object
+type AuditResult struct {
+	Hash   string    `json:"hash"`
+	PeerID string    `json:"peer_id"`
+	Passed bool      `json:"passed"`
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// auditor tracks outstanding challenges and audit counters
+type auditor struct {
+	mu      sync.Mutex
+	pending map[string]chan protocol.AuditProof
+	passed  metrics.Counter
+	failed  metrics.Counter
+	lastRun atomic.Int64 // unix seconds
+}
+
+func newAuditor() *auditor {
+	return &auditor{pending: make(map[string]chan protocol.AuditProof)}
+}
+
+// Audit challenges the peers holding an object, or a random sample of
+// holders of locally stored objects if hash is empty. Only objects this
+// node holds can be audited, since it checks answers against its own copy.
+// Holders that fail are no longer counted as replicas until they pass.
+func (n *Node) Audit(hash string) ([]AuditResult, error) {
+	claims := n.replicas.claims()
+
+	type pair struct{ hash, peer string }
+	var pairs []pair
+	if hash != "" {
+		if !n.store.Exists(hash) {
+			return nil, fmt.Errorf("%s is not stored locally", hash)
+		}
+		for _, id := range claims[hash] {
+			pairs = append(pairs, pair{hash, id})
+		}
+	} else {
+		for h, ids := range claims {
+			if !n.store.Exists(h) {
+				continue
+			}
+			for _, id := range ids {
+				pairs = append(pairs, pair{h, id})
+			}
+		}
+		mathrand.Shuffle(len(pairs), func(i, j int) { pairs[i], pairs[j] = pairs[j], pairs[i] })
+		if n.auditConfig.Sample > 0 && len(pairs) > n.auditConfig.Sample {
+			pairs = pairs[:n.auditConfig.Sample]
+		}
+	}
+
+	results := make([]AuditResult, 0, len(pairs))
+	for _, p := range pairs {
+		peer, ok := n.peerConn(p.peer)
+		if !ok {
+			// Inventories expire on their own; there is no one to ask
+			continue
+		}
+		results = append(results, n.auditPeer(peer, p.peer, p.hash))
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Hash != results[j].Hash {
+			return results[i].Hash < results[j].Hash
+		}
+		return results[i].PeerID < results[j].PeerID
+	})
+	n.audits.lastRun.Store(time.Now().Unix())
+	return results, nil
+}
+
+// auditPeer challenges one holder and records the outcome
+func (n *Node) auditPeer(peer *network.Peer, peerID, hash string) AuditResult {
+	result := AuditResult{Hash: hash, PeerID: peerID, Time: time.Now()}
+	if err := n.challenge(peer, hash); err != nil {
+		result.Error = err.Error()
+		n.audits.failed.Inc()
+		n.replicas.dispute(peerID, hash, true)
+		fmt.Printf("Peer %s failed the audit of %s: %v\n", peerID, hash, err)
+		n.emit(Event{Type: EventAuditFailed, PeerID: peerID, ContentHash: hash, Error: result.Error})
+		return result
+	}
+	result.Passed = true
+	n.audits.passed.Inc()
+	n.replicas.dispute(peerID, hash, false)
+	return result
+}
+
+// challenge asks a peer for the digest of a random range of hash and checks
+// it against the local copy
+func (n *Node) challenge(peer *network.Peer, hash string) error {
+	size, err := n.store.Size(hash)
+	if err != nil {
+		return fmt.Errorf("failed to read local copy: %w", err)
+	}
+	length := n.auditConfig.RangeSize
+	if length <= 0 || length > size {
+		length = size
+	}
+	offset, err := randomOffset(size - length)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 16)
+	id := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+
+	challenge := protocol.AuditChallenge{
+		ID:          hex.EncodeToString(id),
+		ContentHash: hash,
+		Nonce:       nonce,
+		Offset:      offset,
+		Length:      length,
+	}
+	expected, err := n.auditDigest(challenge)
+	if err != nil {
+		return fmt.Errorf("failed to read local copy: %w", err)
+	}
+
+	answer := make(chan protocol.AuditProof, 1)
+	n.audits.mu.Lock()
+	n.audits.pending[challenge.ID] = answer
+	n.audits.mu.Unlock()
+	defer func() {
+		n.audits.mu.Lock()
+		delete(n.audits.pending, challenge.ID)
+		n.audits.mu.Unlock()
+	}()
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeAudit, n.ID, challenge)
+	if err != nil {
+		return err
+	}
+	if err := peer.Send(msg); err != nil {
+		return fmt.Errorf("failed to send challenge: %w", err)
+	}
+
+	timer := time.NewTimer(auditTimeout)
+	defer timer.Stop()
+	select {
+	case proof := <-answer:
+		if proof.Error != "" {
+			return fmt.Errorf("holder could not answer: %s", proof.Error)
+		}
+		if !bytes.Equal(proof.Digest, expected) {
+			return fmt.Errorf("wrong digest for bytes %d-%d", offset, offset+length)
+		}
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("no answer within %v", auditTimeout)
+	case <-n.done:
+		return fmt.Errorf("node stopped")
+	}
+}
+
+// randomOffset returns a uniformly random offset in [0, limit]
+func randomOffset(limit int64) (int64, error) {
+	if limit <= 0 {
+		return 0, nil
+	}
+	v, err := rand.Int(rand.Reader, big.NewInt(limit+1))
+	if err != nil {
+		return 0, err
+	}
+	return v.Int64(), nil
+}
+
+// auditDigest hashes the nonce followed by the challenged range of the
+// locally stored object
+func (n *Node) auditDigest(c protocol.AuditChallenge) ([]byte, error) {
+	reader, err := n.store.Load(c.ContentHash)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if _, err := io.CopyN(io.Discard, reader, c.Offset); err != nil {
+		return nil, fmt.Errorf("range starts past the end of the object")
+	}
+	h := sha256.New()
+	h.Write(c.Nonce)
+	if _, err := io.CopyN(h, reader, c.Length); err != nil {
+		return nil, fmt.Errorf("range ends past the end of the object")
+	}
+	return h.Sum(nil), nil
+}
+
+// handleAudit answers a challenge for an object this node claims to hold
+func (n *Node) handleAudit(peer *network.Peer, msg *protocol.Message) error {
+	var challenge protocol.AuditChallenge
+	if err := msg.ParsePayload(&challenge); err != nil {
+		return fmt.Errorf("failed to parse audit challenge: %w", err)
+	}
+
+	proof := protocol.AuditProof{ID: challenge.ID}
+	if challenge.Offset < 0 || challenge.Length < 0 {
+		proof.Error = "invalid range"
+	} else if digest, err := n.auditDigest(challenge); err != nil {
+		proof.Error = err.Error()
+	} else {
+		proof.Digest = digest
+	}
+
+	reply, err := protocol.NewMessage(protocol.MessageTypeAuditProof, n.ID, proof)
+	if err != nil {
+		return err
+	}
+	return peer.Send(reply)
+}
+
+// handleAuditProof hands an answer to the challenge waiting for it
+func (n *Node) handleAuditProof(peer *network.Peer, msg *protocol.Message) error {
+	var proof protocol.AuditProof
+	if err := msg.ParsePayload(&proof); err != nil {
+		return fmt.Errorf("failed to parse audit proof: %w", err)
+	}
+
+	n.audits.mu.Lock()
+	answer, ok := n.audits.pending[proof.ID]
+	n.audits.mu.Unlock()
+	if ok {
+		select {
+		case answer <- proof:
+		default:
+		}
+	}
+	return nil
+}
+
+func (n *Node) auditLoop() {
+	ticker := time.NewTicker(n.auditConfig.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			results, err := n.Audit("")
+			if err != nil {
+				fmt.Printf("Scheduled audit failed: %v\n", err)
+				continue
+			}
+			failed := 0
+			for _, r := range results {
+				if !r.Passed {
+					failed++
+				}
+			}
+			fmt.Printf("Audit challenged %d holders (%d failed)\n", len(results), failed)
+			if failed > 0 {
+				if _, err := n.checkReplication(); err != nil {
+					fmt.Printf("Replication check failed: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+// registerAuditMetrics exposes storage audit counters
+func (n *Node) registerAuditMetrics() {
+	n.metrics.Register("p2p_audits_total", "Storage audit challenges by result", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{
+			{Labels: map[string]string{"result": "passed"}, Value: float64(n.audits.passed.Value())},
+			{Labels: map[string]string{"result": "failed"}, Value: float64(n.audits.failed.Value())},
+		}
+	})
+	n.metrics.Register("p2p_audit_last_run_timestamp_seconds", "Unix time of the last completed audit", metrics.KindGauge, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.audits.lastRun.Load())}}
+	})
+}
@@ -0,0 +1,101 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplicaTracker_Dispute(t *testing.T) {
+	tracker := newReplicaTracker(0)
+	tracker.update("peer", []string{"abc"})
+
+	tracker.dispute("peer", "abc", true)
+	if tracker.holds("peer", "abc") || len(tracker.holders()["abc"]) != 0 {
+		t.Error("Disputed copy is still counted as a replica")
+	}
+	if claims := tracker.claims()["abc"]; len(claims) != 1 {
+		t.Errorf("claims() = %v, want the disputed peer", claims)
+	}
+
+	// A full inventory repeating the claim does not lift the dispute
+	tracker.update("peer", []string{"abc"})
+	if tracker.holds("peer", "abc") {
+		t.Error("Full inventory lifted the dispute")
+	}
+
+	tracker.dispute("peer", "abc", false)
+	if !tracker.holds("peer", "abc") {
+		t.Error("Passing an audit did not lift the dispute")
+	}
+}
+
+func TestNode_AuditHolders(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	cfg := ReplicationConfig{Target: 2, Interval: time.Hour}
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true), WithReplication(cfg), WithAudits(AuditConfig{Sample: 4, RangeSize: 16}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "prove you still have this")
+	hash, err := first.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	if result, err := first.Repair([]string{hash}, nil); err != nil || result.Repaired != 1 {
+		t.Fatalf("Failed to replicate: %+v, %v", result, err)
+	}
+
+	results, err := first.Audit(hash)
+	if err != nil {
+		t.Fatalf("Failed to audit: %v", err)
+	}
+	if len(results) != 1 || !results[0].Passed || results[0].PeerID != "second" {
+		t.Fatalf("Audit() = %+v, want second to pass", results)
+	}
+
+	// The holder silently loses its copy but still lists it
+	if err := second.store.Delete(hash); err != nil {
+		t.Fatalf("Failed to delete object: %v", err)
+	}
+	events, unsubscribe := first.Subscribe()
+	defer unsubscribe()
+
+	results, err = first.Audit("")
+	if err != nil {
+		t.Fatalf("Failed to audit: %v", err)
+	}
+	if len(results) != 1 || results[0].Passed || results[0].Error == "" {
+		t.Fatalf("Audit() = %+v, want second to fail", results)
+	}
+	event := waitForEvent(t, events, EventAuditFailed, time.Second)
+	if event.PeerID != "second" || event.ContentHash != hash {
+		t.Errorf("event = %+v, want audit failure of second for %s", event, hash)
+	}
+	if status := first.Replicas(hash); status.Replicas != 1 {
+		t.Errorf("Replicas = %d after failed audit, want 1", status.Replicas)
+	}
+}
@@ -0,0 +1,192 @@
+package node
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// BatchConfig controls how announcements of objects stored in quick
+// succession, such as files dropped into the watch directory together or a
+// bulk import, are coalesced. An announcement waits up to Window for others
+// to join it, and those gathered are sent as one batch to peers that take
+// batches and one by one to those that don't.
+type BatchConfig struct {
+	Window  time.Duration // how long an announcement waits for others; 0 sends each at once
+	MaxSize int           // announcements in one batch, at most protocol.MaxAnnouncements
+}
+
+// DefaultBatchConfig returns a config that gathers announcements for 100ms,
+// up to 256 at a time
+func DefaultBatchConfig() BatchConfig {
+	return BatchConfig{
+		Window:  100 * time.Millisecond,
+		MaxSize: 256,
+	}
+}
+
+// WithBatching sets how announcements are coalesced
+func WithBatching(cfg BatchConfig) Option {
+	return func(n *Node) {
+		n.batchConfig = cfg
+	}
+}
+
+// announceQueue holds announcements waiting for their batch to be sent
+type announceQueue struct {
+	mu      sync.Mutex
+	pending []protocol.DataPayload
+	timer   *time.Timer
+}
+
+// take removes and returns the pending announcements
+func (q *announceQueue) take() []protocol.DataPayload {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.timer != nil {
+		q.timer.Stop()
+		q.timer = nil
+	}
+	pending := q.pending
+	q.pending = nil
+	return pending
+}
+
+// queueAnnouncement announces an object stored here with the next batch,
+// which is sent once the window has passed or it is full
+func (n *Node) queueAnnouncement(payload protocol.DataPayload) {
+	size := min(n.batchConfig.MaxSize, protocol.MaxAnnouncements)
+	if n.batchConfig.Window <= 0 || size <= 1 {
+		n.sendAnnouncements([]protocol.DataPayload{payload})
+		return
+	}
+
+	q := &n.announcements
+	q.mu.Lock()
+	q.pending = append(q.pending, payload)
+	full := len(q.pending) >= size
+	if !full && q.timer == nil {
+		q.timer = time.AfterFunc(n.batchConfig.Window, n.flushAnnouncements)
+	}
+	q.mu.Unlock()
+	if full {
+		n.flushAnnouncements()
+	}
+}
+
+// flushAnnouncements sends the pending announcements at once
+func (n *Node) flushAnnouncements() {
+	if pending := n.announcements.take(); len(pending) > 0 {
+		n.sendAnnouncements(pending)
+	}
+}
+
+// sendAnnouncements spreads announcements: a single one in a data message,
+// several in a batch to the peers that take batches and in data messages
+// of their own to the others. The data messages of a gossiped batch have
+// the IDs its announcements are passed on under, so nodes reached both ways
+// handle each once.
+func (n *Node) sendAnnouncements(payloads []protocol.DataPayload) {
+	if len(payloads) == 1 {
+		msg, err := protocol.NewMessage(protocol.MessageTypeData, n.ID, payloads[0])
+		if err != nil {
+			return
+		}
+		msg.TraceID = n.traceID(nil)
+		if err := n.spread("announcement of "+payloads[0].ContentHash, msg); err != nil {
+			fmt.Printf("Failed to announce %s: %v\n", payloads[0].ContentHash, err)
+		}
+		return
+	}
+
+	batch, err := protocol.NewMessage(protocol.MessageTypeDataBatch, n.ID, protocol.AnnouncementBatch{Announcements: payloads})
+	if err != nil {
+		return
+	}
+	batch.TraceID = n.traceID(nil)
+	if n.gossipConfig.TTL > 1 {
+		id, err := protocol.NewMessageID()
+		if err != nil {
+			return
+		}
+		batch.ID, batch.TTL = id, n.gossipConfig.TTL
+		n.gossip.seen.add(id)
+	}
+	n.sign(batch)
+	singles, err := n.unbatched(batch, payloads)
+	if err != nil {
+		fmt.Printf("Failed to announce %d objects: %v\n", len(payloads), err)
+		return
+	}
+	for _, msg := range singles {
+		if msg.ID != "" {
+			n.gossip.seen.add(msg.ID)
+		}
+		n.sign(msg)
+	}
+
+	for _, id := range n.connectedPeers() {
+		peer, ok := n.peerConn(id)
+		if !ok {
+			continue
+		}
+		if n.peerSupports(id, protocol.FeatureBatch) {
+			if err := peer.Send(batch); err != nil {
+				fmt.Printf("Failed to send %d announcements to %s: %v\n", len(payloads), id, err)
+			}
+			continue
+		}
+		for _, msg := range singles {
+			if err := peer.Send(msg); err != nil {
+				fmt.Printf("Failed to send announcement to %s: %v\n", id, err)
+				break
+			}
+		}
+	}
+}
+
+// unbatched returns the data messages a batch's announcements are handled
+// as, each under the ID derived from the batch's, if it has one
+func (n *Node) unbatched(batch *protocol.Message, payloads []protocol.DataPayload) ([]*protocol.Message, error) {
+	msgs := make([]*protocol.Message, len(payloads))
+	for i, payload := range payloads {
+		msg, err := protocol.NewMessage(protocol.MessageTypeData, batch.SenderID, payload)
+		if err != nil {
+			return nil, err
+		}
+		msg.TraceID, msg.TTL = batch.TraceID, batch.TTL
+		if batch.ID != "" {
+			msg.ID = batch.ID + "/" + strconv.Itoa(i)
+		}
+		msgs[i] = msg
+	}
+	return msgs, nil
+}
+
+// handleDataBatch handles each announcement of a batch as if it had come in
+// a data message of its own. Those already heard of under their own ID are
+// skipped.
+func (n *Node) handleDataBatch(peer *network.Peer, msg *protocol.Message) error {
+	var batch protocol.AnnouncementBatch
+	if err := msg.ParsePayload(&batch); err != nil {
+		return fmt.Errorf("failed to parse announcement batch: %w", err)
+	}
+	msgs, err := n.unbatched(msg, batch.Announcements)
+	if err != nil {
+		return err
+	}
+	for _, single := range msgs {
+		if single.ID != "" && !n.gossip.seen.add(single.ID) {
+			continue
+		}
+		if err := n.handleData(peer, single); err != nil {
+			n.debugf("Failed to handle announcement from %s: %v\n", peer.ID(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+func TestNode_AnnouncementBatch(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	newTestNode := func(id string, first bool) *Node {
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"),
+			WithFirstNode(first), WithReplication(ReplicationConfig{Target: 1, Interval: time.Hour}),
+			WithBatching(BatchConfig{Window: 200 * time.Millisecond, MaxSize: 16}))
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		n.transport.Start()
+		return n
+	}
+	sender := newTestNode("sender", true)
+	defer sender.Stop()
+	receiver := newTestNode("receiver", false)
+	defer receiver.Stop()
+
+	if err := receiver.Connect(context.Background(), sender.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := receiver.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	var mu sync.Mutex
+	sent := make(map[protocol.MessageType]int)
+	sender.SetTap(func(e network.TapEvent) {
+		if e.Sent {
+			mu.Lock()
+			sent[e.Type]++
+			mu.Unlock()
+		}
+	})
+
+	// 20 objects at a batch size of 16 make a full batch sent at once and
+	// one sent when the window has passed
+	var hashes []string
+	for i := 0; i < 20; i++ {
+		data := []byte(fmt.Sprintf("object %d", i))
+		hash, err := crypto.ContentHash(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to hash object: %v", err)
+		}
+		if err := sender.store.Store(hash, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Failed to store object: %v", err)
+		}
+		meta := FileMeta{Hash: hash, Name: fmt.Sprintf("file%d.txt", i), Size: int64(len(data))}
+		if err := sender.catalog.add(meta); err != nil {
+			t.Fatalf("Failed to catalog object: %v", err)
+		}
+		sender.announce(meta)
+		hashes = append(hashes, hash)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for _, hash := range hashes {
+		for !receiver.store.Exists(hash) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Receiver never fetched %s", hash)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sent[protocol.MessageTypeDataBatch] != 2 || sent[protocol.MessageTypeData] != 0 {
+		t.Errorf("Sent %d batches and %d single announcements, want 2 and none", sent[protocol.MessageTypeDataBatch], sent[protocol.MessageTypeData])
+	}
+}
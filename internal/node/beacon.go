@@ -0,0 +1,139 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+// BeaconConfig sets up LAN discovery by UDP broadcast, for networks where
+// multicast is blocked. The zero config sends and listens for no beacons.
+type BeaconConfig struct {
+	// Port is the UDP port beacons are broadcast to and listened for on;
+	// 0 turns beacons off
+	Port int
+	// Interval between beacons sent
+	Interval time.Duration
+	// Broadcast is the address beacons are sent to, by default the
+	// limited broadcast address at Port
+	Broadcast string
+}
+
+// DefaultBeaconConfig returns beacons every 10s on network.DefaultBeaconPort
+func DefaultBeaconConfig() BeaconConfig {
+	return BeaconConfig{Port: network.DefaultBeaconPort, Interval: 10 * time.Second}
+}
+
+func (c BeaconConfig) enabled() bool {
+	return c.Port > 0
+}
+
+// WithLANBeacon has the node broadcast a beacon with its listen port and
+// network ID on the LAN, and dial the nodes of its network whose beacons it
+// hears like peers learned through discovery
+func WithLANBeacon(cfg BeaconConfig) Option {
+	return func(n *Node) {
+		n.beaconConfig = cfg
+	}
+}
+
+// beaconLoop sends beacons and handles those received until the node stops
+func (n *Node) beaconLoop() {
+	conn, err := network.ListenBeacons(n.beaconConfig.Port)
+	if err != nil {
+		fmt.Printf("Failed to start LAN beacons: %v\n", err)
+		return
+	}
+	go func() {
+		<-n.done
+		conn.Close()
+	}()
+	go n.receiveBeacons(conn)
+
+	broadcast := n.beaconConfig.Broadcast
+	if broadcast == "" {
+		broadcast = net.JoinHostPort(net.IPv4bcast.String(), strconv.Itoa(n.beaconConfig.Port))
+	}
+	target, err := net.ResolveUDPAddr("udp4", broadcast)
+	if err != nil {
+		fmt.Printf("Failed to start LAN beacons: %v\n", err)
+		return
+	}
+
+	interval := n.beaconConfig.Interval
+	if interval <= 0 {
+		interval = DefaultBeaconConfig().Interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := n.sendBeacon(conn, target); err != nil {
+			n.debugf("Failed to send LAN beacon: %v\n", err)
+		}
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (n *Node) sendBeacon(conn net.PacketConn, target net.Addr) error {
+	_, portStr, err := net.SplitHostPort(n.transport.Address())
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid listen port %q", portStr)
+	}
+	data, err := network.EncodeBeacon(network.Beacon{NodeID: n.ID, NetworkID: n.networkID, Port: port})
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(data, target)
+	return err
+}
+
+// receiveBeacons reads beacons until conn is closed
+func (n *Node) receiveBeacons(conn net.PacketConn) {
+	buf := make([]byte, 1500)
+	for {
+		size, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				fmt.Printf("Stopped receiving LAN beacons: %v\n", err)
+			}
+			return
+		}
+		beacon, err := network.DecodeBeacon(buf[:size])
+		if err != nil {
+			continue
+		}
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		n.handleBeacon(beacon, udpAddr.IP)
+	}
+}
+
+// handleBeacon dials the node that sent a beacon from ip, unless it is this
+// node, of another network or already connected
+func (n *Node) handleBeacon(beacon network.Beacon, ip net.IP) {
+	if beacon.NodeID == n.ID || beacon.NetworkID != n.networkID {
+		return
+	}
+	n.mu.RLock()
+	_, alreadyConnected := n.peerKeys[beacon.NodeID]
+	n.mu.RUnlock()
+	if alreadyConnected {
+		return
+	}
+	address := net.JoinHostPort(ip.String(), strconv.Itoa(beacon.Port))
+	n.learnPeer(beacon.NodeID, []string{address}, "LAN beacon from "+address)
+}
@@ -0,0 +1,87 @@
+package node
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+// freeUDPPort returns a currently unused loopback UDP port
+func freeUDPPort(t *testing.T) int {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestNode_LANBeacon(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	// Beacons are sent to the other node's port on loopback rather than
+	// broadcast, so the test doesn't depend on the host's interfaces
+	portA, portB := freeUDPPort(t), freeUDPPort(t)
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true), WithNetworkID("lab"),
+		WithLANBeacon(BeaconConfig{Port: portA, Interval: 50 * time.Millisecond, Broadcast: "127.0.0.1:" + strconv.Itoa(portB)}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	if err := first.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+
+	listener, err := NewNode("listener", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithNetworkID("lab"),
+		WithLANBeacon(BeaconConfig{Port: portB, Interval: time.Hour, Broadcast: "127.0.0.1:" + strconv.Itoa(freeUDPPort(t))}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer listener.Stop()
+
+	events, unsubscribe := listener.Subscribe()
+	defer unsubscribe()
+	if err := listener.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	event := waitForEvent(t, events, EventPeerConnected, 5*time.Second)
+	if event.PeerID != "first" {
+		t.Errorf("Connected to %q, want first", event.PeerID)
+	}
+}
+
+func TestNode_HandleBeaconIgnoresOtherNetworks(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+		WithFirstNode(true), WithNetworkID("lab"), WithOverlay(OverlayConfig{}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	ip := net.ParseIP("192.0.2.1")
+	node.handleBeacon(network.Beacon{NodeID: "test-node", NetworkID: "lab", Port: 3000}, ip)
+	node.handleBeacon(network.Beacon{NodeID: "other", NetworkID: "prod", Port: 3000}, ip)
+	if len(node.discovery.queue) != 0 {
+		t.Fatalf("Queued %d dials for own and foreign beacons, want none", len(node.discovery.queue))
+	}
+
+	node.handleBeacon(network.Beacon{NodeID: "other", NetworkID: "lab", Port: 3000}, ip)
+	select {
+	case p := <-node.discovery.queue:
+		if p.id != "other" || len(p.addresses) != 1 || p.addresses[0] != "192.0.2.1:3000" {
+			t.Errorf("Queued %+v, want other at 192.0.2.1:3000", p)
+		}
+	default:
+		t.Error("Beacon of the node's network was not queued for dialing")
+	}
+}
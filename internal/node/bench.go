@@ -0,0 +1,404 @@
+package node
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+const (
+	// minBenchSize leaves room for the index that makes each benchmark
+	// object unique
+	minBenchSize = 8
+	// maxBenchSize bounds the object size of a benchmark, since objects are
+	// held in memory, and the data a peer sends for one benchmark request
+	maxBenchSize = 256 << 20
+)
+
+// BenchConfig sets the workload of a benchmark
+type BenchConfig struct {
+	Size        int64  `json:"size"`        // bytes per object
+	Count       int    `json:"count"`       // objects per phase
+	Concurrency int    `json:"concurrency"` // operations in flight at once
+	Peer        string `json:"peer"`        // node ID for the transfer phases; empty skips them
+}
+
+// DefaultBenchConfig returns 16 objects of 1 MiB, 4 at a time
+func DefaultBenchConfig() BenchConfig {
+	return BenchConfig{
+		Size:        1 << 20,
+		Count:       16,
+		Concurrency: 4,
+	}
+}
+
+// LatencyStats summarizes the duration of the operations of a phase
+type LatencyStats struct {
+	Min  time.Duration `json:"min"`
+	Mean time.Duration `json:"mean"`
+	P50  time.Duration `json:"p50"`
+	P99  time.Duration `json:"p99"`
+	Max  time.Duration `json:"max"`
+}
+
+// BenchResult is the outcome of one benchmark phase
+type BenchResult struct {
+	Name       string        `json:"name"`
+	Ops        int           `json:"ops"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"duration"`
+	Throughput float64       `json:"throughput"` // bytes per second
+	Latency    LatencyStats  `json:"latency"`
+}
+
+// BenchReport holds the results of every phase of a benchmark
+type BenchReport struct {
+	Config  BenchConfig   `json:"config"`
+	Results []BenchResult `json:"results"`
+}
+
+// benchPhase is one measured operation of a benchmark
+type benchPhase struct {
+	name        string
+	concurrency int
+	op          func(i int) (int64, error)
+}
+
+// benchTracker matches benchmark chunks received from peers with the
+// requests waiting for them
+type benchTracker struct {
+	mu      sync.Mutex
+	pending map[string]*benchWait
+}
+
+type benchWait struct {
+	received int64
+	finished bool
+	done     chan struct{}
+}
+
+func newBenchTracker() *benchTracker {
+	return &benchTracker{pending: make(map[string]*benchWait)}
+}
+
+// receive counts a chunk towards its request
+func (b *benchTracker) receive(transfer *protocol.DataTransfer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	w, ok := b.pending[transfer.Bench]
+	if !ok || w.finished {
+		return
+	}
+	w.received += int64(len(transfer.Data))
+	if transfer.FinalChunk {
+		w.finished = true
+		close(w.done)
+	}
+}
+
+// Benchmark measures encryption, store and, when cfg.Peer is set, transfer
+// performance with random data. Objects written to the store are removed
+// again; the peer discards what it is sent. Each phase runs cfg.Count
+// operations on objects of cfg.Size bytes, cfg.Concurrency at a time.
+func (n *Node) Benchmark(cfg BenchConfig) (BenchReport, error) {
+	report := BenchReport{Config: cfg}
+	if cfg.Size < minBenchSize || cfg.Size > maxBenchSize {
+		return report, fmt.Errorf("size must be between %d and %d bytes", minBenchSize, maxBenchSize)
+	}
+	if cfg.Count < 1 || cfg.Concurrency < 1 {
+		return report, errors.New("count and concurrency must be at least 1")
+	}
+	var peer *network.Peer
+	if cfg.Peer != "" {
+		p, ok := n.peerConn(cfg.Peer)
+		if !ok {
+			return report, fmt.Errorf("peer %s is not connected", cfg.Peer)
+		}
+		if !n.peerSupports(cfg.Peer, protocol.FeatureBench) {
+			return report, fmt.Errorf("peer %s does not support benchmarks", cfg.Peer)
+		}
+		peer = p
+	}
+
+	data := make([]byte, cfg.Size)
+	if _, err := rand.Read(data); err != nil {
+		return report, err
+	}
+	var sealed bytes.Buffer
+	if err := crypto.EncryptStream(n.localKey, bytes.NewReader(data), &sealed); err != nil {
+		return report, err
+	}
+
+	phases := []benchPhase{
+		{"encrypt", cfg.Concurrency, func(int) (int64, error) {
+			return cfg.Size, crypto.EncryptStream(n.localKey, bytes.NewReader(data), io.Discard)
+		}},
+		{"decrypt", cfg.Concurrency, func(int) (int64, error) {
+			return cfg.Size, crypto.DecryptStream(n.localKey, bytes.NewReader(sealed.Bytes()), io.Discard)
+		}},
+	}
+
+	// Store phases write distinct objects, hashed up front so hashing isn't
+	// timed, and skip any that happen to be stored already
+	hashes := make([]string, cfg.Count)
+	ours := make([]bool, cfg.Count)
+	for i := range hashes {
+		hash, err := crypto.ContentHash(benchObject(data, i))
+		if err != nil {
+			return report, err
+		}
+		hashes[i] = hash
+		ours[i] = !n.store.Exists(hash)
+	}
+	defer func() {
+		for i, hash := range hashes {
+			if ours[i] {
+				n.store.Delete(hash)
+			}
+		}
+	}()
+	phases = append(phases, []benchPhase{
+		{"store write", cfg.Concurrency, func(i int) (int64, error) {
+			if !ours[i] {
+				return 0, nil
+			}
+			return cfg.Size, n.store.Store(hashes[i], benchObject(data, i))
+		}},
+		{"store read", cfg.Concurrency, func(i int) (int64, error) {
+			reader, err := n.store.Load(hashes[i])
+			if err != nil {
+				return 0, err
+			}
+			defer reader.Close()
+			return io.Copy(io.Discard, reader)
+		}},
+	}...)
+
+	if peer != nil {
+		phases = append(phases, []benchPhase{
+			// Empty requests measure the round trip alone
+			{"round trip", 1, func(int) (int64, error) {
+				return 0, n.benchRequest(peer, 0)
+			}},
+			{"transfer", cfg.Concurrency, func(int) (int64, error) {
+				return cfg.Size, n.benchRequest(peer, cfg.Size)
+			}},
+		}...)
+	}
+
+	for _, phase := range phases {
+		result, err := runBench(phase.name, cfg.Count, phase.concurrency, phase.op)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", phase.name, err)
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report, nil
+}
+
+// benchObject returns the i-th benchmark object: data with its first bytes
+// replaced by i
+func benchObject(data []byte, i int) io.Reader {
+	prefix := binary.BigEndian.AppendUint64(nil, uint64(i))
+	return io.MultiReader(bytes.NewReader(prefix), bytes.NewReader(data[len(prefix):]))
+}
+
+// runBench runs op for indexes 0 to ops-1 with up to concurrency operations
+// in flight, stopping at the first error
+func runBench(name string, ops, concurrency int, op func(i int) (int64, error)) (BenchResult, error) {
+	result := BenchResult{Name: name, Ops: ops}
+	if concurrency > ops {
+		concurrency = ops
+	}
+
+	indexes := make(chan int, ops)
+	for i := 0; i < ops; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	var (
+		mu        sync.Mutex
+		latencies = make([]time.Duration, 0, ops)
+		firstErr  error
+		wg        sync.WaitGroup
+	)
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				opStart := time.Now()
+				size, err := op(i)
+				elapsed := time.Since(opStart)
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				failed := firstErr != nil
+				result.Bytes += size
+				latencies = append(latencies, elapsed)
+				mu.Unlock()
+				if failed {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	result.Duration = time.Since(start)
+	if firstErr != nil {
+		return result, firstErr
+	}
+
+	if result.Duration > 0 {
+		result.Throughput = float64(result.Bytes) / result.Duration.Seconds()
+	}
+	result.Latency = latencyStats(latencies)
+	return result, nil
+}
+
+// latencyStats summarizes operation durations
+func latencyStats(latencies []time.Duration) LatencyStats {
+	if len(latencies) == 0 {
+		return LatencyStats{}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	percentile := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	return LatencyStats{
+		Min:  latencies[0],
+		Mean: total / time.Duration(len(latencies)),
+		P50:  percentile(0.50),
+		P99:  percentile(0.99),
+		Max:  latencies[len(latencies)-1],
+	}
+}
+
+// benchRequest asks a peer for size bytes of benchmark data and waits until
+// all of it has arrived
+func (n *Node) benchRequest(peer *network.Peer, size int64) error {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	request := protocol.BenchRequest{ID: hex.EncodeToString(id), Size: size}
+
+	wait := &benchWait{done: make(chan struct{})}
+	n.benches.mu.Lock()
+	n.benches.pending[request.ID] = wait
+	n.benches.mu.Unlock()
+	defer func() {
+		n.benches.mu.Lock()
+		delete(n.benches.pending, request.ID)
+		n.benches.mu.Unlock()
+	}()
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeBench, n.ID, request)
+	if err != nil {
+		return err
+	}
+	if err := peer.Send(msg); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	timer := time.NewTimer(DefaultFetchTimeout)
+	defer timer.Stop()
+	select {
+	case <-wait.done:
+	case <-timer.C:
+		return fmt.Errorf("no answer within %v", DefaultFetchTimeout)
+	case <-n.done:
+		return fmt.Errorf("node stopped")
+	}
+
+	n.benches.mu.Lock()
+	received := wait.received
+	n.benches.mu.Unlock()
+	if received != size {
+		return fmt.Errorf("peer sent %d of %d bytes; see its log for why", received, size)
+	}
+	return nil
+}
+
+// handleBench sends a peer the benchmark data it asked for. Refused requests
+// are answered with an empty final chunk so the requester stops waiting.
+func (n *Node) handleBench(peer *network.Peer, msg *protocol.Message) error {
+	var request protocol.BenchRequest
+	if err := msg.ParsePayload(&request); err != nil {
+		return fmt.Errorf("failed to parse bench request: %w", err)
+	}
+
+	id := n.nodeID(peer)
+	refuse := func(reason error) error {
+		fmt.Printf("Refusing benchmark request from %s: %v\n", id, reason)
+		return peer.SendTransfer(n.ID, &protocol.DataTransfer{Bench: request.ID, FinalChunk: true})
+	}
+	if request.Size < 0 || request.Size > maxBenchSize {
+		return refuse(fmt.Errorf("size %d is out of range", request.Size))
+	}
+	rate, err := n.uploadRate(id)
+	if err != nil {
+		return refuse(err)
+	}
+
+	// Chunks match those of regular transfers to the peer
+	buffer := make([]byte, n.peerCapabilities(id).ChunkSize())
+	if request.Size < int64(len(buffer)) {
+		buffer = buffer[:request.Size]
+	}
+	if _, err := rand.Read(buffer); err != nil {
+		return refuse(err)
+	}
+
+	start := time.Now()
+	var sent int64
+	for index := 0; ; index++ {
+		chunk := buffer
+		if remaining := request.Size - sent; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		sent += int64(len(chunk))
+		transfer := protocol.DataTransfer{
+			Data:       chunk,
+			ChunkIndex: index,
+			FinalChunk: sent == request.Size,
+			TotalSize:  request.Size,
+			Bench:      request.ID,
+		}
+		if err := peer.SendTransfer(n.ID, &transfer); err != nil {
+			return fmt.Errorf("failed to send benchmark data: %w", err)
+		}
+		n.ledger.record(id, int64(len(chunk)), 0)
+		if transfer.FinalChunk {
+			return nil
+		}
+
+		if rate > 0 {
+			expected := time.Duration(float64(sent) / float64(rate) * float64(time.Second))
+			if wait := expected - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+	}
+}
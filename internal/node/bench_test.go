@@ -0,0 +1,77 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNode_Benchmark(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	if _, err := second.Benchmark(BenchConfig{Size: 1024, Count: 1, Concurrency: 1, Peer: "unknown"}); err == nil {
+		t.Error("Expected error for a peer that is not connected")
+	}
+	if _, err := second.Benchmark(BenchConfig{Size: 4, Count: 1, Concurrency: 1}); err == nil {
+		t.Error("Expected error for a size below the minimum")
+	}
+
+	cfg := BenchConfig{Size: 3<<20 + 5, Count: 4, Concurrency: 2, Peer: "first"}
+	report, err := second.Benchmark(cfg)
+	if err != nil {
+		t.Fatalf("Failed to run benchmark: %v", err)
+	}
+	want := []string{"encrypt", "decrypt", "store write", "store read", "round trip", "transfer"}
+	if len(report.Results) != len(want) {
+		t.Fatalf("Got %d phases, want %d", len(report.Results), len(want))
+	}
+	for i, r := range report.Results {
+		if r.Name != want[i] {
+			t.Errorf("Phase %d = %s, want %s", i, r.Name, want[i])
+		}
+		if r.Ops != cfg.Count || r.Latency.Max < r.Latency.Min || r.Latency.Max == 0 {
+			t.Errorf("%s: ops %d, latency %+v", r.Name, r.Ops, r.Latency)
+		}
+		wantBytes := int64(cfg.Count) * cfg.Size
+		if r.Name == "round trip" {
+			wantBytes = 0
+		}
+		if r.Bytes != wantBytes {
+			t.Errorf("%s: bytes = %d, want %d", r.Name, r.Bytes, wantBytes)
+		}
+	}
+
+	// Benchmark objects are removed and nothing is stored on the peer
+	if stats, _ := second.store.Stats(); stats.Files != 0 {
+		t.Errorf("Store holds %d files after the benchmark, want 0", stats.Files)
+	}
+	if stats, _ := first.store.Stats(); stats.Files != 0 {
+		t.Errorf("Peer stores %d files after the benchmark, want 0", stats.Files)
+	}
+	if entry := first.ledger.get("second"); entry.Sent != int64(cfg.Count)*cfg.Size {
+		t.Errorf("Peer ledger sent = %d, want %d", entry.Sent, int64(cfg.Count)*cfg.Size)
+	}
+}
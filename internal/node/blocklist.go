@@ -0,0 +1,343 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+)
+
+// ErrBanned is returned for connections to or from banned peers
+var ErrBanned = errors.New("peer is banned")
+
+// BanKind tells whether a ban matches a node ID, an identity key or a
+// network address
+type BanKind string
+
+const (
+	BanPeer     BanKind = "peer"
+	BanIdentity BanKind = "identity"
+	BanAddress  BanKind = "address"
+)
+
+// BanEntry blocks a peer by node ID, identity key fingerprint or network
+// address. Node IDs are chosen by peers themselves, so an identity ban is
+// the one a peer can't shed by picking another ID. Address bans given
+// as a bare host match every port on that host, and CIDR blocks such as
+// 10.0.0.0/8 every address in them. Addresses are compared as written,
+// without resolving host names.
+type BanEntry struct {
+	Target  string    `json:"target"`
+	Kind    BanKind   `json:"kind"`
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"` // zero for a permanent ban
+}
+
+// Permanent reports whether the ban never expires
+func (b BanEntry) Permanent() bool {
+	return b.Expires.IsZero()
+}
+
+func (b BanEntry) expired(now time.Time) bool {
+	return !b.Permanent() && !now.Before(b.Expires)
+}
+
+// ParseBanTarget classifies a ban target: IP addresses, CIDR blocks and
+// host:port pairs are addresses, 16 hex digits an identity key
+// fingerprint, and anything else is a node ID
+func ParseBanTarget(target string) BanKind {
+	if isFingerprint(target) {
+		return BanIdentity
+	}
+	if net.ParseIP(target) != nil {
+		return BanAddress
+	}
+	if _, _, err := net.ParseCIDR(target); err == nil {
+		return BanAddress
+	}
+	if _, port, err := net.SplitHostPort(target); err == nil {
+		if _, err := strconv.Atoi(port); err == nil {
+			return BanAddress
+		}
+	}
+	return BanPeer
+}
+
+// blocklist holds banned peers and addresses and persists them as JSON
+type blocklist struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]BanEntry
+	now     func() time.Time
+}
+
+func banKey(kind BanKind, target string) string {
+	return string(kind) + " " + target
+}
+
+// loadBlocklist reads the blocklist at path, starting empty if it does not exist
+func loadBlocklist(path string) (*blocklist, error) {
+	b := &blocklist{
+		path:    path,
+		entries: make(map[string]BanEntry),
+		now:     time.Now,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blocklist: %w", err)
+	}
+
+	var entries []BanEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse blocklist: %w", err)
+	}
+	for _, e := range entries {
+		b.entries[banKey(e.Kind, e.Target)] = e
+	}
+	return b, nil
+}
+
+// reload replaces the bans with those in the file and returns their number
+func (b *blocklist) reload() (int, error) {
+	loaded, err := loadBlocklist(b.path)
+	if err != nil {
+		return 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.entries = loaded.entries
+	return len(b.entries), nil
+}
+
+// add records a ban, replacing any earlier ban of the same target
+func (b *blocklist) add(entry BanEntry) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.entries[banKey(entry.Kind, entry.Target)] = entry
+	return b.saveLocked()
+}
+
+// remove lifts the ban on target, reporting whether there was one
+func (b *blocklist) remove(target string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	found := false
+	for _, kind := range []BanKind{BanPeer, BanIdentity, BanAddress} {
+		key := banKey(kind, target)
+		if _, ok := b.entries[key]; ok {
+			delete(b.entries, key)
+			found = true
+		}
+	}
+	if !found {
+		return false, nil
+	}
+	return true, b.saveLocked()
+}
+
+// list returns the bans in force, sorted by target
+func (b *blocklist) list() []BanEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	entries := make([]BanEntry, 0, len(b.entries))
+	for _, e := range b.entries {
+		if !e.expired(now) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Target != entries[j].Target {
+			return entries[i].Target < entries[j].Target
+		}
+		return entries[i].Kind < entries[j].Kind
+	})
+	return entries
+}
+
+// peer returns the ban in force on a node ID or identity fingerprint, as
+// kind says, if any
+func (b *blocklist) peer(kind BanKind, id string) (BanEntry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.entries[banKey(kind, id)]
+	if !ok || e.expired(b.now()) {
+		return BanEntry{}, false
+	}
+	return e, true
+}
+
+// address returns the ban in force on an address, if any
+func (b *blocklist) address(addr string) (BanEntry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	for _, e := range b.entries {
+		if e.Kind == BanAddress && !e.expired(now) && addressMatches(e.Target, addr) {
+			return e, true
+		}
+	}
+	return BanEntry{}, false
+}
+
+// saveLocked writes the blocklist atomically, dropping expired bans; the
+// caller must hold b.mu
+func (b *blocklist) saveLocked() error {
+	now := b.now()
+	entries := make([]BanEntry, 0, len(b.entries))
+	for key, e := range b.entries {
+		if e.expired(now) {
+			delete(b.entries, key)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return banKey(entries[i].Kind, entries[i].Target) < banKey(entries[j].Kind, entries[j].Target)
+	})
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode blocklist: %w", err)
+	}
+	return writeFileAtomic(b.path, data)
+}
+
+// addressMatches reports whether addr falls under a banned address. A ban
+// without a port matches the host on any port, and a CIDR block any host
+// in it.
+func addressMatches(banned, addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	if _, block, err := net.ParseCIDR(banned); err == nil {
+		ip := net.ParseIP(host)
+		return ip != nil && block.Contains(ip)
+	}
+	bannedHost, bannedPort, err := net.SplitHostPort(banned)
+	if err != nil {
+		bannedHost, bannedPort = banned, ""
+	}
+	if bannedHost != host {
+		return false
+	}
+	return bannedPort == "" || bannedPort == port
+}
+
+// Ban blocks a peer by node ID, identity key fingerprint or address (see
+// ParseBanTarget) for duration,
+// or permanently when duration is zero. Matching peers are disconnected
+// immediately and refused on later connection attempts in either direction.
+func (n *Node) Ban(target, reason string, duration time.Duration) (BanEntry, error) {
+	if target == "" {
+		return BanEntry{}, fmt.Errorf("missing ban target")
+	}
+	if duration < 0 {
+		return BanEntry{}, fmt.Errorf("ban duration must not be negative")
+	}
+
+	entry := BanEntry{
+		Target:  target,
+		Kind:    ParseBanTarget(target),
+		Reason:  reason,
+		Created: n.blocklist.now(),
+	}
+	if duration > 0 {
+		entry.Expires = entry.Created.Add(duration)
+	}
+	if err := n.blocklist.add(entry); err != nil {
+		return BanEntry{}, err
+	}
+
+	n.disconnectBanned()
+	return entry, nil
+}
+
+// Unban lifts a ban, reporting whether target was banned
+func (n *Node) Unban(target string) (bool, error) {
+	return n.blocklist.remove(target)
+}
+
+// Bans returns the bans currently in force
+func (n *Node) Bans() []BanEntry {
+	return n.blocklist.list()
+}
+
+// checkAddress is the transport's connection filter
+func (n *Node) checkAddress(addr string) error {
+	if ban, ok := n.blocklist.address(addr); ok {
+		return fmt.Errorf("%w: address %s (%s)", ErrBanned, addr, ban.Target)
+	}
+	return nil
+}
+
+// checkPeer rejects a peer whose node ID, identity key or advertised
+// address is banned. key is nil for peers without one, or not yet known.
+func (n *Node) checkPeer(id string, key []byte, addr string) error {
+	if _, ok := n.blocklist.peer(BanPeer, id); ok {
+		return fmt.Errorf("%w: %s", ErrBanned, id)
+	}
+	if key != nil {
+		fingerprint := crypto.Fingerprint(key)
+		if _, ok := n.blocklist.peer(BanIdentity, fingerprint); ok {
+			return fmt.Errorf("%w: %s (%s)", ErrBanned, id, fingerprint)
+		}
+	}
+	if addr != "" {
+		return n.checkAddress(addr)
+	}
+	return nil
+}
+
+// disconnectBanned closes connections to peers that are now banned
+func (n *Node) disconnectBanned() {
+	n.mu.RLock()
+	banned := make(map[string]*network.Peer) // by identity
+	ids := make(map[string]string)           // node ID by identity
+	for key, peer := range n.conns {
+		info := n.peers[key]
+		if n.checkPeer(info.ID, info.PublicKey, info.Address) != nil || n.checkAddress(peer.Address()) != nil {
+			banned[key] = peer
+			ids[key] = info.ID
+		}
+	}
+	n.mu.RUnlock()
+
+	// Closing runs the disconnect handler, which takes the lock
+	for _, peer := range banned {
+		peer.Close()
+	}
+
+	n.mu.Lock()
+	for key, peer := range banned {
+		if n.conns[key] == peer {
+			n.forgetPeerLocked(key)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, id := range ids {
+		n.replicas.forget(id)
+		fmt.Printf("Disconnected banned peer %s\n", id)
+	}
+}
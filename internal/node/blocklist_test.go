@@ -0,0 +1,148 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseBanTarget(t *testing.T) {
+	tests := []struct {
+		target string
+		want   BanKind
+	}{
+		{"node1", BanPeer},
+		{"10.0.0.1", BanAddress},
+		{"10.0.0.1:3000", BanAddress},
+		{"localhost:3000", BanAddress},
+		{"::1", BanAddress},
+		{"[::1]:3000", BanAddress},
+		{"node:name", BanPeer},
+		{"4b32b393c49dbfd8", BanIdentity},
+		{"10.0.0.0/8", BanAddress},
+		{"fd00::/8", BanAddress},
+	}
+
+	for _, tt := range tests {
+		if got := ParseBanTarget(tt.target); got != tt.want {
+			t.Errorf("ParseBanTarget(%q) = %v, want %v", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestAddressMatches(t *testing.T) {
+	tests := []struct {
+		banned, addr string
+		want         bool
+	}{
+		{"10.0.0.1", "10.0.0.1:51234", true},
+		{"10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1:3000", "10.0.0.1:3000", true},
+		{"10.0.0.1:3000", "10.0.0.1:3001", false},
+		{"10.0.0.1", "10.0.0.2:3000", false},
+		{"::1", "[::1]:3000", true},
+		{"10.0.0.0/8", "10.1.2.3:3000", true},
+		{"10.0.0.0/8", "11.0.0.1:3000", false},
+		{"10.0.0.0/8", "localhost:3000", false},
+	}
+
+	for _, tt := range tests {
+		if got := addressMatches(tt.banned, tt.addr); got != tt.want {
+			t.Errorf("addressMatches(%q, %q) = %v, want %v", tt.banned, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestBlocklist_PersistsAndExpires(t *testing.T) {
+	dir, cleanup := setupTestDir(t)
+	defer cleanup()
+	path := filepath.Join(dir, "blocklist.json")
+
+	now := time.Now()
+	b, err := loadBlocklist(path)
+	if err != nil {
+		t.Fatalf("Failed to load blocklist: %v", err)
+	}
+	b.now = func() time.Time { return now }
+
+	if err := b.add(BanEntry{Target: "node1", Kind: BanPeer, Reason: "spam", Created: now}); err != nil {
+		t.Fatalf("Failed to add ban: %v", err)
+	}
+	if err := b.add(BanEntry{Target: "10.0.0.1", Kind: BanAddress, Created: now, Expires: now.Add(time.Hour)}); err != nil {
+		t.Fatalf("Failed to add ban: %v", err)
+	}
+
+	reloaded, err := loadBlocklist(path)
+	if err != nil {
+		t.Fatalf("Failed to reload blocklist: %v", err)
+	}
+	reloaded.now = func() time.Time { return now }
+	if got := reloaded.list(); len(got) != 2 {
+		t.Fatalf("list() has %d entries, want 2", len(got))
+	}
+	if ban, ok := reloaded.peer(BanPeer, "node1"); !ok || ban.Reason != "spam" {
+		t.Errorf("peer(node1) = %+v, %v, want the spam ban", ban, ok)
+	}
+	if _, ok := reloaded.address("10.0.0.1:4000"); !ok {
+		t.Error("address(10.0.0.1:4000) not banned")
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, ok := reloaded.address("10.0.0.1:4000"); ok {
+		t.Error("Expired address ban still in force")
+	}
+	if got := reloaded.list(); len(got) != 1 || got[0].Target != "node1" {
+		t.Errorf("list() = %+v, want only the permanent ban", got)
+	}
+
+	found, err := reloaded.remove("node1")
+	if err != nil || !found {
+		t.Errorf("remove(node1) = %v, %v, want true, nil", found, err)
+	}
+	if found, _ := reloaded.remove("node1"); found {
+		t.Error("remove(node1) found a ban twice")
+	}
+}
+
+func TestNode_BanRefusesHandshake(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	if _, err := first.Ban("second", "test", 0); err != nil {
+		t.Fatalf("Failed to ban: %v", err)
+	}
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(500 * time.Millisecond); err == nil {
+		t.Error("Banned peer received the network key")
+	}
+	if peers := first.Peers(); len(peers) != 0 {
+		t.Errorf("Peers() = %v, want none", peers)
+	}
+
+	// Dialing a banned address fails before connecting
+	if _, err := second.Ban("127.0.0.1", "", time.Hour); err != nil {
+		t.Fatalf("Failed to ban: %v", err)
+	}
+	if err := second.Connect(context.Background(), first.Address()); !errors.Is(err, ErrBanned) {
+		t.Errorf("Connect() error = %v, want %v", err, ErrBanned)
+	}
+}
@@ -0,0 +1,183 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+// BootstrapConfig sets the peers a node joins the network through and how
+// it keeps retrying them until it has
+type BootstrapConfig struct {
+	// Peers are addresses tried in order on each attempt
+	Peers []string
+	// MinBackoff is the wait after the first failed attempt; it doubles
+	// after each further failure up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts is how many attempts are made before giving up; 0 keeps
+	// trying until the node stops
+	MaxAttempts int
+	// KeyTimeout is how long an attempt that connected waits for the
+	// network key before it counts as failed
+	KeyTimeout time.Duration
+}
+
+// DefaultBootstrapConfig returns no peers, retried from one second up to
+// a minute apart for as long as the node runs
+func DefaultBootstrapConfig() BootstrapConfig {
+	return BootstrapConfig{
+		MinBackoff: time.Second,
+		MaxBackoff: time.Minute,
+		KeyTimeout: network.DefaultHandshakeTimeout,
+	}
+}
+
+// WithBootstrap sets the peers the node joins the network through. They are
+// dialed at start and again with backoff until one is connected and the
+// network key has arrived; see BootstrapStatus.
+func WithBootstrap(cfg BootstrapConfig) Option {
+	return func(n *Node) {
+		n.bootstrapConfig = cfg
+	}
+}
+
+// BootstrapStatus reports how joining the network through the bootstrap
+// peers is going
+type BootstrapStatus struct {
+	// Complete is set once a bootstrap peer is connected and the network
+	// key has arrived. A node with no bootstrap peers is complete once it
+	// holds the network key.
+	Complete bool      `json:"complete"`
+	Peer     string    `json:"peer,omitempty"` // the peer bootstrap completed through
+	Attempts int       `json:"attempts"`
+	Done     time.Time `json:"done,omitempty"` // when bootstrap completed or gave up
+	// GaveUp is set if MaxAttempts ran out before bootstrap completed
+	GaveUp    bool   `json:"gave_up,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// bootstrapState is the status of the bootstrap loop
+type bootstrapState struct {
+	mu     sync.Mutex
+	status BootstrapStatus
+}
+
+// BootstrapStatus returns how joining the network through the bootstrap
+// peers is going
+func (n *Node) BootstrapStatus() BootstrapStatus {
+	n.bootstrap.mu.Lock()
+	status := n.bootstrap.status
+	n.bootstrap.mu.Unlock()
+
+	if len(n.bootstrapConfig.Peers) == 0 {
+		status.Complete = n.hasNetworkKey()
+	}
+	return status
+}
+
+// Bootstrapped reports whether the node has joined the network through a
+// bootstrap peer and holds the network key
+func (n *Node) Bootstrapped() bool {
+	return n.BootstrapStatus().Complete
+}
+
+// hasNetworkKey reports whether the node holds the network key, either its
+// own as the first node or one received from a peer
+func (n *Node) hasNetworkKey() bool {
+	if n.isFirstNode {
+		return true
+	}
+	select {
+	case <-n.keyReady:
+		return true
+	default:
+		return false
+	}
+}
+
+// bootstrapLoop tries the bootstrap peers until an attempt completes, the
+// attempts run out or the node stops
+func (n *Node) bootstrapLoop() {
+	cfg := n.bootstrapConfig
+	backoff := cfg.MinBackoff
+	for attempt := 1; ; attempt++ {
+		peer, err := n.bootstrapOnce()
+
+		n.bootstrap.mu.Lock()
+		status := &n.bootstrap.status
+		status.Attempts = attempt
+		if err != nil {
+			status.LastError = err.Error()
+		} else {
+			status.Complete = true
+			status.Peer = peer
+			status.Done = time.Now()
+		}
+		gaveUp := err != nil && cfg.MaxAttempts > 0 && attempt >= cfg.MaxAttempts
+		if gaveUp {
+			status.GaveUp = true
+			status.Done = time.Now()
+		}
+		n.bootstrap.mu.Unlock()
+
+		if err == nil {
+			fmt.Printf("Bootstrap complete through %s\n", peer)
+			n.emit(Event{Type: EventBootstrapComplete, Address: peer, Count: attempt})
+			return
+		}
+		if gaveUp {
+			fmt.Printf("Bootstrap gave up after %d attempts: %v\n", attempt, err)
+			return
+		}
+		fmt.Printf("Bootstrap attempt %d failed, retrying in %v: %v\n", attempt, backoff, err)
+		select {
+		case <-n.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, cfg.MaxBackoff)
+	}
+}
+
+// bootstrapOnce connects to the first bootstrap peer that answers, or finds
+// one already connected, and waits for the network key. It returns the
+// address of the peer.
+func (n *Node) bootstrapOnce() (string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-n.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	connected := n.connectedAddresses()
+	var errs []error
+	for _, address := range n.bootstrapConfig.Peers {
+		if !connected[address] {
+			if err := n.Connect(ctx, address); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", address, err))
+				continue
+			}
+		}
+		if n.hasNetworkKey() {
+			return address, nil
+		}
+		select {
+		case <-n.keyReady:
+			return address, nil
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(n.bootstrapConfig.KeyTimeout):
+			errs = append(errs, fmt.Errorf("%s: no network key after %v", address, n.bootstrapConfig.KeyTimeout))
+		}
+	}
+	return "", errors.Join(errs...)
+}
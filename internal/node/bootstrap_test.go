@@ -0,0 +1,110 @@
+package node
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNode_BootstrapRetriesUntilPeerIsUp(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	// The bootstrap peer isn't listening yet when the node starts
+	peerAddr := freeAddr(t)
+	cfg := DefaultBootstrapConfig()
+	cfg.Peers = []string{peerAddr}
+	cfg.MinBackoff = 20 * time.Millisecond
+	cfg.MaxBackoff = 50 * time.Millisecond
+	n, err := NewNode("joiner", freeAddr(t), filepath.Join(baseDir, "joiner", "store"), filepath.Join(baseDir, "joiner", "watch"), WithFirstNode(false), WithBootstrap(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer n.Stop()
+	events, unsubscribe := n.Subscribe()
+	defer unsubscribe()
+	if err := n.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for n.BootstrapStatus().Attempts < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for a retry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := n.BootstrapStatus(); status.Complete || status.LastError == "" {
+		t.Errorf("BootstrapStatus() with the peer down = %+v, want incomplete with an error", status)
+	}
+
+	peer, err := NewNode("peer", peerAddr, filepath.Join(baseDir, "peer", "store"), filepath.Join(baseDir, "peer", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer peer.Stop()
+	peer.transport.Start()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type != EventBootstrapComplete {
+				continue
+			}
+			if event.Address != peerAddr {
+				t.Errorf("Bootstrap completed through %s, want %s", event.Address, peerAddr)
+			}
+			if !n.Bootstrapped() || !n.hasNetworkKey() {
+				t.Error("Bootstrap completed without the network key")
+			}
+			return
+		case <-timeout:
+			t.Fatalf("Timed out waiting for bootstrap, status %+v", n.BootstrapStatus())
+		}
+	}
+}
+
+func TestNode_BootstrapGivesUp(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	cfg := DefaultBootstrapConfig()
+	cfg.Peers = []string{freeAddr(t)}
+	cfg.MinBackoff = time.Millisecond
+	cfg.MaxAttempts = 3
+	n, err := NewNode("joiner", freeAddr(t), filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(false), WithBootstrap(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer n.Stop()
+	if err := n.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !n.BootstrapStatus().GaveUp {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for bootstrap to give up, status %+v", n.BootstrapStatus())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := n.BootstrapStatus(); status.Attempts != 3 || status.Complete {
+		t.Errorf("BootstrapStatus() = %+v, want 3 failed attempts", status)
+	}
+}
+
+func TestNode_BootstrapStatusWithoutPeers(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	n, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer n.Stop()
+
+	if !n.Bootstrapped() {
+		t.Error("First node isn't bootstrapped")
+	}
+}
@@ -0,0 +1,79 @@
+package node
+
+import (
+	"sort"
+
+	"p2p-storage/internal/protocol"
+)
+
+// capabilities returns the capabilities the node announces in handshakes
+func (n *Node) capabilities() protocol.Capabilities {
+	return protocol.Capabilities{
+		Compression:  protocol.Compressions,
+		Relay:        n.relayEnabled,
+		StorageOnly:  n.storageOnly,
+		MaxChunkSize: protocol.ChunkSize(n.maxChunkSize),
+	}
+}
+
+// peerCapabilities returns the capabilities of a connected peer, or those of
+// a peer predating capabilities if it isn't connected
+func (n *Node) peerCapabilities(id string) protocol.Capabilities {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if info, ok := n.peers[n.peerKeys[id]]; ok {
+		return info.Capabilities
+	}
+	return protocol.HandshakePayload{}.PeerCapabilities()
+}
+
+// storageFirst orders peers so that storage-only peers come first, keeping
+// the order otherwise
+func (n *Node) storageFirst(ids []string) []string {
+	sort.SliceStable(ids, func(i, j int) bool {
+		return n.peerCapabilities(ids[i]).StorageOnly && !n.peerCapabilities(ids[j]).StorageOnly
+	})
+	return ids
+}
+
+// compressChunk compresses a chunk of a plaintext object for a peer that
+// decodes it, keeping the chunk as is where that doesn't make it smaller.
+// Encrypted data doesn't compress, so it is always sent as is.
+func compressChunk(transfer *protocol.DataTransfer, caps protocol.Capabilities) {
+	if !transfer.Plaintext || !caps.Decodes(protocol.CompressionGzip) {
+		return
+	}
+	packed, err := protocol.CompressChunk(protocol.CompressionGzip, transfer.Data)
+	if err != nil || len(packed) >= len(transfer.Data) {
+		return
+	}
+	transfer.Data = packed
+	transfer.Compression = protocol.CompressionGzip
+}
+
+// splitChunk splits a chunk into chunks of at most size bytes for a peer
+// that accepts no larger ones. Chunk sizes are powers of two, so the pieces
+// line up with chunk boundaries of the smaller size.
+func splitChunk(transfer protocol.DataTransfer, size int) []protocol.DataTransfer {
+	chunkSize := transfer.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = protocol.DefaultChunkSize
+	}
+	if size >= chunkSize {
+		return []protocol.DataTransfer{transfer}
+	}
+
+	first := transfer.ChunkIndex * (chunkSize / size)
+	pieces := make([]protocol.DataTransfer, 0, (len(transfer.Data)+size-1)/size)
+	for start := 0; start < len(transfer.Data) || len(pieces) == 0; start += size {
+		end := min(start+size, len(transfer.Data))
+		piece := transfer
+		piece.Data = transfer.Data[start:end]
+		piece.ChunkIndex = first + start/size
+		piece.ChunkSize = size
+		piece.FinalChunk = transfer.FinalChunk && end == len(transfer.Data)
+		pieces = append(pieces, piece)
+	}
+	return pieces
+}
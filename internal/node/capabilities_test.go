@@ -0,0 +1,114 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestSplitChunk(t *testing.T) {
+	data := bytes.Repeat([]byte{7}, protocol.DefaultChunkSize/2+10)
+	chunk := protocol.DataTransfer{ContentHash: "abc", Data: data, ChunkIndex: 2, FinalChunk: true}
+
+	size := protocol.DefaultChunkSize / 4
+	pieces := splitChunk(chunk, size)
+	if len(pieces) != 3 {
+		t.Fatalf("splitChunk() = %d pieces, want 3", len(pieces))
+	}
+	var joined []byte
+	for i, piece := range pieces {
+		if piece.Offset() != chunk.Offset()+int64(i*size) {
+			t.Errorf("Piece %d offset = %d, want %d", i, piece.Offset(), chunk.Offset()+int64(i*size))
+		}
+		if piece.FinalChunk != (i == len(pieces)-1) {
+			t.Errorf("Piece %d FinalChunk = %v", i, piece.FinalChunk)
+		}
+		joined = append(joined, piece.Data...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Error("Pieces don't add up to the chunk")
+	}
+
+	// Chunks no larger than the size are left alone
+	if pieces := splitChunk(chunk, protocol.DefaultChunkSize); len(pieces) != 1 || pieces[0].ChunkIndex != 2 {
+		t.Errorf("splitChunk() at the chunk size = %+v, want the chunk itself", pieces)
+	}
+}
+
+func TestCompressChunk_PlaintextOnly(t *testing.T) {
+	data := bytes.Repeat([]byte("plain "), 1000)
+	gzip := protocol.Capabilities{Compression: protocol.Compressions}
+
+	transfer := protocol.DataTransfer{Data: data, Plaintext: true}
+	compressChunk(&transfer, gzip)
+	if transfer.Compression != protocol.CompressionGzip || len(transfer.Data) >= len(data) {
+		t.Errorf("Plaintext chunk: compression %q, %d bytes; want gzip and fewer than %d", transfer.Compression, len(transfer.Data), len(data))
+	}
+
+	encrypted := protocol.DataTransfer{Data: data}
+	compressChunk(&encrypted, gzip)
+	if encrypted.Compression != "" {
+		t.Errorf("Encrypted chunk compression = %q, want none", encrypted.Compression)
+	}
+
+	old := protocol.DataTransfer{Data: data, Plaintext: true}
+	compressChunk(&old, protocol.HandshakePayload{}.PeerCapabilities())
+	if old.Compression != "" {
+		t.Errorf("Chunk for a peer without gzip compression = %q, want none", old.Compression)
+	}
+}
+
+func TestNode_AdaptsToPeerCapabilities(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	holder, err := NewNode("holder", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer holder.Stop()
+	holder.transport.Start()
+
+	// Several chunks of the small size the requester accepts
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, strings.Repeat("sent in small chunks ", 10000))
+	hash, err := holder.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	requester, err := NewNode("requester", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false),
+		WithMaxChunkSize(protocol.MinChunkSize), WithStorageOnly(true), WithRelay(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer requester.Stop()
+	requester.transport.Start()
+
+	if err := requester.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := requester.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	caps := holder.peerCapabilities("requester")
+	if !caps.StorageOnly || caps.Relay || caps.ChunkSize() != protocol.MinChunkSize {
+		t.Errorf("Holder sees the requester's capabilities as %+v", caps)
+	}
+	if caps := requester.peerCapabilities("holder"); caps.StorageOnly || !caps.Relay || caps.ChunkSize() != protocol.DefaultChunkSize {
+		t.Errorf("Requester sees the holder's capabilities as %+v", caps)
+	}
+
+	if err := requester.fetch(hash, 5*time.Second); err != nil {
+		t.Fatalf("Failed to fetch in small chunks: %v", err)
+	}
+	if !requester.store.Exists(hash) {
+		t.Error("Object was not stored by the requester")
+	}
+}
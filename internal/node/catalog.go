@@ -0,0 +1,236 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileMeta describes the original file behind a stored object
+type FileMeta struct {
+	Hash     string    `json:"hash"`
+	Name     string    `json:"name"`
+	Path     string    `json:"path,omitempty"` // slash-separated path relative to the import root
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time,omitempty"`
+	Manifest bool      `json:"manifest,omitempty"`
+	Link     string    `json:"link,omitempty"`     // target, if the object is a preserved symlink
+	Previous string    `json:"previous,omitempty"` // hash of the version of the file this object replaces
+	// Namespace and Encryption record how the object is encrypted; Key is
+	// its own key under EncryptPerFile
+	Namespace  string         `json:"namespace,omitempty"`
+	Encryption EncryptionMode `json:"encryption,omitempty"`
+	Key        []byte         `json:"key,omitempty"`
+}
+
+// catalog maps content hashes to file metadata and persists it as JSON
+type catalog struct {
+	path  string
+	mu    sync.RWMutex
+	files map[string]FileMeta
+	index nameIndex // words of names and paths -> hashes
+}
+
+// loadCatalog reads the catalog at path, starting empty if it does not exist
+func loadCatalog(path string) (*catalog, error) {
+	c := &catalog{
+		path:  path,
+		files: make(map[string]FileMeta),
+		index: make(nameIndex),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog: %w", err)
+	}
+
+	var files []FileMeta
+	if err := json.Unmarshal(data, &files); err != nil {
+		return nil, fmt.Errorf("failed to parse catalog: %w", err)
+	}
+	for _, f := range files {
+		c.putLocked(f)
+	}
+	return c, nil
+}
+
+// add records metadata for a hash and persists the catalog
+func (c *catalog) add(meta FileMeta) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.putLocked(meta)
+	return c.saveLocked()
+}
+
+// addAll records metadata for several hashes with a single write
+func (c *catalog) addAll(metas []FileMeta) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, meta := range metas {
+		c.putLocked(meta)
+	}
+	return c.saveLocked()
+}
+
+// addIfMissing records metadata only when the hash is not yet known, so
+// announcements from peers never overwrite locally imported metadata
+func (c *catalog) addIfMissing(meta FileMeta) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.files[meta.Hash]; ok {
+		return nil
+	}
+	c.putLocked(meta)
+	return c.saveLocked()
+}
+
+// remove forgets the metadata of a hash
+func (c *catalog) remove(hash string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	meta, ok := c.files[hash]
+	if !ok {
+		return nil
+	}
+	c.index.remove(meta)
+	delete(c.files, hash)
+	return c.saveLocked()
+}
+
+// putLocked records metadata for a hash, indexing its name in place of
+// what was recorded before; the caller must hold c.mu
+func (c *catalog) putLocked(meta FileMeta) {
+	if old, ok := c.files[meta.Hash]; ok {
+		c.index.remove(old)
+	}
+	c.files[meta.Hash] = meta
+	c.index.add(meta)
+}
+
+func (c *catalog) get(hash string) (FileMeta, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	meta, ok := c.files[hash]
+	return meta, ok
+}
+
+// previous returns the hash of the most recent other version of a file with
+// the same name and path, if one is cataloged
+func (c *catalog) previous(meta FileMeta) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var latest FileMeta
+	for _, f := range c.files {
+		if f.Hash == meta.Hash || f.Manifest || f.Link != "" || f.Name != meta.Name || f.Path != meta.Path {
+			continue
+		}
+		if latest.Hash == "" || f.ModTime.After(latest.ModTime) {
+			latest = f
+		}
+	}
+	return latest.Hash
+}
+
+// all returns every entry sorted by path, then name
+func (c *catalog) all() []FileMeta {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	files := make([]FileMeta, 0, len(c.files))
+	for _, f := range c.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Path != files[j].Path {
+			return files[i].Path < files[j].Path
+		}
+		return files[i].Name < files[j].Name
+	})
+	return files
+}
+
+// saveLocked writes the catalog atomically; the caller must hold c.mu
+func (c *catalog) saveLocked() error {
+	files := make([]FileMeta, 0, len(c.files))
+	for _, f := range c.files {
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Hash < files[j].Hash })
+
+	data, err := json.MarshalIndent(files, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog: %w", err)
+	}
+	return writeFileAtomic(c.path, data)
+}
+
+// writeFileAtomic replaces path with data via a temp file and rename
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Files returns the metadata of all cataloged files
+func (n *Node) Files() []FileMeta {
+	return n.catalog.all()
+}
+
+// FileInfo returns the metadata recorded for a content hash
+func (n *Node) FileInfo(hash string) (FileMeta, bool) {
+	return n.catalog.get(hash)
+}
+
+// ObjectInfo combines what the node knows about a single object
+type ObjectInfo struct {
+	Hash       string           `json:"hash"`
+	Stored     bool             `json:"stored"`
+	StoredSize int64            `json:"stored_size,omitempty"`
+	Meta       *FileMeta        `json:"meta,omitempty"`
+	Popularity ObjectPopularity `json:"popularity"`
+}
+
+// Info returns the catalog entry, local storage state and popularity of an object
+func (n *Node) Info(hash string) ObjectInfo {
+	info := ObjectInfo{
+		Hash:       hash,
+		Stored:     n.store.Exists(hash),
+		Popularity: n.popularity.get(hash),
+	}
+	if info.Stored {
+		info.StoredSize, _ = n.store.Size(hash)
+	}
+	if meta, ok := n.catalog.get(hash); ok {
+		meta.Key = nil // never shown
+		info.Meta = &meta
+	}
+	return info
+}
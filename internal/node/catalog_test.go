@@ -0,0 +1,56 @@
+package node
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCatalog_Persistence(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	path := filepath.Join(baseDir, "catalog.json")
+	c, err := loadCatalog(path)
+	if err != nil {
+		t.Fatalf("Failed to load catalog: %v", err)
+	}
+
+	meta := FileMeta{Hash: "abc", Name: "b.txt", Path: "a/b.txt", Size: 3}
+	if err := c.add(meta); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+
+	reloaded, err := loadCatalog(path)
+	if err != nil {
+		t.Fatalf("Failed to reload catalog: %v", err)
+	}
+	got, ok := reloaded.get("abc")
+	if !ok {
+		t.Fatal("Entry not found after reload")
+	}
+	if got.Path != meta.Path || got.Size != meta.Size {
+		t.Errorf("Entry = %+v, want %+v", got, meta)
+	}
+}
+
+func TestCatalog_AddIfMissing(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	c, err := loadCatalog(filepath.Join(baseDir, "catalog.json"))
+	if err != nil {
+		t.Fatalf("Failed to load catalog: %v", err)
+	}
+
+	if err := c.add(FileMeta{Hash: "abc", Name: "local.txt"}); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+	if err := c.addIfMissing(FileMeta{Hash: "abc", Name: "remote.txt"}); err != nil {
+		t.Fatalf("Failed to add entry: %v", err)
+	}
+
+	got, _ := c.get("abc")
+	if got.Name != "local.txt" {
+		t.Errorf("Name = %v, want %v", got.Name, "local.txt")
+	}
+}
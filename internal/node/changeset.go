@@ -0,0 +1,490 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// maxChangeChain bounds how many versions an incremental sync may span
+// before falling back to a full restore
+const maxChangeChain = 64
+
+// ChangeSet lists the entries added, changed and removed between two
+// versions of an imported directory. It is signed by the importing node.
+type ChangeSet struct {
+	Root      string          `json:"root"`
+	Base      string          `json:"base"`
+	Manifest  string          `json:"manifest"`
+	Created   time.Time       `json:"created"`
+	Added     []ManifestEntry `json:"added,omitempty"`
+	Changed   []ManifestEntry `json:"changed,omitempty"`
+	Removed   []string        `json:"removed,omitempty"`
+	PublicKey []byte          `json:"public_key"`
+	Signature []byte          `json:"signature"`
+}
+
+func (c ChangeSet) payload() protocol.ChangeSet {
+	return protocol.ChangeSet{
+		Root:      c.Root,
+		Base:      c.Base,
+		Manifest:  c.Manifest,
+		Timestamp: c.Created.Unix(),
+		Added:     changeEntries(c.Added),
+		Changed:   changeEntries(c.Changed),
+		Removed:   c.Removed,
+		PublicKey: c.PublicKey,
+		Signature: c.Signature,
+	}
+}
+
+func changeSetFromPayload(p protocol.ChangeSet) ChangeSet {
+	return ChangeSet{
+		Root:      p.Root,
+		Base:      p.Base,
+		Manifest:  p.Manifest,
+		Created:   time.Unix(p.Timestamp, 0).UTC(),
+		Added:     manifestEntries(p.Added),
+		Changed:   manifestEntries(p.Changed),
+		Removed:   p.Removed,
+		PublicKey: p.PublicKey,
+		Signature: p.Signature,
+	}
+}
+
+func changeEntries(entries []ManifestEntry) []protocol.ChangeEntry {
+	if len(entries) == 0 {
+		return nil
+	}
+	out := make([]protocol.ChangeEntry, len(entries))
+	for i, e := range entries {
+		out[i] = protocol.ChangeEntry{
+			Path:    e.Path,
+			Hash:    e.Hash,
+			Link:    e.Link,
+			Size:    e.Size,
+			Mode:    uint32(e.Mode),
+			ModTime: e.ModTime.UnixNano(),
+		}
+	}
+	return out
+}
+
+func manifestEntries(entries []protocol.ChangeEntry) []ManifestEntry {
+	if len(entries) == 0 {
+		return nil
+	}
+	out := make([]ManifestEntry, len(entries))
+	for i, e := range entries {
+		out[i] = ManifestEntry{
+			Path:    e.Path,
+			Hash:    e.Hash,
+			Link:    e.Link,
+			Size:    e.Size,
+			Mode:    fs.FileMode(e.Mode),
+			ModTime: time.Unix(0, e.ModTime).UTC(),
+		}
+	}
+	return out
+}
+
+// Verify reports whether the change set is signed by the key it carries
+func (c ChangeSet) Verify() bool {
+	if c.Base == "" || c.Manifest == "" {
+		return false
+	}
+	p := c.payload()
+	return crypto.Verify(p.PublicKey, p.SignedData(), p.Signature)
+}
+
+// diffManifests returns the entries of next that are new or differ from
+// prev, and the paths of prev that next no longer has, each sorted by path
+func diffManifests(prev, next Manifest) (added, changed []ManifestEntry, removed []string) {
+	old := make(map[string]ManifestEntry, len(prev.Entries))
+	for _, e := range prev.Entries {
+		old[e.Path] = e
+	}
+	seen := make(map[string]bool, len(next.Entries))
+	for _, e := range next.Entries {
+		seen[e.Path] = true
+		before, ok := old[e.Path]
+		switch {
+		case !ok:
+			added = append(added, e)
+		case before.Hash != e.Hash || before.Link != e.Link || before.Mode != e.Mode || !before.ModTime.Equal(e.ModTime):
+			changed = append(changed, e)
+		}
+	}
+	for _, e := range prev.Entries {
+		if !seen[e.Path] {
+			removed = append(removed, e.Path)
+		}
+	}
+
+	sort.Slice(added, func(i, j int) bool { return added[i].Path < added[j].Path })
+	sort.Slice(changed, func(i, j int) bool { return changed[i].Path < changed[j].Path })
+	sort.Strings(removed)
+	return added, changed, removed
+}
+
+// syncRecord is the manifest a destination directory was last restored
+// from, and the state the restore left each of its entries in
+type syncRecord struct {
+	Manifest  string                  `json:"manifest"`
+	PublicKey []byte                  `json:"public_key,omitempty"` // key of the manifest's publisher
+	Files     map[string]restoredFile `json:"files,omitempty"`
+}
+
+// restoredFile is what a restored entry looked like on disk right after it
+// was written, so a later sync can tell whether it was changed since
+type restoredFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Link    string    `json:"link,omitempty"`
+}
+
+// restoredState reads the state of the entry at path under dest
+func restoredState(dest, path string) (restoredFile, error) {
+	target := filepath.Join(dest, filepath.FromSlash(path))
+	info, err := os.Lstat(target)
+	if err != nil {
+		return restoredFile{}, err
+	}
+	state := restoredFile{Size: info.Size(), ModTime: info.ModTime()}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if state.Link, err = os.Readlink(target); err != nil {
+			return restoredFile{}, err
+		}
+	}
+	return state, nil
+}
+
+// changedLocally reports whether the entry at path under dest differs from
+// the state recorded for it. A path without a record must not exist.
+func (r syncRecord) changedLocally(dest, path string) bool {
+	state, err := restoredState(dest, path)
+	want, ok := r.Files[path]
+	if !ok {
+		return !errors.Is(err, fs.ErrNotExist)
+	}
+	return err != nil || state.Size != want.Size || !state.ModTime.Equal(want.ModTime) || state.Link != want.Link
+}
+
+// record notes the state the entry at path under dest was left in
+func (r syncRecord) record(dest, path string) {
+	if state, err := restoredState(dest, path); err == nil {
+		r.Files[path] = state
+	} else {
+		delete(r.Files, path)
+	}
+}
+
+// syncStore remembers the latest manifest of each imported directory and of
+// each restored destination, and the change sets linking manifest versions.
+// It is persisted as JSON.
+type syncStore struct {
+	path       string
+	mu         sync.Mutex
+	imports    map[string]string     // absolute source directory -> manifest
+	restores   map[string]syncRecord // absolute destination -> record
+	changeSets map[string]ChangeSet  // changeSetKey -> change set from its base
+}
+
+// changeSetKey indexes change sets by manifest and signer, so a change set
+// forged by another node can't displace the publisher's
+func changeSetKey(manifest string, key []byte) string {
+	return manifest + "/" + crypto.Fingerprint(key)
+}
+
+type syncFile struct {
+	Imports    map[string]string     `json:"imports"`
+	Restores   map[string]syncRecord `json:"restores"`
+	ChangeSets []ChangeSet           `json:"change_sets"`
+}
+
+// loadSync reads the sync state at path, starting empty if it does not exist
+func loadSync(path string) (*syncStore, error) {
+	s := &syncStore{
+		path:       path,
+		imports:    make(map[string]string),
+		restores:   make(map[string]syncRecord),
+		changeSets: make(map[string]ChangeSet),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sync state: %w", err)
+	}
+
+	var file syncFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse sync state: %w", err)
+	}
+	for dir, hash := range file.Imports {
+		s.imports[dir] = hash
+	}
+	for dir, record := range file.Restores {
+		s.restores[dir] = record
+	}
+	for _, c := range file.ChangeSets {
+		s.changeSets[changeSetKey(c.Manifest, c.PublicKey)] = c
+	}
+	return s, nil
+}
+
+func (s *syncStore) saveLocked() error {
+	file := syncFile{
+		Imports:    s.imports,
+		Restores:   s.restores,
+		ChangeSets: make([]ChangeSet, 0, len(s.changeSets)),
+	}
+	for _, c := range s.changeSets {
+		file.ChangeSets = append(file.ChangeSets, c)
+	}
+	sort.Slice(file.ChangeSets, func(i, j int) bool {
+		return changeSetKey(file.ChangeSets[i].Manifest, file.ChangeSets[i].PublicKey) < changeSetKey(file.ChangeSets[j].Manifest, file.ChangeSets[j].PublicKey)
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sync state: %w", err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+func (s *syncStore) lastImport(dir string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.imports[dir]
+}
+
+func (s *syncStore) imported(dir, manifest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.imports[dir] = manifest
+	return s.saveLocked()
+}
+
+func (s *syncStore) lastRestore(dest string) (syncRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.restores[dest]
+	return record, ok
+}
+
+func (s *syncStore) restored(dest string, record syncRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.restores[dest] = record
+	return s.saveLocked()
+}
+
+// addChangeSet stores a verified change set, reporting whether it was new
+func (s *syncStore) addChangeSet(c ChangeSet) (bool, error) {
+	if !c.Verify() {
+		return false, fmt.Errorf("invalid signature on change set for %s", c.Manifest)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := changeSetKey(c.Manifest, c.PublicKey)
+	if _, ok := s.changeSets[key]; ok {
+		return false, nil
+	}
+	s.changeSets[key] = c
+	return true, s.saveLocked()
+}
+
+// chain returns the change sets leading from base to manifest, oldest
+// first. Every change set must be signed with key.
+func (s *syncStore) chain(base, manifest string, key []byte) ([]ChangeSet, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sets []ChangeSet
+	for hash := manifest; hash != base; {
+		c, ok := s.changeSets[changeSetKey(hash, key)]
+		if !ok || len(sets) == maxChangeChain {
+			return nil, false
+		}
+		sets = append(sets, c)
+		hash = c.Base
+	}
+	for i, j := 0, len(sets)-1; i < j; i, j = i+1, j-1 {
+		sets[i], sets[j] = sets[j], sets[i]
+	}
+	return sets, true
+}
+
+// loadManifest reads and decodes a locally stored manifest
+func (n *Node) loadManifest(hash string) (Manifest, error) {
+	var buf bytes.Buffer
+	if err := n.readObject(hash, &buf); err != nil {
+		return Manifest{}, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil || manifest.Root == "" {
+		return Manifest{}, fmt.Errorf("object %s is not a valid manifest", hash)
+	}
+	return manifest, nil
+}
+
+// publishChangeSet signs a change set of this node's import and
+// propagates it to peers
+func (n *Node) publishChangeSet(c ChangeSet) error {
+	c.PublicKey = n.identity.Public
+	p := c.payload()
+	c.Signature = n.identity.Sign(p.SignedData())
+
+	if _, err := n.sync.addChangeSet(c); err != nil {
+		return err
+	}
+	if err := n.sendChangeSet(nil, c); err != nil {
+		fmt.Printf("Failed to propagate change set: %v\n", err)
+	}
+	return nil
+}
+
+// sendChangeSet sends a change set to one peer, or to every connected peer
+// when peer is nil
+func (n *Node) sendChangeSet(peer *network.Peer, c ChangeSet) error {
+	msg, err := protocol.NewMessage(protocol.MessageTypeChangeSet, n.ID, c.payload())
+	if err != nil {
+		return err
+	}
+	if peer == nil {
+		return n.broadcast("change set", msg)
+	}
+	return peer.Send(msg)
+}
+
+// handleChangeSet keeps change sets not seen before and passes them on
+func (n *Node) handleChangeSet(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.ChangeSet
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse change set: %w", err)
+	}
+
+	c := changeSetFromPayload(payload)
+	added, err := n.sync.addChangeSet(c)
+	if err != nil {
+		return fmt.Errorf("rejected change set from %s: %w", msg.SenderID, err)
+	}
+	if !added {
+		return nil
+	}
+	return n.sendChangeSet(nil, c)
+}
+
+// syncRestore updates a destination previously restored from an earlier
+// version of manifest by applying only the changes since, without fetching
+// the manifest itself. It reports false if no chain of change sets signed
+// by the manifest's publisher leads there from the destination's version.
+func (n *Node) syncRestore(manifest, dest string) (*RestoreResult, bool) {
+	record, ok := n.sync.lastRestore(dest)
+	if !ok || len(record.PublicKey) == 0 || record.Files == nil {
+		return nil, false
+	}
+	sets, ok := n.sync.chain(record.Manifest, manifest, record.PublicKey)
+	if !ok {
+		return nil, false
+	}
+	files := make(map[string]restoredFile, len(record.Files))
+	for path, state := range record.Files {
+		files[path] = state
+	}
+	record.Files = files
+
+	// Collapse the versions into the final state of each touched path
+	final := make(map[string]*ManifestEntry)
+	for _, c := range sets {
+		for _, list := range [][]ManifestEntry{c.Added, c.Changed} {
+			for i := range list {
+				final[list[i].Path] = &list[i]
+			}
+		}
+		for _, path := range c.Removed {
+			final[path] = nil
+		}
+	}
+	result := &RestoreResult{Incremental: true}
+	var entries []ManifestEntry
+	var removed []string
+	for path, e := range final {
+		// Files changed in the destination since they were restored are
+		// left as they are rather than overwritten or removed
+		if record.changedLocally(dest, path) {
+			result.Skipped++
+			delete(record.Files, path)
+			continue
+		}
+		if e == nil {
+			removed = append(removed, path)
+		} else {
+			entries = append(entries, *e)
+		}
+	}
+	sort.Strings(removed)
+	sort.Slice(entries, func(i, j int) bool {
+		// Links last, as in a full restore
+		if (entries[i].Link == "") != (entries[j].Link == "") {
+			return entries[i].Link == ""
+		}
+		return entries[i].Path < entries[j].Path
+	})
+
+	for _, path := range removed {
+		target, err := pathUnder(dest, path)
+		if errors.Is(err, errOutsideDest) {
+			continue
+		}
+		if err == nil {
+			err = os.Remove(target)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", path, err))
+			continue
+		}
+		delete(record.Files, path)
+		result.Removed++
+	}
+	for _, entry := range entries {
+		if err := n.restoreEntry(entry, dest); err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", entry.Path, err))
+			continue
+		}
+		record.record(dest, entry.Path)
+		result.Files++
+		result.Bytes += entry.Size
+	}
+
+	// The state of what was written is kept even if some entries failed,
+	// so retrying the sync doesn't mistake them for local changes
+	if result.Failed == 0 {
+		record.Manifest = manifest
+	}
+	if err := n.sync.restored(dest, record); err != nil {
+		fmt.Printf("Failed to record sync of %s: %v\n", dest, err)
+	}
+	return result, true
+}
@@ -0,0 +1,216 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffManifests(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	prev := Manifest{Entries: []ManifestEntry{
+		{Path: "a.txt", Hash: "h1", Mode: 0644, ModTime: modTime},
+		{Path: "b.txt", Hash: "h2", Mode: 0644, ModTime: modTime},
+		{Path: "c.txt", Hash: "h3", Mode: 0644, ModTime: modTime},
+		{Path: "link", Link: "a.txt", ModTime: modTime},
+	}}
+	next := Manifest{Entries: []ManifestEntry{
+		{Path: "a.txt", Hash: "h1", Mode: 0644, ModTime: modTime},
+		{Path: "b.txt", Hash: "h2", Mode: 0600, ModTime: modTime},
+		{Path: "d.txt", Hash: "h4", Mode: 0644, ModTime: modTime},
+		{Path: "link", Link: "d.txt", ModTime: modTime},
+	}}
+
+	added, changed, removed := diffManifests(prev, next)
+	if len(added) != 1 || added[0].Path != "d.txt" {
+		t.Errorf("added = %+v, want d.txt", added)
+	}
+	var paths []string
+	for _, e := range changed {
+		paths = append(paths, e.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"b.txt", "link"}) {
+		t.Errorf("changed = %v, want [b.txt link]", paths)
+	}
+	if !reflect.DeepEqual(removed, []string{"c.txt"}) {
+		t.Errorf("removed = %v, want [c.txt]", removed)
+	}
+}
+
+func TestNode_IncrementalSync(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	src := filepath.Join(baseDir, "src")
+	write := func(name, content string) {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		writeTestFile(t, path, content)
+	}
+	write("keep.txt", "unchanged")
+	write("edit.txt", "before")
+	write("sub/gone.txt", "removed later")
+
+	first, err := node.Import(src)
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	dest := filepath.Join(baseDir, "restored")
+	if result, err := node.Restore(first.Manifest, dest); err != nil || result.Incremental {
+		t.Fatalf("Restore() = %+v, %v, want a full restore", result, err)
+	}
+
+	// Re-importing an unchanged tree keeps the manifest
+	again, err := node.Import(src)
+	if err != nil {
+		t.Fatalf("Failed to re-import: %v", err)
+	}
+	if again.Manifest != first.Manifest || again.Base != first.Manifest {
+		t.Errorf("Re-import manifest = %s (base %s), want %s", again.Manifest, again.Base, first.Manifest)
+	}
+
+	write("edit.txt", "after the edit")
+	write("new.txt", "added")
+	if err := os.Remove(filepath.Join(src, "sub", "gone.txt")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	second, err := node.Import(src)
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if second.Base != first.Manifest || second.Added != 1 || second.Changed != 1 || second.Removed != 1 {
+		t.Errorf("Import = base %s, %d added, %d changed, %d removed, want %s, 1, 1, 1",
+			second.Base, second.Added, second.Changed, second.Removed, first.Manifest)
+	}
+
+	// Only the changes are applied, without the new manifest
+	if err := node.store.Delete(second.Manifest); err != nil {
+		t.Fatalf("Failed to delete manifest: %v", err)
+	}
+	result, err := node.Restore(second.Manifest, dest)
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if !result.Incremental || result.Files != 2 || result.Removed != 1 || result.Failed != 0 {
+		t.Errorf("Restore = %+v, want incremental with 2 files and 1 removed", result)
+	}
+	for name, want := range map[string]string{"keep.txt": "unchanged", "edit.txt": "after the edit", "new.txt": "added"} {
+		data, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dest, "sub", "gone.txt")); !os.IsNotExist(err) {
+		t.Errorf("Removed file still present: %v", err)
+	}
+}
+
+func TestNode_SyncLeavesLocalChanges(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	src := filepath.Join(baseDir, "src")
+	dest := filepath.Join(baseDir, "restored")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	for _, name := range []string{"edited.txt", "synced.txt", "removed.txt"} {
+		writeTestFile(t, filepath.Join(src, name), "original "+name)
+	}
+	first, err := node.Import(src)
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if _, err := node.Restore(first.Manifest, dest); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+
+	// Change the destination, then publish changes to the same paths
+	local := map[string]string{"edited.txt": "edited here", "removed.txt": "kept here", "added.txt": "made here"}
+	for name, content := range local {
+		writeTestFile(t, filepath.Join(dest, name), content)
+	}
+	for _, name := range []string{"edited.txt", "synced.txt", "added.txt"} {
+		writeTestFile(t, filepath.Join(src, name), "published "+name)
+	}
+	if err := os.Remove(filepath.Join(src, "removed.txt")); err != nil {
+		t.Fatalf("Failed to remove file: %v", err)
+	}
+	second, err := node.Import(src)
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+
+	result, err := node.Restore(second.Manifest, dest)
+	if err != nil {
+		t.Fatalf("Failed to sync: %v", err)
+	}
+	if !result.Incremental || result.Files != 1 || result.Skipped != 3 || result.Removed != 0 || result.Failed != 0 {
+		t.Errorf("Restore = %+v, want incremental with 1 file and 3 skipped", result)
+	}
+	local["synced.txt"] = "published synced.txt"
+	for name, want := range local {
+		data, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+}
+
+func TestChangeSet_Verify(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	c := ChangeSet{
+		Root:     "site",
+		Base:     "base0123",
+		Manifest: "next0123",
+		Created:  time.Now().UTC().Truncate(time.Second),
+		Added:    []ManifestEntry{{Path: "a.txt", Hash: "h1", Size: 3, Mode: 0644, ModTime: time.Now().UTC()}},
+		Removed:  []string{"b.txt"},
+	}
+	if err := node.publishChangeSet(c); err != nil {
+		t.Fatalf("Failed to publish change set: %v", err)
+	}
+	stored, ok := node.sync.chain("base0123", "next0123", node.identity.Public)
+	if !ok || len(stored) != 1 || !stored[0].Verify() {
+		t.Fatalf("chain() = %+v, %v, want the published change set", stored, ok)
+	}
+
+	// The signature covers the entries
+	forged := stored[0]
+	forged.Removed = []string{"keep.txt"}
+	if forged.Verify() {
+		t.Error("Expected a change set with altered entries to fail verification")
+	}
+	if _, err := node.sync.addChangeSet(forged); err == nil {
+		t.Error("Expected error adding a forged change set")
+	}
+
+	// Round-tripping through the wire format keeps the signature valid
+	if !changeSetFromPayload(stored[0].payload()).Verify() {
+		t.Error("Change set failed verification after round-tripping")
+	}
+}
@@ -0,0 +1,85 @@
+package node
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultWatchDebounce is how long a path in the watch directory must go
+// without events before it is ingested
+const DefaultWatchDebounce = 250 * time.Millisecond
+
+// debouncer coalesces bursts of events per path into a single call of fire,
+// made once the path has been quiet for the delay
+type debouncer struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	pending map[string]*debounced
+	fire    func(path string)
+	stopped bool
+}
+
+// debounced is the timer of one path; a timer replaced while it was firing
+// no longer matches its path's entry and does nothing
+type debounced struct {
+	timer *time.Timer
+}
+
+func newDebouncer(delay time.Duration, fire func(path string)) *debouncer {
+	return &debouncer{
+		delay:   delay,
+		pending: make(map[string]*debounced),
+		fire:    fire,
+	}
+}
+
+// touch records an event for path, postponing its call until the path has
+// been quiet for the delay
+func (d *debouncer) touch(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.stopped {
+		return
+	}
+	if entry, ok := d.pending[path]; ok && entry.timer.Stop() {
+		entry.timer.Reset(d.delay)
+		return
+	}
+	entry := &debounced{}
+	entry.timer = time.AfterFunc(d.delay, func() {
+		d.mu.Lock()
+		current := d.pending[path] == entry
+		if current {
+			delete(d.pending, path)
+		}
+		d.mu.Unlock()
+		if current {
+			d.fire(path)
+		}
+	})
+	d.pending[path] = entry
+}
+
+// cancel drops a pending call for path, such as when the file was removed
+func (d *debouncer) cancel(path string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if entry, ok := d.pending[path]; ok {
+		entry.timer.Stop()
+		delete(d.pending, path)
+	}
+}
+
+// stop drops every pending call; later events are ignored
+func (d *debouncer) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.stopped = true
+	for path, entry := range d.pending {
+		entry.timer.Stop()
+		delete(d.pending, path)
+	}
+}
@@ -0,0 +1,58 @@
+package node
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDebouncer(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		fired = make(map[string]int)
+	)
+	d := newDebouncer(50*time.Millisecond, func(path string) {
+		mu.Lock()
+		fired[path]++
+		mu.Unlock()
+	})
+	defer d.stop()
+	count := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return fired[path]
+	}
+
+	// A burst spread over more than the delay still fires once
+	for i := 0; i < 10; i++ {
+		d.touch("a")
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.touch("b")
+	d.touch("removed")
+	d.cancel("removed")
+	if got := count("a"); got != 0 {
+		t.Errorf("Calls for a during the burst = %d, want 0", got)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	for path, want := range map[string]int{"a": 1, "b": 1, "removed": 0} {
+		if got := count(path); got != want {
+			t.Errorf("Calls for %s = %d, want %d", path, got, want)
+		}
+	}
+
+	// A later change fires again
+	d.touch("a")
+	time.Sleep(200 * time.Millisecond)
+	if got := count("a"); got != 2 {
+		t.Errorf("Calls for a after a second change = %d, want 2", got)
+	}
+
+	d.stop()
+	d.touch("c")
+	time.Sleep(100 * time.Millisecond)
+	if got := count("c"); got != 0 {
+		t.Errorf("Calls for c after stop = %d, want 0", got)
+	}
+}
@@ -0,0 +1,127 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// ErrDraining is returned when new content is offered to a node that is
+// being decommissioned
+var ErrDraining = errors.New("node is decommissioning and not accepting new content")
+
+// DecommissionResult summarizes an attempt to drain the node
+type DecommissionResult struct {
+	Objects int // locally stored objects
+	Copies  int // new replicas created on peers
+	// SoleCopies are objects no other live peer holds; they would be lost
+	// if the node left now
+	SoleCopies []string
+	// UnderTarget are objects that survive the node leaving but will have
+	// fewer replicas than the target
+	UnderTarget []string
+	Errors      []string
+	// Safe is set once every object has a live copy on another peer and the
+	// node has announced its departure
+	Safe bool
+}
+
+// Decommission prepares the node for permanent removal. It stops accepting
+// new content, pushes every object that would fall below the replication
+// target without this node to other peers, and, once no object depends on
+// this node alone, announces its departure. The node keeps draining after an
+// unsafe result so the call can simply be repeated, for example once more
+// peers are connected. progress, if non-nil, is called with the status of
+// each object that needed copies.
+func (n *Node) Decommission(progress func(ReplicaStatus)) (DecommissionResult, error) {
+	var result DecommissionResult
+	n.draining.Store(true)
+
+	hashes, err := n.store.Hashes()
+	if err != nil {
+		return result, fmt.Errorf("failed to list store: %w", err)
+	}
+	result.Objects = len(hashes)
+
+	for _, hash := range hashes {
+		// Count only the copies that remain once this node is gone
+		status := n.Replicas(hash)
+		status.Replicas = len(status.Holders)
+		if status.UnderReplicated() {
+			copies, err := n.repairObject(status)
+			result.Copies += copies
+			if err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", hash, err))
+			}
+			if progress != nil {
+				progress(n.Replicas(hash))
+			}
+		}
+
+		switch remaining := len(n.Replicas(hash).Holders); {
+		case remaining == 0:
+			result.SoleCopies = append(result.SoleCopies, hash)
+		case remaining < status.Target:
+			result.UnderTarget = append(result.UnderTarget, hash)
+		}
+	}
+
+	if len(result.SoleCopies) > 0 {
+		return result, nil
+	}
+	if err := n.announceLeave(); err != nil {
+		return result, err
+	}
+	result.Safe = true
+	return result, nil
+}
+
+// Draining reports whether the node is being decommissioned
+func (n *Node) Draining() bool {
+	return n.draining.Load()
+}
+
+// announceLeave tells every peer that this node is leaving
+func (n *Node) announceLeave() error {
+	msg, err := protocol.NewMessage(protocol.MessageTypeLeave, n.ID, protocol.LeavePayload{NodeID: n.ID})
+	if err != nil {
+		return err
+	}
+	if err := n.broadcast("departure", msg); err != nil {
+		return fmt.Errorf("failed to announce departure: %w", err)
+	}
+	return nil
+}
+
+// handleLeave forgets the node on the connection, which announced it is
+// leaving; a node can only announce its own departure
+func (n *Node) handleLeave(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.LeavePayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse leave: %w", err)
+	}
+	id := n.nodeID(peer)
+	if id == "" || payload.NodeID != id {
+		return fmt.Errorf("departure of %s announced by %s", payload.NodeID, peer.ID())
+	}
+
+	n.mu.Lock()
+	n.forgetPeerLocked(peer.ID())
+	n.mu.Unlock()
+	n.replicas.forget(id)
+	n.overlay.forget(id)
+	n.peerDB.forget(id)
+
+	fmt.Printf("Peer %s left the network\n", id)
+	n.emit(Event{Type: EventPeerLeft, PeerID: id})
+
+	// Objects the departed node held may now be under-replicated
+	if n.replicationConfig.Interval > 0 {
+		if _, err := n.checkReplication(); err != nil {
+			fmt.Printf("Replication check failed: %v\n", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestNode_DecommissionRefusesSoleCopies(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "only here")
+	hash, err := node.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	result, err := node.Decommission(nil)
+	if err != nil {
+		t.Fatalf("Failed to decommission: %v", err)
+	}
+	if result.Safe {
+		t.Error("Safe = true with a sole copy on the node")
+	}
+	if len(result.SoleCopies) != 1 || result.SoleCopies[0] != hash {
+		t.Errorf("SoleCopies = %v, want [%s]", result.SoleCopies, hash)
+	}
+	if !node.Draining() {
+		t.Error("Draining() = false after decommission")
+	}
+
+	if _, err := node.StoreFile(path); !errors.Is(err, ErrDraining) {
+		t.Errorf("StoreFile() error = %v, want %v", err, ErrDraining)
+	}
+	if _, err := node.Import(baseDir); !errors.Is(err, ErrDraining) {
+		t.Errorf("Import() error = %v, want %v", err, ErrDraining)
+	}
+}
+
+func TestNode_DecommissionEmptyNode(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	result, err := node.Decommission(nil)
+	if err != nil {
+		t.Fatalf("Failed to decommission: %v", err)
+	}
+	if !result.Safe || result.Objects != 0 {
+		t.Errorf("result = %+v, want a safe result with no objects", result)
+	}
+}
+
+func TestNode_DecommissionHandsOffToPeer(t *testing.T) {
+	t.Run("inventories", func(t *testing.T) { testDecommissionHandsOff(t, time.Hour) })
+	// Without inventories, the copy is confirmed by the peer's receipt
+	t.Run("receipts", func(t *testing.T) { testDecommissionHandsOff(t, 0) })
+}
+
+func testDecommissionHandsOff(t *testing.T, interval time.Duration) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	cfg := ReplicationConfig{Target: 1, Interval: interval}
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "hand me off")
+	hash, err := first.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	events, unsubscribe := second.Subscribe()
+	defer unsubscribe()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	result, err := first.Decommission(nil)
+	if err != nil {
+		t.Fatalf("Failed to decommission: %v", err)
+	}
+	if !result.Safe || result.Copies != 1 {
+		t.Errorf("result = %+v, want a safe result after 1 copy", result)
+	}
+	if !second.store.Exists(hash) {
+		t.Error("Object was not handed off to the peer")
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.Type != EventPeerLeft {
+				continue
+			}
+			if event.PeerID != "first" {
+				t.Errorf("PeerID = %s, want first", event.PeerID)
+			}
+			for _, p := range second.Peers() {
+				if p.ID == "first" {
+					t.Error("Departed peer is still listed")
+				}
+			}
+			return
+		case <-timeout:
+			t.Fatal("Timed out waiting for the departure announcement")
+		}
+	}
+}
+
+func TestNode_LeaveOnlyForItself(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	peer, ok := first.peerConn("second")
+	if !ok {
+		t.Fatal("First node is not connected to the second")
+	}
+	key := []byte("test seal key")
+	peer.SealStamps(key, key)
+
+	// The second node announces the departure of a node it isn't
+	msg, err := protocol.NewMessage(protocol.MessageTypeLeave, "third", protocol.LeavePayload{NodeID: "third"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	second.sign(msg)
+	first.peerDB.seen(PeerInfo{ID: "third", Address: "x:1"})
+	if err := first.HandleMessage(peer, sealWith(t, msg, key)); err == nil {
+		t.Error("HandleMessage() of another node's departure succeeded")
+	}
+	for _, known := range first.KnownPeers() {
+		if known.ID == "third" {
+			return
+		}
+	}
+	t.Error("The node named in the departure was forgotten")
+}
@@ -0,0 +1,343 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/delta"
+	"p2p-storage/internal/metrics"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// maxDeltaFileSize bounds the files sent as deltas, since both versions are
+// held in memory and the delta goes in one message. A delta is smaller than
+// its file, so even base64 encoded it fits in network.DefaultMaxFrameSize.
+// Larger files are always sent whole.
+const maxDeltaFileSize = 8 << 20
+
+// deltaTimeout is how long a requested delta may take to arrive before the
+// whole object is requested instead
+const deltaTimeout = DefaultFetchTimeout
+
+// pendingDeltas falls back to fetching whole objects whose requested deltas
+// don't arrive in time, such as from a peer that can't fit them in a frame
+type pendingDeltas struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer // by content hash
+}
+
+func newPendingDeltas() *pendingDeltas {
+	return &pendingDeltas{timers: make(map[string]*time.Timer)}
+}
+
+// wait calls fallback unless the delta for hash arrives within timeout
+func (p *pendingDeltas) wait(hash string, timeout time.Duration, fallback func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old, ok := p.timers[hash]; ok {
+		old.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		p.mu.Lock()
+		current := p.timers[hash] == timer
+		if current {
+			delete(p.timers, hash)
+		}
+		p.mu.Unlock()
+		if current {
+			fallback()
+		}
+	})
+	p.timers[hash] = timer
+}
+
+// arrived stops waiting for the delta for hash
+func (p *pendingDeltas) arrived(hash string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if timer, ok := p.timers[hash]; ok {
+		timer.Stop()
+		delete(p.timers, hash)
+	}
+}
+
+// deltaStats counts delta transfers received
+type deltaStats struct {
+	applied  metrics.Counter
+	fallback metrics.Counter
+	saved    metrics.Counter // bytes not transferred thanks to deltas
+}
+
+// requestDelta asks a peer for an object as a delta against basis, an older
+// version of the same file held locally. The block signature of the basis
+// is encrypted so only members of the network can read it.
+func (n *Node) requestDelta(peer *network.Peer, hash, basis, trace string) error {
+	size, err := n.store.Size(basis)
+	if err != nil {
+		return err
+	}
+	if size > maxDeltaFileSize {
+		return fmt.Errorf("previous version is larger than %d bytes", maxDeltaFileSize)
+	}
+
+	var plain bytes.Buffer
+	if err := n.readObject(basis, &plain); err != nil {
+		return err
+	}
+	sig, err := delta.Sign(&plain, delta.BlockSize(size))
+	if err != nil {
+		return err
+	}
+	encoded, err := sig.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	sealed, err := n.seal(encoded)
+	if err != nil {
+		return err
+	}
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeDeltaRequest, n.ID, protocol.DeltaRequest{
+		ContentHash: hash,
+		Basis:       basis,
+		Signature:   sealed,
+	})
+	if err != nil {
+		return err
+	}
+	msg.TraceID = trace
+	if err := peer.Send(msg); err != nil {
+		return err
+	}
+	n.pendingDeltas.wait(hash, deltaTimeout, func() {
+		if n.store.Exists(hash) {
+			return
+		}
+		fmt.Printf("Fetching all of %s instead of a delta: none within %v\n", hash, deltaTimeout)
+		n.deltas.fallback.Inc()
+		if err := n.requestObject(peer, hash, true, trace); err != nil {
+			fmt.Printf("Failed to request %s: %v\n", hash, err)
+		}
+	})
+	return nil
+}
+
+// handleDeltaRequest answers with the delta from the requester's version,
+// or with an error telling it to fetch the whole object
+func (n *Node) handleDeltaRequest(peer *network.Peer, msg *protocol.Message) error {
+	var request protocol.DeltaRequest
+	if err := msg.ParsePayload(&request); err != nil {
+		return fmt.Errorf("failed to parse delta request: %w", err)
+	}
+
+	id := n.nodeID(peer)
+	reply := protocol.Delta{ContentHash: request.ContentHash, Basis: request.Basis}
+	if err := n.computeDelta(id, request, &reply); err != nil {
+		reply = protocol.Delta{ContentHash: request.ContentHash, Basis: request.Basis, Error: err.Error()}
+	}
+
+	out, err := protocol.NewMessage(protocol.MessageTypeDelta, n.ID, reply)
+	if err != nil {
+		return err
+	}
+	out.TraceID = msg.TraceID
+	if err := peer.Send(out); err != nil {
+		return err
+	}
+	n.ledger.record(id, int64(len(reply.Ops)), 0)
+	return nil
+}
+
+func (n *Node) computeDelta(peerID string, request protocol.DeltaRequest, reply *protocol.Delta) error {
+	if !n.store.Exists(request.ContentHash) {
+		return fmt.Errorf("%s is not stored", request.ContentHash)
+	}
+	if _, err := n.uploadRate(peerID); err != nil {
+		return err
+	}
+	size, err := n.store.Size(request.ContentHash)
+	if err != nil {
+		return err
+	}
+	if size > maxDeltaFileSize+crypto.IVSize {
+		return fmt.Errorf("object is larger than %d bytes", maxDeltaFileSize)
+	}
+
+	encoded, err := n.unseal(request.Signature)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt signature: %w", err)
+	}
+	sig, err := delta.ParseSignature(encoded)
+	if err != nil {
+		return err
+	}
+
+	key, err := n.objectKey(request.ContentHash)
+	if err != nil {
+		return err
+	}
+	var iv []byte
+	if key != nil {
+		reader, err := n.store.Load(request.ContentHash)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		iv = make([]byte, crypto.IVSize)
+		if _, err := io.ReadFull(reader, iv); err != nil {
+			return fmt.Errorf("failed to read IV: %w", err)
+		}
+	}
+	var target bytes.Buffer
+	if err := n.readObjectWith(request.ContentHash, key, &target); err != nil {
+		return err
+	}
+
+	ops := delta.EncodeOps(delta.Compute(sig, target.Bytes()))
+	if len(ops) >= target.Len() {
+		return errors.New("delta is no smaller than the object")
+	}
+	sealed, err := n.seal(ops)
+	if err != nil {
+		return err
+	}
+
+	n.popularity.record(request.ContentHash, true)
+	reply.BlockSize = sig.BlockSize
+	reply.IV = iv
+	reply.Ops = sealed
+	return nil
+}
+
+// handleDelta rebuilds an object from a delta and the local basis. If that
+// fails for any reason, the whole object is requested instead.
+func (n *Node) handleDelta(peer *network.Peer, msg *protocol.Message) error {
+	var reply protocol.Delta
+	if err := msg.ParsePayload(&reply); err != nil {
+		return fmt.Errorf("failed to parse delta: %w", err)
+	}
+	n.pendingDeltas.arrived(reply.ContentHash)
+	if n.store.Exists(reply.ContentHash) {
+		return nil
+	}
+	n.ledger.record(n.nodeID(peer), 0, int64(len(reply.Ops)))
+
+	if err := n.applyDelta(reply); err != nil {
+		if errors.Is(err, ErrHashMismatch) {
+			n.scorePeer(peer, scoreHashMismatch)
+		}
+		fmt.Printf("Fetching all of %s instead of a delta: %v\n", reply.ContentHash, err)
+		n.deltas.fallback.Inc()
+		return n.requestObject(peer, reply.ContentHash, true, msg.TraceID)
+	}
+
+	n.deltas.applied.Inc()
+	n.confirmReplica(peer, reply.ContentHash)
+	n.sendReceipt(peer, reply.ContentHash)
+	n.passOn(reply.ContentHash)
+	return nil
+}
+
+func (n *Node) applyDelta(reply protocol.Delta) error {
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	encoded, err := n.unseal(reply.Ops)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt delta: %w", err)
+	}
+	ops, err := delta.DecodeOps(encoded)
+	if err != nil {
+		return err
+	}
+	if reply.BlockSize < 1 || reply.BlockSize > delta.MaxBlockSize {
+		return fmt.Errorf("invalid block size %d", reply.BlockSize)
+	}
+
+	var basis bytes.Buffer
+	if err := n.readObject(reply.Basis, &basis); err != nil {
+		return err
+	}
+	var rebuilt bytes.Buffer
+	sig := &delta.Signature{BlockSize: reply.BlockSize, Size: int64(basis.Len())}
+	if err := delta.Apply(bytes.NewReader(basis.Bytes()), sig, ops, &rebuilt); err != nil {
+		return err
+	}
+	size := int64(rebuilt.Len())
+
+	key, err := n.objectKey(reply.ContentHash)
+	if err != nil {
+		return err
+	}
+	object := &rebuilt
+	if key != nil {
+		// Encrypting with the sender's IV reproduces its ciphertext exactly
+		object = new(bytes.Buffer)
+		if err := crypto.EncryptStreamWithIV(key, reply.IV, &rebuilt, object); err != nil {
+			return err
+		}
+	}
+	hash, err := crypto.ContentHash(bytes.NewReader(object.Bytes()))
+	if err != nil {
+		return err
+	}
+	if hash != reply.ContentHash {
+		return ErrHashMismatch
+	}
+	if err := n.store.Store(hash, object); err != nil {
+		return fmt.Errorf("failed to store file: %w", err)
+	}
+
+	if saved := size - int64(len(reply.Ops)); saved > 0 {
+		n.deltas.saved.Add(saved)
+	}
+	n.emit(Event{Type: EventFileStored, ContentHash: hash, Size: size})
+	fmt.Printf("File stored from a delta against %s with hash: %s\n", reply.Basis, hash)
+	return nil
+}
+
+// seal encrypts a small message body with the network key
+func (n *Node) seal(data []byte) ([]byte, error) {
+	n.mu.RLock()
+	key := n.networkKey
+	n.mu.RUnlock()
+
+	var out bytes.Buffer
+	if err := crypto.EncryptStream(key, bytes.NewReader(data), &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// unseal decrypts a message body encrypted with seal
+func (n *Node) unseal(data []byte) ([]byte, error) {
+	n.mu.RLock()
+	key := n.networkKey
+	n.mu.RUnlock()
+
+	var out bytes.Buffer
+	if err := crypto.DecryptStream(key, bytes.NewReader(data), &out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// registerDeltaMetrics exposes delta transfer counters
+func (n *Node) registerDeltaMetrics() {
+	n.metrics.Register("p2p_delta_transfers_total", "Objects requested as deltas by outcome", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{
+			{Labels: map[string]string{"result": "applied"}, Value: float64(n.deltas.applied.Value())},
+			{Labels: map[string]string{"result": "fallback"}, Value: float64(n.deltas.fallback.Value())},
+		}
+	})
+	n.metrics.Register("p2p_delta_bytes_saved_total", "Bytes not transferred because objects were sent as deltas", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.deltas.saved.Value())}}
+	})
+}
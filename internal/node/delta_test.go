@@ -0,0 +1,148 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/delta"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+func TestNode_DeltaTransfer(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	src := filepath.Join(baseDir, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	path := filepath.Join(src, "app.log")
+	content := make([]byte, 256<<10)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	version := func(data []byte) string {
+		t.Helper()
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if _, err := first.Import(src); err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+		for _, f := range first.Files() {
+			if f.Path == "app.log" && f.Size == int64(len(data)) {
+				return f.Hash
+			}
+		}
+		t.Fatal("Imported file not in catalog")
+		return ""
+	}
+	waitStored := func(hash string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !second.store.Exists(hash) {
+			if time.Now().After(deadline) {
+				t.Fatalf("Second node did not store %s", hash)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The first version is sent whole
+	waitStored(version(content))
+
+	// An append is sent as a delta against the first version
+	content = append(content, []byte("one more line\n")...)
+	appended := version(content)
+	if meta, _ := first.catalog.get(appended); meta.Previous == "" {
+		t.Error("New version does not name the previous one")
+	}
+	waitStored(appended)
+	if got := second.deltas.applied.Value(); got != 1 {
+		t.Errorf("Deltas applied = %d, want 1", got)
+	}
+	if saved := second.deltas.saved.Value(); saved < int64(len(content))/2 {
+		t.Errorf("Bytes saved = %d, want most of %d", saved, len(content))
+	}
+
+	// Unrelated content gains nothing from a delta; it is fetched whole
+	other := make([]byte, 64<<10)
+	rand.New(rand.NewSource(2)).Read(other)
+	waitStored(version(other))
+	if got := second.deltas.fallback.Value(); got != 1 {
+		t.Errorf("Delta fallbacks = %d, want 1", got)
+	}
+}
+
+func TestDelta_LargestFitsInFrame(t *testing.T) {
+	// The largest delta sent is just under the size of its file, sealed
+	ops := make([]byte, maxDeltaFileSize+crypto.IVSize)
+	msg, err := protocol.NewMessage(protocol.MessageTypeDelta, "sender", protocol.Delta{
+		ContentHash: strings.Repeat("a", 40),
+		Basis:       strings.Repeat("b", 40),
+		BlockSize:   delta.MaxBlockSize,
+		IV:          make([]byte, crypto.IVSize),
+		Ops:         ops,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		t.Fatalf("Failed to encode message: %v", err)
+	}
+	if len(data) > network.DefaultMaxFrameSize {
+		t.Errorf("Delta message is %d bytes, over the %d byte frame limit", len(data), network.DefaultMaxFrameSize)
+	}
+}
+
+func TestPendingDeltas(t *testing.T) {
+	p := newPendingDeltas()
+
+	fellBack := make(chan string, 2)
+	p.wait("late", 10*time.Millisecond, func() { fellBack <- "late" })
+	p.wait("arrives", 50*time.Millisecond, func() { fellBack <- "arrives" })
+	p.arrived("arrives")
+
+	select {
+	case hash := <-fellBack:
+		if hash != "late" {
+			t.Errorf("Fell back for %s, want late", hash)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No fallback for a delta that never arrived")
+	}
+	select {
+	case hash := <-fellBack:
+		t.Errorf("Fell back for %s, which arrived", hash)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
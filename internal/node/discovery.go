@@ -0,0 +1,168 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/metrics"
+)
+
+// DiscoveryConfig limits how quickly the node dials peers it learns about
+// from other peers, so a large mesh doesn't set off a connection storm
+type DiscoveryConfig struct {
+	// DialInterval is the minimum time between two discovery dials
+	DialInterval time.Duration
+	// MaxPeers stops discovery dials once the node has this many
+	// connections (0 = no cap)
+	MaxPeers int
+	// QueueSize bounds how many discovered peers may wait to be dialed;
+	// further discoveries are dropped until the queue drains
+	QueueSize int
+}
+
+// DefaultDiscoveryConfig returns a limit of five dials per second, up to 32
+// connections, with up to 256 peers waiting
+func DefaultDiscoveryConfig() DiscoveryConfig {
+	return DiscoveryConfig{
+		DialInterval: 200 * time.Millisecond,
+		MaxPeers:     32,
+		QueueSize:    256,
+	}
+}
+
+type discoveredPeer struct {
+	id        string
+	addresses []string // tried in order
+}
+
+// discoveryQueue dials discovered peers one at a time at a limited rate. A
+// peer that is already queued or being dialed, by ID or by address, is not
+// queued again.
+type discoveryQueue struct {
+	cfg     DiscoveryConfig
+	queue   chan discoveredPeer
+	mu      sync.Mutex
+	pending map[string]bool // node IDs and addresses queued or in flight
+	dropped metrics.Counter
+	dialed  metrics.Counter
+}
+
+func newDiscoveryQueue(cfg DiscoveryConfig) *discoveryQueue {
+	size := cfg.QueueSize
+	if size <= 0 {
+		size = 1
+	}
+	return &discoveryQueue{
+		cfg:     cfg,
+		queue:   make(chan discoveredPeer, size),
+		pending: make(map[string]bool),
+	}
+}
+
+// enqueue queues a discovered peer, reporting false if it is a duplicate or
+// the queue is full
+func (q *discoveryQueue) enqueue(p discoveredPeer) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.pending[p.id] {
+		return false
+	}
+	for _, address := range p.addresses {
+		if q.pending[address] {
+			return false
+		}
+	}
+	select {
+	case q.queue <- p:
+	default:
+		q.dropped.Inc()
+		return false
+	}
+	q.pending[p.id] = true
+	for _, address := range p.addresses {
+		q.pending[address] = true
+	}
+	return true
+}
+
+func (q *discoveryQueue) finish(p discoveredPeer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.pending, p.id)
+	for _, address := range p.addresses {
+		delete(q.pending, address)
+	}
+}
+
+// run dials queued peers until done is closed, which also abandons a dial in
+// progress. skip is consulted right before each dial, since a peer may have
+// connected while it waited in the queue.
+func (q *discoveryQueue) run(done <-chan struct{}, skip func(discoveredPeer) string, dial func(ctx context.Context, addresses []string) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-done
+		cancel()
+	}()
+
+	var last time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case p := <-q.queue:
+			if reason := skip(p); reason != "" {
+				fmt.Printf("Not dialing discovered peer %s: %s\n", p.id, reason)
+				q.finish(p)
+				continue
+			}
+
+			if wait := q.cfg.DialInterval - time.Since(last); wait > 0 {
+				select {
+				case <-done:
+					return
+				case <-time.After(wait):
+				}
+			}
+			last = time.Now()
+
+			q.dialed.Inc()
+			if err := dial(ctx, p.addresses); err != nil {
+				fmt.Printf("Failed to connect to discovered peer %s: %v\n", p.id, err)
+			} else {
+				fmt.Printf("Successfully connected to discovered peer %s\n", p.id)
+			}
+			q.finish(p)
+		}
+	}
+}
+
+// skipDiscovered returns why a queued peer should not be dialed, if it shouldn't
+func (n *Node) skipDiscovered(p discoveredPeer) string {
+	n.mu.RLock()
+	_, connected := n.peerKeys[p.id]
+	n.mu.RUnlock()
+	if connected {
+		return "already connected"
+	}
+	if limit := n.discoveryConfig.MaxPeers; limit > 0 && n.transport.PeerCount() >= limit {
+		return fmt.Sprintf("at the limit of %d peers", limit)
+	}
+	return ""
+}
+
+// registerDiscoveryMetrics exposes discovery queue counters
+func (n *Node) registerDiscoveryMetrics() {
+	n.metrics.Register("p2p_discovery_queue_length", "Discovered peers waiting to be dialed", metrics.KindGauge, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(len(n.discovery.queue))}}
+	})
+	n.metrics.Register("p2p_discovery_dials_total", "Dials made to discovered peers", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.discovery.dialed.Value())}}
+	})
+	n.metrics.Register("p2p_discovery_dropped_total", "Discovered peers dropped because the queue was full", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.discovery.dropped.Value())}}
+	})
+}
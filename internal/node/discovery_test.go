@@ -0,0 +1,113 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiscoveryQueue_Dedup(t *testing.T) {
+	q := newDiscoveryQueue(DiscoveryConfig{QueueSize: 8})
+
+	if !q.enqueue(discoveredPeer{id: "a", addresses: []string{"10.0.0.1:3000"}}) {
+		t.Fatal("First enqueue refused")
+	}
+	if q.enqueue(discoveredPeer{id: "a", addresses: []string{"10.0.0.1:3000"}}) {
+		t.Error("Duplicate peer queued")
+	}
+	if q.enqueue(discoveredPeer{id: "b", addresses: []string{"10.0.0.1:3000"}}) {
+		t.Error("Duplicate address queued under another ID")
+	}
+
+	q.finish(discoveredPeer{id: "a", addresses: []string{"10.0.0.1:3000"}})
+	if !q.enqueue(discoveredPeer{id: "a", addresses: []string{"10.0.0.1:3000"}}) {
+		t.Error("Peer not queued again after its dial finished")
+	}
+}
+
+func TestDiscoveryQueue_DropsWhenFull(t *testing.T) {
+	q := newDiscoveryQueue(DiscoveryConfig{QueueSize: 1})
+
+	q.enqueue(discoveredPeer{id: "a", addresses: []string{"a:1"}})
+	if q.enqueue(discoveredPeer{id: "b", addresses: []string{"b:1"}}) {
+		t.Error("Peer queued beyond the queue size")
+	}
+	if got := q.dropped.Value(); got != 1 {
+		t.Errorf("dropped = %d, want 1", got)
+	}
+}
+
+func TestDiscoveryQueue_RateLimitsAndSkips(t *testing.T) {
+	interval := 50 * time.Millisecond
+	q := newDiscoveryQueue(DiscoveryConfig{DialInterval: interval, QueueSize: 8})
+
+	var mu sync.Mutex
+	var dials []time.Time
+	dialedAll := make(chan struct{})
+	dial := func(ctx context.Context, addresses []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		dials = append(dials, time.Now())
+		if len(dials) == 3 {
+			close(dialedAll)
+		}
+		return nil
+	}
+	skip := func(p discoveredPeer) string {
+		if p.id == "skipped" {
+			return "already connected"
+		}
+		return ""
+	}
+
+	for _, id := range []string{"a", "skipped", "b", "c"} {
+		q.enqueue(discoveredPeer{id: id, addresses: []string{id + ":1"}})
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go q.run(done, skip, dial)
+
+	select {
+	case <-dialedAll:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for dials")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 1; i < len(dials); i++ {
+		if gap := dials[i].Sub(dials[i-1]); gap < interval-5*time.Millisecond {
+			t.Errorf("Dials %d and %d were %v apart, want at least %v", i-1, i, gap, interval)
+		}
+	}
+	if got := q.dialed.Value(); got != 3 {
+		t.Errorf("dialed = %d, want 3", got)
+	}
+}
+
+func TestNode_SkipDiscoveredAtPeerLimit(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+		WithFirstNode(true), WithDiscovery(DiscoveryConfig{MaxPeers: 1, QueueSize: 4}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	if reason := node.skipDiscovered(discoveredPeer{id: "new", addresses: []string{"x:1"}}); reason != "" {
+		t.Errorf("skipDiscovered() = %q with no peers, want empty", reason)
+	}
+
+	node.mu.Lock()
+	node.peers["fingerprint"] = PeerInfo{ID: "known", Address: "y:1"}
+	node.peerKeys["known"] = "fingerprint"
+	node.mu.Unlock()
+	if reason := node.skipDiscovered(discoveredPeer{id: "known", addresses: []string{"y:1"}}); reason == "" {
+		t.Error("skipDiscovered() allowed dialing a connected peer")
+	}
+}
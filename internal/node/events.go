@@ -0,0 +1,128 @@
+package node
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType identifies the kind of node event
+type EventType string
+
+const (
+	EventPeerConnected     EventType = "peer_connected"
+	EventTransferStarted   EventType = "transfer_started"
+	EventTransferCompleted EventType = "transfer_completed"
+	EventTransferFailed    EventType = "transfer_failed"
+	EventFileStored        EventType = "file_stored"
+	EventIntegrityFailed   EventType = "integrity_failed"
+	EventScrubCompleted    EventType = "scrub_completed"
+	// Replica counts are carried in Count
+	EventUnderReplicated     EventType = "under_replicated"
+	EventReplicationRestored EventType = "replication_restored"
+	EventPeerLeft            EventType = "peer_left"
+	// The error code the peer refused the connection with is in Error
+	EventPeerRejected EventType = "peer_rejected"
+	// A holder failed a storage audit; the reason is in Error
+	EventAuditFailed EventType = "audit_failed"
+	// A followed feed gained an entry; the feed is in PeerID and its
+	// sequence number in Count
+	EventFeedEntry EventType = "feed_entry"
+	// A peer's connection closed; one replaced by a newer connection to the
+	// same peer doesn't count
+	EventPeerDisconnected EventType = "peer_disconnected"
+	// A listener failed and stopped accepting connections; its address is
+	// in Address and the error in Error
+	EventListenerFailed EventType = "listener_failed"
+	// The node joined the network through the bootstrap peer in Address,
+	// after Count attempts
+	EventBootstrapComplete EventType = "bootstrap_complete"
+	// An object was deleted from the store, here or by a node whose
+	// deletions are honored
+	EventFileDeleted EventType = "file_deleted"
+)
+
+// eventBufferSize is how many events a slow subscriber may lag behind
+// before further events are dropped for it
+const eventBufferSize = 64
+
+// Event is a typed notification about something that happened on the node
+type Event struct {
+	Type        EventType `json:"type"`
+	Time        time.Time `json:"time"`
+	PeerID      string    `json:"peer_id,omitempty"`
+	Address     string    `json:"address,omitempty"`
+	ContentHash string    `json:"content_hash,omitempty"`
+	FileName    string    `json:"file_name,omitempty"`
+	Direction   string    `json:"direction,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Count       int       `json:"count,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// eventBus fans events out to subscribers without ever blocking the emitter
+type eventBus struct {
+	mu     sync.RWMutex
+	nextID int
+	subs   map[int]chan Event
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subs: make(map[int]chan Event),
+	}
+}
+
+func (b *eventBus) subscribe() (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	id := b.nextID
+	b.nextID++
+	ch := make(chan Event, eventBufferSize)
+	b.subs[id] = ch
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+	return ch, cancel
+}
+
+func (b *eventBus) publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, ch := range b.subs {
+		select {
+		case ch <- event:
+		default:
+			// Subscriber is not keeping up; drop rather than stall the node
+		}
+	}
+}
+
+// Subscribe returns a channel receiving node events and a function that
+// cancels the subscription. Events are dropped for subscribers that fall
+// too far behind.
+func (n *Node) Subscribe() (<-chan Event, func()) {
+	return n.events.subscribe()
+}
+
+func (n *Node) emit(event Event) {
+	switch event.Type {
+	case EventTransferCompleted:
+		n.tracker.outcome(event.Direction, true)
+	case EventTransferFailed:
+		n.tracker.outcome(event.Direction, false)
+	}
+	n.events.publish(event)
+}
@@ -0,0 +1,81 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus()
+
+	events, cancel := bus.subscribe()
+	bus.publish(Event{Type: EventFileStored, ContentHash: "abc123"})
+
+	event := <-events
+	if event.Type != EventFileStored {
+		t.Errorf("Event type = %v, want %v", event.Type, EventFileStored)
+	}
+	if event.Time.IsZero() {
+		t.Error("Event time was not set")
+	}
+
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("Channel not closed after cancel")
+	}
+
+	// Publishing after cancel must not panic
+	bus.publish(Event{Type: EventFileStored})
+}
+
+func TestEventBus_SlowSubscriber(t *testing.T) {
+	bus := newEventBus()
+
+	events, cancel := bus.subscribe()
+	defer cancel()
+
+	// Overfilling the buffer drops events instead of blocking
+	for i := 0; i < eventBufferSize*2; i++ {
+		bus.publish(Event{Type: EventTransferStarted})
+	}
+
+	if len(events) != eventBufferSize {
+		t.Errorf("Buffered events = %v, want %v", len(events), eventBufferSize)
+	}
+}
+
+func TestNode_PeerDisconnectedEvent(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "first", "store"), filepath.Join(baseDir, "first", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	first.transport.Start()
+	defer first.Stop()
+	events, cancel := first.Subscribe()
+	defer cancel()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "second", "store"), filepath.Join(baseDir, "second", "watch"))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	second.transport.Start()
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	event := waitForEvent(t, events, EventPeerConnected, 5*time.Second)
+	if event.PeerID != "second" {
+		t.Errorf("Connected peer = %v, want %v", event.PeerID, "second")
+	}
+
+	second.Stop()
+	event = waitForEvent(t, events, EventPeerDisconnected, 5*time.Second)
+	if event.PeerID != "second" {
+		t.Errorf("Disconnected peer = %v, want %v", event.PeerID, "second")
+	}
+}
@@ -0,0 +1,414 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// maxFeedBatch bounds the number of entries sent in answer to a feed request
+const maxFeedBatch = 256
+
+// FeedEntry is one item of a node's append-only, signed feed of published
+// hashes. Feeds are identified by the fingerprint of the publisher's key.
+type FeedEntry struct {
+	Sequence  uint64    `json:"sequence"`
+	Hash      string    `json:"hash"`
+	Published time.Time `json:"published"`
+	Prev      []byte    `json:"prev,omitempty"`
+	PublicKey []byte    `json:"public_key"`
+	Signature []byte    `json:"signature"`
+}
+
+// Feed returns the fingerprint of the feed the entry belongs to
+func (e FeedEntry) Feed() string {
+	return crypto.Fingerprint(e.PublicKey)
+}
+
+// digest identifies the entry to the one that follows it
+func (e FeedEntry) digest() []byte {
+	sum := sha256.Sum256(e.Signature)
+	return sum[:]
+}
+
+func (e FeedEntry) payload() protocol.FeedEntry {
+	return protocol.FeedEntry{
+		Sequence:  e.Sequence,
+		Hash:      e.Hash,
+		Timestamp: e.Published.Unix(),
+		Prev:      e.Prev,
+		PublicKey: e.PublicKey,
+		Signature: e.Signature,
+	}
+}
+
+func feedEntryFromPayload(p protocol.FeedEntry) FeedEntry {
+	return FeedEntry{
+		Sequence:  p.Sequence,
+		Hash:      p.Hash,
+		Published: time.Unix(p.Timestamp, 0).UTC(),
+		Prev:      p.Prev,
+		PublicKey: p.PublicKey,
+		Signature: p.Signature,
+	}
+}
+
+// Verify reports whether the entry is signed by the key of its feed
+func (e FeedEntry) Verify() bool {
+	if e.Hash == "" || e.Sequence == 0 {
+		return false
+	}
+	p := e.payload()
+	return crypto.Verify(p.PublicKey, p.SignedData(), p.Signature)
+}
+
+// FeedInfo summarizes a known feed
+type FeedInfo struct {
+	Feed      string    `json:"feed"`
+	Entries   int       `json:"entries"`
+	Latest    FeedEntry `json:"latest"`
+	Following bool      `json:"following"`
+}
+
+// feedStore keeps every known feed and the feeds this node follows, and
+// persists them as JSON
+type feedStore struct {
+	path      string
+	mu        sync.Mutex
+	feeds     map[string][]FeedEntry
+	following map[string]bool
+}
+
+type feedFile struct {
+	Feeds     map[string][]FeedEntry `json:"feeds"`
+	Following []string               `json:"following"`
+}
+
+// loadFeeds reads the feeds at path, starting empty if it does not exist
+func loadFeeds(path string) (*feedStore, error) {
+	s := &feedStore{
+		path:      path,
+		feeds:     make(map[string][]FeedEntry),
+		following: make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feeds: %w", err)
+	}
+
+	var file feedFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse feeds: %w", err)
+	}
+	for feed, entries := range file.Feeds {
+		s.feeds[feed] = entries
+	}
+	for _, feed := range file.Following {
+		s.following[feed] = true
+	}
+	return s, nil
+}
+
+func (s *feedStore) saveLocked() error {
+	file := feedFile{Feeds: s.feeds, Following: make([]string, 0, len(s.following))}
+	for feed := range s.following {
+		file.Following = append(file.Following, feed)
+	}
+	sort.Strings(file.Following)
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode feeds: %w", err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// append adds the next entry of a feed, reporting whether it was new and
+// how many entries of the feed were held before it
+func (s *feedStore) append(e FeedEntry) (bool, uint64, error) {
+	if !e.Verify() {
+		return false, 0, fmt.Errorf("invalid signature on entry %d of feed %s", e.Sequence, e.Feed())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	feed := e.Feed()
+	entries := s.feeds[feed]
+	have := uint64(len(entries))
+	if e.Sequence <= have {
+		// Already held; a different entry at the same position is a fork
+		if !bytes.Equal(entries[e.Sequence-1].Signature, e.Signature) {
+			return false, have, fmt.Errorf("entry %d of feed %s conflicts with the one held", e.Sequence, feed)
+		}
+		return false, have, nil
+	}
+	if e.Sequence > have+1 {
+		return false, have, nil
+	}
+
+	var prev []byte
+	if have > 0 {
+		prev = entries[have-1].digest()
+	}
+	if !bytes.Equal(prev, e.Prev) {
+		return false, have, fmt.Errorf("entry %d of feed %s does not follow the one before it", e.Sequence, feed)
+	}
+
+	s.feeds[feed] = append(entries, e)
+	return true, have, s.saveLocked()
+}
+
+// entries returns the entries of a feed after a sequence number
+func (s *feedStore) entries(feed string, after uint64) []FeedEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.feeds[feed]
+	if after >= uint64(len(entries)) {
+		return nil
+	}
+	return append([]FeedEntry(nil), entries[after:]...)
+}
+
+// heads returns the latest entry of every feed
+func (s *feedStore) heads() []FeedEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	heads := make([]FeedEntry, 0, len(s.feeds))
+	for _, entries := range s.feeds {
+		if len(entries) > 0 {
+			heads = append(heads, entries[len(entries)-1])
+		}
+	}
+	return heads
+}
+
+// follow marks whether a feed is followed
+func (s *feedStore) follow(feed string, on bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if on {
+		s.following[feed] = true
+	} else {
+		delete(s.following, feed)
+	}
+	return s.saveLocked()
+}
+
+func (s *feedStore) isFollowing(feed string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.following[feed]
+}
+
+// list summarizes every known or followed feed, sorted by fingerprint
+func (s *feedStore) list() []FeedInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	var infos []FeedInfo
+	for feed, entries := range s.feeds {
+		info := FeedInfo{Feed: feed, Entries: len(entries), Following: s.following[feed]}
+		if len(entries) > 0 {
+			info.Latest = entries[len(entries)-1]
+		}
+		infos = append(infos, info)
+		seen[feed] = true
+	}
+	for feed := range s.following {
+		if !seen[feed] {
+			infos = append(infos, FeedInfo{Feed: feed, Following: true})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Feed < infos[j].Feed })
+	return infos
+}
+
+// PublishToFeed appends a stored hash to this node's feed and propagates
+// the new entry to peers
+func (n *Node) PublishToFeed(hash string) (FeedEntry, error) {
+	if !n.store.Exists(hash) {
+		return FeedEntry{}, fmt.Errorf("%s is not stored locally", hash)
+	}
+
+	n.feedMu.Lock()
+	defer n.feedMu.Unlock()
+
+	entry := FeedEntry{
+		Sequence:  1,
+		Hash:      hash,
+		Published: time.Now().UTC().Truncate(time.Second),
+		PublicKey: n.identity.Public,
+	}
+	if own := n.feeds.entries(n.Identity(), 0); len(own) > 0 {
+		last := own[len(own)-1]
+		entry.Sequence = last.Sequence + 1
+		entry.Prev = last.digest()
+	}
+	p := entry.payload()
+	entry.Signature = n.identity.Sign(p.SignedData())
+
+	if _, _, err := n.feeds.append(entry); err != nil {
+		return FeedEntry{}, err
+	}
+	if err := n.sendFeed(nil, []FeedEntry{entry}); err != nil {
+		fmt.Printf("Failed to propagate feed entry: %v\n", err)
+	}
+	return entry, nil
+}
+
+// Feed returns the entries of a feed in order; an empty fingerprint means
+// this node's own feed
+func (n *Node) Feed(feed string) []FeedEntry {
+	if feed == "" {
+		feed = n.Identity()
+	}
+	return n.feeds.entries(feed, 0)
+}
+
+// Feeds summarizes every known or followed feed
+func (n *Node) Feeds() []FeedInfo {
+	return n.feeds.list()
+}
+
+// Follow subscribes to a feed: every hash published to it, including those
+// already known, is fetched and stored locally. Peers are asked for any
+// entries not yet seen.
+func (n *Node) Follow(feed string) error {
+	if !isFingerprint(feed) {
+		return fmt.Errorf("%q is not a key fingerprint", feed)
+	}
+	if err := n.feeds.follow(feed, true); err != nil {
+		return err
+	}
+	held := n.feeds.entries(feed, 0)
+	for _, e := range held {
+		n.fetchFeedEntry(e)
+	}
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeFeedRequest, n.ID, protocol.FeedRequest{Feed: feed, After: uint64(len(held))})
+	if err != nil {
+		return err
+	}
+	return n.broadcast("feed request", msg)
+}
+
+// Unfollow stops fetching new entries of a feed. Entries already fetched
+// are kept.
+func (n *Node) Unfollow(feed string) error {
+	return n.feeds.follow(feed, false)
+}
+
+// fetchFeedEntry stores the content of a followed feed's entry in the background
+func (n *Node) fetchFeedEntry(e FeedEntry) {
+	if n.hasObject(e.Hash) {
+		return
+	}
+	go func() {
+		if err := n.fetch(e.Hash, n.requestConfig.Timeout); err != nil {
+			fmt.Printf("Failed to fetch entry %d of feed %s: %v\n", e.Sequence, e.Feed(), err)
+		}
+	}()
+}
+
+// sendFeed sends feed entries to one peer, or to every connected peer when
+// peer is nil
+func (n *Node) sendFeed(peer *network.Peer, entries []FeedEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	payload := protocol.FeedPayload{Entries: make([]protocol.FeedEntry, len(entries))}
+	for i, e := range entries {
+		payload.Entries[i] = e.payload()
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeFeed, n.ID, payload)
+	if err != nil {
+		return err
+	}
+	if peer == nil {
+		return n.broadcast("feed entries", msg)
+	}
+	return peer.Send(msg)
+}
+
+// handleFeed appends new entries, passes them on to peers and fetches the
+// content of followed feeds. Missing entries are requested from the sender.
+func (n *Node) handleFeed(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.FeedPayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse feed entries: %w", err)
+	}
+
+	var accepted []FeedEntry
+	requested := make(map[string]bool)
+	for _, p := range payload.Entries {
+		entry := feedEntryFromPayload(p)
+		added, have, err := n.feeds.append(entry)
+		if err != nil {
+			fmt.Printf("Rejected feed entry from %s: %v\n", msg.SenderID, err)
+			continue
+		}
+		feed := entry.Feed()
+		if !added {
+			// Entries are missing before this one; ask the sender once
+			if entry.Sequence > have+1 && !requested[feed] {
+				requested[feed] = true
+				n.requestFeed(peer, feed, have)
+			}
+			continue
+		}
+		accepted = append(accepted, entry)
+		if n.feeds.isFollowing(feed) {
+			n.emit(Event{Type: EventFeedEntry, PeerID: feed, ContentHash: entry.Hash, Count: int(entry.Sequence)})
+			n.fetchFeedEntry(entry)
+		}
+	}
+	// A full batch in answer to a request may have more behind it
+	if len(accepted) == maxFeedBatch {
+		last := accepted[len(accepted)-1]
+		n.requestFeed(peer, last.Feed(), last.Sequence)
+	}
+	return n.sendFeed(nil, accepted)
+}
+
+// requestFeed asks a peer for the entries of a feed after a sequence number
+func (n *Node) requestFeed(peer *network.Peer, feed string, after uint64) {
+	msg, err := protocol.NewMessage(protocol.MessageTypeFeedRequest, n.ID, protocol.FeedRequest{Feed: feed, After: after})
+	if err != nil {
+		return
+	}
+	if err := peer.Send(msg); err != nil {
+		fmt.Printf("Failed to request feed %s: %v\n", feed, err)
+	}
+}
+
+// handleFeedRequest answers with the requested entries of a feed
+func (n *Node) handleFeedRequest(peer *network.Peer, msg *protocol.Message) error {
+	var request protocol.FeedRequest
+	if err := msg.ParsePayload(&request); err != nil {
+		return fmt.Errorf("failed to parse feed request: %w", err)
+	}
+
+	entries := n.feeds.entries(request.Feed, request.After)
+	if len(entries) > maxFeedBatch {
+		entries = entries[:maxFeedBatch]
+	}
+	return n.sendFeed(peer, entries)
+}
@@ -0,0 +1,158 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+)
+
+func TestFeedStore_Append(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	identity, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	sign := func(seq uint64, hash string, prev []byte) FeedEntry {
+		e := FeedEntry{
+			Sequence:  seq,
+			Hash:      hash,
+			Published: time.Now().UTC().Truncate(time.Second),
+			Prev:      prev,
+			PublicKey: identity.Public,
+		}
+		p := e.payload()
+		e.Signature = identity.Sign(p.SignedData())
+		return e
+	}
+
+	path := filepath.Join(baseDir, "feeds.json")
+	store, err := loadFeeds(path)
+	if err != nil {
+		t.Fatalf("Failed to load feeds: %v", err)
+	}
+
+	first := sign(1, "hash1", nil)
+	second := sign(2, "hash2", first.digest())
+	third := sign(3, "hash3", second.digest())
+
+	if added, _, err := store.append(first); !added || err != nil {
+		t.Fatalf("append(first) = %v, %v, want true", added, err)
+	}
+	if added, _, err := store.append(first); added || err != nil {
+		t.Errorf("append(first) again = %v, %v, want false", added, err)
+	}
+	if added, have, err := store.append(third); added || have != 1 || err != nil {
+		t.Errorf("append(third) = %v, %d, %v, want false after 1", added, have, err)
+	}
+	if _, _, err := store.append(sign(1, "other", nil)); err == nil {
+		t.Error("Expected error for a conflicting first entry")
+	}
+	if _, _, err := store.append(sign(2, "hash2", nil)); err == nil {
+		t.Error("Expected error for an entry that doesn't follow the previous one")
+	}
+	forged := second
+	forged.Hash = "forged"
+	if _, _, err := store.append(forged); err == nil {
+		t.Error("Expected error for a forged entry")
+	}
+	for _, e := range []FeedEntry{second, third} {
+		if added, _, err := store.append(e); !added || err != nil {
+			t.Fatalf("append(%d) = %v, %v, want true", e.Sequence, added, err)
+		}
+	}
+	if err := store.follow(identity.Fingerprint(), true); err != nil {
+		t.Fatalf("Failed to follow: %v", err)
+	}
+
+	// Entries and subscriptions survive a reload
+	store, err = loadFeeds(path)
+	if err != nil {
+		t.Fatalf("Failed to reload feeds: %v", err)
+	}
+	entries := store.entries(identity.Fingerprint(), 0)
+	if len(entries) != 3 || entries[2].Hash != "hash3" {
+		t.Fatalf("entries = %+v, want 3 ending in hash3", entries)
+	}
+	if got := store.entries(identity.Fingerprint(), 2); len(got) != 1 || got[0].Sequence != 3 {
+		t.Errorf("entries after 2 = %+v, want entry 3", got)
+	}
+	if !store.isFollowing(identity.Fingerprint()) {
+		t.Error("Expected feed to still be followed")
+	}
+}
+
+func TestNode_FollowFetchesFeed(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	publish := func(content string) string {
+		path := filepath.Join(baseDir, "file.txt")
+		writeTestFile(t, path, content)
+		hash, err := first.StoreFile(path)
+		if err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+		if _, err := first.PublishToFeed(hash); err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+		return hash
+	}
+
+	// Published before anyone follows; fetched as backlog
+	earlier := publish("first post")
+	if _, err := first.PublishToFeed("missing0123"); err == nil {
+		t.Error("Expected error publishing a hash that isn't stored")
+	}
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+	events, unsubscribe := second.Subscribe()
+	defer unsubscribe()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	if err := second.Follow(first.Identity()); err != nil {
+		t.Fatalf("Failed to follow: %v", err)
+	}
+
+	// Published while followed; pushed to the follower
+	later := publish("second post")
+	event := waitForEvent(t, events, EventFeedEntry, 5*time.Second)
+	for event.Count != 2 {
+		event = waitForEvent(t, events, EventFeedEntry, 5*time.Second)
+	}
+	if event.PeerID != first.Identity() || event.ContentHash != later {
+		t.Errorf("event = %+v, want entry 2 of %s", event, first.Identity())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !second.store.Exists(earlier) || !second.store.Exists(later) {
+		if time.Now().After(deadline) {
+			t.Fatal("Follower did not fetch the published hashes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if feed := second.Feed(first.Identity()); len(feed) != 2 {
+		t.Errorf("Feed() has %d entries, want 2", len(feed))
+	}
+}
@@ -0,0 +1,182 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// DefaultTransferWindow is how many chunks of a transfer a peer may send
+// ahead of those written here
+const DefaultTransferWindow = 16
+
+// creditTimeout is how long a sender waits for its requester to grant more
+// credit before the transfer is given up
+const creditTimeout = time.Minute
+
+// maxWindowedUploads bounds the transfers with a window sent to one peer at
+// once. Each runs in the background while it waits for credit, so a peer
+// could otherwise start any number of them.
+const maxWindowedUploads = 8
+
+// WithTransferWindow sets how many chunks of a transfer peers may send ahead
+// of those written here. Peers announcing protocol.FeatureCredit wait for
+// more as chunks are written, so a slow disk holds them back rather than
+// filling the connection; zero lets them send as fast as they read.
+func WithTransferWindow(chunks int) Option {
+	return func(n *Node) {
+		n.transferWindow = chunks
+	}
+}
+
+// creditWindow counts the chunks a transfer's sender may still send
+type creditWindow struct {
+	mu      sync.Mutex
+	credit  int
+	granted chan struct{} // signalled when credit is added
+}
+
+// take uses up a chunk of credit, waiting up to timeout for more if there
+// is none
+func (w *creditWindow) take(timeout time.Duration, done <-chan struct{}) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		w.mu.Lock()
+		if w.credit > 0 {
+			w.credit--
+			w.mu.Unlock()
+			return nil
+		}
+		w.mu.Unlock()
+
+		select {
+		case <-w.granted:
+		case <-timer.C:
+			return fmt.Errorf("no credit granted in %v", timeout)
+		case <-done:
+			return fmt.Errorf("node stopped")
+		}
+	}
+}
+
+func (w *creditWindow) grant(chunks int) {
+	w.mu.Lock()
+	w.credit += chunks
+	w.mu.Unlock()
+	select {
+	case w.granted <- struct{}{}:
+	default:
+	}
+}
+
+// creditWindows tracks the windows of the transfers being sent, by
+// requester and content hash, and how many are sent to each requester
+type creditWindows struct {
+	mu      sync.Mutex
+	windows map[string]*creditWindow
+	uploads map[string]int // by requester
+}
+
+func newCreditWindows() *creditWindows {
+	return &creditWindows{windows: make(map[string]*creditWindow), uploads: make(map[string]int)}
+}
+
+// acquire takes one of the requester's maxWindowedUploads slots, reporting
+// false if it has none left
+func (c *creditWindows) acquire(peerID string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.uploads[peerID] >= maxWindowedUploads {
+		return false
+	}
+	c.uploads[peerID]++
+	return true
+}
+
+// release returns a slot taken by acquire
+func (c *creditWindows) release(peerID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.uploads[peerID]--; c.uploads[peerID] <= 0 {
+		delete(c.uploads, peerID)
+	}
+}
+
+// open starts the window of a transfer with its initial credit, replacing
+// that of an earlier request for the same object
+func (c *creditWindows) open(key string, credit int) *creditWindow {
+	w := &creditWindow{credit: credit, granted: make(chan struct{}, 1)}
+	c.mu.Lock()
+	c.windows[key] = w
+	c.mu.Unlock()
+	return w
+}
+
+func (c *creditWindows) close(key string, w *creditWindow) {
+	c.mu.Lock()
+	if c.windows[key] == w {
+		delete(c.windows, key)
+	}
+	c.mu.Unlock()
+}
+
+// grant adds credit to a transfer's window, reporting false if none is open
+func (c *creditWindows) grant(key string, chunks int) bool {
+	c.mu.Lock()
+	w, ok := c.windows[key]
+	c.mu.Unlock()
+	if ok {
+		w.grant(chunks)
+	}
+	return ok
+}
+
+// windowed asks a peer taking credit to send no more than the transfer
+// window ahead of the chunks written here
+func (n *Node) windowed(peerID string, request *protocol.DataRequest) {
+	if request.Range == nil && n.transferWindow > 0 && n.peerSupports(peerID, protocol.FeatureCredit) {
+		request.Window = min(n.transferWindow, protocol.MaxWindow)
+	}
+}
+
+// grantCredit tells the sender of a transfer requested with a window that
+// it may send more, once half the window's chunks have been written
+func (n *Node) grantCredit(peer *network.Peer, state *transferState) {
+	id := n.nodeID(peer)
+	if n.transferWindow <= 0 || !n.peerSupports(id, protocol.FeatureCredit) {
+		return
+	}
+	n.mu.Lock()
+	state.uncredited++
+	chunks := state.uncredited
+	if chunks < max(min(n.transferWindow, protocol.MaxWindow)/2, 1) {
+		n.mu.Unlock()
+		return
+	}
+	state.uncredited = 0
+	n.mu.Unlock()
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeCredit, n.ID, protocol.Credit{ContentHash: state.hash, Chunks: chunks})
+	if err != nil {
+		return
+	}
+	if err := peer.Send(msg); err != nil {
+		n.debugf("Failed to grant %s credit for %s: %v\n", id, state.hash, err)
+	}
+}
+
+func (n *Node) handleCredit(peer *network.Peer, msg *protocol.Message) error {
+	var credit protocol.Credit
+	if err := msg.ParsePayload(&credit); err != nil {
+		return fmt.Errorf("failed to parse credit: %w", err)
+	}
+	// Only the requester on the connection can open its own windows
+	if !n.credits.grant(n.nodeID(peer)+"-"+credit.ContentHash, credit.Chunks) {
+		n.debugf("Ignoring credit for %s from %s, which isn't being sent\n", credit.ContentHash, peer.ID())
+	}
+	return nil
+}
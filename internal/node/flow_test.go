@@ -0,0 +1,122 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+func TestCreditWindow(t *testing.T) {
+	windows := newCreditWindows()
+	w := windows.open("peer-hash", 1)
+	done := make(chan struct{})
+
+	if err := w.take(time.Second, done); err != nil {
+		t.Fatalf("take() with credit left error = %v", err)
+	}
+	if err := w.take(20*time.Millisecond, done); err == nil {
+		t.Fatal("take() succeeded without credit")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		windows.grant("peer-hash", 2)
+	}()
+	for i := 0; i < 2; i++ {
+		if err := w.take(time.Second, done); err != nil {
+			t.Fatalf("take() after a grant error = %v", err)
+		}
+	}
+
+	windows.close("peer-hash", w)
+	if windows.grant("peer-hash", 1) {
+		t.Error("grant() found a closed window")
+	}
+}
+
+func TestCreditWindows_BoundsUploadsPerPeer(t *testing.T) {
+	windows := newCreditWindows()
+	for i := 0; i < maxWindowedUploads; i++ {
+		if !windows.acquire("peer") {
+			t.Fatalf("acquire() %d refused", i)
+		}
+	}
+	if windows.acquire("peer") {
+		t.Error("acquire() over the limit succeeded")
+	}
+	if !windows.acquire("other") {
+		t.Error("acquire() for another peer refused")
+	}
+	windows.release("peer")
+	if !windows.acquire("peer") {
+		t.Error("acquire() after a release refused")
+	}
+}
+
+func TestNode_TransferWindow(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	holder, err := NewNode("holder", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer holder.Stop()
+	holder.transport.Start()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, strings.Repeat("sent a few chunks at a time ", 10000))
+	hash, err := holder.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	const window = 4
+	requester, err := NewNode("requester", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false),
+		WithMaxChunkSize(protocol.MinChunkSize), WithTransferWindow(window))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer requester.Stop()
+	requester.transport.Start()
+
+	if err := requester.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := requester.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	// The holder never has more chunks out than the window and the credit
+	// granted since
+	var mu sync.Mutex
+	var sent, granted, overruns int
+	holder.SetTap(func(e network.TapEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case e.Sent && e.Type == protocol.MessageTypeDataTransfer:
+			sent++
+			if sent > window+granted {
+				overruns++
+			}
+		case !e.Sent && e.Type == protocol.MessageTypeCredit:
+			granted += window / 2
+		}
+	})
+
+	if err := requester.fetch(hash, 10*time.Second); err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if sent < 2*window || granted == 0 || overruns > 0 {
+		t.Errorf("Holder sent %d chunks for %d chunks of credit, %d past the window; want more than the window, within it", sent, granted, overruns)
+	}
+}
@@ -0,0 +1,165 @@
+package node
+
+import (
+	"sync"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// GossipConfig controls how announcements of new objects spread. A node
+// announces an object to its neighbours, and each passes the announcement
+// on to its own neighbours once it holds the object, until it has
+// travelled TTL hops. Announcements carry an ID, so nodes that hear of an
+// object twice, through different neighbours, handle it only once.
+type GossipConfig struct {
+	// TTL is how many hops announcements travel; 1 or less reaches the
+	// announcing node's neighbours only, and nothing is passed on
+	TTL int
+	// SeenSize and SeenExpiry bound the cache of message IDs already
+	// handled. Expired IDs are forgotten, and the oldest ones make room for
+	// new ones when the cache is full.
+	SeenSize   int
+	SeenExpiry time.Duration
+}
+
+// DefaultGossipConfig returns a config that lets announcements travel 6
+// hops and remembers up to 65536 message IDs for 10 minutes
+func DefaultGossipConfig() GossipConfig {
+	return GossipConfig{
+		TTL:        6,
+		SeenSize:   65536,
+		SeenExpiry: 10 * time.Minute,
+	}
+}
+
+// WithGossip sets how far announcements travel and how long their IDs are
+// remembered
+func WithGossip(cfg GossipConfig) Option {
+	return func(n *Node) {
+		n.gossipConfig = cfg
+	}
+}
+
+// seenCache remembers message IDs for a while
+type seenCache struct {
+	mu     sync.Mutex
+	size   int
+	expiry time.Duration
+	ids    map[string]time.Time
+	order  []string // oldest first
+	now    func() time.Time
+}
+
+func newSeenCache(size int, expiry time.Duration) *seenCache {
+	return &seenCache{
+		size:   size,
+		expiry: expiry,
+		ids:    make(map[string]time.Time),
+		now:    time.Now,
+	}
+}
+
+// add records id, reporting false if it was seen before
+func (c *seenCache) add(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	for len(c.order) > 0 && c.expiry > 0 && now.Sub(c.ids[c.order[0]]) > c.expiry {
+		delete(c.ids, c.order[0])
+		c.order = c.order[1:]
+	}
+	if _, ok := c.ids[id]; ok {
+		return false
+	}
+	c.ids[id] = now
+	c.order = append(c.order, id)
+	if c.size > 0 && len(c.order) > c.size {
+		delete(c.ids, c.order[0])
+		c.order = c.order[1:]
+	}
+	return true
+}
+
+// heldAnnouncement is an announcement waiting for its object to arrive
+// before it is passed on
+type heldAnnouncement struct {
+	msg  *protocol.Message
+	from *network.Peer
+	at   time.Time
+}
+
+// gossipState tracks the gossiped messages a node has handled
+type gossipState struct {
+	seen *seenCache
+	mu   sync.Mutex
+	held map[string]heldAnnouncement // by content hash
+}
+
+func newGossipState(cfg GossipConfig) *gossipState {
+	return &gossipState{
+		seen: newSeenCache(cfg.SeenSize, cfg.SeenExpiry),
+		held: make(map[string]heldAnnouncement),
+	}
+}
+
+// spread broadcasts a message that peers pass on, under a new ID
+func (n *Node) spread(what string, msg *protocol.Message) error {
+	if n.gossipConfig.TTL > 1 {
+		id, err := protocol.NewMessageID()
+		if err != nil {
+			return err
+		}
+		msg.ID, msg.TTL = id, n.gossipConfig.TTL
+		n.gossip.seen.add(id)
+	}
+	return n.broadcast(what, msg)
+}
+
+// holdAnnouncement keeps an announcement of hash received from peer until
+// the object is held, so the neighbours it is passed on to can fetch it from
+// here. Announcements at the end of their TTL are not kept.
+func (n *Node) holdAnnouncement(peer *network.Peer, hash string, msg *protocol.Message) {
+	if msg.ID == "" || min(msg.TTL, n.gossipConfig.TTL) <= 1 {
+		return
+	}
+	n.gossip.mu.Lock()
+	defer n.gossip.mu.Unlock()
+
+	now := time.Now()
+	for h, held := range n.gossip.held {
+		// The object never arrived
+		if now.Sub(held.at) > n.gossipConfig.SeenExpiry {
+			delete(n.gossip.held, h)
+		}
+	}
+	if _, ok := n.gossip.held[hash]; !ok {
+		n.gossip.held[hash] = heldAnnouncement{msg: msg, from: peer, at: now}
+	}
+}
+
+// passOn forwards the held announcement of hash, now that the object is
+// held, to every neighbour but the one it came from
+func (n *Node) passOn(hash string) {
+	n.gossip.mu.Lock()
+	held, ok := n.gossip.held[hash]
+	delete(n.gossip.held, hash)
+	n.gossip.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	msg := held.msg.Forwarded(n.ID)
+	msg.TTL = min(msg.TTL, n.gossipConfig.TTL-1)
+	for _, id := range n.connectedPeers() {
+		peer, ok := n.peerConn(id)
+		if !ok || peer == held.from {
+			continue
+		}
+		if err := peer.Send(msg); err != nil {
+			n.debugf("Failed to pass announcement of %s on to %s: %v\n", hash, id, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSeenCache(t *testing.T) {
+	now := time.Now()
+	c := newSeenCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+
+	if !c.add("a") {
+		t.Fatal("add() = false for a new ID")
+	}
+	if c.add("a") {
+		t.Error("add() = true for an ID already seen")
+	}
+
+	// The oldest ID makes room once the cache is full
+	c.add("b")
+	c.add("c")
+	if !c.add("a") {
+		t.Error("add() = false for an ID evicted from a full cache")
+	}
+
+	now = now.Add(2 * time.Minute)
+	if !c.add("c") {
+		t.Error("add() = false for an expired ID")
+	}
+	if len(c.ids) != 1 {
+		t.Errorf("Cache holds %d IDs after expiry, want 1", len(c.ids))
+	}
+}
+
+func TestNode_PassesAnnouncementsOn(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	newTestNode := func(id string, first bool) *Node {
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"), WithFirstNode(first))
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		n.transport.Start()
+		return n
+	}
+
+	// origin and far are both connected to hub, but not to each other
+	hub := newTestNode("hub", true)
+	defer hub.Stop()
+	origin := newTestNode("origin", false)
+	defer origin.Stop()
+	far := newTestNode("far", false)
+	defer far.Stop()
+	for _, n := range []*Node{origin, far} {
+		if err := n.Connect(context.Background(), hub.Address()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		if err := n.waitForKey(5 * time.Second); err != nil {
+			t.Fatalf("Failed to receive network key: %v", err)
+		}
+	}
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "spread by gossip")
+	hash, err := origin.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	meta, _ := origin.catalog.get(hash)
+	origin.announce(meta)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !far.store.Exists(hash) {
+		if time.Now().After(deadline) {
+			t.Fatal("Announcement was not passed on to a peer two hops away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hub.gossip.mu.Lock()
+	held := len(hub.gossip.held)
+	hub.gossip.mu.Unlock()
+	if held != 0 {
+		t.Errorf("Hub still holds %d announcements after passing them on", held)
+	}
+}
+
+func TestNode_DropsSeenMessages(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	meta := FileMeta{Hash: "abc123", Name: "file.txt", Size: 1}
+	msg, err := node.announcement(meta)
+	if err != nil {
+		t.Fatalf("Failed to create announcement: %v", err)
+	}
+	if err := node.spread("announcement", msg); err != nil {
+		t.Fatalf("spread() error = %v", err)
+	}
+	if msg.ID == "" {
+		t.Fatal("spread() sent the announcement without an ID")
+	}
+	if msg.TTL != DefaultGossipConfig().TTL {
+		t.Errorf("TTL = %d, want %d", msg.TTL, DefaultGossipConfig().TTL)
+	}
+
+	// Its own announcement coming back is dropped before it is handled
+	if err := node.HandleMessage(nil, msg); err != nil {
+		t.Errorf("HandleMessage() error = %v for a message already seen", err)
+	}
+	if _, ok := node.catalog.get("abc123"); ok {
+		t.Error("A message already seen was handled")
+	}
+}
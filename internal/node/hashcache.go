@@ -0,0 +1,90 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// hashCacheEntry remembers which object a file became at a given size and mtime
+type hashCacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+}
+
+// hashCache lets re-imports skip files that have not changed since they were
+// last stored. Encryption uses a random IV, so re-storing an unchanged file
+// would otherwise produce a new, duplicate object.
+type hashCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]hashCacheEntry
+	dirty   bool
+}
+
+// loadHashCache reads the cache at path, starting empty if it does not exist
+func loadHashCache(path string) (*hashCache, error) {
+	c := &hashCache{
+		path:    path,
+		entries: make(map[string]hashCacheEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hash cache: %w", err)
+	}
+	if err := json.Unmarshal(data, &c.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse hash cache: %w", err)
+	}
+	return c, nil
+}
+
+// lookup returns the cached hash for path if its size and mtime still match
+func (c *hashCache) lookup(path string, info os.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[path]
+	if !ok || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	return entry.Hash, true
+}
+
+// put records the hash for path; call save to persist
+func (c *hashCache) put(path string, info os.FileInfo, hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[path] = hashCacheEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Hash:    hash,
+	}
+	c.dirty = true
+}
+
+// save persists the cache if it changed since the last save
+func (c *hashCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode hash cache: %w", err)
+	}
+	if err := writeFileAtomic(c.path, data); err != nil {
+		return fmt.Errorf("failed to write hash cache: %w", err)
+	}
+	c.dirty = false
+	return nil
+}
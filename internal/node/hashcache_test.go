@@ -0,0 +1,50 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashCache(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	file := filepath.Join(baseDir, "file.txt")
+	if err := os.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("Failed to stat file: %v", err)
+	}
+
+	cachePath := filepath.Join(baseDir, "hashcache.json")
+	c, err := loadHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("Failed to load hash cache: %v", err)
+	}
+	c.put(file, info, "abc")
+	if err := c.save(); err != nil {
+		t.Fatalf("Failed to save hash cache: %v", err)
+	}
+
+	reloaded, err := loadHashCache(cachePath)
+	if err != nil {
+		t.Fatalf("Failed to reload hash cache: %v", err)
+	}
+	if hash, ok := reloaded.lookup(file, info); !ok || hash != "abc" {
+		t.Errorf("lookup() = %v, %v, want abc, true", hash, ok)
+	}
+
+	// A changed mtime invalidates the entry
+	later := info.ModTime().Add(time.Second)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatalf("Failed to touch file: %v", err)
+	}
+	info, _ = os.Stat(file)
+	if _, ok := reloaded.lookup(file, info); ok {
+		t.Error("lookup() hit for a modified file")
+	}
+}
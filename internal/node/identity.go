@@ -0,0 +1,214 @@
+package node
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+var (
+	// ErrSelfConnection is returned when a node receives its own handshake,
+	// typically after dialing its own advertised address
+	ErrSelfConnection = errors.New("connection to self")
+	// ErrDuplicateID is returned when a peer presents a node ID that is
+	// already in use by a different identity key
+	ErrDuplicateID = errors.New("node ID already in use by another identity")
+	// ErrUnprovenIdentity is returned when a peer presents an identity key
+	// without proving it holds it
+	ErrUnprovenIdentity = errors.New("identity key not proven")
+	// ErrNoHandshake is returned for messages from a peer whose handshake
+	// is not complete
+	ErrNoHandshake = errors.New("handshake not complete")
+)
+
+// handshakeTypes are the messages taken from peers before their handshake
+// is complete
+var handshakeTypes = map[protocol.MessageType]bool{
+	protocol.MessageTypeHandshake:      true,
+	protocol.MessageTypeHandshakeProof: true,
+	protocol.MessageTypeError:          true,
+}
+
+// Identity returns the fingerprint of the node's identity key
+func (n *Node) Identity() string {
+	return n.identity.Fingerprint()
+}
+
+// checkIdentity rejects handshakes from this node itself, from peers
+// claiming the ID of another, still connected, identity or, without a key,
+// the ID of any identity known by its key and from peers whose
+// TLS certificate or exchange key is for another identity
+func (n *Node) checkIdentity(peer *network.Peer, payload protocol.HandshakePayload) error {
+	if err := n.checkCertificate(peer, payload.PublicKey); err != nil {
+		return err
+	}
+	if err := n.checkSessionKey(peer, payload.PublicKey); err != nil {
+		return err
+	}
+	if err := checkExchangeKey(payload); err != nil {
+		return err
+	}
+	if payload.NodeID == n.ID {
+		if bytes.Equal(payload.PublicKey, n.identity.Public) {
+			return ErrSelfConnection
+		}
+		return fmt.Errorf("%w: %s is this node's ID", ErrDuplicateID, payload.NodeID)
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	key := n.peerKeys[payload.NodeID]
+	known, ok := n.peers[key]
+	if !ok || known.PublicKey == nil || bytes.Equal(known.PublicKey, payload.PublicKey) {
+		return nil
+	}
+	// A peer without a key never takes the place of one identified by its key
+	if payload.PublicKey == nil {
+		return fmt.Errorf("%w: %s is known as %s", ErrDuplicateID, payload.NodeID, crypto.Fingerprint(known.PublicKey))
+	}
+	// A different key is only accepted once the old identity has disconnected
+	if conn := n.conns[key]; conn != nil && conn != peer && !conn.Closed() {
+		return fmt.Errorf("%w: %s is connected as %s", ErrDuplicateID, payload.NodeID, crypto.Fingerprint(known.PublicKey))
+	}
+	return nil
+}
+
+// renamePeerLocked drops what is known of the peer that last used nodeID,
+// if it had another identity than key, and the node ID that key last went
+// by, if it had another; the caller must hold n.mu
+func (n *Node) renamePeerLocked(key, nodeID string) {
+	if old, ok := n.peerKeys[nodeID]; ok && old != key {
+		delete(n.peers, old)
+		delete(n.conns, old)
+	}
+	if info, ok := n.peers[key]; ok && info.ID != nodeID && n.peerKeys[info.ID] == key {
+		delete(n.peerKeys, info.ID)
+	}
+}
+
+// forgetPeerLocked drops what is known of the peer with identity key; the
+// caller must hold n.mu
+func (n *Node) forgetPeerLocked(key string) {
+	if id := n.peers[key].ID; n.peerKeys[id] == key {
+		delete(n.peerKeys, id)
+	}
+	delete(n.peers, key)
+	delete(n.conns, key)
+}
+
+// checkProof rejects a handshake proof unless it is the signature of the
+// handshake it answers by publicKey; see protocol.ProofData
+func checkProof(publicKey, handshake, proof []byte) error {
+	if len(handshake) == 0 || !crypto.Verify(publicKey, protocol.ProofData(handshake), proof) {
+		return fmt.Errorf("%w: handshake signature of %s does not verify", ErrUnprovenIdentity, crypto.Fingerprint(publicKey))
+	}
+	return nil
+}
+
+// proveHandshake checks that the reply to this node's handshake was signed
+// with the identity key in it, then proves this node's own key by signing
+// the reply. A reply without a key has nothing to check, but still gets the
+// proof, which the peer waits for.
+func (n *Node) proveHandshake(peer *network.Peer, msg *protocol.Message, payload protocol.HandshakePayload) error {
+	if payload.PublicKey != nil {
+		if err := checkProof(payload.PublicKey, peer.Hello(), payload.Proof); err != nil {
+			return err
+		}
+	}
+	proof, err := protocol.NewMessage(protocol.MessageTypeHandshakeProof, n.ID, protocol.HandshakeProof{
+		Proof: n.identity.Sign(protocol.ProofData(msg.Payload)),
+	})
+	if err != nil {
+		return err
+	}
+	if proof, err = proof.Stamp(); err != nil {
+		return err
+	}
+	return peer.Send(proof)
+}
+
+// handleHandshakeProof completes the handshake of a peer that dialed this
+// node once it signed the reply with the identity key it presented
+func (n *Node) handleHandshakeProof(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.HandshakeProof
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse handshake proof: %w", err)
+	}
+	n.mu.Lock()
+	hs, ok := n.handshakes[peer]
+	delete(n.handshakes, peer)
+	n.mu.Unlock()
+	if !ok {
+		// A peer without a key proves nothing; it was identified already
+		return nil
+	}
+	if err := checkProof(hs.payload.PublicKey, hs.reply, payload.Proof); err != nil {
+		n.rejectPeer(peer, err)
+		return err
+	}
+	return n.completeHandshake(peer, hs)
+}
+
+// rejectPeer tells a peer why its connection is refused, then closes it
+func (n *Node) rejectPeer(peer *network.Peer, reason error) {
+	code := ""
+	switch {
+	case errors.Is(reason, ErrSelfConnection):
+		code = protocol.ErrorCodeSelfConnection
+	case errors.Is(reason, ErrDuplicateID):
+		code = protocol.ErrorCodeDuplicateID
+	case errors.Is(reason, ErrBanned):
+		code = protocol.ErrorCodeBanned
+	case errors.Is(reason, ErrNotAllowed):
+		code = protocol.ErrorCodeNotAllowed
+	case errors.Is(reason, ErrCertificateMismatch):
+		code = protocol.ErrorCodeCertificate
+	case errors.Is(reason, ErrSessionKeyMismatch):
+		code = protocol.ErrorCodeSessionKey
+	case errors.Is(reason, ErrInvalidExchangeKey):
+		code = protocol.ErrorCodeExchangeKey
+	case errors.Is(reason, protocol.ErrIncompatibleVersion):
+		code = protocol.ErrorCodeVersion
+	case errors.Is(reason, ErrWrongNetwork):
+		code = protocol.ErrorCodeNetwork
+	case errors.Is(reason, ErrInviteRequired):
+		code = protocol.ErrorCodeInvite
+	case errors.Is(reason, ErrUnprovenIdentity):
+		code = protocol.ErrorCodeUnproven
+	}
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeError, n.ID, protocol.ErrorPayload{
+		Code:    code,
+		Message: reason.Error(),
+	})
+	if err == nil {
+		peer.Send(msg)
+	}
+	peer.Close()
+}
+
+// handleError hands an answer to a request to the request, or logs a
+// peer's refusal and drops the connection
+func (n *Node) handleError(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.ErrorPayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse error: %w", err)
+	}
+	// An answer to a request; the connection stays open
+	if msg.RequestID != "" {
+		if !n.requests.resolve(msg.RequestID, requestError(payload)) && !n.requestRefused(peer, msg.RequestID, payload) {
+			n.debugf("Peer %s answered request %s, which is no longer pending\n", peer.ID(), msg.RequestID)
+		}
+		return nil
+	}
+
+	fmt.Printf("Peer %s refused the connection (%s): %s\n", peer.ID(), payload.Code, payload.Message)
+	n.emit(Event{Type: EventPeerRejected, PeerID: msg.SenderID, Address: peer.Address(), Error: payload.Code})
+	peer.Close()
+	return nil
+}
@@ -0,0 +1,461 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// waitForEvent returns the first event of type want, failing after timeout
+func waitForEvent(t *testing.T, events <-chan Event, want EventType, timeout time.Duration) Event {
+	t.Helper()
+	deadline := time.After(timeout)
+	for {
+		select {
+		case event := <-events:
+			if event.Type == want {
+				return event
+			}
+		case <-deadline:
+			t.Fatalf("Timed out waiting for %s event", want)
+			return Event{}
+		}
+	}
+}
+
+func TestNode_IdentityPersists(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	fingerprint := node.Identity()
+	node.Stop()
+
+	node, err = NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to recreate node: %v", err)
+	}
+	defer node.Stop()
+	if node.Identity() != fingerprint {
+		t.Errorf("Identity() = %s after restart, want %s", node.Identity(), fingerprint)
+	}
+}
+
+func TestNode_RejectsSelfConnection(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("self", freeAddr(t), filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+	node.transport.Start()
+
+	events, unsubscribe := node.Subscribe()
+	defer unsubscribe()
+
+	if err := node.Connect(context.Background(), node.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	event := waitForEvent(t, events, EventPeerRejected, 5*time.Second)
+	if event.Error != protocol.ErrorCodeSelfConnection {
+		t.Errorf("Error = %q, want %q", event.Error, protocol.ErrorCodeSelfConnection)
+	}
+	if peers := node.Peers(); len(peers) != 0 {
+		t.Errorf("Peers() = %v, want none", peers)
+	}
+}
+
+func TestNode_RejectsDuplicateID(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	// Two nodes with their own data directories, and so their own identity
+	// keys, both claiming the ID "twin"
+	original, err := NewNode("twin", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer original.Stop()
+	original.transport.Start()
+
+	impostor, err := NewNode("twin", freeAddr(t), filepath.Join(baseDir, "c", "store"), filepath.Join(baseDir, "c", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer impostor.Stop()
+	impostor.transport.Start()
+
+	if err := original.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := original.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	events, unsubscribe := impostor.Subscribe()
+	defer unsubscribe()
+	if err := impostor.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	event := waitForEvent(t, events, EventPeerRejected, 5*time.Second)
+	if event.Error != protocol.ErrorCodeDuplicateID {
+		t.Errorf("Error = %q, want %q", event.Error, protocol.ErrorCodeDuplicateID)
+	}
+
+	peers := first.Peers()
+	if len(peers) != 1 || !bytes.Equal(peers[0].PublicKey, original.identity.Public) {
+		t.Errorf("Peers() = %+v, want only the original twin", peers)
+	}
+}
+
+func TestNode_KeylessPeerCannotTakeKeyedID(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("node", freeAddr(t), filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	// A peer known by its key, even though no longer connected
+	key := []byte("twin identity key")
+	node.peers[crypto.Fingerprint(key)] = PeerInfo{ID: "twin", PublicKey: key}
+	node.peerKeys["twin"] = crypto.Fingerprint(key)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	peer := network.NewPeer(local, node)
+	defer peer.Close()
+
+	err = node.checkIdentity(peer, protocol.HandshakePayload{NodeID: "twin"})
+	if !errors.Is(err, ErrDuplicateID) {
+		t.Errorf("checkIdentity() = %v, want %v", err, ErrDuplicateID)
+	}
+	if err := node.checkIdentity(peer, protocol.HandshakePayload{NodeID: "other"}); err != nil {
+		t.Errorf("checkIdentity() of a new keyless peer = %v", err)
+	}
+}
+
+func TestNode_RecordsPeerVersion(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	// The dialing side learns the version from the reply, the other from
+	// the initial handshake
+	for _, n := range []*Node{first, second} {
+		peers := n.Peers()
+		if len(peers) != 1 {
+			t.Fatalf("%s has %d peers, want 1", n.ID, len(peers))
+		}
+		if peers[0].UserAgent != protocol.UserAgent() {
+			t.Errorf("%s: UserAgent = %q, want %q", n.ID, peers[0].UserAgent, protocol.UserAgent())
+		}
+		if !peers[0].Supports(protocol.FeatureDelta) {
+			t.Errorf("%s: Supports(%q) = false, want true", n.ID, protocol.FeatureDelta)
+		}
+		if peers[0].Version != protocol.ProtocolVersion {
+			t.Errorf("%s: Version = %d, want %d", n.ID, peers[0].Version, protocol.ProtocolVersion)
+		}
+		if len(peers[0].Addresses) != 1 || peers[0].Addresses[0] != peers[0].Address {
+			t.Errorf("%s: Addresses = %v, want [%s]", n.ID, peers[0].Addresses, peers[0].Address)
+		}
+	}
+
+	// Peers that predate feature announcement support nothing
+	old := PeerInfo{ID: "old"}
+	if old.Supports(protocol.FeatureDelta) {
+		t.Errorf("Supports(%q) on an old peer = true, want false", protocol.FeatureDelta)
+	}
+}
+
+func TestNode_NegotiatesCodec(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	binary, err := NewNode("binary", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer binary.Stop()
+	binary.transport.Start()
+
+	jsonOnly, err := NewNode("json", freeAddr(t), filepath.Join(baseDir, "c", "store"), filepath.Join(baseDir, "c", "watch"), WithFirstNode(false),
+		WithCodecs([]string{protocol.CodecJSON}), WithFrameCompression(nil, 0))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer jsonOnly.Stop()
+	jsonOnly.transport.Start()
+
+	for _, n := range []*Node{binary, jsonOnly} {
+		if err := n.Connect(context.Background(), first.Address()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		if err := n.waitForKey(5 * time.Second); err != nil {
+			t.Fatalf("%s: Failed to receive network key: %v", n.ID, err)
+		}
+	}
+
+	connOf := func(n *Node, peer string) *network.Peer {
+		conn, _ := n.peerConn(peer)
+		return conn
+	}
+	for _, tc := range []struct {
+		from, to    string
+		node        *Node
+		want        string
+		compression string
+	}{
+		{"first", "binary", first, protocol.CodecBinary, protocol.CompressionGzip},
+		{"binary", "first", binary, protocol.CodecBinary, protocol.CompressionGzip},
+		{"first", "json", first, protocol.CodecJSON, ""},
+		{"json", "first", jsonOnly, protocol.CodecJSON, ""},
+	} {
+		conn := connOf(tc.node, tc.to)
+		if got := conn.Codec().Name(); got != tc.want {
+			t.Errorf("Codec from %s to %s = %q, want %q", tc.from, tc.to, got, tc.want)
+		}
+		if got := conn.Compression(); got != tc.compression {
+			t.Errorf("Compression from %s to %s = %q, want %q", tc.from, tc.to, got, tc.compression)
+		}
+	}
+}
+
+func TestNode_ReconnectKeepsPeerID(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	// Each connection comes from a new address
+	var conns []*network.Peer
+	for i := 0; i < 2; i++ {
+		if err := second.Connect(context.Background(), first.Address()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			conn, ok := first.peerConn("second")
+			if ok && (len(conns) == 0 || conn != conns[0]) {
+				conns = append(conns, conn)
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for connection %d", i+1)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	if conns[0].Address() == conns[1].Address() {
+		t.Fatalf("Both connections came from %s", conns[0].Address())
+	}
+	if conns[0].ID() != second.Identity() || conns[1].ID() != second.Identity() {
+		t.Errorf("Peer IDs = %q, %q, want the identity fingerprint %q", conns[0].ID(), conns[1].ID(), second.Identity())
+	}
+	if !conns[0].Closed() {
+		t.Error("The first connection was left open after reconnecting")
+	}
+}
+
+func TestNode_SimultaneousDialKeepsOneConnection(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	errs := make(chan error, 1)
+	go func() { errs <- first.Connect(context.Background(), second.Address()) }()
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	// Both keep the connection dialed by the lower fingerprint
+	dialer, listener := first, second
+	if second.Identity() < first.Identity() {
+		dialer, listener = second, first
+	}
+	settled := func() bool {
+		out, ok := dialer.peerConn(listener.ID)
+		if !ok || out.Address() != listener.Address() {
+			return false
+		}
+		in, ok := listener.peerConn(dialer.ID)
+		return ok && in.Address() != dialer.Address() &&
+			dialer.transport.PeerCount() == 1 && listener.transport.PeerCount() == 1
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !settled() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Connections did not settle: %d and %d peers", first.transport.PeerCount(), second.transport.PeerCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !settled() {
+		t.Error("The surviving connection was closed")
+	}
+}
+
+// recordedMessage is a message received by a bare transport
+type recordedMessage struct {
+	peer *network.Peer
+	msg  *protocol.Message
+}
+
+// messageRecorder passes the messages a bare transport receives to a channel
+type messageRecorder chan recordedMessage
+
+func (r messageRecorder) HandleMessage(peer *network.Peer, msg *protocol.Message) error {
+	r <- recordedMessage{peer, msg}
+	return nil
+}
+
+func TestNode_RefusesUnprovenIdentity(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	// The impostor presents a public key it doesn't hold the private half of
+	victim, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	forger, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	received := make(messageRecorder, 16)
+	impostor, err := network.NewTransport("victim", freeAddr(t), received, network.WithIdentityKey(victim.Public), network.WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer impostor.Stop()
+	if err := impostor.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	next := func(want protocol.MessageType) recordedMessage {
+		t.Helper()
+		for {
+			select {
+			case r := <-received:
+				if r.msg.Type == want {
+					return r
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Timed out waiting for %s", want)
+				return recordedMessage{}
+			}
+		}
+	}
+	reply := next(protocol.MessageTypeHandshake)
+	if _, ok := first.peerConn("victim"); ok || len(first.Peers()) != 0 {
+		t.Fatalf("Peers() = %+v before the key was proven, want none", first.Peers())
+	}
+
+	// A proof signed with any other key is refused
+	proof, err := protocol.NewMessage(protocol.MessageTypeHandshakeProof, "victim", protocol.HandshakeProof{
+		Proof: forger.Sign(protocol.ProofData(reply.msg.Payload)),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := reply.peer.Send(proof); err != nil {
+		t.Fatalf("Failed to send proof: %v", err)
+	}
+	var refusal protocol.ErrorPayload
+	if err := next(protocol.MessageTypeError).msg.ParsePayload(&refusal); err != nil {
+		t.Fatalf("Failed to parse error: %v", err)
+	}
+	if refusal.Code != protocol.ErrorCodeUnproven {
+		t.Errorf("Code = %q, want %q", refusal.Code, protocol.ErrorCodeUnproven)
+	}
+	if peers := first.Peers(); len(peers) != 0 {
+		t.Errorf("Peers() = %+v, want none", peers)
+	}
+}
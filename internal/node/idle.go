@@ -0,0 +1,120 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+// IdleConfig closes connections that have carried nothing but heartbeats
+// for a while, so a node in a large network doesn't hold a connection to
+// every peer it ever talked to. Peers whose connections are closed stay
+// known and can be dialed again with ConnectKnown.
+type IdleConfig struct {
+	// Timeout is how long a connection may go unused before it is closed;
+	// 0 never closes idle connections
+	Timeout time.Duration
+	// MinPeers is how many connections are kept open however idle they are
+	MinPeers int
+}
+
+// DefaultIdleConfig closes connections unused for ten minutes, keeping at
+// least eight open
+func DefaultIdleConfig() IdleConfig {
+	return IdleConfig{
+		Timeout:  10 * time.Minute,
+		MinPeers: 8,
+	}
+}
+
+// WithIdleConfig sets when idle connections are closed
+func WithIdleConfig(cfg IdleConfig) Option {
+	return func(n *Node) {
+		n.idleConfig = cfg
+	}
+}
+
+// idleLoop closes idle connections a few times per timeout until the node
+// stops
+func (n *Node) idleLoop() {
+	ticker := time.NewTicker(n.idleConfig.Timeout / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			n.closeIdle()
+		}
+	}
+}
+
+// closeIdle closes the connections unused for longer than the timeout, the
+// longest unused first, while more than MinPeers are open. Overlay
+// neighbours and peers with transfers under way are kept.
+func (n *Node) closeIdle() {
+	keep := make(map[string]bool)
+	if n.overlayConfig.enabled() {
+		for id := range n.overlay.targets() {
+			keep[id] = true
+		}
+	}
+	for _, t := range n.Transfers() {
+		keep[t.PeerID] = true
+	}
+
+	type candidate struct {
+		id   string
+		conn *network.Peer
+		used time.Time
+	}
+	open := 0
+	var idle []candidate
+	n.mu.RLock()
+	for key, conn := range n.conns {
+		if conn.Closed() {
+			continue
+		}
+		open++
+		id := n.peers[key].ID
+		if used := conn.LastUsed(); !keep[id] && time.Since(used) >= n.idleConfig.Timeout {
+			idle = append(idle, candidate{id, conn, used})
+		}
+	}
+	n.mu.RUnlock()
+
+	sort.Slice(idle, func(i, j int) bool { return idle[i].used.Before(idle[j].used) })
+	for _, c := range idle {
+		if open <= n.idleConfig.MinPeers {
+			return
+		}
+		n.debugf("Closing connection to %s: unused for %v\n", c.id, time.Since(c.used).Round(time.Second))
+		c.conn.Close()
+		open--
+	}
+}
+
+// ConnectKnown dials a peer the node has connected to before, such as one
+// whose idle connection was closed, at the addresses it last announced. It
+// returns at once if the peer is still connected.
+func (n *Node) ConnectKnown(ctx context.Context, nodeID string) error {
+	if _, ok := n.peerConn(nodeID); ok {
+		return nil
+	}
+	n.mu.RLock()
+	info, ok := n.peers[n.peerKeys[nodeID]]
+	n.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown peer %s", nodeID)
+	}
+
+	addresses := info.Addresses
+	if len(addresses) == 0 {
+		addresses = []string{info.Address}
+	}
+	return n.ConnectAny(ctx, addresses)
+}
@@ -0,0 +1,119 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNode_ClosesIdleConnections(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "first", "store"), filepath.Join(baseDir, "first", "watch"), WithFirstNode(true), WithOverlay(OverlayConfig{}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "second", "store"), filepath.Join(baseDir, "second", "watch"),
+		WithFirstNode(false), WithOverlay(OverlayConfig{}), WithIdleConfig(IdleConfig{Timeout: 200 * time.Millisecond}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	if err := second.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	if _, ok := second.peerConn("first"); !ok {
+		t.Fatal("Not connected after the handshake")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := second.peerConn("first"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the idle connection to close")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	known := false
+	for _, p := range second.Peers() {
+		known = known || p.ID == "first"
+	}
+	if !known {
+		t.Fatal("Peer forgotten after its idle connection closed")
+	}
+
+	if err := second.ConnectKnown(context.Background(), "first"); err != nil {
+		t.Fatalf("ConnectKnown() error = %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := second.peerConn("first"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting to reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNode_KeepsMinPeersOpen(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "first", "store"), filepath.Join(baseDir, "first", "watch"), WithFirstNode(true), WithOverlay(OverlayConfig{}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "second", "store"), filepath.Join(baseDir, "second", "watch"),
+		WithFirstNode(false), WithOverlay(OverlayConfig{}), WithIdleConfig(IdleConfig{Timeout: time.Millisecond, MinPeers: 1}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	second.closeIdle()
+	if _, ok := second.peerConn("first"); !ok {
+		t.Error("Closed the only connection with MinPeers 1")
+	}
+}
+
+func TestNode_ConnectKnownUnknownPeer(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	n, err := NewNode("node", freeAddr(t), filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer n.Stop()
+
+	if err := n.ConnectKnown(context.Background(), "stranger"); err == nil {
+		t.Error("ConnectKnown() to an unknown peer succeeded")
+	}
+}
@@ -0,0 +1,75 @@
+package node
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// IgnoreFileName is the per-directory file listing patterns to skip when
+// importing or watching, one per line
+const IgnoreFileName = ".p2pignore"
+
+// defaultIgnorePatterns are skipped even without an ignore file
+var defaultIgnorePatterns = []string{
+	".git/",
+	".DS_Store",
+	"*.swp",
+	"*.tmp",
+	"*~",
+	IgnoreFileName,
+}
+
+// ignoreRules matches paths against gitignore-style patterns. A pattern
+// ending in "/" only matches directories; a pattern containing "/" is
+// matched against the path relative to the root, otherwise against any
+// single path element's base name.
+type ignoreRules struct {
+	patterns []string
+}
+
+// loadIgnoreRules combines the default patterns with the ignore file in dir, if any
+func loadIgnoreRules(dir string) *ignoreRules {
+	rules := &ignoreRules{patterns: append([]string(nil), defaultIgnorePatterns...)}
+
+	file, err := os.Open(filepath.Join(dir, IgnoreFileName))
+	if err != nil {
+		return rules
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules.patterns = append(rules.patterns, line)
+	}
+	return rules
+}
+
+// match reports whether the slash-separated relative path should be skipped
+func (r *ignoreRules) match(rel string, isDir bool) bool {
+	base := path.Base(rel)
+	for _, pattern := range r.patterns {
+		dirOnly := strings.HasSuffix(pattern, "/")
+		pattern = strings.TrimSuffix(pattern, "/")
+		if dirOnly && !isDir {
+			continue
+		}
+
+		var ok bool
+		if strings.Contains(pattern, "/") {
+			ok, _ = path.Match(strings.TrimPrefix(pattern, "/"), rel)
+		} else {
+			ok, _ = path.Match(pattern, base)
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	dir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	patterns := "# build output\nbuild/\n*.log\ndocs/draft.md\n"
+	if err := os.WriteFile(filepath.Join(dir, IgnoreFileName), []byte(patterns), 0644); err != nil {
+		t.Fatalf("Failed to write ignore file: %v", err)
+	}
+	rules := loadIgnoreRules(dir)
+
+	tests := []struct {
+		path  string
+		isDir bool
+		want  bool
+	}{
+		{".git", true, true},
+		{"src/.DS_Store", false, true},
+		{"build", true, true},
+		{"build", false, false},
+		{"logs/server.log", false, true},
+		{"docs/draft.md", false, true},
+		{"docs/final.md", false, false},
+		{"src/main.go", false, false},
+	}
+	for _, tt := range tests {
+		if got := rules.match(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("match(%q, %v) = %v, want %v", tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+// Manifest records the layout of an imported directory tree so it can be
+// restored elsewhere. It is stored as an ordinary encrypted object.
+type Manifest struct {
+	Root    string          `json:"root"`
+	Created time.Time       `json:"created"`
+	Entries []ManifestEntry `json:"entries"`
+	// Base is the manifest of the previous import of the same directory
+	Base      string `json:"base,omitempty"`
+	PublicKey []byte `json:"public_key,omitempty"` // identity of the importing node
+}
+
+// ManifestEntry is a single file within a manifest
+type ManifestEntry struct {
+	Path    string      `json:"path"` // slash-separated, relative to the root
+	Hash    string      `json:"hash,omitempty"`
+	Link    string      `json:"link,omitempty"` // symlink target, for preserved links
+	Size    int64       `json:"size"`
+	Mode    fs.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+	// Encryption and Key tell how the object is encrypted, so a restore
+	// does not depend on the catalog
+	Encryption EncryptionMode `json:"encryption,omitempty"`
+	Key        []byte         `json:"key,omitempty"`
+}
+
+// ImportResult summarizes a directory import
+type ImportResult struct {
+	Imported int
+	Skipped  int // unchanged since a previous import
+	Ignored  int
+	Links    int // symlinks preserved as links
+	Failed   int
+	Bytes    int64
+	Manifest string // hash of the stored manifest
+	Errors   []string
+	// Changes since the previous import of the directory, whose manifest
+	// is Base
+	Base    string
+	Added   int
+	Changed int
+	Removed int
+}
+
+// Import walks dir and stores every regular file not excluded by ignore
+// patterns, recording paths relative to dir. Files unchanged since they were
+// last imported are not stored again. Symbolic links are handled according
+// to the node's symlink policy. A manifest of the tree is stored too, and all
+// new objects are announced to peers like watch directory files. When the
+// directory was imported before, the changes since are published as a
+// change set, and an unchanged tree keeps its previous manifest.
+func (n *Node) Import(dir string) (*ImportResult, error) {
+	return n.ImportIn("", dir)
+}
+
+// ImportIn imports dir into a namespace, encrypting its files and manifest
+// as the namespace's policy requires
+func (n *Node) ImportIn(namespace, dir string) (*ImportResult, error) {
+	if n.Draining() {
+		return nil, ErrDraining
+	}
+	if namespace != "" {
+		if err := validateNamespace(namespace); err != nil {
+			return nil, err
+		}
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve directory: %w", err)
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve directory: %w", err)
+	}
+
+	if err := n.waitForKey(10 * time.Second); err != nil {
+		return nil, fmt.Errorf("failed waiting for network key: %w", err)
+	}
+
+	im := &importer{
+		node:      n,
+		rules:     loadIgnoreRules(root),
+		result:    &ImportResult{},
+		manifest:  Manifest{Root: filepath.Base(root), Created: time.Now()},
+		namespace: namespace,
+		mode:      n.NamespaceMode(namespace),
+	}
+	err = im.walk(root, "", []string{realRoot})
+	if saveErr := n.hashes.save(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	result := im.result
+	if err != nil {
+		return result, fmt.Errorf("failed to import directory: %w", err)
+	}
+	if err := n.catalog.addAll(im.metas); err != nil {
+		return result, fmt.Errorf("failed to update catalog: %w", err)
+	}
+
+	for _, meta := range im.stored {
+		n.announce(meta)
+	}
+
+	// Files that failed to import are missing from the manifest, so it is
+	// not compared with the previous version or recorded as the latest
+	var changes *ChangeSet
+	base := n.sync.lastImport(root)
+	if base != "" && result.Failed == 0 {
+		if prev, err := n.loadManifest(base); err == nil {
+			c := ChangeSet{Root: im.manifest.Root, Base: base, Created: im.manifest.Created.UTC().Truncate(time.Second)}
+			c.Added, c.Changed, c.Removed = diffManifests(prev, im.manifest)
+			result.Base = base
+			result.Added, result.Changed, result.Removed = len(c.Added), len(c.Changed), len(c.Removed)
+			if len(c.Added)+len(c.Changed)+len(c.Removed) == 0 {
+				result.Manifest = base
+				return result, nil
+			}
+			im.manifest.Base = base
+			changes = &c
+		}
+	}
+
+	im.manifest.PublicKey = n.identity.Public
+	manifestHash, err := n.storeManifest(im.manifest, namespace)
+	if err != nil {
+		return result, err
+	}
+	result.Manifest = manifestHash
+
+	if changes != nil {
+		changes.Manifest = manifestHash
+		if err := n.publishChangeSet(*changes); err != nil {
+			return result, fmt.Errorf("failed to publish change set: %w", err)
+		}
+	}
+	if result.Failed == 0 {
+		if err := n.sync.imported(root, manifestHash); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// importer accumulates the state of a single Import call
+type importer struct {
+	node     *Node
+	rules    *ignoreRules
+	result   *ImportResult
+	manifest Manifest
+	metas    []FileMeta // catalog entries for every imported file
+	stored   []FileMeta // files newly stored by this import
+	// Files are imported into namespace and encrypted with mode
+	namespace string
+	mode      EncryptionMode
+}
+
+func (im *importer) fail(rel string, err error) {
+	im.result.Failed++
+	im.result.Errors = append(im.result.Errors, fmt.Sprintf("%s: %v", rel, err))
+}
+
+// walk imports the tree at dir, naming entries relative to prefix. chain
+// holds the real paths of the import root and every directory reached by
+// following a link, used to detect links that loop back on themselves.
+func (im *importer) walk(dir, prefix string, chain []string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			im.fail(path, err)
+			if d != nil && d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if path == dir {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(filepath.Join(prefix, rel))
+
+		isLink := d.Type()&fs.ModeSymlink != 0
+		if im.rules.match(rel, d.IsDir()) {
+			im.result.Ignored++
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isLink {
+			return im.link(path, rel, chain)
+		}
+		if d.IsDir() || !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			im.fail(rel, err)
+			return nil
+		}
+		im.file(path, rel, info)
+		return nil
+	})
+}
+
+// link applies the symlink policy to the link at path
+func (im *importer) link(path, rel string, chain []string) error {
+	switch im.node.symlinkPolicy {
+	case SymlinkIgnore:
+		im.result.Ignored++
+		return nil
+	case SymlinkPreserve:
+		target, err := os.Readlink(path)
+		if err != nil {
+			im.fail(rel, err)
+			return nil
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			im.fail(rel, err)
+			return nil
+		}
+		im.manifest.Entries = append(im.manifest.Entries, ManifestEntry{
+			Path:    rel,
+			Link:    target,
+			ModTime: info.ModTime(),
+		})
+		im.result.Links++
+		return nil
+	}
+
+	real, info, err := resolveLink(path)
+	if err != nil {
+		im.fail(rel, err)
+		return nil
+	}
+	if !info.IsDir() {
+		if info.Mode().IsRegular() {
+			im.file(real, rel, info)
+		}
+		return nil
+	}
+
+	// A directory link loops if it leads back to a directory being walked
+	// or to one of their ancestors
+	for _, dir := range chain {
+		if within(dir, real) {
+			im.fail(rel, errSymlinkLoop)
+			return nil
+		}
+	}
+	if current, err := filepath.EvalSymlinks(filepath.Dir(path)); err == nil && within(current, real) {
+		im.fail(rel, errSymlinkLoop)
+		return nil
+	}
+	return im.walk(real, rel, append(chain[:len(chain):len(chain)], real))
+}
+
+// file stores one regular file unless the hash cache shows it is unchanged.
+// A file stored before with a different encryption mode is stored again.
+func (im *importer) file(path, rel string, info os.FileInfo) {
+	n := im.node
+	hash, ok := n.hashes.lookup(path, info)
+	known, cataloged := n.catalog.get(hash)
+	fresh := !ok || !n.store.Exists(hash) || !cataloged || known.Encryption.orDefault() != im.mode
+	var key crypto.Key
+	if !fresh {
+		im.result.Skipped++
+		key = known.Key
+	} else {
+		var err error
+		if hash, key, err = n.ingestFile(path, im.mode); err != nil {
+			im.fail(rel, err)
+			return
+		}
+		n.hashes.put(path, info, hash)
+		im.result.Imported++
+		im.result.Bytes += info.Size()
+	}
+
+	meta := FileMeta{
+		Hash:       hash,
+		Name:       filepath.Base(filepath.FromSlash(rel)),
+		Path:       rel,
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		Namespace:  im.namespace,
+		Encryption: im.mode,
+		Key:        key,
+	}
+	if fresh {
+		meta.Previous = n.catalog.previous(meta)
+	} else {
+		meta.Previous = known.Previous
+	}
+	im.metas = append(im.metas, meta)
+	if fresh {
+		im.stored = append(im.stored, meta)
+		n.emit(Event{Type: EventFileStored, ContentHash: hash, FileName: rel, Size: info.Size()})
+	}
+
+	im.manifest.Entries = append(im.manifest.Entries, ManifestEntry{
+		Path:       rel,
+		Hash:       hash,
+		Size:       info.Size(),
+		Mode:       info.Mode().Perm(),
+		ModTime:    info.ModTime(),
+		Encryption: im.mode,
+		Key:        key,
+	})
+}
+
+// storeManifest stores an encoded manifest as an object in a namespace and
+// catalogs it
+func (n *Node) storeManifest(manifest Manifest, namespace string) (string, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	mode := n.NamespaceMode(namespace)
+	hash, key, err := n.ingest(bytes.NewReader(data), mode)
+	if err != nil {
+		return "", fmt.Errorf("failed to store manifest: %w", err)
+	}
+
+	meta := FileMeta{
+		Hash:       hash,
+		Name:       manifest.Root,
+		Size:       int64(len(data)),
+		ModTime:    manifest.Created,
+		Manifest:   true,
+		Namespace:  namespace,
+		Encryption: mode,
+		Key:        key,
+	}
+	if err := n.catalog.add(meta); err != nil {
+		return "", fmt.Errorf("failed to update catalog: %w", err)
+	}
+	n.announce(meta)
+	return hash, nil
+}
+
+// ingestFile encrypts and stores the file at path within the ingest
+// limits, returning its content hash and, under EncryptPerFile, its key
+func (n *Node) ingestFile(path string, mode EncryptionMode) (string, crypto.Key, error) {
+	release, err := n.admitIngest(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer release()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	return n.ingest(file, mode)
+}
+
+// ingest encrypts r as mode requires and stores the result. The key is
+// returned only for EncryptPerFile, which generates a new one.
+func (n *Node) ingest(r io.Reader, mode EncryptionMode) (string, crypto.Key, error) {
+	tempFile, err := n.store.CreateTemp()
+	if err != nil {
+		return "", nil, err
+	}
+	defer func() {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+	}()
+
+	var key, fileKey crypto.Key
+	switch mode.orDefault() {
+	case EncryptPerFile:
+		if fileKey, err = crypto.GenerateKey(); err != nil {
+			return "", nil, fmt.Errorf("failed to generate file key: %w", err)
+		}
+		key = fileKey
+	case EncryptNetwork:
+		n.mu.RLock()
+		key = n.networkKey
+		n.mu.RUnlock()
+	}
+
+	if key == nil {
+		if _, err := io.Copy(tempFile, r); err != nil {
+			return "", nil, fmt.Errorf("failed to copy file: %w", err)
+		}
+	} else if err := crypto.EncryptStream(key, r, tempFile); err != nil {
+		return "", nil, fmt.Errorf("failed to encrypt file: %w", err)
+	}
+
+	if _, err := tempFile.Seek(0, 0); err != nil {
+		return "", nil, err
+	}
+
+	hash, err := crypto.ContentHash(tempFile)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if _, err := tempFile.Seek(0, 0); err != nil {
+		return "", nil, err
+	}
+
+	if err := n.store.Store(hash, tempFile); err != nil {
+		return "", nil, err
+	}
+	return hash, fileKey, nil
+}
+
+// announce tells peers about a stored object so they replicate it. Objects
+// stored in quick succession are announced together; see BatchConfig.
+func (n *Node) announce(meta FileMeta) {
+	payload, err := n.announcementPayload(meta)
+	if err != nil {
+		return
+	}
+	n.queueAnnouncement(payload)
+}
+
+// announcement builds the message offering a stored object to peers. It
+// fails for plaintext objects of a namespace that requires encryption.
+func (n *Node) announcement(meta FileMeta) (*protocol.Message, error) {
+	payload, err := n.announcementPayload(meta)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, n.ID, payload)
+	if err != nil {
+		return nil, err
+	}
+	msg.TraceID = n.traceID(nil)
+	return msg, nil
+}
+
+func (n *Node) announcementPayload(meta FileMeta) (protocol.DataPayload, error) {
+	if err := n.servable(meta); err != nil {
+		return protocol.DataPayload{}, err
+	}
+	payload := protocol.DataPayload{
+		ContentHash: meta.Hash,
+		FileName:    meta.Name,
+		Path:        meta.Path,
+		Size:        meta.Size,
+		Encrypted:   meta.Encryption != EncryptNone,
+		FromWatch:   true,
+		Manifest:    meta.Manifest,
+		Link:        meta.Link,
+		Previous:    meta.Previous,
+		Namespace:   meta.Namespace,
+	}
+	if meta.Encryption == EncryptPerFile {
+		// Only members of the network can unwrap the key
+		wrapped, err := n.seal(meta.Key)
+		if err != nil {
+			return protocol.DataPayload{}, fmt.Errorf("failed to wrap file key: %w", err)
+		}
+		payload.Encryption = string(EncryptPerFile)
+		payload.Key = wrapped
+	}
+	return payload, nil
+}
@@ -0,0 +1,72 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNode_Import(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	src := filepath.Join(baseDir, "src")
+	files := map[string]string{
+		"a.txt":          "alpha",
+		"sub/b.txt":      "beta",
+		"sub/deep/c.txt": "gamma",
+		"sub/skip.log":   "ignored by pattern",
+		".git/config":    "ignored by default",
+	}
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, IgnoreFileName), []byte("*.log\n"), 0644); err != nil {
+		t.Fatalf("Failed to write ignore file: %v", err)
+	}
+
+	result, err := node.Import(src)
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+	if result.Imported != 3 {
+		t.Errorf("Imported = %v, want %v", result.Imported, 3)
+	}
+	if result.Ignored != 3 { // .git, skip.log, .p2pignore
+		t.Errorf("Ignored = %v, want %v", result.Ignored, 3)
+	}
+	if result.Manifest == "" || !node.store.Exists(result.Manifest) {
+		t.Error("Manifest was not stored")
+	}
+
+	paths := make(map[string]bool)
+	for _, f := range node.Files() {
+		paths[f.Path] = true
+	}
+	for _, want := range []string{"a.txt", "sub/b.txt", "sub/deep/c.txt"} {
+		if !paths[want] {
+			t.Errorf("Catalog missing path %q", want)
+		}
+	}
+
+	// A second import of the unchanged tree stores nothing new
+	again, err := node.Import(src)
+	if err != nil {
+		t.Fatalf("Failed to re-import: %v", err)
+	}
+	if again.Imported != 0 || again.Skipped != 3 {
+		t.Errorf("Re-import = %d imported, %d skipped, want 0, 3", again.Imported, again.Skipped)
+	}
+}
@@ -0,0 +1,283 @@
+package node
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+// ErrInviteRequired is returned for peers joining an invite-only node
+// without a valid invite
+var ErrInviteRequired = errors.New("a valid invite is required to join")
+
+// Invite admits new nodes to an invite-only node. Only a hash of its token
+// is kept, so the token is shown once, when the invite is created.
+type Invite struct {
+	ID      string    `json:"id"`   // short prefix of the token hash, for listing and revoking
+	Hash    string    `json:"hash"` // SHA-256 of the token
+	Uses    int       `json:"uses"` // joins left; 0 for any number until it expires
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"` // zero if it never expires
+}
+
+func (i Invite) expired(now time.Time) bool {
+	return !i.Expires.IsZero() && !now.Before(i.Expires)
+}
+
+// inviteStore holds open invites and the identities of the nodes admitted
+// with one, which need no invite to reconnect, and persists them as JSON
+type inviteStore struct {
+	path    string
+	mu      sync.Mutex
+	invites map[string]Invite // by ID
+	members map[string]string // node ID by identity key fingerprint
+	now     func() time.Time
+}
+
+type inviteFile struct {
+	Invites []Invite          `json:"invites"`
+	Members map[string]string `json:"members"`
+}
+
+// loadInvites reads the invites at path, starting empty if it does not exist
+func loadInvites(path string) (*inviteStore, error) {
+	s := &inviteStore{
+		path:    path,
+		invites: make(map[string]Invite),
+		members: make(map[string]string),
+		now:     time.Now,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read invites: %w", err)
+	}
+
+	var file inviteFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse invites: %w", err)
+	}
+	for _, invite := range file.Invites {
+		s.invites[invite.ID] = invite
+	}
+	for fingerprint, id := range file.Members {
+		s.members[fingerprint] = id
+	}
+	return s, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// create adds an invite and returns its token
+func (s *inviteStore) create(uses int, ttl time.Duration) (string, Invite, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", Invite{}, err
+	}
+	token := hex.EncodeToString(secret)
+	hash := hashToken(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	invite := Invite{ID: hash[:8], Hash: hash, Uses: uses, Created: s.now()}
+	if ttl > 0 {
+		invite.Expires = invite.Created.Add(ttl)
+	}
+	s.invites[invite.ID] = invite
+	return token, invite, s.saveLocked()
+}
+
+// redeem uses up one join of the invite with the given token and, if the
+// joining node has an identity key, admits it for good. It reports false
+// if the token matches no open invite.
+func (s *inviteStore) redeem(token, fingerprint, nodeID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hash := hashToken(token)
+	invite, ok := s.invites[hash[:8]]
+	if !ok || invite.Hash != hash || invite.expired(s.now()) {
+		return false, nil
+	}
+	switch invite.Uses {
+	case 0:
+		// Any number of joins until it expires
+	case 1:
+		delete(s.invites, invite.ID)
+	default:
+		invite.Uses--
+		s.invites[invite.ID] = invite
+	}
+	if fingerprint != "" {
+		s.members[fingerprint] = nodeID
+	}
+	return true, s.saveLocked()
+}
+
+// member reports whether the identity was admitted with an invite before
+func (s *inviteStore) member(fingerprint string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.members[fingerprint]
+	return ok
+}
+
+// revoke removes an open invite, reporting whether there was one
+func (s *inviteStore) revoke(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.invites[id]; !ok {
+		return false, nil
+	}
+	delete(s.invites, id)
+	return true, s.saveLocked()
+}
+
+// list returns the open invites, oldest first
+func (s *inviteStore) list() []Invite {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	invites := make([]Invite, 0, len(s.invites))
+	for _, invite := range s.invites {
+		if !invite.expired(now) {
+			invites = append(invites, invite)
+		}
+	}
+	sort.Slice(invites, func(i, j int) bool {
+		return invites[i].Created.Before(invites[j].Created)
+	})
+	return invites
+}
+
+// saveLocked writes the invites atomically, dropping expired ones; the
+// caller must hold s.mu
+func (s *inviteStore) saveLocked() error {
+	now := s.now()
+	file := inviteFile{Members: s.members}
+	for id, invite := range s.invites {
+		if invite.expired(now) {
+			delete(s.invites, id)
+			continue
+		}
+		file.Invites = append(file.Invites, invite)
+	}
+	sort.Slice(file.Invites, func(i, j int) bool {
+		return file.Invites[i].ID < file.Invites[j].ID
+	})
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode invites: %w", err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// WithInviteOnly admits only peers that present a valid invite, or that
+// were admitted with one before, instead of any peer that connects. Only
+// admitted peers are sent the network key. See CreateInvite.
+func WithInviteOnly(enabled bool) Option {
+	return func(n *Node) {
+		n.inviteOnly = enabled
+	}
+}
+
+// WithInvite sets the invite token the node presents to join the
+// invite-only node at address. It is sent only in handshakes dialed to that
+// address, so no other peer learns it.
+func WithInvite(token, address string) Option {
+	return func(n *Node) {
+		n.invite = token
+		n.inviteAddress = address
+	}
+}
+
+// InviteOnly reports whether the node admits only invited peers
+func (n *Node) InviteOnly() bool {
+	return n.inviteOnly
+}
+
+// CreateInvite returns the token of a new invite that admits uses nodes,
+// or any number while it lasts if uses is 0, until ttl has passed, or for
+// good if ttl is 0. An invite must be limited in uses, time or both.
+func (n *Node) CreateInvite(uses int, ttl time.Duration) (string, Invite, error) {
+	if uses < 0 || ttl < 0 {
+		return "", Invite{}, fmt.Errorf("invite uses and lifetime must not be negative")
+	}
+	if uses == 0 && ttl == 0 {
+		return "", Invite{}, fmt.Errorf("an invite needs a number of uses, a lifetime or both")
+	}
+	return n.invites.create(uses, ttl)
+}
+
+// Invites returns the open invites
+func (n *Node) Invites() []Invite {
+	return n.invites.list()
+}
+
+// RevokeInvite removes an open invite by ID, reporting whether there was one
+func (n *Node) RevokeInvite(id string) (bool, error) {
+	return n.invites.revoke(id)
+}
+
+// checkInvite rejects peers of an invite-only node that were not admitted
+// before and present no invite, before their handshake is answered. The
+// invite is only checked and used up by redeemInvite, once the peer has
+// proven its identity key.
+func (n *Node) checkInvite(payload protocol.HandshakePayload) error {
+	if !n.inviteOnly {
+		return nil
+	}
+	// Membership is bound to an identity key, so peers without one can't
+	// be admitted
+	if payload.PublicKey == nil {
+		return fmt.Errorf("%w: %s presented no identity key", ErrInviteRequired, payload.NodeID)
+	}
+	if n.invites.member(crypto.Fingerprint(payload.PublicKey)) {
+		return nil
+	}
+	if payload.Invite == "" {
+		return fmt.Errorf("%w: %s presented none", ErrInviteRequired, payload.NodeID)
+	}
+	return nil
+}
+
+// redeemInvite admits a peer of an invite-only node that proved its
+// identity key, using up its invite unless the key was admitted before
+func (n *Node) redeemInvite(payload protocol.HandshakePayload) error {
+	if err := n.checkInvite(payload); err != nil {
+		return err
+	}
+	fingerprint := crypto.Fingerprint(payload.PublicKey)
+	if !n.inviteOnly || n.invites.member(fingerprint) {
+		return nil
+	}
+	ok, err := n.invites.redeem(payload.Invite, fingerprint, payload.NodeID)
+	if err != nil {
+		return fmt.Errorf("failed to redeem invite: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: the invite of %s is unknown, used up or expired", ErrInviteRequired, payload.NodeID)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+func TestInviteStore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "invites.json")
+	store, err := loadInvites(path)
+	if err != nil {
+		t.Fatalf("loadInvites() error = %v", err)
+	}
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	single, _, err := store.create(1, 0)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	expiring, _, err := store.create(0, time.Hour)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+
+	if ok, _ := store.redeem("not a token", "", "x"); ok {
+		t.Error("redeem() of an unknown token = true")
+	}
+	if ok, _ := store.redeem(single, "fp-a", "a"); !ok {
+		t.Fatal("redeem() of a single-use invite = false")
+	}
+	if ok, _ := store.redeem(single, "fp-b", "b"); ok {
+		t.Error("redeem() of a used-up invite = true")
+	}
+	if !store.member("fp-a") || store.member("fp-b") {
+		t.Error("Only the node that redeemed the invite should be a member")
+	}
+
+	// Unlimited uses until it expires
+	for _, fp := range []string{"fp-c", "fp-d"} {
+		if ok, _ := store.redeem(expiring, fp, fp); !ok {
+			t.Errorf("redeem() of an open expiring invite by %s = false", fp)
+		}
+	}
+	now = now.Add(2 * time.Hour)
+	if ok, _ := store.redeem(expiring, "fp-e", "e"); ok {
+		t.Error("redeem() of an expired invite = true")
+	}
+
+	// Members survive a restart; tokens themselves are not stored
+	reloaded, err := loadInvites(path)
+	if err != nil {
+		t.Fatalf("loadInvites() error = %v", err)
+	}
+	if !reloaded.member("fp-a") || !reloaded.member("fp-c") {
+		t.Error("Members were not persisted")
+	}
+	for _, invite := range reloaded.list() {
+		if invite.Hash == single || invite.Hash == expiring {
+			t.Error("Invite tokens were stored in the clear")
+		}
+	}
+}
+
+func TestNode_InviteOnly(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true), WithInviteOnly(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	if _, _, err := first.CreateInvite(0, 0); err == nil {
+		t.Error("CreateInvite() without a limit succeeded, want an error")
+	}
+	token, _, err := first.CreateInvite(1, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateInvite() error = %v", err)
+	}
+
+	// Without an invite, a node is refused and gets no key
+	stranger, err := NewNode("stranger", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer stranger.Stop()
+	stranger.transport.Start()
+
+	events, unsubscribe := stranger.Subscribe()
+	defer unsubscribe()
+	if err := stranger.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	event := waitForEvent(t, events, EventPeerRejected, 5*time.Second)
+	if event.Error != protocol.ErrorCodeInvite {
+		t.Errorf("Error = %q, want %q", event.Error, protocol.ErrorCodeInvite)
+	}
+	if err := stranger.waitForKey(200 * time.Millisecond); err == nil {
+		t.Error("Node without an invite received the network key")
+	}
+
+	// With one, it joins and keeps its membership after the invite is used up
+	invitedDir := filepath.Join(baseDir, "c")
+	invited, err := NewNode("invited", freeAddr(t), filepath.Join(invitedDir, "store"), filepath.Join(invitedDir, "watch"),
+		WithFirstNode(false), WithInvite(token, first.Address()))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	invited.transport.Start()
+	if err := invited.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := invited.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Invited node did not receive the network key: %v", err)
+	}
+	if invites := first.Invites(); len(invites) != 0 {
+		t.Errorf("Invites() = %+v after the only use, want none", invites)
+	}
+	invited.Stop()
+
+	// Same identity, no invite
+	again, err := NewNode("invited", freeAddr(t), filepath.Join(invitedDir, "store"), filepath.Join(invitedDir, "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer again.Stop()
+	again.transport.Start()
+	if err := again.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := again.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Admitted node was refused on reconnecting: %v", err)
+	}
+}
+
+func TestNode_PresentsInviteOnlyToInvitingNode(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	received := make(messageRecorder, 16)
+	other, err := network.NewTransport("other", freeAddr(t), received, network.WithBulkChannel(false))
+	if err != nil {
+		t.Fatalf("Failed to create transport: %v", err)
+	}
+	defer other.Stop()
+	other.Start()
+
+	invited, err := NewNode("invited", freeAddr(t), filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+		WithFirstNode(false), WithInvite("token", "127.0.0.1:1"))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer invited.Stop()
+	invited.transport.Start()
+	if err := invited.Connect(context.Background(), other.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case r := <-received:
+			if r.msg.Type != protocol.MessageTypeHandshake {
+				continue
+			}
+			var payload protocol.HandshakePayload
+			if err := r.msg.ParsePayload(&payload); err != nil {
+				t.Fatalf("Failed to parse handshake: %v", err)
+			}
+			if payload.Invite != "" {
+				t.Errorf("Invite = %q sent to another node, want none", payload.Invite)
+			}
+			return
+		case <-timeout:
+			t.Fatal("Timed out waiting for the handshake")
+		}
+	}
+}
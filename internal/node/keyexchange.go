@@ -0,0 +1,94 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+var (
+	// ErrInvalidExchangeKey is returned when a peer's exchange key is not
+	// signed by the identity key in its handshake
+	ErrInvalidExchangeKey = errors.New("exchange key is not signed by the identity key")
+	// ErrNoExchangeKey is returned when the network key can't be wrapped for
+	// a peer because it offered no exchange key
+	ErrNoExchangeKey = errors.New("peer offered no key exchange")
+)
+
+// checkExchangeKey rejects an exchange key that was not signed by the
+// identity presenting it, so the network key is only wrapped for keys whose
+// owner is known
+func checkExchangeKey(payload protocol.HandshakePayload) error {
+	if payload.ExchangeKey == nil {
+		return nil
+	}
+	if !crypto.VerifyExchangeKey(payload.PublicKey, payload.ExchangeKey, payload.ExchangeSignature) {
+		return ErrInvalidExchangeKey
+	}
+	return nil
+}
+
+// wrapNetworkKey encrypts the network key for the peer that sent payload
+func (n *Node) wrapNetworkKey(payload protocol.HandshakePayload) ([]byte, error) {
+	if payload.ExchangeKey == nil {
+		return nil, ErrNoExchangeKey
+	}
+	n.mu.RLock()
+	key := n.networkKey
+	n.mu.RUnlock()
+
+	return n.exchange.WrapKey(key, payload.ExchangeKey, protocol.KeyWrapContext(n.ID, payload.NodeID))
+}
+
+// unwrapNetworkKey decrypts the network key wrapped for this node by the
+// node nodeID, whose handshake offered exchangeKey
+func (n *Node) unwrapNetworkKey(nodeID string, exchangeKey, wrapped []byte) (crypto.Key, error) {
+	if exchangeKey == nil {
+		return nil, ErrNoExchangeKey
+	}
+	return n.exchange.UnwrapKey(wrapped, exchangeKey, protocol.KeyWrapContext(nodeID, n.ID))
+}
+
+// sendNetworkKey sends the network key, wrapped for it, to the peer that
+// sent payload in a handshake it has completed
+func (n *Node) sendNetworkKey(peer *network.Peer, payload protocol.HandshakePayload) error {
+	wrapped, err := n.wrapNetworkKey(payload)
+	if err != nil {
+		return err
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeNetworkKey, n.ID, protocol.NetworkKey{WrappedKey: wrapped})
+	if err != nil {
+		return err
+	}
+	return peer.Send(msg)
+}
+
+// handleNetworkKey adopts the network key sent by the peer whose handshake
+// this node answered. The first node and public mirrors never do.
+func (n *Node) handleNetworkKey(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.NetworkKey
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse network key: %w", err)
+	}
+	if n.isFirstNode || n.publicMirror {
+		return nil
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	info := n.peers[peer.ID()]
+	id := info.ID
+	key, err := n.unwrapNetworkKey(id, info.exchangeKey, payload.WrappedKey)
+	if err != nil {
+		return fmt.Errorf("failed to unwrap network key from peer %s: %w", id, err)
+	}
+	n.networkKey = key
+	select {
+	case <-n.keyReady: // Channel already closed
+	default:
+		close(n.keyReady)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+func TestNode_KeyExchange(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	if !bytes.Equal(second.networkKey, first.networkKey) {
+		t.Error("Second node adopted a different network key")
+	}
+
+	// The wrapped key is useless to anyone but its recipient
+	handshake := protocol.HandshakePayload{
+		NodeID:            second.ID,
+		PublicKey:         second.identity.Public,
+		ExchangeKey:       second.exchange.Public(),
+		ExchangeSignature: second.identity.SignExchangeKey(second.exchange.Public()),
+	}
+	wrapped, err := first.wrapNetworkKey(handshake)
+	if err != nil {
+		t.Fatalf("Failed to wrap network key: %v", err)
+	}
+	encoded, err := json.Marshal(protocol.NetworkKey{WrappedKey: wrapped})
+	if err != nil {
+		t.Fatalf("Failed to encode network key: %v", err)
+	}
+	if bytes.Contains(encoded, first.networkKey) || bytes.Contains(wrapped, first.networkKey) {
+		t.Error("Network key message carries the key in the clear")
+	}
+	if _, err := first.unwrapNetworkKey(first.ID, first.exchange.Public(), wrapped); !errors.Is(err, crypto.ErrUnwrapKey) {
+		t.Errorf("Unwrap by the sender: error = %v, want %v", err, crypto.ErrUnwrapKey)
+	}
+
+	// Peers without an exchange key are not sent the network key
+	if _, err := first.wrapNetworkKey(protocol.HandshakePayload{NodeID: "old"}); !errors.Is(err, ErrNoExchangeKey) {
+		t.Errorf("Wrap for a peer without exchange key: error = %v, want %v", err, ErrNoExchangeKey)
+	}
+
+	// An exchange key signed by someone else is refused
+	forged := handshake
+	forged.ExchangeSignature = first.identity.SignExchangeKey(second.exchange.Public())
+	if err := checkExchangeKey(forged); !errors.Is(err, ErrInvalidExchangeKey) {
+		t.Errorf("checkExchangeKey() = %v, want %v", err, ErrInvalidExchangeKey)
+	}
+	if err := checkExchangeKey(handshake); err != nil {
+		t.Errorf("checkExchangeKey() = %v, want nil", err)
+	}
+}
@@ -0,0 +1,49 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// RTT returns the smoothed round trip to a connected peer, from its
+// answered heartbeats and pings, or 0 if it isn't connected or none was
+// answered yet
+func (n *Node) RTT(peerID string) time.Duration {
+	peer, ok := n.peerConn(peerID)
+	if !ok {
+		return 0
+	}
+	return peer.SmoothedRTT()
+}
+
+// Ping measures the round trip to a connected peer now, rather than at its
+// next heartbeat, and counts it into the peer's RTT. Only peers announcing
+// protocol.FeatureHeartbeat answer pings.
+func (n *Node) Ping(ctx context.Context, peerID string) (time.Duration, error) {
+	peer, ok := n.peerConn(peerID)
+	if !ok {
+		return 0, fmt.Errorf("peer %s is not connected", peerID)
+	}
+	if !n.peerSupports(peerID, protocol.FeatureHeartbeat) {
+		return 0, fmt.Errorf("peer %s does not answer pings", peerID)
+	}
+	return peer.Ping(ctx)
+}
+
+// byLatency orders peers by smoothed round trip, lowest first. Peers whose
+// round trip isn't known yet follow in the order given.
+func (n *Node) byLatency(ids []string) []string {
+	rtts := make(map[string]time.Duration, len(ids))
+	for _, id := range ids {
+		rtts[id] = n.RTT(id)
+	}
+	sort.SliceStable(ids, func(i, j int) bool {
+		a, b := rtts[ids[i]], rtts[ids[j]]
+		return a > 0 && (b == 0 || a < b)
+	})
+	return ids
+}
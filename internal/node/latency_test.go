@@ -0,0 +1,64 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNode_PingOrdersByLatency(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	newTestNode := func(id string, first bool) *Node {
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"), WithFirstNode(first))
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		n.transport.Start()
+		return n
+	}
+	first := newTestNode("a-first", true)
+	defer first.Stop()
+	second := newTestNode("b-second", false)
+	defer second.Stop()
+	requester := newTestNode("requester", false)
+	defer requester.Stop()
+
+	for _, n := range []*Node{first, second} {
+		if err := requester.Connect(context.Background(), n.Address()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(requester.connectedPeers()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Requester did not connect to both peers")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Neither round trip is known before the first heartbeat
+	if got := requester.byLatency([]string{"a-first", "b-second"}); !reflect.DeepEqual(got, []string{"a-first", "b-second"}) {
+		t.Errorf("byLatency() without round trips = %v, want the order given", got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rtt, err := requester.Ping(ctx, "b-second")
+	if err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	if rtt <= 0 || requester.RTT("b-second") != rtt {
+		t.Errorf("Ping() = %v, RTT() = %v; want the first round trip to be the smoothed one", rtt, requester.RTT("b-second"))
+	}
+	if got := requester.byLatency([]string{"a-first", "b-second"}); !reflect.DeepEqual(got, []string{"b-second", "a-first"}) {
+		t.Errorf("byLatency() = %v, want the measured peer first", got)
+	}
+
+	if _, err := requester.Ping(ctx, "unknown"); err == nil {
+		t.Error("Ping() of a peer that isn't connected succeeded")
+	}
+}
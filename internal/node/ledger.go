@@ -0,0 +1,243 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+// ErrNoSettler is returned when settling the ledger without a settler configured
+var ErrNoSettler = errors.New("no settler configured")
+
+// LedgerEntry is the data exchanged with one peer, by node ID
+type LedgerEntry struct {
+	PeerID   string    `json:"peer_id"`
+	Sent     int64     `json:"sent"`     // bytes served to the peer
+	Received int64     `json:"received"` // bytes received from the peer
+	LastSeen time.Time `json:"last_seen"`
+	// Totals at the last settlement; the difference is still unsettled
+	SettledSent     int64 `json:"settled_sent"`
+	SettledReceived int64 `json:"settled_received"`
+}
+
+// Ratio returns bytes received from the peer per byte served to it. A peer
+// that was never served anything has an infinite ratio.
+func (e LedgerEntry) Ratio() float64 {
+	if e.Sent == 0 {
+		return math.Inf(1)
+	}
+	return float64(e.Received) / float64(e.Sent)
+}
+
+// LedgerPolicy sets the exchange ratio peers must keep up to be served at
+// full speed, so free-riding peers can't use the node for nothing
+type LedgerPolicy struct {
+	// MinRatio is the lowest ratio of bytes received to bytes served a peer
+	// may have; zero disables enforcement
+	MinRatio float64
+	// Grace is how many bytes a peer is served before its ratio is enforced
+	Grace int64
+	// ThrottleRate caps uploads in bytes/s to peers below MinRatio; zero
+	// refuses their requests instead
+	ThrottleRate int64
+}
+
+// DefaultLedgerPolicy returns a policy that accounts for traffic without
+// enforcing a ratio. Once given a MinRatio, peers are served 64 MiB before
+// being throttled to 256 KiB/s.
+func DefaultLedgerPolicy() LedgerPolicy {
+	return LedgerPolicy{
+		MinRatio:     0,
+		Grace:        64 << 20,
+		ThrottleRate: 256 << 10,
+	}
+}
+
+// Settler settles ledger balances outside the network, for example with
+// payments. It receives the traffic exchanged with each peer since the
+// previous settlement.
+type Settler interface {
+	Settle(entries []LedgerEntry) error
+}
+
+// ledger keeps per-peer byte counts and persists them as JSON
+type ledger struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]*LedgerEntry
+	now     func() time.Time
+}
+
+// loadLedger reads the ledger at path, starting empty if it does not exist
+func loadLedger(path string) (*ledger, error) {
+	l := &ledger{
+		path:    path,
+		entries: make(map[string]*LedgerEntry),
+		now:     time.Now,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger: %w", err)
+	}
+
+	var entries []*LedgerEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse ledger: %w", err)
+	}
+	for _, e := range entries {
+		l.entries[e.PeerID] = e
+	}
+	return l, nil
+}
+
+// record adds traffic exchanged with a peer
+func (l *ledger) record(peerID string, sent, received int64) {
+	if peerID == "" {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[peerID]
+	if !ok {
+		e = &LedgerEntry{PeerID: peerID}
+		l.entries[peerID] = e
+	}
+	e.Sent += sent
+	e.Received += received
+	e.LastSeen = l.now()
+}
+
+// get returns the entry for a peer
+func (l *ledger) get(peerID string) LedgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e, ok := l.entries[peerID]
+	if !ok {
+		return LedgerEntry{PeerID: peerID}
+	}
+	return *e
+}
+
+// list returns every entry sorted by peer ID
+func (l *ledger) list() []LedgerEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]LedgerEntry, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].PeerID < entries[j].PeerID })
+	return entries
+}
+
+// save persists the ledger
+func (l *ledger) save() error {
+	data, err := json.MarshalIndent(l.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode ledger: %w", err)
+	}
+	return writeFileAtomic(l.path, data)
+}
+
+// settle passes the unsettled traffic of each peer to fn, and marks it
+// settled if fn succeeds
+func (l *ledger) settle(fn func([]LedgerEntry) error) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var deltas []LedgerEntry
+	for _, e := range l.entries {
+		delta := LedgerEntry{
+			PeerID:   e.PeerID,
+			Sent:     e.Sent - e.SettledSent,
+			Received: e.Received - e.SettledReceived,
+			LastSeen: e.LastSeen,
+		}
+		if delta.Sent != 0 || delta.Received != 0 {
+			deltas = append(deltas, delta)
+		}
+	}
+	if len(deltas) == 0 {
+		return 0, nil
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].PeerID < deltas[j].PeerID })
+
+	if err := fn(deltas); err != nil {
+		return 0, err
+	}
+	for _, d := range deltas {
+		e := l.entries[d.PeerID]
+		e.SettledSent += d.Sent
+		e.SettledReceived += d.Received
+	}
+	return len(deltas), nil
+}
+
+// Ledger returns the traffic exchanged with each peer, sorted by peer ID
+func (n *Node) Ledger() []LedgerEntry {
+	return n.ledger.list()
+}
+
+// SettleLedger hands the traffic exchanged since the last settlement to the
+// configured settler, returning the number of peers settled
+func (n *Node) SettleLedger() (int, error) {
+	if n.settler == nil {
+		return 0, ErrNoSettler
+	}
+	settled, err := n.ledger.settle(n.settler.Settle)
+	if err != nil {
+		return 0, fmt.Errorf("failed to settle ledger: %w", err)
+	}
+	if settled > 0 {
+		if err := n.ledger.save(); err != nil {
+			return settled, err
+		}
+	}
+	return settled, nil
+}
+
+// uploadRate applies the ledger policy to a peer requesting data. It returns
+// the rate in bytes/s to serve the peer at, zero meaning unlimited, or an
+// error if the peer is refused.
+func (n *Node) uploadRate(peerID string) (int64, error) {
+	policy := n.ledgerPolicy
+	if policy.MinRatio <= 0 || peerID == "" {
+		return 0, nil
+	}
+	entry := n.ledger.get(peerID)
+	if entry.Sent < policy.Grace || entry.Ratio() >= policy.MinRatio {
+		return 0, nil
+	}
+	if policy.ThrottleRate <= 0 {
+		return 0, fmt.Errorf("peer %s is below the minimum exchange ratio (%.2f < %.2f)", peerID, entry.Ratio(), policy.MinRatio)
+	}
+	return policy.ThrottleRate, nil
+}
+
+// nodeID returns the node ID of the peer on a connection, if it has
+// completed its handshake. Requests are charged to the ledger entry of this
+// ID, never to the sender a message names, so a peer can't run up the
+// account of another.
+func (n *Node) nodeID(peer *network.Peer) string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	if n.conns[peer.ID()] != peer {
+		return ""
+	}
+	return n.peers[peer.ID()].ID
+}
@@ -0,0 +1,211 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+type recordingSettler struct {
+	calls [][]LedgerEntry
+	err   error
+}
+
+func (s *recordingSettler) Settle(entries []LedgerEntry) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.calls = append(s.calls, entries)
+	return nil
+}
+
+func TestLedger_PersistsAndSettles(t *testing.T) {
+	dir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	path := filepath.Join(dir, "ledger.json")
+	l, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("Failed to load ledger: %v", err)
+	}
+	l.record("peer-a", 100, 40)
+	l.record("peer-b", 0, 10)
+	l.record("", 5, 5) // connections that never completed a handshake aren't tracked
+	if err := l.save(); err != nil {
+		t.Fatalf("Failed to save ledger: %v", err)
+	}
+
+	l, err = loadLedger(path)
+	if err != nil {
+		t.Fatalf("Failed to reload ledger: %v", err)
+	}
+	entries := l.list()
+	if len(entries) != 2 || entries[0].PeerID != "peer-a" || entries[0].Sent != 100 || entries[0].Received != 40 {
+		t.Fatalf("list() = %+v, want peer-a and peer-b", entries)
+	}
+	if ratio := entries[0].Ratio(); ratio != 0.4 {
+		t.Errorf("Ratio() = %v, want 0.4", ratio)
+	}
+
+	failing := &recordingSettler{err: errors.New("payment rail down")}
+	if _, err := l.settle(failing.Settle); err == nil {
+		t.Fatal("Expected settlement error")
+	}
+
+	settler := &recordingSettler{}
+	if settled, err := l.settle(settler.Settle); err != nil || settled != 2 {
+		t.Fatalf("settle() = %d, %v, want 2 peers", settled, err)
+	}
+	l.record("peer-a", 10, 0)
+	if settled, err := l.settle(settler.Settle); err != nil || settled != 1 {
+		t.Fatalf("settle() = %d, %v, want 1 peer", settled, err)
+	}
+	// Only traffic since the previous settlement is passed on
+	if delta := settler.calls[1][0]; delta.PeerID != "peer-a" || delta.Sent != 10 || delta.Received != 0 {
+		t.Errorf("second settlement = %+v, want 10 bytes sent to peer-a", delta)
+	}
+}
+
+func TestNode_UploadRatePolicy(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+		WithFirstNode(true), WithLedgerPolicy(LedgerPolicy{MinRatio: 0.5, Grace: 100}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	node.ledger.record("leech", 90, 0)
+	if rate, err := node.uploadRate("leech"); err != nil || rate != 0 {
+		t.Errorf("uploadRate() = %d, %v within grace, want unlimited", rate, err)
+	}
+
+	node.ledger.record("leech", 10, 0)
+	if _, err := node.uploadRate("leech"); err == nil {
+		t.Error("Expected free-riding peer to be refused")
+	}
+
+	node.ledgerPolicy.ThrottleRate = 1024
+	if rate, err := node.uploadRate("leech"); err != nil || rate != 1024 {
+		t.Errorf("uploadRate() = %d, %v, want throttled to 1024", rate, err)
+	}
+
+	node.ledger.record("seeder", 200, 150)
+	if rate, err := node.uploadRate("seeder"); err != nil || rate != 0 {
+		t.Errorf("uploadRate() = %d, %v for a contributing peer, want unlimited", rate, err)
+	}
+
+	if _, err := node.SettleLedger(); !errors.Is(err, ErrNoSettler) {
+		t.Errorf("SettleLedger() error = %v, want %v", err, ErrNoSettler)
+	}
+}
+
+func TestNode_LedgerCountsTransfers(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "bytes to account for")
+	hash, err := first.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	size, _ := first.store.Size(hash)
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	if err := second.fetch(hash, 5*time.Second); err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+
+	// The sender records a chunk once it is written, which may be after
+	// the receiver has stored it
+	deadline := time.Now().Add(5 * time.Second)
+	for len(first.Ledger()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sent := first.Ledger(); len(sent) != 1 || sent[0].PeerID != "second" || sent[0].Sent != size {
+		t.Errorf("first.Ledger() = %+v, want %d bytes sent to second", sent, size)
+	}
+	if received := second.Ledger(); len(received) != 1 || received[0].PeerID != "first" || received[0].Received != size {
+		t.Errorf("second.Ledger() = %+v, want %d bytes received from first", received, size)
+	}
+}
+
+func TestNode_LedgerChargesTheConnection(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "bytes to account for")
+	hash, err := first.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	peer, ok := second.peerConn("first")
+	if !ok {
+		t.Fatal("Second node is not connected to the first")
+	}
+
+	// A request naming another node as its sender
+	msg, err := protocol.NewMessage(protocol.MessageTypeDataRequest, "victim", protocol.DataRequest{ContentHash: hash})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := peer.Send(msg); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(first.Ledger()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sent := first.Ledger(); len(sent) != 1 || sent[0].PeerID != "second" {
+		t.Errorf("first.Ledger() = %+v, want the bytes charged to second", sent)
+	}
+}
@@ -0,0 +1,94 @@
+package node
+
+import (
+	"fmt"
+	"os"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+// objectOverhead is what encryption adds to an object beyond the size of
+// the file it holds: the IV written in front of the ciphertext
+const objectOverhead = crypto.IVSize
+
+// checkObjectSize refuses announcements of files over the maximum object size
+func (n *Node) checkObjectSize(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("invalid size %d", size)
+	}
+	if n.maxObjectSize > 0 && size > n.maxObjectSize {
+		return fmt.Errorf("size %d exceeds the maximum object size of %d bytes", size, n.maxObjectSize)
+	}
+	return nil
+}
+
+// checkTransferSize validates the total size the sender announces with the
+// first chunk of a transfer, against the maximum object size and the size
+// the object was announced with
+func (n *Node) checkTransferSize(transfer *protocol.DataTransfer) error {
+	return n.checkStoredSize(transfer.ContentHash, transfer.TotalSize)
+}
+
+// checkStoredSize validates the size of an object as stored, IV and
+// encryption included, against the maximum object size and the size the
+// object was announced with
+func (n *Node) checkStoredSize(hash string, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("invalid size %d", size)
+	}
+	if n.maxObjectSize > 0 && size > n.maxObjectSize+objectOverhead {
+		return fmt.Errorf("size %d exceeds the maximum object size of %d bytes", size, n.maxObjectSize)
+	}
+	if meta, ok := n.catalog.get(hash); ok && size > meta.Size+objectOverhead {
+		return fmt.Errorf("size %d exceeds the announced %d bytes", size, meta.Size)
+	}
+	return nil
+}
+
+// checkChunk accounts a chunk towards its transfer, failing if it reaches
+// past the announced size. Chunks received again are only counted once.
+func (n *Node) checkChunk(state *transferState, transfer *protocol.DataTransfer, offset int64) error {
+	length := int64(len(transfer.Data))
+	if end := offset + length; end > state.size {
+		return fmt.Errorf("chunk %d ends at byte %d, past the announced %d bytes", transfer.ChunkIndex, end, state.size)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !state.chunks[transfer.ChunkIndex] {
+		state.bytes += length
+	}
+	return nil
+}
+
+// abortTransfer drops an incoming transfer and its temporary file. Chunks
+// still arriving for it start a new transfer, which fails its size check
+// once the final chunk arrives.
+func (n *Node) abortTransfer(transferKey string, state *transferState, hash string, reason error) {
+	n.mu.Lock()
+	if n.transfers[transferKey] == state {
+		delete(n.transfers, transferKey)
+	}
+	n.mu.Unlock()
+	n.tracker.finish(transferKey)
+
+	state.tempFile.Close()
+	os.Remove(state.tempFile.Name())
+	if state.relay {
+		n.endRelay(hash, nil, 0, reason)
+	}
+}
+
+// verifyTransferSize checks that a finished transfer delivered exactly the
+// announced size, without gaps, before it is hashed
+func verifyTransferSize(state *transferState) error {
+	info, err := state.tempFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat temp file: %w", err)
+	}
+	if state.bytes != state.size || info.Size() != state.size {
+		return fmt.Errorf("received %d of %d announced bytes", state.bytes, state.size)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestNode_TransferSizeLimits(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	sender, err := NewNode("sender", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer sender.Stop()
+	sender.transport.Start()
+
+	receiver, err := NewNode("receiver", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithMaxObjectSize(1000))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer receiver.Stop()
+	receiver.transport.Start()
+
+	if err := receiver.Connect(context.Background(), sender.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := receiver.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	peer, ok := receiver.peerConn("sender")
+	if !ok {
+		t.Fatalf("Sender is not connected")
+	}
+
+	if err := receiver.checkObjectSize(1000); err != nil {
+		t.Errorf("checkObjectSize(1000) = %v, want nil", err)
+	}
+	if err := receiver.checkObjectSize(1001); err == nil {
+		t.Errorf("checkObjectSize(1001) = nil, want error")
+	}
+	announced := FileMeta{Hash: strings.Repeat("c", 40), Name: "small.txt", Size: 10}
+	if err := receiver.catalog.add(announced); err != nil {
+		t.Fatalf("Failed to update catalog: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		chunks []protocol.DataTransfer
+		want   string
+	}{
+		{
+			name:   "over the maximum",
+			chunks: []protocol.DataTransfer{{ContentHash: strings.Repeat("a", 40), Data: make([]byte, 10), TotalSize: 2000}},
+			want:   "maximum object size",
+		},
+		{
+			name:   "over the announcement",
+			chunks: []protocol.DataTransfer{{ContentHash: announced.Hash, Data: make([]byte, 10), TotalSize: 500}},
+			want:   "announced 10 bytes",
+		},
+		{
+			name:   "past the total size",
+			chunks: []protocol.DataTransfer{{ContentHash: strings.Repeat("b", 40), Data: make([]byte, 200), TotalSize: 100}},
+			want:   "past the announced 100 bytes",
+		},
+		{
+			name: "short of the total size",
+			chunks: []protocol.DataTransfer{{
+				ContentHash: strings.Repeat("d", 40), Data: make([]byte, 50), TotalSize: 100, FinalChunk: true, FromWatch: true,
+			}},
+			want: "received 50 of 100 announced bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			for i := range tt.chunks {
+				if err = receiver.HandleTransfer(peer, &tt.chunks[i]); err != nil {
+					break
+				}
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("HandleTransfer() = %v, want error containing %q", err, tt.want)
+			}
+
+			receiver.mu.RLock()
+			pending := len(receiver.transfers)
+			receiver.mu.RUnlock()
+			if pending != 0 {
+				t.Errorf("Pending transfers = %d, want 0", pending)
+			}
+			if active := len(receiver.Transfers()); active != 0 {
+				t.Errorf("Active transfers = %d, want 0", active)
+			}
+		})
+	}
+
+	temps, err := filepath.Glob(filepath.Join(baseDir, "b", "store", "temp", "transfer-*"))
+	if err != nil {
+		t.Fatalf("Failed to list temp files: %v", err)
+	}
+	if len(temps) != 0 {
+		t.Errorf("Temp files left = %v, want none", temps)
+	}
+}
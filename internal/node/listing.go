@@ -0,0 +1,139 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// listPage returns the hashes of a sorted list that follow after, at most
+// limit of them, and the hash the next page follows, if there is one
+func listPage(hashes []string, after string, limit int) ([]string, string) {
+	start := 0
+	if after != "" {
+		start = sort.SearchStrings(hashes, after)
+		if start < len(hashes) && hashes[start] == after {
+			start++
+		}
+	}
+	end := min(start+limit, len(hashes))
+	page := hashes[start:end]
+	if end == len(hashes) {
+		return page, ""
+	}
+	return page, page[len(page)-1]
+}
+
+// handleListRequest answers with a page of the hashes stored here
+func (n *Node) handleListRequest(peer *network.Peer, msg *protocol.Message) error {
+	var request protocol.ListRequest
+	if err := msg.ParsePayload(&request); err != nil {
+		return fmt.Errorf("failed to parse list request: %w", err)
+	}
+	if msg.RequestID == "" {
+		return fmt.Errorf("refusing list request from %s without a request ID", msg.SenderID)
+	}
+
+	hashes, err := n.store.Hashes()
+	if err != nil {
+		return fmt.Errorf("failed to list store: %w", err)
+	}
+	sort.Strings(hashes)
+	limit := request.Limit
+	if limit == 0 {
+		limit = protocol.DefaultListLimit
+	}
+	page, next := listPage(hashes, request.After, limit)
+
+	reply, err := protocol.NewMessage(protocol.MessageTypeListResponse, n.ID, protocol.ListResponse{Hashes: page, Next: next})
+	if err != nil {
+		return err
+	}
+	reply.RequestID = msg.RequestID
+	reply.TraceID = msg.TraceID
+	return peer.Send(reply)
+}
+
+func (n *Node) handleListResponse(peer *network.Peer, msg *protocol.Message) error {
+	var page protocol.ListResponse
+	if err := msg.ParsePayload(&page); err != nil {
+		return fmt.Errorf("failed to parse list response: %w", err)
+	}
+	if !n.lists.resolve(msg.RequestID, page) {
+		n.debugf("Peer %s answered list request %s, which is no longer pending\n", peer.ID(), msg.RequestID)
+	}
+	return nil
+}
+
+// ListPeer returns a page of the hashes a connected peer stores, in order,
+// those following after, at most limit of them or protocol.DefaultListLimit
+// if limit is 0. The hash the next page follows is returned with it, empty
+// once there are no more.
+func (n *Node) ListPeer(ctx context.Context, peerID, after string, limit int) ([]string, string, error) {
+	if limit < 0 || limit > protocol.MaxListHashes {
+		return nil, "", fmt.Errorf("limit %d is out of range (0-%d)", limit, protocol.MaxListHashes)
+	}
+	peer, ok := n.peerConn(peerID)
+	if !ok {
+		return nil, "", fmt.Errorf("peer %s is not connected", peerID)
+	}
+	if !n.peerSupports(peerID, protocol.FeatureList) {
+		return nil, "", fmt.Errorf("peer %s does not support list requests", peerID)
+	}
+
+	requestID, err := protocol.NewMessageID()
+	if err != nil {
+		return nil, "", err
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeListRequest, n.ID, protocol.ListRequest{After: after, Limit: limit})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create list request: %w", err)
+	}
+	msg.RequestID = requestID
+	msg.TraceID = n.traceID(nil)
+
+	page := n.lists.add(requestID)
+	defer n.lists.remove(requestID)
+	answer := n.requests.add(requestID)
+	defer n.requests.remove(requestID)
+	if err := peer.Send(msg); err != nil {
+		return nil, "", fmt.Errorf("failed to send list request: %w", err)
+	}
+
+	select {
+	case p := <-page:
+		return p.Hashes, p.Next, nil
+	case err := <-answer:
+		return nil, "", fmt.Errorf("failed to list peer %s: %w", peerID, err)
+	case <-ctx.Done():
+		return nil, "", ctx.Err()
+	case <-n.done:
+		return nil, "", fmt.Errorf("node stopped")
+	}
+}
+
+// PeerHashes returns every hash a connected peer stores, in order, paging
+// through its listing, so a node can learn what a peer holds at once rather
+// than from the objects it announces
+func (n *Node) PeerHashes(ctx context.Context, peerID string) ([]string, error) {
+	var hashes []string
+	after := ""
+	for {
+		page, next, err := n.ListPeer(ctx, peerID, after, 0)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, page...)
+		if next == "" {
+			return hashes, nil
+		}
+		// A listing moves forward, or it would never end
+		if next <= after {
+			return nil, fmt.Errorf("peer %s listed page after %q out of order", peerID, after)
+		}
+		after = next
+	}
+}
@@ -0,0 +1,97 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListPage(t *testing.T) {
+	hashes := []string{"a1", "b2", "c3", "d4", "e5"}
+	tests := []struct {
+		name     string
+		after    string
+		limit    int
+		want     []string
+		wantNext string
+	}{
+		{"first page", "", 2, []string{"a1", "b2"}, "b2"},
+		{"next page", "b2", 2, []string{"c3", "d4"}, "d4"},
+		{"last page", "d4", 2, []string{"e5"}, ""},
+		{"after a hash not held", "b", 2, []string{"b2", "c3"}, "c3"},
+		{"past the end", "f", 2, []string{}, ""},
+		{"everything", "", 10, hashes, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, next := listPage(hashes, tt.after, tt.limit)
+			if !reflect.DeepEqual(page, tt.want) || next != tt.wantNext {
+				t.Errorf("listPage() = %v, %q; want %v, %q", page, next, tt.want, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestNode_ListPeer(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	holder, err := NewNode("holder", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer holder.Stop()
+	holder.transport.Start()
+
+	lister, err := NewNode("lister", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer lister.Stop()
+	lister.transport.Start()
+
+	var want []string
+	for _, content := range []string{"one", "two", "three", "four", "five"} {
+		path := filepath.Join(baseDir, content+".txt")
+		writeTestFile(t, path, content)
+		hash, err := holder.StoreFile(path)
+		if err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+		want = append(want, hash)
+	}
+	sort.Strings(want)
+
+	if err := lister.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := lister.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	page, next, err := lister.ListPeer(ctx, "holder", "", 2)
+	if err != nil {
+		t.Fatalf("ListPeer() error = %v", err)
+	}
+	if !reflect.DeepEqual(page, want[:2]) || next != want[1] {
+		t.Errorf("ListPeer() = %v, %q; want %v, %q", page, next, want[:2], want[1])
+	}
+
+	all, err := lister.PeerHashes(ctx, "holder")
+	if err != nil {
+		t.Fatalf("PeerHashes() error = %v", err)
+	}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("PeerHashes() = %v, want %v", all, want)
+	}
+
+	if _, _, err := lister.ListPeer(ctx, "unknown", "", 0); err == nil || !strings.Contains(err.Error(), "not connected") {
+		t.Errorf("ListPeer(unknown) error = %v, want one saying it isn't connected", err)
+	}
+}
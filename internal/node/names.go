@@ -0,0 +1,284 @@
+package node
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// ErrNameNotFound is returned when resolving a name with no known record
+var ErrNameNotFound = errors.New("name not found")
+
+// maxLabelLength bounds the label part of a name
+const maxLabelLength = 255
+
+// NameRecord is a signed, versioned pointer from a stable name to the latest
+// content hash published under it. Names are bound to the publisher's
+// identity key: the full name is the key fingerprint followed by the label,
+// e.g. 3f9a0c2e71b4d586/backups/latest, so only that node can update it.
+type NameRecord struct {
+	Label     string    `json:"label"`
+	Hash      string    `json:"hash"`
+	Sequence  uint64    `json:"sequence"`
+	Published time.Time `json:"published"`
+	PublicKey []byte    `json:"public_key"`
+	Signature []byte    `json:"signature"`
+}
+
+// Name returns the full name of the record
+func (r NameRecord) Name() string {
+	return crypto.Fingerprint(r.PublicKey) + "/" + r.Label
+}
+
+func (r NameRecord) payload() protocol.NameRecord {
+	return protocol.NameRecord{
+		Label:     r.Label,
+		Hash:      r.Hash,
+		Sequence:  r.Sequence,
+		Timestamp: r.Published.Unix(),
+		PublicKey: r.PublicKey,
+		Signature: r.Signature,
+	}
+}
+
+func nameRecordFromPayload(p protocol.NameRecord) NameRecord {
+	return NameRecord{
+		Label:     p.Label,
+		Hash:      p.Hash,
+		Sequence:  p.Sequence,
+		Published: time.Unix(p.Timestamp, 0).UTC(),
+		PublicKey: p.PublicKey,
+		Signature: p.Signature,
+	}
+}
+
+// Verify reports whether the record is well formed and signed by the key
+// it is bound to
+func (r NameRecord) Verify() bool {
+	if validateLabel(r.Label) != nil || r.Hash == "" {
+		return false
+	}
+	p := r.payload()
+	return crypto.Verify(p.PublicKey, p.SignedData(), p.Signature)
+}
+
+// validateLabel checks that a label is printable and can't be confused
+// with a full name
+func validateLabel(label string) error {
+	if label == "" || len(label) > maxLabelLength {
+		return fmt.Errorf("label must be 1 to %d bytes", maxLabelLength)
+	}
+	for _, r := range label {
+		if unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return fmt.Errorf("label %q contains whitespace or control characters", label)
+		}
+	}
+	if _, _, full := splitName(label); full {
+		return fmt.Errorf("label %q starts with a key fingerprint", label)
+	}
+	return nil
+}
+
+// splitName splits a full name into fingerprint and label, reporting false
+// if name does not start with a fingerprint
+func splitName(name string) (string, string, bool) {
+	fingerprint, label, ok := strings.Cut(name, "/")
+	if !ok || !isFingerprint(fingerprint) || label == "" {
+		return "", "", false
+	}
+	return fingerprint, label, true
+}
+
+// isFingerprint reports whether s has the form of a key fingerprint
+func isFingerprint(s string) bool {
+	if len(s) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// nameStore keeps the latest record of every known name and persists them
+// as JSON
+type nameStore struct {
+	path    string
+	mu      sync.Mutex
+	records map[string]NameRecord // full name -> record
+}
+
+// loadNames reads the name records at path, starting empty if it does not exist
+func loadNames(path string) (*nameStore, error) {
+	s := &nameStore{
+		path:    path,
+		records: make(map[string]NameRecord),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read names: %w", err)
+	}
+
+	var records []NameRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse names: %w", err)
+	}
+	for _, r := range records {
+		s.records[r.Name()] = r
+	}
+	return s, nil
+}
+
+// put stores a verified record if it is newer than the one held, reporting
+// whether it was accepted
+func (s *nameStore) put(r NameRecord) (bool, error) {
+	if !r.Verify() {
+		return false, fmt.Errorf("invalid signature on name %s", r.Name())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := r.Name()
+	if current, ok := s.records[name]; ok && current.Sequence >= r.Sequence {
+		return false, nil
+	}
+	s.records[name] = r
+
+	data, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return true, fmt.Errorf("failed to encode names: %w", err)
+	}
+	return true, writeFileAtomic(s.path, data)
+}
+
+// get returns the record for a full name
+func (s *nameStore) get(name string) (NameRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[name]
+	return r, ok
+}
+
+// list returns every record sorted by full name
+func (s *nameStore) list() []NameRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked()
+}
+
+func (s *nameStore) listLocked() []NameRecord {
+	records := make([]NameRecord, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name() < records[j].Name() })
+	return records
+}
+
+// Publish points a label under this node's identity at hash and propagates
+// the record to peers. Each publication supersedes the previous one.
+func (n *Node) Publish(label, hash string) (NameRecord, error) {
+	if err := validateLabel(label); err != nil {
+		return NameRecord{}, err
+	}
+	if !n.store.Exists(hash) {
+		return NameRecord{}, fmt.Errorf("%s is not stored locally", hash)
+	}
+
+	record := NameRecord{
+		Label:     label,
+		Hash:      hash,
+		Sequence:  1,
+		Published: time.Now().UTC().Truncate(time.Second),
+		PublicKey: n.identity.Public,
+	}
+	if current, ok := n.names.get(record.Name()); ok {
+		record.Sequence = current.Sequence + 1
+	}
+	p := record.payload()
+	record.Signature = n.identity.Sign(p.SignedData())
+
+	if _, err := n.names.put(record); err != nil {
+		return NameRecord{}, err
+	}
+	if err := n.sendNames(nil, []NameRecord{record}); err != nil {
+		fmt.Printf("Failed to propagate name %s: %v\n", record.Name(), err)
+	}
+	return record, nil
+}
+
+// Resolve returns the latest known record for a name. A label without a key
+// fingerprint refers to this node's own names.
+func (n *Node) Resolve(name string) (NameRecord, error) {
+	if _, _, full := splitName(name); !full {
+		name = n.Identity() + "/" + name
+	}
+	record, ok := n.names.get(name)
+	if !ok {
+		return NameRecord{}, fmt.Errorf("%w: %s", ErrNameNotFound, name)
+	}
+	return record, nil
+}
+
+// Names returns every known name record, sorted by full name
+func (n *Node) Names() []NameRecord {
+	return n.names.list()
+}
+
+// sendNames sends name records to one peer, or to every connected peer
+// when peer is nil
+func (n *Node) sendNames(peer *network.Peer, records []NameRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	payload := protocol.NamePayload{Records: make([]protocol.NameRecord, len(records))}
+	for i, r := range records {
+		payload.Records[i] = r.payload()
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeName, n.ID, payload)
+	if err != nil {
+		return err
+	}
+	if peer == nil {
+		return n.broadcast("names", msg)
+	}
+	return peer.Send(msg)
+}
+
+// handleName stores records newer than the ones held and passes them on.
+// Records that aren't newer stop spreading, so propagation ends.
+func (n *Node) handleName(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.NamePayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse name records: %w", err)
+	}
+
+	var accepted []NameRecord
+	for _, p := range payload.Records {
+		record := nameRecordFromPayload(p)
+		ok, err := n.names.put(record)
+		if err != nil {
+			fmt.Printf("Rejected name record from %s: %v\n", msg.SenderID, err)
+			continue
+		}
+		if ok {
+			accepted = append(accepted, record)
+		}
+	}
+	return n.sendNames(nil, accepted)
+}
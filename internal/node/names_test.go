@@ -0,0 +1,185 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestValidateLabel(t *testing.T) {
+	tests := []struct {
+		label   string
+		wantErr bool
+	}{
+		{"backups/latest", false},
+		{"site", false},
+		{"", true},
+		{"has space", true},
+		{"line\nbreak", true},
+		{"0123456789abcdef/latest", true}, // would read as a full name
+	}
+	for _, tt := range tests {
+		if err := validateLabel(tt.label); (err != nil) != tt.wantErr {
+			t.Errorf("validateLabel(%q) error = %v, wantErr %v", tt.label, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNode_PublishAndResolve(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	newNode := func() *Node {
+		node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		return node
+	}
+	node := newNode()
+
+	var hashes []string
+	for i, content := range []string{"first backup", "second backup"} {
+		path := filepath.Join(baseDir, "backup.txt")
+		writeTestFile(t, path, content)
+		hash, err := node.StoreFile(path)
+		if err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+		hashes = append(hashes, hash)
+
+		record, err := node.Publish("backups/latest", hash)
+		if err != nil {
+			t.Fatalf("Failed to publish: %v", err)
+		}
+		if record.Sequence != uint64(i+1) {
+			t.Errorf("Sequence = %d, want %d", record.Sequence, i+1)
+		}
+	}
+
+	if _, err := node.Publish("backups/latest", "missing0123"); err == nil {
+		t.Error("Expected error publishing a hash that isn't stored")
+	}
+	if _, err := node.Resolve("unknown"); !errors.Is(err, ErrNameNotFound) {
+		t.Errorf("Resolve(unknown) error = %v, want %v", err, ErrNameNotFound)
+	}
+
+	fullName := node.Identity() + "/backups/latest"
+	node.Stop()
+
+	// Records survive a restart, and the full name resolves like the label
+	node = newNode()
+	defer node.Stop()
+	for _, name := range []string{"backups/latest", fullName} {
+		record, err := node.Resolve(name)
+		if err != nil {
+			t.Fatalf("Failed to resolve %s: %v", name, err)
+		}
+		if record.Hash != hashes[1] || record.Name() != fullName || !record.Verify() {
+			t.Errorf("Resolve(%s) = %+v, want %s at %s", name, record, fullName, hashes[1])
+		}
+	}
+}
+
+func TestNameStore_RejectsStaleAndForged(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "named content")
+	hash, err := node.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	first, err := node.Publish("site", hash)
+	if err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	if _, err := node.Publish("site", hash); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	if accepted, err := node.names.put(first); accepted || err != nil {
+		t.Errorf("put() = %v, %v for a superseded record, want false", accepted, err)
+	}
+
+	forged := first
+	forged.Sequence = 99
+	forged.Hash = "otherhash0123"
+	if accepted, err := node.names.put(forged); accepted || err == nil {
+		t.Errorf("put() = %v, %v for a forged record, want an error", accepted, err)
+	}
+}
+
+func TestNode_NamesPropagate(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	store := func(content string) string {
+		path := filepath.Join(baseDir, "file.txt")
+		writeTestFile(t, path, content)
+		hash, err := first.StoreFile(path)
+		if err != nil {
+			t.Fatalf("Failed to store file: %v", err)
+		}
+		return hash
+	}
+
+	// Published before the peer connects; sent during the handshake
+	if _, err := first.Publish("backups/latest", store("monday")); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	name := first.Identity() + "/backups/latest"
+	waitForName := func(hash string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			record, err := second.Resolve(name)
+			if err == nil && record.Hash == hash {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Resolve(%s) = %+v, %v, want %s", name, record, err, hash)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForName(first.names.list()[0].Hash)
+
+	// Published while connected; broadcast to peers
+	tuesday := store("tuesday")
+	if _, err := first.Publish("backups/latest", tuesday); err != nil {
+		t.Fatalf("Failed to publish: %v", err)
+	}
+	waitForName(tuesday)
+}
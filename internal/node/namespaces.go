@@ -0,0 +1,302 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+// EncryptionMode is how the objects of a namespace are encrypted
+type EncryptionMode string
+
+const (
+	// EncryptNetwork encrypts objects with the shared network key
+	EncryptNetwork EncryptionMode = "network"
+	// EncryptPerFile encrypts each object with its own random key, which is
+	// sent to peers wrapped with the network key
+	EncryptPerFile EncryptionMode = "file"
+	// EncryptNone stores and transfers objects as plaintext, for public assets
+	EncryptNone EncryptionMode = "none"
+)
+
+// ParseEncryptionMode validates an encryption mode name
+func ParseEncryptionMode(s string) (EncryptionMode, error) {
+	switch mode := EncryptionMode(s); mode {
+	case EncryptNetwork, EncryptPerFile, EncryptNone:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown encryption mode %q (want network, file or none)", s)
+}
+
+// orDefault maps the empty mode recorded for older objects to EncryptNetwork
+func (m EncryptionMode) orDefault() EncryptionMode {
+	if m == "" {
+		return EncryptNetwork
+	}
+	return m
+}
+
+// NamespaceInfo describes the encryption policy of one namespace
+type NamespaceInfo struct {
+	Name string         `json:"name"`
+	Mode EncryptionMode `json:"mode"`
+}
+
+// maxNamespaceLen bounds namespace names
+const maxNamespaceLen = 64
+
+// validateNamespace checks that a namespace name is short and made of
+// letters, digits, '-', '_' and '.'
+func validateNamespace(name string) error {
+	if name == "" || len(name) > maxNamespaceLen {
+		return fmt.Errorf("namespace must be 1 to %d characters", maxNamespaceLen)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("invalid character %q in namespace", r)
+		}
+	}
+	return nil
+}
+
+// namespaceStore holds the encryption policy of each namespace and persists
+// it as JSON. Namespaces without a policy, including the default unnamed
+// one, use the network key.
+type namespaceStore struct {
+	path  string
+	mu    sync.RWMutex
+	modes map[string]EncryptionMode
+}
+
+// loadNamespaces reads the policies at path, starting empty if it does not exist
+func loadNamespaces(path string) (*namespaceStore, error) {
+	s := &namespaceStore{
+		path:  path,
+		modes: make(map[string]EncryptionMode),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read namespaces: %w", err)
+	}
+
+	var list []NamespaceInfo
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse namespaces: %w", err)
+	}
+	for _, ns := range list {
+		s.modes[ns.Name] = ns.Mode
+	}
+	return s, nil
+}
+
+// reload replaces the policies with those in the file and returns their
+// number
+func (s *namespaceStore) reload() (int, error) {
+	loaded, err := loadNamespaces(s.path)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modes = loaded.modes
+	return len(s.modes), nil
+}
+
+// mode returns the encryption mode of a namespace
+func (s *namespaceStore) mode(name string) EncryptionMode {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.modes[name].orDefault()
+}
+
+// set records the mode of a namespace and persists the policies
+func (s *namespaceStore) set(name string, mode EncryptionMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.modes[name] = mode
+	return s.saveLocked()
+}
+
+// list returns every namespace with a policy, sorted by name
+func (s *namespaceStore) list() []NamespaceInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]NamespaceInfo, 0, len(s.modes))
+	for name, mode := range s.modes {
+		list = append(list, NamespaceInfo{Name: name, Mode: mode})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// saveLocked writes the policies atomically; the caller must hold s.mu
+func (s *namespaceStore) saveLocked() error {
+	list := make([]NamespaceInfo, 0, len(s.modes))
+	for name, mode := range s.modes {
+		list = append(list, NamespaceInfo{Name: name, Mode: mode})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode namespaces: %w", err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// SetNamespaceMode sets the encryption mode of a namespace. It applies to
+// objects stored from then on; objects already stored keep their encryption,
+// but plaintext ones are no longer served once the namespace requires
+// encryption.
+func (n *Node) SetNamespaceMode(name string, mode EncryptionMode) error {
+	if err := validateNamespace(name); err != nil {
+		return err
+	}
+	if _, err := ParseEncryptionMode(string(mode)); err != nil {
+		return err
+	}
+	return n.namespaces.set(name, mode)
+}
+
+// NamespaceMode returns the encryption mode of a namespace. On a public
+// mirror every namespace is plaintext.
+func (n *Node) NamespaceMode(name string) EncryptionMode {
+	if n.publicMirror {
+		return EncryptNone
+	}
+	return n.namespaces.mode(name)
+}
+
+// Namespaces returns every namespace with an encryption policy
+func (n *Node) Namespaces() []NamespaceInfo {
+	return n.namespaces.list()
+}
+
+// keyFor returns the key of an object encrypted with mode, or nil for a
+// plaintext object. fileKey is the object's own key under EncryptPerFile.
+func (n *Node) keyFor(mode EncryptionMode, fileKey []byte) (crypto.Key, error) {
+	switch mode.orDefault() {
+	case EncryptNone:
+		return nil, nil
+	case EncryptPerFile:
+		if len(fileKey) == 0 {
+			return nil, errors.New("the key of the object is unknown")
+		}
+		return crypto.Key(fileKey), nil
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.networkKey == nil {
+		return nil, errors.New("the object is encrypted and this node has no network key")
+	}
+	return n.networkKey, nil
+}
+
+// objectKey returns the key a stored object is encrypted with, according
+// to its catalog entry, or nil if it is plaintext. Uncataloged objects are
+// assumed to use the network key.
+func (n *Node) objectKey(hash string) (crypto.Key, error) {
+	meta, _ := n.catalog.get(hash)
+	return n.keyFor(meta.Encryption, meta.Key)
+}
+
+// decryptObject copies an object from r to w, decrypting it unless key is
+// nil
+func decryptObject(key crypto.Key, r io.Reader, w io.Writer) error {
+	if key == nil {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	return crypto.DecryptStream(key, r, w)
+}
+
+// notePlaintext records that an object received without an announcement is
+// plaintext, so it is read without decrypting
+func (n *Node) notePlaintext(hash string) {
+	if err := n.catalog.addIfMissing(FileMeta{Hash: hash, Encryption: EncryptNone}); err != nil {
+		fmt.Printf("Failed to update catalog: %v\n", err)
+	}
+}
+
+// PublicMirror reports whether the node is a public mirror without the
+// network key
+func (n *Node) PublicMirror() bool {
+	return n.publicMirror
+}
+
+// peerKeyless reports whether a connected peer is a public mirror
+func (n *Node) peerKeyless(id string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.peers[n.peerKeys[id]].Keyless
+}
+
+// payloadMode returns the encryption mode an announcement declares
+func payloadMode(payload protocol.DataPayload) EncryptionMode {
+	if !payload.Encrypted {
+		return EncryptNone
+	}
+	return EncryptionMode(payload.Encryption).orDefault()
+}
+
+// acceptAnnouncement checks an announced object against the local policy
+// of its namespace and returns its catalog entry, with the per-file key
+// unwrapped
+func (n *Node) acceptAnnouncement(payload protocol.DataPayload) (FileMeta, error) {
+	meta := FileMeta{
+		Hash:      payload.ContentHash,
+		Name:      payload.FileName,
+		Path:      payload.Path,
+		Size:      payload.Size,
+		Manifest:  payload.Manifest,
+		Link:      payload.Link,
+		Previous:  payload.Previous,
+		Namespace: payload.Namespace,
+	}
+	if payload.Namespace != "" {
+		if err := validateNamespace(payload.Namespace); err != nil {
+			return meta, err
+		}
+	}
+	mode := payloadMode(payload)
+	if want := n.NamespaceMode(payload.Namespace); mode != want {
+		return meta, fmt.Errorf("namespace %q requires %s encryption, not %s", payload.Namespace, want, mode)
+	}
+	meta.Encryption = mode
+	if mode == EncryptPerFile {
+		key, err := n.unseal(payload.Key)
+		if err != nil || len(key) != crypto.KeySize {
+			return meta, errors.New("failed to unwrap the key of the object")
+		}
+		meta.Key = key
+	}
+	return meta, nil
+}
+
+// servable reports whether an object may be sent to peers: plaintext
+// objects are withheld once their namespace requires encryption. Plaintext
+// objects outside any namespace were fetched from elsewhere and are public.
+func (n *Node) servable(meta FileMeta) error {
+	if meta.Encryption != EncryptNone || meta.Namespace == "" {
+		return nil
+	}
+	if want := n.NamespaceMode(meta.Namespace); want != EncryptNone {
+		return fmt.Errorf("%s is plaintext but namespace %q requires %s encryption", meta.Hash, meta.Namespace, want)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNode_NamespaceModes(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	if err := node.SetNamespaceMode("public", EncryptNone); err != nil {
+		t.Fatalf("Failed to set namespace mode: %v", err)
+	}
+	if err := node.SetNamespaceMode("private", EncryptPerFile); err != nil {
+		t.Fatalf("Failed to set namespace mode: %v", err)
+	}
+	if err := node.SetNamespaceMode("bad/name", EncryptNone); err == nil {
+		t.Error("Expected error for an invalid namespace name")
+	}
+	if err := node.SetNamespaceMode("other", EncryptionMode("rot13")); err == nil {
+		t.Error("Expected error for an unknown mode")
+	}
+	if got := node.NamespaceMode("unset"); got != EncryptNetwork {
+		t.Errorf("NamespaceMode(unset) = %s, want %s", got, EncryptNetwork)
+	}
+
+	content := "namespaced content"
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, content)
+
+	for _, tt := range []struct {
+		namespace string
+		plaintext bool
+		fileKey   bool
+	}{
+		{namespace: ""},
+		{namespace: "public", plaintext: true},
+		{namespace: "private", fileKey: true},
+	} {
+		hash, err := node.StoreFileIn(tt.namespace, path)
+		if err != nil {
+			t.Fatalf("Failed to store file in %q: %v", tt.namespace, err)
+		}
+		reader, err := node.store.Load(hash)
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", hash, err)
+		}
+		var raw bytes.Buffer
+		raw.ReadFrom(reader)
+		reader.Close()
+		if got := raw.String() == content; got != tt.plaintext {
+			t.Errorf("%q: stored as plaintext = %v, want %v", tt.namespace, got, tt.plaintext)
+		}
+
+		meta, _ := node.FileInfo(hash)
+		if got := len(meta.Key) > 0; got != tt.fileKey {
+			t.Errorf("%q: has a file key = %v, want %v", tt.namespace, got, tt.fileKey)
+		}
+		var plain bytes.Buffer
+		if err := node.readObject(hash, &plain); err != nil || plain.String() != content {
+			t.Errorf("%q: readObject() = %q, %v, want %q", tt.namespace, plain.String(), err, content)
+		}
+	}
+
+	// Policies persist
+	loaded, err := loadNamespaces(filepath.Join(node.dataDir, "namespaces.json"))
+	if err != nil {
+		t.Fatalf("Failed to load namespaces: %v", err)
+	}
+	if got := loaded.list(); len(got) != 2 || got[0].Name != "private" || got[1].Mode != EncryptNone {
+		t.Errorf("Loaded namespaces = %+v, want private and public", got)
+	}
+}
+
+func TestNode_NamespacePolicyEnforced(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	for _, n := range []*Node{first, second} {
+		if err := n.SetNamespaceMode("private", EncryptPerFile); err != nil {
+			t.Fatalf("Failed to set namespace mode: %v", err)
+		}
+	}
+	if err := first.SetNamespaceMode("public", EncryptNone); err != nil {
+		t.Fatalf("Failed to set namespace mode: %v", err)
+	}
+
+	importFile := func(namespace, name, content string) string {
+		t.Helper()
+		src := filepath.Join(baseDir, "src-"+namespace)
+		if err := os.MkdirAll(src, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		writeTestFile(t, filepath.Join(src, name), content)
+		if _, err := first.ImportIn(namespace, src); err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+		for _, f := range first.Files() {
+			if f.Path == name {
+				return f.Hash
+			}
+		}
+		t.Fatal("Imported file not in catalog")
+		return ""
+	}
+
+	// Per-file keys reach peers with the same policy
+	private := importFile("private", "secret.txt", "confidential")
+	deadline := time.Now().Add(5 * time.Second)
+	for !second.store.Exists(private) {
+		if time.Now().After(deadline) {
+			t.Fatal("Second node did not store the per-file encrypted object")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	var plain bytes.Buffer
+	if err := second.readObject(private, &plain); err != nil || plain.String() != "confidential" {
+		t.Errorf("readObject() on peer = %q, %v, want confidential", plain.String(), err)
+	}
+
+	// The second node requires encryption for public, so it refuses plaintext
+	public := importFile("public", "logo.txt", "public asset")
+	time.Sleep(500 * time.Millisecond)
+	if second.store.Exists(public) {
+		t.Error("Plaintext object stored despite the namespace policy")
+	}
+	if _, ok := second.FileInfo(public); ok {
+		t.Error("Plaintext object cataloged despite the namespace policy")
+	}
+
+	// Tightening the policy stops plaintext objects from being offered
+	if err := first.SetNamespaceMode("public", EncryptNetwork); err != nil {
+		t.Fatalf("Failed to set namespace mode: %v", err)
+	}
+	meta, _ := first.FileInfo(public)
+	if _, err := first.announcement(meta); err == nil {
+		t.Error("Expected plaintext object to be withheld")
+	}
+}
+
+func TestNode_PublicMirror(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	mirror, err := NewNode("mirror", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(true), WithPublicMirror(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer mirror.Stop()
+	mirror.transport.Start()
+
+	if err := mirror.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(first.Peers()) == 0 || len(mirror.Peers()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Nodes did not complete the handshake")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if mirror.networkKey != nil {
+		t.Error("Public mirror holds a network key")
+	}
+	if got := mirror.NamespaceMode("anything"); got != EncryptNone {
+		t.Errorf("NamespaceMode() on a mirror = %s, want %s", got, EncryptNone)
+	}
+
+	if err := first.SetNamespaceMode("public", EncryptNone); err != nil {
+		t.Fatalf("Failed to set namespace mode: %v", err)
+	}
+	importDir := func(namespace, content string) string {
+		t.Helper()
+		src := filepath.Join(baseDir, "src-"+namespace)
+		if err := os.MkdirAll(src, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		writeTestFile(t, filepath.Join(src, "file.txt"), content)
+		result, err := first.ImportIn(namespace, src)
+		if err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+		return result.Manifest
+	}
+
+	// Public content is replicated to the mirror and readable there
+	public := importDir("public", "public asset")
+	deadline = time.Now().Add(5 * time.Second)
+	for !mirror.store.Exists(public) {
+		if time.Now().After(deadline) {
+			t.Fatal("Mirror did not store the public manifest")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dest := filepath.Join(baseDir, "restored")
+	if _, err := mirror.Restore(public, dest); err != nil {
+		t.Fatalf("Failed to restore on the mirror: %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dest, "file.txt")); err != nil || string(data) != "public asset" {
+		t.Errorf("Restored file = %q, %v, want %q", data, err, "public asset")
+	}
+
+	// Encrypted content is refused
+	private := importDir("", "confidential")
+	time.Sleep(500 * time.Millisecond)
+	if mirror.store.Exists(private) {
+		t.Error("Mirror stored an encrypted object")
+	}
+
+	// Files stored on the mirror are plaintext, and a node fetching one by
+	// hash without an announcement reads it without decrypting
+	path := filepath.Join(baseDir, "mirrored.txt")
+	writeTestFile(t, path, "mirrored content")
+	hash, err := mirror.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file on the mirror: %v", err)
+	}
+	var plain bytes.Buffer
+	if err := first.fetch(hash, 5*time.Second); err != nil {
+		t.Fatalf("Failed to fetch from the mirror: %v", err)
+	}
+	if err := first.readObject(hash, &plain); err != nil || plain.String() != "mirrored content" {
+		t.Errorf("readObject() = %q, %v, want mirrored content", plain.String(), err)
+	}
+}
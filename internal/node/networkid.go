@@ -0,0 +1,34 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrWrongNetwork is returned for peers whose handshake names another network
+var ErrWrongNetwork = errors.New("peer belongs to another network")
+
+// WithNetworkID sets the network the node belongs to. Peers announcing
+// another network ID are refused before any key is exchanged, so unrelated
+// deployments that reach each other stay apart. Nodes without one, including
+// those that predate network IDs, form the default network. See
+// protocol.NetworkIDFromSecret for deriving an ID from a shared secret.
+func WithNetworkID(id string) Option {
+	return func(n *Node) {
+		n.networkID = id
+	}
+}
+
+// NetworkID returns the network the node belongs to; empty for the default
+// network
+func (n *Node) NetworkID() string {
+	return n.networkID
+}
+
+// checkNetwork rejects peers from another network
+func (n *Node) checkNetwork(id string) error {
+	if id != n.networkID {
+		return fmt.Errorf("%w: %q, this node is on %q", ErrWrongNetwork, id, n.networkID)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestNode_RejectsOtherNetwork(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true), WithNetworkID("blue"))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	member, err := NewNode("member", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithNetworkID("blue"))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer member.Stop()
+	member.transport.Start()
+
+	outsider, err := NewNode("outsider", freeAddr(t), filepath.Join(baseDir, "c", "store"), filepath.Join(baseDir, "c", "watch"),
+		WithFirstNode(false), WithNetworkID("green"))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer outsider.Stop()
+	outsider.transport.Start()
+
+	if err := member.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := member.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Member of the network did not receive the network key: %v", err)
+	}
+
+	events, unsubscribe := outsider.Subscribe()
+	defer unsubscribe()
+	if err := outsider.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	event := waitForEvent(t, events, EventPeerRejected, 5*time.Second)
+	if event.Error != protocol.ErrorCodeNetwork {
+		t.Errorf("Error = %q, want %q", event.Error, protocol.ErrorCodeNetwork)
+	}
+	if err := outsider.waitForKey(200 * time.Millisecond); err == nil {
+		t.Error("Node of another network received the network key")
+	}
+	if peers := first.Peers(); len(peers) != 1 || peers[0].ID != "member" {
+		t.Errorf("Peers() = %+v, want only the member", peers)
+	}
+}
@@ -1,14 +1,18 @@
 package node
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/metrics"
 	"p2p-storage/internal/network"
 	"p2p-storage/internal/protocol"
 	"p2p-storage/internal/storage"
@@ -18,68 +22,416 @@ import (
 
 // Node represents a P2P node
 type PeerInfo struct {
-	ID      string
-	Address string
+	ID        string
+	Address   string
+	PublicKey []byte // identity key presented in the handshake, if any
+	Keyless   bool   // the peer is a public mirror without the network key
+	UserAgent string // software and version, empty for peers that predate it
+	Features  []string
+	Version   int // protocol version negotiated with the peer
+	// Capabilities announced by the peer, or those of a peer predating them
+	Capabilities protocol.Capabilities
+
+	// RTT is the round trip of the last answered heartbeat, 0 if unknown,
+	// and SmoothedRTT the average of those answered; see Node.RTT
+	RTT         time.Duration
+	SmoothedRTT time.Duration
+	// Addresses are all the addresses the peer can be dialed at, starting
+	// with Address
+	Addresses []string
+
+	// exchangeKey is the one from the peer's handshake, which the network
+	// key it sends is wrapped with
+	exchangeKey []byte
+}
+
+// Supports reports whether the peer announced a protocol feature
+func (p PeerInfo) Supports(feature string) bool {
+	return protocol.HasFeature(p.Features, feature)
 }
 
 type Node struct {
-	ID          string
-	transport   *network.Transport
-	store       *storage.Store
-	localKey    crypto.Key
-	networkKey  crypto.Key
-	isFirstNode bool
-	watchDir    string
-	watcher     *fsnotify.Watcher
-	peers       map[string]PeerInfo
-	transfers   map[string]*transferState
-	done        chan struct{}
-	mu          sync.RWMutex
-	keyReady    chan struct{} // Channel to signal network key is ready
+	ID            string
+	transport     *network.Transport
+	store         *storage.Store
+	localKey      crypto.Key
+	identity      *crypto.Identity
+	exchange      *crypto.ExchangeKey // regenerated on every start
+	networkKey    crypto.Key
+	isFirstNode   bool
+	watchDir      string
+	watcher       *fsnotify.Watcher
+	peers         map[string]PeerInfo             // by identity, see network.Peer.ID
+	conns         map[string]*network.Peer        // open connection per peer, likewise
+	peerKeys      map[string]string               // identity of each peer, by node ID
+	handshakes    map[*network.Peer]peerHandshake // answered, waiting for the peer's proof
+	transfers     map[string]*transferState
+	done          chan struct{}
+	mu            sync.RWMutex
+	keyReady      chan struct{} // Channel to signal network key is ready
+	tracker       *transferTracker
+	metrics       *metrics.Registry
+	events        *eventBus
+	scrubber      *scrubber
+	scrubConfig   ScrubConfig
+	dataDir       string
+	catalog       *catalog
+	hashes        *hashCache
+	popularity    *popularityTracker
+	relay         *relayCache
+	relayBudget   int64
+	relaying      map[string]*relayFetch // objects fetched for peers, by hash
+	relayIdle     time.Duration          // see relayIdleTimeout
+	replicas      *replicaTracker
+	blocklist     *blocklist
+	receipts      *receiptStore
+	invites       *inviteStore
+	ledger        *ledger
+	peerDB        *peerDB
+	names         *nameStore
+	tombstones    *tombstoneStore
+	feeds         *feedStore
+	feedMu        sync.Mutex // serializes appends to this node's own feed
+	sync          *syncStore
+	namespaces    *namespaceStore
+	settler       Settler
+	discovery     *discoveryQueue
+	overlay       *overlay
+	gossip        *gossipState
+	requests      *pendingRequests
+	draining      atomic.Bool // set while decommissioning; no new content is accepted
+	logLevel      atomic.Int32
+	audits        *auditor
+	benches       *benchTracker
+	ranges        *rangeTracker
+	lists         *replies[protocol.ListResponse]
+	stats         *replies[protocol.Stat]
+	searchReplies *replies[protocol.SearchResult]
+	searches      *seenCache // IDs of searches already answered
+	haves         *replies[protocol.Have]
+	swarms        *swarmTracker
+	credits       *creditWindows // windows of the transfers being sent
+	uploads       *uploadScheduler
+	pubsub        *pubsub
+	announcements announceQueue
+	antiEntropy   *antiEntropy
+	ingests       *ingestQueue
+	replays       *replayGuard
+	deltas        deltaStats
+	pendingDeltas *pendingDeltas
+	bootstrap     bootstrapState
+
+	replicationConfig ReplicationConfig
+	discoveryConfig   DiscoveryConfig
+	seedConfig        SeedConfig
+	bootstrapConfig   BootstrapConfig
+	idleConfig        IdleConfig
+	peerDBConfig      PeerDBConfig
+	beaconConfig      BeaconConfig
+	replayConfig      ReplayConfig
+	overlayConfig     OverlayConfig
+	antiEntropyConfig AntiEntropyConfig
+	deletePolicy      DeletePolicy
+	gossipConfig      GossipConfig
+	requestConfig     RequestConfig
+	auditConfig       AuditConfig
+	ledgerPolicy      LedgerPolicy
+	ingestConfig      IngestConfig
+	batchConfig       BatchConfig
+
+	symlinkPolicy  SymlinkPolicy
+	deltaTransfers bool
+	publicMirror   bool
+	relayEnabled   bool
+	tracing        bool // start traces on announcements and requests; see WithTracing
+	storageOnly    bool
+	networkID      string
+	inviteOnly     bool
+	invite         string
+	inviteAddress  string // the node invite joins
+	maxChunkSize   int    // largest chunk peers send; protocol.DefaultChunkSize if 0
+	transferWindow int    // chunks peers send ahead of those written; see WithTransferWindow
+	uploadSlots    int    // chunks sent at once; see WithUploadSlots
+	maxObjectSize  int64  // largest object accepted from peers; 0 means no limit
+	watchDebounce  time.Duration
+	downloadDir    string // where downloads are decrypted; "downloads" if empty
+	tlsConfig      TLSConfig
+	codecs         []string // announced in handshakes, in order of preference
+	compressions   []string // frame compression schemes, likewise
+	// sessionEncryption encrypts connections with per-connection keys
+	sessionEncryption bool
+
+	// stunServer is asked for the external address peers punch through to;
+	// punches holds the peers a punch is under way with
+	stunServer   string
+	externalAddr string
+	punches      map[string]bool
+	// signals holds the WebRTC offers waiting for an answer, by session,
+	// and answered the sessions of offers already answered
+	signals  map[string]chan protocol.SignalPayload
+	answered map[string]bool
+
+	// portMapping forwards the listen port on the router through
+	// portMapper, or one found at start if it is nil
+	portMapping bool
+	portMapper  network.PortMapper
+	// advertisedAddr, if set, is advertised instead of any mapped address
+	advertisedAddr string
+
+	// allowlist and denylist are fixed admission rules; see WithAllowlist
+	allowlist *accessList
+	denylist  *accessList
+
+	// scores rate peers on their behaviour; see WithScoring
+	scoreConfig ScoreConfig
+	scores      *scoreboard
+
+	transportOpts []network.Option
+	storeOpts     []storage.Option
 }
 
 type transferState struct {
+	peerID    string // the sender's peer.ID(), as in the transfer's key
+	hash      string
 	tempFile  *os.File
 	chunks    map[int]bool
 	received  int
+	size      int64 // announced by the sender
+	bytes     int64 // received in distinct chunks
+	resends   int   // times missing chunks were asked for again
+	final     bool  // the final chunk arrived
+	count     int   // chunks in the transfer, known once the final one arrived
+	finishing bool  // claimed for completion; see claimTransfer
+	chunkSize int   // of the chunks as the sender sends them
+	// suspended is when the sender disconnected, zero while it is connected
+	suspended time.Time
 	fromWatch bool
+	plaintext bool // the sender stores the object unencrypted
+	priority  int  // asked for in the request; see protocol.PriorityBulk
+	progress  *transferProgress
+	// relay marks objects fetched on behalf of another peer; they are kept
+	// in the relay cache instead of the store
+	relay bool
+
+	// uncredited counts the chunks written since the sender was last
+	// granted credit; see grantCredit
+	uncredited int
 }
 
 // NewNode creates a new P2P node
-func NewNode(nodeID, address, storeDir, watchDir string) (*Node, error) {
+func NewNode(nodeID, address, storeDir, watchDir string, opts ...Option) (*Node, error) {
 	key, err := crypto.GenerateKey()
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate key: %w", err)
 	}
 
-	store, err := storage.NewStore(storeDir)
+	node := &Node{
+		ID:            nodeID,
+		localKey:      key,
+		networkKey:    key,
+		isFirstNode:   len(os.Args) <= 3,
+		watchDir:      watchDir,
+		peers:         make(map[string]PeerInfo),
+		conns:         make(map[string]*network.Peer),
+		peerKeys:      make(map[string]string),
+		handshakes:    make(map[*network.Peer]peerHandshake),
+		transfers:     make(map[string]*transferState),
+		relaying:      make(map[string]*relayFetch),
+		relayIdle:     relayIdleTimeout,
+		punches:       make(map[string]bool),
+		signals:       make(map[string]chan protocol.SignalPayload),
+		answered:      make(map[string]bool),
+		done:          make(chan struct{}),
+		keyReady:      make(chan struct{}),
+		tracker:       newTransferTracker(),
+		metrics:       metrics.NewRegistry(),
+		events:        newEventBus(),
+		scrubber:      &scrubber{},
+		audits:        newAuditor(),
+		benches:       newBenchTracker(),
+		ranges:        newRangeTracker(),
+		lists:         newReplies[protocol.ListResponse](),
+		stats:         newReplies[protocol.Stat](),
+		searchReplies: newReplies[protocol.SearchResult](),
+		searches:      newSeenCache(1024, 10*time.Minute),
+		haves:         newReplies[protocol.Have](),
+		swarms:        newSwarmTracker(),
+		credits:       newCreditWindows(),
+		pubsub:        newPubSub(),
+		antiEntropy:   newAntiEntropy(),
+		scrubConfig:   DefaultScrubConfig(),
+
+		symlinkPolicy:     SymlinkFollow,
+		deltaTransfers:    true,
+		relayEnabled:      true,
+		watchDebounce:     DefaultWatchDebounce,
+		transferWindow:    DefaultTransferWindow,
+		uploadSlots:       DefaultUploadSlots,
+		replicationConfig: DefaultReplicationConfig(),
+		discoveryConfig:   DefaultDiscoveryConfig(),
+		seedConfig:        DefaultSeedConfig(),
+		bootstrapConfig:   DefaultBootstrapConfig(),
+		idleConfig:        DefaultIdleConfig(),
+		peerDBConfig:      DefaultPeerDBConfig(),
+		replayConfig:      DefaultReplayConfig(),
+		overlayConfig:     DefaultOverlayConfig(),
+		antiEntropyConfig: DefaultAntiEntropyConfig(),
+		gossipConfig:      DefaultGossipConfig(),
+		requestConfig:     DefaultRequestConfig(),
+		auditConfig:       DefaultAuditConfig(),
+		ledgerPolicy:      DefaultLedgerPolicy(),
+		ingestConfig:      DefaultIngestConfig(),
+		batchConfig:       DefaultBatchConfig(),
+		codecs:            protocol.Codecs,
+		compressions:      protocol.FrameCompressions,
+
+		scoreConfig: DefaultScoreConfig(),
+	}
+	for _, opt := range opts {
+		opt(node)
+	}
+	if node.publicMirror {
+		// A mirror neither creates nor adopts a network key
+		node.isFirstNode = false
+		node.networkKey = nil
+	}
+
+	node.replicas = newReplicaTracker(inventoryExpiry * node.replicationConfig.Interval)
+	node.discovery = newDiscoveryQueue(node.discoveryConfig)
+	node.gossip = newGossipState(node.gossipConfig)
+	node.requests = newPendingRequests()
+	node.pendingDeltas = newPendingDeltas()
+	node.ingests = newIngestQueue(node.ingestConfig)
+	node.replays = newReplayGuard(node.replayConfig)
+	node.scores = newScoreboard(node.scoreConfig)
+	node.uploads = newUploadScheduler(node.uploadSlots)
+
+	if node.dataDir == "" {
+		node.dataDir = filepath.Dir(storeDir)
+	}
+	if node.popularity, err = loadPopularity(filepath.Join(node.dataDir, "popularity.json")); err != nil {
+		return nil, err
+	}
+
+	if node.downloadDir != "" {
+		if err := storage.CheckWritable(node.downloadDir); err != nil {
+			return nil, fmt.Errorf("download directory is not usable: %w", err)
+		}
+	}
+
+	storeOpts := append([]storage.Option{
+		storage.WithCacheAdmission(node.admitToCache),
+		storage.WithCacheEviction(node.popularityScore),
+	}, node.storeOpts...)
+	store, err := storage.NewStore(storeDir, storeOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create store: %w", err)
 	}
+	node.store = store
 
-	node := &Node{
-		ID:          nodeID,
-		localKey:    key,
-		networkKey:  key,
-		isFirstNode: len(os.Args) <= 3,
-		store:       store,
-		watchDir:    watchDir,
-		peers:       make(map[string]PeerInfo),
-		transfers:   make(map[string]*transferState),
-		done:        make(chan struct{}),
-		keyReady:    make(chan struct{}),
-	}
-
-	// If this is the first node, mark key as ready immediately
-	if node.isFirstNode {
+	if node.relayBudget > 0 {
+		// An evicted object stays tracked only while the store holds it
+		evicted := func(hash string) {
+			if !node.store.Exists(hash) {
+				node.popularity.forget(hash)
+			}
+		}
+		if node.relay, err = openRelayCache(filepath.Join(node.dataDir, "relay"), node.relayBudget, node.popularityScore, evicted); err != nil {
+			return nil, err
+		}
+	}
+	if node.catalog, err = loadCatalog(filepath.Join(node.dataDir, "catalog.json")); err != nil {
+		return nil, err
+	}
+	if node.hashes, err = loadHashCache(filepath.Join(node.dataDir, "hashcache.json")); err != nil {
+		return nil, err
+	}
+	if node.blocklist, err = loadBlocklist(filepath.Join(node.dataDir, "blocklist.json")); err != nil {
+		return nil, err
+	}
+	if node.receipts, err = loadReceipts(filepath.Join(node.dataDir, "receipts.json")); err != nil {
+		return nil, err
+	}
+	if node.invites, err = loadInvites(filepath.Join(node.dataDir, "invites.json")); err != nil {
+		return nil, err
+	}
+	if node.ledger, err = loadLedger(filepath.Join(node.dataDir, "ledger.json")); err != nil {
+		return nil, err
+	}
+	if node.peerDB, err = loadPeerDB(filepath.Join(node.dataDir, peerDBFile)); err != nil {
+		return nil, err
+	}
+	for _, p := range node.peerDB.list() {
+		node.scores.restore(network.IdentityOf(p.PublicKey, p.ID), p.ID, p.Score, p.Updated)
+	}
+	if err := node.restoreTransfers(); err != nil {
+		return nil, err
+	}
+	if node.names, err = loadNames(filepath.Join(node.dataDir, "names.json")); err != nil {
+		return nil, err
+	}
+	if node.tombstones, err = loadTombstones(filepath.Join(node.dataDir, "tombstones.json")); err != nil {
+		return nil, err
+	}
+	if node.feeds, err = loadFeeds(filepath.Join(node.dataDir, "feeds.json")); err != nil {
+		return nil, err
+	}
+	if node.sync, err = loadSync(filepath.Join(node.dataDir, "sync.json")); err != nil {
+		return nil, err
+	}
+	if node.namespaces, err = loadNamespaces(filepath.Join(node.dataDir, "namespaces.json")); err != nil {
+		return nil, err
+	}
+	if node.identity, err = crypto.LoadOrCreateIdentity(filepath.Join(node.dataDir, "identity.key")); err != nil {
+		return nil, err
+	}
+	node.overlay = newOverlay(node.overlayConfig, nodeID, node.Identity())
+	if node.exchange, err = crypto.GenerateExchangeKey(); err != nil {
+		return nil, err
+	}
+
+	// If this is the first node, mark key as ready immediately; a mirror
+	// has no key to wait for
+	if node.isFirstNode || node.publicMirror {
 		close(node.keyReady)
 	}
 
-	transport, err := network.NewTransport(nodeID, address, node)
+	transportOpts := append([]network.Option{
+		network.WithConnFilter(node.filterConn),
+		network.WithIdentityKey(node.identity.Public),
+		network.WithExchangeKey(node.exchange.Public(), node.identity.SignExchangeKey(node.exchange.Public())),
+		network.WithKeyless(node.publicMirror),
+		network.WithCapabilities(node.capabilities()),
+		network.WithNetworkID(node.networkID),
+		network.WithInvite(node.invite, node.inviteAddress),
+		network.WithEvictHandler(node.dropPeer),
+		network.WithMalformedHandler(node.malformedMessage),
+		network.WithBroadcastFailureHandler(node.broadcastFailed),
+		network.WithDisconnectHandler(node.peerDisconnected),
+		network.WithListenerErrorHandler(node.listenerFailed),
+	}, node.transportOpts...)
+	tlsConfig, err := node.transportTLS()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		transportOpts = append(transportOpts, network.WithTLS(tlsConfig))
+	}
+	if node.sessionEncryption {
+		transportOpts = append(transportOpts, network.WithSessionEncryption(node.identity.Sign))
+	}
+	transport, err := network.NewTransport(nodeID, address, node, transportOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create transport: %w", err)
 	}
 	node.transport = transport
+	node.registerMetrics()
+	node.registerScrubMetrics()
+	node.registerReplicationMetrics()
+	node.registerDiscoveryMetrics()
+	node.registerReplayMetrics()
+	node.registerAuditMetrics()
+	node.registerDeltaMetrics()
 
 	return node, nil
 }
@@ -87,34 +439,182 @@ func NewNode(nodeID, address, storeDir, watchDir string) (*Node, error) {
 // Start starts the node
 func (n *Node) Start() error {
 	n.transport.Start()
-	if err := n.startWatcher(); err != nil {
-		return fmt.Errorf("failed to start watcher: %w", err)
+	// A storage-only node ingests no files of its own
+	if !n.storageOnly {
+		if err := n.startWatcher(); err != nil {
+			return fmt.Errorf("failed to start watcher: %w", err)
+		}
+	}
+	if n.scrubConfig.Interval > 0 {
+		go n.scrubLoop()
+	}
+	if n.replicationConfig.Interval > 0 {
+		go n.replicationLoop()
+	}
+	if n.auditConfig.Interval > 0 {
+		go n.auditLoop()
+	}
+	go n.discovery.run(n.done, n.skipDiscovered, n.ConnectAny)
+	if n.peerDBConfig.Reconnect > 0 {
+		n.reconnectKnown()
+	}
+	if len(n.seedConfig.Seeds) > 0 {
+		go n.seedLoop()
+	}
+	if len(n.bootstrapConfig.Peers) > 0 {
+		go n.bootstrapLoop()
+	}
+	if n.idleConfig.Timeout > 0 {
+		go n.idleLoop()
+	}
+	if n.beaconConfig.enabled() {
+		go n.beaconLoop()
+	}
+	if n.overlayConfig.enabled() {
+		go n.overlayLoop()
+	}
+	if n.antiEntropyConfig.enabled() {
+		go n.antiEntropyLoop()
+	}
+	if n.portMapping {
+		go n.portMappingLoop()
+	}
+	if n.stunServer != "" {
+		go func() {
+			if err := n.discoverExternalAddress(); err != nil {
+				fmt.Printf("Failed to discover external address: %v\n", err)
+			}
+		}()
 	}
 	return nil
 }
 
 // Stop stops the node
 func (n *Node) Stop() {
+	// Announcements still waiting for their batch go out before peers are
+	// disconnected
+	n.flushAnnouncements()
 	close(n.done)
 	n.transport.Stop()
 	if n.watcher != nil {
 		n.watcher.Close()
 	}
+	if err := n.popularity.save(); err != nil {
+		fmt.Printf("Failed to save popularity: %v\n", err)
+	}
+	if err := n.ledger.save(); err != nil {
+		fmt.Printf("Failed to save ledger: %v\n", err)
+	}
+	if err := n.peerDB.save(n.peerDBConfig.MaxAge, n.scores.list()); err != nil {
+		fmt.Printf("Failed to save known peers: %v\n", err)
+	}
+	if err := n.saveTransfers(); err != nil {
+		fmt.Printf("Failed to save interrupted transfers: %v\n", err)
+	}
 }
 
-// HandleMessage implements the MessageHandler interface
+// HandleMessage implements the MessageHandler interface. Messages that
+// don't parse count against the sender's score.
 func (n *Node) HandleMessage(peer *network.Peer, msg *protocol.Message) error {
+	err := n.handleMessage(peer, msg)
+	if errors.Is(err, protocol.ErrInvalidPayload) || errors.Is(err, protocol.ErrBadSignature) {
+		n.scorePeer(peer, scoreInvalidMessage)
+	}
+	return err
+}
+
+func (n *Node) handleMessage(peer *network.Peer, msg *protocol.Message) error {
+	// Until its handshake is complete, a peer is only heard on the
+	// handshake itself, or refusing it
+	if peer != nil && !handshakeTypes[msg.Type] && n.nodeID(peer) == "" {
+		return fmt.Errorf("refused %s from %s: %w", msg.Type, peer.ID(), ErrNoHandshake)
+	}
+	if err := n.checkReplay(peer, msg); err != nil {
+		return fmt.Errorf("refused %s from %s: %w", msg.Type, msg.SenderID, err)
+	}
+	// Checked before the ID is marked seen, so a forged copy arriving first
+	// doesn't keep the genuine message out
+	if err := n.checkSignature(peer, msg); err != nil {
+		return fmt.Errorf("refused %s from %s: %w", msg.Type, msg.SenderID, err)
+	}
+	// A gossiped message reaches a node once through each path to it
+	if msg.ID != "" && !n.gossip.seen.add(msg.ID) {
+		return nil
+	}
+
 	switch msg.Type {
 	case protocol.MessageTypeHandshake:
 		return n.handleHandshake(peer, msg)
+	case protocol.MessageTypeHandshakeProof:
+		return n.handleHandshakeProof(peer, msg)
+	case protocol.MessageTypeNetworkKey:
+		return n.handleNetworkKey(peer, msg)
 	case protocol.MessageTypeData:
 		return n.handleData(peer, msg)
+	case protocol.MessageTypeDataBatch:
+		return n.handleDataBatch(peer, msg)
 	case protocol.MessageTypeDiscovery:
 		return n.handleDiscovery(peer, msg)
 	case protocol.MessageTypeDataRequest:
 		return n.handleDataRequest(peer, msg)
 	case protocol.MessageTypeDataTransfer:
 		return n.handleDataTransfer(peer, msg)
+	case protocol.MessageTypeCredit:
+		return n.handleCredit(peer, msg)
+	case protocol.MessageTypeInventory:
+		return n.handleInventory(peer, msg)
+	case protocol.MessageTypeListRequest:
+		return n.handleListRequest(peer, msg)
+	case protocol.MessageTypeListResponse:
+		return n.handleListResponse(peer, msg)
+	case protocol.MessageTypeSyncSummary:
+		return n.handleSyncSummary(peer, msg)
+	case protocol.MessageTypeStatRequest:
+		return n.handleStatRequest(peer, msg)
+	case protocol.MessageTypeStat:
+		return n.handleStat(peer, msg)
+	case protocol.MessageTypeSearch:
+		return n.handleSearch(peer, msg)
+	case protocol.MessageTypeSearchResult:
+		return n.handleSearchResult(peer, msg)
+	case protocol.MessageTypeWant:
+		return n.handleWant(peer, msg)
+	case protocol.MessageTypeHave:
+		return n.handleHave(peer, msg)
+	case protocol.MessageTypeSubscribe, protocol.MessageTypeUnsubscribe:
+		return n.handleSubscription(peer, msg)
+	case protocol.MessageTypePublish:
+		return n.handlePublish(peer, msg)
+	case protocol.MessageTypeLeave:
+		return n.handleLeave(peer, msg)
+	case protocol.MessageTypeError:
+		return n.handleError(peer, msg)
+	case protocol.MessageTypeReceipt:
+		return n.handleReceipt(peer, msg)
+	case protocol.MessageTypeAudit:
+		return n.handleAudit(peer, msg)
+	case protocol.MessageTypeAuditProof:
+		return n.handleAuditProof(peer, msg)
+	case protocol.MessageTypeName:
+		return n.handleName(peer, msg)
+	case protocol.MessageTypeTombstone:
+		return n.handleTombstone(peer, msg)
+	case protocol.MessageTypeFeed:
+		return n.handleFeed(peer, msg)
+	case protocol.MessageTypeFeedRequest:
+		return n.handleFeedRequest(peer, msg)
+	case protocol.MessageTypeChangeSet:
+		return n.handleChangeSet(peer, msg)
+	case protocol.MessageTypeDeltaRequest:
+		return n.handleDeltaRequest(peer, msg)
+	case protocol.MessageTypeDelta:
+		return n.handleDelta(peer, msg)
+	case protocol.MessageTypeBench:
+		return n.handleBench(peer, msg)
+	case protocol.MessageTypePunch:
+		return n.handlePunch(peer, msg)
+	case protocol.MessageTypeSignal:
+		return n.handleSignal(peer, msg)
 	default:
 		return fmt.Errorf("unknown message type: %s", msg.Type)
 	}
@@ -125,145 +625,365 @@ func (n *Node) handleHandshake(peer *network.Peer, msg *protocol.Message) error
 	if err := msg.ParsePayload(&payload); err != nil {
 		return fmt.Errorf("failed to parse handshake: %w", err)
 	}
+	// Peers speaking no version this node understands would misread its
+	// messages, so they are refused before anything else is sent
+	version, err := protocol.NegotiateVersion(payload.Version, payload.MinVersion)
+	if err != nil {
+		n.rejectPeer(peer, err)
+		return err
+	}
+	if err := n.checkNetwork(payload.NetworkID); err != nil {
+		n.rejectPeer(peer, err)
+		return err
+	}
+	// Peers behind NAT or in containers may advertise a bind address; where
+	// it is unroutable, the address they connected from stands in for it
+	address := network.DialableAddress(payload.Address, peer.Address())
+	addresses := dialableAddresses(payload.DialAddresses(), peer.Address())
+	if err := n.checkPeer(payload.NodeID, payload.PublicKey, address); err != nil {
+		n.rejectPeer(peer, err)
+		return err
+	}
+	// The access lists go by the key the peer presents. It is checked now,
+	// so a peer that isn't admitted hears why before its handshake is
+	// answered, but no peer is taken in until it has proven the key.
+	if err := n.checkAccessPeer(payload.NodeID, payload.PublicKey, peer.Address()); err != nil {
+		n.rejectPeer(peer, err)
+		return err
+	}
+	if err := n.checkIdentity(peer, payload); err != nil {
+		n.rejectPeer(peer, err)
+		return err
+	}
+	if err := n.checkInvite(payload); err != nil {
+		n.rejectPeer(peer, err)
+		return err
+	}
+	hs := peerHandshake{payload: payload, version: version, address: address, addresses: addresses}
+
+	if payload.Reply {
+		// The peer answered this node's handshake, proving its key; this
+		// node proves its own in turn, before sending anything else
+		if err := n.proveHandshake(peer, msg, payload); err != nil {
+			n.rejectPeer(peer, err)
+			return err
+		}
+		return n.completeHandshake(peer, hs)
+	}
+
+	if payload.PublicKey != nil && len(payload.Challenge) == 0 {
+		err := fmt.Errorf("%w: %s sent no challenge", ErrUnprovenIdentity, payload.NodeID)
+		n.rejectPeer(peer, err)
+		return err
+	}
+	reply, err := n.replyHandshake(peer, msg, payload)
+	if err != nil {
+		return err
+	}
+	if payload.PublicKey == nil {
+		// A peer without a key has nothing to prove
+		return n.completeHandshake(peer, hs)
+	}
+	// The peer is taken for the holder of its key once it signs the reply
+	hs.reply = reply
+	n.mu.Lock()
+	n.handshakes[peer] = hs
+	n.mu.Unlock()
+	return nil
+}
+
+// peerHandshake is a handshake that passed its checks, with what was made
+// of it
+type peerHandshake struct {
+	payload   protocol.HandshakePayload
+	version   int
+	address   string
+	addresses []string
+	// reply is the payload of the reply sent to it, which the peer signs to
+	// prove its identity key; see handleHandshakeProof
+	reply []byte
+}
+
+// completeHandshake identifies a peer whose handshake passed its checks and
+// proved its identity key, and starts working with it
+func (n *Node) completeHandshake(peer *network.Peer, hs peerHandshake) error {
+	payload, version, address, addresses := hs.payload, hs.version, hs.address, hs.addresses
+	// Invites are redeemed only once the key they admit is proven
+	if err := n.redeemInvite(payload); err != nil {
+		n.rejectPeer(peer, err)
+		return err
+	}
+	kept := true
+	if payload.PublicKey != nil {
+		kept = n.transport.Identify(peer, payload.PublicKey)
+	} else {
+		kept = n.transport.IdentifyNode(peer, payload.NodeID)
+	}
+	if !kept {
+		// Both sides dialed at once; the other connection carries on
+		return nil
+	}
+
+	// Peers are keyed by the identity the transport now knows them by, the
+	// fingerprint of the key they proved
+	key := peer.ID()
 
 	n.mu.Lock()
 	// Store peer information
-	n.peers[payload.NodeID] = PeerInfo{
-		ID:      payload.NodeID,
-		Address: payload.Address,
+	_, known := n.peers[key]
+	// A connection replacing one still open is no change in topology
+	previous := n.conns[key]
+	connected := previous == nil || previous.Closed()
+	n.renamePeerLocked(key, payload.NodeID)
+	n.peers[key] = PeerInfo{
+		ID:        payload.NodeID,
+		Address:   address,
+		PublicKey: payload.PublicKey,
+		Keyless:   payload.Keyless,
+		UserAgent: payload.UserAgent,
+		Features:  payload.Features,
+		Version:   version,
+		Addresses: addresses,
+
+		Capabilities: payload.PeerCapabilities(),
+
+		exchangeKey: payload.ExchangeKey,
+	}
+	n.peerDB.seen(n.peers[key])
+	n.conns[key] = peer
+	n.peerKeys[payload.NodeID] = key
+	if protocol.HasFeature(payload.Features, protocol.FeatureHeartbeat) {
+		peer.EnableHeartbeats()
+	}
+	if protocol.HasFeature(payload.Features, protocol.FeatureMux) {
+		peer.EnableMux()
+	}
+	if protocol.HasFeature(payload.Features, protocol.FeatureReplay) {
+		if err := n.sealStamps(peer, payload); err != nil {
+			n.mu.Unlock()
+			n.rejectPeer(peer, err)
+			return err
+		}
+		peer.EnableStamps()
 	}
+	peer.UseCodec(protocol.NegotiateCodec(n.codecs, payload.Codecs))
+	peer.UseCompression(protocol.NegotiateCompression(n.compressions, payload.FrameCompression))
 
-	// Key exchange logic
-	if n.isFirstNode {
-		// fmt.Printf("DEBUG: First node handling handshake from %s\n", payload.NodeID)
-		// fmt.Printf("DEBUG: Sending network key: %v\n", n.networkKey != nil)
-	} else {
-		if payload.Key != nil {
-			n.networkKey = payload.Key
-			// fmt.Printf("Adopted network key from peer %s\n", payload.NodeID)
-			// Signal that key is ready
-			select {
-			case <-n.keyReady: // Channel already closed
-			default:
-				close(n.keyReady)
+	n.mu.Unlock()
+
+	// Only the first node sends its key, to peers that dialed it, and never
+	// to a public mirror
+	if !payload.Reply && n.isFirstNode && !payload.Keyless {
+		if err := n.sendNetworkKey(peer, payload); err != nil {
+			fmt.Printf("Not sending the network key to %s: %v\n", payload.NodeID, err)
+		}
+	}
+
+	if connected {
+		n.emit(Event{Type: EventPeerConnected, PeerID: payload.NodeID, Address: address})
+	}
+	go n.resumeTransfers(peer)
+	if n.overlayConfig.enabled() {
+		n.overlay.confirm(payload.NodeID, key, addresses)
+	}
+	if !known {
+		// Let the new peer count our replicas without waiting for the next exchange
+		if n.replicationConfig.Interval > 0 {
+			go func() {
+				if err := n.sendInventory(peer); err != nil {
+					fmt.Printf("Failed to send inventory to %s: %v\n", payload.NodeID, err)
+				}
+			}()
+		}
+		// Bring the new peer up to date with the names and feeds we know;
+		// it asks for the earlier entries of any feed it is behind on
+		go func() {
+			if err := n.sendNames(peer, n.names.list()); err != nil {
+				fmt.Printf("Failed to send names to %s: %v\n", payload.NodeID, err)
+			}
+			if err := n.sendFeed(peer, n.feeds.heads()); err != nil {
+				fmt.Printf("Failed to send feeds to %s: %v\n", payload.NodeID, err)
 			}
+			if err := n.sendTombstones(peer, n.tombstones.list()); err != nil {
+				fmt.Printf("Failed to send tombstones to %s: %v\n", payload.NodeID, err)
+			}
+		}()
+		// Tell the new peer whom else it could connect to
+		if n.overlayConfig.enabled() {
+			go func() {
+				if err := n.sharePeers(peer, payload.NodeID); err != nil {
+					fmt.Printf("Failed to share peers with %s: %v\n", payload.NodeID, err)
+				}
+			}()
 		}
 	}
-	n.mu.Unlock()
 
-	// Prepare response
+	// Subscriptions are forgotten on disconnect, so they are sent again on
+	// every handshake
+	go func() {
+		if err := n.sendSubscriptions(peer, payload.NodeID); err != nil {
+			fmt.Printf("Failed to send subscriptions to %s: %v\n", payload.NodeID, err)
+		}
+	}()
+
+	return nil
+}
+
+// replyHandshake answers a peer's handshake with this node's own, signing
+// the peer's to prove this node's identity key, and returns the payload of
+// the reply
+func (n *Node) replyHandshake(peer *network.Peer, msg *protocol.Message, payload protocol.HandshakePayload) ([]byte, error) {
+	capabilities := n.capabilities()
 	response := protocol.HandshakePayload{
 		NodeID:     n.ID,
-		Address:    n.transport.Address(),
+		Address:    n.transport.AdvertisedAddress(),
+		Addresses:  n.transport.AdvertisedAddresses(),
 		KnownPeers: n.getKnownPeers(),
-	}
+		Reply:      true,
+		PublicKey:  n.identity.Public,
+		Keyless:    n.publicMirror,
+		UserAgent:  protocol.UserAgent(),
+		Features:   protocol.Features,
+		Codecs:     n.codecs,
+		Version:    protocol.ProtocolVersion,
+		MinVersion: protocol.MinProtocolVersion,
 
-	// Only the first node sends its key
-	if n.isFirstNode {
-		n.mu.RLock()
-		response.Key = n.networkKey
-		n.mu.RUnlock()
+		Capabilities: &capabilities,
+		NetworkID:    n.networkID,
+
+		FrameCompression: n.compressions,
+
+		ExchangeKey:       n.exchange.Public(),
+		ExchangeSignature: n.identity.SignExchangeKey(n.exchange.Public()),
+
+		Challenge: peer.Challenge(),
+		Proof:     n.identity.Sign(protocol.ProofData(msg.Payload)),
 	}
 
 	responseMsg, err := protocol.NewMessage(protocol.MessageTypeHandshake, n.ID, response)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return peer.Send(responseMsg)
+	// Stamped like the handshake it answers, since the peer's own
+	// messages are not stamped for until its handshake is complete
+	if responseMsg, err = responseMsg.Stamp(); err != nil {
+		return nil, err
+	}
+	return responseMsg.Payload, peer.Send(responseMsg)
 }
 
 func (n *Node) handleNewFile(path string) {
-	fmt.Printf("\nDEBUG: Starting to handle new file: %s\n", path)
+	n.debugf("Starting to handle new file: %s\n", path)
+
+	if n.Draining() {
+		fmt.Printf("Not storing %s: %v\n", path, ErrDraining)
+		return
+	}
 
 	// Wait for key to be ready before processing
 	if err := n.waitForKey(10 * time.Second); err != nil {
-		fmt.Printf("DEBUG: Failed waiting for network key: %v\n", err)
+		fmt.Printf("Failed waiting for network key: %v\n", err)
 		return
 	}
 
-	// Add a small delay to ensure file is completely written
-	time.Sleep(100 * time.Millisecond)
+	source, ok := n.resolveWatchPath(path)
+	if !ok {
+		return
+	}
 
-	file, err := os.Open(path)
+	release, err := n.admitIngest(source)
 	if err != nil {
-		fmt.Printf("DEBUG: Failed to open file: %v\n", err)
+		fmt.Printf("Not storing %s: %v\n", path, err)
+		return
+	}
+	defer release()
+
+	file, err := os.Open(source)
+	if err != nil {
+		fmt.Printf("Failed to open file: %v\n", err)
 		return
 	}
 	defer file.Close()
 
 	tempFile, err := n.store.CreateTemp()
 	if err != nil {
-		fmt.Printf("DEBUG: Failed to create temp file: %v\n", err)
+		fmt.Printf("Failed to create temp file: %v\n", err)
 		return
 	}
 	defer tempFile.Close()
 
 	n.mu.RLock()
 	key := n.networkKey
-	fmt.Printf("DEBUG: Network key present: %v\n", key != nil)
+	n.debugf("Network key present: %v\n", key != nil)
 	n.mu.RUnlock()
 
-	fmt.Printf("DEBUG: Attempting to encrypt file...\n")
-	if err := crypto.EncryptStream(key, file, tempFile); err != nil {
-		fmt.Printf("DEBUG: Failed to encrypt file: %v\n", err)
-		return
+	// Watch directory files have no namespace, so only a public mirror
+	// stores them as plaintext
+	mode := n.NamespaceMode("")
+	if mode == EncryptNone {
+		if _, err := io.Copy(tempFile, file); err != nil {
+			fmt.Printf("Failed to copy file: %v\n", err)
+			return
+		}
+	} else {
+		n.debugf("Attempting to encrypt file...\n")
+		if err := crypto.EncryptStream(key, file, tempFile); err != nil {
+			fmt.Printf("Failed to encrypt file: %v\n", err)
+			return
+		}
 	}
 
 	if _, err := tempFile.Seek(0, 0); err != nil {
-		fmt.Printf("DEBUG: Failed to reset file pointer for hashing: %v\n", err)
+		fmt.Printf("Failed to reset file pointer for hashing: %v\n", err)
 		return
 	}
 
-	fmt.Printf("DEBUG: Calculating hash...\n")
+	n.debugf("Calculating hash...\n")
 	hash, err := crypto.ContentHash(tempFile)
 	if err != nil {
-		fmt.Printf("DEBUG: Failed to calculate hash: %v\n", err)
+		fmt.Printf("Failed to calculate hash: %v\n", err)
 		return
 	}
 
 	if _, err := tempFile.Seek(0, 0); err != nil {
-		fmt.Printf("DEBUG: Failed to reset file pointer for storage: %v\n", err)
+		fmt.Printf("Failed to reset file pointer for storage: %v\n", err)
 		return
 	}
 
-	fmt.Printf("DEBUG: Storing file with hash: %s\n", hash)
+	n.debugf("Storing file with hash: %s\n", hash)
 	if err := n.store.Store(hash, tempFile); err != nil {
-		fmt.Printf("DEBUG: Failed to store file: %v\n", err)
+		fmt.Printf("Failed to store file: %v\n", err)
 		return
 	}
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		fmt.Printf("DEBUG: Failed to get file info: %v\n", err)
+		fmt.Printf("Failed to get file info: %v\n", err)
 		return
 	}
+	meta := FileMeta{Hash: hash, Name: filepath.Base(path), Size: fileInfo.Size(), ModTime: fileInfo.ModTime(), Encryption: mode}
+	meta.Previous = n.catalog.previous(meta)
+	if err := n.catalog.add(meta); err != nil {
+		fmt.Printf("Failed to update catalog: %v\n", err)
+	}
+	n.emit(Event{Type: EventFileStored, ContentHash: hash, FileName: filepath.Base(path), Size: fileInfo.Size()})
 
 	payload := protocol.DataPayload{
 		ContentHash: hash,
 		FileName:    filepath.Base(path),
 		Size:        fileInfo.Size(),
-		Encrypted:   true,
+		Encrypted:   mode != EncryptNone,
 		FromWatch:   true,
+		Previous:    meta.Previous,
 	}
 
-	msg, err := protocol.NewMessage(protocol.MessageTypeData, n.ID, payload)
-	if err != nil {
-		// fmt.Printf("DEBUG: Failed to create message: %v\n", err)
-		return
-	}
-
-	fmt.Printf("DEBUG: Broadcasting file %s with hash %s\n", filepath.Base(path), hash)
+	n.debugf("Announcing file %s with hash %s\n", filepath.Base(path), hash)
 	n.mu.RLock()
 	peerCount := len(n.peers)
 	n.mu.RUnlock()
-	fmt.Printf("DEBUG: Number of connected peers: %d\n", peerCount)
+	n.debugf("Number of connected peers: %d\n", peerCount)
 
-	if err := n.transport.Broadcast(msg); err != nil {
-		fmt.Printf("DEBUG: Failed to broadcast message: %v\n", err)
-		return
-	}
-	// fmt.Printf("DEBUG: File processing complete\n")
+	n.queueAnnouncement(payload)
 }
 
 func (n *Node) handleData(peer *network.Peer, msg *protocol.Message) error {
@@ -272,20 +992,58 @@ func (n *Node) handleData(peer *network.Peer, msg *protocol.Message) error {
 		return err
 	}
 
-	if n.store.Exists(payload.ContentHash) {
+	// Objects that break the local policy of their namespace are neither
+	// cataloged nor replicated
+	meta, err := n.acceptAnnouncement(payload)
+	if err == nil {
+		err = n.checkObjectSize(payload.Size)
+	}
+	if err != nil {
+		fmt.Printf("Refusing %s from %s: %v\n", payload.ContentHash, peer.ID(), err)
+		return nil
+	}
+	if payload.FileName != "" {
+		if err := n.catalog.addIfMissing(meta); err != nil {
+			fmt.Printf("Failed to update catalog: %v\n", err)
+		}
+	}
+	if n.scores.derated(peer.ID()) {
+		n.debugf("Ignoring offer of %s from derated peer %s\n", payload.ContentHash, peer.ID())
 		return nil
 	}
 
-	request := protocol.DataRequest{
-		ContentHash: payload.ContentHash,
-		FromWatch:   payload.FromWatch,
+	if n.Draining() {
+		return nil
 	}
-	requestMsg, err := protocol.NewMessage(protocol.MessageTypeDataRequest, n.ID, request)
-	if err != nil {
-		return fmt.Errorf("failed to create data request: %w", err)
+	n.holdAnnouncement(peer, payload.ContentHash, msg)
+	if n.store.Exists(payload.ContentHash) {
+		// The sender may be counting replicas from a stale inventory
+		n.confirmReplica(peer, payload.ContentHash)
+		n.sendReceipt(peer, payload.ContentHash)
+		n.passOn(payload.ContentHash)
+		return nil
 	}
+	// Deltas are sealed with the network key, which a mirror doesn't have,
+	// and older peers can't answer delta requests
+	if n.deltaTransfers && !n.publicMirror && payload.Previous != "" && n.store.Exists(payload.Previous) &&
+		n.peerSupports(n.nodeID(peer), protocol.FeatureDelta) {
+		// Only the changes from the version already held need to be sent
+		err := n.requestDelta(peer, payload.ContentHash, payload.Previous, n.traceID(msg))
+		if err == nil {
+			return nil
+		}
+		fmt.Printf("Failed to request delta for %s: %v\n", payload.ContentHash, err)
+	}
+	return n.requestObject(peer, payload.ContentHash, payload.FromWatch, n.traceID(msg))
+}
 
-	return peer.Send(requestMsg)
+// requestObject asks a peer to send a whole object, as part of trace
+func (n *Node) requestObject(peer *network.Peer, hash string, fromWatch bool, trace string) error {
+	request := protocol.DataRequest{
+		ContentHash: hash,
+		FromWatch:   fromWatch,
+	}
+	return n.sendDataRequest(peer, request, trace)
 }
 
 func (n *Node) handleDataRequest(peer *network.Peer, msg *protocol.Message) error {
@@ -293,16 +1051,132 @@ func (n *Node) handleDataRequest(peer *network.Peer, msg *protocol.Message) erro
 	if err := msg.ParsePayload(&request); err != nil {
 		return fmt.Errorf("failed to parse data request: %w", err)
 	}
+	request.TraceID, request.RequestID = msg.TraceID, msg.RequestID
 
-	file, err := n.store.Load(request.ContentHash)
+	if meta, ok := n.catalog.get(request.ContentHash); ok {
+		if err := n.servable(meta); err != nil {
+			n.refuseRequest(peer, msg, protocol.ErrorCodeUnauthorized, err.Error())
+			return err
+		}
+	}
+	id := n.nodeID(peer)
+	if _, err := n.uploadRate(id); err != nil {
+		n.refuseRequest(peer, msg, protocol.ErrorCodeQuota, err.Error())
+		return err
+	}
+	if n.hasObject(request.ContentHash) {
+		n.popularity.record(request.ContentHash, true)
+	} else if n.relayEnabled && request.Range == nil {
+		if relayed, err := n.relayRequest(peer, id, request); relayed || err != nil {
+			return err
+		}
+	}
+	if request.Range != nil && !n.hasObject(request.ContentHash) {
+		// Chunks a swarm download already received are served to others
+		if file, size, ok := n.swarms.openRange(request.ContentHash, *request.Range); ok {
+			defer file.Close()
+			return n.serveRange(peer, msg, request, file, size)
+		}
+	}
+	file, size, err := n.openObject(request.ContentHash)
 	if err != nil {
+		n.refuseRequest(peer, msg, protocol.ErrorCodeNotFound, "no copy of "+request.ContentHash)
 		return fmt.Errorf("failed to load file: %w", err)
 	}
+	if request.Window > 0 && request.Range == nil {
+		if !n.credits.acquire(id) {
+			file.Close()
+			n.refuseRequest(peer, msg, protocol.ErrorCodeBusy, fmt.Sprintf("already sending %d transfers", maxWindowedUploads))
+			return fmt.Errorf("refusing %s to %s: %w", request.ContentHash, id, ErrBusy)
+		}
+		// Sent in the background, so the credit the requester grants is read
+		// from the connection while the transfer waits for it
+		release := peer.Hold(msg)
+		go func() {
+			defer release()
+			defer n.credits.release(id)
+			defer file.Close()
+			if err := n.serveObject(peer, id, request, file, size); err != nil {
+				fmt.Printf("Failed to send %s to %s: %v\n", request.ContentHash, peer.ID(), err)
+			}
+		}()
+		return nil
+	}
 	defer file.Close()
 
-	buffer := make([]byte, 1024*1024) // 1MB chunks
+	if request.Range != nil {
+		return n.serveRange(peer, msg, request, file, size)
+	}
+	return n.serveObject(peer, id, request, file, size)
+}
+
+// serveObject sends an object to a peer, tracking the upload and applying
+// the ledger policy
+func (n *Node) serveObject(peer *network.Peer, peerID string, request protocol.DataRequest, file io.Reader, size int64) error {
+	rate, err := n.uploadRate(peerID)
+	if err != nil {
+		return err
+	}
+
+	uploadKey := fmt.Sprintf("upload-%s-%s", peer.ID(), request.ContentHash)
+	progress := n.tracker.begin(uploadKey, peer.ID(), request.ContentHash, DirectionUpload, size)
+	defer n.tracker.finish(uploadKey)
+	n.emit(Event{Type: EventTransferStarted, PeerID: peer.ID(), ContentHash: request.ContentHash, Direction: DirectionUpload, Size: size})
+
+	if err := n.sendChunks(peer, peerID, request, file, size, progress, rate); err != nil {
+		n.emit(Event{Type: EventTransferFailed, PeerID: peer.ID(), ContentHash: request.ContentHash, Direction: DirectionUpload, Error: err.Error()})
+		return err
+	}
+
+	n.emit(Event{Type: EventTransferCompleted, PeerID: peer.ID(), ContentHash: request.ContentHash, Direction: DirectionUpload, Size: size})
+	return nil
+}
+
+// sendChunks streams a stored file to a peer as DataTransfer messages, at
+// most rate bytes/s unless rate is zero. A request listing chunks only gets
+// those, and one resuming a transfer the chunks from where it resumes, at
+// the chunk size it asks for. A request with a window gets no more chunks
+// than the peer granted credit for. Chunks wait for a slot in the upload
+// scheduler, by the request's priority.
+func (n *Node) sendChunks(peer *network.Peer, peerID string, request protocol.DataRequest, file io.Reader, size int64, progress *transferProgress, rate int64) error {
+	caps := n.peerCapabilities(peerID)
+	chunkSize := caps.ChunkSize()
+	if request.ChunkSize > 0 {
+		chunkSize = request.ChunkSize
+	}
+	var window *creditWindow
+	if request.Window > 0 {
+		key := peerID + "-" + request.ContentHash
+		window = n.credits.open(key, request.Window)
+		defer n.credits.close(key, window)
+	}
+	buffer := make([]byte, chunkSize)
 	chunkIndex := 0
+	pending := resendOrder(request.Chunks)
+	resend := pending != nil
+	meta, _ := n.catalog.get(request.ContentHash)
+	plaintext := meta.Encryption == EncryptNone
+	start := time.Now()
+	var sent, position int64
+	if !resend && request.ResumeFrom > 0 {
+		chunkIndex = request.ResumeFrom
+		position = int64(chunkIndex) * int64(chunkSize)
+		if err := skipBytes(file, position); err != nil {
+			return fmt.Errorf("failed to skip to chunk %d: %w", chunkIndex, err)
+		}
+	}
 	for {
+		if resend {
+			if len(pending) == 0 {
+				break
+			}
+			chunkIndex, pending = pending[0], pending[1:]
+			offset := int64(chunkIndex) * int64(chunkSize)
+			if err := skipBytes(file, offset-position); err != nil {
+				return fmt.Errorf("failed to skip to chunk %d: %w", chunkIndex, err)
+			}
+			position = offset
+		}
 		bytesRead, err := file.Read(buffer)
 		if err == io.EOF {
 			break
@@ -310,23 +1184,50 @@ func (n *Node) handleDataRequest(peer *network.Peer, msg *protocol.Message) erro
 		if err != nil {
 			return fmt.Errorf("failed to read file: %w", err)
 		}
+		position += int64(bytesRead)
 
 		transfer := protocol.DataTransfer{
 			ContentHash: request.ContentHash,
 			Data:        buffer[:bytesRead],
 			ChunkIndex:  chunkIndex,
-			FinalChunk:  bytesRead < len(buffer),
+			FinalChunk:  bytesRead < len(buffer) || position >= size || (resend && len(pending) == 0),
 			FromWatch:   request.FromWatch,
+			TotalSize:   size,
+			Plaintext:   plaintext,
+			ChunkSize:   len(buffer),
+			Priority:    request.Priority,
+			TraceID:     request.TraceID,
 		}
-
-		transferMsg, err := protocol.NewMessage(protocol.MessageTypeDataTransfer, n.ID, transfer)
-		if err != nil {
-			return fmt.Errorf("failed to create transfer message: %w", err)
+		if request.Range != nil {
+			transfer.Range = request.RequestID
 		}
+		compressChunk(&transfer, caps)
 
-		if err := peer.Send(transferMsg); err != nil {
+		if window != nil {
+			if err := window.take(creditTimeout, n.done); err != nil {
+				return fmt.Errorf("stopped sending %s: %w", request.ContentHash, err)
+			}
+		}
+		// Chunks of interactive transfers go ahead of bulk ones when the
+		// node is busy
+		if err := n.uploads.acquire(request.Priority, n.done); err != nil {
+			return err
+		}
+		err = peer.SendTransfer(n.ID, &transfer)
+		n.uploads.release()
+		if err != nil {
 			return fmt.Errorf("failed to send chunk: %w", err)
 		}
+		n.tracker.record(progress, int64(bytesRead))
+		n.ledger.record(peerID, int64(bytesRead), 0)
+
+		sent += int64(bytesRead)
+		if rate > 0 {
+			expected := time.Duration(float64(sent) / float64(rate) * float64(time.Second))
+			if wait := expected - time.Since(start); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
 
 		chunkIndex++
 	}
@@ -339,27 +1240,84 @@ func (n *Node) handleDataTransfer(peer *network.Peer, msg *protocol.Message) err
 	if err := msg.ParsePayload(&transfer); err != nil {
 		return fmt.Errorf("failed to parse data transfer: %w", err)
 	}
+	return n.HandleTransfer(peer, &transfer)
+}
+
+// HandleTransfer implements the TransferHandler interface for chunks that
+// arrive over a bulk channel
+func (n *Node) HandleTransfer(peer *network.Peer, transfer *protocol.DataTransfer) error {
+	if transfer.Bench != "" {
+		n.ledger.record(n.nodeID(peer), 0, int64(len(transfer.Data)))
+		n.benches.receive(transfer)
+		return nil
+	}
+
+	if transfer.Compression != "" {
+		// No chunk is larger than the default, whatever its sender claims
+		data, err := protocol.DecompressChunk(transfer.Compression, transfer.Data, protocol.DefaultChunkSize)
+		if err != nil {
+			return fmt.Errorf("refusing chunk %d of %s: %w", transfer.ChunkIndex, transfer.ContentHash, err)
+		}
+		transfer.Data, transfer.Compression = data, ""
+	}
+	if transfer.Range != "" {
+		n.ledger.record(n.nodeID(peer), 0, int64(len(transfer.Data)))
+		n.ranges.receive(transfer)
+		return nil
+	}
 
 	transferKey := fmt.Sprintf("%s-%s", peer.ID(), transfer.ContentHash)
 
 	n.mu.Lock()
 	state, exists := n.transfers[transferKey]
+	var relay *relayFetch
 	if !exists {
+		if err := n.checkTransferSize(transfer); err != nil {
+			n.mu.Unlock()
+			n.emit(Event{Type: EventTransferFailed, PeerID: peer.ID(), ContentHash: transfer.ContentHash, Direction: DirectionDownload, Error: err.Error()})
+			return fmt.Errorf("refusing transfer of %s: %w", transfer.ContentHash, err)
+		}
 		tempFile, err := n.store.CreateTemp()
 		if err != nil {
 			n.mu.Unlock()
 			return fmt.Errorf("failed to create temp file: %w", err)
 		}
+		chunkSize := transfer.ChunkSize
+		if chunkSize <= 0 {
+			chunkSize = protocol.DefaultChunkSize
+		}
+		relay = n.claimRelayLocked(peer, transfer.ContentHash)
 		state = &transferState{
+			peerID:    peer.ID(),
+			hash:      transfer.ContentHash,
 			tempFile:  tempFile,
 			chunks:    make(map[int]bool),
+			chunkSize: chunkSize,
 			fromWatch: transfer.FromWatch,
+			plaintext: transfer.Plaintext,
+			priority:  transfer.Priority,
+			size:      transfer.TotalSize,
+			progress:  n.tracker.begin(transferKey, peer.ID(), transfer.ContentHash, DirectionDownload, transfer.TotalSize),
+			relay:     relay != nil,
 		}
 		n.transfers[transferKey] = state
 	}
 	n.mu.Unlock()
 
-	offset := int64(transfer.ChunkIndex * 1024 * 1024)
+	if relay != nil {
+		n.startRelay(relay, transfer)
+	}
+	if !exists {
+		n.emit(Event{Type: EventTransferStarted, PeerID: peer.ID(), ContentHash: transfer.ContentHash, Direction: DirectionDownload, Size: transfer.TotalSize})
+	}
+
+	offset := transfer.Offset()
+	if err := n.checkChunk(state, transfer, offset); err != nil {
+		n.abortTransfer(transferKey, state, transfer.ContentHash, err)
+		n.emit(Event{Type: EventTransferFailed, PeerID: peer.ID(), ContentHash: transfer.ContentHash, Direction: DirectionDownload, Error: err.Error()})
+		n.scoreTransfer(peer, err)
+		return fmt.Errorf("aborted transfer of %s: %w", transfer.ContentHash, err)
+	}
 	if _, err := state.tempFile.WriteAt(transfer.Data, offset); err != nil {
 		return fmt.Errorf("failed to write chunk: %w", err)
 	}
@@ -367,22 +1325,61 @@ func (n *Node) handleDataTransfer(peer *network.Peer, msg *protocol.Message) err
 	n.mu.Lock()
 	state.chunks[transfer.ChunkIndex] = true
 	state.received++
-	n.mu.Unlock()
-
 	if transfer.FinalChunk {
-		if state.fromWatch {
-			// For watch transfers, just store in store directory
-			if err := n.finalizeWatchTransfer(transferKey, transfer.ContentHash); err != nil {
-				return fmt.Errorf("failed to finalize watch transfer: %w", err)
-			}
-		} else {
-			// For manual get requests, decrypt to downloads directory
-			if err := n.finalizeDownload(transferKey, transfer.ContentHash); err != nil {
-				return fmt.Errorf("failed to finalize download: %w", err)
+		state.final = true
+		state.count = transfer.ChunkCount()
+	}
+	gaps := state.final && len(state.missingChunks()) > 0
+	n.mu.Unlock()
+	n.tracker.record(state.progress, int64(len(transfer.Data)))
+	n.ledger.record(n.nodeID(peer), 0, int64(len(transfer.Data)))
+	n.grantCredit(peer, state)
+	if state.relay {
+		n.forwardChunk(transfer)
+	}
+
+	if transfer.FinalChunk && gaps {
+		// Chunks sent before the final one may still be on their way
+		time.AfterFunc(resendDelay, func() {
+			if err := n.resendMissing(peer, transferKey, state); err != nil {
+				fmt.Printf("Failed to complete transfer of %s: %v\n", state.hash, err)
 			}
+		})
+		return nil
+	}
+	if !n.claimTransfer(state) {
+		return nil
+	}
+	return n.completeTransfer(peer, transferKey, state)
+}
+
+// completeTransfer verifies and keeps a transfer whose final chunk arrived,
+// once it has been claimed
+func (n *Node) completeTransfer(peer *network.Peer, transferKey string, state *transferState) error {
+	var err error
+	if state.fromWatch {
+		// For watch transfers, just store in store directory
+		if err = n.finalizeWatchTransfer(transferKey, state.hash); err != nil {
+			err = fmt.Errorf("failed to finalize watch transfer: %w", err)
+		}
+	} else {
+		// For manual get requests, decrypt to downloads directory
+		if err = n.finalizeDownload(transferKey, state.hash); err != nil {
+			err = fmt.Errorf("failed to finalize download: %w", err)
 		}
 	}
 
+	n.scoreTransfer(peer, err)
+	if err != nil {
+		n.emit(Event{Type: EventTransferFailed, PeerID: peer.ID(), ContentHash: state.hash, Direction: DirectionDownload, Error: err.Error()})
+		return err
+	}
+	n.emit(Event{Type: EventTransferCompleted, PeerID: peer.ID(), ContentHash: state.hash, Direction: DirectionDownload, Size: state.progress.meter.Total()})
+	if state.fromWatch && !state.relay {
+		n.confirmReplica(peer, state.hash)
+		n.sendReceipt(peer, state.hash)
+		n.passOn(state.hash)
+	}
 	return nil
 }
 
@@ -395,6 +1392,7 @@ func (n *Node) finalizeWatchTransfer(transferKey, expectedHash string) error {
 	}
 	delete(n.transfers, transferKey)
 	n.mu.Unlock()
+	n.tracker.finish(transferKey)
 
 	// cleanup temporary files
 	defer func() {
@@ -404,6 +1402,13 @@ func (n *Node) finalizeWatchTransfer(transferKey, expectedHash string) error {
 
 	defer state.tempFile.Close()
 
+	if err := verifyTransferSize(state); err != nil {
+		if state.relay {
+			n.endRelay(expectedHash, nil, 0, err)
+		}
+		return err
+	}
+
 	// Verify hash
 	if _, err := state.tempFile.Seek(0, 0); err != nil {
 		return fmt.Errorf("failed to reset file pointer: %w", err)
@@ -415,7 +1420,13 @@ func (n *Node) finalizeWatchTransfer(transferKey, expectedHash string) error {
 	}
 
 	if hash != expectedHash {
-		return fmt.Errorf("content hash mismatch")
+		if state.relay {
+			n.endRelay(expectedHash, nil, 0, ErrHashMismatch)
+		}
+		return ErrHashMismatch
+	}
+	if state.plaintext {
+		n.notePlaintext(expectedHash)
 	}
 
 	// Store in store directory without decrypting
@@ -423,9 +1434,24 @@ func (n *Node) finalizeWatchTransfer(transferKey, expectedHash string) error {
 		return fmt.Errorf("failed to reset file pointer: %w", err)
 	}
 
+	if state.relay {
+		size := state.progress.meter.Total()
+		defer n.endRelay(expectedHash, state.tempFile, size, nil)
+		if n.relay == nil {
+			// Nothing to keep; the chunks were forwarded as they arrived
+			return nil
+		}
+		if err := n.relay.put(expectedHash, state.tempFile, size); err != nil {
+			return fmt.Errorf("failed to cache relayed file: %w", err)
+		}
+		n.emit(Event{Type: EventFileStored, ContentHash: expectedHash})
+		return nil
+	}
+
 	if err := n.store.Store(expectedHash, state.tempFile); err != nil {
 		return fmt.Errorf("failed to store file: %w", err)
 	}
+	n.emit(Event{Type: EventFileStored, ContentHash: expectedHash})
 
 	fmt.Printf("File stored in store directory with hash: %s\n", expectedHash)
 	return nil
@@ -440,6 +1466,7 @@ func (n *Node) finalizeDownload(transferKey, expectedHash string) error {
 	}
 	delete(n.transfers, transferKey)
 	n.mu.Unlock()
+	n.tracker.finish(transferKey)
 
 	// cleanup temporary files
 	defer func() {
@@ -449,6 +1476,10 @@ func (n *Node) finalizeDownload(transferKey, expectedHash string) error {
 
 	defer state.tempFile.Close()
 
+	if err := verifyTransferSize(state); err != nil {
+		return err
+	}
+
 	if _, err := state.tempFile.Seek(0, 0); err != nil {
 		return fmt.Errorf("failed to reset file pointer: %w", err)
 	}
@@ -459,10 +1490,13 @@ func (n *Node) finalizeDownload(transferKey, expectedHash string) error {
 	}
 
 	if hash != expectedHash {
-		return fmt.Errorf("content hash mismatch")
+		return ErrHashMismatch
+	}
+	if state.plaintext {
+		n.notePlaintext(expectedHash)
 	}
 
-	finalPath := filepath.Join("downloads", expectedHash)
+	finalPath := filepath.Join(n.DownloadDir(), expectedHash)
 	finalFile, err := os.Create(finalPath)
 	if err != nil {
 		return fmt.Errorf("failed to create final file: %w", err)
@@ -473,11 +1507,12 @@ func (n *Node) finalizeDownload(transferKey, expectedHash string) error {
 		return fmt.Errorf("failed to reset file pointer: %w", err)
 	}
 
-	n.mu.RLock()
-	key := n.networkKey
-	n.mu.RUnlock()
-
-	if err := crypto.DecryptStream(key, state.tempFile, finalFile); err != nil {
+	key, err := n.objectKey(expectedHash)
+	if err != nil {
+		os.Remove(finalPath)
+		return err
+	}
+	if err := decryptObject(key, state.tempFile, finalFile); err != nil {
 		os.Remove(finalPath)
 		return fmt.Errorf("failed to decrypt file: %w", err)
 	}
@@ -500,27 +1535,33 @@ func (n *Node) handleDiscovery(peer *network.Peer, msg *protocol.Message) error
 		return nil
 	}
 
+	n.learnPeer(payload.NodeID, payload.DialAddresses(), "peer "+peer.ID())
+	return nil
+}
+
+// learnPeer hands a peer learned of through source, such as another peer,
+// to the overlay, or queues a dial to it if the overlay is off
+func (n *Node) learnPeer(nodeID string, addresses []string, source string) {
+	// The overlay decides which of the peers it learns of to dial
+	if n.overlayConfig.enabled() {
+		if n.overlay.learn(nodeID, addresses) {
+			n.debugf("Discovered peer %s through %s\n", nodeID, source)
+		}
+		return
+	}
+
 	n.mu.RLock()
-	_, alreadyConnected := n.peers[payload.NodeID]
+	_, alreadyConnected := n.peerKeys[nodeID]
 	n.mu.RUnlock()
 
 	if !alreadyConnected {
-		fmt.Printf("Discovered new peer %s through peer %s\n", payload.NodeID, peer.ID())
-		go func() {
-			if err := n.Connect(payload.Address); err != nil {
-				fmt.Printf("Failed to connect to discovered peer %s (through %s): %v\n",
-					payload.NodeID, peer.ID(), err)
-			} else {
-				fmt.Printf("Successfully connected to discovered peer %s (through %s)\n",
-					payload.NodeID, peer.ID())
-			}
-		}()
+		// Dials are queued and rate limited rather than started immediately
+		if n.discovery.enqueue(discoveredPeer{id: nodeID, addresses: addresses}) {
+			fmt.Printf("Discovered new peer %s through %s\n", nodeID, source)
+		}
 	} else {
-		fmt.Printf("Received discovery from peer %s: already connected to %s\n",
-			peer.ID(), payload.NodeID)
+		fmt.Printf("Learned of peer %s through %s: already connected\n", nodeID, source)
 	}
-
-	return nil
 }
 
 // waitForKey waits for network key to be ready
@@ -559,6 +1600,13 @@ func (n *Node) startWatcher() error {
 
 func (n *Node) watchLoop() {
 	fmt.Printf("Watch loop started for directory: %s\n", n.watchDir)
+	// Editors and copy tools fire bursts of events for one file; it is
+	// ingested once they settle
+	pending := newDebouncer(n.watchDebounce, func(path string) {
+		n.debugf("Watch events settled, calling handleNewFile for: %s\n", path)
+		n.handleNewFile(path)
+	})
+	defer pending.stop()
 	for {
 		select {
 		case <-n.done:
@@ -569,10 +1617,16 @@ func (n *Node) watchLoop() {
 				fmt.Printf("Watch event channel closed\n")
 				return
 			}
-			fmt.Printf("Watch event received: %s %s\n", event.Op, event.Name)
-			if event.Op&fsnotify.Create == fsnotify.Create {
-				fmt.Printf("Create event detected, calling handleNewFile for: %s\n", event.Name)
-				go n.handleNewFile(event.Name)
+			n.debugf("Watch event received: %s %s\n", event.Op, event.Name)
+			switch {
+			case event.Op&(fsnotify.Create|fsnotify.Write) != 0:
+				if loadIgnoreRules(n.watchDir).match(filepath.Base(event.Name), false) {
+					continue
+				}
+				pending.touch(event.Name)
+			case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+				// The path is gone; a rename shows up again as a Create
+				pending.cancel(event.Name)
 			}
 		case err, ok := <-n.watcher.Errors:
 			if !ok {
@@ -583,13 +1637,108 @@ func (n *Node) watchLoop() {
 	}
 }
 
-// Connect connects to a peer
-func (n *Node) Connect(address string) error {
+// Connect connects to a peer, giving up once ctx is done or the transport's
+// dial or handshake timeout runs out
+func (n *Node) Connect(ctx context.Context, address string) error {
 	// When a non-first node connects, it should prepare to receive the network key
 	if !n.isFirstNode {
 		fmt.Printf("Connecting to established node to receive network key...\n")
 	}
-	return n.transport.Connect(address)
+	return n.transport.Connect(ctx, address)
+}
+
+// ConnectAny connects to a peer that can be reached at any of addresses,
+// trying them in order
+func (n *Node) ConnectAny(ctx context.Context, addresses []string) error {
+	return n.transport.ConnectAny(ctx, addresses)
+}
+
+// Address returns the address the node's transport listens on
+func (n *Node) Address() string {
+	return n.transport.Address()
+}
+
+// Addresses returns every address the node's transport listens on
+func (n *Node) Addresses() []string {
+	return n.transport.Addresses()
+}
+
+// Peers returns the peers the node has completed a handshake with
+func (n *Node) Peers() []PeerInfo {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	peers := make([]PeerInfo, 0, len(n.peers))
+	for key, p := range n.peers {
+		if conn := n.conns[key]; conn != nil {
+			p.RTT, p.SmoothedRTT = conn.RTT(), conn.SmoothedRTT()
+		}
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// dropPeer forgets a peer whose connection was evicted for not answering
+// heartbeats, unless it has reconnected since
+func (n *Node) dropPeer(peer *network.Peer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	key := peer.ID()
+	if n.conns[key] == peer {
+		id := n.peers[key].ID
+		n.forgetPeerLocked(key)
+		fmt.Printf("Removed unresponsive peer %s\n", id)
+	}
+}
+
+// peerDisconnected emits an event when the connection to a peer closes,
+// unless the peer has connected again since
+func (n *Node) peerDisconnected(peer *network.Peer) {
+	n.mu.Lock()
+	delete(n.handshakes, peer)
+	n.mu.Unlock()
+
+	n.mu.RLock()
+	var id, address string
+	if n.conns[peer.ID()] == peer {
+		info := n.peers[peer.ID()]
+		id, address = info.ID, info.Address
+	}
+	n.mu.RUnlock()
+
+	if id != "" {
+		n.peerDB.touch(id)
+		n.pubsub.forgetPeer(id)
+		n.tracker.forgetPeer(peer.ID())
+		n.emit(Event{Type: EventPeerDisconnected, PeerID: id, Address: address})
+		if n.suspendTransfers(peer.ID()) > 0 {
+			if err := n.saveTransfers(); err != nil {
+				fmt.Printf("Failed to save interrupted transfers: %v\n", err)
+			}
+		}
+	}
+}
+
+// listenerFailed reports a listener that stopped accepting connections
+func (n *Node) listenerFailed(address string, err error) {
+	fmt.Printf("Stopped accepting connections on %s: %v\n", address, err)
+	n.emit(Event{Type: EventListenerFailed, Address: address, Error: err.Error()})
+}
+
+// RestartListeners reopens the node's listeners, such as after one failed;
+// see network.Transport.RestartListeners
+func (n *Node) RestartListeners() error {
+	return n.transport.RestartListeners()
+}
+
+// peerSupports reports whether a connected peer announced a protocol feature
+func (n *Node) peerSupports(id, feature string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	info, ok := n.peers[n.peerKeys[id]]
+	return ok && info.Supports(feature)
 }
 
 // List returns a list of stored files
@@ -597,57 +1746,92 @@ func (n *Node) List() ([]string, error) {
 	return n.store.List()
 }
 
-// StoreFile stores a file
-func (n *Node) StoreFile(path string) (string, error) {
-	// Wait for key to be ready before storing
-	if err := n.waitForKey(10 * time.Second); err != nil {
-		return "", fmt.Errorf("failed waiting for network key: %w", err)
-	}
+// Hashes returns the content hashes of all stored files
+func (n *Node) Hashes() ([]string, error) {
+	return n.store.Hashes()
+}
 
-	file, err := os.Open(path)
+// MigrateStore copies every stored object into a store at target, which may
+// use a different path layout. Re-running with the same target resumes an
+// interrupted migration. The node keeps using its current store; restart it
+// against the new location once the result is complete.
+func (n *Node) MigrateStore(target string, progress func(done, total int), opts ...storage.Option) (storage.MigrateResult, error) {
+	dir, err := storage.ParseBackend(target)
 	if err != nil {
-		return "", err
+		return storage.MigrateResult{}, err
 	}
-	defer file.Close()
-
-	tempFile, err := n.store.CreateTemp()
+	dst, err := storage.NewStore(dir, opts...)
 	if err != nil {
-		return "", err
+		return storage.MigrateResult{}, fmt.Errorf("failed to open destination store: %w", err)
 	}
-	defer tempFile.Close()
+	return storage.Migrate(n.store, dst, progress)
+}
 
-	n.mu.RLock()
-	key := n.networkKey
-	n.mu.RUnlock()
+// StoreFile stores a file
+func (n *Node) StoreFile(path string) (string, error) {
+	return n.StoreFileIn("", path)
+}
 
-	if err := crypto.EncryptStream(key, file, tempFile); err != nil {
-		return "", fmt.Errorf("failed to encrypt file: %w", err)
+// StoreFileIn stores a file in a namespace, encrypting it as the
+// namespace's policy requires
+func (n *Node) StoreFileIn(namespace, path string) (string, error) {
+	if n.Draining() {
+		return "", ErrDraining
+	}
+	if namespace != "" {
+		if err := validateNamespace(namespace); err != nil {
+			return "", err
+		}
 	}
 
-	if _, err := tempFile.Seek(0, 0); err != nil {
-		return "", err
+	// Wait for key to be ready before storing
+	if err := n.waitForKey(10 * time.Second); err != nil {
+		return "", fmt.Errorf("failed waiting for network key: %w", err)
 	}
 
-	hash, err := crypto.ContentHash(tempFile)
+	info, err := os.Stat(path)
 	if err != nil {
 		return "", err
 	}
 
-	if _, err := tempFile.Seek(0, 0); err != nil {
+	mode := n.NamespaceMode(namespace)
+	hash, key, err := n.ingestFile(path, mode)
+	if err != nil {
 		return "", err
 	}
 
-	if err := n.store.Store(hash, tempFile); err != nil {
-		return "", err
+	meta := FileMeta{
+		Hash:       hash,
+		Name:       filepath.Base(path),
+		Size:       info.Size(),
+		ModTime:    info.ModTime(),
+		Namespace:  namespace,
+		Encryption: mode,
+		Key:        key,
+	}
+	meta.Previous = n.catalog.previous(meta)
+	if err := n.catalog.add(meta); err != nil {
+		return "", fmt.Errorf("failed to update catalog: %w", err)
 	}
+	n.emit(Event{Type: EventFileStored, ContentHash: hash, FileName: meta.Name, Size: meta.Size})
 
 	return hash, nil
 }
 
-// GetFile retrieves a file and its decryption key
+// DownloadDir returns the directory files fetched with get are decrypted to
+func (n *Node) DownloadDir() string {
+	if n.downloadDir == "" {
+		return "downloads"
+	}
+	return n.downloadDir
+}
+
+// GetFile retrieves a file and its decryption key, which is nil for
+// plaintext objects. A file not stored locally is fetched from peers and
+// stored first; see WithRequests.
 func (n *Node) GetFile(contentHash string) (io.ReadCloser, crypto.Key, error) {
 	// Create downloads directory if it doesn't exist
-	if err := os.MkdirAll("downloads", 0755); err != nil {
+	if err := os.MkdirAll(n.DownloadDir(), 0755); err != nil {
 		return nil, nil, fmt.Errorf("failed to create downloads directory: %w", err)
 	}
 
@@ -656,34 +1840,54 @@ func (n *Node) GetFile(contentHash string) (io.ReadCloser, crypto.Key, error) {
 		return nil, nil, fmt.Errorf("failed waiting for network key: %w", err)
 	}
 
-	// First try local storage
-	reader, err := n.store.Load(contentHash)
-	if err == nil {
-		n.mu.RLock()
-		key := n.networkKey
-		n.mu.RUnlock()
-		return reader, key, nil
+	// First try local storage, then store a copy from peers
+	if n.hasObject(contentHash) {
+		n.popularity.record(contentHash, false)
+	} else if err := n.fetchAt(contentHash, protocol.PriorityInteractive, n.requestConfig.Timeout); err != nil {
+		return nil, nil, err
 	}
-
-	// If not found locally, request from peers
-	request := protocol.DataRequest{
-		ContentHash: contentHash,
+	reader, _, err := n.openObject(contentHash)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load file: %w", err)
 	}
-
-	requestMsg, err := protocol.NewMessage(protocol.MessageTypeDataRequest, n.ID, request)
+	key, err := n.objectKey(contentHash)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create request message: %w", err)
+		reader.Close()
+		return nil, nil, err
 	}
+	return reader, key, nil
+}
 
-	if err := n.transport.Broadcast(requestMsg); err != nil {
-		return nil, nil, fmt.Errorf("failed to broadcast request: %w", err)
+// broadcast queues msg for every connected peer and logs, by node ID, the
+// peers it couldn't be queued for. It only returns an error if it was
+// queued for no peer. Messages of signed types are signed first.
+func (n *Node) broadcast(what string, msg *protocol.Message) error {
+	n.sign(msg)
+	err := n.transport.Broadcast(msg)
+	var result *network.BroadcastError
+	if !errors.As(err, &result) {
+		return err
+	}
+	for _, failed := range result.Failed {
+		fmt.Printf("Failed to send %s to %s: %v\n", what, n.peerName(failed.Peer), failed.Err)
+	}
+	if result.Delivered == 0 {
+		return err
 	}
+	return nil
+}
 
-	n.mu.RLock()
-	key := n.networkKey
-	n.mu.RUnlock()
+// broadcastFailed logs a queued broadcast that could not be written
+func (n *Node) broadcastFailed(peer *network.Peer, msg *protocol.Message, err error) {
+	fmt.Printf("Failed to send %s to %s: %v\n", msg.Type, n.peerName(peer), err)
+}
 
-	return nil, key, fmt.Errorf("file not found locally, request sent to peers")
+// peerName is the node ID of a connected peer, or its connection's ID
+func (n *Node) peerName(peer *network.Peer) string {
+	if id := n.nodeID(peer); id != "" {
+		return id
+	}
+	return peer.ID()
 }
 
 func (n *Node) getKnownPeers() []string {
@@ -1,9 +1,13 @@
 package node
 
 import (
+	"context"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
 )
 
 func setupTestDir(t *testing.T) (string, func()) {
@@ -19,6 +23,15 @@ func setupTestDir(t *testing.T) (string, func()) {
 	return tmpDir, cleanup
 }
 
+func writeTestFile(t *testing.T, path, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+}
+
 func TestNewNode(t *testing.T) {
 	baseDir, cleanup := setupTestDir(t)
 	defer cleanup()
@@ -85,3 +98,78 @@ func TestNode_List(t *testing.T) {
 		t.Errorf("Expected empty list, got %d files", len(files))
 	}
 }
+
+func TestNewNode_ScratchAndDownloadDirs(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	downloads := filepath.Join(baseDir, "downloads")
+	scratch := filepath.Join(baseDir, "scratch")
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+		WithDownloadDir(downloads), WithScratchDir(scratch))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	if node.DownloadDir() != downloads {
+		t.Errorf("DownloadDir() = %s, want %s", node.DownloadDir(), downloads)
+	}
+	if node.store.ScratchDir() != scratch {
+		t.Errorf("ScratchDir() = %s, want %s", node.store.ScratchDir(), scratch)
+	}
+
+	blocker := filepath.Join(baseDir, "file")
+	writeTestFile(t, blocker, "not a directory")
+	if _, err := NewNode("other", ":0", filepath.Join(baseDir, "other"), filepath.Join(baseDir, "watch"),
+		WithDownloadDir(filepath.Join(blocker, "downloads"))); err == nil {
+		t.Error("NewNode() with an unusable download directory succeeded, want error")
+	}
+}
+
+func TestNode_HeartbeatRTTAndDropPeer(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	heartbeat := network.WithHeartbeat(network.HeartbeatConfig{Interval: 20 * time.Millisecond, MaxMissed: 3})
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true), WithTransportOptions(heartbeat))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false), WithTransportOptions(heartbeat))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	// Both sides ping once they see the other announce heartbeats
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		firstPeers, secondPeers := first.Peers(), second.Peers()
+		if len(firstPeers) == 1 && len(secondPeers) == 1 && firstPeers[0].RTT > 0 && secondPeers[0].RTT > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for heartbeat round trips")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// An evicted connection takes the peer's entry with it
+	conn, _ := first.peerConn("second")
+	first.dropPeer(conn)
+	if peers := first.Peers(); len(peers) != 0 {
+		t.Errorf("Peers() after eviction = %v, want none", peers)
+	}
+}
@@ -0,0 +1,245 @@
+package node
+
+import (
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/storage"
+)
+
+// Option configures a Node
+type Option func(*Node)
+
+// WithFirstNode marks the node as the first node of the network, which
+// generates and hands out the network key instead of waiting to receive one
+func WithFirstNode(first bool) Option {
+	return func(n *Node) {
+		n.isFirstNode = first
+	}
+}
+
+// WithTransportOptions passes options through to the node's network transport
+func WithTransportOptions(opts ...network.Option) Option {
+	return func(n *Node) {
+		n.transportOpts = append(n.transportOpts, opts...)
+	}
+}
+
+// WithStoreOptions passes options through to the node's content store
+func WithStoreOptions(opts ...storage.Option) Option {
+	return func(n *Node) {
+		n.storeOpts = append(n.storeOpts, opts...)
+	}
+}
+
+// WithScrubSchedule enables scheduled background integrity checks
+func WithScrubSchedule(cfg ScrubConfig) Option {
+	return func(n *Node) {
+		n.scrubConfig = cfg
+	}
+}
+
+// WithDataDir sets the directory holding the node's own state such as the
+// file catalog. It defaults to the parent of the store directory.
+func WithDataDir(dir string) Option {
+	return func(n *Node) {
+		n.dataDir = dir
+	}
+}
+
+// WithSymlinkPolicy sets how symbolic links in the watch directory and
+// imported trees are handled. The default is SymlinkFollow.
+func WithSymlinkPolicy(policy SymlinkPolicy) Option {
+	return func(n *Node) {
+		n.symlinkPolicy = policy
+	}
+}
+
+// WithRelayCache keeps copies of content fetched on behalf of other peers in
+// a separate cache of up to budget bytes. Zero disables the relay cache.
+func WithRelayCache(budget int64) Option {
+	return func(n *Node) {
+		n.relayBudget = budget
+	}
+}
+
+// WithRelay sets whether requests for content the node lacks are relayed to
+// a peer that holds it. Enabled by default.
+func WithRelay(enabled bool) Option {
+	return func(n *Node) {
+		n.relayEnabled = enabled
+	}
+}
+
+// WithStorageOnly makes the node hold replicas for its peers without
+// ingesting files of its own: it doesn't watch its watch directory. Peers
+// prefer storage-only nodes when placing replicas.
+func WithStorageOnly(enabled bool) Option {
+	return func(n *Node) {
+		n.storageOnly = enabled
+	}
+}
+
+// WithMaxChunkSize sets the largest transfer chunk the node accepts, which
+// peers then send it objects in. It is rounded down to a power of two of at
+// least protocol.MinChunkSize; zero, the default, accepts
+// protocol.DefaultChunkSize.
+func WithMaxChunkSize(size int) Option {
+	return func(n *Node) {
+		n.maxChunkSize = size
+	}
+}
+
+// WithDiscovery sets the rate and connection limits for dialing peers
+// learned through discovery
+func WithDiscovery(cfg DiscoveryConfig) Option {
+	return func(n *Node) {
+		n.discoveryConfig = cfg
+	}
+}
+
+// WithReplication sets the replication target and how often inventories are
+// exchanged with peers to count replicas
+func WithReplication(cfg ReplicationConfig) Option {
+	return func(n *Node) {
+		n.replicationConfig = cfg
+	}
+}
+
+// WithAudits enables scheduled storage audits of peers holding replicas
+func WithAudits(cfg AuditConfig) Option {
+	return func(n *Node) {
+		n.auditConfig = cfg
+	}
+}
+
+// WithLedgerPolicy sets the exchange ratio peers must keep to be served at
+// full speed
+func WithLedgerPolicy(policy LedgerPolicy) Option {
+	return func(n *Node) {
+		n.ledgerPolicy = policy
+	}
+}
+
+// WithSettler sets where ledger balances are settled outside the network
+func WithSettler(s Settler) Option {
+	return func(n *Node) {
+		n.settler = s
+	}
+}
+
+// WithLogLevel sets the initial log verbosity; LogInfo by default
+func WithLogLevel(level LogLevel) Option {
+	return func(n *Node) {
+		n.logLevel.Store(int32(level))
+	}
+}
+
+// WithPublicMirror makes the node a public mirror: it never holds the
+// network key, stores everything as plaintext and only replicates objects
+// announced as unencrypted. A mirror is never the first node.
+func WithPublicMirror(enabled bool) Option {
+	return func(n *Node) {
+		n.publicMirror = enabled
+	}
+}
+
+// WithDeltaTransfers sets whether new versions of files are fetched as
+// deltas against the previous version when it is held. Enabled by default.
+func WithDeltaTransfers(enabled bool) Option {
+	return func(n *Node) {
+		n.deltaTransfers = enabled
+	}
+}
+
+// WithMaxObjectSize sets the largest file accepted from peers, in bytes.
+// Larger announcements are refused and larger transfers aborted. Zero, the
+// default, means no limit.
+func WithMaxObjectSize(size int64) Option {
+	return func(n *Node) {
+		n.maxObjectSize = size
+	}
+}
+
+// WithWatchDebounce sets how long a file in the watch directory must go
+// without changes before it is stored; DefaultWatchDebounce by default
+func WithWatchDebounce(delay time.Duration) Option {
+	return func(n *Node) {
+		n.watchDebounce = delay
+	}
+}
+
+// WithScratchDir puts the temporary files of transfers and ingests under
+// dir instead of the store's temp directory. The directory is created if
+// needed and must be writable.
+func WithScratchDir(dir string) Option {
+	return func(n *Node) {
+		n.storeOpts = append(n.storeOpts, storage.WithScratchDir(dir))
+	}
+}
+
+// WithDownloadDir sets where files fetched with get are decrypted to;
+// "downloads" in the working directory by default. The directory is created
+// if needed and must be writable.
+func WithDownloadDir(dir string) Option {
+	return func(n *Node) {
+		n.downloadDir = dir
+	}
+}
+
+// WithIngestLimits bounds the ingestion of files from the watch directory,
+// store and import; DefaultIngestConfig by default
+func WithIngestLimits(cfg IngestConfig) Option {
+	return func(n *Node) {
+		n.ingestConfig = cfg
+	}
+}
+
+// WithTLS secures peer connections with TLS and mutual authentication.
+// Plaintext TCP is used by default.
+func WithTLS(cfg TLSConfig) Option {
+	return func(n *Node) {
+		n.tlsConfig = cfg
+	}
+}
+
+// WithSessionEncryption encrypts peer connections with keys agreed anew for
+// each one, signed with the identity key; see
+// network.WithSessionEncryption. Every node of the network must enable it.
+func WithSessionEncryption(enabled bool) Option {
+	return func(n *Node) {
+		n.sessionEncryption = enabled
+	}
+}
+
+// WithRateLimits caps the node's upload and download rates, in total and
+// per peer. They can be changed at runtime with SetRateLimits.
+func WithRateLimits(limits network.RateLimits) Option {
+	return func(n *Node) {
+		n.transportOpts = append(n.transportOpts, network.WithRateLimits(limits))
+	}
+}
+
+// WithCodecs sets the codecs this node accepts on framed connections, in
+// order of preference; protocol.Codecs by default. Each peer is sent the
+// first of them it also accepts, or JSON.
+func WithCodecs(codecs []string) Option {
+	return func(n *Node) {
+		n.codecs = codecs
+		n.transportOpts = append(n.transportOpts, network.WithCodecs(codecs))
+	}
+}
+
+// WithFrameCompression sets the schemes this node decompresses frames
+// with, in order of preference; protocol.FrameCompressions by default. Each
+// peer is sent frames compressed with the first of them it also
+// decompresses, or uncompressed. Frames smaller than threshold bytes are
+// always sent uncompressed.
+func WithFrameCompression(schemes []string, threshold int) Option {
+	return func(n *Node) {
+		n.compressions = schemes
+		n.transportOpts = append(n.transportOpts,
+			network.WithFrameCompression(schemes),
+			network.WithCompressThreshold(threshold))
+	}
+}
@@ -0,0 +1,402 @@
+package node
+
+import (
+	"crypto/sha256"
+	"fmt"
+	mathrand "math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// overlayMaxMisses is how many maintenance rounds a target may stay
+// unreachable before it is dropped from the table
+const overlayMaxMisses = 3
+
+// overlayMaxKnown bounds the table of known peers. Peers learned of through
+// discovery make room for proven ones, never the other way round, so a
+// flood of made-up peers can't push out those the node has shaken hands
+// with.
+const overlayMaxKnown = 1024
+
+// OverlayConfig shapes the overlay: instead of dialing every peer it hears
+// of, the node keeps connections to a bounded set of them. Peers tell new
+// peers about the ones they know, and each node connects to those nearest
+// to it by identity distance, which keeps the overlay well connected
+// locally, plus a few random ones, which keep it connected as a whole.
+type OverlayConfig struct {
+	// Nearest is how many of the closest known peers the node connects to
+	Nearest int
+	// Random is how many other known peers, picked at random, it connects to
+	Random int
+	// Interval between maintenance rounds, which dial missing neighbours,
+	// drop surplus ones and exchange known peers with a neighbour
+	Interval time.Duration
+}
+
+// DefaultOverlayConfig returns an overlay of 4 nearest and 4 random
+// neighbours, maintained every 30 seconds
+func DefaultOverlayConfig() OverlayConfig {
+	return OverlayConfig{
+		Nearest:  4,
+		Random:   4,
+		Interval: 30 * time.Second,
+	}
+}
+
+func (c OverlayConfig) enabled() bool {
+	return c.Nearest > 0 || c.Random > 0
+}
+
+// OverlayPeer is a peer known to the overlay
+type OverlayPeer struct {
+	ID        string   `json:"id"`
+	Addresses []string `json:"addresses"`
+	// Kind is "nearest" or "random" for the node's chosen neighbours, and
+	// empty for other known peers
+	Kind string `json:"kind,omitempty"`
+	// Identity is the fingerprint the peer proved in a handshake, empty
+	// for peers only heard of
+	Identity  string `json:"identity,omitempty"`
+	Connected bool   `json:"connected"`
+}
+
+type overlayPeer struct {
+	id        string
+	addresses []string
+	// identity and key, its hash, are set once a handshake proves them;
+	// only then is the peer ranked by distance
+	identity string
+	key      [sha256.Size]byte
+	misses   int // rounds in a row it was a target but not connected
+}
+
+func (p *overlayPeer) confirmed() bool {
+	return p.identity != ""
+}
+
+// overlay is the table of known peers and the neighbours chosen from it
+type overlay struct {
+	mu     sync.Mutex
+	cfg    OverlayConfig
+	selfID string
+	self   [sha256.Size]byte
+	known  map[string]*overlayPeer
+	random map[string]bool // random neighbours, kept across rounds
+	dialed map[string]bool // peers connected because the overlay dialed them
+	wake   chan struct{}
+}
+
+func newOverlay(cfg OverlayConfig, selfID, identity string) *overlay {
+	return &overlay{
+		cfg:    cfg,
+		selfID: selfID,
+		self:   sha256.Sum256([]byte(identity)),
+		known:  make(map[string]*overlayPeer),
+		random: make(map[string]bool),
+		dialed: make(map[string]bool),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// closer reports whether a is closer to key than b, by XOR distance
+func closer(key, a, b [sha256.Size]byte) bool {
+	for i := range key {
+		da, db := a[i]^key[i], b[i]^key[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// learn adds or updates a peer heard of from others, reporting whether it
+// was unknown. The addresses of confirmed peers are left as their
+// handshake gave them. Learning a new peer wakes the maintenance loop.
+func (o *overlay) learn(id string, addresses []string) bool {
+	if len(addresses) == 0 || id == o.selfID {
+		return false
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if p, ok := o.known[id]; ok {
+		if !p.confirmed() {
+			p.addresses = addresses
+		}
+		return false
+	}
+	if len(o.known) >= overlayMaxKnown && !o.evictLocked(false) {
+		return false
+	}
+	o.known[id] = &overlayPeer{id: id, addresses: addresses}
+	o.wakeLocked()
+	return true
+}
+
+// confirm records the identity a peer proved in a handshake, adding the
+// peer if it was unknown
+func (o *overlay) confirm(id, identity string, addresses []string) {
+	key := sha256.Sum256([]byte(identity))
+	if len(addresses) == 0 || id == o.selfID || key == o.self {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	p, ok := o.known[id]
+	if !ok {
+		if len(o.known) >= overlayMaxKnown && !o.evictLocked(true) {
+			return
+		}
+		p = &overlayPeer{id: id}
+		o.known[id] = p
+		o.wakeLocked()
+	}
+	p.addresses = addresses
+	p.identity = identity
+	p.key = key
+}
+
+// evictLocked makes room in the table by dropping a random unconfirmed
+// peer or, if confirmed is set and there is none, the confirmed peer
+// farthest away. Chosen neighbours stay. It reports whether it made room;
+// callers hold the lock.
+func (o *overlay) evictLocked(confirmed bool) bool {
+	var farthest *overlayPeer
+	for id, p := range o.known {
+		if o.random[id] || o.dialed[id] {
+			continue
+		}
+		if !p.confirmed() {
+			// Map order is random enough to spread evictions
+			delete(o.known, id)
+			return true
+		}
+		if confirmed && (farthest == nil || closer(o.self, farthest.key, p.key)) {
+			farthest = p
+		}
+	}
+	if farthest == nil {
+		return false
+	}
+	delete(o.known, farthest.id)
+	return true
+}
+
+func (o *overlay) wakeLocked() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *overlay) forget(id string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.known, id)
+	delete(o.random, id)
+}
+
+// sortedLocked returns the confirmed peers nearest to key first, leaving
+// out except; callers hold the lock
+func (o *overlay) sortedLocked(key [sha256.Size]byte, except string) []*overlayPeer {
+	peers := make([]*overlayPeer, 0, len(o.known))
+	for _, p := range o.known {
+		if p.confirmed() && p.id != except {
+			peers = append(peers, p)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return closer(key, peers[i].key, peers[j].key) })
+	return peers
+}
+
+// targets returns the chosen neighbours by ID: the nearest confirmed
+// peers, and random ones among the rest, confirmed or not. Random picks are
+// kept while they stay known, so the overlay doesn't churn; dialing them is
+// how peers heard of get confirmed and ranked.
+func (o *overlay) targets() map[string]string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	targets := make(map[string]string)
+	for i, p := range o.sortedLocked(o.self, "") {
+		if i >= o.cfg.Nearest {
+			break
+		}
+		targets[p.id] = "nearest"
+	}
+	var rest []string
+	for id := range o.known {
+		if targets[id] == "" {
+			rest = append(rest, id)
+		}
+	}
+	for id := range o.random {
+		if _, known := o.known[id]; !known || targets[id] != "" {
+			delete(o.random, id)
+		}
+	}
+	mathrand.Shuffle(len(rest), func(i, j int) { rest[i], rest[j] = rest[j], rest[i] })
+	for _, id := range rest {
+		if len(o.random) >= o.cfg.Random {
+			break
+		}
+		o.random[id] = true
+	}
+	for id := range o.random {
+		targets[id] = "random"
+	}
+	return targets
+}
+
+// sample returns the confirmed peers to tell the peer id, known by
+// identity, about: those nearest to it, which it is most likely to want,
+// and some random others. Peers only heard of aren't passed on.
+func (o *overlay) sample(id, identity string) []overlayPeer {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	sorted := o.sortedLocked(sha256.Sum256([]byte(identity)), id)
+	n := min(o.cfg.Nearest, len(sorted))
+	picked := make([]overlayPeer, 0, n+o.cfg.Random)
+	for _, p := range sorted[:n] {
+		picked = append(picked, *p)
+	}
+	rest := sorted[n:]
+	for _, i := range mathrand.Perm(len(rest))[:min(o.cfg.Random, len(rest))] {
+		picked = append(picked, *rest[i])
+	}
+	return picked
+}
+
+// WithOverlay sets the shape of the overlay. A config with neither nearest
+// nor random neighbours turns it off, and the node dials every peer it
+// learns of through discovery.
+func WithOverlay(cfg OverlayConfig) Option {
+	return func(n *Node) {
+		n.overlayConfig = cfg
+	}
+}
+
+// Overlay returns the peers known to the overlay, sorted by ID, with the
+// node's chosen neighbours marked
+func (n *Node) Overlay() []OverlayPeer {
+	targets := n.overlay.targets()
+	n.overlay.mu.Lock()
+	peers := make([]OverlayPeer, 0, len(n.overlay.known))
+	for id, p := range n.overlay.known {
+		peers = append(peers, OverlayPeer{ID: id, Addresses: p.addresses, Kind: targets[id], Identity: p.identity})
+	}
+	n.overlay.mu.Unlock()
+
+	for i := range peers {
+		_, peers[i].Connected = n.peerConn(peers[i].ID)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+// overlayLoop maintains the overlay until the node stops
+func (n *Node) overlayLoop() {
+	ticker := time.NewTicker(n.overlayConfig.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			n.shareWithNeighbour()
+			n.maintainOverlay(true)
+		case <-n.overlay.wake:
+			n.maintainOverlay(false)
+		}
+	}
+}
+
+// maintainOverlay dials chosen neighbours that aren't connected, through the
+// discovery queue, and closes connections the overlay dialed to peers that
+// are no longer chosen. Connections it didn't dial are left alone. Scheduled
+// rounds count the misses of neighbours that are still not connected.
+func (n *Node) maintainOverlay(scheduled bool) {
+	targets := n.overlay.targets()
+
+	var dial []discoveredPeer
+	var drop []string
+	n.overlay.mu.Lock()
+	for id := range targets {
+		p, ok := n.overlay.known[id]
+		if !ok {
+			continue
+		}
+		if _, connected := n.peerConn(id); connected {
+			p.misses = 0
+			continue
+		}
+		if scheduled {
+			p.misses++
+		}
+		if p.misses > overlayMaxMisses {
+			// Unreachable; the next round picks another
+			delete(n.overlay.known, id)
+			delete(n.overlay.random, id)
+			continue
+		}
+		n.overlay.dialed[id] = true
+		dial = append(dial, discoveredPeer{id: id, addresses: p.addresses})
+	}
+	for id := range n.overlay.dialed {
+		if targets[id] == "" {
+			delete(n.overlay.dialed, id)
+			drop = append(drop, id)
+		}
+	}
+	n.overlay.mu.Unlock()
+
+	for _, p := range dial {
+		n.discovery.enqueue(p)
+	}
+	for _, id := range drop {
+		if peer, ok := n.peerConn(id); ok {
+			n.debugf("Dropping overlay connection to %s\n", id)
+			peer.Close()
+		}
+	}
+}
+
+// sharePeers tells a peer about known peers it may want as neighbours
+func (n *Node) sharePeers(peer *network.Peer, id string) error {
+	for _, p := range n.overlay.sample(id, peer.ID()) {
+		msg, err := protocol.NewMessage(protocol.MessageTypeDiscovery, n.ID, protocol.DiscoveryPayload{
+			NodeID:    p.id,
+			Address:   p.addresses[0],
+			Addresses: p.addresses,
+		})
+		if err != nil {
+			return err
+		}
+		if err := peer.Send(msg); err != nil {
+			return fmt.Errorf("failed to send discovery: %w", err)
+		}
+	}
+	return nil
+}
+
+// shareWithNeighbour exchanges known peers with one random neighbour, so
+// peers that joined after a handshake still spread through the overlay
+func (n *Node) shareWithNeighbour() {
+	ids := n.connectedPeers()
+	if len(ids) == 0 {
+		return
+	}
+	id := ids[mathrand.Intn(len(ids))]
+	if peer, ok := n.peerConn(id); ok {
+		if err := n.sharePeers(peer, id); err != nil {
+			fmt.Printf("Failed to share peers with %s: %v\n", id, err)
+		}
+	}
+}
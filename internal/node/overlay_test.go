@@ -0,0 +1,203 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestOverlay_Targets(t *testing.T) {
+	o := newOverlay(OverlayConfig{Nearest: 2, Random: 2}, "self", "self-key")
+	if o.learn("self", []string{"self:1"}) {
+		t.Error("learn() accepted the node itself")
+	}
+	var ids []string
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("peer-%d", i)
+		ids = append(ids, id)
+		if !o.learn(id, []string{id + ":1"}) {
+			t.Fatalf("learn(%q) = false for a new peer", id)
+		}
+	}
+	if o.learn("peer-0", []string{"moved:1"}) {
+		t.Error("learn() reported a known peer as new")
+	}
+
+	// Peers only heard of are never ranked by distance
+	for id, kind := range o.targets() {
+		if kind == "nearest" {
+			t.Errorf("Unconfirmed peer %s chosen as nearest", id)
+		}
+	}
+
+	for _, id := range ids {
+		o.confirm(id, id+"-key", []string{id + ":1"})
+	}
+	self := sha256.Sum256([]byte("self-key"))
+	sort.Slice(ids, func(i, j int) bool {
+		return closer(self, sha256.Sum256([]byte(ids[i]+"-key")), sha256.Sum256([]byte(ids[j]+"-key")))
+	})
+
+	targets := o.targets()
+	if len(targets) != 4 {
+		t.Fatalf("targets() = %v, want 4 neighbours", targets)
+	}
+	for _, id := range ids[:2] {
+		if targets[id] != "nearest" {
+			t.Errorf("targets()[%q] = %q, want nearest", id, targets[id])
+		}
+	}
+	random := 0
+	for id, kind := range targets {
+		if kind == "random" {
+			random++
+			if id == ids[0] || id == ids[1] {
+				t.Errorf("Nearest peer %s also picked at random", id)
+			}
+		}
+	}
+	if random != 2 {
+		t.Errorf("targets() has %d random neighbours, want 2", random)
+	}
+
+	// Random picks stay put while they are known
+	again := o.targets()
+	for id, kind := range targets {
+		if again[id] != kind {
+			t.Errorf("Neighbour %s changed from %q to %q", id, kind, again[id])
+		}
+	}
+
+	// Discovery can't move a confirmed peer
+	o.learn(ids[0], []string{"elsewhere:1"})
+	if got := o.known[ids[0]].addresses[0]; got != ids[0]+":1" {
+		t.Errorf("Confirmed peer moved to %s by discovery", got)
+	}
+}
+
+func TestOverlay_EvictsUnconfirmedFirst(t *testing.T) {
+	o := newOverlay(OverlayConfig{Nearest: 2, Random: 2}, "self", "self-key")
+	for i := 0; i < 10; i++ {
+		id := fmt.Sprintf("proven-%d", i)
+		o.confirm(id, id+"-key", []string{id + ":1"})
+	}
+	for i := 0; len(o.known) < overlayMaxKnown; i++ {
+		o.learn(fmt.Sprintf("heard-%d", i), []string{"heard:1"})
+	}
+
+	// A full table takes proven peers in place of ones heard of
+	o.confirm("late", "late-key", []string{"late:1"})
+	if p, ok := o.known["late"]; !ok || !p.confirmed() {
+		t.Error("Full table refused a confirmed peer")
+	}
+	if len(o.known) != overlayMaxKnown {
+		t.Errorf("Table holds %d peers, want %d", len(o.known), overlayMaxKnown)
+	}
+
+	// Peers heard of push out only others heard of
+	for i := 0; i < 2*overlayMaxKnown; i++ {
+		o.learn(fmt.Sprintf("flood-%d", i), []string{"flood:1"})
+	}
+	for i := 0; i < 10; i++ {
+		if _, ok := o.known[fmt.Sprintf("proven-%d", i)]; !ok {
+			t.Errorf("proven-%d evicted by peers heard of", i)
+		}
+	}
+	if len(o.known) > overlayMaxKnown {
+		t.Errorf("Table grew to %d peers", len(o.known))
+	}
+}
+
+func TestOverlay_Sample(t *testing.T) {
+	o := newOverlay(OverlayConfig{Nearest: 2, Random: 1}, "self", "self-key")
+	for i := 0; i < 6; i++ {
+		id := fmt.Sprintf("peer-%d", i)
+		o.confirm(id, id+"-key", []string{id + ":1"})
+	}
+	o.learn("rumour", []string{"rumour:1"})
+
+	sample := o.sample("peer-0", "peer-0-key")
+	if len(sample) != 3 {
+		t.Fatalf("sample() returned %d peers, want 3", len(sample))
+	}
+	for _, p := range sample {
+		if p.id == "peer-0" {
+			t.Error("sample() included the peer it is for")
+		}
+	}
+
+	o.forget("peer-1")
+	for i := 0; i < 20; i++ {
+		for _, p := range o.sample("peer-0", "peer-0-key") {
+			if p.id == "peer-1" {
+				t.Error("sample() included a forgotten peer")
+			}
+			if p.id == "rumour" {
+				t.Fatal("sample() passed on a peer only heard of")
+			}
+		}
+	}
+}
+
+func TestNode_OverlayDialsSharedPeers(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	overlay := WithOverlay(OverlayConfig{Nearest: 2, Random: 2, Interval: time.Hour})
+	newTestNode := func(id string, first bool) *Node {
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"), WithFirstNode(first), overlay)
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		n.transport.Start()
+		return n
+	}
+
+	hub := newTestNode("hub", true)
+	defer hub.Stop()
+	a := newTestNode("a", false)
+	defer a.Stop()
+	b := newTestNode("b", false)
+	defer b.Stop()
+	go b.discovery.run(b.done, b.skipDiscovered, b.ConnectAny)
+	go b.overlayLoop()
+
+	if err := a.Connect(context.Background(), hub.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := a.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	events, cancel := b.Subscribe()
+	defer cancel()
+	if err := b.Connect(context.Background(), hub.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	// The hub tells b about a, and b's overlay dials it
+	deadline := time.After(10 * time.Second)
+	for {
+		if _, ok := b.peerConn("a"); ok {
+			break
+		}
+		select {
+		case <-events:
+		case <-deadline:
+			t.Fatalf("b did not connect to a; overlay = %+v", b.Overlay())
+		}
+	}
+
+	peers := b.Overlay()
+	if len(peers) != 2 {
+		t.Fatalf("Overlay() = %+v, want hub and a", peers)
+	}
+	for _, p := range peers {
+		if p.Kind == "" || !p.Connected {
+			t.Errorf("Overlay peer %+v is not a connected neighbour", p)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+// peerDBFile is where known peers are kept, under the node's data directory
+const peerDBFile = "peers.json"
+
+// KnownPeer is a peer the node has completed a handshake with, as kept
+// across restarts
+type KnownPeer struct {
+	ID        string    `json:"id"`
+	Addresses []string  `json:"addresses"`
+	PublicKey []byte    `json:"public_key,omitempty"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Score is the peer's score when the node last saved it; see PeerScore
+	Score   float64   `json:"score"`
+	Updated time.Time `json:"score_updated,omitempty"`
+}
+
+// PeerDBConfig sets which known peers the node dials again when it starts
+type PeerDBConfig struct {
+	// Reconnect is how many of the most recently seen peers are dialed at
+	// start; 0 dials none
+	Reconnect int
+	// MaxAge is how long a peer may go unseen before it is no longer
+	// dialed at start and is dropped from the database; 0 keeps peers
+	// forever
+	MaxAge time.Duration
+}
+
+// DefaultPeerDBConfig dials the 8 most recently seen peers at start, among
+// those seen in the last week
+func DefaultPeerDBConfig() PeerDBConfig {
+	return PeerDBConfig{
+		Reconnect: 8,
+		MaxAge:    7 * 24 * time.Hour,
+	}
+}
+
+// WithPeerDB sets which known peers are dialed again at start
+func WithPeerDB(cfg PeerDBConfig) Option {
+	return func(n *Node) {
+		n.peerDBConfig = cfg
+	}
+}
+
+// HasKnownPeers reports whether a node keeping its data in dataDir saved
+// known peers in an earlier run, so it can rejoin the network through them
+func HasKnownPeers(dataDir string) bool {
+	db, err := loadPeerDB(filepath.Join(dataDir, peerDBFile))
+	return err == nil && len(db.peers) > 0
+}
+
+// peerDB keeps the peers the node has connected to and persists them as
+// JSON
+type peerDB struct {
+	path  string
+	mu    sync.Mutex
+	peers map[string]*KnownPeer
+	now   func() time.Time
+}
+
+// loadPeerDB reads the peer database at path, starting empty if it does
+// not exist
+func loadPeerDB(path string) (*peerDB, error) {
+	db := &peerDB{
+		path:  path,
+		peers: make(map[string]*KnownPeer),
+		now:   time.Now,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return db, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read peer database: %w", err)
+	}
+
+	var peers []*KnownPeer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("failed to parse peer database: %w", err)
+	}
+	for _, p := range peers {
+		db.peers[p.ID] = p
+	}
+	return db, nil
+}
+
+// seen records a peer as seen now, at the addresses it announced
+func (db *peerDB) seen(info PeerInfo) {
+	addresses := info.Addresses
+	if len(addresses) == 0 && info.Address != "" {
+		addresses = []string{info.Address}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	p, ok := db.peers[info.ID]
+	if !ok {
+		p = &KnownPeer{ID: info.ID}
+		db.peers[info.ID] = p
+	}
+	p.Addresses = addresses
+	if info.PublicKey != nil {
+		p.PublicKey = info.PublicKey
+	}
+	p.LastSeen = db.now()
+}
+
+// touch moves a known peer's last sighting up to now
+func (db *peerDB) touch(id string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if p, ok := db.peers[id]; ok {
+		p.LastSeen = db.now()
+	}
+}
+
+// key returns the identity key a known peer presented, if any
+func (db *peerDB) key(id string) []byte {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if p, ok := db.peers[id]; ok {
+		return p.PublicKey
+	}
+	return nil
+}
+
+// forget drops a peer, such as one that left the network for good
+func (db *peerDB) forget(id string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.peers, id)
+}
+
+// list returns the known peers, most recently seen first
+func (db *peerDB) list() []KnownPeer {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	peers := make([]KnownPeer, 0, len(db.peers))
+	for _, p := range db.peers {
+		peers = append(peers, *p)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		if !peers[i].LastSeen.Equal(peers[j].LastSeen) {
+			return peers[i].LastSeen.After(peers[j].LastSeen)
+		}
+		return peers[i].ID < peers[j].ID
+	})
+	return peers
+}
+
+// save persists the peers seen within maxAge, with their current scores
+func (db *peerDB) save(maxAge time.Duration, scores []PeerScore) error {
+	byIdentity := make(map[string]PeerScore, len(scores))
+	for _, s := range scores {
+		byIdentity[s.Identity] = s
+	}
+
+	db.mu.Lock()
+	now := db.now()
+	for id, p := range db.peers {
+		if maxAge > 0 && now.Sub(p.LastSeen) > maxAge {
+			delete(db.peers, id)
+			continue
+		}
+		if s, ok := byIdentity[network.IdentityOf(p.PublicKey, p.ID)]; ok {
+			p.Score, p.Updated = s.Score, s.Updated
+		}
+	}
+	db.mu.Unlock()
+
+	data, err := json.MarshalIndent(db.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode peer database: %w", err)
+	}
+	return writeFileAtomic(db.path, data)
+}
+
+// KnownPeers returns the peers the node has connected to, in this run or
+// earlier ones, most recently seen first
+func (n *Node) KnownPeers() []KnownPeer {
+	return n.peerDB.list()
+}
+
+// reconnectKnown queues dials to the most recently seen known peers that
+// are neither banned nor scored below the disconnect threshold
+func (n *Node) reconnectKnown() {
+	cfg := n.peerDBConfig
+	queued := 0
+	for _, p := range n.peerDB.list() {
+		if queued >= cfg.Reconnect {
+			return
+		}
+		if cfg.MaxAge > 0 && time.Since(p.LastSeen) > cfg.MaxAge {
+			return
+		}
+		if len(p.Addresses) == 0 || n.checkPeer(p.ID, p.PublicKey, "") != nil {
+			continue
+		}
+		if threshold := n.scoreConfig.DisconnectThreshold; threshold != 0 && p.Score < threshold {
+			continue
+		}
+		if n.discovery.enqueue(discoveredPeer{id: p.ID, addresses: p.Addresses}) {
+			n.debugf("Reconnecting to known peer %s\n", p.ID)
+			queued++
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+func TestPeerDB_SaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "peers.json")
+	db, err := loadPeerDB(path)
+	if err != nil {
+		t.Fatalf("loadPeerDB() error = %v", err)
+	}
+	now := time.Now()
+	db.now = func() time.Time { return now.Add(-30 * 24 * time.Hour) }
+	db.seen(PeerInfo{ID: "old", Address: "10.0.0.1:3000"})
+	db.now = func() time.Time { return now }
+	db.seen(PeerInfo{ID: "recent", Address: "10.0.0.2:3000", Addresses: []string{"10.0.0.2:3000", "[::1]:3000"}})
+
+	scores := []PeerScore{{Identity: network.IdentityOf(nil, "recent"), PeerID: "recent", Score: -12, Updated: now}}
+	if err := db.save(7*24*time.Hour, scores); err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+
+	loaded, err := loadPeerDB(path)
+	if err != nil {
+		t.Fatalf("loadPeerDB() error = %v", err)
+	}
+	peers := loaded.list()
+	if len(peers) != 1 || peers[0].ID != "recent" {
+		t.Fatalf("Loaded peers = %+v, want only the recent one", peers)
+	}
+	if len(peers[0].Addresses) != 2 || peers[0].Score != -12 {
+		t.Errorf("Loaded peer = %+v, want both addresses and its score", peers[0])
+	}
+}
+
+func TestNode_ReconnectsToKnownPeers(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "first", "store"), filepath.Join(baseDir, "first", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	storeDir, watchDir := filepath.Join(baseDir, "second", "store"), filepath.Join(baseDir, "second", "watch")
+	second, err := NewNode("second", freeAddr(t), storeDir, watchDir, WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	second.transport.Start()
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	second.Stop()
+	if !HasKnownPeers(filepath.Join(baseDir, "second")) {
+		t.Fatal("HasKnownPeers() = false after connecting and stopping")
+	}
+
+	// Restarted with no peer given, it dials the peer it knew
+	restarted, err := NewNode("second", freeAddr(t), storeDir, watchDir, WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer restarted.Stop()
+	if known := restarted.KnownPeers(); len(known) != 1 || known[0].ID != "first" {
+		t.Fatalf("KnownPeers() = %+v, want first", known)
+	}
+	if err := restarted.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	if err := restarted.waitForKey(10 * time.Second); err != nil {
+		t.Fatalf("Restarted node didn't rejoin: %v", err)
+	}
+	if _, ok := restarted.peerConn("first"); !ok {
+		t.Error("Restarted node isn't connected to first")
+	}
+}
@@ -0,0 +1,187 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PopularityHalfLife is how long it takes for an access to count half as
+// much toward an object's popularity score
+const PopularityHalfLife = 24 * time.Hour
+
+// cacheAdmissionAccesses is how many times an object must have been accessed
+// before it is admitted to the in-memory cache, so one-off reads and scans
+// don't push out content that is actually hot
+const cacheAdmissionAccesses = 2
+
+// ObjectPopularity reports how often and how recently an object was accessed
+type ObjectPopularity struct {
+	Hash           string    `json:"hash"`
+	LocalReads     int64     `json:"local_reads"`
+	RemoteRequests int64     `json:"remote_requests"`
+	LastAccess     time.Time `json:"last_access"`
+	// Score is the access count with each access decayed by its age
+	Score float64 `json:"score"`
+}
+
+// Accesses returns the total number of local reads and remote requests
+func (p ObjectPopularity) Accesses() int64 {
+	return p.LocalReads + p.RemoteRequests
+}
+
+// popularityTracker keeps per-object access counts and a recency-weighted score
+type popularityTracker struct {
+	path    string
+	mu      sync.Mutex
+	objects map[string]*ObjectPopularity
+	now     func() time.Time
+}
+
+// loadPopularity reads tracked popularity from path, starting empty if it does not exist
+func loadPopularity(path string) (*popularityTracker, error) {
+	p := &popularityTracker{
+		path:    path,
+		objects: make(map[string]*ObjectPopularity),
+		now:     time.Now,
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read popularity: %w", err)
+	}
+
+	var objects []*ObjectPopularity
+	if err := json.Unmarshal(data, &objects); err != nil {
+		return nil, fmt.Errorf("failed to parse popularity: %w", err)
+	}
+	for _, o := range objects {
+		p.objects[o.Hash] = o
+	}
+	return p, nil
+}
+
+// record counts an access to hash, either a local read or a peer's request
+func (p *popularityTracker) record(hash string, remote bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	o, ok := p.objects[hash]
+	if !ok {
+		o = &ObjectPopularity{Hash: hash}
+		p.objects[hash] = o
+	}
+	o.Score = decay(o.Score, o.LastAccess, now) + 1
+	o.LastAccess = now
+	if remote {
+		o.RemoteRequests++
+	} else {
+		o.LocalReads++
+	}
+}
+
+// get returns the popularity of hash with its score decayed to the present
+func (p *popularityTracker) get(hash string) ObjectPopularity {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	o, ok := p.objects[hash]
+	if !ok {
+		return ObjectPopularity{Hash: hash}
+	}
+	current := *o
+	current.Score = decay(o.Score, o.LastAccess, p.now())
+	return current
+}
+
+// top returns up to limit objects ordered by descending score
+func (p *popularityTracker) top(limit int) []ObjectPopularity {
+	p.mu.Lock()
+	now := p.now()
+	all := make([]ObjectPopularity, 0, len(p.objects))
+	for _, o := range p.objects {
+		current := *o
+		current.Score = decay(o.Score, o.LastAccess, now)
+		all = append(all, current)
+	}
+	p.mu.Unlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Score != all[j].Score {
+			return all[i].Score > all[j].Score
+		}
+		return all[i].Hash < all[j].Hash
+	})
+	if limit > 0 && len(all) > limit {
+		all = all[:limit]
+	}
+	return all
+}
+
+// forget drops tracking for an object that is no longer stored
+func (p *popularityTracker) forget(hash string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.objects, hash)
+}
+
+// save persists the tracked popularity
+func (p *popularityTracker) save() error {
+	p.mu.Lock()
+	objects := make([]*ObjectPopularity, 0, len(p.objects))
+	for _, o := range p.objects {
+		copied := *o
+		objects = append(objects, &copied)
+	}
+	p.mu.Unlock()
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Hash < objects[j].Hash })
+	data, err := json.Marshal(objects)
+	if err != nil {
+		return fmt.Errorf("failed to encode popularity: %w", err)
+	}
+	return writeFileAtomic(p.path, data)
+}
+
+// decay ages score from the time of the last access to now
+func decay(score float64, last, now time.Time) float64 {
+	if score == 0 || last.IsZero() {
+		return score
+	}
+	elapsed := now.Sub(last)
+	if elapsed <= 0 {
+		return score
+	}
+	return score * math.Exp2(-float64(elapsed)/float64(PopularityHalfLife))
+}
+
+// admitToCache is the store's cache admission policy: only objects that have
+// been accessed repeatedly are kept in memory
+func (n *Node) admitToCache(hash string) bool {
+	return n.popularity.get(hash).Accesses() >= cacheAdmissionAccesses
+}
+
+// popularityScore returns the decayed popularity score of hash, used to
+// rank objects for cache eviction and repair
+func (n *Node) popularityScore(hash string) float64 {
+	return n.popularity.get(hash).Score
+}
+
+// Popularity returns the access statistics of an object
+func (n *Node) Popularity(hash string) ObjectPopularity {
+	return n.popularity.get(hash)
+}
+
+// PopularObjects returns the most popular objects, most popular first
+func (n *Node) PopularObjects(limit int) []ObjectPopularity {
+	return n.popularity.top(limit)
+}
@@ -0,0 +1,143 @@
+package node
+
+import (
+	"io"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPopularity_DecayAndRanking(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	p, err := loadPopularity(filepath.Join(baseDir, "popularity.json"))
+	if err != nil {
+		t.Fatalf("Failed to load popularity: %v", err)
+	}
+	now := time.Now()
+	p.now = func() time.Time { return now }
+
+	p.record("old", false)
+	p.record("old", true)
+	now = now.Add(PopularityHalfLife)
+	p.record("new", true)
+
+	old := p.get("old")
+	if old.LocalReads != 1 || old.RemoteRequests != 1 {
+		t.Errorf("Counts = %d/%d, want 1/1", old.LocalReads, old.RemoteRequests)
+	}
+	if math.Abs(old.Score-1) > 1e-9 {
+		t.Errorf("Score after one half-life = %v, want 1", old.Score)
+	}
+
+	// Equal scores fall back to hash order
+	top := p.top(1)
+	if len(top) != 1 || top[0].Hash != "new" {
+		t.Errorf("top(1) = %v, want new", top)
+	}
+
+	now = now.Add(time.Hour)
+	p.record("old", false)
+	if top := p.top(0); top[0].Hash != "old" {
+		t.Errorf("Most popular = %v, want old", top[0].Hash)
+	}
+}
+
+func TestPopularity_Persistence(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	path := filepath.Join(baseDir, "popularity.json")
+	p, err := loadPopularity(path)
+	if err != nil {
+		t.Fatalf("Failed to load popularity: %v", err)
+	}
+	p.record("abc", true)
+	if err := p.save(); err != nil {
+		t.Fatalf("Failed to save popularity: %v", err)
+	}
+
+	reloaded, err := loadPopularity(path)
+	if err != nil {
+		t.Fatalf("Failed to reload popularity: %v", err)
+	}
+	if got := reloaded.get("abc"); got.RemoteRequests != 1 {
+		t.Errorf("RemoteRequests = %v, want %v", got.RemoteRequests, 1)
+	}
+}
+
+func TestNode_PopularityFromReads(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	src := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, src, "popular")
+	hash, err := node.StoreFile(src)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	if node.admitToCache(hash) {
+		t.Error("Object admitted to cache before any reads")
+	}
+	for i := 0; i < 2; i++ {
+		if err := node.readObject(hash, io.Discard); err != nil {
+			t.Fatalf("Failed to read object: %v", err)
+		}
+	}
+
+	info := node.Info(hash)
+	if info.Popularity.LocalReads != 2 {
+		t.Errorf("LocalReads = %v, want %v", info.Popularity.LocalReads, 2)
+	}
+	if !node.admitToCache(hash) {
+		t.Error("Repeatedly read object not admitted to cache")
+	}
+	if info.Meta == nil || info.Meta.Name != "file.txt" {
+		t.Errorf("Info().Meta = %+v, want file.txt", info.Meta)
+	}
+}
+
+func TestNode_RemoveObjectForgetsPopularity(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	src := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, src, "short-lived")
+	hash, err := node.StoreFile(src)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	if err := node.readObject(hash, io.Discard); err != nil {
+		t.Fatalf("Failed to read object: %v", err)
+	}
+	if node.Popularity(hash).Accesses() != 1 {
+		t.Fatal("Read was not tracked")
+	}
+
+	if err := node.removeObject(hash); err != nil {
+		t.Fatalf("Failed to remove object: %v", err)
+	}
+	if got := node.Popularity(hash); got.Accesses() != 0 {
+		t.Errorf("Popularity after removal = %+v, want none", got)
+	}
+	for _, o := range node.PopularObjects(0) {
+		if o.Hash == hash {
+			t.Error("Removed object still listed as popular")
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+// portMappingLifetime is how long the router is asked to keep the mapping;
+// it is renewed halfway through
+const portMappingLifetime = time.Hour
+
+// WithPortMapping has the router in front of the node forward the listen
+// port, and advertises the router's external address in handshakes instead
+// of the bind address. A nil mapper finds the router with NAT-PMP, then
+// UPnP, when the node starts.
+func WithPortMapping(mapper network.PortMapper) Option {
+	return func(n *Node) {
+		n.portMapping = true
+		n.portMapper = mapper
+	}
+}
+
+// WithAdvertisedAddress sets the address peers are told to dial, for nodes
+// behind NAT or in containers whose bind address is useless to peers. It
+// takes precedence over the address found by port mapping.
+func WithAdvertisedAddress(address string) Option {
+	return func(n *Node) {
+		n.advertisedAddr = address
+		n.transportOpts = append(n.transportOpts, network.WithAdvertisedAddress(address))
+	}
+}
+
+// AdvertisedAddress returns the address peers are told to dial
+func (n *Node) AdvertisedAddress() string {
+	return n.transport.AdvertisedAddress()
+}
+
+// dialableAddresses resolves the addresses a peer advertised against the
+// address it connected from, see network.DialableAddress
+func dialableAddresses(advertised []string, observed string) []string {
+	addresses := make([]string, len(advertised))
+	for i, address := range advertised {
+		addresses[i] = network.DialableAddress(address, observed)
+	}
+	return addresses
+}
+
+// portMappingLoop maps the listen port and keeps renewing the mapping until
+// the node stops, then removes it
+func (n *Node) portMappingLoop() {
+	mapper := n.portMapper
+	if mapper == nil {
+		var err error
+		if mapper, err = network.DiscoverPortMapper(network.DefaultPortMapTimeout); err != nil {
+			fmt.Printf("Failed to set up port mapping: %v\n", err)
+			return
+		}
+	}
+	_, portStr, err := net.SplitHostPort(n.transport.Address())
+	if err != nil {
+		fmt.Printf("Failed to set up port mapping: %v\n", err)
+		return
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		fmt.Printf("Failed to set up port mapping: invalid port %q\n", portStr)
+		return
+	}
+
+	// Ask for the same port outside; the router may grant another
+	external := port
+	mapped := false
+	ticker := time.NewTicker(portMappingLifetime / 2)
+	defer ticker.Stop()
+	for {
+		granted, err := n.mapPort(mapper, port, external)
+		if err != nil {
+			fmt.Printf("Failed to map port %d with %s: %v\n", port, mapper.Name(), err)
+		} else {
+			external, mapped = granted, true
+		}
+
+		select {
+		case <-n.done:
+			if mapped {
+				if err := mapper.DeleteMapping(port, external); err != nil {
+					fmt.Printf("Failed to remove port mapping: %v\n", err)
+				}
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// mapPort maps port on the router and advertises the external address,
+// returning the external port granted
+func (n *Node) mapPort(mapper network.PortMapper, port, external int) (int, error) {
+	granted, err := mapper.AddMapping(port, external, portMappingLifetime)
+	if err != nil {
+		return 0, err
+	}
+	if n.advertisedAddr != "" {
+		// The configured address stays advertised
+		return granted, nil
+	}
+	ip, err := mapper.ExternalIP()
+	if err != nil {
+		return granted, fmt.Errorf("failed to get external address: %w", err)
+	}
+
+	address := net.JoinHostPort(ip.String(), strconv.Itoa(granted))
+	if address != n.transport.AdvertisedAddress() {
+		fmt.Printf("Mapped port %d with %s, advertising %s\n", port, mapper.Name(), address)
+	}
+	n.transport.SetAdvertisedAddress(address)
+	return granted, nil
+}
@@ -0,0 +1,125 @@
+package node
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMapper grants a fixed external port and records deletions
+type fakeMapper struct {
+	mu      sync.Mutex
+	deleted []int
+}
+
+func (m *fakeMapper) Name() string                { return "fake" }
+func (m *fakeMapper) ExternalIP() (net.IP, error) { return net.ParseIP("203.0.113.9"), nil }
+
+func (m *fakeMapper) AddMapping(internalPort, externalPort int, lifetime time.Duration) (int, error) {
+	return 41000, nil
+}
+
+func (m *fakeMapper) DeleteMapping(internalPort, externalPort int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted = append(m.deleted, externalPort)
+	return nil
+}
+
+func TestNode_PortMapping(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	mapper := &fakeMapper{}
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true), WithPortMapping(mapper))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	first.transport.Start()
+	go first.portMappingLoop()
+
+	const want = "203.0.113.9:41000"
+	deadline := time.Now().Add(5 * time.Second)
+	for first.AdvertisedAddress() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("AdvertisedAddress() = %q, want %q", first.AdvertisedAddress(), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Peers learn the mapped address from the handshake
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	if peers := second.Peers(); len(peers) != 1 || peers[0].Address != want {
+		t.Errorf("Peers() = %+v, want first at %s", peers, want)
+	}
+
+	// Stopping removes the mapping
+	first.Stop()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		mapper.mu.Lock()
+		deleted := append([]int(nil), mapper.deleted...)
+		mapper.mu.Unlock()
+		if len(deleted) == 1 && deleted[0] == 41000 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deleted mappings = %v, want [41000]", deleted)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNode_AdvertisedAddress(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	const advertised = "node1.example.com:3000"
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true), WithAdvertisedAddress(advertised))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+	events, cancel := first.Subscribe()
+	defer cancel()
+
+	// The second node advertises its bind address, which has no host
+	_, port, _ := net.SplitHostPort(freeAddr(t))
+	second, err := NewNode("second", ":"+port, filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	waitForEvent(t, events, EventPeerConnected, 5*time.Second)
+
+	if peers := second.Peers(); len(peers) != 1 || peers[0].Address != advertised {
+		t.Errorf("Second node's Peers() = %+v, want first at %s", peers, advertised)
+	}
+	// The first node falls back to the address the second connected from
+	want := net.JoinHostPort("127.0.0.1", port)
+	if peers := first.Peers(); len(peers) != 1 || peers[0].Address != want {
+		t.Errorf("First node's Peers() = %+v, want second at %s", peers, want)
+	}
+}
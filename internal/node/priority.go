@@ -0,0 +1,101 @@
+package node
+
+import (
+	"fmt"
+	"sync"
+
+	"p2p-storage/internal/protocol"
+)
+
+// DefaultUploadSlots is how many chunks a node sends at once before further
+// chunks queue by priority
+const DefaultUploadSlots = 4
+
+// WithUploadSlots sets how many chunks are sent at once, to all peers
+// together. Chunks beyond that wait for a slot, those of interactive
+// transfers ahead of bulk ones; zero sends every chunk at once, in no
+// particular order.
+func WithUploadSlots(slots int) Option {
+	return func(n *Node) {
+		n.uploadSlots = slots
+	}
+}
+
+// uploadScheduler hands out the slots chunks are sent in, to the highest
+// priority waiting first and in order of arrival within a priority
+type uploadScheduler struct {
+	mu      sync.Mutex
+	free    int
+	limited bool
+	waiting [protocol.MaxPriority + 1][]chan struct{}
+}
+
+func newUploadScheduler(slots int) *uploadScheduler {
+	return &uploadScheduler{free: slots, limited: slots > 0}
+}
+
+// acquire waits for a slot to send a chunk of the given priority in
+func (s *uploadScheduler) acquire(priority int, done <-chan struct{}) error {
+	if !s.limited {
+		return nil
+	}
+	priority = min(max(priority, 0), protocol.MaxPriority)
+
+	s.mu.Lock()
+	if s.free > 0 && !s.queuedFrom(priority) {
+		s.free--
+		s.mu.Unlock()
+		return nil
+	}
+	turn := make(chan struct{})
+	s.waiting[priority] = append(s.waiting[priority], turn)
+	s.mu.Unlock()
+
+	select {
+	case <-turn:
+		return nil
+	case <-done:
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, ch := range s.waiting[priority] {
+			if ch == turn {
+				s.waiting[priority] = append(s.waiting[priority][:i], s.waiting[priority][i+1:]...)
+				return fmt.Errorf("node stopped")
+			}
+		}
+		// The slot was handed over just as the node stopped
+		s.releaseLocked()
+		return fmt.Errorf("node stopped")
+	}
+}
+
+// release passes a slot on to the next chunk waiting, or frees it
+func (s *uploadScheduler) release() {
+	if !s.limited {
+		return
+	}
+	s.mu.Lock()
+	s.releaseLocked()
+	s.mu.Unlock()
+}
+
+func (s *uploadScheduler) releaseLocked() {
+	for priority := protocol.MaxPriority; priority >= 0; priority-- {
+		if queue := s.waiting[priority]; len(queue) > 0 {
+			s.waiting[priority] = queue[1:]
+			close(queue[0])
+			return
+		}
+	}
+	s.free++
+}
+
+// queuedFrom reports whether chunks of priority or higher are waiting
+func (s *uploadScheduler) queuedFrom(priority int) bool {
+	for p := priority; p <= protocol.MaxPriority; p++ {
+		if len(s.waiting[p]) > 0 {
+			return true
+		}
+	}
+	return false
+}
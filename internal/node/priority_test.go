@@ -0,0 +1,79 @@
+package node
+
+import (
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestUploadScheduler_Priority(t *testing.T) {
+	s := newUploadScheduler(1)
+	done := make(chan struct{})
+	if err := s.acquire(protocol.PriorityBulk, done); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	// A bulk chunk queues first, then an interactive one
+	order := make(chan string, 2)
+	wait := func(name string, priority int) {
+		if err := s.acquire(priority, done); err != nil {
+			t.Errorf("acquire(%s) error = %v", name, err)
+			return
+		}
+		order <- name
+		s.release()
+	}
+	go wait("bulk", protocol.PriorityBulk)
+	waitQueued(t, s, protocol.PriorityBulk)
+	go wait("interactive", protocol.PriorityInteractive)
+	waitQueued(t, s, protocol.PriorityInteractive)
+
+	s.release()
+	for _, want := range []string{"interactive", "bulk"} {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Fatalf("Slot went to the %s chunk, want the %s one", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("The %s chunk never got a slot", want)
+		}
+	}
+
+	// Waiting chunks give up when the node stops
+	if err := s.acquire(protocol.PriorityBulk, done); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	close(done)
+	if err := s.acquire(protocol.PriorityInteractive, done); err == nil {
+		t.Error("acquire() got a slot none was free for")
+	}
+}
+
+func TestUploadScheduler_Unlimited(t *testing.T) {
+	s := newUploadScheduler(0)
+	for i := 0; i < 10; i++ {
+		if err := s.acquire(protocol.PriorityBulk, nil); err != nil {
+			t.Fatalf("acquire() error = %v", err)
+		}
+	}
+}
+
+// waitQueued waits until a chunk of priority is waiting for a slot
+func waitQueued(t *testing.T, s *uploadScheduler, priority int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		queued := len(s.waiting[priority]) > 0
+		s.mu.Unlock()
+		if queued {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Chunk never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
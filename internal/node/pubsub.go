@@ -0,0 +1,293 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// topicBufferSize is how many messages a topic subscriber may fall behind
+// before further ones are dropped for it
+const topicBufferSize = 64
+
+// maxPeerTopics bounds the topics tracked for one peer. A peer subscribing
+// to more is scored as sending an invalid message, and the topics over the
+// cap aren't recorded.
+const maxPeerTopics = 1024
+
+// TopicMessage is an application message published to a topic
+type TopicMessage struct {
+	Topic  string `json:"topic"`
+	Origin string `json:"origin"` // ID of the node that published it
+	Data   []byte `json:"data"`
+}
+
+// pubsub tracks the topics subscribed to here, with the channels they are
+// delivered on, and those each peer subscribed to
+type pubsub struct {
+	mu     sync.RWMutex
+	nextID int
+	local  map[string]map[int]chan TopicMessage // by topic, then subscription
+	peers  map[string]map[string]bool           // by node ID, then topic
+}
+
+func newPubSub() *pubsub {
+	return &pubsub{
+		local: make(map[string]map[int]chan TopicMessage),
+		peers: make(map[string]map[string]bool),
+	}
+}
+
+// subscribe adds a local subscription, reporting whether it is the topic's
+// first
+func (p *pubsub) subscribe(topic string) (int, chan TopicMessage, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	first := len(p.local[topic]) == 0
+	if first {
+		p.local[topic] = make(map[int]chan TopicMessage)
+	}
+	id := p.nextID
+	p.nextID++
+	ch := make(chan TopicMessage, topicBufferSize)
+	p.local[topic][id] = ch
+	return id, ch, first
+}
+
+// unsubscribe drops a local subscription, reporting whether it was the
+// topic's last
+func (p *pubsub) unsubscribe(topic string, id int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	close(p.local[topic][id])
+	delete(p.local[topic], id)
+	if len(p.local[topic]) > 0 {
+		return false
+	}
+	delete(p.local, topic)
+	return true
+}
+
+// deliver hands a message to the local subscribers of its topic, dropping
+// it for those that fall too far behind
+func (p *pubsub) deliver(m TopicMessage) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, ch := range p.local[m.Topic] {
+		select {
+		case ch <- m:
+		default:
+		}
+	}
+}
+
+func (p *pubsub) topics() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	topics := make([]string, 0, len(p.local))
+	for topic := range p.local {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// setPeer records topics a peer subscribed to, or no longer does. It fails
+// once the peer's topics would exceed maxPeerTopics, keeping those within.
+func (p *pubsub) setPeer(id string, topics []string, subscribed bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.peers[id] == nil {
+		p.peers[id] = make(map[string]bool)
+	}
+	var err error
+	for _, topic := range topics {
+		switch {
+		case !subscribed:
+			delete(p.peers[id], topic)
+		case p.peers[id][topic]:
+		case len(p.peers[id]) >= maxPeerTopics:
+			err = fmt.Errorf("%w: peer subscribed to more than %d topics", protocol.ErrInvalidPayload, maxPeerTopics)
+		default:
+			p.peers[id][topic] = true
+		}
+	}
+	if len(p.peers[id]) == 0 {
+		delete(p.peers, id)
+	}
+	return err
+}
+
+func (p *pubsub) forgetPeer(id string) {
+	p.mu.Lock()
+	delete(p.peers, id)
+	p.mu.Unlock()
+}
+
+func (p *pubsub) peerSubscribed(id, topic string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.peers[id][topic]
+}
+
+// SubscribeTopic returns a channel receiving the messages published to a
+// topic, by this node or any reached through peers subscribed to it, and a
+// function that cancels the subscription. Peers are told of the first
+// subscription to a topic and of the last one cancelled. Messages are
+// dropped for subscribers that fall too far behind.
+func (n *Node) SubscribeTopic(topic string) (<-chan TopicMessage, func(), error) {
+	if err := checkTopic(topic); err != nil {
+		return nil, nil, err
+	}
+	id, ch, first := n.pubsub.subscribe(topic)
+	if first {
+		n.sendSubscription(protocol.MessageTypeSubscribe, []string{topic})
+	}
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() {
+			if n.pubsub.unsubscribe(topic, id) {
+				n.sendSubscription(protocol.MessageTypeUnsubscribe, []string{topic})
+			}
+		})
+	}
+	return ch, cancel, nil
+}
+
+// Topics returns the topics subscribed to on this node
+func (n *Node) Topics() []string {
+	return n.pubsub.topics()
+}
+
+// PublishTopic sends data to the subscribers of a topic: those on this
+// node and on peers subscribed to it, which pass it on to their own
+// subscribed peers as far as announcements travel. Publications are meant
+// for small application events, at most protocol.MaxPublication bytes, not
+// content.
+func (n *Node) PublishTopic(topic string, data []byte) error {
+	if err := checkTopic(topic); err != nil {
+		return err
+	}
+	if len(data) > protocol.MaxPublication {
+		return fmt.Errorf("%d bytes exceed the %d a publication may hold", len(data), protocol.MaxPublication)
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypePublish, n.ID, protocol.Publication{Topic: topic, Origin: n.ID, Data: data})
+	if err != nil {
+		return err
+	}
+	id, err := protocol.NewMessageID()
+	if err != nil {
+		return err
+	}
+	msg.ID, msg.TTL = id, max(n.gossipConfig.TTL, 1)
+	n.gossip.seen.add(id)
+	n.sign(msg)
+
+	n.pubsub.deliver(TopicMessage{Topic: topic, Origin: n.ID, Data: data})
+	n.sendPublication(topic, msg, nil)
+	return nil
+}
+
+func checkTopic(topic string) error {
+	if topic == "" {
+		return errors.New("topic must not be empty")
+	}
+	if len(topic) > protocol.MaxTopicLength {
+		return fmt.Errorf("topic of %d bytes exceeds the maximum of %d", len(topic), protocol.MaxTopicLength)
+	}
+	return nil
+}
+
+// sendSubscription tells every connected peer taking subscriptions of
+// topics subscribed to or no longer
+func (n *Node) sendSubscription(msgType protocol.MessageType, topics []string) {
+	msg, err := protocol.NewMessage(msgType, n.ID, protocol.Subscription{Topics: topics})
+	if err != nil {
+		return
+	}
+	for _, id := range n.connectedPeers() {
+		peer, ok := n.peerConn(id)
+		if !ok || !n.peerSupports(id, protocol.FeaturePubSub) {
+			continue
+		}
+		if err := peer.Send(msg); err != nil {
+			n.debugf("Failed to send %s to %s: %v\n", msgType, id, err)
+		}
+	}
+}
+
+// sendSubscriptions tells a peer that just connected of every topic
+// subscribed to here
+func (n *Node) sendSubscriptions(peer *network.Peer, id string) error {
+	topics := n.pubsub.topics()
+	if len(topics) == 0 || !n.peerSupports(id, protocol.FeaturePubSub) {
+		return nil
+	}
+	for start := 0; start < len(topics); start += protocol.MaxTopics {
+		end := min(start+protocol.MaxTopics, len(topics))
+		msg, err := protocol.NewMessage(protocol.MessageTypeSubscribe, n.ID, protocol.Subscription{Topics: topics[start:end]})
+		if err != nil {
+			return err
+		}
+		if err := peer.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendPublication sends a publication to every connected peer subscribed
+// to its topic but from
+func (n *Node) sendPublication(topic string, msg *protocol.Message, from *network.Peer) {
+	for _, id := range n.connectedPeers() {
+		peer, ok := n.peerConn(id)
+		if !ok || peer == from || !n.pubsub.peerSubscribed(id, topic) {
+			continue
+		}
+		if err := peer.Send(msg); err != nil {
+			n.debugf("Failed to send publication to %s: %v\n", id, err)
+		}
+	}
+}
+
+func (n *Node) handleSubscription(peer *network.Peer, msg *protocol.Message) error {
+	var subscription protocol.Subscription
+	if err := msg.ParsePayload(&subscription); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", msg.Type, err)
+	}
+	id := n.nodeID(peer)
+	if id == "" {
+		return nil
+	}
+	// Too many topics count against the peer's score, like any invalid
+	// message
+	return n.pubsub.setPeer(id, subscription.Topics, msg.Type == protocol.MessageTypeSubscribe)
+}
+
+// handlePublish delivers a publication to the local subscribers of its
+// topic and passes it on to the subscribed peers, until its TTL runs out
+func (n *Node) handlePublish(peer *network.Peer, msg *protocol.Message) error {
+	var publication protocol.Publication
+	if err := msg.ParsePayload(&publication); err != nil {
+		return fmt.Errorf("failed to parse publication: %w", err)
+	}
+	n.pubsub.deliver(TopicMessage{Topic: publication.Topic, Origin: publication.Origin, Data: publication.Data})
+
+	if msg.ID == "" || min(msg.TTL, n.gossipConfig.TTL) <= 1 {
+		return nil
+	}
+	forwarded := msg.Forwarded(n.ID)
+	forwarded.TTL = min(forwarded.TTL, n.gossipConfig.TTL-1)
+	n.sendPublication(publication.Topic, forwarded, peer)
+	return nil
+}
@@ -0,0 +1,159 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestPubSub_Subscriptions(t *testing.T) {
+	p := newPubSub()
+	first, ch, isFirst := p.subscribe("releases")
+	if !isFirst {
+		t.Error("subscribe() = not first for a new topic")
+	}
+	second, _, isFirst := p.subscribe("releases")
+	if isFirst {
+		t.Error("subscribe() = first for a topic already subscribed to")
+	}
+
+	p.deliver(TopicMessage{Topic: "releases", Data: []byte("v2")})
+	p.deliver(TopicMessage{Topic: "other", Data: []byte("ignored")})
+	if m := <-ch; string(m.Data) != "v2" {
+		t.Errorf("delivered %q, want v2", m.Data)
+	}
+	select {
+	case m := <-ch:
+		t.Errorf("delivered %+v for a topic not subscribed to", m)
+	default:
+	}
+
+	if p.unsubscribe("releases", first) {
+		t.Error("unsubscribe() = last with a subscription left")
+	}
+	if !p.unsubscribe("releases", second) {
+		t.Error("unsubscribe() = not last for the topic's last subscription")
+	}
+	if _, ok := <-ch; ok {
+		t.Error("Channel not closed on unsubscribe")
+	}
+
+	p.setPeer("peer1", []string{"a", "b"}, true)
+	p.setPeer("peer1", []string{"a"}, false)
+	if p.peerSubscribed("peer1", "a") || !p.peerSubscribed("peer1", "b") {
+		t.Error("Peer subscriptions don't follow subscribe and unsubscribe")
+	}
+	p.forgetPeer("peer1")
+	if p.peerSubscribed("peer1", "b") {
+		t.Error("Peer subscriptions kept after forgetPeer()")
+	}
+}
+
+func TestPubSub_PeerTopicLimit(t *testing.T) {
+	p := newPubSub()
+	topics := make([]string, maxPeerTopics)
+	for i := range topics {
+		topics[i] = fmt.Sprintf("topic-%d", i)
+	}
+	if err := p.setPeer("peer1", topics, true); err != nil {
+		t.Fatalf("setPeer() within the limit error = %v", err)
+	}
+	// Subscribing again to a known topic is no new topic
+	if err := p.setPeer("peer1", topics[:1], true); err != nil {
+		t.Errorf("setPeer() for a known topic error = %v", err)
+	}
+
+	err := p.setPeer("peer1", []string{"one-too-many"}, true)
+	if !errors.Is(err, protocol.ErrInvalidPayload) {
+		t.Errorf("setPeer() over the limit = %v, want %v", err, protocol.ErrInvalidPayload)
+	}
+	if p.peerSubscribed("peer1", "one-too-many") {
+		t.Error("Topic over the limit recorded")
+	}
+
+	// Unsubscribing makes room again
+	if err := p.setPeer("peer1", topics[:1], false); err != nil {
+		t.Errorf("setPeer() unsubscribing error = %v", err)
+	}
+	if err := p.setPeer("peer1", []string{"one-too-many"}, true); err != nil {
+		t.Errorf("setPeer() after unsubscribing error = %v", err)
+	}
+}
+
+func TestNode_PublishReachesSubscribers(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	// A single peer each, so discovery doesn't connect the ends of the chain
+	discovery := WithDiscovery(DiscoveryConfig{DialInterval: time.Millisecond, MaxPeers: 1, QueueSize: 8})
+	newTestNode := func(id string, first bool, opts ...Option) *Node {
+		opts = append(opts, WithFirstNode(first))
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"), opts...)
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		n.transport.Start()
+		return n
+	}
+	middle := newTestNode("middle", true)
+	defer middle.Stop()
+	near := newTestNode("near", false, discovery)
+	defer near.Stop()
+	far := newTestNode("far", false, discovery)
+	defer far.Stop()
+
+	// The far node subscribes before connecting and the others after
+	farMessages, cancelFar, err := far.SubscribeTopic("releases")
+	if err != nil {
+		t.Fatalf("SubscribeTopic() error = %v", err)
+	}
+	for _, n := range []*Node{near, far} {
+		if err := n.Connect(context.Background(), middle.Address()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		if err := n.waitForKey(5 * time.Second); err != nil {
+			t.Fatalf("Failed to receive network key: %v", err)
+		}
+	}
+	middleMessages, cancelMiddle, err := middle.SubscribeTopic("releases")
+	if err != nil {
+		t.Fatalf("SubscribeTopic() error = %v", err)
+	}
+	defer cancelMiddle()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !near.pubsub.peerSubscribed("middle", "releases") || !middle.pubsub.peerSubscribed("far", "releases") {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscriptions never reached the peers")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := near.PublishTopic("releases", []byte("v1.2 is out")); err != nil {
+		t.Fatalf("PublishTopic() error = %v", err)
+	}
+	for name, messages := range map[string]<-chan TopicMessage{"middle": middleMessages, "far": farMessages} {
+		select {
+		case m := <-messages:
+			if m.Topic != "releases" || m.Origin != "near" || string(m.Data) != "v1.2 is out" {
+				t.Errorf("%s received %+v", name, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Publication never reached %s", name)
+		}
+	}
+
+	cancelFar()
+	deadline = time.Now().Add(5 * time.Second)
+	for middle.pubsub.peerSubscribed("far", "releases") {
+		if time.Now().After(deadline) {
+			t.Fatal("Unsubscribe never reached the middle node")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,183 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+var (
+	// ErrNoExternalAddress is returned when a punch is requested before the
+	// node has learned its external address from a STUN server
+	ErrNoExternalAddress = errors.New("external address is unknown")
+	// ErrNoRelay is returned when no connected peer could pass a punch on
+	ErrNoRelay = errors.New("no connected peer to relay the punch")
+)
+
+// WithHolePunching lets the node connect directly to peers that, like
+// itself, are behind NAT. Its external address is looked up from
+// stunServer at start; see Punch.
+func WithHolePunching(stunServer string) Option {
+	return func(n *Node) {
+		n.stunServer = stunServer
+		n.transportOpts = append(n.transportOpts, network.WithHolePunching(true))
+	}
+}
+
+// discoverExternalAddress asks the STUN server, from the listen port that
+// punches leave from, for the address and port the router maps it to.
+// Peers are told to dial that.
+func (n *Node) discoverExternalAddress() error {
+	addr, err := n.transport.DiscoverExternalAddress(n.stunServer, network.DefaultSTUNTimeout)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.externalAddr = addr.String()
+	n.mu.Unlock()
+	n.debugf("External address is %s\n", n.ExternalAddress())
+	return nil
+}
+
+// ExternalAddress returns the address peers behind NAT are told to punch
+// through to, or "" until it is known
+func (n *Node) ExternalAddress() string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.externalAddr
+}
+
+// Punch asks the peer nodeID, through every connected peer, to open a
+// direct connection with this node. Peers connected to both pass the
+// request on; nodeID answers with its own external address and both sides
+// dial each other at once. Punch returns once the request is sent; the
+// connection, if the routers in between allow it, shows up as a connected
+// peer.
+func (n *Node) Punch(nodeID string) error {
+	if _, ok := n.peerConn(nodeID); ok {
+		return fmt.Errorf("already connected to %s", nodeID)
+	}
+	address := n.ExternalAddress()
+	if address == "" {
+		return ErrNoExternalAddress
+	}
+
+	msg, err := protocol.NewMessage(protocol.MessageTypePunch, n.ID, protocol.PunchPayload{
+		From:    n.ID,
+		To:      nodeID,
+		Address: address,
+	})
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.punches[nodeID] = true
+	n.mu.Unlock()
+
+	sent := 0
+	for _, id := range n.connectedPeers() {
+		if relay, ok := n.peerConn(id); ok && relay.Send(msg) == nil {
+			sent++
+		}
+	}
+	if sent == 0 {
+		n.mu.Lock()
+		delete(n.punches, nodeID)
+		n.mu.Unlock()
+		return ErrNoRelay
+	}
+	return nil
+}
+
+// handlePunch passes on punch requests between two connected peers, and
+// starts punching when this node is the one asked or the one answered
+func (n *Node) handlePunch(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.PunchPayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse punch: %w", err)
+	}
+
+	if payload.To != n.ID {
+		// Only relay straight from the source, so punches can't loop
+		if msg.SenderID != payload.From {
+			return nil
+		}
+		target, ok := n.peerConn(payload.To)
+		if !ok {
+			return nil
+		}
+		relayed, err := protocol.NewMessage(protocol.MessageTypePunch, n.ID, payload)
+		if err != nil {
+			return err
+		}
+		return target.Send(relayed)
+	}
+
+	if err := n.checkPeer(payload.From, n.knownKey(payload.From), payload.Address); err != nil {
+		return err
+	}
+	if _, ok := n.peerConn(payload.From); ok {
+		return nil
+	}
+
+	n.mu.Lock()
+	pending := n.punches[payload.From]
+	if !payload.Reply {
+		// Several relays may deliver the same request
+		n.punches[payload.From] = true
+	}
+	n.mu.Unlock()
+
+	if payload.Reply {
+		// Only dial addresses we asked for
+		if !pending {
+			return nil
+		}
+		go n.punch(payload.From, payload.Address, true)
+		return nil
+	}
+	if pending {
+		return nil
+	}
+
+	address := n.ExternalAddress()
+	if address == "" {
+		n.mu.Lock()
+		delete(n.punches, payload.From)
+		n.mu.Unlock()
+		return ErrNoExternalAddress
+	}
+	reply, err := protocol.NewMessage(protocol.MessageTypePunch, n.ID, protocol.PunchPayload{
+		From:    n.ID,
+		To:      payload.From,
+		Address: address,
+		Reply:   true,
+	})
+	if err != nil {
+		return err
+	}
+	if err := peer.Send(reply); err != nil {
+		return fmt.Errorf("failed to answer punch: %w", err)
+	}
+	go n.punch(payload.From, payload.Address, false)
+	return nil
+}
+
+// punch dials the peer nodeID at address until a connection opens. The
+// node that asked for the punch sends the handshake.
+func (n *Node) punch(nodeID, address string, initiator bool) {
+	defer func() {
+		n.mu.Lock()
+		delete(n.punches, nodeID)
+		n.mu.Unlock()
+	}()
+
+	n.debugf("Punching through to %s at %s\n", nodeID, address)
+	if err := n.transport.Punch(address, initiator, network.DefaultPunchTimeout); err != nil {
+		fmt.Printf("Failed to punch through to %s: %v\n", nodeID, err)
+	}
+}
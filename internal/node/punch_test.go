@@ -0,0 +1,82 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNode_Punch(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	relay, err := NewNode("relay", freeAddr(t), filepath.Join(baseDir, "relay", "store"), filepath.Join(baseDir, "relay", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer relay.Stop()
+	relay.transport.Start()
+
+	// Two nodes that can only reach each other once both dial
+	var natted []*Node
+	for _, id := range []string{"alice", "bob"} {
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"), WithFirstNode(false), WithHolePunching("stun.invalid:3478"))
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		defer n.Stop()
+		n.transport.Start()
+		// Stands in for the STUN lookup, which Start would run
+		n.externalAddr = n.Address()
+
+		if err := n.Connect(context.Background(), relay.Address()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		if err := n.waitForKey(5 * time.Second); err != nil {
+			t.Fatalf("Failed to receive network key: %v", err)
+		}
+		natted = append(natted, n)
+	}
+	alice, bob := natted[0], natted[1]
+
+	if err := alice.Punch("bob"); err != nil {
+		t.Fatalf("Punch() error = %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, aliceSeesBob := alice.peerConn("bob")
+		_, bobSeesAlice := bob.peerConn("alice")
+		if aliceSeesBob && bobSeesAlice {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the punched connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := alice.Punch("bob"); err == nil {
+		t.Error("Punch() to a connected peer succeeded, want error")
+	}
+}
+
+func TestNode_PunchNeedsExternalAddress(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	n, err := NewNode("node", freeAddr(t), filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true), WithHolePunching("stun.invalid:3478"))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer n.Stop()
+
+	if err := n.Punch("other"); !errors.Is(err, ErrNoExternalAddress) {
+		t.Errorf("Punch() error = %v, want %v", err, ErrNoExternalAddress)
+	}
+	n.externalAddr = n.Address()
+	if err := n.Punch("other"); !errors.Is(err, ErrNoRelay) {
+		t.Errorf("Punch() without peers error = %v, want %v", err, ErrNoRelay)
+	}
+}
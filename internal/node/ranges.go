@@ -0,0 +1,175 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// MaxRangeLength bounds the bytes FetchRange returns, since a range is
+// held in memory
+const MaxRangeLength = 64 << 20
+
+// rangeTracker gathers the chunks answering range requests for the
+// FetchRange calls waiting on them
+type rangeTracker struct {
+	mu      sync.Mutex
+	pending map[string]*rangeWait // by request ID
+}
+
+type rangeWait struct {
+	limit    int64 // most bytes the range may hold
+	data     []byte
+	chunks   map[int]bool
+	received int64
+	err      error
+	finished bool
+	done     chan struct{}
+}
+
+func newRangeTracker() *rangeTracker {
+	return &rangeTracker{pending: make(map[string]*rangeWait)}
+}
+
+func (r *rangeTracker) add(id string, limit int64) *rangeWait {
+	w := &rangeWait{limit: limit, chunks: make(map[int]bool), done: make(chan struct{})}
+	r.mu.Lock()
+	r.pending[id] = w
+	r.mu.Unlock()
+	return w
+}
+
+func (r *rangeTracker) remove(id string) {
+	r.mu.Lock()
+	delete(r.pending, id)
+	r.mu.Unlock()
+}
+
+// receive writes a chunk into the range it answers. The range is done once
+// every byte of it arrived, whatever order the chunks came in.
+func (r *rangeTracker) receive(transfer *protocol.DataTransfer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	w, ok := r.pending[transfer.Range]
+	if !ok || w.finished {
+		return
+	}
+	if w.data == nil {
+		if transfer.TotalSize > w.limit {
+			w.finish(fmt.Errorf("range of %d bytes is larger than the %d asked for", transfer.TotalSize, w.limit))
+			return
+		}
+		w.data = make([]byte, transfer.TotalSize)
+	}
+	offset := transfer.Offset()
+	if transfer.TotalSize != int64(len(w.data)) || offset+int64(len(transfer.Data)) > int64(len(w.data)) {
+		w.finish(fmt.Errorf("chunk %d doesn't fit the range", transfer.ChunkIndex))
+		return
+	}
+	if !w.chunks[transfer.ChunkIndex] {
+		copy(w.data[offset:], transfer.Data)
+		w.chunks[transfer.ChunkIndex] = true
+		w.received += int64(len(transfer.Data))
+	}
+	if w.received == int64(len(w.data)) {
+		w.finish(nil)
+	}
+}
+
+func (w *rangeWait) finish(err error) {
+	w.err = err
+	w.finished = true
+	close(w.done)
+}
+
+// serveRange sends part of an object, as chunks tagged with the ID of the
+// request asking for it
+func (n *Node) serveRange(peer *network.Peer, msg *protocol.Message, request protocol.DataRequest, file io.Reader, size int64) error {
+	if msg.RequestID == "" {
+		return fmt.Errorf("refusing range of %s without a request ID", request.ContentHash)
+	}
+	r := *request.Range
+	if r.Offset > size {
+		n.refuseRequest(peer, msg, protocol.ErrorCodeRange, fmt.Sprintf("offset %d is past the %d bytes of %s", r.Offset, size, request.ContentHash))
+		return fmt.Errorf("refusing range of %s: offset %d past %d bytes", request.ContentHash, r.Offset, size)
+	}
+	length := size - r.Offset
+	if r.Length > 0 {
+		length = min(length, r.Length)
+	}
+	if length == 0 {
+		return peer.SendTransfer(n.ID, &protocol.DataTransfer{ContentHash: request.ContentHash, Range: request.RequestID, FinalChunk: true})
+	}
+	if err := skipBytes(file, r.Offset); err != nil {
+		return fmt.Errorf("failed to skip to offset %d: %w", r.Offset, err)
+	}
+	return n.serveObject(peer, n.nodeID(peer), request, io.LimitReader(file, length), length)
+}
+
+// FetchRange returns length bytes of an object as stored, from offset, or
+// the rest of it if length is 0, fetched from a connected peer holding it.
+// Objects are stored encrypted unless their namespace says otherwise, so
+// the bytes are those of the stored object, IV first, not of the file. At
+// most MaxRangeLength bytes are fetched at once.
+func (n *Node) FetchRange(ctx context.Context, peerID, hash string, offset, length int64) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, errors.New("offset and length must not be negative")
+	}
+	if length > MaxRangeLength {
+		return nil, fmt.Errorf("length %d exceeds the maximum of %d bytes", length, MaxRangeLength)
+	}
+	peer, ok := n.peerConn(peerID)
+	if !ok {
+		return nil, fmt.Errorf("peer %s is not connected", peerID)
+	}
+	if !n.peerSupports(peerID, protocol.FeatureRange) {
+		return nil, fmt.Errorf("peer %s does not support range requests", peerID)
+	}
+
+	requestID, err := protocol.NewMessageID()
+	if err != nil {
+		return nil, err
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeDataRequest, n.ID, protocol.DataRequest{
+		ContentHash: hash,
+		Range:       &protocol.ByteRange{Offset: offset, Length: length},
+		Priority:    protocol.PriorityInteractive,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create range request: %w", err)
+	}
+	msg.RequestID = requestID
+	msg.TraceID = n.traceID(nil)
+
+	limit := length
+	if limit == 0 {
+		limit = MaxRangeLength
+	}
+	wait := n.ranges.add(requestID, limit)
+	defer n.ranges.remove(requestID)
+	answer := n.requests.add(requestID)
+	defer n.requests.remove(requestID)
+	if err := peer.Send(msg); err != nil {
+		return nil, fmt.Errorf("failed to send range request: %w", err)
+	}
+
+	select {
+	case <-wait.done:
+		if wait.err != nil {
+			return nil, fmt.Errorf("failed to fetch range of %s: %w", hash, wait.err)
+		}
+		return wait.data, nil
+	case err := <-answer:
+		return nil, fmt.Errorf("failed to fetch range of %s: %w", hash, err)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-n.done:
+		return nil, fmt.Errorf("node stopped")
+	}
+}
@@ -0,0 +1,88 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+func TestNode_FetchRange(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	sender, err := NewNode("sender", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer sender.Stop()
+	sender.transport.Start()
+
+	receiver, err := NewNode("receiver", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithMaxChunkSize(protocol.MinChunkSize))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer receiver.Stop()
+	receiver.transport.Start()
+	if err := receiver.Connect(context.Background(), sender.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := receiver.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	data := make([]byte, 3*protocol.MinChunkSize+100)
+	rand.Read(data)
+	hash, err := crypto.ContentHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to hash object: %v", err)
+	}
+	if err := sender.store.Store(hash, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to store object: %v", err)
+	}
+
+	tests := []struct {
+		name           string
+		offset, length int64
+		want           []byte
+	}{
+		{"across chunks", 1000, 2 * protocol.MinChunkSize, data[1000 : 1000+2*protocol.MinChunkSize]},
+		{"whole chunks", protocol.MinChunkSize, protocol.MinChunkSize, data[protocol.MinChunkSize : 2*protocol.MinChunkSize]},
+		{"to the end", int64(len(data)) - 50, 0, data[len(data)-50:]},
+		{"past the end", int64(len(data)) - 50, 1000, data[len(data)-50:]},
+		{"empty", int64(len(data)), 0, []byte{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			got, err := receiver.FetchRange(ctx, "sender", hash, tt.offset, tt.length)
+			if err != nil {
+				t.Fatalf("FetchRange() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("FetchRange() returned %d bytes, want %d matching bytes", len(got), len(tt.want))
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := receiver.FetchRange(ctx, "sender", hash, int64(len(data))+1, 10); err == nil {
+		t.Error("FetchRange() past the end of the object succeeded")
+	}
+	if _, err := receiver.FetchRange(ctx, "sender", strings.Repeat("e", 40), 0, 10); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FetchRange() of a missing object error = %v, want %v", err, ErrNotFound)
+	}
+	if receiver.store.Exists(hash) {
+		t.Error("Range requests stored the object")
+	}
+}
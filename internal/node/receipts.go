@@ -0,0 +1,209 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// Receipt is a peer's signed statement that it stored and verified an
+// object. It can be checked by anyone holding the receipt, without trusting
+// the node that collected it.
+type Receipt struct {
+	Hash      string    `json:"hash"`
+	Size      int64     `json:"size"`
+	Stored    time.Time `json:"stored"`
+	NodeID    string    `json:"node_id"`
+	PublicKey []byte    `json:"public_key"`
+	Signature []byte    `json:"signature"`
+}
+
+func (r Receipt) payload() protocol.ReceiptPayload {
+	return protocol.ReceiptPayload{
+		ContentHash: r.Hash,
+		Size:        r.Size,
+		Timestamp:   r.Stored.Unix(),
+		NodeID:      r.NodeID,
+		PublicKey:   r.PublicKey,
+		Signature:   r.Signature,
+	}
+}
+
+// Verify reports whether the receipt is signed by the key it names
+func (r Receipt) Verify() bool {
+	p := r.payload()
+	return crypto.Verify(p.PublicKey, p.SignedData(), p.Signature)
+}
+
+// Fingerprint returns the fingerprint of the signing node's identity key
+func (r Receipt) Fingerprint() string {
+	return crypto.Fingerprint(r.PublicKey)
+}
+
+// receiptStore keeps the latest receipt from each holder of each object and
+// persists them as JSON
+type receiptStore struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]map[string]Receipt // hash -> node ID -> receipt
+}
+
+// loadReceipts reads the receipts at path, starting empty if it does not exist
+func loadReceipts(path string) (*receiptStore, error) {
+	s := &receiptStore{
+		path:    path,
+		entries: make(map[string]map[string]Receipt),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read receipts: %w", err)
+	}
+
+	var receipts []Receipt
+	if err := json.Unmarshal(data, &receipts); err != nil {
+		return nil, fmt.Errorf("failed to parse receipts: %w", err)
+	}
+	for _, r := range receipts {
+		s.setLocked(r)
+	}
+	return s, nil
+}
+
+func (s *receiptStore) setLocked(r Receipt) {
+	byNode, ok := s.entries[r.Hash]
+	if !ok {
+		byNode = make(map[string]Receipt)
+		s.entries[r.Hash] = byNode
+	}
+	byNode[r.NodeID] = r
+}
+
+// add records a receipt, replacing an older one from the same holder
+func (s *receiptStore) add(r Receipt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.entries[r.Hash][r.NodeID]; ok && old.Stored.After(r.Stored) {
+		return nil
+	}
+	s.setLocked(r)
+
+	data, err := json.MarshalIndent(s.listLocked(""), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode receipts: %w", err)
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// list returns the receipts for hash, or every receipt if hash is empty,
+// sorted by hash and then holder
+func (s *receiptStore) list(hash string) []Receipt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked(hash)
+}
+
+func (s *receiptStore) listLocked(hash string) []Receipt {
+	var receipts []Receipt
+	for h, byNode := range s.entries {
+		if hash != "" && h != hash {
+			continue
+		}
+		for _, r := range byNode {
+			receipts = append(receipts, r)
+		}
+	}
+	sort.Slice(receipts, func(i, j int) bool {
+		if receipts[i].Hash != receipts[j].Hash {
+			return receipts[i].Hash < receipts[j].Hash
+		}
+		return receipts[i].NodeID < receipts[j].NodeID
+	})
+	return receipts
+}
+
+// Receipts returns the storage receipts collected from peers for an object,
+// or for every object if hash is empty
+func (n *Node) Receipts(hash string) []Receipt {
+	return n.receipts.list(hash)
+}
+
+// sendReceipt signs a receipt for a stored object and sends it to the peer
+// that supplied it
+func (n *Node) sendReceipt(peer *network.Peer, hash string) {
+	size, err := n.store.Size(hash)
+	if err != nil {
+		return
+	}
+	payload := protocol.ReceiptPayload{
+		ContentHash: hash,
+		Size:        size,
+		Timestamp:   time.Now().Unix(),
+		NodeID:      n.ID,
+		PublicKey:   n.identity.Public,
+	}
+	payload.Signature = n.identity.Sign(payload.SignedData())
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeReceipt, n.ID, payload)
+	if err != nil {
+		return
+	}
+	if err := peer.Send(msg); err != nil {
+		fmt.Printf("Failed to send receipt for %s: %v\n", hash, err)
+	}
+}
+
+// handleReceipt stores a receipt for an object this node holds, once it is
+// verified against the identity key the peer presented in its handshake
+func (n *Node) handleReceipt(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.ReceiptPayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse receipt: %w", err)
+	}
+	if !n.store.Exists(payload.ContentHash) {
+		return nil
+	}
+
+	// Only the node on the connection can vouch for itself
+	id := n.nodeID(peer)
+	n.mu.RLock()
+	info := n.peers[peer.ID()]
+	n.mu.RUnlock()
+	if id == "" || payload.NodeID != id || !bytes.Equal(info.PublicKey, payload.PublicKey) {
+		return fmt.Errorf("receipt for %s from %s does not match the peer's identity", payload.ContentHash, peer.ID())
+	}
+
+	receipt := Receipt{
+		Hash:      payload.ContentHash,
+		Size:      payload.Size,
+		Stored:    time.Unix(payload.Timestamp, 0).UTC(),
+		NodeID:    payload.NodeID,
+		PublicKey: payload.PublicKey,
+		Signature: payload.Signature,
+	}
+	if !receipt.Verify() {
+		return fmt.Errorf("invalid receipt signature for %s from %s", payload.ContentHash, msg.SenderID)
+	}
+	if size, err := n.store.Size(payload.ContentHash); err == nil && size != payload.Size {
+		return fmt.Errorf("receipt for %s from %s names size %d, want %d", payload.ContentHash, msg.SenderID, payload.Size, size)
+	}
+	if err := n.receipts.add(receipt); err != nil {
+		return fmt.Errorf("failed to save receipt: %w", err)
+	}
+	// The peer's signed word counts it as a holder, also where no
+	// inventories are exchanged
+	n.replicas.add(id, []string{payload.ContentHash})
+	return nil
+}
@@ -0,0 +1,147 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+)
+
+func signedReceipt(t *testing.T, id *crypto.Identity) Receipt {
+	t.Helper()
+	r := Receipt{
+		Hash:      "abc123",
+		Size:      42,
+		Stored:    time.Unix(1700000000, 0).UTC(),
+		NodeID:    "holder",
+		PublicKey: id.Public,
+	}
+	p := r.payload()
+	r.Signature = id.Sign(p.SignedData())
+	return r
+}
+
+func TestReceipt_Verify(t *testing.T) {
+	id, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	r := signedReceipt(t, id)
+	if !r.Verify() {
+		t.Fatal("Verify() = false for a valid receipt")
+	}
+
+	tampered := r
+	tampered.Size = 43
+	if tampered.Verify() {
+		t.Error("Verify() = true after changing the size")
+	}
+
+	other, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	tampered = r
+	tampered.PublicKey = other.Public
+	if tampered.Verify() {
+		t.Error("Verify() = true with another node's key")
+	}
+}
+
+func TestReceiptStore_Persists(t *testing.T) {
+	dir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	id, err := crypto.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	path := filepath.Join(dir, "receipts.json")
+	store, err := loadReceipts(path)
+	if err != nil {
+		t.Fatalf("Failed to load receipts: %v", err)
+	}
+
+	newer := signedReceipt(t, id)
+	if err := store.add(newer); err != nil {
+		t.Fatalf("Failed to add receipt: %v", err)
+	}
+	older := newer
+	older.Stored = newer.Stored.Add(-time.Hour)
+	if err := store.add(older); err != nil {
+		t.Fatalf("Failed to add receipt: %v", err)
+	}
+
+	reloaded, err := loadReceipts(path)
+	if err != nil {
+		t.Fatalf("Failed to reload receipts: %v", err)
+	}
+	receipts := reloaded.list("abc123")
+	if len(receipts) != 1 || !receipts[0].Stored.Equal(newer.Stored) {
+		t.Fatalf("list() = %+v, want only the newer receipt", receipts)
+	}
+	if !receipts[0].Verify() {
+		t.Error("Reloaded receipt no longer verifies")
+	}
+	if got := reloaded.list("other"); len(got) != 0 {
+		t.Errorf("list(other) = %+v, want none", got)
+	}
+}
+
+func TestNode_CollectsReceiptFromReplica(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	cfg := ReplicationConfig{Target: 2, Interval: time.Hour}
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "keep a receipt for me")
+	hash, err := first.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	if _, err := first.Repair([]string{hash}, nil); err != nil {
+		t.Fatalf("Failed to repair: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(first.Receipts(hash)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("No receipt received for %s", hash)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	receipt := first.Receipts(hash)[0]
+	if receipt.NodeID != "second" || receipt.Fingerprint() != second.Identity() {
+		t.Errorf("receipt from %s (%s), want second (%s)", receipt.NodeID, receipt.Fingerprint(), second.Identity())
+	}
+	size, _ := first.store.Size(hash)
+	if receipt.Size != size || !receipt.Verify() {
+		t.Errorf("receipt = %+v, want a valid receipt for %d bytes", receipt, size)
+	}
+}
@@ -0,0 +1,281 @@
+package node
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// relayIdleTimeout is how long a relay fetch that has started may go without
+// a chunk from its source before the requesters waiting on it are failed
+const relayIdleTimeout = DefaultFetchTimeout
+
+// relayFetch is an object being fetched from a holder on behalf of peers
+// that are not connected to it. Chunks are forwarded to the requesters as
+// they arrive, so the object is never stored unless the relay cache is on.
+type relayFetch struct {
+	source  *network.Peer
+	started bool
+	active  time.Time      // when the last chunk arrived
+	waiters []*relayWaiter // receive chunks as they arrive
+	late    []*relayWaiter // asked after the first chunk; served once complete
+}
+
+// relayWaiter is a peer waiting for a relayed object
+type relayWaiter struct {
+	peer        *network.Peer
+	requesterID string
+	request     protocol.DataRequest
+	key         string
+	progress    *transferProgress
+}
+
+// relayRequest fetches an object this node lacks from a connected holder and
+// forwards it to the requester. It reports false when the request can't be
+// relayed: it was already relayed once, or no other connected peer holds it.
+func (n *Node) relayRequest(peer *network.Peer, requesterID string, request protocol.DataRequest) (bool, error) {
+	if request.Relayed {
+		return false, nil
+	}
+
+	var source *network.Peer
+	for _, id := range n.replicas.holders()[request.ContentHash] {
+		if id == requesterID {
+			continue
+		}
+		if conn, ok := n.peerConn(id); ok && conn != peer {
+			source = conn
+			break
+		}
+	}
+	if source == nil {
+		return false, nil
+	}
+
+	waiter := &relayWaiter{
+		peer:        peer,
+		requesterID: requesterID,
+		request:     request,
+		key:         fmt.Sprintf("upload-%s-%s", peer.ID(), request.ContentHash),
+	}
+
+	n.mu.Lock()
+	if fetch, ok := n.relaying[request.ContentHash]; ok {
+		// Another requester is already waiting on the same object
+		if fetch.started {
+			fetch.late = append(fetch.late, waiter)
+		} else {
+			fetch.waiters = append(fetch.waiters, waiter)
+		}
+		n.mu.Unlock()
+		n.popularity.record(request.ContentHash, true)
+		return true, nil
+	}
+	fetch := &relayFetch{source: source, waiters: []*relayWaiter{waiter}}
+	n.relaying[request.ContentHash] = fetch
+	n.mu.Unlock()
+	n.popularity.record(request.ContentHash, true)
+
+	err := n.sendDataRequest(source, protocol.DataRequest{
+		ContentHash: request.ContentHash,
+		FromWatch:   true,
+		Relayed:     true,
+		Priority:    request.Priority,
+	}, request.TraceID)
+	if err != nil {
+		n.mu.Lock()
+		delete(n.relaying, request.ContentHash)
+		n.mu.Unlock()
+		return true, fmt.Errorf("failed to request %s from holder: %w", request.ContentHash, err)
+	}
+	fmt.Printf("Relaying %s from %s to %s\n", request.ContentHash, source.ID(), peer.ID())
+
+	// Give up on holders that never start sending, so later requests retry
+	time.AfterFunc(DefaultFetchTimeout, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		if n.relaying[request.ContentHash] == fetch && !fetch.started {
+			delete(n.relaying, request.ContentHash)
+		}
+	})
+	return true, nil
+}
+
+// claimRelayLocked returns the relay fetch a new transfer of hash from peer
+// answers, marking it started, or nil if the transfer is not a relay fetch.
+// n.mu must be held.
+func (n *Node) claimRelayLocked(peer *network.Peer, hash string) *relayFetch {
+	fetch, ok := n.relaying[hash]
+	if !ok || fetch.source != peer || fetch.started {
+		return nil
+	}
+	fetch.started = true
+	fetch.active = time.Now()
+	return fetch
+}
+
+// startRelay starts forwarding a relay fetch claimed by its first chunk to
+// the requesters waiting on it
+func (n *Node) startRelay(fetch *relayFetch, transfer *protocol.DataTransfer) {
+	n.mu.RLock()
+	waiters := append([]*relayWaiter(nil), fetch.waiters...)
+	n.mu.RUnlock()
+
+	for _, w := range waiters {
+		w.progress = n.tracker.begin(w.key, w.peer.ID(), transfer.ContentHash, DirectionUpload, transfer.TotalSize)
+		n.emit(Event{Type: EventTransferStarted, PeerID: w.peer.ID(), ContentHash: transfer.ContentHash, Direction: DirectionUpload, Size: transfer.TotalSize})
+	}
+	go n.watchRelay(transfer.ContentHash, fetch)
+}
+
+// watchRelay fails a relay fetch whose source stops sending for
+// n.relayIdle, so its requesters move on instead of waiting for good
+func (n *Node) watchRelay(hash string, fetch *relayFetch) {
+	ticker := time.NewTicker(n.relayIdle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+		n.mu.RLock()
+		current := n.relaying[hash] == fetch
+		idle := time.Since(fetch.active)
+		n.mu.RUnlock()
+		if !current {
+			return
+		}
+		if idle < n.relayIdle {
+			continue
+		}
+		err := fmt.Errorf("no chunk from %s within %v", fetch.source.ID(), n.relayIdle)
+		key := fmt.Sprintf("%s-%s", fetch.source.ID(), hash)
+		n.mu.RLock()
+		state, ok := n.transfers[key]
+		n.mu.RUnlock()
+		if ok && state.relay {
+			// Drops the partial file too, and ends the relay
+			n.abortTransfer(key, state, hash, err)
+		} else {
+			n.endRelay(hash, nil, 0, err)
+		}
+		return
+	}
+}
+
+// forwardChunk passes a relayed chunk on to each requester, dropping those
+// that can no longer be reached
+func (n *Node) forwardChunk(transfer *protocol.DataTransfer) {
+	n.mu.Lock()
+	fetch, ok := n.relaying[transfer.ContentHash]
+	var waiters []*relayWaiter
+	if ok {
+		fetch.active = time.Now()
+		waiters = append(waiters, fetch.waiters...)
+	}
+	n.mu.Unlock()
+
+	for _, w := range waiters {
+		chunk := *transfer
+		chunk.FromWatch = w.request.FromWatch
+		chunk.TraceID = w.request.TraceID
+		if err := n.sendSplit(w.peer, chunk, n.peerCapabilities(w.requesterID).ChunkSize()); err != nil {
+			n.dropWaiter(transfer.ContentHash, w, fmt.Errorf("failed to forward chunk: %w", err))
+			continue
+		}
+		n.tracker.record(w.progress, int64(len(transfer.Data)))
+		n.ledger.record(w.requesterID, int64(len(transfer.Data)), 0)
+	}
+}
+
+// sendSplit sends a chunk in pieces of at most size bytes
+func (n *Node) sendSplit(peer *network.Peer, chunk protocol.DataTransfer, size int) error {
+	for _, piece := range splitChunk(chunk, size) {
+		if err := peer.SendTransfer(n.ID, &piece); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropWaiter stops forwarding an object to one requester
+func (n *Node) dropWaiter(hash string, w *relayWaiter, reason error) {
+	n.mu.Lock()
+	if fetch, ok := n.relaying[hash]; ok {
+		for i, other := range fetch.waiters {
+			if other == w {
+				fetch.waiters = append(fetch.waiters[:i], fetch.waiters[i+1:]...)
+				break
+			}
+		}
+	}
+	n.mu.Unlock()
+
+	n.tracker.finish(w.key)
+	n.emit(Event{Type: EventTransferFailed, PeerID: w.peer.ID(), ContentHash: hash, Direction: DirectionUpload, Error: reason.Error()})
+}
+
+// refuseRelay drops a relay fetch whose source refused it before sending
+// anything, passing the refusal on to the requesters waiting on it
+func (n *Node) refuseRelay(source *network.Peer, hash string, payload protocol.ErrorPayload) {
+	n.mu.Lock()
+	fetch, ok := n.relaying[hash]
+	if !ok || fetch.source != source || fetch.started {
+		n.mu.Unlock()
+		return
+	}
+	delete(n.relaying, hash)
+	n.mu.Unlock()
+
+	for _, w := range append(fetch.waiters, fetch.late...) {
+		n.refuseRequest(w.peer, &protocol.Message{RequestID: w.request.RequestID, TraceID: w.request.TraceID}, payload.Code, payload.Message)
+	}
+}
+
+// endRelay completes a relay fetch. On success, requesters that joined after
+// the first chunk are sent the verified object from file, each in the
+// background so the source's connection isn't held up; on failure they are
+// told it can't be sent.
+func (n *Node) endRelay(hash string, file *os.File, size int64, failure error) {
+	n.mu.Lock()
+	fetch, ok := n.relaying[hash]
+	delete(n.relaying, hash)
+	n.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	for _, w := range fetch.waiters {
+		n.tracker.finish(w.key)
+		if failure != nil {
+			n.emit(Event{Type: EventTransferFailed, PeerID: w.peer.ID(), ContentHash: hash, Direction: DirectionUpload, Error: failure.Error()})
+		} else {
+			n.emit(Event{Type: EventTransferCompleted, PeerID: w.peer.ID(), ContentHash: hash, Direction: DirectionUpload, Size: size})
+		}
+	}
+	if failure != nil {
+		for _, w := range fetch.late {
+			n.refuseRequest(w.peer, &protocol.Message{RequestID: w.request.RequestID, TraceID: w.request.TraceID}, protocol.ErrorCodeNotFound, failure.Error())
+		}
+		return
+	}
+
+	for _, w := range fetch.late {
+		// A file of its own, which outlives the caller removing the original
+		own, err := os.Open(file.Name())
+		if err != nil {
+			fmt.Printf("Failed to relay %s to %s: %v\n", hash, w.peer.ID(), err)
+			continue
+		}
+		go func() {
+			defer own.Close()
+			if err := n.serveObject(w.peer, w.requesterID, w.request, own, size); err != nil {
+				fmt.Printf("Failed to relay %s to %s: %v\n", hash, w.peer.ID(), err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,211 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+func TestNode_RelaysRequestToHolder(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	cfg := ReplicationConfig{Target: 2, Interval: time.Hour}
+	// A single peer each, so discovery doesn't connect requester and holder
+	discovery := DiscoveryConfig{DialInterval: time.Millisecond, MaxPeers: 1, QueueSize: 8}
+
+	holder, err := NewNode("holder", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer holder.Stop()
+	holder.transport.Start()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "reachable through a relay")
+	hash, err := holder.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	relay, err := NewNode("relay", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithReplication(cfg), WithRelayCache(1<<20))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer relay.Stop()
+	relay.transport.Start()
+
+	if err := relay.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := relay.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !relay.replicas.holds("holder", hash) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Relay never learned the holder's inventory")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	requester, err := NewNode("requester", freeAddr(t), filepath.Join(baseDir, "c", "store"), filepath.Join(baseDir, "c", "watch"),
+		WithFirstNode(false), WithDiscovery(discovery))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer requester.Stop()
+	requester.transport.Start()
+
+	// Only the first node hands out the network key, but relayed objects
+	// stay encrypted, so the requester doesn't need it
+	if err := requester.Connect(context.Background(), relay.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(requester.connectedPeers()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Requester never completed the handshake with the relay")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := requester.fetch(hash, 5*time.Second); err != nil {
+		t.Fatalf("Failed to fetch through relay: %v", err)
+	}
+	if !requester.store.Exists(hash) {
+		t.Error("Relayed object was not stored by the requester")
+	}
+	if relay.store.Exists(hash) {
+		t.Error("Relay stored the object instead of caching it")
+	}
+	if !relay.relay.has(hash) {
+		t.Error("Relay did not keep the object in its relay cache")
+	}
+	if _, ok := requester.peerConn("holder"); ok {
+		t.Error("Requester connected to the holder directly")
+	}
+}
+
+func TestNode_RelayRequestLimits(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	node.replicas.update("holder", []string{"somehash"})
+
+	// Already relayed once; relaying again could loop between relays
+	relayed, err := node.relayRequest(nil, "requester", protocol.DataRequest{ContentHash: "somehash", Relayed: true})
+	if relayed || err != nil {
+		t.Errorf("relayRequest() = %v, %v for a relayed request, want false", relayed, err)
+	}
+
+	// The holder is known but not connected
+	relayed, err = node.relayRequest(nil, "requester", protocol.DataRequest{ContentHash: "somehash"})
+	if relayed || err != nil {
+		t.Errorf("relayRequest() = %v, %v without a connected holder, want false", relayed, err)
+	}
+}
+
+func TestNode_RelayFailsStalledSource(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	cfg := ReplicationConfig{Target: 2, Interval: time.Hour}
+	discovery := DiscoveryConfig{DialInterval: time.Millisecond, MaxPeers: 1, QueueSize: 8}
+
+	holder, err := NewNode("holder", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer holder.Stop()
+	holder.transport.Start()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, strings.Repeat("relayed a chunk at a time ", 4000))
+	hash, err := holder.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	relay, err := NewNode("relay", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithReplication(cfg), WithMaxChunkSize(protocol.MinChunkSize))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer relay.Stop()
+	relay.relayIdle = 200 * time.Millisecond
+	relay.transport.Start()
+
+	if err := relay.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := relay.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !relay.replicas.holds("holder", hash) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Relay never learned the holder's inventory")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The holder sends its first chunk and then nothing more
+	release := make(chan struct{})
+	defer close(release)
+	var once sync.Once
+	holder.SetTap(func(e network.TapEvent) {
+		if e.Sent && e.Type == protocol.MessageTypeDataTransfer {
+			once.Do(func() { <-release })
+		}
+	})
+
+	requester, err := NewNode("requester", freeAddr(t), filepath.Join(baseDir, "c", "store"), filepath.Join(baseDir, "c", "watch"),
+		WithFirstNode(false), WithDiscovery(discovery))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer requester.Stop()
+	requester.transport.Start()
+
+	if err := requester.Connect(context.Background(), relay.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for len(requester.connectedPeers()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Requester never completed the handshake with the relay")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	events, unsubscribe := relay.Subscribe()
+	defer unsubscribe()
+	go requester.fetch(hash, 5*time.Second)
+
+	event := waitForEvent(t, events, EventTransferFailed, 3*time.Second)
+	if event.Direction != DirectionUpload || event.ContentHash != hash {
+		t.Errorf("Failed %s transfer of %s, want the relayed upload of %s", event.Direction, event.ContentHash, hash)
+	}
+	relay.mu.RLock()
+	_, relaying := relay.relaying[hash]
+	relay.mu.RUnlock()
+	if relaying {
+		t.Error("Relay still waits on the stalled source")
+	}
+}
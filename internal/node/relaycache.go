@@ -0,0 +1,205 @@
+package node
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/metrics"
+	"p2p-storage/internal/storage"
+)
+
+// RelayCacheStats reports the state of the relay cache
+type RelayCacheStats struct {
+	Budget    int64 `json:"budget"`
+	Used      int64 `json:"used"`
+	Objects   int   `json:"objects"`
+	Hits      int64 `json:"hits"`
+	Evictions int64 `json:"evictions"`
+}
+
+type relayEntry struct {
+	size     int64
+	lastUsed time.Time
+}
+
+// relayCache keeps copies of content the node fetched on behalf of other
+// peers. It lives in its own store with its own byte budget, so cached
+// content never competes with, or is confused with, the node's own data.
+// When over budget, the least popular entries are evicted first.
+type relayCache struct {
+	store     *storage.Store
+	budget    int64
+	score     func(hash string) float64
+	evicted   func(hash string) // called with c.mu held; may be nil
+	mu        sync.Mutex
+	used      int64
+	entries   map[string]*relayEntry
+	hits      metrics.Counter
+	evictions metrics.Counter
+}
+
+// openRelayCache opens the relay cache in dir, indexing objects left by a
+// previous run and trimming them to the budget. evicted, if non-nil, is told
+// of each object evicted.
+func openRelayCache(dir string, budget int64, score func(hash string) float64, evicted func(hash string)) (*relayCache, error) {
+	store, err := storage.NewStore(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open relay cache: %w", err)
+	}
+
+	c := &relayCache{
+		store:   store,
+		budget:  budget,
+		score:   score,
+		evicted: evicted,
+		entries: make(map[string]*relayEntry),
+	}
+
+	hashes, err := store.Hashes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to index relay cache: %w", err)
+	}
+	for _, hash := range hashes {
+		size, err := store.Size(hash)
+		if err != nil {
+			continue
+		}
+		c.entries[hash] = &relayEntry{size: size, lastUsed: time.Now()}
+		c.used += size
+	}
+
+	c.mu.Lock()
+	c.evictLocked(0)
+	c.mu.Unlock()
+	return c, nil
+}
+
+// put stores a relayed object, evicting less popular entries to stay within
+// the budget. Objects larger than the whole budget are not cached.
+func (c *relayCache) put(hash string, r io.Reader, size int64) error {
+	if size > c.budget {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[hash]; ok {
+		return nil
+	}
+	c.evictLocked(size)
+	if err := c.store.Store(hash, r); err != nil {
+		return err
+	}
+	c.entries[hash] = &relayEntry{size: size, lastUsed: time.Now()}
+	c.used += size
+	return nil
+}
+
+// evictLocked removes entries until room bytes fit within the budget. The
+// lowest-scoring entry goes first; ties go to the least recently used.
+func (c *relayCache) evictLocked(room int64) {
+	for c.used+room > c.budget && len(c.entries) > 0 {
+		var victim string
+		var victimScore float64
+		for hash, e := range c.entries {
+			s := c.score(hash)
+			if victim == "" || s < victimScore || s == victimScore && e.lastUsed.Before(c.entries[victim].lastUsed) {
+				victim, victimScore = hash, s
+			}
+		}
+		if err := c.store.Delete(victim); err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Failed to evict %s from relay cache: %v\n", victim, err)
+		}
+		c.used -= c.entries[victim].size
+		delete(c.entries, victim)
+		c.evictions.Inc()
+		if c.evicted != nil {
+			c.evicted(victim)
+		}
+	}
+}
+
+// load opens a cached object, marking it as recently used
+func (c *relayCache) load(hash string) (io.ReadCloser, error) {
+	c.mu.Lock()
+	e, ok := c.entries[hash]
+	if ok {
+		e.lastUsed = time.Now()
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the relay cache", hash)
+	}
+
+	c.hits.Inc()
+	return c.store.Load(hash)
+}
+
+func (c *relayCache) has(hash string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.entries[hash]
+	return ok
+}
+
+func (c *relayCache) size(hash string) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[hash]
+	if !ok {
+		return 0, false
+	}
+	return e.size, true
+}
+
+func (c *relayCache) stats() RelayCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return RelayCacheStats{
+		Budget:    c.budget,
+		Used:      c.used,
+		Objects:   len(c.entries),
+		Hits:      c.hits.Value(),
+		Evictions: c.evictions.Value(),
+	}
+}
+
+// openObject opens a locally held object, from the store or else from the
+// relay cache, and returns its size
+func (n *Node) openObject(hash string) (io.ReadCloser, int64, error) {
+	if n.store.Exists(hash) || n.relay == nil {
+		size, err := n.store.Size(hash)
+		if err != nil {
+			return nil, 0, err
+		}
+		reader, err := n.store.Load(hash)
+		return reader, size, err
+	}
+
+	size, ok := n.relay.size(hash)
+	if !ok {
+		return nil, 0, fmt.Errorf("failed to open file: %s not found", hash)
+	}
+	reader, err := n.relay.load(hash)
+	return reader, size, err
+}
+
+// hasObject reports whether the node holds an object in its store or relay cache
+func (n *Node) hasObject(hash string) bool {
+	return n.store.Exists(hash) || n.relay != nil && n.relay.has(hash)
+}
+
+// RelayCacheStats returns the relay cache statistics; all zero when disabled
+func (n *Node) RelayCacheStats() RelayCacheStats {
+	if n.relay == nil {
+		return RelayCacheStats{}
+	}
+	return n.relay.stats()
+}
@@ -0,0 +1,98 @@
+package node
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"p2p-storage/internal/crypto"
+)
+
+func relayPut(t *testing.T, c *relayCache, content string) string {
+	hash, err := crypto.ContentHash(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Failed to hash content: %v", err)
+	}
+	if err := c.put(hash, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatalf("Failed to cache content: %v", err)
+	}
+	return hash
+}
+
+func TestRelayCache_EvictsLeastPopular(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	scores := make(map[string]float64)
+	c, err := openRelayCache(filepath.Join(baseDir, "relay"), 10, func(hash string) float64 { return scores[hash] }, nil)
+	if err != nil {
+		t.Fatalf("Failed to open relay cache: %v", err)
+	}
+
+	popular := relayPut(t, c, "aaaa")
+	unpopular := relayPut(t, c, "bbbb")
+	scores[popular] = 5
+
+	// Needs 4 more bytes than the budget allows; the unpopular entry goes
+	third := relayPut(t, c, "cccc")
+	if c.has(unpopular) {
+		t.Error("Unpopular entry was not evicted")
+	}
+	if !c.has(popular) || !c.has(third) {
+		t.Error("Popular or newly cached entry missing")
+	}
+
+	stats := c.stats()
+	if stats.Used != 8 || stats.Objects != 2 || stats.Evictions != 1 {
+		t.Errorf("stats() = %+v, want 8 bytes, 2 objects, 1 eviction", stats)
+	}
+
+	// Objects larger than the budget are not cached
+	relayPut(t, c, "this is far too large")
+	if c.stats().Objects != 2 {
+		t.Error("Oversized object was cached")
+	}
+
+	// Reopening indexes the cached objects
+	reopened, err := openRelayCache(filepath.Join(baseDir, "relay"), 10, func(string) float64 { return 0 }, nil)
+	if err != nil {
+		t.Fatalf("Failed to reopen relay cache: %v", err)
+	}
+	if !reopened.has(popular) || reopened.stats().Used != 8 {
+		t.Errorf("Reopened cache = %+v, want the two entries", reopened.stats())
+	}
+}
+
+func TestNode_ServesFromRelayCache(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+		WithFirstNode(true), WithRelayCache(1024))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	hash := relayPut(t, node.relay, "relayed content")
+	if node.store.Exists(hash) {
+		t.Error("Relayed content was written to the store")
+	}
+	if !node.hasObject(hash) {
+		t.Fatal("hasObject() = false for relayed content")
+	}
+
+	reader, size, err := node.openObject(hash)
+	if err != nil {
+		t.Fatalf("Failed to open relayed object: %v", err)
+	}
+	defer reader.Close()
+	data, _ := io.ReadAll(reader)
+	if string(data) != "relayed content" || size != int64(len(data)) {
+		t.Errorf("openObject() = %q (%d bytes), want relayed content", data, size)
+	}
+	if node.RelayCacheStats().Hits != 1 {
+		t.Errorf("Hits = %v, want %v", node.RelayCacheStats().Hits, 1)
+	}
+}
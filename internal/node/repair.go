@@ -0,0 +1,185 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+// RepairResult summarizes a repair run
+type RepairResult struct {
+	Checked  int // under-replicated objects examined
+	Repaired int // objects brought back up to the target
+	Copies   int // new replicas created on peers
+	Skipped  int // under-replicated objects this node does not hold
+	Failed   int
+	Errors   []string
+}
+
+// Repair pushes copies of under-replicated objects to peers that do not yet
+// hold them until each object reaches the replication target, most popular
+// objects first. With no hashes every under-replicated object known to the
+// node is repaired. progress, if
+// non-nil, is called with the resulting status of each object.
+func (n *Node) Repair(hashes []string, progress func(ReplicaStatus)) (RepairResult, error) {
+	var result RepairResult
+
+	var candidates []ReplicaStatus
+	if len(hashes) == 0 {
+		report, err := n.ReplicationReport()
+		if err != nil {
+			return result, err
+		}
+		candidates = report
+	} else {
+		for _, hash := range hashes {
+			candidates = append(candidates, n.Replicas(hash))
+		}
+	}
+
+	// The most popular objects are repaired first, so content in demand
+	// regains its replicas before a run is cut short or peers run out
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return n.popularityScore(candidates[i].Hash) > n.popularityScore(candidates[j].Hash)
+	})
+	for _, status := range candidates {
+		if !status.UnderReplicated() {
+			continue
+		}
+		result.Checked++
+
+		if !status.Local {
+			// Only holders can push copies; another peer has to repair it
+			result.Skipped++
+			continue
+		}
+
+		copies, err := n.repairObject(status)
+		result.Copies += copies
+		if err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", status.Hash, err))
+		} else {
+			result.Repaired++
+		}
+		if progress != nil {
+			progress(n.Replicas(status.Hash))
+		}
+	}
+
+	if _, err := n.checkReplication(); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// repairObject pushes one object to peers without a copy, one at a time,
+// until it reaches the target or no peers are left to try
+func (n *Node) repairObject(status ReplicaStatus) (int, error) {
+	meta, ok := n.catalog.get(status.Hash)
+	if !ok {
+		size, err := n.store.Size(status.Hash)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read object: %w", err)
+		}
+		meta = FileMeta{Hash: status.Hash, Size: size}
+	}
+
+	held := make(map[string]bool, len(status.Holders))
+	for _, id := range status.Holders {
+		held[id] = true
+	}
+
+	copies := 0
+	replicas := status.Replicas
+	var lastErr error
+	// Storage-only peers are there to hold replicas, so they are tried first
+	for _, id := range n.byScore(n.storageFirst(n.connectedPeers())) {
+		if replicas >= status.Target {
+			break
+		}
+		if held[id] || meta.Encryption != EncryptNone && n.peerKeyless(id) {
+			// Public mirrors refuse encrypted objects
+			continue
+		}
+		if err := n.pushReplica(id, meta); err != nil {
+			fmt.Printf("Failed to replicate %s to %s: %v\n", status.Hash, id, err)
+			lastErr = err
+			continue
+		}
+		copies++
+		replicas++
+	}
+
+	if replicas < status.Target {
+		if lastErr != nil {
+			return copies, fmt.Errorf("reached %d of %d replicas: %w", replicas, status.Target, lastErr)
+		}
+		return copies, fmt.Errorf("reached %d of %d replicas: no more peers to copy to", replicas, status.Target)
+	}
+	return copies, nil
+}
+
+// pushReplica offers an object to one peer and waits until the peer confirms
+// it has stored it, by its inventory or by a storage receipt, which also
+// confirm copies when inventories aren't exchanged
+func (n *Node) pushReplica(id string, meta FileMeta) error {
+	peer, ok := n.peerConn(id)
+	if !ok {
+		return fmt.Errorf("peer is not connected")
+	}
+
+	msg, err := n.announcement(meta)
+	if err != nil {
+		return err
+	}
+	n.sign(msg)
+	if err := peer.Send(msg); err != nil {
+		return fmt.Errorf("failed to offer object: %w", err)
+	}
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.NewTimer(DefaultFetchTimeout)
+	defer timeout.Stop()
+
+	for !n.replicas.holds(id, meta.Hash) {
+		select {
+		case <-n.done:
+			return fmt.Errorf("node stopped")
+		case <-timeout.C:
+			return fmt.Errorf("timed out waiting for the peer to store the object")
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// connectedPeers returns the IDs of peers with an open connection, sorted
+func (n *Node) connectedPeers() []string {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	ids := make([]string, 0, len(n.conns))
+	for key, peer := range n.conns {
+		if !peer.Closed() {
+			ids = append(ids, n.peers[key].ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// peerConn returns the open connection to a peer, if any
+func (n *Node) peerConn(id string) (*network.Peer, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	peer, ok := n.conns[n.peerKeys[id]]
+	if !ok || peer.Closed() {
+		return nil, false
+	}
+	return peer, true
+}
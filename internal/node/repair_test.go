@@ -0,0 +1,112 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNode_RepairWithoutPeers(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+		WithFirstNode(true), WithReplication(ReplicationConfig{Target: 2, Interval: time.Hour}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "lonely object")
+	if _, err := node.StoreFile(path); err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	result, err := node.Repair(nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to repair: %v", err)
+	}
+	if result.Checked != 1 || result.Failed != 1 || result.Repaired != 0 {
+		t.Errorf("result = %+v, want 1 checked and 1 failed", result)
+	}
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0], "no more peers") {
+		t.Errorf("Errors = %v, want a no more peers error", result.Errors)
+	}
+}
+
+func TestNode_RepairSkipsObjectsHeldElsewhere(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+		WithFirstNode(true), WithReplication(ReplicationConfig{Target: 2, Interval: time.Hour}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	node.replicas.update("peer", []string{"remotehash0123"})
+	result, err := node.Repair(nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to repair: %v", err)
+	}
+	if result.Checked != 1 || result.Skipped != 1 {
+		t.Errorf("result = %+v, want 1 checked and 1 skipped", result)
+	}
+}
+
+func TestNode_RepairPushesToPeer(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	cfg := ReplicationConfig{Target: 2, Interval: time.Hour}
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "needs a second copy")
+	hash, err := first.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	var reported []ReplicaStatus
+	result, err := first.Repair([]string{hash}, func(status ReplicaStatus) {
+		reported = append(reported, status)
+	})
+	if err != nil {
+		t.Fatalf("Failed to repair: %v", err)
+	}
+	if result.Repaired != 1 || result.Copies != 1 || result.Failed != 0 {
+		t.Errorf("result = %+v, want 1 object repaired with 1 copy", result)
+	}
+	if !second.store.Exists(hash) {
+		t.Error("Object was not copied to the peer")
+	}
+	if len(reported) != 1 || reported[0].Replicas != 2 {
+		t.Errorf("reported = %+v, want one status with 2 replicas", reported)
+	}
+}
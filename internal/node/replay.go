@@ -0,0 +1,197 @@
+package node
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/metrics"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// Errors for messages refused as replays
+var (
+	ErrStaleMessage     = errors.New("message timestamp outside the allowed clock skew")
+	ErrReplayedMessage  = errors.New("message nonce already seen")
+	ErrUnstampedMessage = errors.New("message from a peer announcing replay protection is not stamped")
+	ErrUnsealedMessage  = errors.New("message stamp is not sealed with the connection's key")
+	ErrReplayWindowFull = errors.New("too many messages from the peer within the allowed clock skew")
+)
+
+// maxNonces bounds the nonces remembered per peer, so a peer can't make the
+// node hold more than that for the length of the skew
+const maxNonces = 1 << 16
+
+// ReplayConfig bounds how far a message's timestamp may be from the local
+// clock. Nonces are remembered for as long as their messages would be
+// accepted, so a message can't be played back within that window either.
+type ReplayConfig struct {
+	// MaxSkew is the largest difference allowed between a message's
+	// timestamp and the local clock, either way; 0 turns checks off
+	MaxSkew time.Duration
+}
+
+// DefaultReplayConfig returns a skew of five minutes
+func DefaultReplayConfig() ReplayConfig {
+	return ReplayConfig{MaxSkew: 5 * time.Minute}
+}
+
+// WithReplayProtection sets how messages are checked against replays.
+// Messages are stamped for peers announcing the feature either way.
+func WithReplayProtection(cfg ReplayConfig) Option {
+	return func(n *Node) {
+		n.replayConfig = cfg
+	}
+}
+
+// replayGuard remembers the nonces of each sender's recent messages
+type replayGuard struct {
+	cfg      ReplayConfig
+	mu       sync.Mutex
+	nonces   map[string]map[string]int64 // sender -> nonce -> timestamp
+	swept    time.Time
+	rejected metrics.Counter
+}
+
+func newReplayGuard(cfg ReplayConfig) *replayGuard {
+	return &replayGuard{cfg: cfg, nonces: make(map[string]map[string]int64)}
+}
+
+// check refuses a stamped message whose timestamp is too far from now or
+// whose nonce sender already used. Unstamped messages pass.
+func (g *replayGuard) check(sender string, msg *protocol.Message, now time.Time) error {
+	if g.cfg.MaxSkew <= 0 || !msg.Stamped() {
+		return nil
+	}
+	skew := now.Sub(time.UnixMilli(msg.Timestamp))
+	if skew > g.cfg.MaxSkew || skew < -g.cfg.MaxSkew {
+		g.rejected.Inc()
+		return fmt.Errorf("%w: %v off", ErrStaleMessage, skew.Round(time.Millisecond))
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweepLocked(now)
+	seen := g.nonces[sender]
+	if _, ok := seen[msg.Nonce]; ok {
+		g.rejected.Inc()
+		return ErrReplayedMessage
+	}
+	if len(seen) >= maxNonces {
+		g.sweepSenderLocked(seen, now)
+		if len(seen) >= maxNonces {
+			g.rejected.Inc()
+			return ErrReplayWindowFull
+		}
+	}
+	if seen == nil {
+		seen = make(map[string]int64)
+		g.nonces[sender] = seen
+	}
+	seen[msg.Nonce] = msg.Timestamp
+	return nil
+}
+
+// sweepLocked forgets nonces whose messages would be refused as stale
+// anyway, every quarter of the skew
+func (g *replayGuard) sweepLocked(now time.Time) {
+	if now.Sub(g.swept) < g.cfg.MaxSkew/4 {
+		return
+	}
+	g.swept = now
+	for sender, seen := range g.nonces {
+		g.sweepSenderLocked(seen, now)
+		if len(seen) == 0 {
+			delete(g.nonces, sender)
+		}
+	}
+}
+
+// sweepSenderLocked forgets the nonces of one sender whose messages would
+// be refused as stale anyway
+func (g *replayGuard) sweepSenderLocked(seen map[string]int64, now time.Time) {
+	oldest := now.Add(-g.cfg.MaxSkew).UnixMilli()
+	for nonce, timestamp := range seen {
+		if timestamp < oldest {
+			delete(seen, nonce)
+		}
+	}
+}
+
+// checkReplay refuses replayed messages, unstamped ones from peers that
+// announced they stamp theirs and, on connections whose stamps are sealed,
+// ones not sealed with the connection's key. What a peer announced and
+// whose nonces a message is checked against are those of the node on the
+// connection, whatever the message's sender ID says. A handshake announcing
+// the feature must be stamped itself, so an old one can't be played back
+// stripped of its stamp.
+func (n *Node) checkReplay(peer *network.Peer, msg *protocol.Message) error {
+	// Messages handed in by the node itself come on no connection
+	if n.replays.cfg.MaxSkew <= 0 || peer == nil {
+		return nil
+	}
+	sender := n.nodeID(peer)
+	if !msg.Stamped() {
+		stamps := false
+		if msg.Type == protocol.MessageTypeHandshake {
+			var payload protocol.HandshakePayload
+			if err := msg.ParsePayload(&payload); err == nil {
+				stamps = protocol.HasFeature(payload.Features, protocol.FeatureReplay)
+			}
+		} else {
+			stamps = n.peerSupports(sender, protocol.FeatureReplay)
+		}
+		if stamps {
+			n.replays.rejected.Inc()
+			return ErrUnstampedMessage
+		}
+		return nil
+	}
+	// Handshake messages are signed, and sent before the key is agreed on
+	if required, ok := peer.Sealed(msg); required && !ok && !handshakeTypes[msg.Type] {
+		n.replays.rejected.Inc()
+		return ErrUnsealedMessage
+	}
+	if sender == "" {
+		// Not identified yet; only handshake messages get this far
+		sender = peer.ID()
+	}
+	return n.replays.check(sender, msg, time.Now())
+}
+
+// sealStamps agrees with a peer that completed its handshake on the keys
+// stamps are sealed with on the connection, if both announce
+// protocol.FeatureSealed. Each direction has its own key, derived from the
+// exchange keys and both handshake challenges, so seals are good on this
+// connection alone and a message can't be reflected back to its sender.
+func (n *Node) sealStamps(peer *network.Peer, payload protocol.HandshakePayload) error {
+	if !protocol.HasFeature(payload.Features, protocol.FeatureSealed) || payload.ExchangeKey == nil || len(payload.Challenge) == 0 {
+		return nil
+	}
+	challenges := [][]byte{peer.Challenge(), payload.Challenge}
+	if bytes.Compare(challenges[0], challenges[1]) > 0 {
+		challenges[0], challenges[1] = challenges[1], challenges[0]
+	}
+	context := append([]byte("p2p-storage seal\x00"), bytes.Join(challenges, nil)...)
+	shared, err := n.exchange.SharedKey(payload.ExchangeKey, context)
+	if err != nil {
+		return err
+	}
+	direction := func(public []byte) []byte {
+		sum := sha256.Sum256(append(append([]byte{}, shared...), public...))
+		return sum[:]
+	}
+	peer.SealStamps(direction(n.identity.Public), direction(payload.PublicKey))
+	return nil
+}
+
+// registerReplayMetrics exposes the count of messages refused as replays
+func (n *Node) registerReplayMetrics() {
+	n.metrics.Register("p2p_replayed_messages_total", "Messages refused as stale, replayed or missing their stamp", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.replays.rejected.Value())}}
+	})
+}
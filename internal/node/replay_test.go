@@ -0,0 +1,161 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+// sealWith stamps msg and seals it with key, as sent on a connection whose
+// stamps are sealed with key
+func sealWith(t *testing.T, msg *protocol.Message, key []byte) *protocol.Message {
+	t.Helper()
+	stamped, err := msg.Stamp()
+	if err != nil {
+		t.Fatalf("Stamp() error = %v", err)
+	}
+	stamped.Seal(key)
+	return stamped
+}
+
+func TestReplayGuard(t *testing.T) {
+	g := newReplayGuard(ReplayConfig{MaxSkew: time.Minute})
+	now := time.Now()
+	stamped := func(at time.Time, nonce string) *protocol.Message {
+		return &protocol.Message{Type: protocol.MessageTypeData, Timestamp: at.UnixMilli(), Nonce: nonce}
+	}
+
+	if err := g.check("a", stamped(now, "n1"), now); err != nil {
+		t.Fatalf("check() of a fresh message = %v", err)
+	}
+	if err := g.check("a", stamped(now, "n1"), now); !errors.Is(err, ErrReplayedMessage) {
+		t.Errorf("check() of a repeated nonce = %v, want %v", err, ErrReplayedMessage)
+	}
+	if err := g.check("b", stamped(now, "n1"), now); err != nil {
+		t.Errorf("check() of another sender's nonce = %v", err)
+	}
+	if err := g.check("a", stamped(now.Add(-2*time.Minute), "n2"), now); !errors.Is(err, ErrStaleMessage) {
+		t.Errorf("check() of an old message = %v, want %v", err, ErrStaleMessage)
+	}
+	if err := g.check("a", stamped(now.Add(2*time.Minute), "n3"), now); !errors.Is(err, ErrStaleMessage) {
+		t.Errorf("check() of a message from the future = %v, want %v", err, ErrStaleMessage)
+	}
+	if err := g.check("a", &protocol.Message{Type: protocol.MessageTypeData}, now); err != nil {
+		t.Errorf("check() of an unstamped message = %v", err)
+	}
+	if got := g.rejected.Value(); got != 3 {
+		t.Errorf("rejected = %d, want 3", got)
+	}
+
+	// A sender can't make the guard hold more than maxNonces nonces
+	for i := 0; i < maxNonces; i++ {
+		if err := g.check("flood", stamped(now, fmt.Sprint(i)), now); err != nil {
+			t.Fatalf("check() of message %d = %v", i, err)
+		}
+	}
+	if err := g.check("flood", stamped(now, "one more"), now); !errors.Is(err, ErrReplayWindowFull) {
+		t.Errorf("check() over the window = %v, want %v", err, ErrReplayWindowFull)
+	}
+	if err := g.check("b", stamped(now, "n5"), now); err != nil {
+		t.Errorf("check() of another sender = %v", err)
+	}
+	if got := g.rejected.Value(); got != 4 {
+		t.Errorf("rejected = %d, want 4", got)
+	}
+
+	// Nonces are forgotten once their messages would be stale anyway
+	later := now.Add(2 * time.Minute)
+	if err := g.check("c", stamped(later, "n4"), later); err != nil {
+		t.Fatalf("check() = %v", err)
+	}
+	if _, ok := g.nonces["a"]; ok {
+		t.Error("Nonces of stale messages were kept")
+	}
+}
+
+func TestNode_RefusesReplayedMessages(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	// The handshakes both ways were stamped, or the key wouldn't arrive
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	peer, ok := first.peerConn("second")
+	if !ok {
+		t.Fatal("First node is not connected to the second")
+	}
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeLeave, "second", nil)
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := first.HandleMessage(peer, msg); !errors.Is(err, ErrUnstampedMessage) {
+		t.Errorf("HandleMessage() of an unstamped message = %v, want %v", err, ErrUnstampedMessage)
+	}
+
+	// The nodes seal their stamps; a stamp without a seal, or sealed with
+	// another key, is refused
+	if required, _ := peer.Sealed(msg); !required {
+		t.Fatal("Stamps between the nodes are not sealed")
+	}
+	unsealed, err := msg.Stamp()
+	if err != nil {
+		t.Fatalf("Stamp() error = %v", err)
+	}
+	if err := first.HandleMessage(peer, unsealed); !errors.Is(err, ErrUnsealedMessage) {
+		t.Errorf("HandleMessage() of an unsealed message = %v, want %v", err, ErrUnsealedMessage)
+	}
+	if err := first.HandleMessage(peer, sealWith(t, msg, []byte("another key"))); !errors.Is(err, ErrUnsealedMessage) {
+		t.Errorf("HandleMessage() of a message sealed with another key = %v, want %v", err, ErrUnsealedMessage)
+	}
+
+	// Stale messages are refused even with a good seal
+	key := []byte("test seal key")
+	peer.SealStamps(key, key)
+	stale := *msg
+	stale.Timestamp, stale.Nonce = time.Now().Add(-time.Hour).UnixMilli(), "old"
+	stale.Seal(key)
+	if err := first.HandleMessage(peer, &stale); !errors.Is(err, ErrStaleMessage) {
+		t.Errorf("HandleMessage() of a stale message = %v, want %v", err, ErrStaleMessage)
+	}
+
+	// An old handshake played back without its stamp is refused too
+	handshake, err := protocol.NewMessage(protocol.MessageTypeHandshake, "second", protocol.HandshakePayload{NodeID: "second", Features: protocol.Features})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := first.HandleMessage(peer, handshake); !errors.Is(err, ErrUnstampedMessage) {
+		t.Errorf("HandleMessage() of an unstamped handshake = %v, want %v", err, ErrUnstampedMessage)
+	}
+	stamped, err := handshake.Stamp()
+	if err != nil {
+		t.Fatalf("Stamp() error = %v", err)
+	}
+	stamped.Timestamp = time.Now().Add(-time.Hour).UnixMilli()
+	if err := first.HandleMessage(peer, stamped); !errors.Is(err, ErrStaleMessage) {
+		t.Errorf("HandleMessage() of an old handshake = %v, want %v", err, ErrStaleMessage)
+	}
+}
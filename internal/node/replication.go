@@ -0,0 +1,374 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/metrics"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// ReplicationConfig controls replica monitoring
+type ReplicationConfig struct {
+	// Target is how many live copies of each object the network should
+	// hold, counting this node's own copy
+	Target int
+	// Interval between inventory exchanges; zero disables monitoring.
+	// A peer whose inventory is older than three intervals no longer
+	// counts as holding a replica.
+	Interval time.Duration
+}
+
+// DefaultReplicationConfig returns a target of three replicas with
+// inventories exchanged every 30 seconds
+func DefaultReplicationConfig() ReplicationConfig {
+	return ReplicationConfig{
+		Target:   3,
+		Interval: 30 * time.Second,
+	}
+}
+
+// inventoryExpiry is how many missed exchanges make a peer's inventory stale
+const inventoryExpiry = 3
+
+// ReplicaStatus reports the live replicas of one object
+type ReplicaStatus struct {
+	Hash     string   `json:"hash"`
+	Replicas int      `json:"replicas"`
+	Target   int      `json:"target"`
+	Local    bool     `json:"local"`   // this node holds a copy
+	Holders  []string `json:"holders"` // peers with a live copy
+}
+
+// UnderReplicated reports whether the object has fewer replicas than its target
+func (r ReplicaStatus) UnderReplicated() bool {
+	return r.Replicas < r.Target
+}
+
+type peerInventory struct {
+	hashes map[string]struct{}
+	seen   time.Time
+}
+
+// replicaTracker keeps the latest inventory received from each peer
+type replicaTracker struct {
+	mu    sync.Mutex
+	peers map[string]*peerInventory
+	// under holds objects currently reported as under-replicated, so alerts
+	// fire once when an object drops below target rather than on every check
+	under map[string]bool
+	// disputed holds objects a peer failed an audit for; they aren't counted
+	// as replicas, whatever the peer's inventory claims, until it passes one
+	disputed map[string]map[string]bool
+	ttl      time.Duration
+	now      func() time.Time
+}
+
+func newReplicaTracker(ttl time.Duration) *replicaTracker {
+	return &replicaTracker{
+		peers:    make(map[string]*peerInventory),
+		under:    make(map[string]bool),
+		disputed: make(map[string]map[string]bool),
+		ttl:      ttl,
+		now:      time.Now,
+	}
+}
+
+// update replaces a peer's inventory
+func (t *replicaTracker) update(peerID string, hashes []string) {
+	inv := &peerInventory{
+		hashes: make(map[string]struct{}, len(hashes)),
+		seen:   t.now(),
+	}
+	for _, hash := range hashes {
+		inv.hashes[hash] = struct{}{}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.peers[peerID] = inv
+}
+
+// add extends a peer's inventory with newly stored objects. A fresh copy
+// lifts any dispute from an earlier failed audit.
+func (t *replicaTracker) add(peerID string, hashes []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	inv, ok := t.peers[peerID]
+	if !ok {
+		inv = &peerInventory{hashes: make(map[string]struct{}, len(hashes))}
+		t.peers[peerID] = inv
+	}
+	inv.seen = t.now()
+	for _, hash := range hashes {
+		inv.hashes[hash] = struct{}{}
+		delete(t.disputed[peerID], hash)
+	}
+}
+
+// forget drops a peer's inventory
+func (t *replicaTracker) forget(peerID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.peers, peerID)
+	delete(t.disputed, peerID)
+}
+
+// dispute marks a peer's claim to hold hash as failed, or clears the mark
+func (t *replicaTracker) dispute(peerID, hash string, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !failed {
+		delete(t.disputed[peerID], hash)
+		return
+	}
+	if t.disputed[peerID] == nil {
+		t.disputed[peerID] = make(map[string]bool)
+	}
+	t.disputed[peerID][hash] = true
+}
+
+// holds reports whether a peer's live inventory lists hash
+func (t *replicaTracker) holds(peerID, hash string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	inv, ok := t.peers[peerID]
+	if !ok || t.ttl > 0 && t.now().Sub(inv.seen) > t.ttl {
+		return false
+	}
+	_, ok = inv.hashes[hash]
+	return ok && !t.disputed[peerID][hash]
+}
+
+// holders returns the live peers holding each known object, dropping
+// inventories that have expired
+func (t *replicaTracker) holders() map[string][]string {
+	return t.collect(false)
+}
+
+// claims returns the live peers listing each object in their inventory,
+// including those whose copies are disputed
+func (t *replicaTracker) claims() map[string][]string {
+	return t.collect(true)
+}
+
+func (t *replicaTracker) collect(disputed bool) map[string][]string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	result := make(map[string][]string)
+	for peerID, inv := range t.peers {
+		if t.ttl > 0 && now.Sub(inv.seen) > t.ttl {
+			delete(t.peers, peerID)
+			continue
+		}
+		for hash := range inv.hashes {
+			if !disputed && t.disputed[peerID][hash] {
+				continue
+			}
+			result[hash] = append(result[hash], peerID)
+		}
+	}
+	for _, peers := range result {
+		sort.Strings(peers)
+	}
+	return result
+}
+
+// transition records whether hash is under-replicated and reports whether
+// that changed since the last check
+func (t *replicaTracker) transition(hash string, under bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.under[hash] == under {
+		return false
+	}
+	if under {
+		t.under[hash] = true
+	} else {
+		delete(t.under, hash)
+	}
+	return true
+}
+
+func (t *replicaTracker) underCount() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.under)
+}
+
+// Replicas returns the live replica count of an object
+func (n *Node) Replicas(hash string) ReplicaStatus {
+	holders := n.replicas.holders()[hash]
+	return n.replicaStatus(hash, n.store.Exists(hash), holders)
+}
+
+// ReplicationReport returns the replica status of every object stored
+// locally or listed in a live peer inventory, ordered by hash
+func (n *Node) ReplicationReport() ([]ReplicaStatus, error) {
+	local, err := n.store.Hashes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list store: %w", err)
+	}
+
+	holders := n.replicas.holders()
+	stored := make(map[string]bool, len(local))
+	for _, hash := range local {
+		stored[hash] = true
+	}
+
+	report := make([]ReplicaStatus, 0, len(holders)+len(local))
+	for _, hash := range local {
+		report = append(report, n.replicaStatus(hash, true, holders[hash]))
+	}
+	for hash, peers := range holders {
+		if !stored[hash] {
+			report = append(report, n.replicaStatus(hash, false, peers))
+		}
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Hash < report[j].Hash })
+	return report, nil
+}
+
+func (n *Node) replicaStatus(hash string, local bool, holders []string) ReplicaStatus {
+	status := ReplicaStatus{
+		Hash:     hash,
+		Replicas: len(holders),
+		Target:   n.replicationConfig.Target,
+		Local:    local,
+		Holders:  holders,
+	}
+	if local {
+		status.Replicas++
+	}
+	return status
+}
+
+// checkReplication raises events for locally stored objects that fell below
+// or recovered to their replication target, returning the number of objects
+// currently under-replicated
+func (n *Node) checkReplication() (int, error) {
+	report, err := n.ReplicationReport()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, status := range report {
+		// Only alert about objects this node can act on
+		if !status.Local {
+			continue
+		}
+		under := status.UnderReplicated()
+		if !n.replicas.transition(status.Hash, under) {
+			continue
+		}
+		if under {
+			fmt.Printf("Object %s is under-replicated: %d of %d replicas\n", status.Hash, status.Replicas, status.Target)
+			n.emit(Event{Type: EventUnderReplicated, ContentHash: status.Hash, Count: status.Replicas})
+		} else {
+			n.emit(Event{Type: EventReplicationRestored, ContentHash: status.Hash, Count: status.Replicas})
+		}
+	}
+	return n.replicas.underCount(), nil
+}
+
+// sendInventory sends the list of locally stored objects to one peer, or to
+// every connected peer when peer is nil
+func (n *Node) sendInventory(peer *network.Peer) error {
+	hashes, err := n.store.Hashes()
+	if err != nil {
+		return fmt.Errorf("failed to list store: %w", err)
+	}
+	sort.Strings(hashes)
+
+	msg, err := protocol.NewMessage(protocol.MessageTypeInventory, n.ID, protocol.InventoryPayload{
+		NodeID: n.ID,
+		Hashes: hashes,
+	})
+	if err != nil {
+		return err
+	}
+	if peer == nil {
+		return n.broadcast("inventory", msg)
+	}
+	return peer.Send(msg)
+}
+
+// confirmReplica tells the peer a replicated object came from that it is now
+// stored here, so the sender's replica count updates before the next exchange
+func (n *Node) confirmReplica(peer *network.Peer, hash string) {
+	if n.replicationConfig.Interval <= 0 {
+		return
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeInventory, n.ID, protocol.InventoryPayload{
+		NodeID: n.ID,
+		Hashes: []string{hash},
+		Added:  true,
+	})
+	if err != nil {
+		return
+	}
+	if err := peer.Send(msg); err != nil {
+		fmt.Printf("Failed to confirm replica of %s: %v\n", hash, err)
+	}
+}
+
+func (n *Node) handleInventory(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.InventoryPayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse inventory: %w", err)
+	}
+	// Counted for the node on the connection, whatever node the inventory
+	// names, so no peer can claim copies on another's behalf
+	id := n.nodeID(peer)
+	if id == "" || id == n.ID {
+		return nil
+	}
+
+	if payload.Added {
+		n.replicas.add(id, payload.Hashes)
+	} else {
+		n.replicas.update(id, payload.Hashes)
+	}
+	return nil
+}
+
+// replicationLoop exchanges inventories and checks replica counts until the
+// node stops
+func (n *Node) replicationLoop() {
+	ticker := time.NewTicker(n.replicationConfig.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			if err := n.sendInventory(nil); err != nil {
+				fmt.Printf("Failed to send inventory: %v\n", err)
+			}
+			if _, err := n.checkReplication(); err != nil {
+				fmt.Printf("Replication check failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// registerReplicationMetrics exposes replica monitoring gauges
+func (n *Node) registerReplicationMetrics() {
+	n.metrics.Register("p2p_objects_under_replicated", "Locally stored objects with fewer live replicas than the target", metrics.KindGauge, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.replicas.underCount())}}
+	})
+	n.metrics.Register("p2p_replication_target", "Target number of live replicas per object", metrics.KindGauge, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.replicationConfig.Target)}}
+	})
+}
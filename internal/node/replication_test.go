@@ -0,0 +1,234 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/protocol"
+)
+
+func TestReplicaTracker_ExpiresStaleInventories(t *testing.T) {
+	now := time.Now()
+	tracker := newReplicaTracker(time.Minute)
+	tracker.now = func() time.Time { return now }
+
+	tracker.update("peer-a", []string{"h1", "h2"})
+	now = now.Add(45 * time.Second)
+	tracker.update("peer-b", []string{"h1"})
+
+	holders := tracker.holders()
+	if got := holders["h1"]; len(got) != 2 || got[0] != "peer-a" || got[1] != "peer-b" {
+		t.Errorf("holders[h1] = %v, want [peer-a peer-b]", got)
+	}
+
+	now = now.Add(30 * time.Second) // peer-a last seen 75s ago
+	holders = tracker.holders()
+	if got := holders["h1"]; len(got) != 1 || got[0] != "peer-b" {
+		t.Errorf("holders[h1] = %v, want [peer-b]", got)
+	}
+	if _, ok := holders["h2"]; ok {
+		t.Error("h2 still has holders after peer-a expired")
+	}
+}
+
+func TestReplicaTracker_UpdateReplacesInventory(t *testing.T) {
+	tracker := newReplicaTracker(time.Minute)
+	tracker.update("peer", []string{"h1", "h2"})
+	tracker.update("peer", []string{"h2"})
+
+	holders := tracker.holders()
+	if _, ok := holders["h1"]; ok {
+		t.Error("h1 still held after the peer dropped it")
+	}
+	if len(holders["h2"]) != 1 {
+		t.Errorf("holders[h2] = %v, want [peer]", holders["h2"])
+	}
+}
+
+func TestNode_CheckReplicationEmitsTransitions(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+		WithFirstNode(true), WithReplication(ReplicationConfig{Target: 2, Interval: time.Hour}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "replicate me")
+	hash, err := node.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	events, unsubscribe := node.Subscribe()
+	defer unsubscribe()
+
+	under, err := node.checkReplication()
+	if err != nil {
+		t.Fatalf("Failed to check replication: %v", err)
+	}
+	if under != 1 {
+		t.Errorf("under-replicated = %d, want 1", under)
+	}
+	event := <-events
+	if event.Type != EventUnderReplicated || event.ContentHash != hash || event.Count != 1 {
+		t.Errorf("event = %+v, want under_replicated for %s with count 1", event, hash)
+	}
+
+	// A second check without changes must not alert again
+	if _, err := node.checkReplication(); err != nil {
+		t.Fatalf("Failed to check replication: %v", err)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("Unexpected event %+v", event)
+	default:
+	}
+
+	node.replicas.update("peer", []string{hash})
+	status := node.Replicas(hash)
+	if status.Replicas != 2 || status.UnderReplicated() || !status.Local {
+		t.Errorf("status = %+v, want 2 replicas including the local copy", status)
+	}
+
+	under, err = node.checkReplication()
+	if err != nil {
+		t.Fatalf("Failed to check replication: %v", err)
+	}
+	if under != 0 {
+		t.Errorf("under-replicated = %d, want 0", under)
+	}
+	event = <-events
+	if event.Type != EventReplicationRestored || event.Count != 2 {
+		t.Errorf("event = %+v, want replication_restored with count 2", event)
+	}
+}
+
+func TestNode_ReplicationReportIncludesRemoteObjects(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	node.replicas.update("peer", []string{"remotehash0123"})
+	report, err := node.ReplicationReport()
+	if err != nil {
+		t.Fatalf("Failed to build report: %v", err)
+	}
+	if len(report) != 1 {
+		t.Fatalf("report has %d entries, want 1", len(report))
+	}
+	if report[0].Local || report[0].Replicas != 1 || report[0].Holders[0] != "peer" {
+		t.Errorf("report[0] = %+v, want one remote replica on peer", report[0])
+	}
+}
+
+func TestNode_InventoryExchangedOnHandshake(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	cfg := ReplicationConfig{Target: 2, Interval: time.Hour}
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "held by first")
+	hash, err := first.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for second.Replicas(hash).Replicas == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	status := second.Replicas(hash)
+	if status.Replicas != 1 || len(status.Holders) != 1 || status.Holders[0] != "first" {
+		t.Errorf("status = %+v, want one replica held by first", status)
+	}
+}
+
+func TestNode_InventoryCountsItsSender(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	cfg := ReplicationConfig{Target: 2, Interval: time.Hour}
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"),
+		WithFirstNode(true), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithReplication(cfg))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	conn, ok := second.peerConn("first")
+	if !ok {
+		t.Fatal("Second node is not connected to the first")
+	}
+
+	// The second node claims a copy on behalf of a third
+	const hash = "0123456789abcdef"
+	msg, err := protocol.NewMessage(protocol.MessageTypeInventory, second.ID, protocol.InventoryPayload{
+		NodeID: "third",
+		Hashes: []string{hash},
+		Added:  true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := conn.Send(msg); err != nil {
+		t.Fatalf("Failed to send inventory: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(first.replicas.holders()[hash]) == 0 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := first.replicas.holders()[hash]; len(got) != 1 || got[0] != "second" {
+		t.Errorf("holders = %v, want [second]", got)
+	}
+	// Nor does it take over the third node's connection
+	if _, ok := first.peerConn("third"); ok {
+		t.Error("An inventory naming another node became that node's connection")
+	}
+}
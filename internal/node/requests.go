@@ -0,0 +1,423 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// Errors a peer answers a request with; see requestError
+var (
+	// ErrNotFound is returned when a peer asked for content holds no copy
+	// of it
+	ErrNotFound = errors.New("content not found")
+	// ErrQuotaExceeded is returned when a peer refuses to send more until
+	// the requester sends it more in return; see LedgerPolicy
+	ErrQuotaExceeded = errors.New("upload quota exceeded")
+	// ErrUnauthorized is returned when a peer may not serve the content
+	ErrUnauthorized = errors.New("not authorized")
+	// ErrInvalidRange is returned when a range starts past the end of the
+	// content
+	ErrInvalidRange = errors.New("invalid range")
+	// ErrBusy is returned when a peer already sends the requester as many
+	// transfers as it takes at once
+	ErrBusy = errors.New("peer busy")
+)
+
+// requestNoteExpiry is how long the object a request asked for is
+// remembered, for an error answering it
+const requestNoteExpiry = 10 * time.Minute
+
+// busyRetryDelay is how long a request a peer refused as busy waits before
+// it is sent again
+const busyRetryDelay = time.Second
+
+// RequestConfig sets how objects missing locally are requested from peers.
+// Peers are asked one at a time, holders first; one that has no copy, or
+// doesn't start sending within the timeout, is followed by the next.
+type RequestConfig struct {
+	// Timeout is how long a peer has to start sending the object
+	Timeout time.Duration
+	// Attempts is how many peers are asked before giving up
+	Attempts int
+}
+
+// DefaultRequestConfig returns a config that asks up to 3 peers, giving each
+// DefaultFetchTimeout to answer
+func DefaultRequestConfig() RequestConfig {
+	return RequestConfig{
+		Timeout:  DefaultFetchTimeout,
+		Attempts: 3,
+	}
+}
+
+// WithRequests sets the timeout and attempts for requesting objects
+func WithRequests(cfg RequestConfig) Option {
+	return func(n *Node) {
+		n.requestConfig = cfg
+	}
+}
+
+// pendingRequests correlates the errors peers answer requests with to the
+// requests waiting on them, and to the objects asked for by requests no
+// call waits on
+type pendingRequests struct {
+	mu      sync.Mutex
+	waiting map[string]chan error   // by request ID
+	noted   map[string]notedRequest // by request ID
+}
+
+type notedRequest struct {
+	request protocol.DataRequest
+	trace   string
+	sent    time.Time
+}
+
+func newPendingRequests() *pendingRequests {
+	return &pendingRequests{
+		waiting: make(map[string]chan error),
+		noted:   make(map[string]notedRequest),
+	}
+}
+
+func (p *pendingRequests) add(id string) <-chan error {
+	answer := make(chan error, 1)
+	p.mu.Lock()
+	p.waiting[id] = answer
+	p.mu.Unlock()
+	return answer
+}
+
+func (p *pendingRequests) remove(id string) {
+	p.mu.Lock()
+	delete(p.waiting, id)
+	p.mu.Unlock()
+}
+
+// resolve hands err to the request with the given ID, reporting false if no
+// request is waiting on it
+func (p *pendingRequests) resolve(id string, err error) bool {
+	p.mu.Lock()
+	answer, ok := p.waiting[id]
+	delete(p.waiting, id)
+	p.mu.Unlock()
+	if ok {
+		answer <- err
+	}
+	return ok
+}
+
+// replies hands the messages answering requests to the calls waiting on
+// them, such as the pages of a listing
+type replies[T any] struct {
+	mu      sync.Mutex
+	pending map[string]chan T // by request ID
+}
+
+func newReplies[T any]() *replies[T] {
+	return &replies[T]{pending: make(map[string]chan T)}
+}
+
+func (r *replies[T]) add(id string) <-chan T {
+	answer := make(chan T, 1)
+	r.mu.Lock()
+	r.pending[id] = answer
+	r.mu.Unlock()
+	return answer
+}
+
+func (r *replies[T]) remove(id string) {
+	r.mu.Lock()
+	delete(r.pending, id)
+	r.mu.Unlock()
+}
+
+// resolve hands a reply to the call waiting on it, reporting whether one was
+func (r *replies[T]) resolve(id string, reply T) bool {
+	r.mu.Lock()
+	answer, ok := r.pending[id]
+	delete(r.pending, id)
+	r.mu.Unlock()
+	if ok {
+		answer <- reply
+	}
+	return ok
+}
+
+// note remembers a request no call waits on, forgetting requests sent
+// longer than requestNoteExpiry ago
+func (p *pendingRequests) note(id string, request protocol.DataRequest, trace string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for old, r := range p.noted {
+		if now.Sub(r.sent) > requestNoteExpiry {
+			delete(p.noted, old)
+		}
+	}
+	p.noted[id] = notedRequest{request: request, trace: trace, sent: now}
+}
+
+// take returns and forgets a noted request
+func (p *pendingRequests) take(id string) (notedRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r, ok := p.noted[id]
+	delete(p.noted, id)
+	return r, ok
+}
+
+// requestError turns an error answering a request into an error, wrapping
+// the Err value matching its code
+func requestError(payload protocol.ErrorPayload) error {
+	var sentinel error
+	switch payload.Code {
+	case protocol.ErrorCodeNotFound:
+		sentinel = ErrNotFound
+	case protocol.ErrorCodeQuota:
+		sentinel = ErrQuotaExceeded
+	case protocol.ErrorCodeUnauthorized:
+		sentinel = ErrUnauthorized
+	case protocol.ErrorCodeRange:
+		sentinel = ErrInvalidRange
+	case protocol.ErrorCodeBusy:
+		sentinel = ErrBusy
+	default:
+		return fmt.Errorf("%s: %s", payload.Code, payload.Message)
+	}
+	return fmt.Errorf("%w: %s", sentinel, payload.Message)
+}
+
+// sendDataRequest sends a data request no call waits on, as part of trace.
+// It carries a request ID so the peer can answer why it can't be served;
+// see requestRefused.
+func (n *Node) sendDataRequest(peer *network.Peer, request protocol.DataRequest, trace string) error {
+	requestID, err := protocol.NewMessageID()
+	if err != nil {
+		return err
+	}
+	n.windowed(n.nodeID(peer), &request)
+	msg, err := protocol.NewMessage(protocol.MessageTypeDataRequest, n.ID, request)
+	if err != nil {
+		return fmt.Errorf("failed to create data request: %w", err)
+	}
+	msg.RequestID = requestID
+	msg.TraceID = trace
+
+	n.requests.note(requestID, request, trace)
+	return peer.Send(msg)
+}
+
+// requestRefused handles a peer's refusal of a data request no call waits
+// on: the transfer it was for fails now rather than timing out, and a relay
+// fetch passes the refusal on to its requesters. A peer busy sending other
+// transfers is asked again after busyRetryDelay.
+func (n *Node) requestRefused(peer *network.Peer, requestID string, payload protocol.ErrorPayload) bool {
+	noted, ok := n.requests.take(requestID)
+	if !ok {
+		return false
+	}
+	err := requestError(payload)
+	hash := noted.request.ContentHash
+	if errors.Is(err, ErrBusy) {
+		n.debugf("Peer %s is busy, asking for %s again in %v\n", peer.ID(), hash, busyRetryDelay)
+		time.AfterFunc(busyRetryDelay, func() {
+			if err := n.sendDataRequest(peer, noted.request, noted.trace); err != nil {
+				fmt.Printf("Failed to request %s from %s again: %v\n", hash, peer.ID(), err)
+			}
+		})
+		return true
+	}
+	fmt.Printf("Peer %s can't send %s: %v\n", peer.ID(), hash, err)
+
+	transferKey := fmt.Sprintf("%s-%s", peer.ID(), hash)
+	n.mu.RLock()
+	state, transferring := n.transfers[transferKey]
+	n.mu.RUnlock()
+	if transferring {
+		n.abortTransfer(transferKey, state, hash, err)
+	}
+	n.refuseRelay(peer, hash, payload)
+	n.emit(Event{Type: EventTransferFailed, PeerID: peer.ID(), ContentHash: hash, Direction: DirectionDownload, Error: err.Error()})
+	return true
+}
+
+// refuseRequest tells a peer why its request can't be answered. Requests
+// without an ID come from peers that predate them and would take the error
+// for a refused connection, so they get no answer.
+func (n *Node) refuseRequest(peer *network.Peer, msg *protocol.Message, code, message string) {
+	if msg.RequestID == "" {
+		return
+	}
+	reply, err := protocol.NewMessage(protocol.MessageTypeError, n.ID, protocol.ErrorPayload{Code: code, Message: message})
+	if err != nil {
+		return
+	}
+	reply.RequestID = msg.RequestID
+	reply.TraceID = msg.TraceID
+	if err := peer.Send(reply); err != nil {
+		n.debugf("Failed to answer request from %s: %v\n", peer.ID(), err)
+	}
+}
+
+// fetch stores an object held by peers, asking them in turn, and waits
+// until it is stored. Each peer has timeout to start sending it, and to send
+// each chunk after.
+func (n *Node) fetch(hash string, timeout time.Duration) error {
+	return n.fetchAt(hash, protocol.PriorityBulk, timeout)
+}
+
+// fetchAt fetches an object like fetch, asking for it at priority
+func (n *Node) fetchAt(hash string, priority int, timeout time.Duration) error {
+	if n.hasObject(hash) {
+		return nil
+	}
+
+	events, cancel := n.Subscribe()
+	defer cancel()
+
+	peers := n.requestOrder(hash)
+	if len(peers) == 0 {
+		return fmt.Errorf("failed to fetch %s: no peers connected", hash)
+	}
+	attempts := max(n.requestConfig.Attempts, 1)
+	var errs []error
+	for _, id := range peers[:min(attempts, len(peers))] {
+		err := n.requestFrom(id, hash, priority, timeout, events)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-n.done:
+			return err
+		default:
+		}
+		n.debugf("Request for %s to %s failed: %v\n", hash, id, err)
+		errs = append(errs, fmt.Errorf("%s: %w", id, err))
+	}
+	return fmt.Errorf("failed to fetch %s: %w", hash, errors.Join(errs...))
+}
+
+// requestOrder returns the connected peers to ask for an object: those
+// whose inventories list it first, then those that relay, derated peers
+// last. Within each, peers with the lowest round trip come first.
+func (n *Node) requestOrder(hash string) []string {
+	peers := n.byScore(n.byLatency(n.connectedPeers()))
+	holders := make([]string, 0, len(peers))
+	var relays, others []string
+	for _, id := range peers {
+		switch {
+		case n.replicas.holds(id, hash):
+			holders = append(holders, id)
+		case n.peerCapabilities(id).Relay:
+			relays = append(relays, id)
+		default:
+			others = append(others, id)
+		}
+	}
+	return append(append(holders, relays...), others...)
+}
+
+// requestFrom asks one peer for an object and waits until it is stored, the
+// peer answers that it can't send it, its transfer fails, or it goes timeout
+// without sending a chunk. Events must be subscribed before the call.
+func (n *Node) requestFrom(id, hash string, priority int, timeout time.Duration, events <-chan Event) error {
+	peer, ok := n.peerConn(id)
+	if !ok {
+		return fmt.Errorf("not connected")
+	}
+	requestID, err := protocol.NewMessageID()
+	if err != nil {
+		return err
+	}
+	request := protocol.DataRequest{
+		ContentHash: hash,
+		FromWatch:   true, // store the object rather than decrypting it to downloads/
+		Priority:    priority,
+	}
+	n.windowed(id, &request)
+	msg, err := protocol.NewMessage(protocol.MessageTypeDataRequest, n.ID, request)
+	if err != nil {
+		return fmt.Errorf("failed to create request message: %w", err)
+	}
+	msg.RequestID = requestID
+	msg.TraceID = n.traceID(nil)
+
+	answer := n.requests.add(requestID)
+	defer n.requests.remove(requestID)
+	if err := peer.Send(msg); err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	restart := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(timeout)
+	}
+	// Events may be dropped under load, so also poll the store, and the
+	// transfer for chunks received since the last poll
+	poll := time.NewTicker(min(time.Second, max(timeout/2, time.Millisecond)))
+	defer poll.Stop()
+	received := 0
+	for {
+		select {
+		case err := <-answer:
+			return err
+		case event := <-events:
+			if event.ContentHash != hash {
+				continue
+			}
+			switch event.Type {
+			case EventTransferStarted:
+				if event.PeerID == peer.ID() {
+					restart()
+				}
+			case EventFileStored:
+				return nil
+			case EventTransferFailed:
+				if event.PeerID == peer.ID() {
+					return fmt.Errorf("transfer failed: %s", event.Error)
+				}
+			}
+		case <-poll.C:
+			if n.hasObject(hash) {
+				return nil
+			}
+			if chunks := n.chunksReceived(peer, hash); chunks > received {
+				received = chunks
+				restart()
+			}
+		case <-timer.C:
+			if n.hasObject(hash) {
+				return nil
+			}
+			if received > 0 {
+				return fmt.Errorf("no chunk within %v", timeout)
+			}
+			return fmt.Errorf("no answer within %v", timeout)
+		case <-n.done:
+			return fmt.Errorf("node stopped")
+		}
+	}
+}
+
+// chunksReceived reports how many chunks of an object a peer has sent in
+// its transfer, zero if there is none
+func (n *Node) chunksReceived(peer *network.Peer, hash string) int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if state, ok := n.transfers[fmt.Sprintf("%s-%s", peer.ID(), hash)]; ok {
+		return state.received
+	}
+	return 0
+}
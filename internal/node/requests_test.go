@@ -0,0 +1,296 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+func TestPendingRequests(t *testing.T) {
+	p := newPendingRequests()
+
+	if p.resolve("unknown", nil) {
+		t.Error("resolve() = true for a request nobody waits on")
+	}
+
+	answer := p.add("req")
+	if !p.resolve("req", ErrNotFound) {
+		t.Fatal("resolve() = false for a pending request")
+	}
+	if err := <-answer; !errors.Is(err, ErrNotFound) {
+		t.Errorf("Answer = %v, want %v", err, ErrNotFound)
+	}
+	if p.resolve("req", nil) {
+		t.Error("resolve() = true for a request already answered")
+	}
+}
+
+func TestRequestError(t *testing.T) {
+	err := requestError(protocol.ErrorPayload{Code: protocol.ErrorCodeNotFound, Message: "no copy of abc"})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("requestError(not_found) = %v, want %v", err, ErrNotFound)
+	}
+	for code, want := range map[string]error{
+		protocol.ErrorCodeQuota:        ErrQuotaExceeded,
+		protocol.ErrorCodeUnauthorized: ErrUnauthorized,
+		protocol.ErrorCodeRange:        ErrInvalidRange,
+		protocol.ErrorCodeBusy:         ErrBusy,
+	} {
+		if err := requestError(protocol.ErrorPayload{Code: code}); !errors.Is(err, want) {
+			t.Errorf("requestError(%s) = %v, want %v", code, err, want)
+		}
+	}
+	if err := requestError(protocol.ErrorPayload{Code: "other"}); errors.Is(err, ErrNotFound) {
+		t.Errorf("requestError(other) = %v, want an error other than %v", err, ErrNotFound)
+	}
+}
+
+func TestNode_RefusedRequestFailsTransfer(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	holder, err := NewNode("holder", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer holder.Stop()
+	holder.transport.Start()
+
+	requester, err := NewNode("requester", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer requester.Stop()
+	requester.transport.Start()
+
+	if err := requester.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := requester.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	peer, ok := requester.peerConn("holder")
+	if !ok {
+		t.Fatal("Holder is not connected")
+	}
+
+	events, unsubscribe := requester.Subscribe()
+	defer unsubscribe()
+	hash := strings.Repeat("e", 40)
+	if err := requester.sendDataRequest(peer, protocol.DataRequest{ContentHash: hash}, ""); err != nil {
+		t.Fatalf("sendDataRequest() error = %v", err)
+	}
+
+	event := waitForEvent(t, events, EventTransferFailed, 2*time.Second)
+	if event.ContentHash != hash || !strings.Contains(event.Error, ErrNotFound.Error()) {
+		t.Errorf("Failed transfer of %s with %q, want %s with %q", event.ContentHash, event.Error, hash, ErrNotFound)
+	}
+}
+
+func TestNode_BusyRequestIsSentAgain(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	holder, err := NewNode("holder", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer holder.Stop()
+	holder.transport.Start()
+
+	requester, err := NewNode("requester", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer requester.Stop()
+	requester.transport.Start()
+
+	if err := requester.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := requester.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	peer, ok := requester.peerConn("holder")
+	if !ok {
+		t.Fatal("Holder is not connected")
+	}
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "sent once the holder has room")
+	hash, err := holder.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	// The holder is already sending the requester all it will at once
+	for i := 0; i < maxWindowedUploads; i++ {
+		holder.credits.acquire("requester")
+	}
+
+	if err := requester.requestObject(peer, hash, true, ""); err != nil {
+		t.Fatalf("requestObject() error = %v", err)
+	}
+	time.Sleep(busyRetryDelay / 2)
+	if requester.store.Exists(hash) {
+		t.Fatal("Busy holder sent the object")
+	}
+	holder.credits.release("requester")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !requester.store.Exists(hash) {
+		if time.Now().After(deadline) {
+			t.Fatal("Request refused as busy was not sent again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNode_FetchAsksNextPeerWhenNotFound(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	// No inventories, so the requester doesn't know which peer holds the
+	// object and asks the one without it first
+	replication := WithReplication(ReplicationConfig{Target: 2})
+	newTestNode := func(id string, first bool) *Node {
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"), WithFirstNode(first), replication)
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		n.transport.Start()
+		return n
+	}
+
+	holder := newTestNode("b-holder", true)
+	defer holder.Stop()
+	empty := newTestNode("a-empty", false)
+	defer empty.Stop()
+	requester := newTestNode("requester", false)
+	defer requester.Stop()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "held by one peer only")
+	hash, err := holder.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	if err := requester.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := requester.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	if err := requester.Connect(context.Background(), empty.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(requester.connectedPeers()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Requester did not connect to both peers")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if order := requester.requestOrder(hash); order[0] != "a-empty" {
+		t.Fatalf("requestOrder() = %v, want a-empty first", order)
+	}
+
+	// The empty peer answers at once, well before the timeout
+	timeout := 10 * time.Second
+	start := time.Now()
+	if err := requester.fetch(hash, timeout); err != nil {
+		t.Fatalf("fetch() error = %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= timeout {
+		t.Errorf("fetch() took %v, want the peer without a copy to answer before the %v timeout", elapsed, timeout)
+	}
+
+	// Asking only the peer without a copy fails with its answer
+	missing := "0000000000000000000000000000000000000000000000000000000000000000"
+	requester.requestConfig.Attempts = 1
+	if err := requester.fetch(missing, timeout); !errors.Is(err, ErrNotFound) {
+		t.Errorf("fetch() error = %v, want %v", err, ErrNotFound)
+	}
+}
+
+func TestNode_FetchPassesOverStalledTransfer(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	newTestNode := func(id string, first bool, opts ...Option) *Node {
+		opts = append(opts, WithFirstNode(first), WithReplication(ReplicationConfig{Target: 2}))
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"), opts...)
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		n.transport.Start()
+		return n
+	}
+
+	holder := newTestNode("b-holder", true)
+	defer holder.Stop()
+	stalled := newTestNode("a-stalled", false)
+	defer stalled.Stop()
+	requester := newTestNode("requester", false, WithMaxChunkSize(protocol.MinChunkSize))
+	defer requester.Stop()
+
+	if err := stalled.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := stalled.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, strings.Repeat("more than one chunk ", 4000))
+	hash, err := holder.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	if err := stalled.fetch(hash, 5*time.Second); err != nil {
+		t.Fatalf("Failed to fetch: %v", err)
+	}
+
+	// The stalled peer sends its first chunk and then nothing more
+	release := make(chan struct{})
+	defer close(release)
+	var once sync.Once
+	stalled.SetTap(func(e network.TapEvent) {
+		if e.Sent && e.Type == protocol.MessageTypeDataTransfer {
+			once.Do(func() { <-release })
+		}
+	})
+
+	for _, n := range []*Node{holder, stalled} {
+		if err := requester.Connect(context.Background(), n.Address()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(requester.connectedPeers()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Requester did not connect to both peers")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if order := requester.requestOrder(hash); order[0] != "a-stalled" {
+		t.Fatalf("requestOrder() = %v, want a-stalled first", order)
+	}
+
+	fetched := make(chan error, 1)
+	go func() { fetched <- requester.fetch(hash, 500*time.Millisecond) }()
+	select {
+	case err := <-fetched:
+		if err != nil {
+			t.Fatalf("fetch() error = %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("fetch() still waits on the stalled transfer")
+	}
+}
@@ -0,0 +1,116 @@
+package node
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// maxResends is how many times the missing chunks of a transfer are asked
+// for again before it is finalized with its gaps, and fails
+const maxResends = 3
+
+// resendDelay is how long a transfer whose final chunk arrived with gaps
+// waits for chunks still on their way before asking for them again. Chunks
+// may overtake each other, such as small ones sent whole between the
+// fragments of a larger one.
+const resendDelay = 500 * time.Millisecond
+
+// missingChunks returns the chunks of a transfer that haven't arrived, at
+// most protocol.MaxResendChunks of them. The caller holds n.mu.
+func (state *transferState) missingChunks() []int {
+	var missing []int
+	for i := 0; i < state.count && len(missing) < protocol.MaxResendChunks; i++ {
+		if !state.chunks[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+// claimTransfer reports whether a transfer's final chunk and every chunk
+// before it arrived, claiming it for completion so that it is completed
+// only once, whichever chunk arrives last
+func (n *Node) claimTransfer(state *transferState) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if !state.final || state.finishing || len(state.missingChunks()) > 0 {
+		return false
+	}
+	state.finishing = true
+	return true
+}
+
+// resendMissing asks the sender of a transfer whose final chunk arrived
+// with gaps for the chunks still missing. The last chunk sent again comes
+// as the final one, so the transfer is checked once more when it arrives.
+// Once they have been asked for maxResends times, the transfer is
+// completed with its gaps, and fails.
+func (n *Node) resendMissing(peer *network.Peer, transferKey string, state *transferState) error {
+	n.mu.Lock()
+	if n.transfers[transferKey] != state || state.finishing {
+		n.mu.Unlock()
+		return nil
+	}
+	missing := state.missingChunks()
+	if len(missing) == 0 {
+		n.mu.Unlock()
+		return nil
+	}
+	if state.resends >= maxResends {
+		state.finishing = true
+		n.mu.Unlock()
+		return n.completeTransfer(peer, transferKey, state)
+	}
+	state.resends++
+	n.mu.Unlock()
+
+	n.debugf("Asking %s again for %d missing chunks of %s\n", peer.ID(), len(missing), state.hash)
+	err := n.sendDataRequest(peer, protocol.DataRequest{
+		ContentHash: state.hash,
+		FromWatch:   state.fromWatch,
+		Relayed:     state.relay,
+		Chunks:      missing,
+		ChunkSize:   state.chunkSize,
+		Priority:    state.priority,
+	}, "")
+	if err != nil {
+		return fmt.Errorf("failed to request missing chunks of %s: %w", state.hash, err)
+	}
+	return nil
+}
+
+// resendOrder returns the chunks a request asks for again, sorted and
+// without duplicates, or nil if it asks for the whole object
+func resendOrder(chunks []int) []int {
+	if len(chunks) == 0 {
+		return nil
+	}
+	order := append([]int(nil), chunks...)
+	sort.Ints(order)
+	unique := order[:1]
+	for _, index := range order[1:] {
+		if index != unique[len(unique)-1] {
+			unique = append(unique, index)
+		}
+	}
+	return unique
+}
+
+// skipBytes moves a reader n bytes ahead, seeking if it can
+func skipBytes(r io.Reader, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	if seeker, ok := r.(io.Seeker); ok {
+		_, err := seeker.Seek(n, io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
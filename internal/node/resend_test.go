@@ -0,0 +1,93 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+func TestNode_ResendsMissingChunks(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	sender, err := NewNode("sender", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer sender.Stop()
+	sender.transport.Start()
+
+	receiver, err := NewNode("receiver", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer receiver.Stop()
+	receiver.transport.Start()
+
+	if err := receiver.Connect(context.Background(), sender.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := receiver.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	peer, ok := receiver.peerConn("sender")
+	if !ok {
+		t.Fatal("Sender is not connected")
+	}
+
+	data := make([]byte, 3*protocol.MinChunkSize+100)
+	rand.Read(data)
+	hash, err := crypto.ContentHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to hash object: %v", err)
+	}
+	if err := sender.store.Store(hash, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to store object: %v", err)
+	}
+
+	events, unsubscribe := receiver.Subscribe()
+	defer unsubscribe()
+
+	// Chunk 1 is lost on the way; the final chunk has the receiver ask for it
+	for _, index := range []int{0, 2, 3} {
+		start := index * protocol.MinChunkSize
+		chunk := &protocol.DataTransfer{
+			ContentHash: hash,
+			Data:        data[start:min(start+protocol.MinChunkSize, len(data))],
+			ChunkIndex:  index,
+			FinalChunk:  index == 3,
+			FromWatch:   true,
+			TotalSize:   int64(len(data)),
+			ChunkSize:   protocol.MinChunkSize,
+		}
+		if err := receiver.HandleTransfer(peer, chunk); err != nil {
+			t.Fatalf("HandleTransfer(%d) error = %v", index, err)
+		}
+	}
+
+	waitForEvent(t, events, EventFileStored, 5*time.Second)
+	if !receiver.store.Exists(hash) {
+		t.Fatal("Object not stored after the missing chunk was sent again")
+	}
+	for _, e := range sender.Ledger() {
+		if e.PeerID == "receiver" && e.Sent > protocol.MinChunkSize {
+			t.Errorf("Sender sent %d bytes again, want only the missing chunk's %d", e.Sent, protocol.MinChunkSize)
+		}
+	}
+}
+
+func TestResendOrder(t *testing.T) {
+	if got := resendOrder(nil); got != nil {
+		t.Errorf("resendOrder(nil) = %v, want nil", got)
+	}
+	if got, want := resendOrder([]int{5, 1, 3, 1, 5}), []int{1, 3, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resendOrder() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,258 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+// DefaultFetchTimeout is how long to wait for a peer to start sending an
+// object that is not stored locally
+const DefaultFetchTimeout = 30 * time.Second
+
+// errOutsideDest refuses restoring a path that would land outside the
+// destination, by its name or through a symlink on the way to it
+var errOutsideDest = errors.New("refusing to write outside the destination")
+
+// RestoreResult summarizes a restore
+type RestoreResult struct {
+	Files  int
+	Bytes  int64
+	Failed int
+	Errors []string
+	// Incremental is set when only the changes since the manifest version
+	// last restored to the destination were applied
+	Incremental bool
+	Removed     int
+	Skipped     int // changed in the destination since the last restore
+}
+
+// Restore recreates the object with the given hash under dest. A directory
+// manifest is expanded into its original hierarchy with file modes and
+// modification times; any other object is written under its cataloged name.
+// Objects missing locally are fetched from peers first. A destination
+// restored from an earlier version of a manifest is synced with the change
+// sets published since. Files changed in the destination since they were
+// restored are left alone.
+func (n *Node) Restore(hash, dest string) (*RestoreResult, error) {
+	if err := n.waitForKey(10 * time.Second); err != nil {
+		return nil, fmt.Errorf("failed waiting for network key: %w", err)
+	}
+	absDest, err := filepath.Abs(dest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve destination: %w", err)
+	}
+	if result, ok := n.syncRestore(hash, absDest); ok {
+		return result, nil
+	}
+	if err := n.fetchAt(hash, protocol.PriorityInteractive, n.requestConfig.Timeout); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create destination: %w", err)
+	}
+
+	meta, known := n.catalog.get(hash)
+	if known && !meta.Manifest {
+		return n.restoreFile(hash, dest, meta)
+	}
+
+	var buf bytes.Buffer
+	if err := n.readObject(hash, &buf); err != nil {
+		return nil, err
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil || manifest.Root == "" {
+		if known {
+			return nil, fmt.Errorf("object %s is not a valid manifest", hash)
+		}
+		// Not a manifest and no name on record
+		return n.restoreFile(hash, dest, FileMeta{Hash: hash, Name: hash})
+	}
+
+	// Links are created after all files so that a link to a directory can
+	// never redirect where a later file is written
+	sort.SliceStable(manifest.Entries, func(i, j int) bool {
+		return manifest.Entries[i].Link == "" && manifest.Entries[j].Link != ""
+	})
+
+	result := &RestoreResult{}
+	record := syncRecord{Manifest: hash, PublicKey: manifest.PublicKey, Files: make(map[string]restoredFile)}
+	for _, entry := range manifest.Entries {
+		if err := n.restoreEntry(entry, dest); err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", entry.Path, err))
+			continue
+		}
+		record.record(absDest, entry.Path)
+		result.Files++
+		result.Bytes += entry.Size
+	}
+	if result.Failed == 0 {
+		if err := n.sync.restored(absDest, record); err != nil {
+			fmt.Printf("Failed to record sync of %s: %v\n", dest, err)
+		}
+	}
+	return result, nil
+}
+
+func (n *Node) restoreFile(hash, dest string, meta FileMeta) (*RestoreResult, error) {
+	name := meta.Name
+	if !filepath.IsLocal(name) || filepath.Base(name) != name {
+		name = hash
+	}
+	entry := ManifestEntry{Path: name, Hash: hash, Size: meta.Size, Mode: 0644, ModTime: meta.ModTime, Link: meta.Link}
+	if err := n.restoreEntry(entry, dest); err != nil {
+		return nil, err
+	}
+	return &RestoreResult{Files: 1, Bytes: meta.Size}, nil
+}
+
+// restoreEntry fetches and decrypts one manifest entry to its path under dest
+func (n *Node) restoreEntry(entry ManifestEntry, dest string) error {
+	target, err := pathUnder(dest, entry.Path)
+	if err != nil {
+		return err
+	}
+	if entry.Link != "" {
+		return restoreLink(entry, target)
+	}
+	if err := n.fetchAt(entry.Hash, protocol.PriorityInteractive, n.requestConfig.Timeout); err != nil {
+		return err
+	}
+	// Checked again, since links restored while the object was fetched
+	// may have changed where the path leads
+	if target, err = pathUnder(dest, entry.Path); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tempFile, err := os.CreateTemp(filepath.Dir(target), ".restore-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+
+	// Manifests record how each entry is encrypted; change sets do not, so
+	// their entries rely on the catalog
+	key, err := n.objectKey(entry.Hash)
+	if entry.Encryption != "" {
+		key, err = n.keyFor(entry.Encryption, entry.Key)
+	}
+	if err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to decrypt %s: %w", entry.Hash, err)
+	}
+	if err := n.readObjectWith(entry.Hash, key, tempFile); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+
+	mode := entry.Mode.Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := os.Chmod(tempFile.Name(), mode); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+	if !entry.ModTime.IsZero() {
+		if err := os.Chtimes(tempFile.Name(), entry.ModTime, entry.ModTime); err != nil {
+			return fmt.Errorf("failed to set modification time: %w", err)
+		}
+	}
+	return os.Rename(tempFile.Name(), target)
+}
+
+// pathUnder returns where the manifest path lands under dest. Paths that
+// leave dest by name are refused, as are those whose directory, as far as
+// it exists, resolves outside dest through a symlink, such as one restored
+// earlier. The last element is not followed: a file or link restored there
+// replaces a symlink rather than writing through it.
+func pathUnder(dest, path string) (string, error) {
+	rel := filepath.FromSlash(path)
+	if !filepath.IsLocal(rel) {
+		return "", errOutsideDest
+	}
+	root, err := filepath.EvalSymlinks(dest)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve destination: %w", err)
+	}
+	target := filepath.Join(dest, rel)
+
+	// Directories still missing are created as plain ones, so the deepest
+	// that exists decides where the path leads
+	dir := filepath.Dir(target)
+	for {
+		_, err := os.Lstat(dir)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) || dir == dest {
+			return "", err
+		}
+		dir = filepath.Dir(dir)
+	}
+	resolved, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errOutsideDest, err)
+	}
+	inside, err := filepath.Rel(root, resolved)
+	if err != nil || (inside != "." && !filepath.IsLocal(inside)) {
+		return "", errOutsideDest
+	}
+	return target, nil
+}
+
+// restoreLink recreates a preserved symlink at target
+func restoreLink(entry ManifestEntry, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(entry.Link, target); err != nil {
+		return fmt.Errorf("failed to create symlink: %w", err)
+	}
+	return nil
+}
+
+// readObject decrypts a locally stored object into w, with the key its
+// catalog entry calls for
+func (n *Node) readObject(hash string, w io.Writer) error {
+	key, err := n.objectKey(hash)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", hash, err)
+	}
+	return n.readObjectWith(hash, key, w)
+}
+
+// readObjectWith decrypts a locally stored object into w with key, or
+// copies it as is if key is nil
+func (n *Node) readObjectWith(hash string, key crypto.Key, w io.Writer) error {
+	n.popularity.record(hash, false)
+	reader, _, err := n.openObject(hash)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", hash, err)
+	}
+	defer reader.Close()
+
+	if err := decryptObject(key, reader, w); err != nil {
+		return fmt.Errorf("failed to decrypt %s: %w", hash, err)
+	}
+	return nil
+}
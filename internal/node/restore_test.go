@@ -0,0 +1,235 @@
+package node
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNode_RestoreTree(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	src := filepath.Join(baseDir, "src")
+	files := map[string]string{
+		"readme.md":        "top level",
+		"docs/guide.md":    "guide",
+		"docs/img/logo.sv": "logo",
+	}
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("Failed to write file: %v", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("Failed to set mtime: %v", err)
+		}
+	}
+
+	imported, err := node.Import(src)
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+
+	dest := filepath.Join(baseDir, "restored")
+	result, err := node.Restore(imported.Manifest, dest)
+	if err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	if result.Files != len(files) || result.Failed != 0 {
+		t.Errorf("Restore = %d files, %d failed, want %d, 0", result.Files, result.Failed, len(files))
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dest, filepath.FromSlash(name))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("Failed to read restored %s: %v", name, err)
+			continue
+		}
+		if string(data) != content {
+			t.Errorf("%s content = %q, want %q", name, data, content)
+		}
+		info, _ := os.Stat(path)
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("%s mode = %v, want %v", name, info.Mode().Perm(), os.FileMode(0600))
+		}
+		if !info.ModTime().Equal(modTime) {
+			t.Errorf("%s mtime = %v, want %v", name, info.ModTime(), modTime)
+		}
+	}
+}
+
+func TestNode_RestoreRejectsEscapingPaths(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	path := filepath.Join(baseDir, "payload")
+	if err := os.WriteFile(path, []byte("payload"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	hash, err := node.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	manifestHash, err := node.storeManifest(Manifest{
+		Root:    "evil",
+		Entries: []ManifestEntry{{Path: "../escaped", Hash: hash}},
+	}, "")
+	if err != nil {
+		t.Fatalf("Failed to store manifest: %v", err)
+	}
+
+	dest := filepath.Join(baseDir, "dest")
+	result, err := node.Restore(manifestHash, dest)
+	if err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	if result.Failed != 1 {
+		t.Errorf("Failed = %v, want %v", result.Failed, 1)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "escaped")); !os.IsNotExist(err) {
+		t.Error("Manifest entry was written outside the destination")
+	}
+}
+
+func TestNode_RestoreRefusesPathsThroughLinks(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	path := filepath.Join(baseDir, "payload")
+	if err := os.WriteFile(path, []byte("payload"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	hash, err := node.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	// The destination already holds links, one leading out of it and one
+	// staying inside
+	outside := filepath.Join(baseDir, "outside")
+	dest := filepath.Join(baseDir, "dest")
+	for _, dir := range []string{outside, filepath.Join(dest, "sub")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+	if err := os.Symlink(outside, filepath.Join(dest, "pre")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Symlink("sub", filepath.Join(dest, "in")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	manifestHash, err := node.storeManifest(Manifest{
+		Root: "evil",
+		Entries: []ManifestEntry{
+			{Path: "pre/planted", Hash: hash},
+			{Path: "in/kept", Hash: hash},
+			// A link restored first redirects the one after it
+			{Path: "out", Link: outside},
+			{Path: "out/linked", Link: path},
+		},
+	}, "")
+	if err != nil {
+		t.Fatalf("Failed to store manifest: %v", err)
+	}
+
+	result, err := node.Restore(manifestHash, dest)
+	if err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	if result.Failed != 2 || result.Files != 2 {
+		t.Errorf("Restored %d and failed %d, want 2 each: %v", result.Files, result.Failed, result.Errors)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("Restore wrote %d entries outside the destination through a link", len(entries))
+	}
+	if _, err := os.Stat(filepath.Join(dest, "sub", "kept")); err != nil {
+		t.Errorf("Entry behind a link inside the destination was not restored: %v", err)
+	}
+}
+
+func TestNode_RestoreFetchesFromPeer(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer second.Stop()
+	second.transport.Start()
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := second.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	path := filepath.Join(baseDir, "shared.txt")
+	if err := os.WriteFile(path, []byte("shared content"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	hash, err := first.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	dest := filepath.Join(baseDir, "dest")
+	if _, err := second.Restore(hash, dest); err != nil {
+		t.Fatalf("Failed to restore from peer: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dest, hash))
+	if err != nil {
+		t.Fatalf("Failed to read restored file: %v", err)
+	}
+	if string(data) != "shared content" {
+		t.Errorf("Content = %q, want %q", data, "shared content")
+	}
+}
+
+// freeAddr returns a loopback address with a currently unused port
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
@@ -0,0 +1,220 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// resumeFile is where interrupted downloads are kept, under the node's data
+// directory
+const resumeFile = "transfers.json"
+
+// resumeMaxAge is how long an interrupted download waits for its sender to
+// reconnect before its partial file is dropped
+const resumeMaxAge = 24 * time.Hour
+
+// interruptedTransfer is an incoming transfer cut off by a disconnect or a
+// restart, as kept across restarts
+type interruptedTransfer struct {
+	PeerID      string `json:"peer_id"` // the sender's peer.ID()
+	ContentHash string `json:"content_hash"`
+	TempFile    string `json:"temp_file"`
+	// Received is a bitmap of the chunks written to TempFile, by index at
+	// ChunkSize
+	Received  []byte    `json:"received"`
+	ChunkSize int       `json:"chunk_size"`
+	Size      int64     `json:"size"`
+	Bytes     int64     `json:"bytes"`
+	FromWatch bool      `json:"from_watch,omitempty"`
+	Plaintext bool      `json:"plaintext,omitempty"`
+	Priority  int       `json:"priority,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// chunkBitmap packs a set of chunk indexes into a bitmap
+func chunkBitmap(chunks map[int]bool) []byte {
+	last := -1
+	for index := range chunks {
+		last = max(last, index)
+	}
+	bitmap := make([]byte, last/8+1)
+	for index, ok := range chunks {
+		if ok {
+			bitmap[index/8] |= 1 << (index % 8)
+		}
+	}
+	return bitmap
+}
+
+// bitmapChunks unpacks a bitmap from chunkBitmap
+func bitmapChunks(bitmap []byte) map[int]bool {
+	chunks := make(map[int]bool)
+	for i, b := range bitmap {
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<bit) != 0 {
+				chunks[i*8+bit] = true
+			}
+		}
+	}
+	return chunks
+}
+
+// firstMissing returns the index of the first chunk of a transfer that
+// hasn't arrived
+func firstMissing(chunks map[int]bool) int {
+	index := 0
+	for chunks[index] {
+		index++
+	}
+	return index
+}
+
+// suspendTransfers marks the downloads from a peer that just disconnected,
+// by its peer.ID(), as interrupted, keeping their partial files for when it
+// reconnects, and reports how many there were. Relayed downloads are left
+// as they are.
+func (n *Node) suspendTransfers(peerID string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	suspended := 0
+	for _, state := range n.transfers {
+		if state.peerID == peerID && !state.relay && state.suspended.IsZero() {
+			state.suspended = time.Now()
+			suspended++
+		}
+	}
+	return suspended
+}
+
+// saveTransfers persists the downloads under way, so those interrupted
+// can resume after a restart
+func (n *Node) saveTransfers() error {
+	n.mu.RLock()
+	interrupted := make([]interruptedTransfer, 0, len(n.transfers))
+	for _, state := range n.transfers {
+		if state.relay {
+			continue
+		}
+		since := state.suspended
+		if since.IsZero() {
+			since = time.Now()
+		}
+		interrupted = append(interrupted, interruptedTransfer{
+			PeerID:      state.peerID,
+			ContentHash: state.hash,
+			TempFile:    state.tempFile.Name(),
+			Received:    chunkBitmap(state.chunks),
+			ChunkSize:   state.chunkSize,
+			Size:        state.size,
+			Bytes:       state.bytes,
+			FromWatch:   state.fromWatch,
+			Plaintext:   state.plaintext,
+			Priority:    state.priority,
+			Since:       since,
+		})
+	}
+	n.mu.RUnlock()
+
+	data, err := json.MarshalIndent(interrupted, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode interrupted transfers: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(n.dataDir, resumeFile), data)
+}
+
+// restoreTransfers reloads the downloads interrupted when the node last
+// stopped, to resume when their senders reconnect. Those too old, or whose
+// partial files are gone, are dropped.
+func (n *Node) restoreTransfers() error {
+	data, err := os.ReadFile(filepath.Join(n.dataDir, resumeFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read interrupted transfers: %w", err)
+	}
+	var interrupted []interruptedTransfer
+	if err := json.Unmarshal(data, &interrupted); err != nil {
+		return fmt.Errorf("failed to parse interrupted transfers: %w", err)
+	}
+
+	for _, t := range interrupted {
+		if time.Since(t.Since) > resumeMaxAge || t.ChunkSize <= 0 {
+			os.Remove(t.TempFile)
+			continue
+		}
+		tempFile, err := os.OpenFile(t.TempFile, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		key := fmt.Sprintf("%s-%s", t.PeerID, t.ContentHash)
+		progress := n.tracker.begin(key, t.PeerID, t.ContentHash, DirectionDownload, t.Size)
+		n.tracker.record(progress, t.Bytes)
+		n.transfers[key] = &transferState{
+			peerID:    t.PeerID,
+			hash:      t.ContentHash,
+			tempFile:  tempFile,
+			chunks:    bitmapChunks(t.Received),
+			size:      t.Size,
+			bytes:     t.Bytes,
+			chunkSize: t.ChunkSize,
+			fromWatch: t.FromWatch,
+			plaintext: t.Plaintext,
+			priority:  t.Priority,
+			progress:  progress,
+			suspended: t.Since,
+		}
+	}
+	return nil
+}
+
+// resumeTransfers asks a peer that reconnected for the rest of the
+// downloads it was sending when it disconnected, from the first chunk
+// missing. Peers that predate resuming send the whole object again.
+func (n *Node) resumeTransfers(peer *network.Peer) {
+	peerID := peer.ID()
+	type resume struct {
+		key   string
+		state *transferState
+		from  int
+	}
+	var resumes, expired []resume
+	n.mu.Lock()
+	for key, state := range n.transfers {
+		if state.peerID != peerID || state.suspended.IsZero() {
+			continue
+		}
+		r := resume{key: key, state: state, from: firstMissing(state.chunks)}
+		if time.Since(state.suspended) > resumeMaxAge {
+			expired = append(expired, r)
+			continue
+		}
+		state.suspended = time.Time{}
+		resumes = append(resumes, r)
+	}
+	n.mu.Unlock()
+
+	for _, r := range expired {
+		n.abortTransfer(r.key, r.state, r.state.hash, fmt.Errorf("sender reconnected after %v", resumeMaxAge))
+	}
+	for _, r := range resumes {
+		n.debugf("Resuming %s from %s at chunk %d\n", r.state.hash, peerID, r.from)
+		err := n.sendDataRequest(peer, protocol.DataRequest{
+			ContentHash: r.state.hash,
+			FromWatch:   r.state.fromWatch,
+			ChunkSize:   r.state.chunkSize,
+			ResumeFrom:  r.from,
+			Priority:    r.state.priority,
+		}, "")
+		if err != nil {
+			fmt.Printf("Failed to resume transfer of %s from %s: %v\n", r.state.hash, peerID, err)
+		}
+	}
+}
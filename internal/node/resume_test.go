@@ -0,0 +1,112 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+func TestChunkBitmap(t *testing.T) {
+	chunks := map[int]bool{0: true, 1: true, 7: true, 8: true, 20: true}
+	if got := bitmapChunks(chunkBitmap(chunks)); !reflect.DeepEqual(got, chunks) {
+		t.Errorf("bitmapChunks(chunkBitmap()) = %v, want %v", got, chunks)
+	}
+	if got := firstMissing(chunks); got != 2 {
+		t.Errorf("firstMissing() = %d, want 2", got)
+	}
+}
+
+func TestNode_ResumesTransferAfterRestart(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	sender, err := NewNode("sender", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer sender.Stop()
+	sender.transport.Start()
+
+	data := make([]byte, 3*protocol.MinChunkSize+100)
+	rand.Read(data)
+	hash, err := crypto.ContentHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to hash object: %v", err)
+	}
+	if err := sender.store.Store(hash, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to store object: %v", err)
+	}
+
+	storeDir, watchDir := filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch")
+	receiver, err := NewNode("receiver", freeAddr(t), storeDir, watchDir, WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	receiver.transport.Start()
+	if err := receiver.Connect(context.Background(), sender.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := receiver.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	peer, ok := receiver.peerConn("sender")
+	if !ok {
+		t.Fatal("Sender is not connected")
+	}
+	key := peer.ID() + "-" + hash
+
+	// The first two chunks arrive before the receiver goes down
+	for index := 0; index < 2; index++ {
+		start := index * protocol.MinChunkSize
+		chunk := &protocol.DataTransfer{
+			ContentHash: hash,
+			Data:        data[start : start+protocol.MinChunkSize],
+			ChunkIndex:  index,
+			FromWatch:   true,
+			TotalSize:   int64(len(data)),
+			ChunkSize:   protocol.MinChunkSize,
+		}
+		if err := receiver.HandleTransfer(peer, chunk); err != nil {
+			t.Fatalf("HandleTransfer(%d) error = %v", index, err)
+		}
+	}
+	receiver.Stop()
+
+	restarted, err := NewNode("receiver", freeAddr(t), storeDir, watchDir, WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer restarted.Stop()
+	restarted.mu.RLock()
+	state, ok := restarted.transfers[key]
+	restarted.mu.RUnlock()
+	if !ok {
+		t.Fatal("Interrupted transfer not restored")
+	}
+	if state.bytes != 2*protocol.MinChunkSize || firstMissing(state.chunks) != 2 {
+		t.Fatalf("Restored %d bytes, first missing chunk %d; want %d bytes and chunk 2", state.bytes, firstMissing(state.chunks), 2*protocol.MinChunkSize)
+	}
+
+	events, unsubscribe := restarted.Subscribe()
+	defer unsubscribe()
+	restarted.transport.Start()
+	if err := restarted.Connect(context.Background(), sender.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	waitForEvent(t, events, EventFileStored, 5*time.Second)
+	if !restarted.store.Exists(hash) {
+		t.Fatal("Object not stored after the transfer resumed")
+	}
+	for _, e := range sender.Ledger() {
+		if e.PeerID == "receiver" && e.Sent > int64(len(data)-2*protocol.MinChunkSize) {
+			t.Errorf("Sender sent %d bytes on resuming, want only the %d missing", e.Sent, len(data)-2*protocol.MinChunkSize)
+		}
+	}
+}
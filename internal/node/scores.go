@@ -0,0 +1,275 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+)
+
+// ErrHashMismatch is returned when received data doesn't match the content
+// hash it was sent under
+var ErrHashMismatch = errors.New("content hash mismatch")
+
+// Score changes per event. Penalties outweigh rewards, so a peer can't buy
+// forgiveness for corrupt data with a burst of good transfers.
+const (
+	penaltyInvalidMessage = 5
+	penaltyFailedTransfer = 2
+	penaltyHashMismatch   = 20
+	rewardTransfer        = 1
+	// maxScore caps the credit a peer can build up
+	maxScore = 10
+)
+
+// scoreEvent is something a peer did that changes its score
+type scoreEvent int
+
+const (
+	scoreInvalidMessage scoreEvent = iota
+	scoreFailedTransfer
+	scoreHashMismatch
+	scoreCompletedTransfer
+)
+
+// ScoreConfig sets how peers are scored on their behaviour and what happens
+// to peers that score too low. Scores start at zero, drop with each invalid
+// message, failed transfer and hash mismatch, rise with completed transfers,
+// and drift back towards zero over time.
+type ScoreConfig struct {
+	// DerateThreshold is the score below which a peer's offers of objects
+	// are ignored and it is tried last for repairs; zero disables derating
+	DerateThreshold float64
+	// DisconnectThreshold is the score below which a peer is disconnected;
+	// zero disables disconnecting
+	DisconnectThreshold float64
+	// BanDuration is how long a disconnected peer is banned; zero
+	// disconnects it without a ban
+	BanDuration time.Duration
+	// HalfLife is how long it takes for a score to halve
+	HalfLife time.Duration
+}
+
+// DefaultScoreConfig returns a config that derates a peer after two hash
+// mismatches, disconnects it and bans it for 10 minutes after three, and
+// forgives it with a half-life of an hour
+func DefaultScoreConfig() ScoreConfig {
+	return ScoreConfig{
+		DerateThreshold:     -30,
+		DisconnectThreshold: -50,
+		BanDuration:         10 * time.Minute,
+		HalfLife:            time.Hour,
+	}
+}
+
+// PeerScore is a peer's current score and the events behind it. Scores
+// follow the identity a peer proved, not the node ID it claims, so a peer
+// can't shed a low score by picking another ID.
+type PeerScore struct {
+	// Identity is the peer's key fingerprint, or for a peer without a key
+	// its node ID prefixed with "node:"; see network.IdentityOf
+	Identity           string    `json:"identity"`
+	PeerID             string    `json:"peer_id"` // node ID it last went by
+	Score              float64   `json:"score"`
+	Derated            bool      `json:"derated"`
+	InvalidMessages    int64     `json:"invalid_messages"`
+	FailedTransfers    int64     `json:"failed_transfers"`
+	HashMismatches     int64     `json:"hash_mismatches"`
+	CompletedTransfers int64     `json:"completed_transfers"`
+	Updated            time.Time `json:"updated"`
+}
+
+// scoreboard keeps the scores of peers by identity, in memory only
+type scoreboard struct {
+	mu     sync.Mutex
+	config ScoreConfig
+	peers  map[string]*PeerScore
+	now    func() time.Time
+}
+
+func newScoreboard(config ScoreConfig) *scoreboard {
+	return &scoreboard{
+		config: config,
+		peers:  make(map[string]*PeerScore),
+		now:    time.Now,
+	}
+}
+
+// current brings a score's decay up to now; callers hold the lock
+func (s *scoreboard) current(score *PeerScore, now time.Time) {
+	if s.config.HalfLife > 0 && !score.Updated.IsZero() && now.After(score.Updated) {
+		score.Score *= math.Exp2(-float64(now.Sub(score.Updated)) / float64(s.config.HalfLife))
+	}
+	score.Updated = now
+}
+
+// record applies an event to the score of the peer with identity, last
+// seen as nodeID, and returns the new score
+func (s *scoreboard) record(identity, nodeID string, event scoreEvent) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	score, ok := s.peers[identity]
+	if !ok {
+		score = &PeerScore{Identity: identity}
+		s.peers[identity] = score
+	}
+	score.PeerID = nodeID
+	s.current(score, s.now())
+
+	switch event {
+	case scoreInvalidMessage:
+		score.InvalidMessages++
+		score.Score -= penaltyInvalidMessage
+	case scoreFailedTransfer:
+		score.FailedTransfers++
+		score.Score -= penaltyFailedTransfer
+	case scoreHashMismatch:
+		score.HashMismatches++
+		score.Score -= penaltyHashMismatch
+	case scoreCompletedTransfer:
+		score.CompletedTransfers++
+		score.Score = min(score.Score+rewardTransfer, maxScore)
+	}
+	return score.Score
+}
+
+// restore sets a peer's score as saved in an earlier run; it goes on
+// decaying from when it was last updated
+func (s *scoreboard) restore(identity, nodeID string, score float64, updated time.Time) {
+	if score == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[identity] = &PeerScore{Identity: identity, PeerID: nodeID, Score: score, Updated: updated}
+}
+
+func (s *scoreboard) isDerated(score float64) bool {
+	return s.config.DerateThreshold != 0 && score < s.config.DerateThreshold
+}
+
+// derated reports whether the peer with identity scores below the derate
+// threshold
+func (s *scoreboard) derated(identity string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	score, ok := s.peers[identity]
+	if !ok {
+		return false
+	}
+	s.current(score, s.now())
+	return s.isDerated(score.Score)
+}
+
+// list returns the current scores, sorted by node ID and identity
+func (s *scoreboard) list() []PeerScore {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	scores := make([]PeerScore, 0, len(s.peers))
+	for _, score := range s.peers {
+		s.current(score, now)
+		copied := *score
+		copied.Derated = s.isDerated(score.Score)
+		scores = append(scores, copied)
+	}
+	sort.Slice(scores, func(i, j int) bool {
+		if scores[i].PeerID != scores[j].PeerID {
+			return scores[i].PeerID < scores[j].PeerID
+		}
+		return scores[i].Identity < scores[j].Identity
+	})
+	return scores
+}
+
+// WithScoring sets how peers are scored and when low scorers are derated or
+// disconnected
+func WithScoring(cfg ScoreConfig) Option {
+	return func(n *Node) {
+		n.scoreConfig = cfg
+	}
+}
+
+// PeerScores returns the score of every peer that has done something
+// scored since the node started, or whose score was saved in an earlier run
+func (n *Node) PeerScores() []PeerScore {
+	return n.scores.list()
+}
+
+// scorePeer records an event for a peer and disconnects it if its score
+// drops below the disconnect threshold. Scores and bans go by the identity
+// key the peer proved, so it can't escape either under another node ID,
+// nor get the node ID of another peer banned; only peers without a key are
+// banned by node ID. Peers that haven't completed a handshake have no
+// identity to score.
+func (n *Node) scorePeer(peer *network.Peer, event scoreEvent) {
+	n.mu.RLock()
+	info, ok := n.peers[peer.ID()]
+	ok = ok && n.conns[peer.ID()] == peer
+	n.mu.RUnlock()
+	if !ok {
+		return
+	}
+	score := n.scores.record(peer.ID(), info.ID, event)
+	threshold := n.scoreConfig.DisconnectThreshold
+	if threshold == 0 || score >= threshold {
+		return
+	}
+
+	fmt.Printf("Disconnecting %s: score %.1f is below %.1f\n", info.ID, score, threshold)
+	if n.scoreConfig.BanDuration > 0 {
+		target := info.ID
+		if info.PublicKey != nil {
+			target = crypto.Fingerprint(info.PublicKey)
+		}
+		reason := fmt.Sprintf("peer score %.1f", score)
+		if _, err := n.Ban(target, reason, n.scoreConfig.BanDuration); err != nil {
+			fmt.Printf("Failed to ban %s: %v\n", target, err)
+		}
+	}
+	peer.Close()
+}
+
+// derated reports whether the connected peer with node ID id scores below
+// the derate threshold
+func (n *Node) derated(id string) bool {
+	n.mu.RLock()
+	identity, ok := n.peerKeys[id]
+	n.mu.RUnlock()
+	return ok && n.scores.derated(identity)
+}
+
+// malformedMessage scores a peer whose message the transport refused as out
+// of bounds, which then disconnects it
+func (n *Node) malformedMessage(peer *network.Peer, _ error) {
+	n.scorePeer(peer, scoreInvalidMessage)
+}
+
+// scoreTransfer scores the outcome of a download from a peer
+func (n *Node) scoreTransfer(peer *network.Peer, err error) {
+	switch {
+	case err == nil:
+		n.scorePeer(peer, scoreCompletedTransfer)
+	case errors.Is(err, ErrHashMismatch):
+		n.scorePeer(peer, scoreHashMismatch)
+	default:
+		n.scorePeer(peer, scoreFailedTransfer)
+	}
+}
+
+// byScore orders peer IDs so derated peers come last, keeping the order
+// within each group
+func (n *Node) byScore(ids []string) []string {
+	sort.SliceStable(ids, func(i, j int) bool {
+		return !n.derated(ids[i]) && n.derated(ids[j])
+	})
+	return ids
+}
@@ -0,0 +1,167 @@
+package node
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+func TestScoreboard_RecordAndDecay(t *testing.T) {
+	now := time.Now()
+	s := newScoreboard(ScoreConfig{DerateThreshold: -30, DisconnectThreshold: -50, HalfLife: time.Hour})
+	s.now = func() time.Time { return now }
+
+	if got := s.record("node1", "node1", scoreHashMismatch); got != -penaltyHashMismatch {
+		t.Errorf("record() = %v, want %v", got, -penaltyHashMismatch)
+	}
+	if s.derated("node1") {
+		t.Error("Peer derated after one hash mismatch")
+	}
+	s.record("node1", "node1", scoreHashMismatch)
+	if !s.derated("node1") {
+		t.Error("Peer not derated after two hash mismatches")
+	}
+
+	// Penalties are forgiven over time
+	now = now.Add(time.Hour)
+	scores := s.list()
+	if len(scores) != 1 {
+		t.Fatalf("list() has %d entries, want 1", len(scores))
+	}
+	if scores[0].Score != -penaltyHashMismatch {
+		t.Errorf("Score after a half-life = %v, want %v", scores[0].Score, -penaltyHashMismatch)
+	}
+	if scores[0].Derated {
+		t.Error("Peer still derated after a half-life")
+	}
+	if scores[0].HashMismatches != 2 {
+		t.Errorf("HashMismatches = %d, want 2", scores[0].HashMismatches)
+	}
+
+	// Credit for good transfers is capped
+	for i := 0; i < 2*maxScore; i++ {
+		s.record("node2", "node2", scoreCompletedTransfer)
+	}
+	if got := s.record("node2", "node2", scoreCompletedTransfer); got != maxScore {
+		t.Errorf("record() = %v, want %v", got, maxScore)
+	}
+}
+
+func TestScoreboard_DerateDisabled(t *testing.T) {
+	s := newScoreboard(ScoreConfig{})
+	for i := 0; i < 10; i++ {
+		s.record("node1", "node1", scoreHashMismatch)
+	}
+	if s.derated("node1") {
+		t.Error("Peer derated with derating disabled")
+	}
+}
+
+// connectScoredPeers connects a node with the given scoring to a second
+// node, returning both nodes, the first node's events and the second
+// node's connection to it
+func connectScoredPeers(t *testing.T, baseDir string, scoring ScoreConfig) (*Node, *Node, <-chan Event, *network.Peer) {
+	t.Helper()
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true), WithScoring(scoring))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	t.Cleanup(first.Stop)
+	first.transport.Start()
+	events, cancel := first.Subscribe()
+	t.Cleanup(cancel)
+
+	second, err := NewNode("second", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	t.Cleanup(second.Stop)
+	second.transport.Start()
+	connected, cancelConnected := second.Subscribe()
+	t.Cleanup(cancelConnected)
+
+	if err := second.Connect(context.Background(), first.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	waitForEvent(t, events, EventPeerConnected, 5*time.Second)
+	waitForEvent(t, connected, EventPeerConnected, 5*time.Second)
+	peer, ok := second.peerConn("first")
+	if !ok {
+		t.Fatal("Second node has no connection to the first")
+	}
+	return first, second, events, peer
+}
+
+func TestNode_DisconnectsLowScoringPeer(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	scoring := ScoreConfig{DisconnectThreshold: -10, BanDuration: time.Minute, HalfLife: time.Hour}
+	first, second, events, peer := connectScoredPeers(t, baseDir, scoring)
+
+	// A well-formed announcement passes the transport's checks, but its
+	// signature doesn't verify, so only the score drops
+	msg, err := protocol.NewMessage(protocol.MessageTypeData, "second", protocol.DataPayload{ContentHash: strings.Repeat("ab", 32), FileName: "forged.txt", Size: 1})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if err := protocol.Validate(msg); err != nil {
+		t.Fatalf("Validate() = %v, want a message within bounds", err)
+	}
+	msg.PublicKey = make([]byte, ed25519.PublicKeySize)
+	msg.Signature = make([]byte, ed25519.SignatureSize)
+	for i := 0; i < 3; i++ {
+		if err := peer.Send(msg); err != nil {
+			t.Fatalf("Failed to send message: %v", err)
+		}
+	}
+	waitForEvent(t, events, EventPeerDisconnected, 5*time.Second)
+
+	scores := first.PeerScores()
+	if len(scores) != 1 || scores[0].PeerID != "second" || scores[0].Identity != second.Identity() {
+		t.Fatalf("PeerScores() = %+v, want one entry for second", scores)
+	}
+	if scores[0].InvalidMessages != 3 {
+		t.Errorf("InvalidMessages = %d, want 3", scores[0].InvalidMessages)
+	}
+	// The ban is on the key second proved, not the node ID it claimed
+	bans := first.Bans()
+	if len(bans) != 1 || bans[0].Target != second.Identity() || bans[0].Kind != BanIdentity {
+		t.Errorf("Bans() = %+v, want a ban of second's identity", bans)
+	}
+	if err := first.checkPeer("renamed", second.identity.Public, ""); !errors.Is(err, ErrBanned) {
+		t.Errorf("checkPeer() under another node ID = %v, want %v", err, ErrBanned)
+	}
+}
+
+func TestNode_DisconnectsPeerSendingMalformedPayload(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	scoring := ScoreConfig{DisconnectThreshold: -10, BanDuration: time.Minute, HalfLife: time.Hour}
+	first, _, events, peer := connectScoredPeers(t, baseDir, scoring)
+
+	// A payload of the wrong shape fails validation, and the transport
+	// drops the connection right away, whatever the score
+	msg := &protocol.Message{Type: protocol.MessageTypeData, SenderID: "second", Payload: json.RawMessage(`"not an announcement"`)}
+	if err := peer.Send(msg); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	waitForEvent(t, events, EventPeerDisconnected, 5*time.Second)
+
+	scores := first.PeerScores()
+	if len(scores) != 1 || scores[0].InvalidMessages != 1 {
+		t.Fatalf("PeerScores() = %+v, want one invalid message from second", scores)
+	}
+	if bans := first.Bans(); len(bans) != 0 {
+		t.Errorf("Bans() = %+v, want none above the threshold", bans)
+	}
+}
@@ -0,0 +1,156 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"p2p-storage/internal/metrics"
+	"p2p-storage/internal/storage"
+)
+
+// ScrubConfig schedules background integrity checks of the store
+type ScrubConfig struct {
+	// Interval between scrub runs; zero disables scheduled scrubbing
+	Interval time.Duration
+	// Fraction of the store checked per run (0..1]. Successive runs continue
+	// where the previous one stopped, so the whole store is covered over time.
+	Fraction float64
+	// BytesPerSecond caps the disk read rate while verifying (0 = unpaced)
+	BytesPerSecond int64
+}
+
+// DefaultScrubConfig returns a disabled schedule that, once given an
+// interval, checks 5% of the store per run at 8 MiB/s
+func DefaultScrubConfig() ScrubConfig {
+	return ScrubConfig{
+		Interval:       0,
+		Fraction:       0.05,
+		BytesPerSecond: 8 << 20,
+	}
+}
+
+// ScrubResult summarizes a single scrub run
+type ScrubResult struct {
+	Checked  int
+	Bytes    int64
+	Corrupt  []string
+	Errors   int
+	Duration time.Duration
+}
+
+// scrubber keeps the rotating position and counters for integrity checks
+type scrubber struct {
+	mu      sync.Mutex // serializes runs
+	cursor  string     // last hash checked; the next run starts after it
+	checked metrics.Counter
+	corrupt metrics.Counter
+	bytes   metrics.Counter
+	lastRun atomic.Int64 // unix seconds
+}
+
+// Scrub verifies a fraction of the stored objects against their content
+// hashes, continuing from where the previous run stopped
+func (n *Node) Scrub(fraction float64) (ScrubResult, error) {
+	n.scrubber.mu.Lock()
+	defer n.scrubber.mu.Unlock()
+
+	start := time.Now()
+	var result ScrubResult
+
+	hashes, err := n.store.Hashes()
+	if err != nil {
+		return result, fmt.Errorf("failed to list store: %w", err)
+	}
+	if len(hashes) == 0 {
+		return result, nil
+	}
+	sort.Strings(hashes)
+
+	if fraction <= 0 || fraction > 1 {
+		fraction = 1
+	}
+	count := int(math.Ceil(float64(len(hashes)) * fraction))
+
+	// Resume after the last checked hash so runs rotate through the store
+	next := sort.SearchStrings(hashes, n.scrubber.cursor)
+	if next < len(hashes) && hashes[next] == n.scrubber.cursor {
+		next++
+	}
+
+	for i := 0; i < count; i++ {
+		select {
+		case <-n.done:
+			return result, fmt.Errorf("node stopped")
+		default:
+		}
+
+		hash := hashes[(next+i)%len(hashes)]
+		read, err := n.store.Verify(hash, n.scrubConfig.BytesPerSecond)
+		result.Bytes += read
+		n.scrubber.bytes.Add(read)
+		n.scrubber.cursor = hash
+
+		switch {
+		case errors.Is(err, storage.ErrCorrupt):
+			result.Corrupt = append(result.Corrupt, hash)
+			n.scrubber.corrupt.Inc()
+			fmt.Printf("Integrity check failed for %s: %v\n", hash, err)
+			n.emit(Event{Type: EventIntegrityFailed, ContentHash: hash, Error: err.Error()})
+		case err != nil:
+			// Deleted between listing and verifying, or unreadable
+			result.Errors++
+			continue
+		}
+
+		result.Checked++
+		n.scrubber.checked.Inc()
+	}
+
+	result.Duration = time.Since(start)
+	n.scrubber.lastRun.Store(time.Now().Unix())
+	n.emit(Event{Type: EventScrubCompleted, Count: result.Checked, Size: result.Bytes})
+
+	return result, nil
+}
+
+// scrubLoop runs scheduled integrity checks until the node stops
+func (n *Node) scrubLoop() {
+	ticker := time.NewTicker(n.scrubConfig.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			result, err := n.Scrub(n.scrubConfig.Fraction)
+			if err != nil {
+				fmt.Printf("Scheduled scrub failed: %v\n", err)
+				continue
+			}
+			fmt.Printf("Scrub checked %d objects (%d corrupt) in %v\n",
+				result.Checked, len(result.Corrupt), result.Duration.Round(time.Millisecond))
+		}
+	}
+}
+
+// registerScrubMetrics exposes integrity check counters
+func (n *Node) registerScrubMetrics() {
+	n.metrics.Register("p2p_scrub_objects_checked_total", "Objects verified by integrity checks", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.scrubber.checked.Value())}}
+	})
+	n.metrics.Register("p2p_scrub_corrupt_total", "Objects that failed integrity checks", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.scrubber.corrupt.Value())}}
+	})
+	n.metrics.Register("p2p_scrub_bytes_total", "Bytes read by integrity checks", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.scrubber.bytes.Value())}}
+	})
+	n.metrics.Register("p2p_scrub_last_run_timestamp_seconds", "Unix time of the last completed scrub", metrics.KindGauge, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.scrubber.lastRun.Load())}}
+	})
+}
@@ -0,0 +1,68 @@
+package node
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"p2p-storage/internal/crypto"
+)
+
+func TestNode_Scrub(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	storeDir := filepath.Join(baseDir, "store")
+	node, err := NewNode("test-node", ":0", storeDir, filepath.Join(baseDir, "watch"))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	var hashes []string
+	for _, content := range []string{"one", "two", "three", "four"} {
+		hash, err := crypto.ContentHash(strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("Failed to hash content: %v", err)
+		}
+		if err := node.store.Store(hash, strings.NewReader(content)); err != nil {
+			t.Fatalf("Failed to store content: %v", err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	// Corrupt one object on disk
+	corrupt := hashes[0]
+	corruptPath := filepath.Join(storeDir, corrupt[0:2], corrupt[2:4], corrupt[4:])
+	if err := os.WriteFile(corruptPath, []byte("bit rot"), 0644); err != nil {
+		t.Fatalf("Failed to corrupt file: %v", err)
+	}
+
+	events, cancel := node.Subscribe()
+	defer cancel()
+
+	// Two half-store runs cover every object exactly once
+	var checked int
+	var found []string
+	for i := 0; i < 2; i++ {
+		result, err := node.Scrub(0.5)
+		if err != nil {
+			t.Fatalf("Scrub() error = %v", err)
+		}
+		checked += result.Checked
+		found = append(found, result.Corrupt...)
+	}
+
+	if checked != len(hashes) {
+		t.Errorf("Checked = %v, want %v", checked, len(hashes))
+	}
+	if len(found) != 1 || found[0] != corrupt {
+		t.Errorf("Corrupt = %v, want [%s]", found, corrupt)
+	}
+
+	event := <-events
+	if event.Type != EventIntegrityFailed && event.Type != EventScrubCompleted {
+		t.Errorf("Unexpected event type %v", event.Type)
+	}
+}
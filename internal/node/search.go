@@ -0,0 +1,302 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// DefaultSearchDepth is how many hops a search reaches unless asked
+// otherwise: the node's peers, their peers and theirs
+const DefaultSearchDepth = 3
+
+// searchHopTimeout is how long a search waits for the answers of each hop
+// still ahead of it. A node passing a search on waits one hop less than the
+// node that passed it to it, so its answer arrives in time.
+const searchHopTimeout = 2 * time.Second
+
+// SearchHit is an object whose name or path matched a search, with the
+// nodes found storing it
+type SearchHit struct {
+	Hash    string   `json:"hash"`
+	Name    string   `json:"name"`
+	Path    string   `json:"path,omitempty"`
+	Size    int64    `json:"size"`
+	Holders []string `json:"holders"`
+}
+
+// nameIndex maps the words of cataloged names and paths to the hashes
+// cataloged under them
+type nameIndex map[string]map[string]bool
+
+// searchTerms splits a name, path or query into lowercase words
+func searchTerms(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func (x nameIndex) add(meta FileMeta) {
+	for _, word := range searchTerms(meta.Name + " " + meta.Path) {
+		if x[word] == nil {
+			x[word] = make(map[string]bool)
+		}
+		x[word][meta.Hash] = true
+	}
+}
+
+func (x nameIndex) remove(meta FileMeta) {
+	for _, word := range searchTerms(meta.Name + " " + meta.Path) {
+		delete(x[word], meta.Hash)
+		if len(x[word]) == 0 {
+			delete(x, word)
+		}
+	}
+}
+
+// search returns the cataloged objects with a word in their name or path
+// starting with each of the terms
+func (c *catalog) search(terms []string) []FileMeta {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var matches map[string]bool
+	for _, term := range terms {
+		found := make(map[string]bool)
+		for word, hashes := range c.index {
+			if !strings.HasPrefix(word, term) {
+				continue
+			}
+			for hash := range hashes {
+				if matches == nil || matches[hash] {
+					found[hash] = true
+				}
+			}
+		}
+		matches = found
+	}
+
+	files := make([]FileMeta, 0, len(matches))
+	for hash := range matches {
+		files = append(files, c.files[hash])
+	}
+	return files
+}
+
+// localHits returns the objects stored here matching a query. Those that
+// namespace policy keeps from being served are left out.
+func (n *Node) localHits(query string) []protocol.SearchHit {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	var hits []protocol.SearchHit
+	for _, meta := range n.catalog.search(terms) {
+		if !n.store.Exists(meta.Hash) || n.servable(meta) != nil {
+			continue
+		}
+		hits = append(hits, protocol.SearchHit{
+			ContentHash: meta.Hash,
+			FileName:    meta.Name,
+			Path:        meta.Path,
+			Size:        meta.Size,
+			Holders:     []string{n.ID},
+		})
+	}
+	return hits
+}
+
+// mergeHits merges the hits for the same object, with the holders of each,
+// sorted by path and name and at most protocol.MaxSearchHits of them
+func mergeHits(hits []protocol.SearchHit) []protocol.SearchHit {
+	byHash := make(map[string]*protocol.SearchHit)
+	var merged []protocol.SearchHit
+	for _, hit := range hits {
+		if first, ok := byHash[hit.ContentHash]; ok {
+			first.Holders = append(first.Holders, hit.Holders...)
+			continue
+		}
+		hit.Holders = append([]string(nil), hit.Holders...)
+		merged = append(merged, hit)
+		byHash[hit.ContentHash] = &merged[len(merged)-1]
+	}
+	for i := range merged {
+		holders := merged[i].Holders
+		sort.Strings(holders)
+		merged[i].Holders = compactStrings(holders)
+	}
+	sort.Slice(merged, func(i, j int) bool {
+		a, b := merged[i], merged[j]
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		if a.FileName != b.FileName {
+			return a.FileName < b.FileName
+		}
+		return a.ContentHash < b.ContentHash
+	})
+	if len(merged) > protocol.MaxSearchHits {
+		merged = merged[:protocol.MaxSearchHits]
+	}
+	return merged
+}
+
+// compactStrings drops the repeats from a sorted list
+func compactStrings(sorted []string) []string {
+	out := sorted[:0]
+	for i, s := range sorted {
+		if i == 0 || s != sorted[i-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// searchPeers passes a search on to every connected peer that answers
+// searches but except, and returns their hits once all have answered or ctx
+// is done
+func (n *Node) searchPeers(ctx context.Context, request protocol.SearchRequest, except, trace string) []protocol.SearchHit {
+	var answers []<-chan protocol.SearchResult
+	for _, id := range n.connectedPeers() {
+		if id == except || !n.peerSupports(id, protocol.FeatureSearch) {
+			continue
+		}
+		peer, ok := n.peerConn(id)
+		if !ok {
+			continue
+		}
+		requestID, err := protocol.NewMessageID()
+		if err != nil {
+			continue
+		}
+		msg, err := protocol.NewMessage(protocol.MessageTypeSearch, n.ID, request)
+		if err != nil {
+			continue
+		}
+		msg.RequestID = requestID
+		msg.TraceID = trace
+
+		answer := n.searchReplies.add(requestID)
+		defer n.searchReplies.remove(requestID)
+		if err := peer.Send(msg); err != nil {
+			n.debugf("Failed to pass search on to %s: %v\n", id, err)
+			continue
+		}
+		answers = append(answers, answer)
+	}
+
+	var hits []protocol.SearchHit
+	for _, answer := range answers {
+		select {
+		case result := <-answer:
+			hits = append(hits, result.Hits...)
+		case <-ctx.Done():
+			return hits
+		case <-n.done:
+			return hits
+		}
+	}
+	return hits
+}
+
+// handleSearch answers a search with the matching objects stored here and,
+// while it has hops left, those of the peers it passes it on to. A search
+// reached before is answered at once with no hits.
+func (n *Node) handleSearch(peer *network.Peer, msg *protocol.Message) error {
+	var request protocol.SearchRequest
+	if err := msg.ParsePayload(&request); err != nil {
+		return fmt.Errorf("failed to parse search: %w", err)
+	}
+	if msg.RequestID == "" {
+		return fmt.Errorf("refusing search from %s without a request ID", msg.SenderID)
+	}
+	if !n.searches.add(request.ID) {
+		return n.answerSearch(peer, msg, nil)
+	}
+
+	// Answers from further hops arrive on other connections, so they are
+	// waited for in the background
+	release := peer.Hold(msg)
+	go func() {
+		defer release()
+		hits := n.localHits(request.Query)
+		if request.Hops > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(request.Hops)*searchHopTimeout)
+			forward := request
+			forward.Hops--
+			hits = append(hits, n.searchPeers(ctx, forward, n.nodeID(peer), msg.TraceID)...)
+			cancel()
+		}
+		if err := n.answerSearch(peer, msg, mergeHits(hits)); err != nil {
+			n.debugf("Failed to answer search from %s: %v\n", peer.ID(), err)
+		}
+	}()
+	return nil
+}
+
+func (n *Node) answerSearch(peer *network.Peer, msg *protocol.Message, hits []protocol.SearchHit) error {
+	reply, err := protocol.NewMessage(protocol.MessageTypeSearchResult, n.ID, protocol.SearchResult{Hits: hits})
+	if err != nil {
+		return err
+	}
+	reply.RequestID = msg.RequestID
+	reply.TraceID = msg.TraceID
+	return peer.Send(reply)
+}
+
+func (n *Node) handleSearchResult(peer *network.Peer, msg *protocol.Message) error {
+	var result protocol.SearchResult
+	if err := msg.ParsePayload(&result); err != nil {
+		return fmt.Errorf("failed to parse search result: %w", err)
+	}
+	if !n.searchReplies.resolve(msg.RequestID, result) {
+		n.debugf("Peer %s answered search %s, which is no longer pending\n", peer.ID(), msg.RequestID)
+	}
+	return nil
+}
+
+// Search finds the objects whose names or paths have words starting with
+// every word of query, on this node and on the nodes up to depth hops
+// away, from 1 for its peers only to protocol.MaxSearchHops+1. Nodes that
+// don't answer in time are left out of the hits.
+func (n *Node) Search(ctx context.Context, query string, depth int) ([]SearchHit, error) {
+	if len(searchTerms(query)) == 0 {
+		return nil, errors.New("query has no words to search for")
+	}
+	if depth < 1 || depth > protocol.MaxSearchHops+1 {
+		return nil, fmt.Errorf("depth %d is out of range (1-%d)", depth, protocol.MaxSearchHops+1)
+	}
+	id, err := protocol.NewMessageID()
+	if err != nil {
+		return nil, err
+	}
+	n.searches.add(id)
+
+	hits := n.localHits(query)
+	wait, cancel := context.WithTimeout(ctx, time.Duration(depth)*searchHopTimeout)
+	defer cancel()
+	hits = append(hits, n.searchPeers(wait, protocol.SearchRequest{ID: id, Query: query, Hops: depth - 1}, "", n.traceID(nil))...)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	merged := mergeHits(hits)
+	results := make([]SearchHit, len(merged))
+	for i, hit := range merged {
+		results[i] = SearchHit{
+			Hash:    hit.ContentHash,
+			Name:    hit.FileName,
+			Path:    hit.Path,
+			Size:    hit.Size,
+			Holders: hit.Holders,
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,149 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+func TestCatalog_Search(t *testing.T) {
+	c, err := loadCatalog(filepath.Join(t.TempDir(), "catalog.json"))
+	if err != nil {
+		t.Fatalf("loadCatalog() error = %v", err)
+	}
+	for _, meta := range []FileMeta{
+		{Hash: "aaaa", Name: "Holiday Photos.zip"},
+		{Hash: "bbbb", Name: "plan.txt", Path: "holiday/plan.txt"},
+		{Hash: "cccc", Name: "budget-2024.xlsx"},
+	} {
+		if err := c.add(meta); err != nil {
+			t.Fatalf("add() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"holiday", []string{"aaaa", "bbbb"}},
+		{"HOLI pho", []string{"aaaa"}},
+		{"2024", []string{"cccc"}},
+		{"holiday budget", nil},
+		{"day", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got := make(map[string]bool)
+			for _, meta := range c.search(searchTerms(tt.query)) {
+				got[meta.Hash] = true
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("search(%q) = %v, want %v", tt.query, got, tt.want)
+			}
+			for _, hash := range tt.want {
+				if !got[hash] {
+					t.Errorf("search(%q) = %v, want %v", tt.query, got, tt.want)
+				}
+			}
+		})
+	}
+
+	// Renaming an object drops it from the words of its old name
+	if err := c.add(FileMeta{Hash: "aaaa", Name: "archive.zip"}); err != nil {
+		t.Fatalf("add() error = %v", err)
+	}
+	if got := c.search(searchTerms("photos")); len(got) != 0 {
+		t.Errorf("search() after rename = %v, want no matches", got)
+	}
+	if err := c.remove("bbbb"); err != nil {
+		t.Fatalf("remove() error = %v", err)
+	}
+	if got := c.search(searchTerms("holiday")); len(got) != 0 {
+		t.Errorf("search() after remove = %v, want no matches", got)
+	}
+}
+
+func TestNode_SearchFansOut(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	replication := WithReplication(ReplicationConfig{Target: 1, Interval: time.Hour})
+	// A single peer each, so discovery doesn't connect the ends of the chain
+	discovery := WithDiscovery(DiscoveryConfig{DialInterval: time.Millisecond, MaxPeers: 1, QueueSize: 8})
+	newTestNode := func(id string, first bool, opts ...Option) *Node {
+		opts = append(opts, WithFirstNode(first), replication)
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"), opts...)
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		n.transport.Start()
+		return n
+	}
+	middle := newTestNode("middle", true)
+	defer middle.Stop()
+	far := newTestNode("far", false, discovery)
+	defer far.Stop()
+	near := newTestNode("near", false, discovery)
+	defer near.Stop()
+
+	for _, n := range []*Node{far, near} {
+		if err := n.Connect(context.Background(), middle.Address()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		if err := n.waitForKey(5 * time.Second); err != nil {
+			t.Fatalf("Failed to receive network key: %v", err)
+		}
+	}
+
+	put := func(n *Node, name, content string) string {
+		data := []byte(content)
+		hash, err := crypto.ContentHash(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to hash object: %v", err)
+		}
+		if err := n.store.Store(hash, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Failed to store object: %v", err)
+		}
+		if err := n.catalog.add(FileMeta{Hash: hash, Name: name, Size: int64(len(data))}); err != nil {
+			t.Fatalf("Failed to catalog object: %v", err)
+		}
+		return hash
+	}
+	plan := put(middle, "holiday-plan.txt", "two weeks by the sea")
+	photos := put(far, "Holiday Photos.zip", "not really a zip")
+	put(far, "taxes.pdf", "not found by the query")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	hits, err := near.Search(ctx, "holiday", 1)
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	if len(hits) != 1 || hits[0].Hash != plan || len(hits[0].Holders) != 1 || hits[0].Holders[0] != "middle" {
+		t.Errorf("Search(depth 1) = %+v, want only the plan held by middle", hits)
+	}
+
+	hits, err = near.Search(ctx, "holiday", 2)
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	found := make(map[string][]string)
+	for _, hit := range hits {
+		found[hit.Hash] = hit.Holders
+	}
+	if len(found) != 2 || len(found[photos]) != 1 || found[photos][0] != "far" {
+		t.Errorf("Search(depth 2) = %+v, want the plan and the photos held by far", hits)
+	}
+	if _, ok := near.peerConn("far"); ok {
+		t.Error("Near node connected to the far one directly")
+	}
+
+	if _, err := near.Search(ctx, "holiday", protocol.MaxSearchHops+2); err == nil {
+		t.Error("Search() accepted a depth beyond the hop limit")
+	}
+}
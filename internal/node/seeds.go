@@ -0,0 +1,165 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// seedTXTPrefix marks a seed whose addresses are listed in DNS TXT records
+const seedTXTPrefix = "txt:"
+
+// Resolver looks up the DNS records seeds are given as; *net.Resolver is one
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// SeedConfig lists bootstrap peers given by DNS name rather than address,
+// so a deployment can move them without changing every node's arguments
+type SeedConfig struct {
+	// Seeds are host:port names, each of whose addresses is dialed, or
+	// txt:<name> for a TXT record listing host:port seeds separated by
+	// spaces or commas
+	Seeds []string
+	// Interval is how often seeds are resolved again and those not
+	// connected are dialed; 0 resolves them once, at start
+	Interval time.Duration
+	// Resolver resolves seeds; net.DefaultResolver if nil
+	Resolver Resolver
+}
+
+// DefaultSeedConfig returns no seeds, resolved again every minute once set
+func DefaultSeedConfig() SeedConfig {
+	return SeedConfig{Interval: time.Minute}
+}
+
+// WithSeeds sets the bootstrap peers given by DNS name. Their addresses are
+// dialed through the discovery queue like peers learned from other peers.
+func WithSeeds(cfg SeedConfig) Option {
+	return func(n *Node) {
+		n.seedConfig = cfg
+	}
+}
+
+// seedLoop dials the seeds at start and again each interval until the node
+// stops
+func (n *Node) seedLoop() {
+	for {
+		n.dialSeeds()
+		if n.seedConfig.Interval <= 0 {
+			return
+		}
+		select {
+		case <-n.done:
+			return
+		case <-time.After(n.seedConfig.Interval):
+		}
+	}
+}
+
+// dialSeeds resolves the seeds and queues a dial to each of their addresses
+// the node isn't connected to
+func (n *Node) dialSeeds() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	addresses, err := resolveSeeds(ctx, n.seedResolver(), n.seedConfig.Seeds)
+	if err != nil {
+		fmt.Printf("Failed to resolve seeds: %v\n", err)
+	}
+	connected := n.connectedAddresses()
+	for _, address := range addresses {
+		if connected[address] {
+			continue
+		}
+		if n.discovery.enqueue(discoveredPeer{id: address, addresses: []string{address}}) {
+			n.debugf("Dialing seed %s\n", address)
+		}
+	}
+}
+
+func (n *Node) seedResolver() Resolver {
+	if n.seedConfig.Resolver != nil {
+		return n.seedConfig.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// connectedAddresses returns the addresses of the peers the node has
+// completed a handshake with, as dialed and as they advertise themselves,
+// along with its own
+func (n *Node) connectedAddresses() map[string]bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	addresses := map[string]bool{n.transport.Address(): true}
+	for key, info := range n.peers {
+		addresses[info.Address] = true
+		for _, address := range info.Addresses {
+			addresses[address] = true
+		}
+		if conn := n.conns[key]; conn != nil && !conn.Closed() {
+			addresses[conn.Address()] = true
+		}
+	}
+	return addresses
+}
+
+// resolveSeeds returns the addresses of seeds, without duplicates. Seeds
+// that fail to resolve are skipped, and the error names them, so one bad
+// seed doesn't keep the node from the others.
+func resolveSeeds(ctx context.Context, resolver Resolver, seeds []string) ([]string, error) {
+	var addresses, failed []string
+	seen := make(map[string]bool)
+	add := func(address string) {
+		if !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+
+	for _, seed := range seeds {
+		hosts := []string{seed}
+		if name, ok := strings.CutPrefix(seed, seedTXTPrefix); ok {
+			records, err := resolver.LookupTXT(ctx, name)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", seed, err))
+				continue
+			}
+			hosts = nil
+			for _, record := range records {
+				hosts = append(hosts, strings.FieldsFunc(record, func(r rune) bool {
+					return r == ',' || r == ' ' || r == '\t'
+				})...)
+			}
+		}
+
+		for _, hostPort := range hosts {
+			host, port, err := net.SplitHostPort(hostPort)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", hostPort, err))
+				continue
+			}
+			if net.ParseIP(host) != nil {
+				add(hostPort)
+				continue
+			}
+			ips, err := resolver.LookupHost(ctx, host)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", hostPort, err))
+				continue
+			}
+			for _, ip := range ips {
+				add(net.JoinHostPort(ip, port))
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return addresses, fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return addresses, nil
+}
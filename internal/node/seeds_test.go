@@ -0,0 +1,98 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fakeResolver answers lookups from fixed records
+type fakeResolver struct {
+	hosts map[string][]string
+	txt   map[string][]string
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func (r fakeResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if records, ok := r.txt[name]; ok {
+		return records, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestResolveSeeds(t *testing.T) {
+	resolver := fakeResolver{
+		hosts: map[string][]string{
+			"a.example": {"10.0.0.1", "fd00::1"},
+			"b.example": {"10.0.0.2"},
+		},
+		txt: map[string][]string{
+			"_seeds.example": {"b.example:4000, 10.0.0.3:4000", "a.example:3000"},
+		},
+	}
+
+	addresses, err := resolveSeeds(context.Background(), resolver, []string{"a.example:3000", "txt:_seeds.example"})
+	if err != nil {
+		t.Fatalf("resolveSeeds() error = %v", err)
+	}
+	want := []string{"10.0.0.1:3000", "[fd00::1]:3000", "10.0.0.2:4000", "10.0.0.3:4000"}
+	if !reflect.DeepEqual(addresses, want) {
+		t.Errorf("resolveSeeds() = %v, want %v", addresses, want)
+	}
+
+	// A seed that fails to resolve doesn't hide the others
+	addresses, err = resolveSeeds(context.Background(), resolver, []string{"gone.example:3000", "txt:gone.example", "b.example:3000"})
+	if err == nil {
+		t.Error("resolveSeeds() with unresolvable seeds succeeded, want an error")
+	}
+	if want := []string{"10.0.0.2:3000"}; !reflect.DeepEqual(addresses, want) {
+		t.Errorf("resolveSeeds() = %v, want %v", addresses, want)
+	}
+}
+
+func TestNode_DialsSeeds(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	first, err := NewNode("first", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer first.Stop()
+	first.transport.Start()
+
+	_, port, _ := net.SplitHostPort(first.Address())
+	resolver := fakeResolver{txt: map[string][]string{"_seeds.test": {"seed.test:" + port}}, hosts: map[string][]string{"seed.test": {"127.0.0.1"}}}
+	seeded, err := NewNode("seeded", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithSeeds(SeedConfig{Seeds: []string{"txt:_seeds.test"}, Interval: 50 * time.Millisecond, Resolver: resolver}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer seeded.Stop()
+
+	events, unsubscribe := seeded.Subscribe()
+	defer unsubscribe()
+	if err := seeded.Start(); err != nil {
+		t.Fatalf("Failed to start node: %v", err)
+	}
+	waitForEvent(t, events, EventPeerConnected, 5*time.Second)
+	if err := seeded.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Node did not join through its seed: %v", err)
+	}
+
+	// Later rounds leave the connected seed alone
+	time.Sleep(200 * time.Millisecond)
+	if peers := seeded.connectedPeers(); len(peers) != 1 {
+		t.Errorf("Connected to %d peers, want 1", len(peers))
+	}
+}
@@ -0,0 +1,96 @@
+package node
+
+import (
+	"bytes"
+	"fmt"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// signedTypes are the messages a node signs when it originates them:
+// announcements, alone or in batches, tombstones, departures and
+// publications. Passed on, they keep the signature of the node they
+// originated at.
+var signedTypes = map[protocol.MessageType]bool{
+	protocol.MessageTypeData:      true,
+	protocol.MessageTypeDataBatch: true,
+	protocol.MessageTypeTombstone: true,
+	protocol.MessageTypeLeave:     true,
+	protocol.MessageTypePublish:   true,
+}
+
+// sign signs a message originating here with the identity key, if it is of
+// a signed type. Gossiped messages are signed once they have their ID.
+func (n *Node) sign(msg *protocol.Message) {
+	if signedTypes[msg.Type] && !msg.Signed() {
+		msg.Sign(n.identity.Public, n.identity.Sign)
+	}
+}
+
+// checkSignature refuses a message altered since it was signed and a
+// message of a signed type that is unsigned or signed by a node other than
+// its origin. One without a gossip ID comes straight from the node it
+// originated at, and must be signed with the identity key the peer proved
+// in its handshake. One passed on from elsewhere must be signed with the
+// key of the node its payload names as its origin, where that node's key is
+// known; otherwise its signature names the origin.
+func (n *Node) checkSignature(peer *network.Peer, msg *protocol.Message) error {
+	if err := msg.VerifySignature(); err != nil {
+		return err
+	}
+	if !signedTypes[msg.Type] {
+		return nil
+	}
+	if !msg.Signed() {
+		return fmt.Errorf("%w: unsigned", protocol.ErrBadSignature)
+	}
+
+	var want []byte
+	if msg.ID == "" {
+		n.mu.RLock()
+		want = n.peers[peer.ID()].PublicKey
+		n.mu.RUnlock()
+		if want == nil {
+			return fmt.Errorf("%w: the sender has no identity key", protocol.ErrBadSignature)
+		}
+	} else if origin := messageOrigin(msg); origin == n.ID {
+		want = n.identity.Public
+	} else if origin != "" {
+		want = n.knownKey(origin)
+	}
+	if want != nil && !bytes.Equal(msg.PublicKey, want) {
+		return fmt.Errorf("%w: signed by a key other than its origin's", protocol.ErrBadSignature)
+	}
+	return nil
+}
+
+// messageOrigin returns the node a signed message's payload names as the
+// one it originated at, if it names one
+func messageOrigin(msg *protocol.Message) string {
+	switch msg.Type {
+	case protocol.MessageTypeLeave:
+		var payload protocol.LeavePayload
+		if msg.ParsePayload(&payload) == nil {
+			return payload.NodeID
+		}
+	case protocol.MessageTypePublish:
+		var payload protocol.Publication
+		if msg.ParsePayload(&payload) == nil {
+			return payload.Origin
+		}
+	}
+	return ""
+}
+
+// knownKey returns the identity key of the node id, connected or seen
+// before, if it has one
+func (n *Node) knownKey(id string) []byte {
+	n.mu.RLock()
+	info, ok := n.peers[n.peerKeys[id]]
+	n.mu.RUnlock()
+	if ok {
+		return info.PublicKey
+	}
+	return n.peerDB.key(id)
+}
@@ -0,0 +1,94 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/protocol"
+)
+
+func TestNode_CheckSignature(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	sender, err := NewNode("sender", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer sender.Stop()
+	sender.transport.Start()
+
+	receiver, err := NewNode("receiver", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer receiver.Stop()
+	receiver.transport.Start()
+
+	if err := receiver.Connect(context.Background(), sender.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := receiver.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	peer, ok := receiver.peerConn("sender")
+	if !ok {
+		t.Fatal("Receiver is not connected to the sender")
+	}
+	key := []byte("test seal key")
+	peer.SealStamps(key, key)
+
+	other, err := crypto.LoadOrCreateIdentity(filepath.Join(baseDir, "other.key"))
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	tombstones := func(sign func(*protocol.Message)) *protocol.Message {
+		msg, err := protocol.NewMessage(protocol.MessageTypeTombstone, "sender", protocol.TombstonePayload{})
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		sign(msg)
+		return sealWith(t, msg, key)
+	}
+
+	// Passed on by the sender, from the node the payload names
+	gossiped := func(origin string, sign func(*protocol.Message)) *protocol.Message {
+		msg, err := protocol.NewMessage(protocol.MessageTypeLeave, "sender", protocol.LeavePayload{NodeID: origin})
+		if err != nil {
+			t.Fatalf("Failed to create message: %v", err)
+		}
+		msg.ID, msg.TTL = "gossip-"+origin, 3
+		sign(msg)
+		return sealWith(t, msg, key)
+	}
+	signOther := func(msg *protocol.Message) { msg.Sign(other.Public, other.Sign) }
+
+	tests := []struct {
+		name    string
+		msg     *protocol.Message
+		wantErr bool
+	}{
+		{"signed by the sender", tombstones(sender.sign), false},
+		{"unsigned", tombstones(func(*protocol.Message) {}), true},
+		{"signed by another key", tombstones(signOther), true},
+		{"gossiped unsigned", gossiped("elsewhere", func(*protocol.Message) {}), true},
+		{"gossiped from a known node by another key", gossiped("sender", signOther), true},
+		{"gossiped from an unknown node", gossiped("elsewhere", signOther), false},
+		{"altered after signing", tombstones(func(msg *protocol.Message) {
+			sender.sign(msg)
+			msg.Payload = []byte(`{"tombstones":[]}`)
+		}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := receiver.HandleMessage(peer, tt.msg)
+			if got := errors.Is(err, protocol.ErrBadSignature); got != tt.wantErr {
+				t.Errorf("HandleMessage() error = %v, want a bad signature: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
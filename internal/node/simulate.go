@@ -0,0 +1,263 @@
+package node
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+// SimTopology is how the nodes of a simulation are first connected.
+// Discovery may add more connections afterwards.
+type SimTopology string
+
+const (
+	// SimFull connects every node to every other
+	SimFull SimTopology = "full"
+	// SimStar connects every node to the first
+	SimStar SimTopology = "star"
+	// SimRing connects each node to the next, and the last to the first
+	SimRing SimTopology = "ring"
+	// SimLine connects each node to the previous
+	SimLine SimTopology = "line"
+	// SimRandom connects each node to SimConfig.Degree random earlier nodes
+	SimRandom SimTopology = "random"
+)
+
+// ParseSimTopology validates a topology name
+func ParseSimTopology(s string) (SimTopology, error) {
+	switch t := SimTopology(s); t {
+	case SimFull, SimStar, SimRing, SimLine, SimRandom:
+		return t, nil
+	}
+	return "", fmt.Errorf("unknown topology %q (want full, star, ring, line or random)", s)
+}
+
+// SimConfig describes a simulated cluster and its workload
+type SimConfig struct {
+	Nodes    int
+	Topology SimTopology
+	// Degree is the number of links each node opens in a random topology
+	Degree   int
+	Files    int
+	FileSize int64
+	// Timeout bounds both key distribution and convergence
+	Timeout time.Duration
+}
+
+// DefaultSimConfig returns 5 nodes in a random topology of degree 2, with 5
+// files of 64 KiB
+func DefaultSimConfig() SimConfig {
+	return SimConfig{
+		Nodes:    5,
+		Topology: SimRandom,
+		Degree:   2,
+		Files:    5,
+		FileSize: 64 << 10,
+		Timeout:  30 * time.Second,
+	}
+}
+
+// SimFile is the outcome of one file dropped into a simulated watch directory
+type SimFile struct {
+	Name      string        `json:"name"`
+	Origin    string        `json:"origin"`
+	Hash      string        `json:"hash,omitempty"`
+	Replicas  int           `json:"replicas"`
+	Converged bool          `json:"converged"`
+	Time      time.Duration `json:"time,omitempty"` // from the drop until every node stored it
+}
+
+// SimReport summarizes a simulation
+type SimReport struct {
+	Config      SimConfig        `json:"config"`
+	Links       int              `json:"links"`       // connections opened by the topology
+	Connections int              `json:"connections"` // connections at the end, including discovered ones
+	Setup       time.Duration    `json:"setup"`       // until every node held the network key
+	Files       []SimFile        `json:"files"`
+	Converged   int              `json:"converged"`
+	Convergence time.Duration    `json:"convergence"` // until the last file converged
+	Messages    map[string]int64 `json:"messages"`    // received across all nodes, by type
+	Bytes       int64            `json:"bytes"`       // sent across all nodes
+}
+
+// Simulate runs a cluster of in-process nodes connected by a simulated
+// network, with their data under dir. Once every node holds the network key,
+// files are dropped into the watch directories of the nodes in turn, and
+// the report shows how long each took to reach every node and the messages
+// exchanged. opts are applied to every node.
+func Simulate(dir string, cfg SimConfig, opts ...Option) (SimReport, error) {
+	report := SimReport{Config: cfg, Messages: make(map[string]int64)}
+	if cfg.Nodes < 2 {
+		return report, errors.New("a simulation needs at least 2 nodes")
+	}
+	if cfg.Files < 1 || cfg.FileSize < 1 {
+		return report, errors.New("files and file size must be at least 1")
+	}
+	links, err := simLinks(cfg.Topology, cfg.Nodes, cfg.Degree)
+	if err != nil {
+		return report, err
+	}
+
+	sim := network.NewSimNetwork()
+	width := len(fmt.Sprint(cfg.Nodes - 1))
+	nodes := make([]*Node, 0, cfg.Nodes)
+	defer func() {
+		for _, n := range nodes {
+			n.Stop()
+		}
+	}()
+	for i := 0; i < cfg.Nodes; i++ {
+		id := fmt.Sprintf("node-%0*d", width, i)
+		base := filepath.Join(dir, id)
+		watchDir := filepath.Join(base, "watch")
+		if err := os.MkdirAll(watchDir, 0755); err != nil {
+			return report, err
+		}
+		nodeOpts := append([]Option{
+			WithFirstNode(i == 0),
+			WithDataDir(base),
+			WithTransportOptions(network.WithNetwork(sim)),
+		}, opts...)
+		n, err := NewNode(id, id+":7000", filepath.Join(base, "store"), watchDir, nodeOpts...)
+		if err != nil {
+			return report, fmt.Errorf("failed to create %s: %w", id, err)
+		}
+		if err := n.Start(); err != nil {
+			n.Stop()
+			return report, fmt.Errorf("failed to start %s: %w", id, err)
+		}
+		nodes = append(nodes, n)
+	}
+
+	start := time.Now()
+	for _, link := range links {
+		if err := nodes[link[0]].Connect(context.Background(), nodes[link[1]].Address()); err != nil {
+			return report, fmt.Errorf("failed to connect %s to %s: %w", nodes[link[0]].ID, nodes[link[1]].ID, err)
+		}
+	}
+	report.Links = len(links)
+	// Nodes not linked to the first node get the key once discovery
+	// connects them to it
+	for _, n := range nodes {
+		if err := n.waitForKey(cfg.Timeout); err != nil {
+			return report, fmt.Errorf("%s did not receive the network key, which only the first node hands out to nodes that dial it: %w", n.ID, err)
+		}
+	}
+	report.Setup = time.Since(start)
+
+	data := make([]byte, cfg.FileSize)
+	dropped := make([]time.Time, cfg.Files)
+	for i := range dropped {
+		origin := nodes[i%len(nodes)]
+		name := fmt.Sprintf("sim-%03d.bin", i)
+		if _, err := rand.Read(data); err != nil {
+			return report, err
+		}
+		if err := os.WriteFile(filepath.Join(origin.watchDir, name), data, 0644); err != nil {
+			return report, err
+		}
+		dropped[i] = time.Now()
+		report.Files = append(report.Files, SimFile{Name: name, Origin: origin.ID})
+	}
+
+	deadline := time.Now().Add(cfg.Timeout)
+	for report.Converged < len(report.Files) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		for i := range report.Files {
+			f := &report.Files[i]
+			if f.Converged {
+				continue
+			}
+			if f.Hash == "" {
+				f.Hash = simHash(nodes[i%len(nodes)], f.Name)
+				if f.Hash == "" {
+					continue
+				}
+			}
+			f.Replicas = 0
+			for _, n := range nodes {
+				if n.store.Exists(f.Hash) {
+					f.Replicas++
+				}
+			}
+			if f.Replicas == len(nodes) {
+				f.Converged = true
+				f.Time = time.Since(dropped[i])
+				report.Converged++
+				if f.Time > report.Convergence {
+					report.Convergence = f.Time
+				}
+			}
+		}
+	}
+
+	for _, n := range nodes {
+		report.Connections += len(n.connectedPeers())
+		report.Bytes += n.transport.BytesSent()
+		for msgType, count := range n.transport.MessagesReceived() {
+			report.Messages[string(msgType)] += count
+		}
+	}
+	report.Connections /= 2
+	return report, nil
+}
+
+// simHash returns the hash a node stored a dropped file under, once it has
+func simHash(n *Node, name string) string {
+	for _, f := range n.catalog.all() {
+		if f.Name == name {
+			return f.Hash
+		}
+	}
+	return ""
+}
+
+// simLinks returns the connections of a topology as pairs of the dialing
+// node and the node it dials
+func simLinks(topology SimTopology, nodes, degree int) ([][2]int, error) {
+	var links [][2]int
+	switch topology {
+	case SimFull:
+		for i := 1; i < nodes; i++ {
+			for j := 0; j < i; j++ {
+				links = append(links, [2]int{i, j})
+			}
+		}
+	case SimStar:
+		for i := 1; i < nodes; i++ {
+			links = append(links, [2]int{i, 0})
+		}
+	case SimRing:
+		for i := 1; i < nodes; i++ {
+			links = append(links, [2]int{i, i - 1})
+		}
+		if nodes > 2 {
+			// Only the first node hands out the key, and only to nodes that dial it
+			links = append(links, [2]int{nodes - 1, 0})
+		}
+	case SimLine:
+		for i := 1; i < nodes; i++ {
+			links = append(links, [2]int{i, i - 1})
+		}
+	case SimRandom:
+		if degree < 1 {
+			return nil, errors.New("degree must be at least 1")
+		}
+		// Linking only to earlier nodes keeps the graph connected
+		for i := 1; i < nodes; i++ {
+			for _, j := range mathrand.Perm(i)[:min(degree, i)] {
+				links = append(links, [2]int{i, j})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown topology %q", topology)
+	}
+	return links, nil
+}
@@ -0,0 +1,64 @@
+package node
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSimLinks(t *testing.T) {
+	for _, tt := range []struct {
+		topology SimTopology
+		want     int
+	}{
+		{SimFull, 10},
+		{SimStar, 4},
+		{SimRing, 5},
+		{SimLine, 4},
+		{SimRandom, 7}, // 1 + 2 + 2 + 2 with degree 2
+	} {
+		links, err := simLinks(tt.topology, 5, 2)
+		if err != nil {
+			t.Fatalf("simLinks(%s) failed: %v", tt.topology, err)
+		}
+		if len(links) != tt.want {
+			t.Errorf("simLinks(%s) = %d links, want %d", tt.topology, len(links), tt.want)
+		}
+		for _, link := range links {
+			if link[0] == link[1] || link[0] < 0 || link[0] >= 5 || link[1] < 0 || link[1] >= 5 {
+				t.Errorf("simLinks(%s) has invalid link %v", tt.topology, link)
+			}
+		}
+	}
+	if _, err := ParseSimTopology("mesh"); err == nil {
+		t.Error("Expected error for an unknown topology")
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	cfg := SimConfig{Nodes: 4, Topology: SimFull, Files: 3, FileSize: 4096, Timeout: 10 * time.Second}
+	report, err := Simulate(baseDir, cfg)
+	if err != nil {
+		t.Fatalf("Failed to simulate: %v", err)
+	}
+	if report.Links != 6 || report.Connections != 6 {
+		t.Errorf("Links = %d, connections = %d, want 6", report.Links, report.Connections)
+	}
+	if report.Converged != cfg.Files {
+		t.Fatalf("Converged = %d, want %d: %+v", report.Converged, cfg.Files, report.Files)
+	}
+	for _, f := range report.Files {
+		if f.Hash == "" || f.Replicas != cfg.Nodes || f.Time <= 0 || f.Time > report.Convergence {
+			t.Errorf("File %+v, want stored on all nodes within %v", f, report.Convergence)
+		}
+	}
+	if report.Messages["handshake"] == 0 || report.Messages["data"] == 0 || report.Bytes == 0 {
+		t.Errorf("Messages = %v, bytes = %d, want handshakes, announcements and traffic", report.Messages, report.Bytes)
+	}
+
+	if _, err := Simulate(baseDir, SimConfig{Nodes: 1, Files: 1, FileSize: 1}); err == nil {
+		t.Error("Expected error for a single node")
+	}
+}
@@ -0,0 +1,134 @@
+package node
+
+import (
+	"context"
+	"fmt"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// ObjectStat is what a peer knows of an object, as fetched with Stat. Name,
+// size and encryption are only set if the peer has the object cataloged.
+type ObjectStat struct {
+	Hash       string         `json:"hash"`
+	PeerID     string         `json:"peer_id"`
+	Stored     bool           `json:"stored"`
+	StoredSize int64          `json:"stored_size,omitempty"`
+	Name       string         `json:"name,omitempty"`
+	Path       string         `json:"path,omitempty"`
+	Size       int64          `json:"size,omitempty"`
+	Encryption EncryptionMode `json:"encryption,omitempty"`
+	Manifest   bool           `json:"manifest,omitempty"`
+	Replicas   int            `json:"replicas"` // live copies the peer knows of, its own included
+}
+
+// handleStatRequest answers with what is known here of an object. Objects
+// neither stored nor cataloged are answered as not found, and those whose
+// namespace keeps them from being served as unauthorized.
+func (n *Node) handleStatRequest(peer *network.Peer, msg *protocol.Message) error {
+	var request protocol.StatRequest
+	if err := msg.ParsePayload(&request); err != nil {
+		return fmt.Errorf("failed to parse stat request: %w", err)
+	}
+	if msg.RequestID == "" {
+		return fmt.Errorf("refusing stat request from %s without a request ID", msg.SenderID)
+	}
+
+	info := n.Info(request.ContentHash)
+	if !info.Stored && info.Meta == nil {
+		n.refuseRequest(peer, msg, protocol.ErrorCodeNotFound, "nothing known of "+request.ContentHash)
+		return nil
+	}
+	stat := protocol.Stat{
+		ContentHash: request.ContentHash,
+		Stored:      info.Stored,
+		StoredSize:  info.StoredSize,
+		Replicas:    n.Replicas(request.ContentHash).Replicas,
+	}
+	if meta := info.Meta; meta != nil {
+		if err := n.servable(*meta); err != nil {
+			n.refuseRequest(peer, msg, protocol.ErrorCodeUnauthorized, err.Error())
+			return err
+		}
+		stat.FileName = meta.Name
+		stat.Path = meta.Path
+		stat.Size = meta.Size
+		stat.Encryption = string(meta.Encryption.orDefault())
+		stat.Manifest = meta.Manifest
+	}
+
+	reply, err := protocol.NewMessage(protocol.MessageTypeStat, n.ID, stat)
+	if err != nil {
+		return err
+	}
+	reply.RequestID = msg.RequestID
+	reply.TraceID = msg.TraceID
+	return peer.Send(reply)
+}
+
+func (n *Node) handleStat(peer *network.Peer, msg *protocol.Message) error {
+	var stat protocol.Stat
+	if err := msg.ParsePayload(&stat); err != nil {
+		return fmt.Errorf("failed to parse stat: %w", err)
+	}
+	if !n.stats.resolve(msg.RequestID, stat) {
+		n.debugf("Peer %s answered stat request %s, which is no longer pending\n", peer.ID(), msg.RequestID)
+	}
+	return nil
+}
+
+// Stat asks a connected peer what it knows of an object: whether it stores
+// it, its name, size and encryption, and how many live replicas it counts.
+// Nothing of the content is transferred. A peer knowing nothing of the
+// object answers ErrNotFound.
+func (n *Node) Stat(ctx context.Context, peerID, hash string) (ObjectStat, error) {
+	peer, ok := n.peerConn(peerID)
+	if !ok {
+		return ObjectStat{}, fmt.Errorf("peer %s is not connected", peerID)
+	}
+	if !n.peerSupports(peerID, protocol.FeatureStat) {
+		return ObjectStat{}, fmt.Errorf("peer %s does not support stat requests", peerID)
+	}
+
+	requestID, err := protocol.NewMessageID()
+	if err != nil {
+		return ObjectStat{}, err
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeStatRequest, n.ID, protocol.StatRequest{ContentHash: hash})
+	if err != nil {
+		return ObjectStat{}, fmt.Errorf("failed to create stat request: %w", err)
+	}
+	msg.RequestID = requestID
+	msg.TraceID = n.traceID(nil)
+
+	reply := n.stats.add(requestID)
+	defer n.stats.remove(requestID)
+	answer := n.requests.add(requestID)
+	defer n.requests.remove(requestID)
+	if err := peer.Send(msg); err != nil {
+		return ObjectStat{}, fmt.Errorf("failed to send stat request: %w", err)
+	}
+
+	select {
+	case s := <-reply:
+		return ObjectStat{
+			Hash:       hash,
+			PeerID:     peerID,
+			Stored:     s.Stored,
+			StoredSize: s.StoredSize,
+			Name:       s.FileName,
+			Path:       s.Path,
+			Size:       s.Size,
+			Encryption: EncryptionMode(s.Encryption),
+			Manifest:   s.Manifest,
+			Replicas:   s.Replicas,
+		}, nil
+	case err := <-answer:
+		return ObjectStat{}, fmt.Errorf("failed to stat %s on %s: %w", hash, peerID, err)
+	case <-ctx.Done():
+		return ObjectStat{}, ctx.Err()
+	case <-n.done:
+		return ObjectStat{}, fmt.Errorf("node stopped")
+	}
+}
@@ -0,0 +1,58 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNode_Stat(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	holder, err := NewNode("holder", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer holder.Stop()
+	holder.transport.Start()
+
+	asker, err := NewNode("asker", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"), WithFirstNode(false))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer asker.Stop()
+	asker.transport.Start()
+
+	path := filepath.Join(baseDir, "report.txt")
+	writeTestFile(t, path, "quarterly numbers")
+	hash, err := holder.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+
+	if err := asker.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := asker.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stat, err := asker.Stat(ctx, "holder", hash)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if !stat.Stored || stat.Name != "report.txt" || stat.Size != int64(len("quarterly numbers")) ||
+		stat.Encryption != EncryptNetwork || stat.Replicas < 1 {
+		t.Errorf("Stat() = %+v, want the stored, network-encrypted report.txt of %d bytes", stat, len("quarterly numbers"))
+	}
+
+	if _, err := asker.Stat(ctx, "holder", strings.Repeat("e", 40)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Stat(unknown) error = %v, want %v", err, ErrNotFound)
+	}
+}
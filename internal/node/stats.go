@@ -0,0 +1,525 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"p2p-storage/internal/metrics"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/storage"
+)
+
+// Transfer directions
+const (
+	DirectionDownload = "download"
+	DirectionUpload   = "upload"
+)
+
+// TransferStats describes the progress of an active transfer
+type TransferStats struct {
+	PeerID      string
+	ContentHash string
+	Direction   string
+	BytesDone   int64
+	TotalBytes  int64 // 0 when the size is not known yet
+	Rate        float64
+	ETA         time.Duration // 0 when unknown
+	Elapsed     time.Duration
+}
+
+// PeerThroughput describes the transfer rates to and from a single peer
+type PeerThroughput struct {
+	PeerID        string  `json:"peer_id"`
+	UploadRate    float64 `json:"upload_rate"`
+	DownloadRate  float64 `json:"download_rate"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+}
+
+// NetworkStats summarizes traffic across all peer connections
+type NetworkStats struct {
+	Peers         int   `json:"peers"`
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+}
+
+// TransferCounts summarizes transfer outcomes since the node started
+type TransferCounts struct {
+	Active      int     `json:"active"`
+	Completed   int64   `json:"completed"`
+	Failed      int64   `json:"failed"`
+	SuccessRate float64 `json:"success_rate"` // 0..1, 0 when nothing has finished yet
+}
+
+// statsPopularLimit is how many of the most popular objects Stats reports
+const statsPopularLimit = 10
+
+// NodeStats is an aggregated report of store, network and transfer statistics
+type NodeStats struct {
+	Store     storage.Stats      `json:"store"`
+	Cache     storage.CacheStats `json:"cache"`
+	Relay     RelayCacheStats    `json:"relay_cache"`
+	Network   NetworkStats       `json:"network"`
+	Transfers TransferCounts     `json:"transfers"`
+	Peers     []PeerThroughput   `json:"peers"`
+	Popular   []ObjectPopularity `json:"popular,omitempty"`
+	// UnderReplicated counts local objects below the replication target
+	UnderReplicated int `json:"under_replicated"`
+}
+
+// transferProgress tracks bytes moved for a single transfer
+type transferProgress struct {
+	peerID      string
+	contentHash string
+	direction   string
+	total       atomic.Int64
+	started     time.Time
+	meter       *metrics.Meter
+}
+
+func newTransferProgress(peerID, contentHash, direction string, total int64) *transferProgress {
+	p := &transferProgress{
+		peerID:      peerID,
+		contentHash: contentHash,
+		direction:   direction,
+		started:     time.Now(),
+		meter:       metrics.NewMeter(metrics.DefaultMeterWindow),
+	}
+	p.total.Store(total)
+	return p
+}
+
+func (p *transferProgress) stats() TransferStats {
+	done := p.meter.Total()
+	total := p.total.Load()
+	rate := p.meter.Rate()
+
+	var eta time.Duration
+	if total > done && rate > 0 {
+		eta = time.Duration(float64(total-done) / rate * float64(time.Second))
+	}
+
+	return TransferStats{
+		PeerID:      p.peerID,
+		ContentHash: p.contentHash,
+		Direction:   p.direction,
+		BytesDone:   done,
+		TotalBytes:  total,
+		Rate:        rate,
+		ETA:         eta,
+		Elapsed:     time.Since(p.started),
+	}
+}
+
+// peerRatesIdle is how long the rates of a peer without transfers are kept
+// after its last byte
+const peerRatesIdle = 10 * time.Minute
+
+// peerRates tracks rolling transfer rates for a single peer
+type peerRates struct {
+	sent     *metrics.Meter
+	received *metrics.Meter
+	last     time.Time // of the last bytes recorded
+}
+
+// transferTracker keeps progress for active transfers, rates per peer and
+// outcome counters per direction
+type transferTracker struct {
+	mu        sync.RWMutex
+	active    map[string]*transferProgress
+	peers     map[string]*peerRates
+	completed map[string]*metrics.Counter
+	failed    map[string]*metrics.Counter
+}
+
+func newTransferTracker() *transferTracker {
+	return &transferTracker{
+		active: make(map[string]*transferProgress),
+		peers:  make(map[string]*peerRates),
+		completed: map[string]*metrics.Counter{
+			DirectionDownload: {},
+			DirectionUpload:   {},
+		},
+		failed: map[string]*metrics.Counter{
+			DirectionDownload: {},
+			DirectionUpload:   {},
+		},
+	}
+}
+
+// begin registers an active transfer under key and returns its progress
+func (t *transferTracker) begin(key, peerID, contentHash, direction string, total int64) *transferProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, exists := t.active[key]; exists {
+		return p
+	}
+	p := newTransferProgress(peerID, contentHash, direction, total)
+	t.active[key] = p
+	return p
+}
+
+// finish removes an active transfer
+func (t *transferTracker) finish(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.active, key)
+}
+
+// record accounts n bytes moved for a transfer and its peer
+func (t *transferTracker) record(p *transferProgress, n int64) {
+	p.meter.Mark(n)
+
+	now := time.Now()
+	t.mu.Lock()
+	rates, exists := t.peers[p.peerID]
+	if !exists {
+		t.pruneIdleLocked(now)
+		rates = &peerRates{
+			sent:     metrics.NewMeter(metrics.DefaultMeterWindow),
+			received: metrics.NewMeter(metrics.DefaultMeterWindow),
+		}
+		t.peers[p.peerID] = rates
+	}
+	rates.last = now
+	t.mu.Unlock()
+
+	if p.direction == DirectionUpload {
+		rates.sent.Mark(n)
+	} else {
+		rates.received.Mark(n)
+	}
+}
+
+// pruneIdleLocked drops the rates of peers without active transfers that
+// moved nothing for peerRatesIdle; callers hold the lock
+func (t *transferTracker) pruneIdleLocked(now time.Time) {
+	busy := make(map[string]bool, len(t.active))
+	for _, p := range t.active {
+		busy[p.peerID] = true
+	}
+	for id, rates := range t.peers {
+		if !busy[id] && now.Sub(rates.last) > peerRatesIdle {
+			delete(t.peers, id)
+		}
+	}
+}
+
+// forgetPeer drops the rates of a peer that disconnected
+func (t *transferTracker) forgetPeer(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.peers, id)
+}
+
+// outcome counts a finished transfer as completed or failed
+func (t *transferTracker) outcome(direction string, ok bool) {
+	counters := t.failed
+	if ok {
+		counters = t.completed
+	}
+	if c, exists := counters[direction]; exists {
+		c.Inc()
+	}
+}
+
+func (t *transferTracker) counts() TransferCounts {
+	t.mu.RLock()
+	active := len(t.active)
+	t.mu.RUnlock()
+
+	counts := TransferCounts{Active: active}
+	for _, c := range t.completed {
+		counts.Completed += c.Value()
+	}
+	for _, c := range t.failed {
+		counts.Failed += c.Value()
+	}
+	if finished := counts.Completed + counts.Failed; finished > 0 {
+		counts.SuccessRate = float64(counts.Completed) / float64(finished)
+	}
+	return counts
+}
+
+func (t *transferTracker) transfers() []TransferStats {
+	t.mu.RLock()
+	active := make([]*transferProgress, 0, len(t.active))
+	for _, p := range t.active {
+		active = append(active, p)
+	}
+	t.mu.RUnlock()
+
+	stats := make([]TransferStats, 0, len(active))
+	for _, p := range active {
+		stats = append(stats, p.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Elapsed > stats[j].Elapsed
+	})
+	return stats
+}
+
+func (t *transferTracker) peerThroughput() []PeerThroughput {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := make([]PeerThroughput, 0, len(t.peers))
+	for id, rates := range t.peers {
+		result = append(result, PeerThroughput{
+			PeerID:        id,
+			UploadRate:    rates.sent.Rate(),
+			DownloadRate:  rates.received.Rate(),
+			BytesSent:     rates.sent.Total(),
+			BytesReceived: rates.received.Total(),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].PeerID < result[j].PeerID
+	})
+	return result
+}
+
+// storeStatsMaxAge is how long a walk of the store serves the store gauges,
+// so the gauges of one scrape share a single walk
+const storeStatsMaxAge = time.Second
+
+// storeStatsCache remembers the last walk of the store, which visits every
+// object
+type storeStatsCache struct {
+	mu    sync.Mutex
+	walk  func() (storage.Stats, error)
+	stats storage.Stats
+	err   error
+	at    time.Time
+}
+
+func (c *storeStatsCache) get() (storage.Stats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.at.IsZero() || time.Since(c.at) > storeStatsMaxAge {
+		c.stats, c.err = c.walk()
+		c.at = time.Now()
+	}
+	return c.stats, c.err
+}
+
+// registerMetrics exposes transfer, network and store statistics through the metrics registry
+func (n *Node) registerMetrics() {
+	n.metrics.Register("p2p_transfers_active", "Number of active transfers", metrics.KindGauge, func() []metrics.Sample {
+		counts := map[string]int{DirectionDownload: 0, DirectionUpload: 0}
+		for _, t := range n.tracker.transfers() {
+			counts[t.Direction]++
+		}
+		samples := make([]metrics.Sample, 0, len(counts))
+		for dir, count := range counts {
+			samples = append(samples, metrics.Sample{Labels: map[string]string{"direction": dir}, Value: float64(count)})
+		}
+		return samples
+	})
+
+	outcomes := func(counters map[string]*metrics.Counter) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			samples := make([]metrics.Sample, 0, len(counters))
+			for dir, c := range counters {
+				samples = append(samples, metrics.Sample{Labels: map[string]string{"direction": dir}, Value: float64(c.Value())})
+			}
+			return samples
+		}
+	}
+	n.metrics.Register("p2p_transfers_completed_total", "Transfers that completed successfully", metrics.KindCounter, outcomes(n.tracker.completed))
+	n.metrics.Register("p2p_transfers_failed_total", "Transfers that failed", metrics.KindCounter, outcomes(n.tracker.failed))
+
+	n.metrics.Register("p2p_network_bytes_total", "Bytes exchanged with all peers", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{
+			{Labels: map[string]string{"direction": "sent"}, Value: float64(n.transport.BytesSent())},
+			{Labels: map[string]string{"direction": "received"}, Value: float64(n.transport.BytesReceived())},
+		}
+	})
+	n.metrics.Register("p2p_messages_received_total", "Messages received from all peers by type", metrics.KindCounter, func() []metrics.Sample {
+		counts := n.transport.MessagesReceived()
+		samples := make([]metrics.Sample, 0, len(counts))
+		for msgType, count := range counts {
+			samples = append(samples, metrics.Sample{Labels: map[string]string{"type": string(msgType)}, Value: float64(count)})
+		}
+		return samples
+	})
+	n.metrics.Register("p2p_ingest_files", "Files being ingested and waiting for a worker", metrics.KindGauge, func() []metrics.Sample {
+		running, waiting := n.ingests.counts()
+		return []metrics.Sample{
+			{Labels: map[string]string{"state": "running"}, Value: float64(running)},
+			{Labels: map[string]string{"state": "waiting"}, Value: float64(waiting)},
+		}
+	})
+	n.metrics.Register("p2p_ingest_refused_total", "Files refused for being too large or finding the ingest queue full", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.ingests.refused.Load())}}
+	})
+	n.metrics.Register("p2p_peers_by_version", "Number of known peers by software version", metrics.KindGauge, func() []metrics.Sample {
+		counts := make(map[string]int)
+		for _, p := range n.Peers() {
+			version := p.UserAgent
+			if version == "" {
+				version = "unknown"
+			}
+			counts[version]++
+		}
+		samples := make([]metrics.Sample, 0, len(counts))
+		for version, count := range counts {
+			samples = append(samples, metrics.Sample{Labels: map[string]string{"version": version}, Value: float64(count)})
+		}
+		return samples
+	})
+	n.metrics.Register("p2p_peer_rtt_seconds", "Round trip of the last answered heartbeat by peer", metrics.KindGauge, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, p := range n.Peers() {
+			if p.RTT > 0 {
+				samples = append(samples, metrics.Sample{Labels: map[string]string{"peer": p.ID}, Value: p.RTT.Seconds()})
+			}
+		}
+		return samples
+	})
+	n.metrics.Register("p2p_peers_connected", "Number of connected peers", metrics.KindGauge, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.transport.PeerCount())}}
+	})
+
+	storeStats := &storeStatsCache{walk: func() (storage.Stats, error) { return n.store.Stats() }}
+	n.metrics.Register("p2p_store_files", "Number of objects in the store", metrics.KindGauge, func() []metrics.Sample {
+		stats, err := storeStats.get()
+		if err != nil {
+			return nil
+		}
+		return []metrics.Sample{{Value: float64(stats.Files)}}
+	})
+	n.metrics.Register("p2p_store_bytes", "Total size of objects in the store", metrics.KindGauge, func() []metrics.Sample {
+		stats, err := storeStats.get()
+		if err != nil {
+			return nil
+		}
+		return []metrics.Sample{{Value: float64(stats.Bytes)}}
+	})
+
+	n.metrics.Register("p2p_cache_requests_total", "Object cache lookups by result", metrics.KindCounter, func() []metrics.Sample {
+		stats := n.store.CacheStats()
+		return []metrics.Sample{
+			{Labels: map[string]string{"result": "hit"}, Value: float64(stats.Hits)},
+			{Labels: map[string]string{"result": "miss"}, Value: float64(stats.Misses)},
+		}
+	})
+	n.metrics.Register("p2p_relay_cache_bytes", "Bytes held in the relay cache", metrics.KindGauge, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.RelayCacheStats().Used)}}
+	})
+	n.metrics.Register("p2p_relay_cache_evictions_total", "Objects evicted from the relay cache", metrics.KindCounter, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.RelayCacheStats().Evictions)}}
+	})
+	n.metrics.Register("p2p_cache_bytes", "Bytes held in the object cache", metrics.KindGauge, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(n.store.CacheStats().Size)}}
+	})
+
+	n.metrics.Register("p2p_peer_rate_bytes_per_second", "Rolling transfer rate per peer", metrics.KindGauge, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, p := range n.tracker.peerThroughput() {
+			samples = append(samples,
+				metrics.Sample{Labels: map[string]string{"peer": p.PeerID, "direction": DirectionUpload}, Value: p.UploadRate},
+				metrics.Sample{Labels: map[string]string{"peer": p.PeerID, "direction": DirectionDownload}, Value: p.DownloadRate},
+			)
+		}
+		return samples
+	})
+
+	n.metrics.Register("p2p_peer_transfer_bytes_total", "Bytes transferred per peer", metrics.KindCounter, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, p := range n.tracker.peerThroughput() {
+			samples = append(samples,
+				metrics.Sample{Labels: map[string]string{"peer": p.PeerID, "direction": DirectionUpload}, Value: float64(p.BytesSent)},
+				metrics.Sample{Labels: map[string]string{"peer": p.PeerID, "direction": DirectionDownload}, Value: float64(p.BytesReceived)},
+			)
+		}
+		return samples
+	})
+
+	n.metrics.Register("p2p_peer_network_bytes_total", "Bytes exchanged with each connected peer over the wire", metrics.KindCounter, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, p := range n.NetworkStats() {
+			samples = append(samples,
+				metrics.Sample{Labels: map[string]string{"peer": p.ID, "direction": "sent"}, Value: float64(p.BytesSent)},
+				metrics.Sample{Labels: map[string]string{"peer": p.ID, "direction": "received"}, Value: float64(p.BytesReceived)},
+			)
+		}
+		return samples
+	})
+	n.metrics.Register("p2p_peer_errors_total", "Messages each connected peer failed to be sent or to have handled", metrics.KindCounter, func() []metrics.Sample {
+		var samples []metrics.Sample
+		for _, p := range n.NetworkStats() {
+			samples = append(samples,
+				metrics.Sample{Labels: map[string]string{"peer": p.ID, "kind": "send"}, Value: float64(p.SendErrors)},
+				metrics.Sample{Labels: map[string]string{"peer": p.ID, "kind": "handle"}, Value: float64(p.HandleErrors)},
+			)
+		}
+		return samples
+	})
+}
+
+// NetworkStats returns the traffic of each peer connection, those that
+// exchanged the most bytes first. Peers that completed a handshake are
+// named by node ID, others by the ID the transport knows them by.
+func (n *Node) NetworkStats() []network.PeerStats {
+	stats := n.transport.Stats()
+
+	n.mu.RLock()
+	names := make(map[string]string, len(n.conns))
+	for key, conn := range n.conns {
+		names[conn.ID()] = n.peers[key].ID
+	}
+	n.mu.RUnlock()
+
+	for i := range stats {
+		if id, ok := names[stats[i].ID]; ok {
+			stats[i].ID = id
+		}
+	}
+	return stats
+}
+
+// Transfers returns progress, throughput and ETA for every active transfer
+func (n *Node) Transfers() []TransferStats {
+	return n.tracker.transfers()
+}
+
+// PeerThroughput returns rolling upload/download rates per peer
+func (n *Node) PeerThroughput() []PeerThroughput {
+	return n.tracker.peerThroughput()
+}
+
+// Stats returns an aggregated report backed by the same counters as the
+// metrics registry
+func (n *Node) Stats() (NodeStats, error) {
+	storeStats, err := n.store.Stats()
+	if err != nil {
+		return NodeStats{}, fmt.Errorf("failed to read store stats: %w", err)
+	}
+
+	return NodeStats{
+		Store: storeStats,
+		Cache: n.store.CacheStats(),
+		Relay: n.RelayCacheStats(),
+		Network: NetworkStats{
+			Peers:         n.transport.PeerCount(),
+			BytesSent:     n.transport.BytesSent(),
+			BytesReceived: n.transport.BytesReceived(),
+		},
+		Transfers: n.tracker.counts(),
+		Peers:     n.tracker.peerThroughput(),
+		Popular:   n.popularity.top(statsPopularLimit),
+
+		UnderReplicated: n.replicas.underCount(),
+	}, nil
+}
+
+// Metrics returns the node's metrics registry
+func (n *Node) Metrics() *metrics.Registry {
+	return n.metrics
+}
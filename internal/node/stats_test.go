@@ -0,0 +1,123 @@
+package node
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/storage"
+)
+
+func TestTransferTracker(t *testing.T) {
+	tracker := newTransferTracker()
+
+	progress := tracker.begin("key", "peer1", "abc123", DirectionDownload, 4096)
+	tracker.record(progress, 1024)
+
+	transfers := tracker.transfers()
+	if len(transfers) != 1 {
+		t.Fatalf("Expected 1 transfer, got %d", len(transfers))
+	}
+
+	stats := transfers[0]
+	if stats.BytesDone != 1024 {
+		t.Errorf("BytesDone = %v, want %v", stats.BytesDone, 1024)
+	}
+	if stats.TotalBytes != 4096 {
+		t.Errorf("TotalBytes = %v, want %v", stats.TotalBytes, 4096)
+	}
+	if stats.Rate <= 0 {
+		t.Errorf("Rate = %v, want > 0", stats.Rate)
+	}
+	if stats.ETA <= 0 {
+		t.Errorf("ETA = %v, want > 0", stats.ETA)
+	}
+
+	throughput := tracker.peerThroughput()
+	if len(throughput) != 1 || throughput[0].BytesReceived != 1024 {
+		t.Errorf("peerThroughput() = %+v, want 1024 bytes received from peer1", throughput)
+	}
+
+	tracker.finish("key")
+	if len(tracker.transfers()) != 0 {
+		t.Error("Transfer still active after finish")
+	}
+
+	// Rates of peers idle too long go when another peer's are added, unless
+	// a transfer with them is under way
+	busy := tracker.begin("busy", "peer2", "def456", DirectionUpload, 0)
+	tracker.record(busy, 1)
+	tracker.peers["peer1"].last = time.Now().Add(-2 * peerRatesIdle)
+	tracker.peers["peer2"].last = time.Now().Add(-2 * peerRatesIdle)
+	tracker.record(tracker.begin("other", "peer3", "abc123", DirectionDownload, 0), 1)
+	if _, kept := tracker.peers["peer1"]; kept {
+		t.Error("Rates of an idle peer kept")
+	}
+	if _, kept := tracker.peers["peer2"]; !kept {
+		t.Error("Rates of a peer with a transfer under way dropped")
+	}
+
+	tracker.forgetPeer("peer3")
+	for _, p := range tracker.peerThroughput() {
+		if p.PeerID == "peer3" {
+			t.Error("Rates of a disconnected peer kept")
+		}
+	}
+}
+
+func TestStoreStatsCache(t *testing.T) {
+	walks := 0
+	cache := &storeStatsCache{walk: func() (storage.Stats, error) {
+		walks++
+		return storage.Stats{Files: walks, Bytes: int64(walks)}, nil
+	}}
+
+	// The gauges of one scrape share a walk
+	first, _ := cache.get()
+	second, _ := cache.get()
+	if walks != 1 || first != second {
+		t.Errorf("Two reads walked the store %d times, got %+v and %+v", walks, first, second)
+	}
+
+	cache.at = cache.at.Add(-2 * storeStatsMaxAge)
+	if stats, _ := cache.get(); walks != 2 || stats.Files != 2 {
+		t.Errorf("Read after the walk aged walked %d times, got %+v", walks, stats)
+	}
+}
+
+func TestNode_Stats(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	node.emit(Event{Type: EventTransferCompleted, Direction: DirectionDownload})
+	node.emit(Event{Type: EventTransferCompleted, Direction: DirectionUpload})
+	node.emit(Event{Type: EventTransferCompleted, Direction: DirectionUpload})
+	node.emit(Event{Type: EventTransferFailed, Direction: DirectionDownload})
+
+	stats, err := node.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+
+	if stats.Transfers.Completed != 3 {
+		t.Errorf("Completed = %v, want %v", stats.Transfers.Completed, 3)
+	}
+	if stats.Transfers.Failed != 1 {
+		t.Errorf("Failed = %v, want %v", stats.Transfers.Failed, 1)
+	}
+	if stats.Transfers.SuccessRate != 0.75 {
+		t.Errorf("SuccessRate = %v, want %v", stats.Transfers.SuccessRate, 0.75)
+	}
+
+	// The metrics endpoint reports the same counters
+	snapshot := node.Metrics().Snapshot()
+	if got := snapshot[`p2p_transfers_completed_total{direction="upload"}`]; got != 2 {
+		t.Errorf("Metric completed uploads = %v, want %v", got, 2)
+	}
+}
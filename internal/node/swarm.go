@@ -0,0 +1,487 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// swarmChunkSize is the size of the chunks swarm downloads are scheduled in
+const swarmChunkSize = protocol.DefaultChunkSize
+
+// bitfield marks the chunks of an object held, chunk 0 being the high bit
+// of the first byte
+type bitfield []byte
+
+func newBitfield(chunks int) bitfield {
+	return make(bitfield, (chunks+7)/8)
+}
+
+// fullBitfield marks every one of chunks as held
+func fullBitfield(chunks int) bitfield {
+	b := newBitfield(chunks)
+	for i := 0; i < chunks; i++ {
+		b.set(i)
+	}
+	return b
+}
+
+func (b bitfield) set(i int) {
+	b[i/8] |= 0x80 >> (i % 8)
+}
+
+func (b bitfield) has(i int) bool {
+	return i >= 0 && i/8 < len(b) && b[i/8]&(0x80>>(i%8)) != 0
+}
+
+func chunkCount(size int64, chunkSize int) int {
+	return int((size + int64(chunkSize) - 1) / int64(chunkSize))
+}
+
+// PeerPieces is which chunks of an object a peer can serve, as fetched
+// with Pieces
+type PeerPieces struct {
+	PeerID    string `json:"peer_id"`
+	Size      int64  `json:"size"` // of the whole object as stored
+	ChunkSize int    `json:"chunk_size"`
+	Chunks    int    `json:"chunks"` // in the whole object
+	Held      int    `json:"held"`
+	have      bitfield
+}
+
+// Has reports whether the peer holds chunk i
+func (p PeerPieces) Has(i int) bool {
+	return p.have.has(i)
+}
+
+// swarmDownload is an object being fetched in chunks from several peers.
+// The chunks received so far are served to other peers fetching it.
+type swarmDownload struct {
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+	chunkSize int
+	have      bitfield
+}
+
+// pieces returns the chunks received so far
+func (d *swarmDownload) pieces(hash string) protocol.Have {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return protocol.Have{ContentHash: hash, Size: d.size, ChunkSize: d.chunkSize, Bitfield: append(bitfield(nil), d.have...)}
+}
+
+// missing returns the chunks not received yet, in order
+func (d *swarmDownload) missing() []int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var chunks []int
+	for i := 0; i < chunkCount(d.size, d.chunkSize); i++ {
+		if !d.have.has(i) {
+			chunks = append(chunks, i)
+		}
+	}
+	return chunks
+}
+
+// write keeps data as the chunks from first on
+func (d *swarmDownload) write(first int, data []byte) error {
+	offset := int64(first) * int64(d.chunkSize)
+	if _, err := d.file.WriteAt(data, offset); err != nil {
+		return fmt.Errorf("failed to write chunks: %w", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := first; i < chunkCount(offset+int64(len(data)), d.chunkSize); i++ {
+		d.have.set(i)
+	}
+	return nil
+}
+
+// covers reports whether every chunk of a range was received
+func (d *swarmDownload) covers(r protocol.ByteRange) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	end := d.size
+	if r.Length > 0 {
+		end = min(end, r.Offset+r.Length)
+	}
+	if r.Offset > end {
+		return false
+	}
+	for i := int(r.Offset / int64(d.chunkSize)); i < chunkCount(end, d.chunkSize); i++ {
+		if !d.have.has(i) {
+			return false
+		}
+	}
+	return true
+}
+
+// swarmTracker holds the swarm downloads in progress, by hash
+type swarmTracker struct {
+	mu     sync.Mutex
+	active map[string]*swarmDownload
+}
+
+func newSwarmTracker() *swarmTracker {
+	return &swarmTracker{active: make(map[string]*swarmDownload)}
+}
+
+// begin records a download, reporting false if the object is already
+// being fetched
+func (s *swarmTracker) begin(hash string, d *swarmDownload) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active[hash] != nil {
+		return false
+	}
+	s.active[hash] = d
+	return true
+}
+
+func (s *swarmTracker) end(hash string) {
+	s.mu.Lock()
+	delete(s.active, hash)
+	s.mu.Unlock()
+}
+
+func (s *swarmTracker) get(hash string) *swarmDownload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active[hash]
+}
+
+// openRange opens the part of an object being fetched that a range asks
+// for, if all of it was received
+func (s *swarmTracker) openRange(hash string, r protocol.ByteRange) (io.ReadCloser, int64, bool) {
+	d := s.get(hash)
+	if d == nil || !d.covers(r) {
+		return nil, 0, false
+	}
+	file, err := os.Open(d.file.Name())
+	if err != nil {
+		return nil, 0, false
+	}
+	return file, d.size, true
+}
+
+// handleWant answers with the chunks of an object that can be served from
+// here: all of them if it is stored, or those a swarm download received
+func (n *Node) handleWant(peer *network.Peer, msg *protocol.Message) error {
+	var want protocol.Want
+	if err := msg.ParsePayload(&want); err != nil {
+		return fmt.Errorf("failed to parse want: %w", err)
+	}
+	if msg.RequestID == "" {
+		return fmt.Errorf("refusing want from %s without a request ID", msg.SenderID)
+	}
+	if meta, ok := n.catalog.get(want.ContentHash); ok {
+		if err := n.servable(meta); err != nil {
+			n.refuseRequest(peer, msg, protocol.ErrorCodeUnauthorized, err.Error())
+			return err
+		}
+	}
+
+	var have protocol.Have
+	if n.hasObject(want.ContentHash) {
+		file, size, err := n.openObject(want.ContentHash)
+		if err != nil {
+			n.refuseRequest(peer, msg, protocol.ErrorCodeNotFound, "no copy of "+want.ContentHash)
+			return fmt.Errorf("failed to open %s: %w", want.ContentHash, err)
+		}
+		file.Close()
+		have = protocol.Have{
+			ContentHash: want.ContentHash,
+			Size:        size,
+			ChunkSize:   want.ChunkSize,
+			Bitfield:    fullBitfield(chunkCount(size, want.ChunkSize)),
+		}
+	} else if d := n.swarms.get(want.ContentHash); d != nil {
+		have = d.pieces(want.ContentHash)
+	} else {
+		n.refuseRequest(peer, msg, protocol.ErrorCodeNotFound, "no chunks of "+want.ContentHash)
+		return nil
+	}
+
+	reply, err := protocol.NewMessage(protocol.MessageTypeHave, n.ID, have)
+	if err != nil {
+		return err
+	}
+	reply.RequestID = msg.RequestID
+	reply.TraceID = msg.TraceID
+	return peer.Send(reply)
+}
+
+func (n *Node) handleHave(peer *network.Peer, msg *protocol.Message) error {
+	var have protocol.Have
+	if err := msg.ParsePayload(&have); err != nil {
+		return fmt.Errorf("failed to parse have: %w", err)
+	}
+	if !n.haves.resolve(msg.RequestID, have) {
+		n.debugf("Peer %s answered want %s, which is no longer pending\n", peer.ID(), msg.RequestID)
+	}
+	return nil
+}
+
+// askPieces asks a connected peer which chunks of an object it holds
+func (n *Node) askPieces(ctx context.Context, peerID, hash string) (PeerPieces, error) {
+	peer, ok := n.peerConn(peerID)
+	if !ok {
+		return PeerPieces{}, fmt.Errorf("peer %s is not connected", peerID)
+	}
+	requestID, err := protocol.NewMessageID()
+	if err != nil {
+		return PeerPieces{}, err
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeWant, n.ID, protocol.Want{ContentHash: hash, ChunkSize: swarmChunkSize})
+	if err != nil {
+		return PeerPieces{}, fmt.Errorf("failed to create want: %w", err)
+	}
+	msg.RequestID = requestID
+	msg.TraceID = n.traceID(nil)
+
+	reply := n.haves.add(requestID)
+	defer n.haves.remove(requestID)
+	answer := n.requests.add(requestID)
+	defer n.requests.remove(requestID)
+	if err := peer.Send(msg); err != nil {
+		return PeerPieces{}, fmt.Errorf("failed to send want: %w", err)
+	}
+
+	select {
+	case have := <-reply:
+		pieces := PeerPieces{
+			PeerID:    peerID,
+			Size:      have.Size,
+			ChunkSize: have.ChunkSize,
+			Chunks:    have.ChunkCount(),
+			have:      bitfield(have.Bitfield),
+		}
+		for i := 0; i < pieces.Chunks; i++ {
+			if pieces.Has(i) {
+				pieces.Held++
+			}
+		}
+		return pieces, nil
+	case err := <-answer:
+		return PeerPieces{}, fmt.Errorf("failed to ask %s for chunks of %s: %w", peerID, hash, err)
+	case <-ctx.Done():
+		return PeerPieces{}, ctx.Err()
+	case <-n.done:
+		return PeerPieces{}, fmt.Errorf("node stopped")
+	}
+}
+
+// Pieces asks every connected peer that answers wants which chunks of an
+// object it can serve, and returns those holding any, by peer ID. Peers
+// that don't answer before ctx is done are left out.
+func (n *Node) Pieces(ctx context.Context, hash string) []PeerPieces {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		pieces []PeerPieces
+	)
+	for _, id := range n.connectedPeers() {
+		if !n.peerSupports(id, protocol.FeatureHave) {
+			continue
+		}
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			p, err := n.askPieces(ctx, id, hash)
+			if err != nil {
+				n.debugf("No chunks of %s from %s: %v\n", hash, id, err)
+				return
+			}
+			if p.Held == 0 {
+				return
+			}
+			mu.Lock()
+			pieces = append(pieces, p)
+			mu.Unlock()
+		}(id)
+	}
+	wg.Wait()
+
+	sort.Slice(pieces, func(i, j int) bool { return pieces[i].PeerID < pieces[j].PeerID })
+	return pieces
+}
+
+// schedulePieces spreads chunks over the peers holding them, rarest first,
+// each to the holder given the fewest so far. Each peer's chunks are
+// returned in order.
+func schedulePieces(chunks []int, holders []PeerPieces) (map[string][]int, error) {
+	rarity := make(map[int]int, len(chunks))
+	for _, chunk := range chunks {
+		for _, h := range holders {
+			if h.Has(chunk) {
+				rarity[chunk]++
+			}
+		}
+		if rarity[chunk] == 0 {
+			return nil, fmt.Errorf("no peer holds chunk %d", chunk)
+		}
+	}
+	order := append([]int(nil), chunks...)
+	sort.SliceStable(order, func(i, j int) bool { return rarity[order[i]] < rarity[order[j]] })
+
+	assigned := make(map[string][]int)
+	for _, chunk := range order {
+		best := ""
+		for _, h := range holders {
+			if h.Has(chunk) && (best == "" || len(assigned[h.PeerID]) < len(assigned[best])) {
+				best = h.PeerID
+			}
+		}
+		assigned[best] = append(assigned[best], chunk)
+	}
+	for _, peerChunks := range assigned {
+		sort.Ints(peerChunks)
+	}
+	return assigned, nil
+}
+
+// FetchSwarm fetches an object as stored from every connected peer holding
+// chunks of it at once. Which peer holds which chunks is learned with
+// Pieces; the rarest chunks are asked for first and the rest spread evenly,
+// as range requests. The chunks of a peer that fails are asked of the other
+// holders. Once every chunk arrived the object is verified and stored.
+func (n *Node) FetchSwarm(ctx context.Context, hash string) error {
+	if n.store.Exists(hash) {
+		return nil
+	}
+	holders := n.Pieces(ctx, hash)
+	// Peers fetching the object themselves may report other chunk sizes
+	var usable []PeerPieces
+	for _, h := range holders {
+		if h.ChunkSize == swarmChunkSize && (len(usable) == 0 || h.Size == usable[0].Size) {
+			usable = append(usable, h)
+		}
+	}
+	if len(usable) == 0 {
+		return fmt.Errorf("failed to fetch %s: %w", hash, ErrNotFound)
+	}
+	// Chunks two holders could send equally go to the nearer one
+	ids := make([]string, len(usable))
+	for i, h := range usable {
+		ids[i] = h.PeerID
+	}
+	rank := make(map[string]int, len(ids))
+	for i, id := range n.byLatency(ids) {
+		rank[id] = i
+	}
+	sort.Slice(usable, func(i, j int) bool { return rank[usable[i].PeerID] < rank[usable[j].PeerID] })
+	size := usable[0].Size
+	if err := n.checkStoredSize(hash, size); err != nil {
+		return fmt.Errorf("refusing %s: %w", hash, err)
+	}
+
+	file, err := n.store.CreateTemp()
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+	d := &swarmDownload{file: file, size: size, chunkSize: swarmChunkSize, have: newBitfield(chunkCount(size, swarmChunkSize))}
+	if !n.swarms.begin(hash, d) {
+		return fmt.Errorf("%s is already being fetched", hash)
+	}
+	defer n.swarms.end(hash)
+
+	for pending := d.missing(); len(pending) > 0; pending = d.missing() {
+		assigned, err := schedulePieces(pending, usable)
+		if err != nil {
+			return fmt.Errorf("failed to fetch %s: %w", hash, err)
+		}
+		failed := n.fetchPieces(ctx, hash, d, assigned)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		kept := usable[:0]
+		for _, h := range usable {
+			if failed[h.PeerID] == nil {
+				kept = append(kept, h)
+			}
+		}
+		usable = kept
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to reset file pointer: %w", err)
+	}
+	got, err := crypto.ContentHash(file)
+	if err != nil {
+		return fmt.Errorf("failed to calculate hash: %w", err)
+	}
+	if got != hash {
+		return ErrHashMismatch
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to reset file pointer: %w", err)
+	}
+	if err := n.store.Store(hash, file); err != nil {
+		return fmt.Errorf("failed to store file: %w", err)
+	}
+	n.emit(Event{Type: EventFileStored, ContentHash: hash})
+	return nil
+}
+
+// fetchPieces fetches the chunks assigned to each peer, from all of them
+// at once, and returns why those that failed did
+func (n *Node) fetchPieces(ctx context.Context, hash string, d *swarmDownload, assigned map[string][]int) map[string]error {
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed = make(map[string]error)
+	)
+	for peerID, chunks := range assigned {
+		wg.Add(1)
+		go func(peerID string, chunks []int) {
+			defer wg.Done()
+			for _, run := range chunkRuns(chunks, MaxRangeLength/d.chunkSize) {
+				offset := int64(run[0]) * int64(d.chunkSize)
+				length := min(int64(len(run))*int64(d.chunkSize), d.size-offset)
+				data, err := n.FetchRange(ctx, peerID, hash, offset, length)
+				if err == nil && int64(len(data)) != length {
+					err = fmt.Errorf("got %d bytes of the %d asked for", len(data), length)
+				}
+				if err == nil {
+					err = d.write(run[0], data)
+				}
+				if err != nil {
+					n.debugf("Failed to fetch chunks of %s from %s: %v\n", hash, peerID, err)
+					mu.Lock()
+					failed[peerID] = err
+					mu.Unlock()
+					return
+				}
+			}
+		}(peerID, chunks)
+	}
+	wg.Wait()
+	return failed
+}
+
+// chunkRuns splits sorted chunk indexes into runs of consecutive ones, at
+// most max long
+func chunkRuns(chunks []int, max int) [][]int {
+	var runs [][]int
+	for i, chunk := range chunks {
+		last := len(runs) - 1
+		if i > 0 && chunk == chunks[i-1]+1 && len(runs[last]) < max {
+			runs[last] = append(runs[last], chunk)
+			continue
+		}
+		runs = append(runs, []int{chunk})
+	}
+	return runs
+}
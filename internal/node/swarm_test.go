@@ -0,0 +1,119 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+)
+
+func TestSchedulePieces(t *testing.T) {
+	holders := []PeerPieces{
+		{PeerID: "a", have: fullBitfield(6)},
+		{PeerID: "b", have: bitfield{0xc0}}, // chunks 0 and 1
+		{PeerID: "c", have: bitfield{0x04}}, // chunk 5
+	}
+	got, err := schedulePieces([]int{0, 1, 2, 3, 4, 5}, holders)
+	if err != nil {
+		t.Fatalf("schedulePieces() error = %v", err)
+	}
+	// Chunks only a holds go to it first; the shared ones then go to the
+	// holders given fewest
+	want := map[string][]int{"a": {2, 3, 4}, "b": {0, 1}, "c": {5}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("schedulePieces() = %v, want %v", got, want)
+	}
+
+	if _, err := schedulePieces([]int{6}, holders); err == nil {
+		t.Error("schedulePieces() assigned a chunk no peer holds")
+	}
+}
+
+func TestChunkRuns(t *testing.T) {
+	got := chunkRuns([]int{0, 1, 2, 3, 5, 7, 8}, 3)
+	want := [][]int{{0, 1, 2}, {3}, {5}, {7, 8}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("chunkRuns() = %v, want %v", got, want)
+	}
+}
+
+func TestNode_FetchSwarm(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	newTestNode := func(id string, first bool) *Node {
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"),
+			WithFirstNode(first), WithReplication(ReplicationConfig{Target: 1, Interval: time.Hour}))
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		n.transport.Start()
+		return n
+	}
+	seeder := newTestNode("seeder", true)
+	defer seeder.Stop()
+	partial := newTestNode("partial", false)
+	defer partial.Stop()
+	leecher := newTestNode("leecher", false)
+	defer leecher.Stop()
+
+	data := bytes.Repeat([]byte("swarm"), 4*swarmChunkSize/5)
+	hash, err := crypto.ContentHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to hash object: %v", err)
+	}
+	if err := seeder.store.Store(hash, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Failed to store object: %v", err)
+	}
+
+	// The partial node is fetching the object itself and has its first two
+	// chunks so far
+	file, err := partial.store.CreateTemp()
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer file.Close()
+	d := &swarmDownload{file: file, size: int64(len(data)), chunkSize: swarmChunkSize, have: newBitfield(4)}
+	if err := d.write(0, data[:2*swarmChunkSize]); err != nil {
+		t.Fatalf("write() error = %v", err)
+	}
+	partial.swarms.begin(hash, d)
+
+	for _, address := range []string{seeder.Address(), partial.Address()} {
+		if err := leecher.Connect(context.Background(), address); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(leecher.connectedPeers()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Leecher never completed the handshakes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pieces := leecher.Pieces(ctx, hash)
+	if len(pieces) != 2 || pieces[0].PeerID != "partial" || pieces[0].Held != 2 || pieces[1].Held != 4 {
+		t.Fatalf("Pieces() = %+v, want 2 chunks on partial and all 4 on seeder", pieces)
+	}
+
+	if err := leecher.FetchSwarm(ctx, hash); err != nil {
+		t.Fatalf("FetchSwarm() error = %v", err)
+	}
+	if !leecher.store.Exists(hash) {
+		t.Fatal("Object not stored after FetchSwarm()")
+	}
+	received := make(map[string]int64)
+	for _, entry := range leecher.Ledger() {
+		received[entry.PeerID] = entry.Received
+	}
+	if received["partial"] != 2*swarmChunkSize || received["seeder"] != int64(len(data))-2*swarmChunkSize {
+		t.Errorf("Bytes received by peer = %v, want the first two chunks from partial and the rest from seeder", received)
+	}
+}
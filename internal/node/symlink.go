@@ -0,0 +1,120 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SymlinkPolicy decides what happens to symbolic links found in the watch
+// directory or an imported tree
+type SymlinkPolicy string
+
+const (
+	// SymlinkFollow stores the content the link points to. Links to
+	// directories are descended into during imports; loops are detected
+	// and reported instead of being walked forever.
+	SymlinkFollow SymlinkPolicy = "follow"
+	// SymlinkPreserve stores the link itself, recording its target so that
+	// restoring recreates the link rather than a copy of the content
+	SymlinkPreserve SymlinkPolicy = "preserve"
+	// SymlinkIgnore skips links entirely
+	SymlinkIgnore SymlinkPolicy = "ignore"
+)
+
+// ParseSymlinkPolicy converts a policy name to a SymlinkPolicy
+func ParseSymlinkPolicy(s string) (SymlinkPolicy, error) {
+	switch p := SymlinkPolicy(strings.ToLower(s)); p {
+	case SymlinkFollow, SymlinkPreserve, SymlinkIgnore:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown symlink policy %q (want follow, preserve or ignore)", s)
+	}
+}
+
+// errSymlinkLoop is reported for links that lead back into a directory
+// already being walked
+var errSymlinkLoop = errors.New("symlink loop detected")
+
+// resolveLink returns the real path and file info a symlink points to.
+// Chains of links that never terminate are reported as loops.
+func resolveLink(path string) (string, os.FileInfo, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if strings.Contains(err.Error(), "too many links") {
+			return "", nil, errSymlinkLoop
+		}
+		return "", nil, err
+	}
+	info, err := os.Stat(real)
+	if err != nil {
+		return "", nil, err
+	}
+	return real, info, nil
+}
+
+// within reports whether path is dir itself or lies beneath it
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// resolveWatchPath applies the symlink policy to a new watch directory entry
+// and returns the path whose content should be stored. It returns false when
+// the entry was skipped or has already been stored as a link.
+func (n *Node) resolveWatchPath(path string) (string, bool) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return path, true
+	}
+
+	switch n.symlinkPolicy {
+	case SymlinkIgnore:
+		fmt.Printf("Ignoring symlink %s\n", path)
+		return "", false
+	case SymlinkPreserve:
+		if _, err := n.storeLink(path, info); err != nil {
+			fmt.Printf("Failed to store symlink %s: %v\n", path, err)
+		}
+		return "", false
+	}
+
+	real, target, err := resolveLink(path)
+	if err != nil {
+		fmt.Printf("Skipping symlink %s: %v\n", path, err)
+		return "", false
+	}
+	if !target.Mode().IsRegular() {
+		fmt.Printf("Skipping symlink %s: target is not a regular file (use import for directories)\n", path)
+		return "", false
+	}
+	return real, true
+}
+
+// storeLink stores a symlink as an object holding its target path
+func (n *Node) storeLink(path string, info os.FileInfo) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+
+	hash, _, err := n.ingest(strings.NewReader(target), EncryptNetwork)
+	if err != nil {
+		return "", err
+	}
+
+	meta := FileMeta{
+		Hash:    hash,
+		Name:    filepath.Base(path),
+		Size:    int64(len(target)),
+		ModTime: info.ModTime(),
+		Link:    target,
+	}
+	if err := n.catalog.add(meta); err != nil {
+		return "", fmt.Errorf("failed to update catalog: %w", err)
+	}
+	n.emit(Event{Type: EventFileStored, ContentHash: hash, FileName: meta.Name, Size: meta.Size})
+	n.announce(meta)
+	return hash, nil
+}
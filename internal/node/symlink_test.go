@@ -0,0 +1,135 @@
+package node
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSymlinkPolicy(t *testing.T) {
+	for _, name := range []string{"follow", "preserve", "ignore", "FOLLOW"} {
+		if _, err := ParseSymlinkPolicy(name); err != nil {
+			t.Errorf("ParseSymlinkPolicy(%q) failed: %v", name, err)
+		}
+	}
+	if _, err := ParseSymlinkPolicy("copy"); err == nil {
+		t.Error("Expected error for unknown policy")
+	}
+}
+
+// setupLinkTree creates src/file.txt, src/sub/loop -> src and
+// src/ext -> a directory outside src containing other.txt
+func setupLinkTree(t *testing.T, baseDir string) string {
+	src := filepath.Join(baseDir, "src")
+	external := filepath.Join(baseDir, "external")
+	for _, dir := range []string{filepath.Join(src, "sub"), external} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, "file.txt"), []byte("file"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(external, "other.txt"), []byte("other"), 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Symlink(src, filepath.Join(src, "sub", "loop")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Symlink(external, filepath.Join(src, "ext")); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	return src
+}
+
+func TestImport_SymlinkPolicies(t *testing.T) {
+	tests := []struct {
+		policy   SymlinkPolicy
+		imported int
+		links    int
+		ignored  int
+		failed   int
+	}{
+		{SymlinkFollow, 2, 0, 0, 1}, // file.txt and ext/other.txt; the loop is reported
+		{SymlinkPreserve, 1, 2, 0, 0},
+		{SymlinkIgnore, 1, 0, 2, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			baseDir, cleanup := setupTestDir(t)
+			defer cleanup()
+
+			src := setupLinkTree(t, baseDir)
+			node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+				WithFirstNode(true), WithSymlinkPolicy(tt.policy))
+			if err != nil {
+				t.Fatalf("Failed to create node: %v", err)
+			}
+			defer node.Stop()
+
+			result, err := node.Import(src)
+			if err != nil {
+				t.Fatalf("Failed to import: %v", err)
+			}
+			if result.Imported != tt.imported || result.Links != tt.links || result.Ignored != tt.ignored || result.Failed != tt.failed {
+				t.Errorf("Import = %+v, want %d imported, %d links, %d ignored, %d failed",
+					result, tt.imported, tt.links, tt.ignored, tt.failed)
+			}
+			if tt.failed > 0 && !strings.Contains(strings.Join(result.Errors, "\n"), errSymlinkLoop.Error()) {
+				t.Errorf("Errors = %v, want a symlink loop", result.Errors)
+			}
+		})
+	}
+}
+
+func TestRestore_PreservedSymlinks(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	src := setupLinkTree(t, baseDir)
+	node, err := NewNode("test-node", ":0", filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"),
+		WithFirstNode(true), WithSymlinkPolicy(SymlinkPreserve))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer node.Stop()
+
+	imported, err := node.Import(src)
+	if err != nil {
+		t.Fatalf("Failed to import: %v", err)
+	}
+
+	dest := filepath.Join(baseDir, "dest")
+	if _, err := node.Restore(imported.Manifest, dest); err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+
+	target, err := os.Readlink(filepath.Join(dest, "sub", "loop"))
+	if err != nil {
+		t.Fatalf("Restored entry is not a symlink: %v", err)
+	}
+	if target != src {
+		t.Errorf("Link target = %v, want %v", target, src)
+	}
+}
+
+func TestResolveLink_Loop(t *testing.T) {
+	dir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	if err := os.Symlink(b, a); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+	if err := os.Symlink(a, b); err != nil {
+		t.Fatalf("Failed to create symlink: %v", err)
+	}
+
+	if _, _, err := resolveLink(a); !errors.Is(err, errSymlinkLoop) {
+		t.Errorf("resolveLink() error = %v, want %v", err, errSymlinkLoop)
+	}
+}
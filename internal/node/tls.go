@@ -0,0 +1,95 @@
+package node
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"p2p-storage/internal/network"
+)
+
+// ErrCertificateMismatch is returned when a peer's TLS certificate is not
+// for the identity key in its handshake
+var ErrCertificateMismatch = errors.New("TLS certificate does not match the identity key")
+
+// ErrSessionKeyMismatch is returned when the identity key a peer proved in
+// its session handshake is not the one in its node handshake
+var ErrSessionKeyMismatch = errors.New("session key does not match the identity key")
+
+// TLSConfig selects TLS with mutual authentication for peer connections
+type TLSConfig struct {
+	Enabled bool
+	// CertFile and KeyFile hold the PEM certificate presented to peers. If
+	// empty, a self-signed certificate for the identity key is used.
+	CertFile string
+	KeyFile  string
+	// CAFile holds PEM certificates that peer certificates must chain to.
+	// If empty, any certificate is accepted as long as it is for the
+	// identity key the peer presents in its handshake.
+	CAFile string
+}
+
+// transportTLS builds the TLS configuration of the transport, or returns
+// nil when TLS is disabled
+func (n *Node) transportTLS() (*tls.Config, error) {
+	cfg := n.tlsConfig
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("a TLS certificate and key must be given together")
+	}
+
+	var cert tls.Certificate
+	var err error
+	if cfg.CertFile != "" {
+		cert, err = tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	} else {
+		cert, err = n.identity.Certificate()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	var roots *x509.CertPool
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS CA: %w", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+	return network.NewTLSConfig(cert, roots), nil
+}
+
+// checkCertificate binds a peer's TLS certificate to the identity key of its
+// handshake. Certificates verified against a CA vouch for the peer on their
+// own and are not bound.
+func (n *Node) checkCertificate(peer *network.Peer, publicKey []byte) error {
+	cert := peer.Certificate()
+	if cert == nil || n.tlsConfig.CAFile != "" {
+		return nil
+	}
+	key, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok || !bytes.Equal(key, publicKey) {
+		return ErrCertificateMismatch
+	}
+	return nil
+}
+
+// checkSessionKey binds the identity key a peer proved in its session
+// handshake to the one in its node handshake
+func (n *Node) checkSessionKey(peer *network.Peer, publicKey []byte) error {
+	key := peer.SessionKey()
+	if key != nil && !bytes.Equal(key, publicKey) {
+		return ErrSessionKeyMismatch
+	}
+	return nil
+}
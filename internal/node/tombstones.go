@@ -0,0 +1,337 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"p2p-storage/internal/crypto"
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// tombstoneMaxAge is how long a tombstone is kept and passed on. By then
+// every peer online in the meantime has heard of it.
+const tombstoneMaxAge = 30 * 24 * time.Hour
+
+// tombstoneMaxSkew is how far in the future a tombstone may be dated, to
+// allow for clocks running ahead. A tombstone dated later would outlive
+// tombstoneMaxAge.
+const tombstoneMaxSkew = 5 * time.Minute
+
+// maxTombstonesPerSigner bounds the tombstones kept from any one other
+// node, so a single key can't fill the store with deletions
+const maxTombstonesPerSigner = 10000
+
+// DeletePolicy sets whether the node deletes its copies of objects other
+// nodes deleted. Deletions spread as tombstones signed with the deleting
+// node's identity key; they are passed on whatever the policy.
+type DeletePolicy struct {
+	// Honor makes the node delete objects deleted elsewhere
+	Honor bool
+	// Trusted lists the key fingerprints of the nodes whose deletions are
+	// honored. Deletions by any other node are only passed on, so with
+	// none listed nothing is deleted.
+	Trusted []string
+}
+
+// WithDeletePolicy sets whether deletions by other nodes are honored
+func WithDeletePolicy(policy DeletePolicy) Option {
+	return func(n *Node) {
+		trusted := make([]string, 0, len(policy.Trusted))
+		for _, fingerprint := range policy.Trusted {
+			if fingerprint != "" {
+				trusted = append(trusted, fingerprint)
+			}
+		}
+		policy.Trusted = trusted
+		n.deletePolicy = policy
+	}
+}
+
+// honors reports whether the policy honors deletions signed by a key
+func (p DeletePolicy) honors(fingerprint string) bool {
+	return p.Honor && slices.Contains(p.Trusted, fingerprint)
+}
+
+// Tombstone records that the node holding an identity key deleted an object
+type Tombstone struct {
+	Hash      string    `json:"hash"`
+	Deleted   time.Time `json:"deleted"`
+	PublicKey []byte    `json:"public_key"`
+	Signature []byte    `json:"signature"`
+}
+
+// Signer returns the key fingerprint of the node that deleted the object
+func (t Tombstone) Signer() string {
+	return crypto.Fingerprint(t.PublicKey)
+}
+
+func (t Tombstone) payload() protocol.Tombstone {
+	return protocol.Tombstone{
+		ContentHash: t.Hash,
+		Timestamp:   t.Deleted.Unix(),
+		PublicKey:   t.PublicKey,
+		Signature:   t.Signature,
+	}
+}
+
+func tombstoneFromPayload(p protocol.Tombstone) Tombstone {
+	return Tombstone{
+		Hash:      p.ContentHash,
+		Deleted:   time.Unix(p.Timestamp, 0).UTC(),
+		PublicKey: p.PublicKey,
+		Signature: p.Signature,
+	}
+}
+
+// Verify reports whether the tombstone is signed by the key it names
+func (t Tombstone) Verify() bool {
+	if t.Hash == "" {
+		return false
+	}
+	p := t.payload()
+	return crypto.Verify(p.PublicKey, p.SignedData(), p.Signature)
+}
+
+// expired reports whether a tombstone is too old to keep
+func (t Tombstone) expired() bool {
+	return time.Since(t.Deleted) > tombstoneMaxAge
+}
+
+// tombstoneStore keeps the tombstones heard of, one per object and signer,
+// and persists them as JSON
+type tombstoneStore struct {
+	path    string
+	mu      sync.Mutex
+	records map[string]Tombstone // hash/signer -> tombstone
+}
+
+// loadTombstones reads the tombstones at path, dropping expired ones and
+// starting empty if it does not exist
+func loadTombstones(path string) (*tombstoneStore, error) {
+	s := &tombstoneStore{
+		path:    path,
+		records: make(map[string]Tombstone),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tombstones: %w", err)
+	}
+
+	var tombstones []Tombstone
+	if err := json.Unmarshal(data, &tombstones); err != nil {
+		return nil, fmt.Errorf("failed to parse tombstones: %w", err)
+	}
+	for _, t := range tombstones {
+		if !t.expired() {
+			s.records[t.Hash+"/"+t.Signer()] = t
+		}
+	}
+	return s, nil
+}
+
+// put stores a verified tombstone not yet held, reporting whether it was
+// new. Expired tombstones are ignored, so they stop spreading, and those
+// dated in the future are refused. With a limit, a signer already holding
+// that many tombstones has further ones refused.
+func (s *tombstoneStore) put(t Tombstone, limit int) (bool, error) {
+	if !t.Verify() {
+		return false, fmt.Errorf("invalid signature on tombstone of %s", t.Hash)
+	}
+	if t.Deleted.After(time.Now().Add(tombstoneMaxSkew)) {
+		return false, fmt.Errorf("tombstone of %s is dated in the future: %s", t.Hash, t.Deleted.Format(time.RFC3339))
+	}
+	if t.expired() {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	signer := t.Signer()
+	key := t.Hash + "/" + signer
+	if _, ok := s.records[key]; ok {
+		return false, nil
+	}
+	held := 0
+	for k, old := range s.records {
+		if old.expired() {
+			delete(s.records, k)
+		} else if strings.HasSuffix(k, "/"+signer) {
+			held++
+		}
+	}
+	if limit > 0 && held >= limit {
+		return false, fmt.Errorf("%s already has %d tombstones, refusing the one of %s", signer, held, t.Hash)
+	}
+	s.records[key] = t
+
+	data, err := json.MarshalIndent(s.listLocked(), "", "  ")
+	if err != nil {
+		return true, fmt.Errorf("failed to encode tombstones: %w", err)
+	}
+	return true, writeFileAtomic(s.path, data)
+}
+
+// deleted reports whether a tombstone for hash is signed by a key honored
+func (s *tombstoneStore) deleted(hash string, honored func(fingerprint string) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.records {
+		if t.Hash == hash && honored(t.Signer()) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns every tombstone, oldest first
+func (s *tombstoneStore) list() []Tombstone {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listLocked()
+}
+
+func (s *tombstoneStore) listLocked() []Tombstone {
+	tombstones := make([]Tombstone, 0, len(s.records))
+	for _, t := range s.records {
+		tombstones = append(tombstones, t)
+	}
+	sort.Slice(tombstones, func(i, j int) bool {
+		if !tombstones[i].Deleted.Equal(tombstones[j].Deleted) {
+			return tombstones[i].Deleted.Before(tombstones[j].Deleted)
+		}
+		return tombstones[i].Hash < tombstones[j].Hash
+	})
+	return tombstones
+}
+
+// Delete removes a stored object and propagates a tombstone for it, so
+// peers whose delete policy trusts this node remove their copies as well
+func (n *Node) Delete(hash string) (Tombstone, error) {
+	if !n.store.Exists(hash) {
+		return Tombstone{}, fmt.Errorf("%s is not stored locally", hash)
+	}
+
+	t := Tombstone{
+		Hash:      hash,
+		Deleted:   time.Now().UTC().Truncate(time.Second),
+		PublicKey: n.identity.Public,
+	}
+	p := t.payload()
+	t.Signature = n.identity.Sign(p.SignedData())
+
+	if err := n.removeObject(hash); err != nil {
+		return Tombstone{}, err
+	}
+	if _, err := n.tombstones.put(t, 0); err != nil {
+		return Tombstone{}, err
+	}
+	if err := n.sendTombstones(nil, []Tombstone{t}); err != nil {
+		fmt.Printf("Failed to propagate deletion of %s: %v\n", hash, err)
+	}
+	return t, nil
+}
+
+// Tombstones returns the deletions heard of and not yet expired, oldest
+// first
+func (n *Node) Tombstones() []Tombstone {
+	return n.tombstones.list()
+}
+
+// deleted reports whether an object was deleted by a node whose deletions
+// are honored here, or by this node, so it isn't pulled back in
+func (n *Node) deleted(hash string) bool {
+	self := n.Identity()
+	return n.tombstones.deleted(hash, func(fingerprint string) bool {
+		return fingerprint == self || n.deletePolicy.honors(fingerprint)
+	})
+}
+
+// removeObject deletes an object from the store and the catalog, and stops
+// tracking its popularity unless the relay cache still holds it
+func (n *Node) removeObject(hash string) error {
+	if err := n.store.Delete(hash); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete %s: %w", hash, err)
+	}
+	if err := n.catalog.remove(hash); err != nil {
+		fmt.Printf("Failed to update catalog: %v\n", err)
+	}
+	if !n.hasObject(hash) {
+		n.popularity.forget(hash)
+	}
+	n.emit(Event{Type: EventFileDeleted, ContentHash: hash})
+	return nil
+}
+
+// sendTombstones sends tombstones to one peer, or to every connected peer
+// when peer is nil, protocol.MaxRecords to a message
+func (n *Node) sendTombstones(peer *network.Peer, tombstones []Tombstone) error {
+	for len(tombstones) > 0 {
+		batch := tombstones[:min(len(tombstones), protocol.MaxRecords)]
+		tombstones = tombstones[len(batch):]
+
+		payload := protocol.TombstonePayload{Tombstones: make([]protocol.Tombstone, len(batch))}
+		for i, t := range batch {
+			payload.Tombstones[i] = t.payload()
+		}
+		msg, err := protocol.NewMessage(protocol.MessageTypeTombstone, n.ID, payload)
+		if err != nil {
+			return err
+		}
+		if peer == nil {
+			err = n.broadcast("tombstones", msg)
+		} else {
+			n.sign(msg)
+			err = peer.Send(msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleTombstone stores tombstones not yet held, deletes the objects they
+// are for when the policy trusts their signers and passes them on.
+// Tombstones already held stop spreading, so propagation ends.
+func (n *Node) handleTombstone(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.TombstonePayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse tombstones: %w", err)
+	}
+
+	var accepted []Tombstone
+	for _, p := range payload.Tombstones {
+		t := tombstoneFromPayload(p)
+		ok, err := n.tombstones.put(t, maxTombstonesPerSigner)
+		if err != nil {
+			fmt.Printf("Rejected tombstone from %s: %v\n", msg.SenderID, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		accepted = append(accepted, t)
+		if !n.deletePolicy.honors(t.Signer()) || !n.store.Exists(t.Hash) {
+			continue
+		}
+		if err := n.removeObject(t.Hash); err != nil {
+			fmt.Printf("Failed to honor deletion of %s by %s: %v\n", t.Hash, t.Signer(), err)
+			continue
+		}
+		fmt.Printf("Deleted %s, as %s deleted it\n", t.Hash, t.Signer())
+	}
+	return n.sendTombstones(nil, accepted)
+}
@@ -0,0 +1,156 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+)
+
+func TestDeletePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy DeletePolicy
+		want   bool
+	}{
+		{"ignored", DeletePolicy{}, false},
+		{"no signers", DeletePolicy{Honor: true}, false},
+		{"trusted signer", DeletePolicy{Honor: true, Trusted: []string{"aaaa", "bbbb"}}, true},
+		{"untrusted signer", DeletePolicy{Honor: true, Trusted: []string{"aaaa"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.honors("bbbb"); got != tt.want {
+				t.Errorf("honors() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTombstoneStore(t *testing.T) {
+	dir := t.TempDir()
+	identity, err := crypto.LoadOrCreateIdentity(filepath.Join(dir, "identity.key"))
+	if err != nil {
+		t.Fatalf("Failed to create identity: %v", err)
+	}
+	sign := func(hash string, deleted time.Time) Tombstone {
+		tombstone := Tombstone{Hash: hash, Deleted: deleted.UTC().Truncate(time.Second), PublicKey: identity.Public}
+		p := tombstone.payload()
+		tombstone.Signature = identity.Sign(p.SignedData())
+		return tombstone
+	}
+
+	path := filepath.Join(dir, "tombstones.json")
+	store, err := loadTombstones(path)
+	if err != nil {
+		t.Fatalf("loadTombstones() error = %v", err)
+	}
+	tombstone := sign("abc123", time.Now())
+	if ok, err := store.put(tombstone, maxTombstonesPerSigner); !ok || err != nil {
+		t.Fatalf("put() = %v, %v; want a new tombstone", ok, err)
+	}
+	if ok, _ := store.put(tombstone, maxTombstonesPerSigner); ok {
+		t.Error("put() accepted a tombstone already held")
+	}
+	forged := sign("def456", time.Now())
+	forged.Hash = "fed654"
+	if _, err := store.put(forged, maxTombstonesPerSigner); err == nil {
+		t.Error("put() accepted a tombstone with a forged hash")
+	}
+	if ok, _ := store.put(sign("def456", time.Now().Add(-2*tombstoneMaxAge)), maxTombstonesPerSigner); ok {
+		t.Error("put() accepted an expired tombstone")
+	}
+	if _, err := store.put(sign("f00d", time.Now().Add(time.Hour)), maxTombstonesPerSigner); err == nil {
+		t.Error("put() accepted a tombstone dated in the future")
+	}
+
+	// The signer holds abc123 already, so a limit of two takes one more
+	if ok, err := store.put(sign("beef01", time.Now()), 2); !ok || err != nil {
+		t.Fatalf("put() = %v, %v; want a new tombstone within the limit", ok, err)
+	}
+	if _, err := store.put(sign("beef02", time.Now()), 2); err == nil {
+		t.Error("put() accepted a tombstone beyond the signer's limit")
+	}
+
+	reloaded, err := loadTombstones(path)
+	if err != nil {
+		t.Fatalf("loadTombstones() error = %v", err)
+	}
+	signer := identity.Fingerprint()
+	if !reloaded.deleted("abc123", func(fingerprint string) bool { return fingerprint == signer }) {
+		t.Error("Tombstone not kept across a reload")
+	}
+	if reloaded.deleted("abc123", func(string) bool { return false }) {
+		t.Error("deleted() = true for a signer not honored")
+	}
+}
+
+func TestNode_DeletePropagates(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	newTestNode := func(id string, first bool, opts ...Option) *Node {
+		opts = append(opts, WithFirstNode(first))
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"), opts...)
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		n.transport.Start()
+		return n
+	}
+	deleter := newTestNode("deleter", true)
+	defer deleter.Stop()
+	honoring := newTestNode("honoring", false, WithDeletePolicy(DeletePolicy{Honor: true, Trusted: []string{deleter.Identity()}}))
+	defer honoring.Stop()
+	ignoring := newTestNode("ignoring", false)
+	defer ignoring.Stop()
+
+	data := []byte("deleted everywhere that trusts the deleter")
+	hash, err := crypto.ContentHash(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to hash object: %v", err)
+	}
+	for _, n := range []*Node{deleter, honoring, ignoring} {
+		if err := n.store.Store(hash, bytes.NewReader(data)); err != nil {
+			t.Fatalf("Failed to store object: %v", err)
+		}
+	}
+	for _, n := range []*Node{honoring, ignoring} {
+		if err := n.Connect(context.Background(), deleter.Address()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		if err := n.waitForKey(5 * time.Second); err != nil {
+			t.Fatalf("Failed to receive network key: %v", err)
+		}
+	}
+
+	events, unsubscribe := honoring.Subscribe()
+	defer unsubscribe()
+	if _, err := deleter.Delete(hash); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if deleter.store.Exists(hash) {
+		t.Error("Object still stored on the node that deleted it")
+	}
+	waitForEvent(t, events, EventFileDeleted, 5*time.Second)
+	if honoring.store.Exists(hash) {
+		t.Error("Object still stored on a node honoring the deletion")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ignoring.Tombstones()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(ignoring.Tombstones()) == 0 {
+		t.Fatal("Tombstone didn't reach the node ignoring deletions")
+	}
+	if !ignoring.store.Exists(hash) {
+		t.Error("Object deleted on a node that doesn't honor deletions")
+	}
+	if !honoring.deleted(hash) || ignoring.deleted(hash) {
+		t.Error("deleted() doesn't follow the delete policy")
+	}
+}
@@ -0,0 +1,37 @@
+package node
+
+import (
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// WithTracing has the node give the announcements and requests it starts a
+// trace ID, which the messages and chunks sent because of them carry across
+// nodes. Traces started by other nodes are continued either way.
+func WithTracing(enabled bool) Option {
+	return func(n *Node) {
+		n.tracing = enabled
+	}
+}
+
+// traceID returns the trace ID for messages sent because of msg: that of
+// msg, or a new one if msg has none, or is nil, and the node traces
+func (n *Node) traceID(msg *protocol.Message) string {
+	if msg != nil && msg.TraceID != "" {
+		return msg.TraceID
+	}
+	if !n.tracing {
+		return ""
+	}
+	id, err := protocol.NewMessageID()
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// SetTap shows every message the node sends and receives to tap from now
+// on, or stops if tap is nil; see network.Transport.SetTap
+func (n *Node) SetTap(tap network.Tap) {
+	n.transport.SetTap(tap)
+}
@@ -0,0 +1,73 @@
+package node
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+func TestNode_TracesFetch(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	holder, err := NewNode("holder", freeAddr(t), filepath.Join(baseDir, "a", "store"), filepath.Join(baseDir, "a", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer holder.Stop()
+	holder.transport.Start()
+	events := make(chan network.TapEvent, 256)
+	holder.SetTap(network.ChannelTap(events))
+
+	requester, err := NewNode("requester", freeAddr(t), filepath.Join(baseDir, "b", "store"), filepath.Join(baseDir, "b", "watch"),
+		WithFirstNode(false), WithTracing(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer requester.Stop()
+	requester.transport.Start()
+
+	path := filepath.Join(baseDir, "file.txt")
+	writeTestFile(t, path, "followed from request to chunk")
+	hash, err := holder.StoreFile(path)
+	if err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	if err := requester.Connect(context.Background(), holder.Address()); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	if err := requester.waitForKey(5 * time.Second); err != nil {
+		t.Fatalf("Failed to receive network key: %v", err)
+	}
+	if err := requester.fetch(hash, 5*time.Second); err != nil {
+		t.Fatalf("fetch() error = %v", err)
+	}
+
+	// The holder saw the request arrive and answered it under its trace
+	var trace string
+	timeout := time.After(5 * time.Second)
+	for {
+		var e network.TapEvent
+		select {
+		case e = <-events:
+		case <-timeout:
+			t.Fatal("Timed out waiting for the traced request and chunk")
+		}
+		switch {
+		case e.Type == protocol.MessageTypeDataRequest && !e.Sent:
+			if e.TraceID == "" {
+				t.Fatal("Request from a tracing node carried no trace ID")
+			}
+			trace = e.TraceID
+		case e.Type == protocol.MessageTypeDataTransfer && e.Sent:
+			if trace == "" || e.TraceID != trace {
+				t.Errorf("Chunk trace = %q, want the request's %q", e.TraceID, trace)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"p2p-storage/internal/network"
+	"p2p-storage/internal/protocol"
+)
+
+// ErrNoSignalRelay is returned when no connected peer could pass a WebRTC
+// offer on
+var ErrNoSignalRelay = errors.New("no connected peer to relay the WebRTC offer")
+
+// answeredWindow is how long an answered offer's session is remembered, so
+// the copies other relays deliver are ignored
+const answeredWindow = time.Minute
+
+// WithWebRTC accepts peers over WebRTC data channels, which lets browsers
+// join the network directly, and lets ConnectWebRTC open them. Offers are
+// answered when relayed by a peer, and at network.WebRTCSignalPath on the
+// WebSocket listener, if there is one.
+func WithWebRTC(cfg network.WebRTCConfig) Option {
+	return func(n *Node) {
+		n.transportOpts = append(n.transportOpts, network.WithWebRTC(cfg))
+	}
+}
+
+// ConnectWebRTC opens a WebRTC data channel to the peer nodeID. The offer
+// is sent through every connected peer; peers connected to both pass it on,
+// and nodeID's answer back. ConnectWebRTC returns once the connection is
+// set up, like Connect.
+func (n *Node) ConnectWebRTC(ctx context.Context, nodeID string) error {
+	if _, ok := n.peerConn(nodeID); ok {
+		return fmt.Errorf("already connected to %s", nodeID)
+	}
+	if err := n.checkPeer(nodeID, n.knownKey(nodeID), ""); err != nil {
+		return err
+	}
+	return n.transport.DialWebRTC(ctx, func(ctx context.Context, offer string) (string, error) {
+		return n.signal(ctx, nodeID, offer)
+	})
+}
+
+// signal sends an offer to nodeID through every connected peer and waits
+// for its answer
+func (n *Node) signal(ctx context.Context, nodeID, offer string) (string, error) {
+	session, err := protocol.NewMessageID()
+	if err != nil {
+		return "", err
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeSignal, n.ID, protocol.SignalPayload{
+		From:    n.ID,
+		To:      nodeID,
+		Session: session,
+		SDP:     offer,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	answers := make(chan protocol.SignalPayload, 1)
+	n.mu.Lock()
+	n.signals[session] = answers
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.signals, session)
+		n.mu.Unlock()
+	}()
+
+	sent := 0
+	for _, id := range n.connectedPeers() {
+		if relay, ok := n.peerConn(id); ok && relay.Send(msg) == nil {
+			sent++
+		}
+	}
+	if sent == 0 {
+		return "", ErrNoSignalRelay
+	}
+
+	select {
+	case answer := <-answers:
+		if answer.Error != "" {
+			return "", fmt.Errorf("%s did not answer: %s", nodeID, answer.Error)
+		}
+		return answer.SDP, nil
+	case <-ctx.Done():
+		return "", fmt.Errorf("waiting for an answer from %s: %w", nodeID, ctx.Err())
+	}
+}
+
+// handleSignal passes WebRTC offers and answers on between two connected
+// peers, answers offers made to this node, and hands answers to the offer
+// waiting for them
+func (n *Node) handleSignal(peer *network.Peer, msg *protocol.Message) error {
+	var payload protocol.SignalPayload
+	if err := msg.ParsePayload(&payload); err != nil {
+		return fmt.Errorf("failed to parse signal: %w", err)
+	}
+
+	if payload.To != n.ID {
+		// Only relay straight from the source, so signals can't loop
+		if msg.SenderID != payload.From {
+			return nil
+		}
+		target, ok := n.peerConn(payload.To)
+		if !ok {
+			return nil
+		}
+		relayed, err := protocol.NewMessage(protocol.MessageTypeSignal, n.ID, payload)
+		if err != nil {
+			return err
+		}
+		return target.Send(relayed)
+	}
+
+	if payload.Reply {
+		n.mu.RLock()
+		answers, ok := n.signals[payload.Session]
+		n.mu.RUnlock()
+		if ok {
+			// Several relays may deliver the same answer
+			select {
+			case answers <- payload:
+			default:
+			}
+		}
+		return nil
+	}
+
+	if err := n.checkPeer(payload.From, n.knownKey(payload.From), ""); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	seen := n.answered[payload.Session]
+	n.answered[payload.Session] = true
+	n.mu.Unlock()
+	if seen {
+		return nil
+	}
+	time.AfterFunc(answeredWindow, func() {
+		n.mu.Lock()
+		delete(n.answered, payload.Session)
+		n.mu.Unlock()
+	})
+	release := peer.Hold(msg)
+	go func() {
+		defer release()
+		n.answerSignal(peer, payload)
+	}()
+	return nil
+}
+
+// answerSignal answers an offer back through the peer that relayed it,
+// with the reason instead if it can't be answered
+func (n *Node) answerSignal(relay *network.Peer, offer protocol.SignalPayload) {
+	ctx, cancel := context.WithTimeout(context.Background(), network.DefaultDialTimeout)
+	defer cancel()
+
+	reply := protocol.SignalPayload{From: n.ID, To: offer.From, Session: offer.Session, Reply: true}
+	answer, err := n.transport.AnswerWebRTC(ctx, offer.SDP)
+	if err != nil {
+		reply.Error = err.Error()
+	} else {
+		reply.SDP = answer
+	}
+	msg, err := protocol.NewMessage(protocol.MessageTypeSignal, n.ID, reply)
+	if err == nil {
+		err = relay.Send(msg)
+	}
+	if err != nil {
+		fmt.Printf("Failed to answer WebRTC offer from %s: %v\n", offer.From, err)
+	}
+}
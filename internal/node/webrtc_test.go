@@ -0,0 +1,88 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/network"
+)
+
+func TestNode_ConnectWebRTC(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	relay, err := NewNode("relay", freeAddr(t), filepath.Join(baseDir, "relay", "store"), filepath.Join(baseDir, "relay", "watch"), WithFirstNode(true))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer relay.Stop()
+	relay.transport.Start()
+
+	var nodes []*Node
+	for _, id := range []string{"alice", "bob", "carol"} {
+		opts := []Option{WithFirstNode(false)}
+		// carol takes no WebRTC connections
+		if id != "carol" {
+			opts = append(opts, WithWebRTC(network.WebRTCConfig{}))
+		}
+		n, err := NewNode(id, freeAddr(t), filepath.Join(baseDir, id, "store"), filepath.Join(baseDir, id, "watch"), opts...)
+		if err != nil {
+			t.Fatalf("Failed to create node: %v", err)
+		}
+		defer n.Stop()
+		n.transport.Start()
+
+		if err := n.Connect(context.Background(), relay.Address()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		if err := n.waitForKey(5 * time.Second); err != nil {
+			t.Fatalf("Failed to receive network key: %v", err)
+		}
+		nodes = append(nodes, n)
+	}
+	alice, bob := nodes[0], nodes[1]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := alice.ConnectWebRTC(ctx, "bob"); err != nil {
+		t.Fatalf("ConnectWebRTC() error = %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		_, aliceSeesBob := alice.peerConn("bob")
+		_, bobSeesAlice := bob.peerConn("alice")
+		if aliceSeesBob && bobSeesAlice {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the WebRTC connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := alice.ConnectWebRTC(ctx, "bob"); err == nil {
+		t.Error("ConnectWebRTC() to a connected peer succeeded, want error")
+	}
+	if err := alice.ConnectWebRTC(ctx, "carol"); err == nil || !strings.Contains(err.Error(), network.ErrWebRTCDisabled.Error()) {
+		t.Errorf("ConnectWebRTC() to a node without WebRTC error = %v, want %v", err, network.ErrWebRTCDisabled)
+	}
+}
+
+func TestNode_ConnectWebRTCNeedsRelay(t *testing.T) {
+	baseDir, cleanup := setupTestDir(t)
+	defer cleanup()
+
+	n, err := NewNode("node", freeAddr(t), filepath.Join(baseDir, "store"), filepath.Join(baseDir, "watch"), WithFirstNode(true), WithWebRTC(network.WebRTCConfig{}))
+	if err != nil {
+		t.Fatalf("Failed to create node: %v", err)
+	}
+	defer n.Stop()
+
+	if err := n.ConnectWebRTC(context.Background(), "other"); !errors.Is(err, ErrNoSignalRelay) {
+		t.Errorf("ConnectWebRTC() without peers error = %v, want %v", err, ErrNoSignalRelay)
+	}
+}
@@ -0,0 +1,137 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// BulkMagic opens a bulk data connection. Control connections start with
+// their own magic or a JSON message, so the first bytes tell them apart.
+var BulkMagic = []byte("P2PB")
+
+const (
+	// maxBulkToken bounds the token that pairs a bulk connection with its
+	// control connection
+	maxBulkToken = 256
+	// maxFrameHeader and maxFrameData bound a single transfer frame
+	maxFrameHeader = 64 << 10
+	maxFrameData   = 16 << 20
+)
+
+// BulkChannelPayload is sent on a control connection to announce the token
+// of the bulk connection that belongs to it
+type BulkChannelPayload struct {
+	Token string `json:"token"`
+}
+
+// WriteBulkHello writes the preamble of a bulk connection
+func WriteBulkHello(w io.Writer, token string) error {
+	if len(token) == 0 || len(token) > maxBulkToken {
+		return fmt.Errorf("invalid bulk token length %d", len(token))
+	}
+	buf := make([]byte, 0, len(BulkMagic)+2+len(token))
+	buf = append(buf, BulkMagic...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(token)))
+	buf = append(buf, token...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadBulkHello reads the preamble of a bulk connection and returns its token
+func ReadBulkHello(r io.Reader) (string, error) {
+	header := make([]byte, len(BulkMagic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+	if string(header[:len(BulkMagic)]) != string(BulkMagic) {
+		return "", fmt.Errorf("not a bulk connection")
+	}
+	size := binary.BigEndian.Uint16(header[len(BulkMagic):])
+	if size == 0 || size > maxBulkToken {
+		return "", fmt.Errorf("invalid bulk token length %d", size)
+	}
+	token := make([]byte, size)
+	if _, err := io.ReadFull(r, token); err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// WriteTransferFrame writes a transfer as a length-prefixed JSON header
+// followed by the raw chunk bytes, avoiding the base64 encoding of data in
+// JSON messages
+func WriteTransferFrame(w io.Writer, transfer *DataTransfer) error {
+	header := *transfer
+	header.Data = nil
+	encoded, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("failed to encode frame header: %w", err)
+	}
+	if len(transfer.Data) > maxFrameData {
+		return fmt.Errorf("chunk of %d bytes exceeds frame limit", len(transfer.Data))
+	}
+
+	prefix := make([]byte, 0, 8+len(encoded))
+	prefix = binary.BigEndian.AppendUint32(prefix, uint32(len(encoded)))
+	prefix = append(prefix, encoded...)
+	prefix = binary.BigEndian.AppendUint32(prefix, uint32(len(transfer.Data)))
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	_, err = w.Write(transfer.Data)
+	return err
+}
+
+// ReadTransferFrame reads a frame written by WriteTransferFrame
+func ReadTransferFrame(r io.Reader) (*DataTransfer, error) {
+	return ReadTransferFrameWith(r, nil)
+}
+
+// ReadTransferFrameWith reads a transfer frame like ReadTransferFrame, first
+// passing reserve, if set, the size of each part of the frame as its length
+// prefix announces it. An error from reserve stops the read before the
+// part is.
+func ReadTransferFrameWith(r io.Reader, reserve func(size int) error) (*DataTransfer, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	headerLen := binary.BigEndian.Uint32(size[:])
+	if headerLen > maxFrameHeader {
+		return nil, fmt.Errorf("frame header of %d bytes exceeds limit", headerLen)
+	}
+	if reserve != nil {
+		if err := reserve(len(size) + int(headerLen)); err != nil {
+			return nil, err
+		}
+	}
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	var transfer DataTransfer
+	if err := json.Unmarshal(header, &transfer); err != nil {
+		return nil, fmt.Errorf("failed to parse frame header: %w", err)
+	}
+
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	dataLen := binary.BigEndian.Uint32(size[:])
+	if dataLen > maxFrameData {
+		return nil, fmt.Errorf("frame data of %d bytes exceeds limit", dataLen)
+	}
+	if reserve != nil {
+		if err := reserve(len(size) + int(dataLen)); err != nil {
+			return nil, err
+		}
+	}
+	transfer.Data = make([]byte, dataLen)
+	if _, err := io.ReadFull(r, transfer.Data); err != nil {
+		return nil, err
+	}
+	return &transfer, nil
+}
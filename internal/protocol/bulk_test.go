@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestBulkHello_RoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteBulkHello(&buf, "token123"); err != nil {
+		t.Fatalf("Failed to write hello: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), BulkMagic) {
+		t.Errorf("Hello does not start with %q", BulkMagic)
+	}
+
+	token, err := ReadBulkHello(&buf)
+	if err != nil {
+		t.Fatalf("Failed to read hello: %v", err)
+	}
+	if token != "token123" {
+		t.Errorf("token = %q, want %q", token, "token123")
+	}
+}
+
+func TestBulkHello_Invalid(t *testing.T) {
+	if err := WriteBulkHello(&bytes.Buffer{}, ""); err == nil {
+		t.Error("Expected error for empty token")
+	}
+
+	if _, err := ReadBulkHello(bytes.NewReader([]byte("{\"type\":\"handshake\"}"))); err == nil {
+		t.Error("Expected error for a connection without the bulk magic")
+	}
+
+	oversized := append([]byte{}, BulkMagic...)
+	oversized = binary.BigEndian.AppendUint16(oversized, maxBulkToken+1)
+	if _, err := ReadBulkHello(bytes.NewReader(oversized)); err == nil {
+		t.Error("Expected error for oversized token")
+	}
+}
+
+func TestTransferFrame_RoundTrip(t *testing.T) {
+	transfer := &DataTransfer{
+		ContentHash: "abc123",
+		Data:        []byte("chunk contents"),
+		ChunkIndex:  2,
+		FinalChunk:  true,
+		IV:          []byte{1, 2, 3},
+		TotalSize:   1024,
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < 2; i++ {
+		if err := WriteTransferFrame(&buf, transfer); err != nil {
+			t.Fatalf("Failed to write frame: %v", err)
+		}
+	}
+
+	// Frames are self-delimiting, so consecutive frames read back separately
+	for i := 0; i < 2; i++ {
+		got, err := ReadTransferFrame(&buf)
+		if err != nil {
+			t.Fatalf("Failed to read frame %d: %v", i, err)
+		}
+		if got.ContentHash != transfer.ContentHash || got.ChunkIndex != transfer.ChunkIndex || !got.FinalChunk || got.TotalSize != transfer.TotalSize {
+			t.Errorf("frame %d = %+v, want %+v", i, got, transfer)
+		}
+		if !bytes.Equal(got.Data, transfer.Data) {
+			t.Errorf("Data = %q, want %q", got.Data, transfer.Data)
+		}
+		if !bytes.Equal(got.IV, transfer.IV) {
+			t.Errorf("IV = %v, want %v", got.IV, transfer.IV)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left after reading frames", buf.Len())
+	}
+}
+
+func TestTransferFrame_Limits(t *testing.T) {
+	header := binary.BigEndian.AppendUint32(nil, maxFrameHeader+1)
+	if _, err := ReadTransferFrame(bytes.NewReader(header)); err == nil {
+		t.Error("Expected error for oversized header")
+	}
+
+	frame := binary.BigEndian.AppendUint32(nil, 2)
+	frame = append(frame, "{}"...)
+	frame = binary.BigEndian.AppendUint32(frame, maxFrameData+1)
+	if _, err := ReadTransferFrame(bytes.NewReader(frame)); err == nil {
+		t.Error("Expected error for oversized data")
+	}
+
+	if err := WriteTransferFrame(&bytes.Buffer{}, &DataTransfer{Data: make([]byte, maxFrameData+1)}); err == nil {
+		t.Error("Expected error writing oversized chunk")
+	}
+}
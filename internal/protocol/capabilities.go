@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Chunk compression schemes a peer may decode
+const (
+	CompressionGzip = "gzip"
+)
+
+// Compressions lists the compression schemes this build decodes
+var Compressions = []string{CompressionGzip}
+
+// Chunk sizes of transfers. Objects are sent in DefaultChunkSize chunks
+// unless the recipient accepts only smaller ones; chunk sizes are powers of
+// two, so a chunk can always be split into chunks of a smaller size.
+const (
+	DefaultChunkSize = 1 << 20
+	MinChunkSize     = 16 << 10
+)
+
+// Capabilities describe what a node does and accepts on a connection, so
+// peers can adapt to it instead of assuming every node does everything.
+// Codecs are announced separately, see HandshakePayload.
+type Capabilities struct {
+	Compression  []string `json:"compression,omitempty"`    // Chunk compression schemes the sender decodes
+	Relay        bool     `json:"relay,omitempty"`          // The sender fetches content it lacks from its peers when asked
+	StorageOnly  bool     `json:"storage_only,omitempty"`   // The sender holds replicas for others and ingests no files of its own
+	MaxChunkSize int      `json:"max_chunk_size,omitempty"` // Largest transfer chunk the sender accepts, in bytes
+}
+
+// Decodes reports whether the peer decodes chunks compressed with scheme
+func (c Capabilities) Decodes(scheme string) bool {
+	return HasFeature(c.Compression, scheme)
+}
+
+// ChunkSize returns the size of the chunks to send the peer
+func (c Capabilities) ChunkSize() int {
+	return ChunkSize(c.MaxChunkSize)
+}
+
+// ChunkSize returns the largest valid chunk size up to max, or
+// DefaultChunkSize if max is 0
+func ChunkSize(max int) int {
+	if max <= 0 || max >= DefaultChunkSize {
+		return DefaultChunkSize
+	}
+	size := MinChunkSize
+	for size*2 <= max {
+		size *= 2
+	}
+	return size
+}
+
+// PeerCapabilities returns the capabilities the sender announced. Peers that
+// predate capabilities relay and accept default chunks uncompressed, as
+// every node did before.
+func (p HandshakePayload) PeerCapabilities() Capabilities {
+	if p.Capabilities == nil {
+		return Capabilities{Relay: true, MaxChunkSize: DefaultChunkSize}
+	}
+	caps := *p.Capabilities
+	caps.MaxChunkSize = ChunkSize(caps.MaxChunkSize)
+	return caps
+}
+
+// CompressChunk compresses chunk data with scheme
+func CompressChunk(scheme string, data []byte) ([]byte, error) {
+	if scheme != CompressionGzip {
+		return nil, fmt.Errorf("unknown compression %q", scheme)
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecompressChunk reverses CompressChunk, refusing chunks that expand to more
+// than limit bytes
+func DecompressChunk(scheme string, data []byte, limit int) ([]byte, error) {
+	if scheme != CompressionGzip {
+		return nil, fmt.Errorf("unknown compression %q", scheme)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed chunk: %w", err)
+	}
+	defer r.Close()
+	out, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed chunk: %w", err)
+	}
+	if len(out) > limit {
+		return nil, fmt.Errorf("compressed chunk expands past %d bytes", limit)
+	}
+	return out, nil
+}
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChunkSize(t *testing.T) {
+	tests := []struct {
+		max  int
+		want int
+	}{
+		{0, DefaultChunkSize},
+		{DefaultChunkSize * 4, DefaultChunkSize},
+		{DefaultChunkSize, DefaultChunkSize},
+		{100 << 10, 64 << 10},
+		{64 << 10, 64 << 10},
+		{1, MinChunkSize},
+	}
+
+	for _, tt := range tests {
+		if got := ChunkSize(tt.max); got != tt.want {
+			t.Errorf("ChunkSize(%d) = %d, want %d", tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestHandshakePayload_PeerCapabilities(t *testing.T) {
+	// Peers that predate capabilities get what every node did before
+	old := HandshakePayload{}.PeerCapabilities()
+	if !old.Relay || old.StorageOnly || old.ChunkSize() != DefaultChunkSize || old.Decodes(CompressionGzip) {
+		t.Errorf("PeerCapabilities() of an old peer = %+v", old)
+	}
+
+	announced := HandshakePayload{Capabilities: &Capabilities{StorageOnly: true, MaxChunkSize: 100 << 10, Compression: Compressions}}
+	caps := announced.PeerCapabilities()
+	if caps.Relay || !caps.StorageOnly || !caps.Decodes(CompressionGzip) {
+		t.Errorf("PeerCapabilities() = %+v, want the announced capabilities", caps)
+	}
+	if caps.MaxChunkSize != 64<<10 {
+		t.Errorf("MaxChunkSize = %d, want it rounded down to %d", caps.MaxChunkSize, 64<<10)
+	}
+}
+
+func TestCompressChunk(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	packed, err := CompressChunk(CompressionGzip, data)
+	if err != nil {
+		t.Fatalf("CompressChunk() error = %v", err)
+	}
+	if len(packed) >= len(data) {
+		t.Errorf("CompressChunk() = %d bytes, want fewer than %d", len(packed), len(data))
+	}
+
+	got, err := DecompressChunk(CompressionGzip, packed, len(data))
+	if err != nil {
+		t.Fatalf("DecompressChunk() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("DecompressChunk() did not restore the data")
+	}
+
+	if _, err := DecompressChunk(CompressionGzip, packed, len(data)-1); err == nil {
+		t.Error("DecompressChunk() past the limit succeeded, want an error")
+	}
+	if _, err := DecompressChunk("lz4", packed, len(data)); err == nil {
+		t.Error("DecompressChunk() with an unknown scheme succeeded, want an error")
+	}
+}
+
+func TestDataTransfer_Offset(t *testing.T) {
+	if got := (&DataTransfer{ChunkIndex: 3}).Offset(); got != 3*DefaultChunkSize {
+		t.Errorf("Offset() = %d, want %d", got, 3*DefaultChunkSize)
+	}
+	if got := (&DataTransfer{ChunkIndex: 3, ChunkSize: 64 << 10}).Offset(); got != 3*64<<10 {
+		t.Errorf("Offset() = %d, want %d", got, 3*64<<10)
+	}
+}
@@ -0,0 +1,301 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Codec names announced in handshakes
+const (
+	CodecJSON   = "json"   // messages as JSON, chunk data base64 encoded
+	CodecBinary = "binary" // a binary envelope with raw chunk data
+)
+
+// Codecs lists the codecs of this build in order of preference
+var Codecs = []string{CodecBinary, CodecJSON}
+
+// Frame kinds of the binary codec. JSON frames start with '{', so the first
+// byte of a frame tells the codecs apart and no switch point has to be agreed.
+const (
+	binaryMessage  byte = 0x01
+	binaryTransfer byte = 0x02
+)
+
+// compressedFrame starts a frame holding another frame, compressed with
+// the scheme named after it; see CompressFrame
+const compressedFrame byte = 0x03
+
+// fragmentFrame carries a piece of a larger frame on a multiplexed
+// connection; see AppendFragment
+const fragmentFrame byte = 0x04
+
+// stampedMessage is a binary message with the timestamp and nonce of
+// Message.Stamp after its sender; only peers announcing FeatureReplay are
+// sent one
+const stampedMessage byte = 0x05
+
+// sealedMessage is a stamped message with the MAC of Message.Seal after
+// its nonce; only peers announcing FeatureSealed are sent one
+const sealedMessage byte = 0x06
+
+// MaxStreams bounds the frames a sender may have sent part of at once on a
+// multiplexed connection
+const MaxStreams = 16
+
+// FrameCompressions lists the schemes this build decompresses frames
+// with, in order of preference
+var FrameCompressions = []string{CompressionGzip}
+
+// Codec encodes messages into the frames of a framed connection. Any frame
+// is decoded with DecodeFrame, whichever codec wrote it.
+type Codec interface {
+	Name() string
+	EncodeMessage(msg *Message) ([]byte, error)
+	// EncodeTransfer encodes a chunk as a data_transfer message
+	EncodeTransfer(senderID string, transfer *DataTransfer) ([]byte, error)
+}
+
+// CodecByName returns the codec called name
+func CodecByName(name string) (Codec, error) {
+	switch name {
+	case CodecJSON:
+		return jsonCodec{}, nil
+	case CodecBinary:
+		return binaryCodec{}, nil
+	}
+	return nil, fmt.Errorf("unknown codec %q (want %s or %s)", name, CodecBinary, CodecJSON)
+}
+
+// NegotiateCodec returns the first of the local codecs that the peer
+// accepts, or JSON if there is none, such as for peers that predate codec
+// negotiation
+func NegotiateCodec(local, remote []string) Codec {
+	for _, name := range local {
+		for _, r := range remote {
+			if name == r {
+				if codec, err := CodecByName(name); err == nil {
+					return codec
+				}
+			}
+		}
+	}
+	return jsonCodec{}
+}
+
+// NegotiateCompression returns the first of the local compression schemes
+// that the peer decompresses frames with, or "" if there is none, such as
+// for peers that predate frame compression
+func NegotiateCompression(local, remote []string) string {
+	for _, scheme := range local {
+		if HasFeature(remote, scheme) && HasFeature(FrameCompressions, scheme) {
+			return scheme
+		}
+	}
+	return ""
+}
+
+// CompressFrame compresses a frame written by any codec with scheme
+func CompressFrame(scheme string, frame []byte) ([]byte, error) {
+	packed, err := CompressChunk(scheme, frame)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, 1+binary.MaxVarintLen64+len(scheme)+len(packed))
+	buf = append(buf, compressedFrame)
+	buf = appendString(buf, scheme)
+	return append(buf, packed...), nil
+}
+
+// DecompressFrame returns the frame inside a compressed frame, refusing
+// frames that expand to more than limit bytes. Frames that aren't
+// compressed are returned as they are.
+func DecompressFrame(data []byte, limit int) ([]byte, error) {
+	if len(data) == 0 || data[0] != compressedFrame {
+		return data, nil
+	}
+	r := bytes.NewReader(data[1:])
+	scheme, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	frame, err := DecompressChunk(scheme, data[len(data)-r.Len():], limit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compressed frame: %w", err)
+	}
+	return frame, nil
+}
+
+// AppendFragment appends a fragment frame carrying piece, the next piece of
+// a frame sent on stream, to buf. final marks the last piece, after which
+// the stream is done and the frame can be decoded. The pieces of frames on
+// different streams may be interleaved, so a large frame doesn't hold up
+// the others.
+func AppendFragment(buf []byte, stream uint64, final bool, piece []byte) []byte {
+	buf = append(buf, fragmentFrame)
+	buf = binary.AppendUvarint(buf, stream)
+	if final {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	return append(buf, piece...)
+}
+
+// ParseFragment returns the stream, last-piece flag and piece of a
+// fragment frame. ok is false for frames that aren't fragments.
+func ParseFragment(data []byte) (stream uint64, final bool, piece []byte, ok bool, err error) {
+	if len(data) == 0 || data[0] != fragmentFrame {
+		return 0, false, nil, false, nil
+	}
+	r := bytes.NewReader(data[1:])
+	if stream, err = binary.ReadUvarint(r); err != nil {
+		return 0, false, nil, true, fmt.Errorf("invalid fragment: %w", err)
+	}
+	flag, err := r.ReadByte()
+	if err != nil {
+		return 0, false, nil, true, fmt.Errorf("invalid fragment: %w", err)
+	}
+	return stream, flag == 1, data[len(data)-r.Len():], true, nil
+}
+
+// DecodeFrame decodes a frame written by any codec. Chunks encoded by
+// EncodeTransfer of the binary codec come back as a transfer, with msg
+// holding only its type and sender; everything else is a message.
+func DecodeFrame(data []byte) (msg *Message, transfer *DataTransfer, err error) {
+	if len(data) == 0 {
+		return nil, nil, errors.New("empty frame")
+	}
+
+	switch data[0] {
+	case binaryMessage, stampedMessage, sealedMessage:
+		r := bytes.NewReader(data[1:])
+		msg = &Message{}
+		msgType, err := readString(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		msg.Type = MessageType(msgType)
+		if msg.SenderID, err = readString(r); err != nil {
+			return nil, nil, err
+		}
+		if data[0] != binaryMessage {
+			timestamp, err := binary.ReadVarint(r)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid frame: %w", err)
+			}
+			msg.Timestamp = timestamp
+			if msg.Nonce, err = readString(r); err != nil {
+				return nil, nil, err
+			}
+		}
+		if data[0] == sealedMessage {
+			mac, err := readString(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			msg.MAC = []byte(mac)
+		}
+		msg.Payload = json.RawMessage(data[len(data)-r.Len():])
+		return msg, nil, nil
+	case binaryTransfer:
+		r := bytes.NewReader(data[1:])
+		sender, err := readString(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		if transfer, err = ReadTransferFrame(r); err != nil {
+			return nil, nil, err
+		}
+		return &Message{Type: MessageTypeDataTransfer, SenderID: sender}, transfer, nil
+	}
+
+	msg = &Message{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, nil, fmt.Errorf("invalid frame: %w", err)
+	}
+	return msg, nil, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return CodecJSON }
+
+func (jsonCodec) EncodeMessage(msg *Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+func (c jsonCodec) EncodeTransfer(senderID string, transfer *DataTransfer) ([]byte, error) {
+	msg, err := NewMessage(MessageTypeDataTransfer, senderID, transfer)
+	if err != nil {
+		return nil, err
+	}
+	msg.TraceID = transfer.TraceID
+	return c.EncodeMessage(msg)
+}
+
+// binaryCodec writes the type and sender of a message as length-prefixed
+// strings, then its stamp and seal if it has them, followed by its JSON
+// payload. Chunks are written as a transfer
+// frame, so their data is neither base64 encoded nor parsed as JSON.
+// Gossiped, requested, traced and signed messages, whose IDs, TTL and
+// signatures the envelope has no room for, are written as JSON frames,
+// which every peer decodes.
+type binaryCodec struct{}
+
+func (binaryCodec) Name() string { return CodecBinary }
+
+func (binaryCodec) EncodeMessage(msg *Message) ([]byte, error) {
+	if msg.ID != "" || msg.TTL != 0 || msg.RequestID != "" || msg.TraceID != "" || msg.Signed() {
+		return jsonCodec{}.EncodeMessage(msg)
+	}
+	buf := make([]byte, 0, 1+5*binary.MaxVarintLen64+len(msg.Type)+len(msg.SenderID)+len(msg.Nonce)+len(msg.MAC)+len(msg.Payload))
+	switch {
+	case msg.Stamped() && len(msg.MAC) > 0:
+		buf = append(buf, sealedMessage)
+	case msg.Stamped():
+		buf = append(buf, stampedMessage)
+	default:
+		buf = append(buf, binaryMessage)
+	}
+	buf = appendString(buf, string(msg.Type))
+	buf = appendString(buf, msg.SenderID)
+	if msg.Stamped() {
+		buf = binary.AppendVarint(buf, msg.Timestamp)
+		buf = appendString(buf, msg.Nonce)
+		if len(msg.MAC) > 0 {
+			buf = appendString(buf, string(msg.MAC))
+		}
+	}
+	return append(buf, msg.Payload...), nil
+}
+
+func (binaryCodec) EncodeTransfer(senderID string, transfer *DataTransfer) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(binaryTransfer)
+	buf.Write(appendString(nil, senderID))
+	if err := WriteTransferFrame(&buf, transfer); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", fmt.Errorf("invalid frame: %w", err)
+	}
+	if size > uint64(r.Len()) {
+		return "", fmt.Errorf("invalid frame: string of %d bytes exceeds frame", size)
+	}
+	s := make([]byte, size)
+	r.Read(s)
+	return string(s), nil
+}
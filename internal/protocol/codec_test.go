@@ -0,0 +1,265 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	msg, err := NewMessage(MessageTypeData, "node1", DataPayload{ContentHash: "abc123", FileName: "test.txt", Size: 42})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	transfer := &DataTransfer{ContentHash: "abc123", Data: bytes.Repeat([]byte{0xff, 0}, 512), ChunkIndex: 3, IV: []byte("iv"), TotalSize: 4096, TraceID: "trace"}
+
+	for _, name := range Codecs {
+		codec, err := CodecByName(name)
+		if err != nil {
+			t.Fatalf("CodecByName(%q) error = %v", name, err)
+		}
+		if codec.Name() != name {
+			t.Errorf("Name() = %q, want %q", codec.Name(), name)
+		}
+
+		data, err := codec.EncodeMessage(msg)
+		if err != nil {
+			t.Fatalf("%s: Failed to encode message: %v", name, err)
+		}
+		got, gotTransfer, err := DecodeFrame(data)
+		if err != nil {
+			t.Fatalf("%s: Failed to decode message: %v", name, err)
+		}
+		if gotTransfer != nil || got.Type != msg.Type || got.SenderID != msg.SenderID || !bytes.Equal(got.Payload, msg.Payload) {
+			t.Errorf("%s: message = %+v, want %+v", name, got, msg)
+		}
+
+		data, err = codec.EncodeTransfer("node1", transfer)
+		if err != nil {
+			t.Fatalf("%s: Failed to encode transfer: %v", name, err)
+		}
+		got, gotTransfer, err = DecodeFrame(data)
+		if err != nil {
+			t.Fatalf("%s: Failed to decode transfer: %v", name, err)
+		}
+		if got.Type != MessageTypeDataTransfer || got.SenderID != "node1" {
+			t.Errorf("%s: transfer message = %s from %q, want %s from node1", name, got.Type, got.SenderID, MessageTypeDataTransfer)
+		}
+		if gotTransfer == nil {
+			// JSON carries the chunk in the payload
+			var parsed DataTransfer
+			if err := got.ParsePayload(&parsed); err != nil {
+				t.Fatalf("%s: Failed to parse transfer: %v", name, err)
+			}
+			gotTransfer = &parsed
+		}
+		if !bytes.Equal(gotTransfer.Data, transfer.Data) || gotTransfer.ChunkIndex != 3 || gotTransfer.TotalSize != 4096 || gotTransfer.TraceID != "trace" {
+			t.Errorf("%s: transfer = %+v, want %+v", name, gotTransfer, transfer)
+		}
+	}
+
+	// Raw chunk data is smaller than its base64 encoding
+	jsonCodec, _ := CodecByName(CodecJSON)
+	binaryCodec, _ := CodecByName(CodecBinary)
+	viaJSON, _ := jsonCodec.EncodeTransfer("node1", transfer)
+	viaBinary, _ := binaryCodec.EncodeTransfer("node1", transfer)
+	if len(viaBinary) >= len(viaJSON) {
+		t.Errorf("Binary transfer of %d bytes is not smaller than JSON of %d bytes", len(viaBinary), len(viaJSON))
+	}
+}
+
+func TestCodecs_MessageIDs(t *testing.T) {
+	msg, err := NewMessage(MessageTypeData, "node1", DataPayload{ContentHash: "abc123"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	msg.ID, msg.TTL, msg.RequestID, msg.TraceID = "0123456789abcdef", 3, "fedcba9876543210", "0011223344556677"
+	msg.PublicKey, msg.Signature = bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 64)
+
+	for _, name := range Codecs {
+		codec, _ := CodecByName(name)
+		data, err := codec.EncodeMessage(msg)
+		if err != nil {
+			t.Fatalf("%s: Failed to encode message: %v", name, err)
+		}
+		got, _, err := DecodeFrame(data)
+		if err != nil {
+			t.Fatalf("%s: Failed to decode message: %v", name, err)
+		}
+		if got.ID != msg.ID || got.TTL != msg.TTL || got.RequestID != msg.RequestID || got.TraceID != msg.TraceID || !bytes.Equal(got.Payload, msg.Payload) ||
+			!bytes.Equal(got.PublicKey, msg.PublicKey) || !bytes.Equal(got.Signature, msg.Signature) {
+			t.Errorf("%s: message = %+v, want %+v", name, got, msg)
+		}
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	tests := []struct {
+		name   string
+		local  []string
+		remote []string
+		want   string
+	}{
+		{"both binary", Codecs, Codecs, CodecBinary},
+		{"local preference wins", []string{CodecJSON, CodecBinary}, Codecs, CodecJSON},
+		{"remote only json", Codecs, []string{CodecJSON}, CodecJSON},
+		{"remote predates codecs", Codecs, nil, CodecJSON},
+		{"unknown codec", []string{"protobuf"}, []string{"protobuf"}, CodecJSON},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NegotiateCodec(tt.local, tt.remote).Name(); got != tt.want {
+				t.Errorf("NegotiateCodec() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := CodecByName("protobuf"); err == nil {
+		t.Error("Expected error for an unknown codec")
+	}
+}
+
+func TestDecodeFrame_Invalid(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"empty":            nil,
+		"truncated string": {binaryMessage, 10, 'a'},
+		"bad varint":       {binaryMessage, 0xff},
+		"truncated chunk":  {binaryTransfer, 1, 'a', 0, 0},
+		"not json":         []byte("{nope"),
+	} {
+		if _, _, err := DecodeFrame(data); err == nil {
+			t.Errorf("%s: DecodeFrame() succeeded, want error", name)
+		}
+	}
+}
+
+func TestCompressFrame(t *testing.T) {
+	msg, err := NewMessage(MessageTypeData, "sender", DataPayload{FileName: strings.Repeat("compressible ", 200)})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	frame, err := jsonCodec{}.EncodeMessage(msg)
+	if err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+
+	packed, err := CompressFrame(CompressionGzip, frame)
+	if err != nil {
+		t.Fatalf("CompressFrame() error = %v", err)
+	}
+	if len(packed) >= len(frame) {
+		t.Errorf("CompressFrame() = %d bytes, want fewer than %d", len(packed), len(frame))
+	}
+	got, err := DecompressFrame(packed, len(frame))
+	if err != nil {
+		t.Fatalf("DecompressFrame() error = %v", err)
+	}
+	if !bytes.Equal(got, frame) {
+		t.Error("DecompressFrame() did not restore the frame")
+	}
+	if _, err := DecompressFrame(packed, len(frame)-1); err == nil {
+		t.Error("DecompressFrame() past the limit succeeded, want an error")
+	}
+
+	// Uncompressed frames pass through
+	if got, err := DecompressFrame(frame, len(frame)); err != nil || !bytes.Equal(got, frame) {
+		t.Errorf("DecompressFrame() of an uncompressed frame = %v, %v", got, err)
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		local, remote []string
+		want          string
+	}{
+		{FrameCompressions, FrameCompressions, CompressionGzip},
+		{FrameCompressions, nil, ""},
+		{nil, FrameCompressions, ""},
+		{[]string{"zstd", CompressionGzip}, []string{"zstd", CompressionGzip}, CompressionGzip},
+	}
+	for _, tt := range tests {
+		if got := NegotiateCompression(tt.local, tt.remote); got != tt.want {
+			t.Errorf("NegotiateCompression(%v, %v) = %q, want %q", tt.local, tt.remote, got, tt.want)
+		}
+	}
+}
+
+func TestCodecs_Stamps(t *testing.T) {
+	msg, err := NewMessage(MessageTypeData, "node1", DataPayload{ContentHash: "abc123"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	stamped, err := msg.Stamp()
+	if err != nil {
+		t.Fatalf("Stamp() error = %v", err)
+	}
+	if msg.Stamped() || !stamped.Stamped() {
+		t.Fatal("Stamp() changed the original or left the copy unstamped")
+	}
+	again, _ := msg.Stamp()
+	if again.Nonce == stamped.Nonce {
+		t.Error("Stamp() reused a nonce")
+	}
+
+	for _, name := range Codecs {
+		codec, _ := CodecByName(name)
+		data, err := codec.EncodeMessage(stamped)
+		if err != nil {
+			t.Fatalf("%s: Failed to encode message: %v", name, err)
+		}
+		got, _, err := DecodeFrame(data)
+		if err != nil {
+			t.Fatalf("%s: Failed to decode message: %v", name, err)
+		}
+		if got.Timestamp != stamped.Timestamp || got.Nonce != stamped.Nonce || !bytes.Equal(got.Payload, msg.Payload) {
+			t.Errorf("%s: message = %+v, want %+v", name, got, stamped)
+		}
+	}
+
+	if forwarded := stamped.Forwarded("node2"); forwarded.Stamped() {
+		t.Error("Forwarded() kept the previous hop's stamp")
+	}
+}
+
+func TestCodecs_Seals(t *testing.T) {
+	msg, err := NewMessage(MessageTypeData, "node1", DataPayload{ContentHash: "abc123"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	key := []byte("connection key")
+	if msg.VerifySeal(key) {
+		t.Error("VerifySeal() of an unstamped message = true")
+	}
+	sealed, err := msg.Stamp()
+	if err != nil {
+		t.Fatalf("Stamp() error = %v", err)
+	}
+	sealed.Seal(key)
+
+	for _, name := range Codecs {
+		codec, _ := CodecByName(name)
+		data, err := codec.EncodeMessage(sealed)
+		if err != nil {
+			t.Fatalf("%s: Failed to encode message: %v", name, err)
+		}
+		got, _, err := DecodeFrame(data)
+		if err != nil {
+			t.Fatalf("%s: Failed to decode message: %v", name, err)
+		}
+		if !got.VerifySeal(key) {
+			t.Errorf("%s: VerifySeal() of the decoded message = false", name)
+		}
+		if got.VerifySeal([]byte("another key")) {
+			t.Errorf("%s: VerifySeal() with another key = true", name)
+		}
+	}
+
+	// The seal covers the stamp and the payload
+	moved := *sealed
+	moved.Timestamp++
+	altered := *sealed
+	altered.Payload = []byte(`{"content_hash":"def456"}`)
+	if moved.VerifySeal(key) || altered.VerifySeal(key) {
+		t.Error("VerifySeal() of an altered message = true")
+	}
+}
@@ -1,36 +1,193 @@
 package protocol
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 )
 
+// ProtocolVersion is the wire format version this build speaks, and
+// MinProtocolVersion the oldest it still understands. A change to the wire
+// format that older peers would misread raises ProtocolVersion; dropping
+// support for the old format raises MinProtocolVersion. Peers that predate
+// versioning announce neither and speak version 1.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// ErrIncompatibleVersion is returned when a peer speaks no protocol version
+// this build understands
+var ErrIncompatibleVersion = errors.New("incompatible protocol version")
+
+// Version is the software version presented in handshakes. Release builds
+// set it with -ldflags "-X p2p-storage/internal/protocol.Version=<version>".
+var Version = "dev"
+
+// Features a peer may announce in its handshake. Peers that predate
+// feature announcement announce none.
+const (
+	FeatureBulk     = "bulk"     // accepts chunks over a bulk channel
+	FeatureDelta    = "delta"    // answers delta requests
+	FeatureAudit    = "audit"    // answers storage audits
+	FeatureReceipts = "receipts" // returns signed storage receipts
+	FeatureBench    = "bench"    // answers benchmark requests
+
+	FeatureHeartbeat = "heartbeat" // answers pings with pongs
+	FeatureMux       = "mux"       // reassembles frames sent in fragments
+	FeatureReplay    = "replay"    // stamps every message; see Message.Stamp
+	FeatureSealed    = "sealed"    // seals the stamps of its messages; see Message.Seal
+	FeatureRange     = "range"     // answers requests for part of an object; see DataRequest.Range
+	FeatureList      = "list"      // answers list requests; see ListRequest
+	FeatureSync      = "sync"      // exchanges summaries of stored objects; see SyncSummary
+	FeatureStat      = "stat"      // answers stat requests; see StatRequest
+	FeatureSearch    = "search"    // answers and passes on searches by name; see SearchRequest
+	FeatureHave      = "have"      // answers wants with the chunks it holds; see Want
+	FeaturePubSub    = "pubsub"    // takes subscriptions and passes on publications; see Publication
+	FeatureSigned    = "signed"    // signs the messages it originates; see Message.Sign
+	FeatureBatch     = "batch"     // takes announcements in batches; see AnnouncementBatch
+	FeatureCredit    = "credit"    // keeps transfers within the window their requester grants; see DataRequest.Window
+)
+
+// Features lists the features of this build
+var Features = []string{FeatureBulk, FeatureDelta, FeatureAudit, FeatureReceipts, FeatureBench, FeatureHeartbeat, FeatureMux, FeatureReplay, FeatureRange, FeatureList, FeatureSync, FeatureStat, FeatureSearch, FeatureHave, FeaturePubSub, FeatureSigned, FeatureBatch, FeatureCredit, FeatureSealed}
+
+// UserAgent identifies this software and its version
+func UserAgent() string {
+	return "p2p-storage/" + Version
+}
+
+// HasFeature reports whether features includes feature
+func HasFeature(features []string, feature string) bool {
+	for _, f := range features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateVersion returns the highest protocol version spoken by both this
+// build and a peer announcing version and minVersion, 0 standing for 1
+func NegotiateVersion(version, minVersion int) (int, error) {
+	version = max(version, 1)
+	minVersion = max(minVersion, 1)
+	negotiated := min(version, ProtocolVersion)
+	if negotiated < max(minVersion, MinProtocolVersion) {
+		return 0, fmt.Errorf("%w: peer speaks versions %d to %d, this node %d to %d",
+			ErrIncompatibleVersion, minVersion, version, MinProtocolVersion, ProtocolVersion)
+	}
+	return negotiated, nil
+}
+
 // Handshaker handles the handshake process
 type Handshaker struct {
 	NodeID     string
 	Address    string
 	KnownPeers []string
+	PublicKey  []byte
+	Keyless    bool
+	UserAgent  string
+	Features   []string
+	Codecs     []string
+	Version    int
+	MinVersion int
+
+	// Capabilities are announced as is; nil announces none
+	Capabilities *Capabilities
+	NetworkID    string
+	Invite       string
+	// FrameCompression lists the schemes frames may be compressed with
+	FrameCompression []string
+
+	ExchangeKey       []byte
+	ExchangeSignature []byte
+
+	// Addresses are all the addresses the node can be dialed at, starting
+	// with Address
+	Addresses []string
+	// Challenge is for the peer to sign in its reply; see ProofData
+	Challenge []byte
 }
 
-// NewHandshaker creates a new handshake handler
+// NewHandshaker creates a new handshake handler presenting this build's
+// user agent, features, codecs and protocol versions
 func NewHandshaker(nodeID, address string, knownPeers []string) *Handshaker {
 	return &Handshaker{
 		NodeID:     nodeID,
 		Address:    address,
 		KnownPeers: knownPeers,
+		UserAgent:  UserAgent(),
+		Features:   Features,
+		Codecs:     Codecs,
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
 	}
 }
 
-// CreateHandshake creates a handshake message
+// CreateHandshake creates a handshake message, stamped since it goes out
+// before the peer's features are known
 func (h *Handshaker) CreateHandshake() (*Message, error) {
 	payload := HandshakePayload{
 		NodeID:     h.NodeID,
 		Address:    h.Address,
 		KnownPeers: h.KnownPeers,
+		PublicKey:  h.PublicKey,
+		Keyless:    h.Keyless,
+		UserAgent:  h.UserAgent,
+		Features:   h.Features,
+		Codecs:     h.Codecs,
+		Version:    h.Version,
+		MinVersion: h.MinVersion,
+
+		Capabilities: h.Capabilities,
+		NetworkID:    h.NetworkID,
+		Invite:       h.Invite,
+
+		FrameCompression: h.FrameCompression,
+
+		ExchangeKey:       h.ExchangeKey,
+		ExchangeSignature: h.ExchangeSignature,
+
+		Addresses: h.Addresses,
+		Challenge: h.Challenge,
+	}
+
+	msg, err := NewMessage(MessageTypeHandshake, h.NodeID, payload)
+	if err != nil {
+		return nil, err
 	}
+	return msg.Stamp()
+}
+
+// ChallengeSize is the size of handshake challenges
+const ChallengeSize = 32
+
+// ProofData returns the bytes a node signs to prove to a peer that it holds
+// the identity key it presented: a digest of the raw payload of the peer's
+// handshake. The payload carries the peer's challenge, so a proof is good
+// on one connection only, and covers all the peer announced, so nothing in
+// it can be altered on the way unnoticed.
+func ProofData(handshake []byte) []byte {
+	sum := sha256.Sum256(handshake)
+	return append([]byte("p2p-storage handshake proof\x00"), sum[:]...)
+}
+
+// NetworkIDFromSecret derives a network ID from a secret shared by the
+// nodes of a network, so the ID sent in handshakes doesn't reveal the secret
+func NetworkIDFromSecret(secret string) string {
+	sum := sha256.Sum256([]byte("p2p-storage network\x00" + secret))
+	return hex.EncodeToString(sum[:16])
+}
 
-	return NewMessage(MessageTypeHandshake, h.NodeID, payload)
+// KeyWrapContext returns the context the network key is wrapped with when
+// sent from one node to another, so a wrapped key is only accepted by the
+// node it was sent to
+func KeyWrapContext(from, to string) []byte {
+	return []byte("network key\x00" + from + "\x00" + to)
 }
 
 // HandleHandshake processes a received handshake message
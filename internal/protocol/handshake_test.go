@@ -3,6 +3,9 @@ package protocol
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -30,6 +33,7 @@ func TestHandshaker_CreateHandshake(t *testing.T) {
 	knownPeers := []string{"peer1", "peer2"}
 
 	handshaker := NewHandshaker(nodeID, address, knownPeers)
+	handshaker.PublicKey = []byte("public-key")
 
 	msg, err := handshaker.CreateHandshake()
 	if err != nil {
@@ -57,6 +61,18 @@ func TestHandshaker_CreateHandshake(t *testing.T) {
 	if len(payload.KnownPeers) != len(knownPeers) {
 		t.Errorf("Payload KnownPeers length = %v, want %v", len(payload.KnownPeers), len(knownPeers))
 	}
+	if string(payload.PublicKey) != "public-key" {
+		t.Errorf("Payload PublicKey = %q, want %q", payload.PublicKey, "public-key")
+	}
+	if payload.UserAgent != UserAgent() {
+		t.Errorf("Payload UserAgent = %q, want %q", payload.UserAgent, UserAgent())
+	}
+	if !HasFeature(payload.Features, FeatureBench) {
+		t.Errorf("Payload Features = %v, want %q included", payload.Features, FeatureBench)
+	}
+	if HasFeature(payload.Features, "unknown") {
+		t.Errorf("HasFeature(%v, %q) = true, want false", payload.Features, "unknown")
+	}
 }
 
 func TestHandshaker_HandleHandshake(t *testing.T) {
@@ -112,6 +128,66 @@ func TestHandshaker_HandleHandshake(t *testing.T) {
 	}
 }
 
+func TestHandshakePayload_DialAddresses(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload HandshakePayload
+		want    []string
+	}{
+		{"address list", HandshakePayload{Address: "10.0.0.1:3000", Addresses: []string{"10.0.0.1:3000", "[fd00::1]:3000"}}, []string{"10.0.0.1:3000", "[fd00::1]:3000"}},
+		{"single address", HandshakePayload{Address: "10.0.0.1:3000"}, []string{"10.0.0.1:3000"}},
+		{"no address", HandshakePayload{}, nil},
+	}
+
+	for _, tt := range tests {
+		if got := tt.payload.DialAddresses(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: DialAddresses() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		name       string
+		version    int
+		minVersion int
+		want       int
+		wantErr    bool
+	}{
+		{"same version", ProtocolVersion, MinProtocolVersion, ProtocolVersion, false},
+		{"predates versioning", 0, 0, 1, false},
+		{"newer peer", ProtocolVersion + 1, MinProtocolVersion, ProtocolVersion, false},
+		{"peer dropped our version", ProtocolVersion + 2, ProtocolVersion + 1, 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := NegotiateVersion(tt.version, tt.minVersion)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: NegotiateVersion() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrIncompatibleVersion) {
+			t.Errorf("%s: NegotiateVersion() error = %v, want %v", tt.name, err, ErrIncompatibleVersion)
+		}
+		if !tt.wantErr && got != tt.want {
+			t.Errorf("%s: NegotiateVersion() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNetworkIDFromSecret(t *testing.T) {
+	id := NetworkIDFromSecret("secret")
+	if id != NetworkIDFromSecret("secret") {
+		t.Error("NetworkIDFromSecret() is not deterministic")
+	}
+	if id == NetworkIDFromSecret("other secret") {
+		t.Error("NetworkIDFromSecret() = the same ID for different secrets")
+	}
+	if strings.Contains(id, "secret") {
+		t.Errorf("NetworkIDFromSecret() = %q, which reveals the secret", id)
+	}
+}
+
 func TestHandshaker_WriteAndReadHandshake(t *testing.T) {
 	nodeID := "testNode"
 	address := "localhost:8080"
@@ -1,9 +1,24 @@
 package protocol
 
 import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 )
 
+// ErrInvalidPayload is returned when a message's payload doesn't decode
+var ErrInvalidPayload = errors.New("invalid message payload")
+
+// ErrBadSignature is returned for a signed message whose signature doesn't
+// verify
+var ErrBadSignature = errors.New("message signature does not verify")
+
 // MessageType represents the type of message being sent
 type MessageType string
 
@@ -13,6 +28,45 @@ const (
 	MessageTypeDiscovery    MessageType = "discovery"
 	MessageTypeDataRequest  MessageType = "data_request"
 	MessageTypeDataTransfer MessageType = "data_transfer"
+	MessageTypeInventory    MessageType = "inventory"
+	MessageTypeLeave        MessageType = "leave"
+	MessageTypeError        MessageType = "error"
+	MessageTypeBulkChannel  MessageType = "bulk_channel"
+	MessageTypeReceipt      MessageType = "receipt"
+	MessageTypeAudit        MessageType = "audit"
+	MessageTypeAuditProof   MessageType = "audit_proof"
+	MessageTypeName         MessageType = "name"
+	MessageTypeFeed         MessageType = "feed"
+	MessageTypeFeedRequest  MessageType = "feed_request"
+	MessageTypeChangeSet    MessageType = "change_set"
+	MessageTypeDeltaRequest MessageType = "delta_request"
+	MessageTypeDelta        MessageType = "delta"
+	MessageTypeBench        MessageType = "bench"
+	MessageTypePing         MessageType = "ping"
+	MessageTypePong         MessageType = "pong"
+	MessageTypePunch        MessageType = "punch"
+	MessageTypeSignal       MessageType = "signal"
+	MessageTypeListRequest  MessageType = "list_request"
+	MessageTypeListResponse MessageType = "list_response"
+	MessageTypeSyncSummary  MessageType = "sync_summary"
+	MessageTypeTombstone    MessageType = "tombstone"
+	MessageTypeStatRequest  MessageType = "stat_request"
+	MessageTypeStat         MessageType = "stat"
+	MessageTypeSearch       MessageType = "search"
+	MessageTypeSearchResult MessageType = "search_result"
+	MessageTypeWant         MessageType = "want"
+	MessageTypeHave         MessageType = "have"
+	MessageTypeSubscribe    MessageType = "subscribe"
+	MessageTypeUnsubscribe  MessageType = "unsubscribe"
+	MessageTypePublish      MessageType = "publish"
+	MessageTypeDataBatch    MessageType = "data_batch"
+	MessageTypeCredit       MessageType = "credit"
+	// MessageTypeHandshakeProof completes the handshake of the dialing
+	// node; see HandshakeProof
+	MessageTypeHandshakeProof MessageType = "handshake_proof"
+	// MessageTypeNetworkKey carries the network key to a node that
+	// completed its handshake; see NetworkKey
+	MessageTypeNetworkKey MessageType = "network_key"
 )
 
 // Message represents a protocol message
@@ -20,6 +74,33 @@ type Message struct {
 	Type     MessageType     `json:"type"`
 	SenderID string          `json:"sender_id"`
 	Payload  json.RawMessage `json:"payload"`
+
+	// ID identifies a gossiped message across the hops it travels, so nodes
+	// handle and pass it on only once. TTL is how many more hops it may
+	// travel, counting the one to the recipient.
+	ID  string `json:"id,omitempty"`
+	TTL int    `json:"ttl,omitempty"`
+	// RequestID is set on a request whose sender waits for an answer, and
+	// on the error sent back when it can't be answered
+	RequestID string `json:"request_id,omitempty"`
+	// TraceID, if set, ties together the messages of one flow across nodes,
+	// such as a request, the requests it causes and the chunks sent in
+	// answer, so they can be followed in debug taps and logs
+	TraceID string `json:"trace_id,omitempty"`
+	// Timestamp is when the message was sent, in Unix milliseconds, and
+	// Nonce a random value sent once; together they let the recipient
+	// refuse captured messages played back to it. See Stamp.
+	Timestamp int64  `json:"ts,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+	// MAC authenticates the stamp and the rest of the message with a key
+	// only the two ends of the connection share, so a stamp can't be moved
+	// to another message or renewed on a captured one. See Seal.
+	MAC []byte `json:"mac,omitempty"`
+	// PublicKey and Signature, if set, are the identity key of the node the
+	// message originated at and its signature of SignedData, so peers
+	// passing the message on can't alter it. See Sign.
+	PublicKey []byte `json:"public_key,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
 }
 
 // HandshakePayload represents the handshake message payload
@@ -27,23 +108,173 @@ type HandshakePayload struct {
 	NodeID     string   `json:"node_id"`
 	Address    string   `json:"address"`
 	KnownPeers []string `json:"known_peers"`
-	Key        []byte   `json:"key"`
+	Reply      bool     `json:"reply,omitempty"`      // Set on the response to a handshake
+	PublicKey  []byte   `json:"public_key,omitempty"` // Sender's long-term identity key
+	Keyless    bool     `json:"keyless,omitempty"`    // Sender holds only public content and wants no network key
+	UserAgent  string   `json:"user_agent,omitempty"` // Sender's software and version, e.g. p2p-storage/1.2.0
+	Features   []string `json:"features,omitempty"`   // Protocol features the sender supports
+	Codecs     []string `json:"codecs,omitempty"`     // Codecs the sender decodes, in order of preference
+
+	// Sender's X25519 key for wrapping the network key, signed with its
+	// identity key
+	ExchangeKey       []byte `json:"exchange_key,omitempty"`
+	ExchangeSignature []byte `json:"exchange_signature,omitempty"`
+	// Every address the sender can be dialed at, in order of preference.
+	// Address is the first, for peers that predate the list.
+	Addresses []string `json:"addresses,omitempty"`
+
+	// Newest and oldest protocol versions the sender speaks, see
+	// ProtocolVersion
+	Version    int `json:"version,omitempty"`
+	MinVersion int `json:"min_version,omitempty"`
+
+	// What the sender does and accepts on the connection; nil for peers
+	// that predate capabilities, see PeerCapabilities
+	Capabilities *Capabilities `json:"capabilities,omitempty"`
+	// Network the sender belongs to; empty for the default network and for
+	// peers that predate network IDs
+	NetworkID string `json:"network_id,omitempty"`
+	// Invite token the sender joins an invite-only node with, if any
+	Invite string `json:"invite,omitempty"`
+	// Schemes the sender decompresses frames with, in order of
+	// preference; see CompressFrame
+	FrameCompression []string `json:"frame_compression,omitempty"`
+
+	// Challenge is random, new for each connection, and signed by the
+	// recipient to prove it holds its identity key. Proof, on a reply, is
+	// the sender's signature of ProofData of the handshake it answers.
+	Challenge []byte `json:"challenge,omitempty"`
+	Proof     []byte `json:"proof,omitempty"`
+}
+
+// NetworkKey carries the network key from the first node to a node that
+// dialed it, once its handshake is complete, wrapped for the exchange key
+// in its handshake; see KeyWrapContext
+type NetworkKey struct {
+	WrappedKey []byte `json:"wrapped_key"`
+}
+
+// HandshakeProof is sent by the dialing node in answer to a handshake
+// reply, with its signature of ProofData of the reply. Until it arrives,
+// the node answering the handshake doesn't take the dialer's identity key
+// as its own.
+type HandshakeProof struct {
+	Proof []byte `json:"proof"`
+}
+
+// DialAddresses returns the addresses to dial the sender at, in order
+func (p HandshakePayload) DialAddresses() []string {
+	return dialAddresses(p.Address, p.Addresses)
 }
 
 // DataPayload represents a file transfer message
 type DataPayload struct {
 	ContentHash string `json:"content_hash"`
 	FileName    string `json:"file_name"`
+	Path        string `json:"path,omitempty"` // Path relative to the import root, if imported
 	Size        int64  `json:"size"`
 	Encrypted   bool   `json:"encrypted"`
 	IV          []byte `json:"iv"`
 	FromWatch   bool   `json:"from_watch"`
+	Manifest    bool   `json:"manifest,omitempty"` // Object is a directory manifest
+	Link        string `json:"link,omitempty"`     // Symlink target, if the object is a preserved link
+	Previous    string `json:"previous,omitempty"` // Hash of the version of the file this object replaces
+	Namespace   string `json:"namespace,omitempty"`
+	Encryption  string `json:"encryption,omitempty"` // "file" for per-file keys; the network key otherwise
+	Key         []byte `json:"key,omitempty"`        // Per-file key, encrypted with the network key
+}
+
+// AnnouncementBatch carries announcements of several objects stored in
+// quick succession, such as by a bulk import, in one message. Each is
+// handled as if announced in a data message of its own; passed on, a
+// gossiped batch's announcement at index i has the ID <batch ID>/<i>.
+type AnnouncementBatch struct {
+	Announcements []DataPayload `json:"announcements"`
 }
 
 // DataRequest represents a request for file data
 type DataRequest struct {
 	ContentHash string `json:"content_hash"`
 	FromWatch   bool   `json:"from_watch"`
+	Relayed     bool   `json:"relayed,omitempty"` // sent by a node fetching on behalf of another; never relayed further
+
+	// Chunks lists the only chunks to send, by index at ChunkSize, when a
+	// transfer arrived with gaps. The last of them is sent as FinalChunk.
+	// Peers that predate it send the whole object again, which fills the
+	// gaps all the same.
+	Chunks    []int `json:"chunks,omitempty"`
+	ChunkSize int   `json:"chunk_size,omitempty"`
+	// ResumeFrom resumes a transfer cut off by a disconnect: the chunks
+	// before it, at ChunkSize, are not sent. Ignored if Chunks is set.
+	ResumeFrom int `json:"resume_from,omitempty"`
+	// Range asks for part of the stored object only. The chunks answering
+	// it carry the request's RequestID in DataTransfer.Range, are indexed
+	// from the start of the range, and have the range's length as their
+	// TotalSize. Only peers announcing FeatureRange honor it.
+	Range *ByteRange `json:"range,omitempty"`
+	// Priority orders the transfer among those the sender is busy with;
+	// see PriorityBulk. Peers that predate it send every transfer alike.
+	Priority int `json:"priority,omitempty"`
+	// Window is how many chunks the sender may send ahead of those the
+	// requester has written, which it grants more of in Credit messages as
+	// it writes them. Zero lets the sender send as fast as it reads. Only
+	// peers announcing FeatureCredit honor it.
+	Window int `json:"window,omitempty"`
+
+	// TraceID and RequestID are those of the message the request arrived
+	// in; TraceID is passed on to the chunks sent in answer. They travel
+	// in the message, not the payload.
+	TraceID   string `json:"-"`
+	RequestID string `json:"-"`
+}
+
+// Priorities of transfers. A sender busy with several transfers sends the
+// chunks of higher priority ones first. Requests from peers that predate
+// priorities are bulk.
+const (
+	PriorityBulk        = 0 // replication of watched files, repair and anti-entropy
+	PriorityInteractive = 1 // objects a user is waiting for, as with get
+)
+
+// Credit lets the sender of a transfer requested with a window send Chunks
+// more chunks of it
+type Credit struct {
+	ContentHash string `json:"content_hash"`
+	Chunks      int    `json:"chunks"`
+}
+
+// ByteRange selects Length bytes of an object from Offset, or the rest of
+// the object if Length is 0
+type ByteRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length,omitempty"`
+}
+
+// DeltaRequest asks for an object as a delta against an older version of
+// the same file that the requester holds
+type DeltaRequest struct {
+	ContentHash string `json:"content_hash"`
+	Basis       string `json:"basis"`     // hash of the version the requester holds
+	Signature   []byte `json:"signature"` // block signature of the basis, encrypted with the network key
+}
+
+// Delta answers a DeltaRequest with the changes from the basis. Error is set
+// instead when no delta is available, and the requester fetches the whole
+// object.
+type Delta struct {
+	ContentHash string `json:"content_hash"`
+	Basis       string `json:"basis"`
+	BlockSize   int    `json:"block_size,omitempty"`
+	IV          []byte `json:"iv,omitempty"`  // IV of the stored object, so the rebuilt file encrypts to the same ciphertext
+	Ops         []byte `json:"ops,omitempty"` // encoded delta, encrypted with the network key
+	Error       string `json:"error,omitempty"`
+}
+
+// BenchRequest asks a peer to send Size bytes of throwaway data, as chunks
+// tagged with ID, to measure transfer throughput and latency
+type BenchRequest struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"`
 }
 
 // DataTransfer represents a file data transfer
@@ -54,12 +285,397 @@ type DataTransfer struct {
 	FinalChunk  bool   `json:"final_chunk"`
 	IV          []byte `json:"iv,omitempty"` // IV included in first chunk
 	FromWatch   bool   `json:"from_watch"`
+	TotalSize   int64  `json:"total_size,omitempty"` // Size of the whole object, for progress reporting
+	Plaintext   bool   `json:"plaintext,omitempty"`  // The object is stored unencrypted
+	Bench       string `json:"bench,omitempty"`      // ID of the BenchRequest the chunk answers; the data is discarded
+	Range       string `json:"range,omitempty"`      // RequestID of the DataRequest for a range the chunk answers
+	Priority    int    `json:"priority,omitempty"`   // Priority of the DataRequest the chunk answers
+
+	// ChunkSize is the size of every chunk but the last, DefaultChunkSize
+	// if 0. Compression names the scheme Data is compressed with, if any.
+	ChunkSize   int    `json:"chunk_size,omitempty"`
+	Compression string `json:"compression,omitempty"`
+
+	// TraceID is that of the request the chunk answers, if it had one
+	TraceID string `json:"trace_id,omitempty"`
+}
+
+// Offset returns where in the object the chunk's data belongs
+func (t *DataTransfer) Offset() int64 {
+	return int64(t.ChunkIndex) * int64(t.chunkSize())
+}
+
+// ChunkCount returns how many chunks the whole object is sent in
+func (t *DataTransfer) ChunkCount() int {
+	size := int64(t.chunkSize())
+	return int((t.TotalSize + size - 1) / size)
+}
+
+func (t *DataTransfer) chunkSize() int {
+	if t.ChunkSize <= 0 {
+		return DefaultChunkSize
+	}
+	return t.ChunkSize
 }
 
 // DiscoveryPayload represents a peer discovery message
 type DiscoveryPayload struct {
-	NodeID  string `json:"node_id"`
-	Address string `json:"address"`
+	NodeID    string   `json:"node_id"`
+	Address   string   `json:"address"`
+	Addresses []string `json:"addresses,omitempty"` // All of the peer's addresses, see HandshakePayload
+}
+
+// DialAddresses returns the addresses to dial the peer at, in order
+func (p DiscoveryPayload) DialAddresses() []string {
+	return dialAddresses(p.Address, p.Addresses)
+}
+
+// dialAddresses returns all if it is set, or else address alone
+func dialAddresses(address string, all []string) []string {
+	if len(all) > 0 {
+		return all
+	}
+	if address == "" {
+		return nil
+	}
+	return []string{address}
+}
+
+// InventoryPayload lists the objects a node currently stores, so peers can
+// count how many live replicas each object has. The objects are counted for
+// the node that sent the inventory, whatever NodeID says.
+type InventoryPayload struct {
+	NodeID string   `json:"node_id"`
+	Hashes []string `json:"hashes"`
+	Added  bool     `json:"added,omitempty"` // Hashes extend the previous inventory instead of replacing it
+}
+
+// ListRequest asks a peer for a page of the hashes it stores, in order,
+// starting after After. It is sent with a request ID, which the answering
+// ListResponse carries.
+type ListRequest struct {
+	After string `json:"after,omitempty"`
+	Limit int    `json:"limit,omitempty"` // at most MaxListHashes; zero asks for DefaultListLimit
+}
+
+// ListResponse answers a ListRequest with a page of hashes. Next is set when
+// more follow, as the After of the request for the next page.
+type ListResponse struct {
+	Hashes []string `json:"hashes"`
+	Next   string   `json:"next,omitempty"`
+}
+
+// StatRequest asks a peer what it knows of an object, without sending its
+// content. It is sent with a request ID, which the answering Stat carries.
+type StatRequest struct {
+	ContentHash string `json:"content_hash"`
+}
+
+// Stat answers a StatRequest with what the peer knows of an object. Name,
+// size and encryption come from its catalog, and are only set if the
+// object is cataloged there.
+type Stat struct {
+	ContentHash string `json:"content_hash"`
+	Stored      bool   `json:"stored"`
+	StoredSize  int64  `json:"stored_size,omitempty"` // size as stored, IV and encryption included
+	FileName    string `json:"file_name,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Encryption  string `json:"encryption,omitempty"` // network, file or none
+	Manifest    bool   `json:"manifest,omitempty"`
+	Replicas    int    `json:"replicas"` // live copies the peer knows of, its own included
+}
+
+// SearchRequest asks a peer for the objects it stores whose names or paths
+// match Query, and to pass the search on to its own peers while Hops is
+// above zero. It is sent with a request ID, which the answering
+// SearchResult carries; ID stays the same at every hop, so a node reached
+// twice answers the second time with no hits.
+type SearchRequest struct {
+	ID    string `json:"id"`
+	Query string `json:"query"`
+	Hops  int    `json:"hops"` // how many more times the search is passed on
+}
+
+// SearchResult answers a SearchRequest with the hits of the peer and of the
+// peers it passed the search on to
+type SearchResult struct {
+	Hits []SearchHit `json:"hits"`
+}
+
+// SearchHit is an object matching a search, with the nodes storing it
+type SearchHit struct {
+	ContentHash string   `json:"content_hash"`
+	FileName    string   `json:"file_name"`
+	Path        string   `json:"path,omitempty"`
+	Size        int64    `json:"size"`
+	Holders     []string `json:"holders"` // node IDs
+}
+
+// Want asks a peer which chunks of an object it can serve, at ChunkSize.
+// It is sent with a request ID, which the answering Have carries.
+type Want struct {
+	ContentHash string `json:"content_hash"`
+	ChunkSize   int    `json:"chunk_size"`
+}
+
+// Have answers a Want with the chunks of an object the peer can serve: all
+// of them if it stores the object, those received so far if it is fetching
+// it itself. Bit i of Bitfield, counting from the high bit of the first
+// byte, is set if chunk i at ChunkSize is held; ChunkSize is that of the
+// peer's own download if it has one, whatever the Want asked for. Size is
+// that of the whole object as stored.
+type Have struct {
+	ContentHash string `json:"content_hash"`
+	Size        int64  `json:"size"`
+	ChunkSize   int    `json:"chunk_size"`
+	Bitfield    []byte `json:"bitfield"`
+}
+
+// ChunkCount returns how many chunks of ChunkSize the object is in
+func (h *Have) ChunkCount() int {
+	if h.ChunkSize <= 0 {
+		return 0
+	}
+	size := int64(h.ChunkSize)
+	return int((h.Size + size - 1) / size)
+}
+
+// Subscription lists topics the sender subscribes to, in a subscribe
+// message, or no longer does, in an unsubscribe one
+type Subscription struct {
+	Topics []string `json:"topics"`
+}
+
+// Publication is an application message published to a topic. It is
+// gossiped under a message ID, and passed on only to peers subscribed to
+// the topic.
+type Publication struct {
+	Topic  string `json:"topic"`
+	Origin string `json:"origin"` // ID of the node that published it
+	Data   []byte `json:"data"`
+}
+
+// SyncSummary sums up the objects a node stores, for anti-entropy. Their
+// hashes are grouped by first character, and each group is summed up by its
+// count and the SHA-256 of its hashes in order. A peer holding a group that
+// differs lists it from the sender and pulls the objects it lacks.
+type SyncSummary struct {
+	Buckets []SyncBucket `json:"buckets"` // groups holding objects, by prefix
+}
+
+// SyncBucket is a group of a SyncSummary
+type SyncBucket struct {
+	Prefix string `json:"prefix"`
+	Count  int    `json:"count"`
+	Digest []byte `json:"digest"`
+}
+
+// DefaultListLimit is how many hashes a page of a listing holds unless the
+// request asks for another number
+const DefaultListLimit = 1000
+
+// LeavePayload announces that a node is leaving the network for good, so
+// peers stop counting it as a replica holder
+type LeavePayload struct {
+	NodeID string `json:"node_id"`
+}
+
+// PingPayload is sent as a heartbeat and echoed back unchanged in a pong,
+// so the sender can match the pong and measure the round trip
+type PingPayload struct {
+	Seq  uint64 `json:"seq"`
+	Sent int64  `json:"sent"` // Sender's clock in Unix nanoseconds
+}
+
+// PunchPayload asks the node To, through a peer both are connected to, to
+// dial the node From at Address while From dials it back, opening a direct
+// connection between nodes that are both behind NAT. To answers with its own
+// address and Reply set.
+type PunchPayload struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Address string `json:"address"` // external address of From, as seen through STUN
+	Reply   bool   `json:"reply,omitempty"`
+}
+
+// SignalPayload carries a WebRTC offer from the node From to the node To,
+// through a peer both are connected to, and To's answer back with Reply
+// set. Session ties the answer to the offer; SDP is the session
+// description, with every ICE candidate gathered into it.
+type SignalPayload struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Session string `json:"session"`
+	SDP     string `json:"sdp,omitempty"`
+	Error   string `json:"error,omitempty"` // why To didn't answer
+	Reply   bool   `json:"reply,omitempty"`
+}
+
+// Error codes sent when a peer refuses a connection
+const (
+	ErrorCodeSelfConnection = "self_connection" // the node dialed itself
+	ErrorCodeDuplicateID    = "duplicate_id"    // the node ID belongs to another identity
+	ErrorCodeBanned         = "banned"
+	ErrorCodeCertificate    = "certificate_mismatch" // the TLS certificate is for another identity
+	ErrorCodeSessionKey     = "session_key_mismatch" // the session was set up with another identity
+	ErrorCodeExchangeKey    = "invalid_exchange_key" // the exchange key is not signed by the identity key
+	ErrorCodeNotAllowed     = "not_allowed"          // the node is not on the allowlist
+	ErrorCodeVersion        = "incompatible_version" // the peers share no protocol version
+	ErrorCodeNetwork        = "wrong_network"        // the node belongs to another network
+	ErrorCodeInvite         = "invite_required"      // the node presented no valid invite
+	ErrorCodeUnproven       = "unproven_identity"    // the node didn't prove it holds its identity key
+)
+
+// Error codes answering a request that can't be served. They are sent with
+// the RequestID of the request, and the connection stays open.
+const (
+	ErrorCodeNotFound     = "not_found"      // the peer holds no copy of the content
+	ErrorCodeRange        = "invalid_range"  // the range starts past the end of the content
+	ErrorCodeQuota        = "quota_exceeded" // the requester took more than the ledger policy allows
+	ErrorCodeUnauthorized = "unauthorized"   // the content may not be served, such as by namespace policy
+	ErrorCodeBusy         = "busy"           // the peer sends the requester as many transfers as it takes at once
+)
+
+// ErrorPayload explains why a peer is closing the connection, or, on a
+// message with a RequestID, why it can't answer that request
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ReceiptPayload is a peer's signed statement that it stored and verified
+// an object
+type ReceiptPayload struct {
+	ContentHash string `json:"content_hash"`
+	Size        int64  `json:"size"`
+	Timestamp   int64  `json:"timestamp"` // Unix seconds when the object was stored
+	NodeID      string `json:"node_id"`
+	PublicKey   []byte `json:"public_key"`
+	Signature   []byte `json:"signature"`
+}
+
+// SignedData returns the bytes covered by the receipt's signature
+func (r ReceiptPayload) SignedData() []byte {
+	return []byte(fmt.Sprintf("p2p-storage receipt\n%s\n%d\n%d\n%s\n%x", r.ContentHash, r.Size, r.Timestamp, r.NodeID, r.PublicKey))
+}
+
+// AuditChallenge asks a holder to prove it still has an object by hashing
+// a byte range of it. The nonce keeps answers from being precomputed.
+type AuditChallenge struct {
+	ID          string `json:"id"`
+	ContentHash string `json:"content_hash"`
+	Nonce       []byte `json:"nonce"`
+	Offset      int64  `json:"offset"`
+	Length      int64  `json:"length"`
+}
+
+// AuditProof answers an AuditChallenge with the SHA-256 of the nonce
+// followed by the requested bytes, or the reason it can't
+type AuditProof struct {
+	ID     string `json:"id"`
+	Digest []byte `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// NameRecord points a label under a node's identity key at a content hash.
+// A record with a higher sequence number supersedes earlier ones.
+type NameRecord struct {
+	Label     string `json:"label"`
+	Hash      string `json:"hash"`
+	Sequence  uint64 `json:"sequence"`
+	Timestamp int64  `json:"timestamp"` // Unix seconds when the record was published
+	PublicKey []byte `json:"public_key"`
+	Signature []byte `json:"signature"`
+}
+
+// SignedData returns the bytes covered by the record's signature
+func (r NameRecord) SignedData() []byte {
+	return []byte(fmt.Sprintf("p2p-storage name\n%x\n%s\n%s\n%d\n%d", r.PublicKey, r.Label, r.Hash, r.Sequence, r.Timestamp))
+}
+
+// Tombstone records that a node deleted an object, signed with its identity
+// key. Nodes whose policy trusts the signer delete their copies too.
+type Tombstone struct {
+	ContentHash string `json:"content_hash"`
+	Timestamp   int64  `json:"timestamp"` // Unix seconds when the object was deleted
+	PublicKey   []byte `json:"public_key"`
+	Signature   []byte `json:"signature"`
+}
+
+// SignedData returns the bytes covered by the tombstone's signature
+func (t Tombstone) SignedData() []byte {
+	return []byte(fmt.Sprintf("p2p-storage tombstone\n%x\n%s\n%d", t.PublicKey, t.ContentHash, t.Timestamp))
+}
+
+// TombstonePayload carries tombstones propagated between peers
+type TombstonePayload struct {
+	Tombstones []Tombstone `json:"tombstones"`
+}
+
+// NamePayload carries name records propagated between peers
+type NamePayload struct {
+	Records []NameRecord `json:"records"`
+}
+
+// FeedEntry is one item of a node's append-only feed of published hashes.
+// Each entry names the digest of the previous one, so a feed can only grow.
+type FeedEntry struct {
+	Sequence  uint64 `json:"sequence"`
+	Hash      string `json:"hash"`
+	Timestamp int64  `json:"timestamp"` // Unix seconds when the entry was published
+	Prev      []byte `json:"prev,omitempty"`
+	PublicKey []byte `json:"public_key"`
+	Signature []byte `json:"signature"`
+}
+
+// SignedData returns the bytes covered by the entry's signature
+func (e FeedEntry) SignedData() []byte {
+	return []byte(fmt.Sprintf("p2p-storage feed\n%x\n%d\n%s\n%d\n%x", e.PublicKey, e.Sequence, e.Hash, e.Timestamp, e.Prev))
+}
+
+// FeedPayload carries feed entries, in order, propagated between peers
+type FeedPayload struct {
+	Entries []FeedEntry `json:"entries"`
+}
+
+// FeedRequest asks a peer for the entries of a feed after a sequence number
+type FeedRequest struct {
+	Feed  string `json:"feed"` // fingerprint of the publisher's identity key
+	After uint64 `json:"after"`
+}
+
+// ChangeEntry is a file or link added to or changed in a directory manifest
+type ChangeEntry struct {
+	Path    string `json:"path"`
+	Hash    string `json:"hash,omitempty"`
+	Link    string `json:"link,omitempty"`
+	Size    int64  `json:"size"`
+	Mode    uint32 `json:"mode"`
+	ModTime int64  `json:"mod_time"` // Unix nanoseconds
+}
+
+// ChangeSet describes how a directory manifest differs from the previous
+// version of the same directory, so peers that restored the previous version
+// can sync without fetching the whole manifest
+type ChangeSet struct {
+	Root      string        `json:"root"`
+	Base      string        `json:"base"`     // manifest hash of the previous version
+	Manifest  string        `json:"manifest"` // manifest hash of this version
+	Timestamp int64         `json:"timestamp"`
+	Added     []ChangeEntry `json:"added,omitempty"`
+	Changed   []ChangeEntry `json:"changed,omitempty"`
+	Removed   []string      `json:"removed,omitempty"`
+	PublicKey []byte        `json:"public_key"`
+	Signature []byte        `json:"signature"`
+}
+
+// SignedData returns the bytes covered by the change set's signature
+func (c ChangeSet) SignedData() []byte {
+	entries, _ := json.Marshal([]interface{}{c.Added, c.Changed, c.Removed})
+	sum := sha256.Sum256(entries)
+	return []byte(fmt.Sprintf("p2p-storage change set\n%x\n%s\n%s\n%s\n%d\n%x",
+		c.PublicKey, c.Root, c.Base, c.Manifest, c.Timestamp, sum))
 }
 
 // NewMessage creates a new message with the given type and payload
@@ -76,7 +692,106 @@ func NewMessage(msgType MessageType, senderID string, payload interface{}) (*Mes
 	}, nil
 }
 
+// NewMessageID returns a random ID for a gossiped message or a request
+func NewMessageID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate message ID: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Forwarded returns a copy of a gossiped message to pass on one hop
+// further, sent by senderID. Stamps are per hop, so they are dropped.
+func (m *Message) Forwarded(senderID string) *Message {
+	forwarded := *m
+	forwarded.SenderID = senderID
+	forwarded.TTL--
+	forwarded.Timestamp, forwarded.Nonce, forwarded.MAC = 0, "", nil
+	return &forwarded
+}
+
+// SignedData returns the bytes covered by the message's signature: its
+// type, gossip ID and payload, which stay the same at every hop
+func (m *Message) SignedData() []byte {
+	header := fmt.Sprintf("p2p-storage message\n%s\n%s\n", m.Type, m.ID)
+	return append([]byte(header), m.Payload...)
+}
+
+// Sign signs the message as originating at the node with the identity key
+// public. A gossiped message must have its ID before it is signed.
+func (m *Message) Sign(public []byte, sign func(data []byte) []byte) {
+	m.PublicKey = public
+	m.Signature = sign(m.SignedData())
+}
+
+// Signed reports whether the message carries a signature
+func (m *Message) Signed() bool {
+	return len(m.Signature) > 0
+}
+
+// VerifySignature checks the signature of a signed message, failing with
+// ErrBadSignature if it is not that of PublicKey. Unsigned messages pass.
+func (m *Message) VerifySignature() error {
+	if !m.Signed() {
+		return nil
+	}
+	if len(m.PublicKey) != ed25519.PublicKeySize || !ed25519.Verify(m.PublicKey, m.SignedData(), m.Signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Stamp returns a copy of the message stamped with the current time and a
+// fresh nonce
+func (m *Message) Stamp() (*Message, error) {
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	stamped := *m
+	stamped.Timestamp = time.Now().UnixMilli()
+	stamped.Nonce = hex.EncodeToString(nonce)
+	stamped.MAC = nil
+	return &stamped, nil
+}
+
+// Stamped reports whether the message carries a timestamp and nonce
+func (m *Message) Stamped() bool {
+	return m.Timestamp != 0 && m.Nonce != ""
+}
+
+// sealData returns the bytes covered by the message's MAC: everything but
+// the MAC itself, the payload by its digest
+func (m *Message) sealData() []byte {
+	sum := sha256.Sum256(m.Payload)
+	header := fmt.Sprintf("p2p-storage seal\n%s\n%s\n%s\n%d\n%s\n%s\n%s\n%d\n%s\n%x\n%x\n",
+		m.Type, m.SenderID, m.ID, m.TTL, m.RequestID, m.TraceID, m.Nonce, m.Timestamp, sum[:], m.PublicKey, m.Signature)
+	return []byte(header)
+}
+
+// Seal sets the MAC of a stamped message with key, a key shared by the two
+// ends of the connection it is sent on
+func (m *Message) Seal(key []byte) {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(m.sealData())
+	m.MAC = mac.Sum(nil)
+}
+
+// VerifySeal reports whether the message is stamped and sealed with key
+func (m *Message) VerifySeal(key []byte) bool {
+	if !m.Stamped() || len(m.MAC) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(m.sealData())
+	return hmac.Equal(m.MAC, mac.Sum(nil))
+}
+
 // ParsePayload parses the message payload into the given interface
 func (m *Message) ParsePayload(v interface{}) error {
-	return json.Unmarshal(m.Payload, v)
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPayload, err)
+	}
+	return nil
 }
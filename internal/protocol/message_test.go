@@ -1,7 +1,9 @@
 package protocol
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"testing"
 )
 
@@ -71,7 +73,7 @@ func TestMessage_ParsePayload(t *testing.T) {
 			NodeID:     "node1",
 			Address:    "localhost:8080",
 			KnownPeers: []string{"peer1", "peer2"},
-			Key:        []byte("testkey"),
+			Challenge:  []byte("testchallenge"),
 		}
 
 		msg, err := NewMessage(MessageTypeHandshake, "node1", originalPayload)
@@ -93,8 +95,8 @@ func TestMessage_ParsePayload(t *testing.T) {
 		if len(parsedPayload.KnownPeers) != len(originalPayload.KnownPeers) {
 			t.Errorf("KnownPeers length = %v, want %v", len(parsedPayload.KnownPeers), len(originalPayload.KnownPeers))
 		}
-		if string(parsedPayload.Key) != string(originalPayload.Key) {
-			t.Errorf("Key = %v, want %v", string(parsedPayload.Key), string(originalPayload.Key))
+		if string(parsedPayload.Challenge) != string(originalPayload.Challenge) {
+			t.Errorf("Challenge = %v, want %v", string(parsedPayload.Challenge), string(originalPayload.Challenge))
 		}
 	})
 
@@ -144,8 +146,60 @@ func TestMessage_ParsePayload(t *testing.T) {
 		}
 
 		var payload DataPayload
-		if err := msg.ParsePayload(&payload); err == nil {
-			t.Error("Expected error for invalid payload, got nil")
+		if err := msg.ParsePayload(&payload); !errors.Is(err, ErrInvalidPayload) {
+			t.Errorf("ParsePayload() error = %v, want %v", err, ErrInvalidPayload)
 		}
 	})
 }
+
+func TestMessage_Forwarded(t *testing.T) {
+	msg, err := NewMessage(MessageTypeData, "origin", DataPayload{ContentHash: "abc123"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	if msg.ID, err = NewMessageID(); err != nil {
+		t.Fatalf("Failed to create message ID: %v", err)
+	}
+	msg.TTL = 3
+
+	forwarded := msg.Forwarded("relay")
+	if forwarded.ID != msg.ID || forwarded.TTL != 2 || forwarded.SenderID != "relay" {
+		t.Errorf("Forwarded() = %+v, want ID %s, TTL 2 from relay", forwarded, msg.ID)
+	}
+	if msg.TTL != 3 || msg.SenderID != "origin" {
+		t.Errorf("Forwarded() changed the original message to %+v", msg)
+	}
+	if other, _ := NewMessageID(); other == msg.ID {
+		t.Error("NewMessageID() returned the same ID twice")
+	}
+}
+
+func TestMessage_Sign(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	msg, err := NewMessage(MessageTypeData, "origin", DataPayload{ContentHash: "abc123"})
+	if err != nil {
+		t.Fatalf("Failed to create message: %v", err)
+	}
+	msg.ID, msg.TTL = "0123456789abcdef", 3
+	if err := msg.VerifySignature(); err != nil {
+		t.Errorf("VerifySignature() of an unsigned message = %v", err)
+	}
+	msg.Sign(public, func(data []byte) []byte { return ed25519.Sign(private, data) })
+
+	if err := msg.Forwarded("relay").VerifySignature(); err != nil {
+		t.Errorf("VerifySignature() after a hop = %v", err)
+	}
+	tampered := *msg
+	tampered.Payload = json.RawMessage(`{"content_hash":"def456"}`)
+	if err := tampered.VerifySignature(); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("VerifySignature() of an altered payload = %v, want %v", err, ErrBadSignature)
+	}
+	tampered = *msg
+	tampered.ID = "fedcba9876543210"
+	if err := tampered.VerifySignature(); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("VerifySignature() of an altered ID = %v, want %v", err, ErrBadSignature)
+	}
+}
@@ -0,0 +1,585 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+	"math/bits"
+)
+
+// Bounds payloads are held to by Validate. They are far above what honest
+// peers send, and only there so a malformed or hostile message is refused
+// before any handler works with it.
+const (
+	MaxIDLength        = 256     // node IDs, request, trace and session IDs
+	MaxAddressLength   = 512     // a host:port, or a ws:// URL
+	MaxAddresses       = 64      // addresses a node announces for itself
+	MaxPeerList        = 1024    // known peers listed in a handshake
+	MaxHashLength      = 128     // content hashes; SHA-256 in hex is 64
+	MaxInventoryHashes = 1 << 20 // hashes in one inventory
+	MaxListHashes      = 10000   // hashes in one page of a listing
+	MaxSyncBuckets     = 256     // groups in a sync summary
+	MaxSearchHits      = 1000    // hits in one search result
+	MaxSearchHops      = 4       // times a search is passed on
+	MaxTopics          = 256     // topics in one subscription
+	MaxTopicLength     = 256
+	MaxPublication     = 1 << 16 // bytes of data published in one message
+	MaxRecords         = 1024    // name records or feed entries in one message
+	MaxAnnouncements   = 1024    // announcements in one batch
+	MaxChangeEntries   = 1 << 16 // entries of each kind in a change set
+	MaxPathLength      = 4096    // file names, paths and link targets
+	MaxTextLength      = 4096    // error messages and reasons
+	MaxSDPLength       = 64 << 10
+	MaxTTL             = 64
+	MaxResendChunks    = 4096 // chunks asked for again in one data request
+	MaxWindow          = 4096 // chunks a transfer window or credit allows
+	MaxPriority        = 7    // transfer priority; levels above PriorityInteractive are for later use
+	// MaxChunkIndex keeps a chunk's offset from overflowing
+	MaxChunkIndex = 1 << 32
+)
+
+// Validate checks that a message's envelope and payload are within bounds:
+// IDs and addresses of sane length, lists not too long, hashes well formed
+// and sizes and chunk indexes in range. Messages of types this build
+// doesn't know only have their envelope checked. Errors wrap
+// ErrInvalidPayload.
+func Validate(msg *Message) error {
+	if err := validateEnvelope(msg); err != nil {
+		return err
+	}
+	check, ok := payloadChecks[msg.Type]
+	if !ok {
+		return nil
+	}
+	if err := check(msg); err != nil {
+		return fmt.Errorf("%s: %w", msg.Type, err)
+	}
+	return nil
+}
+
+// ValidateTransfer checks a chunk like Validate checks a data_transfer
+// message, for chunks that arrive decoded, such as on a bulk channel
+func ValidateTransfer(t *DataTransfer) error {
+	if err := validateTransfer(t); err != nil {
+		return fmt.Errorf("%s: %w", MessageTypeDataTransfer, err)
+	}
+	return nil
+}
+
+func validateEnvelope(msg *Message) error {
+	switch {
+	case len(msg.Type) == 0 || len(msg.Type) > MaxIDLength:
+		return invalid("message type of %d bytes", len(msg.Type))
+	case len(msg.SenderID) > MaxIDLength:
+		return invalid("sender ID of %d bytes", len(msg.SenderID))
+	case len(msg.ID) > MaxIDLength || len(msg.RequestID) > MaxIDLength || len(msg.TraceID) > MaxIDLength || len(msg.Nonce) > MaxIDLength:
+		return invalid("message ID, request ID, trace ID or nonce over %d bytes", MaxIDLength)
+	case msg.TTL < 0 || msg.TTL > MaxTTL:
+		return invalid("TTL %d out of range", msg.TTL)
+	case msg.Signed() != (len(msg.PublicKey) > 0):
+		return invalid("signature without a public key, or a public key without a signature")
+	}
+	return firstError(
+		checkKey("public key", msg.PublicKey),
+		checkSignature("signature", msg.Signature),
+		checkBytes("MAC", msg.MAC, sha256.Size),
+	)
+}
+
+// payloadChecks parse and check the payload of each message type
+var payloadChecks = map[MessageType]func(*Message) error{
+	MessageTypeHandshake: parsed(func(p *HandshakePayload) error {
+		return firstError(
+			checkID("node ID", p.NodeID, true),
+			checkAddresses(p.Address, p.Addresses),
+			checkList("known peers", len(p.KnownPeers), MaxPeerList),
+			checkEach(p.KnownPeers, func(a string) error { return checkLength("known peer", a, MaxAddressLength) }),
+			checkKey("public key", p.PublicKey),
+			checkKey("exchange key", p.ExchangeKey),
+			checkSignature("exchange signature", p.ExchangeSignature),
+			checkLength("user agent", p.UserAgent, MaxIDLength),
+			checkList("features", len(p.Features), MaxAddresses),
+			checkList("codecs", len(p.Codecs), MaxAddresses),
+			checkList("frame compression schemes", len(p.FrameCompression), MaxAddresses),
+			checkLength("network ID", p.NetworkID, MaxIDLength),
+			checkLength("invite", p.Invite, MaxIDLength),
+			checkRange("version", int64(p.Version), 0, int64(^uint32(0)>>1)),
+			checkRange("minimum version", int64(p.MinVersion), 0, int64(^uint32(0)>>1)),
+			checkBytes("challenge", p.Challenge, ChallengeSize),
+			checkSignature("proof", p.Proof),
+		)
+	}),
+	MessageTypeNetworkKey: parsed(func(p *NetworkKey) error {
+		return checkBytes("wrapped key", p.WrappedKey, MaxHashLength)
+	}),
+	MessageTypeHandshakeProof: parsed(func(p *HandshakeProof) error {
+		if len(p.Proof) == 0 {
+			return invalid("proof missing")
+		}
+		return checkSignature("proof", p.Proof)
+	}),
+	MessageTypeData: parsed(checkAnnouncement),
+	MessageTypeDataBatch: parsed(func(p *AnnouncementBatch) error {
+		if len(p.Announcements) == 0 {
+			return invalid("no announcements")
+		}
+		return firstError(
+			checkList("announcements", len(p.Announcements), MaxAnnouncements),
+			checkEach(p.Announcements, func(a DataPayload) error { return checkAnnouncement(&a) }),
+		)
+	}),
+	MessageTypeDataRequest: parsed(func(p *DataRequest) error {
+		if err := firstError(
+			checkHash("content hash", p.ContentHash, true),
+			checkList("chunks", len(p.Chunks), MaxResendChunks),
+			checkEach(p.Chunks, func(index int) error {
+				return checkRange("chunk index", int64(index), 0, MaxChunkIndex-1)
+			}),
+			checkRange("resume index", int64(p.ResumeFrom), 0, MaxChunkIndex-1),
+			checkRange("window", int64(p.Window), 0, MaxWindow),
+			checkRange("priority", int64(p.Priority), 0, MaxPriority),
+		); err != nil {
+			return err
+		}
+		if p.Range != nil {
+			if err := firstError(
+				checkRange("range offset", p.Range.Offset, 0, 1<<62),
+				checkRange("range length", p.Range.Length, 0, 1<<62),
+			); err != nil {
+				return err
+			}
+		}
+		if p.ChunkSize == 0 {
+			return nil
+		}
+		return checkChunkSize(p.ChunkSize)
+	}),
+	MessageTypeDataTransfer: parsed(validateTransfer),
+	MessageTypeCredit: parsed(func(p *Credit) error {
+		return firstError(
+			checkHash("content hash", p.ContentHash, true),
+			checkRange("chunks", int64(p.Chunks), 1, MaxWindow),
+		)
+	}),
+	MessageTypeDiscovery: parsed(func(p *DiscoveryPayload) error {
+		return firstError(
+			checkID("node ID", p.NodeID, true),
+			checkAddresses(p.Address, p.Addresses),
+		)
+	}),
+	MessageTypeInventory: parsed(func(p *InventoryPayload) error {
+		return firstError(
+			checkID("node ID", p.NodeID, false),
+			checkList("hashes", len(p.Hashes), MaxInventoryHashes),
+			checkEach(p.Hashes, func(h string) error { return checkHash("hash", h, true) }),
+		)
+	}),
+	MessageTypeListRequest: parsed(func(p *ListRequest) error {
+		return firstError(
+			checkHash("after", p.After, false),
+			checkRange("limit", int64(p.Limit), 0, MaxListHashes),
+		)
+	}),
+	MessageTypeListResponse: parsed(func(p *ListResponse) error {
+		return firstError(
+			checkList("hashes", len(p.Hashes), MaxListHashes),
+			checkEach(p.Hashes, func(h string) error { return checkHash("hash", h, true) }),
+			checkHash("next", p.Next, false),
+		)
+	}),
+	MessageTypeStatRequest: parsed(func(p *StatRequest) error {
+		return checkHash("content hash", p.ContentHash, true)
+	}),
+	MessageTypeStat: parsed(func(p *Stat) error {
+		return firstError(
+			checkHash("content hash", p.ContentHash, true),
+			checkRange("stored size", p.StoredSize, 0, 1<<62),
+			checkLength("file name", p.FileName, MaxPathLength),
+			checkLength("path", p.Path, MaxPathLength),
+			checkRange("size", p.Size, 0, 1<<62),
+			checkLength("encryption", p.Encryption, MaxIDLength),
+			checkRange("replicas", int64(p.Replicas), 0, 1<<40),
+		)
+	}),
+	MessageTypeSearch: parsed(func(p *SearchRequest) error {
+		return firstError(
+			checkID("search ID", p.ID, true),
+			checkLength("query", p.Query, MaxTextLength),
+			checkRange("hops", int64(p.Hops), 0, MaxSearchHops),
+		)
+	}),
+	MessageTypeSearchResult: parsed(func(p *SearchResult) error {
+		return firstError(
+			checkList("hits", len(p.Hits), MaxSearchHits),
+			checkEach(p.Hits, func(h SearchHit) error {
+				return firstError(
+					checkHash("content hash", h.ContentHash, true),
+					checkLength("file name", h.FileName, MaxPathLength),
+					checkLength("path", h.Path, MaxPathLength),
+					checkRange("size", h.Size, 0, 1<<62),
+					checkList("holders", len(h.Holders), MaxPeerList),
+					checkEach(h.Holders, func(id string) error { return checkID("holder", id, true) }),
+				)
+			}),
+		)
+	}),
+	MessageTypeWant: parsed(func(p *Want) error {
+		return firstError(
+			checkHash("content hash", p.ContentHash, true),
+			checkChunkSize(p.ChunkSize),
+		)
+	}),
+	MessageTypeHave: parsed(func(p *Have) error {
+		if err := firstError(
+			checkHash("content hash", p.ContentHash, true),
+			checkRange("size", p.Size, 0, 1<<62),
+			checkChunkSize(p.ChunkSize),
+		); err != nil {
+			return err
+		}
+		if want := (p.ChunkCount() + 7) / 8; len(p.Bitfield) != want {
+			return invalid("bitfield of %d bytes for %d chunks", len(p.Bitfield), p.ChunkCount())
+		}
+		return nil
+	}),
+	MessageTypeSubscribe:   parsed(checkSubscription),
+	MessageTypeUnsubscribe: parsed(checkSubscription),
+	MessageTypePublish: parsed(func(p *Publication) error {
+		return firstError(
+			checkTopic(p.Topic),
+			checkID("origin", p.Origin, true),
+			checkBytes("data", p.Data, MaxPublication),
+		)
+	}),
+	MessageTypeSyncSummary: parsed(func(p *SyncSummary) error {
+		return firstError(
+			checkList("buckets", len(p.Buckets), MaxSyncBuckets),
+			checkEach(p.Buckets, func(b SyncBucket) error {
+				return firstError(
+					checkHash("prefix", b.Prefix, true),
+					checkRange("count", int64(b.Count), 0, 1<<40),
+					checkBytes("digest", b.Digest, MaxHashLength),
+				)
+			}),
+		)
+	}),
+	MessageTypeLeave: parsed(func(p *LeavePayload) error {
+		return checkID("node ID", p.NodeID, true)
+	}),
+	MessageTypeError: parsed(func(p *ErrorPayload) error {
+		return firstError(
+			checkLength("code", p.Code, MaxIDLength),
+			checkLength("message", p.Message, MaxTextLength),
+		)
+	}),
+	MessageTypeBulkChannel: parsed(func(p *BulkChannelPayload) error {
+		return checkLength("token", p.Token, maxBulkToken)
+	}),
+	MessageTypeReceipt: parsed(func(p *ReceiptPayload) error {
+		return firstError(
+			checkHash("content hash", p.ContentHash, true),
+			checkRange("size", p.Size, 0, 1<<62),
+			checkID("node ID", p.NodeID, true),
+			checkKey("public key", p.PublicKey),
+			checkSignature("signature", p.Signature),
+		)
+	}),
+	MessageTypeAudit: parsed(func(p *AuditChallenge) error {
+		return firstError(
+			checkID("challenge ID", p.ID, true),
+			checkHash("content hash", p.ContentHash, true),
+			checkBytes("nonce", p.Nonce, MaxHashLength),
+			checkRange("offset", p.Offset, 0, 1<<62),
+			checkRange("length", p.Length, 0, 1<<62),
+		)
+	}),
+	MessageTypeAuditProof: parsed(func(p *AuditProof) error {
+		return firstError(
+			checkID("challenge ID", p.ID, true),
+			checkBytes("digest", p.Digest, MaxHashLength),
+			checkLength("error", p.Error, MaxTextLength),
+		)
+	}),
+	MessageTypeTombstone: parsed(func(p *TombstonePayload) error {
+		return firstError(
+			checkList("tombstones", len(p.Tombstones), MaxRecords),
+			checkEach(p.Tombstones, func(t Tombstone) error {
+				return firstError(
+					checkHash("content hash", t.ContentHash, true),
+					checkKey("public key", t.PublicKey),
+					checkSignature("signature", t.Signature),
+				)
+			}),
+		)
+	}),
+	MessageTypeName: parsed(func(p *NamePayload) error {
+		return firstError(
+			checkList("records", len(p.Records), MaxRecords),
+			checkEach(p.Records, func(r NameRecord) error {
+				return firstError(
+					checkLength("label", r.Label, MaxIDLength),
+					checkHash("hash", r.Hash, true),
+					checkKey("public key", r.PublicKey),
+					checkSignature("signature", r.Signature),
+				)
+			}),
+		)
+	}),
+	MessageTypeFeed: parsed(func(p *FeedPayload) error {
+		return firstError(
+			checkList("entries", len(p.Entries), MaxRecords),
+			checkEach(p.Entries, func(e FeedEntry) error {
+				return firstError(
+					checkHash("hash", e.Hash, true),
+					checkBytes("previous digest", e.Prev, MaxHashLength),
+					checkKey("public key", e.PublicKey),
+					checkSignature("signature", e.Signature),
+				)
+			}),
+		)
+	}),
+	MessageTypeFeedRequest: parsed(func(p *FeedRequest) error {
+		return checkID("feed", p.Feed, true)
+	}),
+	MessageTypeChangeSet: parsed(func(p *ChangeSet) error {
+		entry := func(e ChangeEntry) error {
+			return firstError(
+				checkLength("path", e.Path, MaxPathLength),
+				checkHash("hash", e.Hash, false),
+				checkLength("link", e.Link, MaxPathLength),
+				checkRange("size", e.Size, 0, 1<<62),
+			)
+		}
+		return firstError(
+			checkLength("root", p.Root, MaxPathLength),
+			checkHash("base", p.Base, false),
+			checkHash("manifest", p.Manifest, true),
+			checkList("added entries", len(p.Added), MaxChangeEntries),
+			checkList("changed entries", len(p.Changed), MaxChangeEntries),
+			checkList("removed entries", len(p.Removed), MaxChangeEntries),
+			checkEach(p.Added, entry),
+			checkEach(p.Changed, entry),
+			checkEach(p.Removed, func(path string) error { return checkLength("path", path, MaxPathLength) }),
+			checkKey("public key", p.PublicKey),
+			checkSignature("signature", p.Signature),
+		)
+	}),
+	MessageTypeDeltaRequest: parsed(func(p *DeltaRequest) error {
+		return firstError(
+			checkHash("content hash", p.ContentHash, true),
+			checkHash("basis", p.Basis, true),
+		)
+	}),
+	MessageTypeDelta: parsed(func(p *Delta) error {
+		return firstError(
+			checkHash("content hash", p.ContentHash, true),
+			checkHash("basis", p.Basis, true),
+			checkRange("block size", int64(p.BlockSize), 0, DefaultChunkSize),
+			checkBytes("IV", p.IV, MaxHashLength),
+			checkLength("error", p.Error, MaxTextLength),
+		)
+	}),
+	MessageTypeBench: parsed(func(p *BenchRequest) error {
+		return firstError(
+			checkID("benchmark ID", p.ID, true),
+			checkRange("size", p.Size, 0, 1<<62),
+		)
+	}),
+	MessageTypePunch: parsed(func(p *PunchPayload) error {
+		return firstError(
+			checkID("from", p.From, true),
+			checkID("to", p.To, true),
+			checkLength("address", p.Address, MaxAddressLength),
+		)
+	}),
+	MessageTypeSignal: parsed(func(p *SignalPayload) error {
+		return firstError(
+			checkID("from", p.From, true),
+			checkID("to", p.To, true),
+			checkID("session", p.Session, true),
+			checkLength("SDP", p.SDP, MaxSDPLength),
+			checkLength("error", p.Error, MaxTextLength),
+		)
+	}),
+}
+
+// validateTransfer checks a chunk's hash, index and size. Data may not be
+// longer than a chunk, nor reach past the object's size if it is given.
+// Benchmark chunks carry no hash.
+func validateTransfer(t *DataTransfer) error {
+	chunkSize := t.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if err := firstError(
+		checkHash("content hash", t.ContentHash, t.Bench == ""),
+		checkID("benchmark ID", t.Bench, false),
+		checkID("range request ID", t.Range, false),
+		checkRange("chunk index", int64(t.ChunkIndex), 0, MaxChunkIndex-1),
+		checkRange("total size", t.TotalSize, 0, 1<<62),
+		checkRange("priority", int64(t.Priority), 0, MaxPriority),
+		checkBytes("IV", t.IV, MaxHashLength),
+		checkLength("compression", t.Compression, MaxIDLength),
+		checkLength("trace ID", t.TraceID, MaxIDLength),
+	); err != nil {
+		return err
+	}
+	if err := checkChunkSize(chunkSize); err != nil {
+		return err
+	}
+	if len(t.Data) > chunkSize {
+		return invalid("chunk of %d bytes is larger than the chunk size %d", len(t.Data), chunkSize)
+	}
+	if t.TotalSize > 0 && t.Compression == "" && t.Offset()+int64(len(t.Data)) > t.TotalSize {
+		return invalid("chunk %d reaches past the object's %d bytes", t.ChunkIndex, t.TotalSize)
+	}
+	return nil
+}
+
+// parsed turns a check of a payload type into one of a message
+func parsed[T any](check func(*T) error) func(*Message) error {
+	return func(msg *Message) error {
+		var payload T
+		if err := msg.ParsePayload(&payload); err != nil {
+			return err
+		}
+		return check(&payload)
+	}
+}
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidPayload}, args...)...)
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkAnnouncement(p *DataPayload) error {
+	return firstError(
+		checkHash("content hash", p.ContentHash, true),
+		checkHash("previous hash", p.Previous, false),
+		checkRange("size", p.Size, 0, 1<<62),
+		checkLength("file name", p.FileName, MaxPathLength),
+		checkLength("path", p.Path, MaxPathLength),
+		checkLength("link", p.Link, MaxPathLength),
+		checkLength("namespace", p.Namespace, MaxIDLength),
+		checkBytes("IV", p.IV, MaxHashLength),
+		checkBytes("key", p.Key, MaxHashLength),
+	)
+}
+
+func checkSubscription(p *Subscription) error {
+	return firstError(
+		checkList("topics", len(p.Topics), MaxTopics),
+		checkEach(p.Topics, checkTopic),
+	)
+}
+
+func checkTopic(topic string) error {
+	if topic == "" {
+		return invalid("topic missing")
+	}
+	return checkLength("topic", topic, MaxTopicLength)
+}
+
+func checkEach[T any](items []T, check func(T) error) error {
+	for _, item := range items {
+		if err := check(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkLength(name, value string, max int) error {
+	if len(value) > max {
+		return invalid("%s of %d bytes, over %d", name, len(value), max)
+	}
+	return nil
+}
+
+func checkID(name, value string, required bool) error {
+	if required && value == "" {
+		return invalid("%s missing", name)
+	}
+	return checkLength(name, value, MaxIDLength)
+}
+
+func checkList(name string, n, max int) error {
+	if n > max {
+		return invalid("%d %s, over %d", n, name, max)
+	}
+	return nil
+}
+
+func checkRange(name string, value, min, max int64) error {
+	if value < min || value > max {
+		return invalid("%s %d out of range", name, value)
+	}
+	return nil
+}
+
+func checkChunkSize(size int) error {
+	if size < MinChunkSize || size > DefaultChunkSize || bits.OnesCount(uint(size)) != 1 {
+		return invalid("chunk size %d is not a power of two from %d to %d", size, MinChunkSize, DefaultChunkSize)
+	}
+	return nil
+}
+
+func checkBytes(name string, value []byte, max int) error {
+	if len(value) > max {
+		return invalid("%s of %d bytes, over %d", name, len(value), max)
+	}
+	return nil
+}
+
+// checkAddresses checks a node's address and the list of all of them
+func checkAddresses(address string, all []string) error {
+	return firstError(
+		checkLength("address", address, MaxAddressLength),
+		checkList("addresses", len(all), MaxAddresses),
+		checkEach(all, func(a string) error { return checkLength("address", a, MaxAddressLength) }),
+	)
+}
+
+// checkHash checks that a hash is only letters and digits, like those the
+// store keeps objects under, and not too long
+func checkHash(name, hash string, required bool) error {
+	if hash == "" {
+		if required {
+			return invalid("%s missing", name)
+		}
+		return nil
+	}
+	if len(hash) > MaxHashLength {
+		return invalid("%s of %d bytes, over %d", name, len(hash), MaxHashLength)
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return invalid("%s contains %q", name, c)
+		}
+	}
+	return nil
+}
+
+// checkKey checks that an identity or exchange key, if given, is the size
+// of one
+func checkKey(name string, key []byte) error {
+	if len(key) != 0 && len(key) != ed25519.PublicKeySize {
+		return invalid("%s of %d bytes", name, len(key))
+	}
+	return nil
+}
+
+func checkSignature(name string, sig []byte) error {
+	if len(sig) != 0 && len(sig) != ed25519.SignatureSize {
+		return invalid("%s of %d bytes", name, len(sig))
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	tests := []struct {
+		name    string
+		msgType MessageType
+		payload interface{}
+		wantErr bool
+	}{
+		{"handshake", MessageTypeHandshake, HandshakePayload{NodeID: "node1", Address: "localhost:3000", KnownPeers: []string{"localhost:3001"}}, false},
+		{"handshake without node ID", MessageTypeHandshake, HandshakePayload{Address: "localhost:3000"}, true},
+		{"handshake with too many peers", MessageTypeHandshake, HandshakePayload{NodeID: "node1", KnownPeers: make([]string, MaxPeerList+1)}, true},
+		{"handshake with a short key", MessageTypeHandshake, HandshakePayload{NodeID: "node1", PublicKey: []byte{1, 2, 3}}, true},
+		{"announcement", MessageTypeData, DataPayload{ContentHash: hash, FileName: "a.txt", Size: 10}, false},
+		{"announcement with a path in the hash", MessageTypeData, DataPayload{ContentHash: "../../etc/passwd"}, true},
+		{"announcement with a negative size", MessageTypeData, DataPayload{ContentHash: hash, Size: -1}, true},
+		{"announcement batch", MessageTypeDataBatch, AnnouncementBatch{Announcements: []DataPayload{{ContentHash: hash, Size: 10}, {ContentHash: hash, Size: 20}}}, false},
+		{"empty announcement batch", MessageTypeDataBatch, AnnouncementBatch{}, true},
+		{"announcement batch with a bad hash", MessageTypeDataBatch, AnnouncementBatch{Announcements: []DataPayload{{ContentHash: hash}, {ContentHash: "x y"}}}, true},
+		{"request without a hash", MessageTypeDataRequest, DataRequest{}, true},
+		{"request for missing chunks", MessageTypeDataRequest, DataRequest{ContentHash: hash, Chunks: []int{1, 4}, ChunkSize: MinChunkSize}, false},
+		{"request for a negative chunk", MessageTypeDataRequest, DataRequest{ContentHash: hash, Chunks: []int{-1}}, true},
+		{"request resuming a transfer", MessageTypeDataRequest, DataRequest{ContentHash: hash, ResumeFrom: 3, ChunkSize: MinChunkSize}, false},
+		{"request resuming at a negative chunk", MessageTypeDataRequest, DataRequest{ContentHash: hash, ResumeFrom: -2}, true},
+		{"request for a range", MessageTypeDataRequest, DataRequest{ContentHash: hash, Range: &ByteRange{Offset: 100, Length: 10}}, false},
+		{"request for a negative range", MessageTypeDataRequest, DataRequest{ContentHash: hash, Range: &ByteRange{Offset: -1}}, true},
+		{"request with a window", MessageTypeDataRequest, DataRequest{ContentHash: hash, Window: 16}, false},
+		{"request with too large a window", MessageTypeDataRequest, DataRequest{ContentHash: hash, Window: MaxWindow + 1}, true},
+		{"interactive request", MessageTypeDataRequest, DataRequest{ContentHash: hash, Priority: PriorityInteractive}, false},
+		{"request with a negative priority", MessageTypeDataRequest, DataRequest{ContentHash: hash, Priority: -1}, true},
+		{"credit", MessageTypeCredit, Credit{ContentHash: hash, Chunks: 8}, false},
+		{"credit for no chunks", MessageTypeCredit, Credit{ContentHash: hash}, true},
+		{"request at an odd chunk size", MessageTypeDataRequest, DataRequest{ContentHash: hash, Chunks: []int{1}, ChunkSize: 1000}, true},
+		{"inventory", MessageTypeInventory, InventoryPayload{NodeID: "node1", Hashes: []string{hash}}, false},
+		{"list request", MessageTypeListRequest, ListRequest{After: hash, Limit: 100}, false},
+		{"list request over the page limit", MessageTypeListRequest, ListRequest{Limit: MaxListHashes + 1}, true},
+		{"list response", MessageTypeListResponse, ListResponse{Hashes: []string{hash}, Next: hash}, false},
+		{"list response with a bad hash", MessageTypeListResponse, ListResponse{Hashes: []string{"../x"}}, true},
+		{"sync summary", MessageTypeSyncSummary, SyncSummary{Buckets: []SyncBucket{{Prefix: "a", Count: 2, Digest: make([]byte, 32)}}}, false},
+		{"sync summary with a bad prefix", MessageTypeSyncSummary, SyncSummary{Buckets: []SyncBucket{{Prefix: "../", Count: 2}}}, true},
+		{"tombstone", MessageTypeTombstone, TombstonePayload{Tombstones: []Tombstone{{ContentHash: hash, Timestamp: 1}}}, false},
+		{"tombstone without a hash", MessageTypeTombstone, TombstonePayload{Tombstones: []Tombstone{{Timestamp: 1}}}, true},
+		{"stat request", MessageTypeStatRequest, StatRequest{ContentHash: hash}, false},
+		{"stat with a negative size", MessageTypeStat, Stat{ContentHash: hash, Size: -1}, true},
+		{"search", MessageTypeSearch, SearchRequest{ID: "s1", Query: "report", Hops: 2}, false},
+		{"search passed on too far", MessageTypeSearch, SearchRequest{ID: "s1", Query: "report", Hops: MaxSearchHops + 1}, true},
+		{"search result", MessageTypeSearchResult, SearchResult{Hits: []SearchHit{{ContentHash: hash, FileName: "report.txt", Holders: []string{"node1"}}}}, false},
+		{"search result without holders' IDs", MessageTypeSearchResult, SearchResult{Hits: []SearchHit{{ContentHash: hash, Holders: []string{""}}}}, true},
+		{"want", MessageTypeWant, Want{ContentHash: hash, ChunkSize: DefaultChunkSize}, false},
+		{"want at an odd chunk size", MessageTypeWant, Want{ContentHash: hash, ChunkSize: 1000}, true},
+		{"have", MessageTypeHave, Have{ContentHash: hash, Size: 9 * DefaultChunkSize, ChunkSize: DefaultChunkSize, Bitfield: []byte{0xff, 0x80}}, false},
+		{"have with a short bitfield", MessageTypeHave, Have{ContentHash: hash, Size: 9 * DefaultChunkSize, ChunkSize: DefaultChunkSize, Bitfield: []byte{0xff}}, true},
+		{"subscribe", MessageTypeSubscribe, Subscription{Topics: []string{"releases"}}, false},
+		{"unsubscribe from an empty topic", MessageTypeUnsubscribe, Subscription{Topics: []string{""}}, true},
+		{"publish", MessageTypePublish, Publication{Topic: "releases", Origin: "node1", Data: []byte("v1.2")}, false},
+		{"publish too much", MessageTypePublish, Publication{Topic: "releases", Origin: "node1", Data: make([]byte, MaxPublication+1)}, true},
+		{"inventory with a bad hash", MessageTypeInventory, InventoryPayload{NodeID: "node1", Hashes: []string{hash, "x y"}}, true},
+		{"chunk", MessageTypeDataTransfer, DataTransfer{ContentHash: hash, Data: make([]byte, 100), ChunkIndex: 2, TotalSize: DefaultChunkSize*2 + 100}, false},
+		{"chunk with too high a priority", MessageTypeDataTransfer, DataTransfer{ContentHash: hash, Priority: MaxPriority + 1}, true},
+		{"chunk with a negative index", MessageTypeDataTransfer, DataTransfer{ContentHash: hash, ChunkIndex: -1}, true},
+		{"chunk past the object", MessageTypeDataTransfer, DataTransfer{ContentHash: hash, Data: make([]byte, 100), ChunkIndex: 1, TotalSize: 100}, true},
+		{"chunk larger than its chunk size", MessageTypeDataTransfer, DataTransfer{ContentHash: hash, Data: make([]byte, MinChunkSize+1), ChunkSize: MinChunkSize}, true},
+		{"chunk with an odd chunk size", MessageTypeDataTransfer, DataTransfer{ContentHash: hash, ChunkSize: MinChunkSize + 1}, true},
+		{"benchmark chunk", MessageTypeDataTransfer, DataTransfer{Bench: "b1", Data: make([]byte, 10)}, false},
+		{"signal with an oversized SDP", MessageTypeSignal, SignalPayload{From: "a", To: "b", Session: "s", SDP: strings.Repeat("x", MaxSDPLength+1)}, true},
+		{"unknown type", MessageType("future"), map[string]int{"anything": 1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := NewMessage(tt.msgType, "node1", tt.payload)
+			if err != nil {
+				t.Fatalf("NewMessage() error = %v", err)
+			}
+			err = Validate(msg)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidPayload) {
+				t.Errorf("Validate() error = %v, want it to wrap %v", err, ErrInvalidPayload)
+			}
+		})
+	}
+}
+
+func TestValidate_Envelope(t *testing.T) {
+	payload := json.RawMessage(`{"node_id":"node1"}`)
+	tests := []struct {
+		name string
+		msg  Message
+	}{
+		{"no type", Message{Payload: payload}},
+		{"long sender", Message{Type: MessageTypeLeave, SenderID: strings.Repeat("x", MaxIDLength+1), Payload: payload}},
+		{"negative TTL", Message{Type: MessageTypeLeave, TTL: -1, Payload: payload}},
+		{"huge TTL", Message{Type: MessageTypeLeave, TTL: MaxTTL + 1, Payload: payload}},
+		{"signature without a key", Message{Type: MessageTypeLeave, Signature: make([]byte, 64), Payload: payload}},
+		{"short signature", Message{Type: MessageTypeLeave, PublicKey: make([]byte, 32), Signature: make([]byte, 10), Payload: payload}},
+		{"payload of the wrong shape", Message{Type: MessageTypeLeave, Payload: json.RawMessage(`[1, 2]`)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(&tt.msg); !errors.Is(err, ErrInvalidPayload) {
+				t.Errorf("Validate() error = %v, want %v", err, ErrInvalidPayload)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// maxEntryFraction limits a single cached object to a fraction of the cache
+// so one large file can't flush every hot entry
+const maxEntryFraction = 4
+
+// evictionSample is how many of the least recently used entries are
+// compared by score when the cache has a score function
+const evictionSample = 8
+
+// CacheStats reports the state of the in-memory object cache
+type CacheStats struct {
+	Capacity int64 `json:"capacity"`
+	Size     int64 `json:"size"`
+	Entries  int   `json:"entries"`
+	Hits     int64 `json:"hits"`
+	Misses   int64 `json:"misses"`
+}
+
+type cacheEntry struct {
+	key  string
+	data []byte
+}
+
+// blockCache is a byte-bounded LRU cache of object contents
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+	score    func(key string) float64 // ranks eviction candidates; nil for plain LRU
+	hits     atomic.Int64
+	misses   atomic.Int64
+}
+
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// maxEntry returns the largest object the cache will hold
+func (c *blockCache) maxEntry() int64 {
+	return c.capacity / maxEntryFraction
+}
+
+func (c *blockCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.ll.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).data, true
+}
+
+func (c *blockCache) add(key string, data []byte) {
+	if int64(len(data)) > c.maxEntry() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		c.size += int64(len(data)) - int64(len(entry.data))
+		entry.data = data
+		c.ll.MoveToFront(elem)
+	} else {
+		c.items[key] = c.ll.PushFront(&cacheEntry{key: key, data: data})
+		c.size += int64(len(data))
+	}
+
+	for c.size > c.capacity {
+		c.removeElement(c.victimLocked())
+	}
+}
+
+// victimLocked picks the entry to evict: the least recently used one, or
+// with a score function, the lowest-scoring of the evictionSample least
+// recently used. The most recent entry is only picked when it is the last.
+func (c *blockCache) victimLocked() *list.Element {
+	victim := c.ll.Back()
+	if c.score == nil {
+		return victim
+	}
+	lowest := c.score(victim.Value.(*cacheEntry).key)
+	elem := victim.Prev()
+	for i := 1; i < evictionSample && elem != nil && elem != c.ll.Front(); i++ {
+		if s := c.score(elem.Value.(*cacheEntry).key); s < lowest {
+			victim, lowest = elem, s
+		}
+		elem = elem.Prev()
+	}
+	return victim
+}
+
+func (c *blockCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.removeElement(elem)
+	}
+}
+
+func (c *blockCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.ll.Remove(elem)
+	delete(c.items, entry.key)
+	c.size -= int64(len(entry.data))
+}
+
+func (c *blockCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Capacity: c.capacity,
+		Size:     c.size,
+		Entries:  len(c.items),
+		Hits:     c.hits.Load(),
+		Misses:   c.misses.Load(),
+	}
+}
@@ -0,0 +1,130 @@
+package storage
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestBlockCache_Eviction(t *testing.T) {
+	cache := newBlockCache(40)
+
+	cache.add("a", make([]byte, 10))
+	cache.add("b", make([]byte, 10))
+	cache.add("c", make([]byte, 10))
+	cache.add("d", make([]byte, 10))
+
+	// Touch "a" so "b" becomes the least recently used entry
+	if _, ok := cache.get("a"); !ok {
+		t.Fatal("Expected cache hit for a")
+	}
+	cache.add("e", make([]byte, 10))
+
+	if _, ok := cache.get("b"); ok {
+		t.Error("Least recently used entry b was not evicted")
+	}
+	if _, ok := cache.get("a"); !ok {
+		t.Error("Recently used entry a was evicted")
+	}
+
+	stats := cache.stats()
+	if stats.Size > stats.Capacity {
+		t.Errorf("Cache size %d exceeds capacity %d", stats.Size, stats.Capacity)
+	}
+}
+
+func TestBlockCache_EvictsLowestScore(t *testing.T) {
+	cache := newBlockCache(40)
+	scores := map[string]float64{"a": 5, "b": 5, "c": 0, "d": 5, "e": 0}
+	cache.score = func(key string) float64 { return scores[key] }
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		cache.add(key, make([]byte, 10))
+	}
+
+	// The least recently used entry a outlasts the unpopular c
+	if _, ok := cache.get("c"); ok {
+		t.Error("Lowest-scoring entry c was not evicted")
+	}
+	for _, key := range []string{"a", "b", "d", "e"} {
+		if _, ok := cache.get(key); !ok {
+			t.Errorf("Entry %s was evicted", key)
+		}
+	}
+}
+
+func TestBlockCache_MaxEntry(t *testing.T) {
+	cache := newBlockCache(40)
+
+	cache.add("big", make([]byte, 11))
+	if _, ok := cache.get("big"); ok {
+		t.Error("Entry larger than the per-entry limit was cached")
+	}
+}
+
+func TestStore_CachedLoad(t *testing.T) {
+	store, _, cleanup := setupTestStore(t)
+	defer cleanup()
+	store.cache = newBlockCache(1024)
+
+	contentHash := "cachehash123"
+	if err := store.Store(contentHash, strings.NewReader("cached content")); err != nil {
+		t.Fatalf("Failed to store content: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		reader, err := store.Load(contentHash)
+		if err != nil {
+			t.Fatalf("Failed to load content: %v", err)
+		}
+		data, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatalf("Failed to read content: %v", err)
+		}
+		if string(data) != "cached content" {
+			t.Errorf("Loaded content = %q, want %q", data, "cached content")
+		}
+	}
+
+	stats := store.CacheStats()
+	if stats.Misses != 1 || stats.Hits != 2 {
+		t.Errorf("Cache hits/misses = %d/%d, want 2/1", stats.Hits, stats.Misses)
+	}
+
+	// Deleting invalidates the cached copy
+	if err := store.Delete(contentHash); err != nil {
+		t.Fatalf("Failed to delete content: %v", err)
+	}
+	if _, err := store.Load(contentHash); err == nil {
+		t.Error("Expected error loading deleted content, got nil")
+	}
+}
+
+func TestStore_CacheAdmission(t *testing.T) {
+	store, _, cleanup := setupTestStore(t)
+	defer cleanup()
+	store.cache = newBlockCache(1024)
+
+	loads := 0
+	store.admit = func(string) bool { return loads >= 2 }
+
+	contentHash := "admithash123"
+	if err := store.Store(contentHash, strings.NewReader("admitted later")); err != nil {
+		t.Fatalf("Failed to store content: %v", err)
+	}
+
+	for loads = 1; loads <= 3; loads++ {
+		reader, err := store.Load(contentHash)
+		if err != nil {
+			t.Fatalf("Failed to load content: %v", err)
+		}
+		reader.Close()
+	}
+
+	// Load 1 is refused admission, load 2 is admitted, load 3 hits
+	stats := store.CacheStats()
+	if stats.Hits != 1 || stats.Misses != 2 {
+		t.Errorf("Cache hits/misses = %d/%d, want 1/2", stats.Hits, stats.Misses)
+	}
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LayoutVersion is the version of the on-disk layout description written by
+// this code. Stores recording a newer version are refused rather than misread.
+const LayoutVersion = 1
+
+// layoutFileName is the file in the store directory recording its layout
+const layoutFileName = "layout.json"
+
+// ErrInvalidHash is returned for content hashes that cannot name an object
+var ErrInvalidHash = errors.New("invalid content hash")
+
+// Layout describes how object paths fan out into subdirectories: Depth
+// directory levels, each named by the next Width characters of the hash.
+// The default 2/2 layout stores abcdef... at ab/cd/ef...
+type Layout struct {
+	Version int `json:"version"`
+	Depth   int `json:"depth"`
+	Width   int `json:"width"`
+}
+
+// DefaultLayout returns the layout used by stores created without WithLayout,
+// which is also the layout of stores that predate layout versioning
+func DefaultLayout() Layout {
+	return Layout{Version: LayoutVersion, Depth: 2, Width: 2}
+}
+
+// ParseLayout parses a "depth/width" layout description such as "2/2"
+func ParseLayout(s string) (Layout, error) {
+	layout := Layout{Version: LayoutVersion}
+	if _, err := fmt.Sscanf(s, "%d/%d", &layout.Depth, &layout.Width); err != nil {
+		return Layout{}, fmt.Errorf("invalid layout %q, want depth/width such as 2/2", s)
+	}
+	if err := layout.Validate(); err != nil {
+		return Layout{}, err
+	}
+	return layout, nil
+}
+
+// Validate checks that the layout is usable
+func (l Layout) Validate() error {
+	if l.Depth < 0 || l.Depth > 8 {
+		return fmt.Errorf("layout depth must be between 0 and 8, got %d", l.Depth)
+	}
+	if l.Depth > 0 && (l.Width < 1 || l.Width > 8) {
+		return fmt.Errorf("layout width must be between 1 and 8, got %d", l.Width)
+	}
+	return nil
+}
+
+func (l Layout) String() string {
+	return fmt.Sprintf("v%d depth=%d width=%d", l.Version, l.Depth, l.Width)
+}
+
+// prefixLen is how many hash characters are consumed by directory names
+func (l Layout) prefixLen() int {
+	return l.Depth * l.Width
+}
+
+// path returns the object path for a hash relative to the store directory
+func (l Layout) path(contentHash string) (string, error) {
+	if err := l.validHash(contentHash); err != nil {
+		return "", err
+	}
+
+	parts := make([]string, 0, l.Depth+1)
+	for i := 0; i < l.Depth; i++ {
+		parts = append(parts, contentHash[i*l.Width:(i+1)*l.Width])
+	}
+	parts = append(parts, contentHash[l.prefixLen():])
+	return filepath.Join(parts...), nil
+}
+
+// validHash rejects hashes that are too short for the fan-out or that
+// contain anything but letters and digits, so a hash can never escape the
+// store directory
+func (l Layout) validHash(contentHash string) error {
+	if len(contentHash) <= l.prefixLen() {
+		return fmt.Errorf("%w: %q is too short", ErrInvalidHash, contentHash)
+	}
+	for _, c := range contentHash {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+			return fmt.Errorf("%w: %q contains %q", ErrInvalidHash, contentHash, c)
+		}
+	}
+	return nil
+}
+
+// WithLayout sets the path layout used when creating a new store. An existing
+// store keeps the layout recorded in it; opening it with a different layout
+// fails so that objects are never looked up in the wrong place.
+func WithLayout(layout Layout) Option {
+	return func(s *Store) {
+		s.layout = layout
+		s.layoutSet = true
+	}
+}
+
+// Layout returns the path layout of the store
+func (s *Store) Layout() Layout {
+	return s.layout
+}
+
+// loadLayout reads the layout recorded in the store, recording one if the
+// store has none yet. Unversioned stores that already hold objects use the
+// default layout, which is the only one that existed before versioning.
+func (s *Store) loadLayout() error {
+	if s.layoutSet {
+		s.layout.Version = LayoutVersion
+		if err := s.layout.Validate(); err != nil {
+			return err
+		}
+	}
+
+	path := filepath.Join(s.baseDir, layoutFileName)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var recorded Layout
+		if err := json.Unmarshal(data, &recorded); err != nil {
+			return fmt.Errorf("failed to parse store layout: %w", err)
+		}
+		if recorded.Version > LayoutVersion {
+			return fmt.Errorf("store layout version %d is newer than supported version %d", recorded.Version, LayoutVersion)
+		}
+		if err := recorded.Validate(); err != nil {
+			return fmt.Errorf("invalid store layout: %w", err)
+		}
+		if s.layoutSet && !s.layout.sameShape(recorded) {
+			return fmt.Errorf("store uses layout %s, not %s; migrate the store to change it", recorded, s.layout)
+		}
+		s.layout = recorded
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read store layout: %w", err)
+	}
+
+	if !s.layoutSet {
+		s.layout = DefaultLayout()
+	}
+	empty, err := s.isEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty && !s.layout.sameShape(DefaultLayout()) {
+		return fmt.Errorf("existing store uses layout %s, not %s; migrate the store to change it", DefaultLayout(), s.layout)
+	}
+
+	data, err = json.MarshalIndent(s.layout, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode store layout: %w", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to record store layout: %w", err)
+	}
+	return nil
+}
+
+func (l Layout) sameShape(other Layout) bool {
+	if l.Depth == 0 && other.Depth == 0 {
+		return true
+	}
+	return l.Depth == other.Depth && l.Width == other.Width
+}
+
+// isEmpty reports whether the store directory holds anything besides the
+// temp directory and hidden files
+func (s *Store) isEmpty() (bool, error) {
+	entries, err := os.ReadDir(s.baseDir)
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if filepath.Join(s.baseDir, e.Name()) != s.tempDir && !strings.HasPrefix(e.Name(), ".") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLayout_Path(t *testing.T) {
+	hash := "abcdef123456"
+	tests := []struct {
+		layout Layout
+		want   string
+	}{
+		{Layout{Depth: 2, Width: 2}, filepath.Join("ab", "cd", "ef123456")},
+		{Layout{Depth: 3, Width: 1}, filepath.Join("a", "b", "c", "def123456")},
+		{Layout{Depth: 1, Width: 3}, filepath.Join("abc", "def123456")},
+		{Layout{Depth: 0}, hash},
+	}
+	for _, tt := range tests {
+		got, err := tt.layout.path(hash)
+		if err != nil {
+			t.Errorf("path() with %v failed: %v", tt.layout, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("path() with %v = %v, want %v", tt.layout, got, tt.want)
+		}
+	}
+}
+
+func TestLayout_InvalidHash(t *testing.T) {
+	layout := DefaultLayout()
+	for _, hash := range []string{"", "abcd", "ab/cd/../../x", "abcd.ef"} {
+		if _, err := layout.path(hash); !errors.Is(err, ErrInvalidHash) {
+			t.Errorf("path(%q) error = %v, want %v", hash, err, ErrInvalidHash)
+		}
+	}
+}
+
+func TestStore_InvalidHashDoesNotPanic(t *testing.T) {
+	store, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	if err := store.Store("abc", strings.NewReader("x")); !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("Store() error = %v, want %v", err, ErrInvalidHash)
+	}
+	if store.Exists("abc") {
+		t.Error("Exists() = true for an invalid hash")
+	}
+	if _, err := store.Load("ab"); !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("Load() error = %v, want %v", err, ErrInvalidHash)
+	}
+}
+
+func TestStore_LayoutRecorded(t *testing.T) {
+	baseDir, err := os.MkdirTemp("", "store-layout-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	layout := Layout{Depth: 3, Width: 1}
+	store, err := NewStore(baseDir, WithLayout(layout))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	if err := store.Store("abcdef123", strings.NewReader("content")); err != nil {
+		t.Fatalf("Failed to store content: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(baseDir, "a", "b", "c", "def123")); err != nil {
+		t.Errorf("Object not at layout path: %v", err)
+	}
+
+	// Reopening without options picks up the recorded layout
+	reopened, err := NewStore(baseDir)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	if got := reopened.Layout(); got.Depth != 3 || got.Width != 1 || got.Version != LayoutVersion {
+		t.Errorf("Layout() = %v, want depth 3 width 1 version %d", got, LayoutVersion)
+	}
+	if !reopened.Exists("abcdef123") {
+		t.Error("Object not found after reopening")
+	}
+
+	// Reopening with a different layout is refused
+	if _, err := NewStore(baseDir, WithLayout(DefaultLayout())); err == nil {
+		t.Error("Expected error opening store with a different layout")
+	}
+
+	// The layout file is not an object
+	hashes, err := reopened.Hashes()
+	if err != nil {
+		t.Fatalf("Failed to list hashes: %v", err)
+	}
+	if len(hashes) != 1 {
+		t.Errorf("Hashes() = %v, want one object", hashes)
+	}
+}
+
+func TestStore_LegacyStoreUsesDefaultLayout(t *testing.T) {
+	baseDir, err := os.MkdirTemp("", "store-legacy-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(baseDir)
+
+	// An object written by a store that predates layout versioning
+	legacy := filepath.Join(baseDir, "ab", "cd", "ef123")
+	if err := os.MkdirAll(filepath.Dir(legacy), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(legacy, []byte("old"), 0644); err != nil {
+		t.Fatalf("Failed to write object: %v", err)
+	}
+
+	if _, err := NewStore(baseDir, WithLayout(Layout{Depth: 1, Width: 4})); err == nil {
+		t.Error("Expected error applying a new layout to a legacy store")
+	}
+
+	store, err := NewStore(baseDir)
+	if err != nil {
+		t.Fatalf("Failed to open legacy store: %v", err)
+	}
+	if !store.Exists("abcdef123") {
+		t.Error("Legacy object not found")
+	}
+}
+
+func TestParseLayout(t *testing.T) {
+	layout, err := ParseLayout("3/2")
+	if err != nil {
+		t.Fatalf("Failed to parse layout: %v", err)
+	}
+	if layout.Depth != 3 || layout.Width != 2 {
+		t.Errorf("ParseLayout() = %v, want depth 3 width 2", layout)
+	}
+	for _, bad := range []string{"", "x/y", "9/1", "2/0"} {
+		if _, err := ParseLayout(bad); err == nil {
+			t.Errorf("ParseLayout(%q) succeeded, want error", bad)
+		}
+	}
+}
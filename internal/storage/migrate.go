@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// migrateJournalName records objects already copied and verified by a
+// migration into a store, so an interrupted migration resumes where it stopped
+const migrateJournalName = ".migrate-journal"
+
+// MigrateResult summarizes a migration between stores
+type MigrateResult struct {
+	Total    int // objects in the source store
+	Copied   int
+	Resumed  int // already migrated by an earlier, interrupted run
+	Failed   int
+	Bytes    int64
+	Errors   []string
+	Complete bool // every source object is present and verified in the destination
+}
+
+// ParseBackend splits a migration target of the form [scheme:]location.
+// Only the local directory backend ("dir", the default) is available.
+func ParseBackend(target string) (string, error) {
+	scheme, location, found := strings.Cut(target, ":")
+	if !found || len(scheme) == 1 { // no scheme, or a Windows drive letter
+		return target, nil
+	}
+	if scheme != "dir" {
+		return "", fmt.Errorf("unsupported storage backend %q (only dir is available)", scheme)
+	}
+	if location == "" {
+		return "", fmt.Errorf("missing directory in %q", target)
+	}
+	return location, nil
+}
+
+// Migrate copies every object from src into dst, verifying each copy against
+// its content hash. Objects recorded in dst's journal by an earlier run are
+// skipped, so re-running after an interruption resumes the migration.
+// progress, if non-nil, is called after each object.
+func Migrate(src, dst *Store, progress func(done, total int)) (MigrateResult, error) {
+	var result MigrateResult
+
+	srcDir, _ := filepath.Abs(src.baseDir)
+	dstDir, _ := filepath.Abs(dst.baseDir)
+	if srcDir == dstDir {
+		return result, fmt.Errorf("source and destination are the same store")
+	}
+
+	hashes, err := src.Hashes()
+	if err != nil {
+		return result, fmt.Errorf("failed to list source objects: %w", err)
+	}
+	result.Total = len(hashes)
+
+	journalPath := filepath.Join(dst.baseDir, migrateJournalName)
+	done, err := readJournal(journalPath)
+	if err != nil {
+		return result, err
+	}
+	journal, err := os.OpenFile(journalPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return result, fmt.Errorf("failed to open migration journal: %w", err)
+	}
+	defer journal.Close()
+
+	for i, hash := range hashes {
+		if done[hash] && dst.Exists(hash) {
+			result.Resumed++
+		} else if err := migrateObject(src, dst, hash); err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", hash, err))
+		} else {
+			if _, err := fmt.Fprintln(journal, hash); err != nil {
+				return result, fmt.Errorf("failed to update migration journal: %w", err)
+			}
+			size, _ := dst.Size(hash)
+			result.Copied++
+			result.Bytes += size
+		}
+		if progress != nil {
+			progress(i+1, len(hashes))
+		}
+	}
+
+	result.Complete = result.Failed == 0
+	return result, nil
+}
+
+// migrateObject copies one object and verifies the copy, removing it again
+// if it does not match its hash
+func migrateObject(src, dst *Store, hash string) error {
+	srcPath, err := src.hashToPath(hash)
+	if err != nil {
+		return err
+	}
+	// Read straight from disk; objects in the cache may not be complete copies
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open source object: %w", err)
+	}
+	defer file.Close()
+
+	if err := dst.Store(hash, file); err != nil {
+		return err
+	}
+	if _, err := dst.Verify(hash, 0); err != nil {
+		dst.Delete(hash)
+		return err
+	}
+	return nil
+}
+
+func readJournal(path string) (map[string]bool, error) {
+	done := make(map[string]bool)
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migration journal: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if hash := strings.TrimSpace(scanner.Text()); hash != "" {
+			done[hash] = true
+		}
+	}
+	return done, scanner.Err()
+}
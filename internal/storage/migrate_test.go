@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"p2p-storage/internal/crypto"
+)
+
+func storeContent(t *testing.T, store *Store, contents ...string) []string {
+	var hashes []string
+	for _, content := range contents {
+		hash, err := crypto.ContentHash(strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("Failed to hash content: %v", err)
+		}
+		if err := store.Store(hash, strings.NewReader(content)); err != nil {
+			t.Fatalf("Failed to store content: %v", err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func TestMigrate(t *testing.T) {
+	src, _, cleanup := setupTestStore(t)
+	defer cleanup()
+	dstDir := migrateTarget(t)
+	defer os.RemoveAll(dstDir)
+
+	hashes := storeContent(t, src, "one", "two", "three")
+
+	dst, err := NewStore(dstDir, WithLayout(Layout{Depth: 1, Width: 3}))
+	if err != nil {
+		t.Fatalf("Failed to create destination store: %v", err)
+	}
+
+	var calls int
+	result, err := Migrate(src, dst, func(done, total int) { calls++ })
+	if err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+	if result.Copied != 3 || !result.Complete {
+		t.Errorf("Migrate() = %+v, want 3 copied and complete", result)
+	}
+	if calls != 3 {
+		t.Errorf("progress called %d times, want %d", calls, 3)
+	}
+
+	for _, hash := range hashes {
+		if _, err := os.Stat(filepath.Join(dstDir, hash[:3], hash[3:])); err != nil {
+			t.Errorf("Object %s not at destination layout path: %v", hash, err)
+		}
+		reader, err := dst.Load(hash)
+		if err != nil {
+			t.Fatalf("Failed to load migrated object: %v", err)
+		}
+		data, _ := io.ReadAll(reader)
+		reader.Close()
+		if got, _ := crypto.ContentHash(strings.NewReader(string(data))); got != hash {
+			t.Errorf("Migrated object %s hashes to %s", hash, got)
+		}
+	}
+
+	// The journal is not listed as an object
+	listed, err := dst.Hashes()
+	if err != nil {
+		t.Fatalf("Failed to list destination: %v", err)
+	}
+	if len(listed) != 3 {
+		t.Errorf("Destination lists %d objects, want %d", len(listed), 3)
+	}
+}
+
+func TestMigrate_Resume(t *testing.T) {
+	src, _, cleanup := setupTestStore(t)
+	defer cleanup()
+	dstDir := migrateTarget(t)
+	defer os.RemoveAll(dstDir)
+
+	storeContent(t, src, "one", "two")
+
+	dst, err := NewStore(dstDir)
+	if err != nil {
+		t.Fatalf("Failed to create destination store: %v", err)
+	}
+	if _, err := Migrate(src, dst, nil); err != nil {
+		t.Fatalf("Failed to migrate: %v", err)
+	}
+
+	// Objects added after the first run are copied by the next one
+	storeContent(t, src, "three")
+	result, err := Migrate(src, dst, nil)
+	if err != nil {
+		t.Fatalf("Failed to resume migration: %v", err)
+	}
+	if result.Resumed != 2 || result.Copied != 1 {
+		t.Errorf("Resumed migration = %+v, want 2 resumed, 1 copied", result)
+	}
+}
+
+func TestMigrate_SameStore(t *testing.T) {
+	store, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	if _, err := Migrate(store, store, nil); err == nil {
+		t.Error("Expected error migrating a store onto itself")
+	}
+}
+
+func TestParseBackend(t *testing.T) {
+	if dir, err := ParseBackend("dir:/mnt/big"); err != nil || dir != "/mnt/big" {
+		t.Errorf("ParseBackend(dir:) = %v, %v", dir, err)
+	}
+	if dir, err := ParseBackend("/mnt/big"); err != nil || dir != "/mnt/big" {
+		t.Errorf("ParseBackend(path) = %v, %v", dir, err)
+	}
+	if _, err := ParseBackend("s3:bucket"); err == nil {
+		t.Error("Expected error for unsupported backend")
+	}
+}
+
+func migrateTarget(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "store-migrate-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	return dir
+}
@@ -1,22 +1,79 @@
 package storage
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
 // Store manages the content-addressable storage
 type Store struct {
 	baseDir string
 	tempDir string
+	cache   *blockCache
+	layout  Layout
 	mu      sync.RWMutex
+
+	layoutSet bool // layout was chosen with WithLayout
+	// admit decides whether a loaded object may enter the cache; nil admits all
+	admit func(contentHash string) bool
+	// score ranks cached objects for eviction; nil evicts by recency alone
+	score func(contentHash string) float64
+
+	// scratchDir holds the files handed out by CreateTemp; tempDir unless
+	// WithScratchDir moves them
+	scratchDir string
+}
+
+// Option configures a Store
+type Option func(*Store)
+
+// WithCacheSize enables an in-memory LRU cache of up to size bytes for
+// recently loaded objects. Zero disables the cache.
+func WithCacheSize(size int64) Option {
+	return func(s *Store) {
+		if size > 0 {
+			s.cache = newBlockCache(size)
+		} else {
+			s.cache = nil
+		}
+	}
+}
+
+// WithCacheAdmission sets a policy deciding which loaded objects are worth
+// keeping in the cache. By default every object small enough is cached.
+func WithCacheAdmission(admit func(contentHash string) bool) Option {
+	return func(s *Store) {
+		s.admit = admit
+	}
+}
+
+// WithCacheEviction has the cache evict the lowest-scoring of its least
+// recently used objects rather than strictly the least recently used one,
+// so content that is popular overall outlasts a burst of other reads
+func WithCacheEviction(score func(contentHash string) float64) Option {
+	return func(s *Store) {
+		s.score = score
+	}
+}
+
+// WithScratchDir puts the temporary files of in-progress transfers and
+// ingests under dir instead of the store's temp directory, for example on
+// a larger or faster volume. Objects are still staged in the store's own
+// temp directory so they can be moved into place atomically.
+func WithScratchDir(dir string) Option {
+	return func(s *Store) {
+		s.scratchDir = dir
+	}
 }
 
 // NewStore creates a new storage instance
-func NewStore(baseDir string) (*Store, error) {
+func NewStore(baseDir string, opts ...Option) (*Store, error) {
 	// Create base directory if it doesn't exist
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		return nil, err
@@ -28,14 +85,35 @@ func NewStore(baseDir string) (*Store, error) {
 		return nil, err
 	}
 
-	return &Store{
+	s := &Store{
 		baseDir: baseDir,
 		tempDir: tempDir,
-	}, nil
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.cache != nil {
+		s.cache.score = s.score
+	}
+	if s.scratchDir == "" {
+		s.scratchDir = tempDir
+	} else if err := CheckWritable(s.scratchDir); err != nil {
+		return nil, fmt.Errorf("scratch directory is not usable: %w", err)
+	}
+	if err := s.loadLayout(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
 // Store stores a file in the content-addressable storage
 func (s *Store) Store(contentHash string, r io.Reader) error {
+	hashPath, err := s.hashToPath(contentHash)
+	if err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -55,7 +133,6 @@ func (s *Store) Store(contentHash string, r io.Reader) error {
 	tempFile.Close()
 
 	// Create hash directory structure
-	hashPath := s.hashToPath(contentHash)
 	if err := os.MkdirAll(filepath.Dir(hashPath), 0755); err != nil {
 		return fmt.Errorf("failed to create hash directory: %w", err)
 	}
@@ -65,38 +142,94 @@ func (s *Store) Store(contentHash string, r io.Reader) error {
 		return fmt.Errorf("failed to move file to final location: %w", err)
 	}
 
+	if s.cache != nil {
+		s.cache.remove(contentHash)
+	}
+
 	return nil
 }
 
 // Load retrieves a file from storage by its content hash
 func (s *Store) Load(contentHash string) (io.ReadCloser, error) {
+	hashPath, err := s.hashToPath(contentHash)
+	if err != nil {
+		return nil, err
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	hashPath := s.hashToPath(contentHash)
+	if s.cache != nil {
+		if data, ok := s.cache.get(contentHash); ok {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+
 	file, err := os.Open(hashPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
 
+	if s.cache != nil && (s.admit == nil || s.admit(contentHash)) {
+		if info, err := file.Stat(); err == nil && info.Size() <= s.cache.maxEntry() {
+			data, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read file: %w", err)
+			}
+			s.cache.add(contentHash, data)
+			return io.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+
 	return file, nil
 }
 
 // Exists checks if a file exists in storage
 func (s *Store) Exists(contentHash string) bool {
+	hashPath, err := s.hashToPath(contentHash)
+	if err != nil {
+		return false
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	_, err := os.Stat(s.hashToPath(contentHash))
+	_, err = os.Stat(hashPath)
 	return err == nil
 }
 
+// Size returns the stored size in bytes of a file
+func (s *Store) Size(contentHash string) (int64, error) {
+	hashPath, err := s.hashToPath(contentHash)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info, err := os.Stat(hashPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+	return info.Size(), nil
+}
+
 // Delete removes a file from storage
 func (s *Store) Delete(contentHash string) error {
+	hashPath, err := s.hashToPath(contentHash)
+	if err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	hashPath := s.hashToPath(contentHash)
+	if s.cache != nil {
+		s.cache.remove(contentHash)
+	}
+
 	if err := os.Remove(hashPath); err != nil {
 		return fmt.Errorf("failed to delete file: %w", err)
 	}
@@ -113,44 +246,145 @@ func (s *Store) Delete(contentHash string) error {
 	return nil
 }
 
-// hashToPath converts a content hash to a file path
-func (s *Store) hashToPath(contentHash string) string {
-	// Use first 4 characters as directory names for better distribution
-	// Example: abc123... -> base/ab/c1/23...
-	return filepath.Join(
-		s.baseDir,
-		contentHash[0:2],
-		contentHash[2:4],
-		contentHash[4:],
-	)
+// hashToPath converts a content hash to a file path according to the
+// store's layout, e.g. abc123... -> base/ab/c1/23... for the default layout
+func (s *Store) hashToPath(contentHash string) (string, error) {
+	rel, err := s.layout.path(contentHash)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.baseDir, rel), nil
 }
 
-// CreateTemp creates a temporary file for in-progress operations
+// CreateTemp creates a temporary file for in-progress operations in the
+// scratch directory
 func (s *Store) CreateTemp() (*os.File, error) {
-	return os.CreateTemp(s.tempDir, "transfer-*")
+	return os.CreateTemp(s.scratchDir, "transfer-*")
+}
+
+// ScratchDir returns the directory holding the files from CreateTemp
+func (s *Store) ScratchDir() string {
+	return s.scratchDir
+}
+
+// tempDirs returns the directories holding temporary files
+func (s *Store) tempDirs() []string {
+	if s.scratchDir == s.tempDir {
+		return []string{s.tempDir}
+	}
+	return []string{s.tempDir, s.scratchDir}
 }
 
 // CleanTemp removes all temporary files
 func (s *Store) CleanTemp() error {
-	dir, err := os.Open(s.tempDir)
-	if err != nil {
-		return err
+	for _, tempDir := range s.tempDirs() {
+		dir, err := os.Open(tempDir)
+		if err != nil {
+			return err
+		}
+		names, err := dir.Readdirnames(-1)
+		dir.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			err := os.Remove(filepath.Join(tempDir, name))
+			if err != nil {
+				fmt.Printf("Failed to remove temp file %s: %v\n", name, err)
+			}
+		}
 	}
-	defer dir.Close()
 
-	names, err := dir.Readdirnames(-1)
+	return nil
+}
+
+// CheckWritable creates dir if needed and verifies that files can be
+// written in it
+func CheckWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	probe, err := os.CreateTemp(dir, ".probe-*")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(probe.Name())
+	if _, err := probe.Write([]byte{0}); err != nil {
+		probe.Close()
+		return err
+	}
+	return probe.Close()
+}
 
-	for _, name := range names {
-		err := os.Remove(filepath.Join(s.tempDir, name))
+// CleanStaleTemp removes temporary files not modified for at least age,
+// which are left over from interrupted operations; files still being
+// written are kept. It returns the number of files and bytes removed.
+func (s *Store) CleanStaleTemp(age time.Duration) (int, int64, error) {
+	cutoff := time.Now().Add(-age)
+	removed, size := 0, int64(0)
+	for _, tempDir := range s.tempDirs() {
+		entries, err := os.ReadDir(tempDir)
 		if err != nil {
-			fmt.Printf("Failed to remove temp file %s: %v\n", name, err)
+			return removed, size, err
+		}
+
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || info.IsDir() || info.ModTime().After(cutoff) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(tempDir, entry.Name())); err != nil {
+				fmt.Printf("Failed to remove temp file %s: %v\n", entry.Name(), err)
+				continue
+			}
+			removed++
+			size += info.Size()
 		}
 	}
+	return removed, size, nil
+}
 
-	return nil
+// CacheStats returns statistics for the in-memory object cache. All fields
+// are zero when the cache is disabled.
+func (s *Store) CacheStats() CacheStats {
+	if s.cache == nil {
+		return CacheStats{}
+	}
+	return s.cache.stats()
+}
+
+// Stats summarizes the contents of the store
+type Stats struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Stats returns the number of stored files and their total size
+func (s *Store) Stats() (Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var stats Stats
+	err := filepath.Walk(s.baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == s.tempDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if s.isMetadata(path) {
+			return nil
+		}
+		stats.Files++
+		stats.Bytes += info.Size()
+		return nil
+	})
+
+	return stats, err
 }
 
 // List returns a list of all content hashes in storage
@@ -163,7 +397,7 @@ func (s *Store) List() ([]string, error) {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() && filepath.Dir(path) != s.tempDir {
+		if !info.IsDir() && filepath.Dir(path) != s.tempDir && !s.isMetadata(path) {
 			relPath, err := filepath.Rel(s.baseDir, path)
 			if err != nil {
 				return err
@@ -179,3 +413,13 @@ func (s *Store) List() ([]string, error) {
 
 	return hashes, err
 }
+
+// isMetadata reports whether path is one of the store's own bookkeeping
+// files: the layout record or a hidden file at the top level
+func (s *Store) isMetadata(path string) bool {
+	if filepath.Dir(path) != s.baseDir {
+		return false
+	}
+	name := filepath.Base(path)
+	return name == layoutFileName || strings.HasPrefix(name, ".")
+}
@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func setupTestStore(t *testing.T) (*Store, string, func()) {
@@ -134,3 +135,145 @@ func TestStore_List(t *testing.T) {
 		}
 	}
 }
+
+func TestStore_Size(t *testing.T) {
+	store, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	contentHash := "sizehash123"
+	if err := store.Store(contentHash, strings.NewReader("twelve bytes")); err != nil {
+		t.Fatalf("Failed to store content: %v", err)
+	}
+
+	size, err := store.Size(contentHash)
+	if err != nil {
+		t.Fatalf("Failed to get size: %v", err)
+	}
+	if size != 12 {
+		t.Errorf("Size = %v, want %v", size, 12)
+	}
+
+	if _, err := store.Size("missing12345"); err == nil {
+		t.Error("Expected error for missing file, got nil")
+	}
+}
+
+func TestStore_Stats(t *testing.T) {
+	store, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	for hash, content := range map[string]string{
+		"abc123456789": "12345",
+		"def123456789": "1234567890",
+	} {
+		if err := store.Store(hash, strings.NewReader(content)); err != nil {
+			t.Fatalf("Failed to store content for hash %s: %v", hash, err)
+		}
+	}
+
+	// In-progress temp files are not counted
+	temp, err := store.CreateTemp()
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	temp.WriteString("partial")
+	temp.Close()
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("Failed to get stats: %v", err)
+	}
+	if stats.Files != 2 {
+		t.Errorf("Files = %v, want %v", stats.Files, 2)
+	}
+	if stats.Bytes != 15 {
+		t.Errorf("Bytes = %v, want %v", stats.Bytes, 15)
+	}
+}
+
+func TestStore_CleanStaleTemp(t *testing.T) {
+	store, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	stale, err := store.CreateTemp()
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	stale.WriteString("abandoned")
+	stale.Close()
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(stale.Name(), old, old); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+
+	active, err := store.CreateTemp()
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	active.WriteString("in progress")
+	active.Close()
+
+	files, size, err := store.CleanStaleTemp(time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to clean temp files: %v", err)
+	}
+	if files != 1 || size != int64(len("abandoned")) {
+		t.Errorf("CleanStaleTemp() = %d, %d, want 1, %d", files, size, len("abandoned"))
+	}
+	if _, err := os.Stat(stale.Name()); !os.IsNotExist(err) {
+		t.Error("Stale temp file was not removed")
+	}
+	if _, err := os.Stat(active.Name()); err != nil {
+		t.Errorf("Active temp file was removed: %v", err)
+	}
+}
+
+func TestStore_ScratchDir(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "store-test-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	scratch := filepath.Join(tmpDir, "scratch")
+	store, err := NewStore(filepath.Join(tmpDir, "store"), WithScratchDir(scratch))
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+
+	temp, err := store.CreateTemp()
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	temp.WriteString("in flight")
+	if filepath.Dir(temp.Name()) != scratch {
+		t.Errorf("CreateTemp() = %s, want a file in %s", temp.Name(), scratch)
+	}
+
+	// Objects are still written through the store's own temp directory
+	temp.Seek(0, io.SeekStart)
+	if err := store.Store("scratchhash123", temp); err != nil {
+		t.Fatalf("Failed to store file: %v", err)
+	}
+	temp.Close()
+	if !store.Exists("scratchhash123") {
+		t.Error("Stored object does not exist")
+	}
+
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(temp.Name(), old, old); err != nil {
+		t.Fatalf("Failed to set modification time: %v", err)
+	}
+	if files, _, err := store.CleanStaleTemp(time.Hour); err != nil || files != 1 {
+		t.Errorf("CleanStaleTemp() = %d, %v, want 1, nil", files, err)
+	}
+
+	// A scratch path that can't be a directory is refused at startup
+	blocker := filepath.Join(tmpDir, "file")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if _, err := NewStore(filepath.Join(tmpDir, "other"), WithScratchDir(filepath.Join(blocker, "scratch"))); err == nil {
+		t.Error("NewStore() with an unusable scratch directory succeeded, want error")
+	}
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"p2p-storage/internal/crypto"
+)
+
+// ErrCorrupt is returned when a stored object no longer matches its content hash
+var ErrCorrupt = errors.New("stored content does not match its hash")
+
+// Verify re-reads an object from disk (bypassing the cache) and checks that
+// it still hashes to its content hash. bytesPerSecond paces the read so
+// background verification doesn't saturate disk I/O; zero means unpaced.
+func (s *Store) Verify(contentHash string, bytesPerSecond int64) (int64, error) {
+	hashPath, err := s.hashToPath(contentHash)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.RLock()
+	file, err := os.Open(hashPath)
+	s.mu.RUnlock()
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	reader := &pacedReader{r: file, bytesPerSecond: bytesPerSecond, start: time.Now()}
+	hash, err := crypto.ContentHash(reader)
+	if err != nil {
+		return reader.read, err
+	}
+
+	if hash != contentHash {
+		return reader.read, fmt.Errorf("%w: %s hashes to %s", ErrCorrupt, contentHash, hash)
+	}
+	return reader.read, nil
+}
+
+// Hashes returns the content hashes of all stored objects
+func (s *Store) Hashes() ([]string, error) {
+	paths, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([]string, len(paths))
+	for i, p := range paths {
+		hashes[i] = strings.ReplaceAll(p, "/", "")
+	}
+	return hashes, nil
+}
+
+// pacedReader throttles reads to roughly bytesPerSecond
+type pacedReader struct {
+	r              io.Reader
+	bytesPerSecond int64
+	start          time.Time
+	read           int64
+}
+
+func (p *pacedReader) Read(b []byte) (int, error) {
+	if p.bytesPerSecond > 0 && int64(len(b)) > p.bytesPerSecond {
+		b = b[:p.bytesPerSecond]
+	}
+
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+
+	if p.bytesPerSecond > 0 {
+		expected := time.Duration(float64(p.read) / float64(p.bytesPerSecond) * float64(time.Second))
+		if wait := expected - time.Since(p.start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-storage/internal/crypto"
+)
+
+func TestStore_Verify(t *testing.T) {
+	store, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	content := "verified content"
+	hash, err := crypto.ContentHash(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Failed to hash content: %v", err)
+	}
+	if err := store.Store(hash, strings.NewReader(content)); err != nil {
+		t.Fatalf("Failed to store content: %v", err)
+	}
+
+	read, err := store.Verify(hash, 0)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if read != int64(len(content)) {
+		t.Errorf("Verify() read = %v, want %v", read, len(content))
+	}
+
+	// Flip the content on disk behind the store's back
+	path, err := store.hashToPath(hash)
+	if err != nil {
+		t.Fatalf("Failed to resolve path: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("tampered"), 0644); err != nil {
+		t.Fatalf("Failed to tamper with file: %v", err)
+	}
+	if _, err := store.Verify(hash, 0); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("Verify() error = %v, want %v", err, ErrCorrupt)
+	}
+}
+
+func TestStore_Hashes(t *testing.T) {
+	store, _, cleanup := setupTestStore(t)
+	defer cleanup()
+
+	if err := store.Store("abc123456789", strings.NewReader("content")); err != nil {
+		t.Fatalf("Failed to store content: %v", err)
+	}
+
+	hashes, err := store.Hashes()
+	if err != nil {
+		t.Fatalf("Failed to list hashes: %v", err)
+	}
+	if len(hashes) != 1 || hashes[0] != "abc123456789" {
+		t.Errorf("Hashes() = %v, want [abc123456789]", hashes)
+	}
+}
+
+func TestPacedReader(t *testing.T) {
+	reader := &pacedReader{
+		r:              strings.NewReader(strings.Repeat("x", 200)),
+		bytesPerSecond: 1000,
+		start:          time.Now(),
+	}
+
+	buf := make([]byte, 64)
+	for {
+		if _, err := reader.Read(buf); err != nil {
+			break
+		}
+	}
+
+	// 200 bytes at 1000 B/s should take roughly 200ms
+	if elapsed := time.Since(reader.start); elapsed < 150*time.Millisecond {
+		t.Errorf("Read finished in %v, expected pacing to slow it down", elapsed)
+	}
+}